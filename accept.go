@@ -1,19 +1,37 @@
 package websocket
 
 import (
-	"context"
 	"crypto/sha1"
 	"encoding/base64"
 	"net/http"
 	"strings"
-	"sync"
 )
 
 // AcceptHTTP handles a WebSocket HTTP request from the net/http client. It may return
 // an error if the HTTP request is not a WebSocket connection, the WebSocket
 // version is not supported, the Sec-WebSocket-Key is not provided, or hijacking
-// the underlying connection fails.
-func AcceptHTTP(w http.ResponseWriter, r *http.Request) (*Conn, Error) {
+// the underlying connection fails. The Conn is configured with the options
+// specified, if any.
+//
+// Headers already set on w are sent with the handshake response, such as
+// Sec-WebSocket-Protocol with the subprotocol selected from the ones the
+// client offered, which AcceptHTTP does not select itself.
+//
+// The requests accepted and rejected, and the accepted connections once
+// they are closed, are counted in AcceptHTTPStats.
+func AcceptHTTP(w http.ResponseWriter, r *http.Request, opts ...Option) (*Conn, Error) {
+	conn, err := acceptHTTP(w, r, opts...)
+	if err != nil {
+		acceptStats.rejected.Add(1)
+		return nil, err
+	}
+	acceptStats.accepted.Add(1)
+	conn.accepted = true
+	return conn, nil
+}
+
+// acceptHTTP accepts the WebSocket request, see AcceptHTTP.
+func acceptHTTP(w http.ResponseWriter, r *http.Request, opts ...Option) (*Conn, Error) {
 	// verify request is for a WebSocket connection and get the Sec-Websocket-Key
 	// https://developer.mozilla.org/en-US/docs/Web/API/WebSockets_API/Writing_WebSocket_servers#client_handshake_request
 	upgrade := r.Header.Get("Upgrade")
@@ -33,16 +51,20 @@ func AcceptHTTP(w http.ResponseWriter, r *http.Request) (*Conn, Error) {
 		return nil, errorf(KEY_NOT_PROVIDED)
 	}
 
-	// developing the Sec-WebSocket-Accept key
-	// https://developer.mozilla.org/en-US/docs/Web/API/WebSockets_API/Writing_WebSocket_servers#server_handshake_response
-	concatenatedKey := strings.TrimSpace(key) + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
-	hashedCKey := sha1.Sum([]byte(concatenatedKey))
-	acceptKey := base64.StdEncoding.EncodeToString(hashedCKey[:])
+	// the options are applied before responding, since compression is
+	// negotiated in the response
+	conn := newConn(opts)
+	if o := conn.compressionOptions; o != nil && !conn.lowMemory {
+		if params, response, ok := o.acceptOffer(r.Header); ok {
+			w.Header().Set("Sec-WebSocket-Extensions", response)
+			conn.compression = &params
+		}
+	}
 
 	// set the server WebSocket Handshake Response headers
 	w.Header().Set("Upgrade", "websocket")
 	w.Header().Set("Connection", "Upgrade")
-	w.Header().Set("Sec-WebSocket-Accept", acceptKey)
+	w.Header().Set("Sec-WebSocket-Accept", acceptKey(key))
 	w.WriteHeader(101)
 
 	// now that the handshake is done, we now have a WebSocket connection expected
@@ -51,11 +73,24 @@ func AcceptHTTP(w http.ResponseWriter, r *http.Request) (*Conn, Error) {
 		return nil, errorf(HTTP_HIJACKING_FAILED)
 	}
 
-	conn, _, err := hijacker.Hijack()
+	nc, brw, err := hijacker.Hijack()
 	if err != nil {
-		return nil, errorf(HTTP_HIJACKING_FAILED)
+		return nil, wrapError(HTTP_HIJACKING_FAILED, err)
+	}
+	// the 101 response is sent before hijacking, so the server may have
+	// read the first frames of the client already
+	if brw.Reader.Buffered() > 0 {
+		nc = &bufferedConn{Conn: nc, r: brw.Reader}
 	}
 
-	ctx, cancel := context.WithCancel(context.Background())
-	return &Conn{underlying: conn, rmx: sync.Mutex{}, wmx: sync.Mutex{}, ctx: ctx, cancel: cancel, closed: false}, nil
+	return conn.attach(nc), nil
+}
+
+// acceptKey returns the Sec-WebSocket-Accept key for the Sec-WebSocket-Key
+// specified.
+// https://developer.mozilla.org/en-US/docs/Web/API/WebSockets_API/Writing_WebSocket_servers#server_handshake_response
+func acceptKey(key string) string {
+	concatenatedKey := strings.TrimSpace(key) + "258EAFA5-E914-47DA-95CA-C5AB0DC85B11"
+	hashedCKey := sha1.Sum([]byte(concatenatedKey))
+	return base64.StdEncoding.EncodeToString(hashedCKey[:])
 }
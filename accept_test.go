@@ -6,7 +6,9 @@ import (
 	"net/http"
 	"net/http/httptest"
 	"testing"
-	"websocket"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
 )
 
 type MockResponseWriterNoHijack struct {
@@ -109,3 +111,40 @@ func TestAcceptHTTPHijackingFailed(t *testing.T) {
 		t.Fatal("expected error due to hijacking failure, got none")
 	}
 }
+
+func TestAcceptHTTP_FramesWithRequest(t *testing.T) {
+	received := make(chan *websocket.Message, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.AcceptHTTP(w, r)
+		if err != nil {
+			t.Errorf("expected no error from AcceptHTTP(), got %v", err)
+			return
+		}
+		defer conn.Close()
+		msg, _ := conn.Read()
+		received <- msg
+	}))
+	defer srv.Close()
+
+	nc, err := net.Dial("tcp", srv.Listener.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer nc.Close()
+	// the frame is sent with the request, so the server reads it with the
+	// request, before the connection is hijacked
+	request := "GET / HTTP/1.1\r\nHost: localhost\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n" +
+		"Sec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n"
+	frame := encodeFrames(t, textMessage("hello"), websocket.RoleClient)
+	if _, err := nc.Write(append([]byte(request), frame...)); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case msg := <-received:
+		if msg == nil || string(msg.Data) != "hello" {
+			t.Fatalf("expected the frame sent with the request to be read, got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the frame sent with the request to be read")
+	}
+}
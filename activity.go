@@ -0,0 +1,61 @@
+package websocket
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Activity holds when a connection last saw traffic, returned by
+// Conn.LastActivity. A zero time means that it never happened.
+type Activity struct {
+	// LastRead is when the last frame was read, of any type, including
+	// the frames discarded by Drain.
+	LastRead time.Time
+	// LastMessage is when the last data message was read, once its last
+	// fragment was read.
+	LastMessage time.Time
+	// LastWrite is when the last message was written to the underlying
+	// connection or to the write buffer.
+	LastWrite time.Time
+	// LastPong is when the last pong was read, whether it answered a ping
+	// or not.
+	LastPong time.Time
+}
+
+// Latest returns the latest of LastRead and LastWrite, when the connection
+// last saw traffic in either direction.
+func (a Activity) Latest() time.Time {
+	if a.LastWrite.After(a.LastRead) {
+		return a.LastWrite
+	}
+	return a.LastRead
+}
+
+// connActivity are the times behind Activity, in Unix nanoseconds, or 0
+// if it never happened.
+type connActivity struct {
+	lastRead    atomic.Int64
+	lastMessage atomic.Int64
+	lastWrite   atomic.Int64
+	lastPong    atomic.Int64
+}
+
+// LastActivity returns when the connection last saw traffic. It may be
+// called at any time, including after the connection is closed, and the
+// times are recorded for every connection, since recording them is cheap.
+func (c *Conn) LastActivity() Activity {
+	a := &c.activity
+	return Activity{
+		LastRead:    activityTime(&a.lastRead),
+		LastMessage: activityTime(&a.lastMessage),
+		LastWrite:   activityTime(&a.lastWrite),
+		LastPong:    activityTime(&a.lastPong),
+	}
+}
+
+func activityTime(t *atomic.Int64) time.Time {
+	if n := t.Load(); n != 0 {
+		return time.Unix(0, n)
+	}
+	return time.Time{}
+}
@@ -0,0 +1,77 @@
+package websocket_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+func TestLastActivity(t *testing.T) {
+	clk := clock.NewFake()
+	client, server := websocket.Pipe(websocket.WithClock(clk))
+	defer client.Close()
+	defer server.Close()
+	if a := server.LastActivity(); a != (websocket.Activity{}) {
+		t.Fatalf("expected no activity before any traffic, got %+v", a)
+	}
+
+	clk.Advance(time.Second)
+	start := clk.Now()
+	go client.WriteText("hello")
+	if _, err := server.Read(); err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	// the write is recorded once it returns, after the server read it
+	waitFor(t, time.Second, func() bool { return client.LastActivity().LastWrite.Equal(start) })
+	expected := websocket.Activity{LastRead: start, LastMessage: start}
+	if a := server.LastActivity(); !activityEqual(a, expected) {
+		t.Fatalf("expected the server to have read a message at %v, got %+v", start, a)
+	}
+	if a := server.LastActivity(); !a.Latest().Equal(start) {
+		t.Fatalf("expected the latest activity to be %v, got %v", start, a.Latest())
+	}
+
+	// a ping is read, but is not a data message, and its pong is written
+	clk.Advance(time.Second)
+	pinged := clk.Now()
+	go client.Write(&websocket.Message{Type: websocket.MessagePing, Data: []byte("p")})
+	go server.Read()
+	if msg, err := client.Read(); err != nil || msg.Type != websocket.MessagePong {
+		t.Fatalf("expected to read a pong, got %v and %v", msg, err)
+	}
+	waitFor(t, time.Second, func() bool { return server.LastActivity().LastWrite.Equal(pinged) })
+	expected = websocket.Activity{LastRead: pinged, LastMessage: start, LastWrite: pinged}
+	if a := server.LastActivity(); !activityEqual(a, expected) {
+		t.Fatalf("expected the server activity to be %+v, got %+v", expected, a)
+	}
+	expected = websocket.Activity{LastRead: pinged, LastWrite: pinged, LastPong: pinged}
+	waitFor(t, time.Second, func() bool { return activityEqual(client.LastActivity(), expected) })
+}
+
+func TestLastActivity_Errors(t *testing.T) {
+	clk := clock.NewFake()
+	mockConn := new(FailingConn)
+	mockConn.fail.Store(true)
+	conn := websocket.From(mockConn, websocket.WithClock(clk))
+	defer conn.Close()
+
+	// writes fail, and reads reach the end of the connection
+	clk.Advance(time.Second)
+	if err := conn.WriteText("hello"); !errors.Is(err, websocket.ErrWrite) {
+		t.Fatalf("expected a CONNECTION_WRITE_ERROR error, got %v", err)
+	}
+	if _, err := conn.Read(); err == nil {
+		t.Fatalf("expected reading past the end of the connection to fail")
+	}
+	if a := conn.LastActivity(); a != (websocket.Activity{}) {
+		t.Fatalf("expected no activity after failed operations, got %+v", a)
+	}
+}
+
+func activityEqual(a, b websocket.Activity) bool {
+	return a.LastRead.Equal(b.LastRead) && a.LastMessage.Equal(b.LastMessage) &&
+		a.LastWrite.Equal(b.LastWrite) && a.LastPong.Equal(b.LastPong)
+}
@@ -2,9 +2,12 @@ package websocket_test
 
 import (
 	"net/http"
+	"runtime"
+	"strings"
 	"testing"
-	"websocket"
 	// coder "github.com/coder/websocket"
+
+	"github.com/tiredkangaroo/websocket"
 )
 
 var conn = new(MockResponseWriterHijack)
@@ -60,6 +63,15 @@ func BenchmarkWrite(b *testing.B) {
 	}
 }
 
+func BenchmarkWriteText(b *testing.B) {
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if err := wsconn.WriteText("hello world"); err != nil {
+			b.Fatalf(err.Error())
+		}
+	}
+}
+
 // func BenchmarkCoderWrite(b *testing.B) {
 // 	ctx := context.Background()
 // 	for i := 0; i < b.N; i++ {
@@ -91,3 +103,205 @@ func BenchmarkWriteLarge(b *testing.B) {
 // 		}
 // 	}
 // }
+
+// burst is the amount of small messages written per tick in the burst benchmarks.
+const burst = 32
+
+func BenchmarkWriteBurst(b *testing.B) {
+	mockConn := &CountingConn{discard: true}
+	burstConn := websocket.From(mockConn)
+	message := &websocket.Message{Type: websocket.MessageText, Data: []byte("tick")}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for range burst {
+			burstConn.Write(message)
+		}
+	}
+	b.ReportMetric(float64(mockConn.Writes())/float64(b.N), "writes/op")
+}
+
+func BenchmarkWriteBurstBuffered(b *testing.B) {
+	mockConn := &CountingConn{discard: true}
+	burstConn := websocket.From(mockConn)
+	burstConn.SetWriteBuffer(4096)
+	message := &websocket.Message{Type: websocket.MessageText, Data: []byte("tick")}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		for range burst {
+			burstConn.Write(message)
+		}
+		burstConn.Flush()
+	}
+	b.ReportMetric(float64(mockConn.Writes())/float64(b.N), "writes/op")
+}
+
+// frameLoop is a connection that reads the same frames over and over, and
+// discards what is written to it.
+type frameLoop struct {
+	frames []byte
+	off    int
+}
+
+func (l *frameLoop) Read(p []byte) (int, error) {
+	n := copy(p, l.frames[l.off:])
+	l.off = (l.off + n) % len(l.frames)
+	return n, nil
+}
+
+func (l *frameLoop) Write(p []byte) (int, error) {
+	return len(p), nil
+}
+
+func (l *frameLoop) Close() error {
+	return nil
+}
+
+// encodeFrames returns the frames of msg written by a Conn with role.
+func encodeFrames(tb testing.TB, msg *websocket.Message, role websocket.Role) []byte {
+	tb.Helper()
+	mockConn := &CountingConn{}
+	if err := websocket.From(mockConn, websocket.WithRole(role)).Write(msg); err != nil {
+		tb.Fatal(err.Error())
+	}
+	return mockConn.buf.Bytes()
+}
+
+func BenchmarkRead(b *testing.B) {
+	for _, size := range []struct {
+		name string
+		data string
+	}{
+		{"Small", "hello world"},
+		{"Large", loremIpsum},
+		{"64KiB", strings.Repeat("x", 64<<10)},
+	} {
+		for _, role := range []struct {
+			name string
+			role websocket.Role
+		}{
+			{"Unmasked", websocket.RoleServer},
+			{"Masked", websocket.RoleClient},
+		} {
+			frames := encodeFrames(b, &websocket.Message{Type: websocket.MessageText, Data: []byte(size.data)}, role.role)
+			for _, reuse := range []bool{false, true} {
+				name := size.name + "/" + role.name
+				if reuse {
+					name += "/Reuse"
+				}
+				b.Run(name, func(b *testing.B) {
+					readConn := websocket.From(&frameLoop{frames: frames}, websocket.WithReadBufferReuse(reuse))
+					b.SetBytes(int64(len(size.data)))
+					b.ReportAllocs()
+					for i := 0; i < b.N; i++ {
+						if _, err := readConn.Read(); err != nil {
+							b.Fatal(err.Error())
+						}
+					}
+				})
+			}
+		}
+	}
+}
+
+// BenchmarkCompressionIdle measures the memory a connection keeps for
+// compression once it has exchanged a message each way and is idle, in
+// idle-B/conn, with and without context takeover.
+func BenchmarkCompressionIdle(b *testing.B) {
+	for name, opts := range map[string]websocket.CompressionOptions{
+		"ContextTakeover":   {},
+		"NoContextTakeover": {ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+	} {
+		b.Run(name, func(b *testing.B) {
+			data := []byte(loremIpsum)
+			conns := make([]*websocket.Conn, 0, 2*b.N)
+			var before, after runtime.MemStats
+			runtime.GC()
+			runtime.ReadMemStats(&before)
+			for i := 0; i < b.N; i++ {
+				client, server := websocket.Pipe(websocket.WithCompression(opts))
+				for _, c := range [][2]*websocket.Conn{{client, server}, {server, client}} {
+					compressed, _ := websocket.Deflate(c[0], nil, data)
+					if _, err := websocket.Inflate(c[1], nil, compressed); err != nil {
+						b.Fatal(err.Error())
+					}
+				}
+				conns = append(conns, client, server)
+			}
+			b.StopTimer()
+			runtime.GC()
+			runtime.ReadMemStats(&after)
+			b.ReportMetric(float64(int64(after.HeapAlloc)-int64(before.HeapAlloc))/float64(len(conns)), "idle-B/conn")
+			runtime.KeepAlive(conns)
+			for _, c := range conns {
+				c.Close()
+			}
+		})
+	}
+}
+
+// compressionBenchmarks are the compression settings the compressed write
+// and read benchmarks compare, where nil is no compression.
+var compressionBenchmarks = []struct {
+	name   string
+	params *websocket.CompressionParams
+}{
+	{"Uncompressed", nil},
+	{"ContextTakeover", &websocket.CompressionParams{ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}},
+	{"NoContextTakeover", &websocket.CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true, ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}},
+}
+
+// compressionOptions returns the options of a Conn with the compression
+// parameters specified as if they were negotiated.
+func compressionOptions(params *websocket.CompressionParams) []websocket.Option {
+	if params == nil {
+		return nil
+	}
+	return []websocket.Option{websocket.WithNegotiatedCompression(*params)}
+}
+
+// BenchmarkWriteCompressed measures writing the loremIpsum payload with and
+// without compression, with the bytes written to the wire in wire-B/op.
+func BenchmarkWriteCompressed(b *testing.B) {
+	for _, bm := range compressionBenchmarks {
+		b.Run(bm.name, func(b *testing.B) {
+			conn := websocket.From(&CountingConn{discard: true}, compressionOptions(bm.params)...)
+			msg := &websocket.Message{Type: websocket.MessageText, Data: []byte(loremIpsum)}
+			b.SetBytes(int64(len(loremIpsum)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if err := conn.Write(msg); err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+			b.ReportMetric(float64(conn.Stats().BytesWritten)/float64(b.N), "wire-B/op")
+		})
+	}
+}
+
+// BenchmarkReadCompressed measures reading the loremIpsum payload with and
+// without compression. The frames are read over and over, so they are
+// compressed without context takeover, which the reader does not need to
+// know about.
+func BenchmarkReadCompressed(b *testing.B) {
+	noTakeover := compressionBenchmarks[2].params
+	for _, bm := range []struct {
+		name   string
+		params *websocket.CompressionParams
+	}{{"Uncompressed", nil}, {"Compressed", noTakeover}} {
+		mockConn := &CountingConn{}
+		if err := websocket.From(mockConn, compressionOptions(bm.params)...).WriteText(loremIpsum); err != nil {
+			b.Fatal(err.Error())
+		}
+		frames := mockConn.buf.Bytes()
+		b.Run(bm.name, func(b *testing.B) {
+			readConn := websocket.From(&frameLoop{frames: frames}, append(compressionOptions(bm.params), websocket.WithReadBufferReuse(true))...)
+			b.SetBytes(int64(len(loremIpsum)))
+			b.ReportAllocs()
+			for i := 0; i < b.N; i++ {
+				if _, err := readConn.Read(); err != nil {
+					b.Fatal(err.Error())
+				}
+			}
+		})
+	}
+}
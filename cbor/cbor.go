@@ -0,0 +1,72 @@
+// Package cbor provides a websocket.Codec for CBOR (RFC 8949), and an
+// ArrayWriter that streams large arrays. It is a separate module so that
+// the websocket package does not depend on github.com/fxamacker/cbor.
+package cbor
+
+import (
+	"io"
+
+	fxcbor "github.com/fxamacker/cbor/v2"
+	"github.com/tiredkangaroo/websocket"
+)
+
+// Codec is a websocket.Codec that encodes values as CBOR and sends them in
+// binary messages. Values are encoded the same way encoding/json would
+// encode them, following the same struct tags, so types used with
+// websocket.JSONCodec can be used with Codec as they are.
+type Codec struct{}
+
+var _ websocket.Codec = Codec{}
+
+func (Codec) Marshal(v any) ([]byte, websocket.MessageType, error) {
+	data, err := fxcbor.Marshal(v)
+	return data, websocket.MessageBinary, err
+}
+
+func (Codec) Unmarshal(data []byte, _ websocket.MessageType, v any) error {
+	return fxcbor.Unmarshal(data, v)
+}
+
+// ArrayWriter writes a CBOR array of indefinite length in a single binary
+// message, encoding its elements one at a time as they are passed to
+// Encode, and sending them as the message's frames fill (see
+// websocket.Conn.NextWriter), so that a large array is never held whole.
+// The peer decodes the message like any other with Codec, into a slice of
+// the elements' type. It is created by NewArrayWriter.
+//
+// No other data message may be written to the connection until the
+// ArrayWriter is closed.
+type ArrayWriter struct {
+	w   io.WriteCloser
+	enc *fxcbor.Encoder
+}
+
+// NewArrayWriter starts a message with an array written by the ArrayWriter
+// returned on conn.
+func NewArrayWriter(conn *websocket.Conn) (*ArrayWriter, error) {
+	w, err := conn.NextWriter(websocket.MessageBinary)
+	if err != nil {
+		return nil, err
+	}
+	a := &ArrayWriter{w: w, enc: fxcbor.NewEncoder(w)}
+	if err := a.enc.StartIndefiniteArray(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+// Encode appends v to the array. A value that cannot be encoded is not
+// appended, and the error is returned. An error writing the message, such
+// as a MESSAGE_TOO_LARGE error once the array outgrows the write limit, is
+// returned by every call from then on.
+func (a *ArrayWriter) Encode(v any) error {
+	return a.enc.Encode(v)
+}
+
+// Close ends the array and the message.
+func (a *ArrayWriter) Close() error {
+	if err := a.enc.EndIndefinite(); err != nil {
+		return err
+	}
+	return a.w.Close()
+}
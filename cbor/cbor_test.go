@@ -0,0 +1,129 @@
+package cbor_test
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/cbor"
+)
+
+// pipe returns two connected Conns, a client and a server.
+func pipe() (*websocket.Conn, *websocket.Conn) {
+	return websocket.Pipe()
+}
+
+type reading struct {
+	Sensor string    `json:"sensor"`
+	Values []float64 `json:"values"`
+	OK     bool      `json:"ok"`
+}
+
+var sample = reading{Sensor: "temperature-1", Values: []float64{21.5, 21.75, 22}, OK: true}
+
+func TestCodec(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	go conn.WriteVia(cbor.Codec{}, &sample)
+
+	var received reading
+	if err := peer.ReadVia(cbor.Codec{}, &received); err != nil {
+		t.Fatalf("expected no error from ReadVia(), got %v", err)
+	}
+	if !reflect.DeepEqual(received, sample) {
+		t.Fatalf("expected %v, got %v", sample, received)
+	}
+}
+
+func TestCodec_MessageType(t *testing.T) {
+	_, messageType, err := cbor.Codec{}.Marshal(&sample)
+	if err != nil {
+		t.Fatalf("expected no error from Marshal(), got %v", err)
+	}
+	if messageType != websocket.MessageBinary {
+		t.Fatalf("expected MessageBinary, got %v", messageType)
+	}
+}
+
+func TestCodec_Malformed(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	go conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: []byte{0xff, 0xff}})
+	var received reading
+	if err := peer.ReadVia(cbor.Codec{}, &received); !errors.Is(err, websocket.ErrCodec) {
+		t.Fatalf("expected CODEC_ERROR error, got %v", err)
+	}
+}
+
+func TestArrayWriter(t *testing.T) {
+	conn, peer := websocket.Pipe(websocket.WithWriteFragmentSize(64))
+	defer conn.Close()
+	defer peer.Close()
+
+	sent := make([]reading, 100)
+	for i := range sent {
+		sent[i] = reading{Sensor: fmt.Sprintf("sensor-%d", i), Values: []float64{float64(i)}, OK: i%2 == 0}
+	}
+	errs := make(chan error, 1)
+	go func() {
+		a, err := cbor.NewArrayWriter(conn)
+		if err != nil {
+			errs <- err
+			return
+		}
+		for _, r := range sent {
+			if err := a.Encode(&r); err != nil {
+				errs <- err
+				return
+			}
+		}
+		if err := a.Encode(make(chan int)); err == nil {
+			errs <- errors.New("expected an error encoding a channel")
+			return
+		}
+		errs <- a.Close()
+	}()
+
+	var received []reading
+	if err := peer.ReadVia(cbor.Codec{}, &received); err != nil {
+		t.Fatalf("expected no error from ReadVia(), got %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("expected no error writing the array, got %v", err)
+	}
+	if !reflect.DeepEqual(received, sent) {
+		t.Fatalf("expected %v, got %v", sent, received)
+	}
+	if stats := conn.Stats(); stats.MessagesWritten.Binary != 1 || stats.FramesWritten < 2 {
+		t.Fatalf("expected the array to be written in one message of several frames, got %d messages and %d frames", stats.MessagesWritten.Binary, stats.FramesWritten)
+	}
+}
+
+// benchmarkSize encodes sample with codec and reports the size of the
+// encoding.
+func benchmarkSize(b *testing.B, codec websocket.Codec) {
+	b.ReportAllocs()
+	var size int
+	for range b.N {
+		data, _, err := codec.Marshal(&sample)
+		if err != nil {
+			b.Fatal(err)
+		}
+		size = len(data)
+	}
+	b.ReportMetric(float64(size), "bytes/msg")
+}
+
+func BenchmarkSize_CBOR(b *testing.B) {
+	benchmarkSize(b, cbor.Codec{})
+}
+
+func BenchmarkSize_JSON(b *testing.B) {
+	benchmarkSize(b, websocket.JSONCodec{})
+}
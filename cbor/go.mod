@@ -0,0 +1,12 @@
+module github.com/tiredkangaroo/websocket/cbor
+
+go 1.22.5
+
+require (
+	github.com/fxamacker/cbor/v2 v2.7.0
+	github.com/tiredkangaroo/websocket v0.0.0
+)
+
+require github.com/x448/float16 v0.8.4 // indirect
+
+replace github.com/tiredkangaroo/websocket => ../
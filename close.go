@@ -0,0 +1,234 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"slices"
+	"unicode/utf8"
+)
+
+// Close codes defined by RFC 6455 and the IANA WebSocket Close Code Number
+// Registry.
+const (
+	CloseNormalClosure           = 1000
+	CloseGoingAway               = 1001
+	CloseProtocolError           = 1002
+	CloseUnsupportedData         = 1003
+	CloseNoStatusReceived        = 1005 // reported when a close frame has no code, never sent
+	CloseAbnormalClosure         = 1006 // reported when the connection is lost without a close frame, never sent
+	CloseInvalidFramePayloadData = 1007
+	ClosePolicyViolation         = 1008
+	CloseMessageTooBig           = 1009
+	CloseMandatoryExtension      = 1010
+	CloseInternalServerErr       = 1011
+	CloseServiceRestart          = 1012
+	CloseTryAgainLater           = 1013
+	CloseBadGateway              = 1014
+	CloseTLSHandshake            = 1015 // reported when the TLS handshake fails, never sent
+
+	// CloseRegisteredMin is the first close code of the range registered
+	// with IANA for libraries, frameworks, and applications (3000-3999).
+	CloseRegisteredMin = 3000
+	// ClosePrivateMin is the first close code of the range for private
+	// use (4000-4999).
+	ClosePrivateMin = 4000
+	// ClosePrivateMax is the last close code of the range for private use.
+	ClosePrivateMax = 4999
+)
+
+// maxCloseReasonLength is the maximum length of the reason of a close frame,
+// which leaves room for the two byte close code in a control frame payload.
+const maxCloseReasonLength = maxControlPayloadLength - 2
+
+// validCloseCode reports whether code may be sent in a close frame. The same
+// codes are accepted in close frames received from the peer.
+func validCloseCode(code int) bool {
+	switch {
+	case code >= CloseNormalClosure && code <= CloseUnsupportedData:
+		return true
+	case code >= CloseInvalidFramePayloadData && code <= CloseBadGateway:
+		return true
+	case code >= CloseRegisteredMin && code <= ClosePrivateMax:
+		return true
+	}
+	return false
+}
+
+// FormatCloseMessage returns the payload of a close frame with the code and
+// text specified. If code is CloseNoStatusReceived, the payload is empty. Text
+// longer than the 123 bytes that fit in a close frame is cut short at the
+// last whole UTF-8 character that fits.
+func FormatCloseMessage(code int, text string) []byte {
+	if code == CloseNoStatusReceived {
+		return []byte{}
+	}
+	if len(text) > maxCloseReasonLength {
+		n := maxCloseReasonLength
+		for n > 0 && !utf8.RuneStart(text[n]) {
+			n--
+		}
+		text = text[:n]
+	}
+	payload := binary.BigEndian.AppendUint16(make([]byte, 0, 2+len(text)), uint16(code))
+	return append(payload, text...)
+}
+
+// parseCloseMessage parses the payload of a close frame. A payload without a
+// code is reported as CloseNoStatusReceived. The code and the reason are
+// only checked if strict is set.
+func parseCloseMessage(payload []byte, strict bool) (*CloseError, Error) {
+	switch {
+	case len(payload) == 0:
+		return &CloseError{Code: CloseNoStatusReceived}, nil
+	case len(payload) == 1:
+		return nil, errorf(MALFORMED_FRAME, "close frame payload is 1 byte")
+	}
+	code := int(binary.BigEndian.Uint16(payload))
+	if strict && !validCloseCode(code) {
+		return nil, errorf(MALFORMED_FRAME, fmt.Sprintf("close code %d is not allowed", code))
+	}
+	if strict && !utf8.Valid(payload[2:]) {
+		return nil, errorf(MALFORMED_FRAME, "close reason is not valid utf-8")
+	}
+	return &CloseError{Code: code, Reason: string(payload[2:])}, nil
+}
+
+// CloseError describes how the peer closed the connection. It is wrapped
+// by the CONNECTION_CLOSED error returned by Read once the peer has sent a
+// close frame, or once the underlying connection ended without one, in
+// which case Code is 1006 (abnormal closure). Use errors.As to retrieve it.
+type CloseError struct {
+	// Code is the close code sent by the peer. It is 1005 (no status
+	// received) if the close frame did not contain a code.
+	Code int
+	// Reason is the reason sent by the peer, if any.
+	Reason string
+}
+
+func (e *CloseError) Error() string {
+	if e.Reason == "" {
+		return fmt.Sprintf("closed with code %d", e.Code)
+	}
+	return fmt.Sprintf("closed with code %d: %s", e.Code, e.Reason)
+}
+
+// IsCloseError reports whether err wraps a *CloseError with one of the
+// codes specified.
+func IsCloseError(err error, codes ...int) bool {
+	var ce *CloseError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	return slices.Contains(codes, ce.Code)
+}
+
+// IsUnexpectedCloseError reports whether err wraps a *CloseError with a
+// code that is not one of the expected codes specified. It returns false
+// for errors that are not close errors.
+func IsUnexpectedCloseError(err error, expectedCodes ...int) bool {
+	var ce *CloseError
+	if !errors.As(err, &ce) {
+		return false
+	}
+	return !slices.Contains(expectedCodes, ce.Code)
+}
+
+// readError returns the error for an error reading from the underlying
+// connection. If the connection is being closed, such as by Close while
+// Read was blocked, it is a CONNECTION_CLOSED error. If the connection
+// ended, it is reported as an abnormal closure. consumed reports whether
+// part of the frame being read was read already. The connection is closed,
+// since the rest of that frame is lost, unless the error is a timeout
+// before any of the frame was read, after which reading can resume.
+func (c *Conn) readError(e error, consumed bool) Error {
+	if c.err.Load() != nil { // the connection was closed while reading
+		return c.closedError()
+	}
+	var err Error
+	if errors.Is(e, io.EOF) || errors.Is(e, io.ErrUnexpectedEOF) {
+		err = wrapError(CONNECTION_CLOSED, &CloseError{Code: CloseAbnormalClosure})
+	} else {
+		err = errorf(CONNECTION_READ_ERROR, e)
+	}
+	if consumed || !isTimeout(e) {
+		c.fail(err)
+	}
+	return err
+}
+
+// CloseWithCode writes a close frame with the code and reason specified,
+// then closes the connection. Writing the close frame is a best effort: it
+// is given up on after one second if the underlying connection supports
+// write deadlines, and the connection is closed either way.
+//
+// The code must be one that may be sent (CloseNormalClosure through
+// CloseBadGateway excluding the codes that are never sent, or a code from
+// CloseRegisteredMin to ClosePrivateMax), otherwise an INVALID_CLOSE_CODE
+// error is returned. The reason may be at most 123 bytes long, otherwise a
+// CONTROL_PAYLOAD_TOO_LONG error is returned. The connection is left open
+// if an error is returned for either.
+func (c *Conn) CloseWithCode(code int, reason string) error {
+	if !validCloseCode(code) {
+		return errorf(INVALID_CLOSE_CODE, code)
+	}
+	if len(reason) > maxCloseReasonLength {
+		return errorf(CONTROL_PAYLOAD_TOO_LONG, 2+len(reason))
+	}
+	return c.closeWithCode(code, reason)
+}
+
+// WriteClose writes a close frame with the code and reason specified
+// without closing the connection, starting a closing handshake: the
+// connection is closed once Read (or Drain) receives the peer's close
+// frame, so that the messages the peer sent before it can still be read.
+// Nothing but the peer's close frame should be expected after that, since
+// the peer may close the underlying connection as soon as it responds, and
+// nothing more can be written: Write returns a CONNECTION_CLOSED error, and
+// pings are not answered.
+//
+// The code and reason are checked like by CloseWithCode, and the
+// connection is left open if an error is returned.
+func (c *Conn) WriteClose(code int, reason string) error {
+	if !validCloseCode(code) {
+		return errorf(INVALID_CLOSE_CODE, code)
+	}
+	if len(reason) > maxCloseReasonLength {
+		return errorf(CONTROL_PAYLOAD_TOO_LONG, 2+len(reason))
+	}
+	if err := c.Write(&Message{Type: MessageClose, Data: FormatCloseMessage(code, reason)}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// handleClose responds to a close frame with the payload specified by
+// echoing its code and closing the connection, unless a close frame was
+// already written, in which case it only closes the connection. A close
+// frame that is not valid is responded to with CloseProtocolError, and one
+// with a code that may not be sent, which is only accepted without the
+// CloseCodes check, with CloseNormalClosure. It returns the error Read
+// returns for the close frame.
+func (c *Conn) handleClose(payload []byte) Error {
+	ce, err := parseCloseMessage(payload, c.strict.CloseCodes)
+	if err != nil {
+		c.logger.Warn("received a malformed close frame", "error", err.Error())
+		c.setErr(err)
+		c.closeWithCode(CloseProtocolError, "")
+		return err
+	}
+	err = wrapError(CONNECTION_CLOSED, ce)
+	c.setErr(err)
+	if c.closeSent.Load() { // this completes a closing handshake started here
+		c.Close()
+		return err
+	}
+	c.setState(StateClosingRemote)
+	code := ce.Code
+	if code != CloseNoStatusReceived && !validCloseCode(code) {
+		code = CloseNormalClosure
+	}
+	c.closeWithCode(code, "")
+	return err
+}
@@ -0,0 +1,287 @@
+package websocket_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strings"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+func closePayload(code uint16, reason string) []byte {
+	return append(binary.BigEndian.AppendUint16(nil, code), reason...)
+}
+
+func TestRead_CloseError(t *testing.T) {
+	server, client := pipe()
+	defer client.Close()
+
+	// the peer reads the close frame echoed back while the server reads
+	echoed := make(chan websocket.Error)
+	go func() {
+		client.Write(&websocket.Message{Type: websocket.MessageClose, Data: closePayload(1001, "going away")})
+		_, err := client.Read()
+		echoed <- err
+	}()
+
+	_, err := server.Read()
+	if !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected a connection closed error, got %v", err)
+	}
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		t.Fatalf("expected a CloseError, got %v", err)
+	}
+	if ce.Code != 1001 || ce.Reason != "going away" {
+		t.Fatalf("expected code 1001 with reason \"going away\", got %d %q", ce.Code, ce.Reason)
+	}
+
+	if rerr := <-echoed; !websocket.IsCloseError(rerr, 1001) {
+		t.Fatalf("expected the peer to receive code 1001, got %v", rerr)
+	}
+
+	select {
+	case <-server.Context().Done():
+	default:
+		t.Fatalf("expected the connection to be closed")
+	}
+	if _, err := server.Read(); err == nil || err.Kind() != websocket.CONNECTION_CLOSED {
+		t.Fatalf("expected CONNECTION_CLOSED error, got %v", err)
+	}
+}
+
+func TestRead_CloseErrorNoStatus(t *testing.T) {
+	server, client := pipe()
+	defer client.Close()
+
+	go func() {
+		client.Write(&websocket.Message{Type: websocket.MessageClose})
+		client.Read()
+	}()
+
+	_, err := server.Read()
+	if !websocket.IsCloseError(err, 1005) {
+		t.Fatalf("expected close code 1005, got %v", err)
+	}
+}
+
+func TestRead_AbnormalClosure(t *testing.T) {
+	server, client := pipe()
+	client.Close()
+
+	_, err := server.Read()
+	if !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected a connection closed error, got %v", err)
+	}
+	if !websocket.IsCloseError(err, 1006) {
+		t.Fatalf("expected close code 1006, got %v", err)
+	}
+	if !websocket.IsUnexpectedCloseError(err, 1000, 1001) {
+		t.Fatalf("expected an abnormal closure to be unexpected")
+	}
+}
+
+func TestIsCloseError(t *testing.T) {
+	err := fmt.Errorf("reading: %w", &websocket.CloseError{Code: 1000})
+	if !websocket.IsCloseError(err, 1001, 1000) {
+		t.Fatalf("expected IsCloseError() to match code 1000")
+	}
+	if websocket.IsCloseError(err, 1001) {
+		t.Fatalf("expected IsCloseError() not to match code 1001")
+	}
+	if websocket.IsUnexpectedCloseError(err, 1000) {
+		t.Fatalf("expected code 1000 not to be unexpected")
+	}
+	if !websocket.IsUnexpectedCloseError(err, 1001) {
+		t.Fatalf("expected code 1000 to be unexpected")
+	}
+
+	// errors that are not close errors never match
+	other := errors.New("not a close error")
+	if websocket.IsCloseError(other, 1000) || websocket.IsUnexpectedCloseError(other) {
+		t.Fatalf("expected a non-close error not to match")
+	}
+	if websocket.IsCloseError(websocket.ErrConnectionClosed, 1000) {
+		t.Fatalf("expected CONNECTION_CLOSED without a CloseError not to match")
+	}
+}
+
+func TestFormatCloseMessage_RoundTrip(t *testing.T) {
+	sendable := []int{
+		websocket.CloseNormalClosure,
+		websocket.CloseGoingAway,
+		websocket.CloseProtocolError,
+		websocket.CloseUnsupportedData,
+		websocket.CloseInvalidFramePayloadData,
+		websocket.ClosePolicyViolation,
+		websocket.CloseMessageTooBig,
+		websocket.CloseMandatoryExtension,
+		websocket.CloseInternalServerErr,
+		websocket.CloseServiceRestart,
+		websocket.CloseTryAgainLater,
+		websocket.CloseBadGateway,
+		websocket.CloseRegisteredMin,
+		websocket.ClosePrivateMin,
+		websocket.ClosePrivateMax,
+	}
+	for _, code := range sendable {
+		ce, err := websocket.ParseCloseMessage(websocket.FormatCloseMessage(code, "reason"))
+		if err != nil {
+			t.Fatalf("expected no error parsing close code %d, got %v", code, err)
+		}
+		if ce.Code != code || ce.Reason != "reason" {
+			t.Fatalf("expected code %d with reason \"reason\", got %d %q", code, ce.Code, ce.Reason)
+		}
+	}
+
+	// a close frame without a code is reported as CloseNoStatusReceived
+	ce, err := websocket.ParseCloseMessage(websocket.FormatCloseMessage(websocket.CloseNoStatusReceived, ""))
+	if err != nil || ce.Code != websocket.CloseNoStatusReceived {
+		t.Fatalf("expected code %d, got %v %v", websocket.CloseNoStatusReceived, ce, err)
+	}
+
+	unsendable := []int{1004, websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake, 999, 2999, 5000}
+	for _, code := range unsendable {
+		_, err := websocket.ParseCloseMessage(websocket.FormatCloseMessage(code, ""))
+		if err == nil || err.Kind() != websocket.MALFORMED_FRAME {
+			t.Fatalf("expected MALFORMED_FRAME error for close code %d, got %v", code, err)
+		}
+	}
+}
+
+func TestFormatCloseMessage_LongText(t *testing.T) {
+	text := strings.Repeat("a", 122) + "é" // the last character does not fit
+	payload := websocket.FormatCloseMessage(websocket.CloseNormalClosure, text)
+	if len(payload) != 124 {
+		t.Fatalf("expected a 124 byte payload, got %d", len(payload))
+	}
+	ce, err := websocket.ParseCloseMessage(payload)
+	if err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+	if ce.Reason != text[:122] {
+		t.Fatalf("expected the reason to be cut short before the last character, got %q", ce.Reason)
+	}
+}
+
+func TestCloseWithCode(t *testing.T) {
+	server, client := pipe()
+	defer client.Close()
+
+	if err := server.CloseWithCode(1006, ""); !errors.Is(err, websocket.ErrInvalidCloseCode) {
+		t.Fatalf("expected INVALID_CLOSE_CODE error, got %v", err)
+	}
+	if err := server.CloseWithCode(websocket.CloseNormalClosure, strings.Repeat("a", 124)); !errors.Is(err, websocket.ErrControlPayloadTooLong) {
+		t.Fatalf("expected CONTROL_PAYLOAD_TOO_LONG error, got %v", err)
+	}
+
+	received := make(chan websocket.Error)
+	go func() {
+		_, err := client.Read()
+		received <- err
+	}()
+	if err := server.CloseWithCode(websocket.CloseGoingAway, "bye"); err != nil {
+		t.Fatalf("expected no error from CloseWithCode(), got %v", err)
+	}
+	err := <-received
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.CloseGoingAway || ce.Reason != "bye" {
+		t.Fatalf("expected the peer to receive code 1001 with reason \"bye\", got %v", err)
+	}
+}
+
+func TestWriteClose(t *testing.T) {
+	server, client := pipe()
+	defer client.Close()
+	defer server.Close()
+
+	if err := server.WriteClose(1006, ""); !errors.Is(err, websocket.ErrInvalidCloseCode) {
+		t.Fatalf("expected INVALID_CLOSE_CODE error, got %v", err)
+	}
+
+	received := make(chan websocket.Error, 1)
+	go func() {
+		_, err := client.Read()
+		received <- err
+	}()
+	if err := server.WriteClose(websocket.CloseGoingAway, "bye"); err != nil {
+		t.Fatalf("expected no error from WriteClose(), got %v", err)
+	}
+	if server.Closed() || server.State() != websocket.StateClosingLocal {
+		t.Fatalf("expected the connection to wait for the peer's close frame, got %v", server.State())
+	}
+
+	if _, err := server.Read(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected the peer to echo the close frame, got %v", err)
+	}
+	if !server.Closed() {
+		t.Fatalf("expected the connection to be closed once the peer's close frame was read")
+	}
+	var ce *websocket.CloseError
+	if err := <-received; !errors.As(err, &ce) || ce.Code != websocket.CloseGoingAway || ce.Reason != "bye" {
+		t.Fatalf("expected the peer to receive code 1001 with reason \"bye\", got %v", err)
+	}
+}
+
+func TestWriteClose_NothingAfter(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := websocket.From(a)
+	defer conn.Close()
+	go io.Copy(io.Discard, b)
+
+	if err := conn.WriteClose(websocket.CloseGoingAway, ""); err != nil {
+		t.Fatalf("expected no error from WriteClose(), got %v", err)
+	}
+	if err := conn.Write(textMessage("late")); !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected CONNECTION_CLOSED error from Write() after the close frame, got %v", err)
+	}
+	if err := conn.WriteText("late"); !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected CONNECTION_CLOSED error from WriteText() after the close frame, got %v", err)
+	}
+	if _, err := conn.NextWriter(websocket.MessageText); !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected CONNECTION_CLOSED error from NextWriter() after the close frame, got %v", err)
+	}
+	if err := conn.WriteClose(websocket.CloseNormalClosure, ""); !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected CONNECTION_CLOSED error from a second WriteClose(), got %v", err)
+	}
+
+	// a ping sent by the peer before it read the close frame is not
+	// answered, and does not end the closing handshake
+	frames := encodeFrames(t, &websocket.Message{Type: websocket.MessagePing, Data: []byte("ping")}, websocket.RoleClient)
+	frames = append(frames, encodeFrames(t, &websocket.Message{Type: websocket.MessageClose, Data: closePayload(websocket.CloseGoingAway, "")}, websocket.RoleClient)...)
+	go b.Write(frames)
+	if msg, err := conn.Read(); err != nil || msg.Type != websocket.MessagePing {
+		t.Fatalf("expected the ping to be read, got %v, %v", msg, err)
+	}
+	if _, err := conn.Read(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected the peer's close frame to end the handshake, got %v", err)
+	}
+	if stats := conn.Stats(); stats.MessagesWritten.Pong != 0 || stats.MessagesWritten.Text != 0 {
+		t.Fatalf("expected nothing but the close frame to be written, got %+v", stats.MessagesWritten)
+	}
+}
+
+func TestRead_InvalidCloseCode(t *testing.T) {
+	client, server := pipe()
+	defer client.Close()
+
+	replied := make(chan websocket.Error)
+	go func() {
+		client.Write(&websocket.Message{Type: websocket.MessageClose, Data: closePayload(1006, "")})
+		_, err := client.Read()
+		replied <- err
+	}()
+
+	_, err := server.Read()
+	if err == nil || err.Kind() != websocket.MALFORMED_FRAME {
+		t.Fatalf("expected MALFORMED_FRAME error, got %v", err)
+	}
+	if err := <-replied; !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+		t.Fatalf("expected the peer to receive code 1002, got %v", err)
+	}
+}
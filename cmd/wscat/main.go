@@ -0,0 +1,242 @@
+// Wscat connects to a WebSocket server, sends every line read from stdin
+// as a message, and prints every message received with its type and the
+// time it was received.
+//
+// Usage:
+//
+//	wscat [flags] url
+//
+// The flags are:
+//
+//	-H "Name: value"
+//		send a header with the handshake; may be repeated
+//	-s subprotocol
+//		offer a subprotocol to the server; may be repeated
+//	-insecure
+//		do not verify the certificate of a wss:// server
+//	-ping interval
+//		ping the server every interval, and give up on it once three
+//		pings in a row are not answered within the interval
+//	-binary
+//		send every line as a binary message of the bytes it encodes in
+//		hexadecimal
+//
+// A line starting with \bin and a space is sent as a binary message of
+// the bytes the rest of the line encodes in hexadecimal, and every other
+// line as a text message, unless -binary is set. Binary messages
+// received are printed in hexadecimal. Once stdin ends, wscat closes the
+// connection with code 1000 and waits for the server to respond.
+//
+// When the connection closes, wscat prints the close code and reason and
+// exits with status 0 if the code is 1000 (normal closure), 1001 (going
+// away), or 1005 (no code), with status 3 for any other code, and with
+// status 1 if the connection failed or ended without a close frame.
+// Invalid flags exit with status 2.
+package main
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// The exit statuses of wscat.
+const (
+	exitOK        = 0
+	exitError     = 1
+	exitUsage     = 2
+	exitCloseCode = 3
+)
+
+// binaryPrefix starts a line sent as a binary message.
+const binaryPrefix = `\bin `
+
+// timeFormat is the format of the time messages are printed with.
+const timeFormat = "15:04:05.000"
+
+func main() {
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt)
+	defer stop()
+	os.Exit(run(ctx, os.Args[1:], os.Stdin, os.Stdout, os.Stderr))
+}
+
+// headerFlag is the value of the -H flag, which may be repeated.
+type headerFlag http.Header
+
+func (h headerFlag) String() string {
+	var b strings.Builder
+	http.Header(h).Write(&b)
+	return strings.TrimSpace(b.String())
+}
+
+func (h headerFlag) Set(s string) error {
+	name, value, ok := strings.Cut(s, ":")
+	if !ok || strings.TrimSpace(name) == "" {
+		return errors.New(`expected "Name: value"`)
+	}
+	http.Header(h).Add(strings.TrimSpace(name), strings.TrimSpace(value))
+	return nil
+}
+
+// listFlag is the value of a flag that may be repeated.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ", ")
+}
+
+func (l *listFlag) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+// run runs wscat with the arguments specified, without the name of the
+// program, and returns its exit status. It returns once the connection
+// ends or ctx is done, in which case the connection is closed with code
+// 1000.
+func run(ctx context.Context, args []string, stdin io.Reader, stdout, stderr io.Writer) int {
+	fs := flag.NewFlagSet("wscat", flag.ContinueOnError)
+	fs.SetOutput(stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(stderr, "usage: wscat [flags] url")
+		fs.PrintDefaults()
+	}
+	header := make(headerFlag)
+	var protocols listFlag
+	fs.Var(header, "H", "send a `header` with the handshake, as \"Name: value\"; may be repeated")
+	fs.Var(&protocols, "s", "offer a `subprotocol` to the server; may be repeated")
+	insecure := fs.Bool("insecure", false, "do not verify the certificate of a wss:// server")
+	ping := fs.Duration("ping", 0, "ping the server every `interval`")
+	binary := fs.Bool("binary", false, "send every line as a binary message of the bytes it encodes in hexadecimal")
+	if err := fs.Parse(args); err != nil {
+		return exitUsage
+	}
+	if fs.NArg() != 1 {
+		fs.Usage()
+		return exitUsage
+	}
+
+	dopts := websocket.DialOptions{Header: http.Header(header), Subprotocols: protocols}
+	if *insecure {
+		dopts.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	}
+	conn, resp, err := websocket.DialWithOptions(ctx, fs.Arg(0), dopts)
+	if err != nil {
+		fmt.Fprintf(stderr, "wscat: %v\n", err)
+		if resp != nil {
+			fmt.Fprintf(stderr, "wscat: the server responded with %s\n", resp.Status)
+		}
+		return exitError
+	}
+	defer conn.Close()
+	fmt.Fprintf(stdout, "connected to %s", fs.Arg(0))
+	if protocol := resp.Header.Get("Sec-WebSocket-Protocol"); protocol != "" {
+		fmt.Fprintf(stdout, " with subprotocol %s", protocol)
+	}
+	fmt.Fprintln(stdout)
+	if *ping > 0 {
+		conn.EnableKeepalive(*ping, *ping, 3)
+	}
+
+	status := make(chan int, 1)
+	go func() { status <- receive(conn, stdout, stderr) }()
+	go send(conn, stdin, *binary, stderr)
+	select {
+	case s := <-status:
+		return s
+	case <-ctx.Done():
+		conn.CloseWithCode(websocket.CloseNormalClosure, "")
+		return exitOK
+	}
+}
+
+// receive prints every message read from conn until it ends, and returns
+// the exit status for how it ended.
+func receive(conn *websocket.Conn, stdout, stderr io.Writer) int {
+	for {
+		msg, err := conn.Read()
+		if err != nil {
+			return closeStatus(err, stdout, stderr)
+		}
+		payload := string(msg.Data)
+		if msg.Type != websocket.MessageText {
+			payload = hex.EncodeToString(msg.Data)
+		}
+		fmt.Fprintf(stdout, "%s < %s %s\n", time.Now().Format(timeFormat), typeName(msg.Type), payload)
+	}
+}
+
+// closeStatus prints how the connection ended with err and returns the
+// exit status for it.
+func closeStatus(err error, stdout, stderr io.Writer) int {
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		fmt.Fprintf(stderr, "wscat: %v\n", err)
+		return exitError
+	}
+	fmt.Fprintf(stdout, "%s closed with code %d", time.Now().Format(timeFormat), ce.Code)
+	if ce.Reason != "" {
+		fmt.Fprintf(stdout, ": %s", ce.Reason)
+	}
+	fmt.Fprintln(stdout)
+	switch ce.Code {
+	case websocket.CloseNormalClosure, websocket.CloseGoingAway, websocket.CloseNoStatusReceived:
+		return exitOK
+	case websocket.CloseAbnormalClosure:
+		return exitError
+	}
+	return exitCloseCode
+}
+
+// send writes every line read from stdin to conn as a message, and starts
+// the closing handshake once stdin ends.
+func send(conn *websocket.Conn, stdin io.Reader, binary bool, stderr io.Writer) {
+	scanner := bufio.NewScanner(stdin)
+	scanner.Buffer(nil, 1<<20)
+	for scanner.Scan() {
+		msg, err := parseLine(scanner.Text(), binary)
+		if err != nil {
+			fmt.Fprintf(stderr, "wscat: %v\n", err)
+			continue
+		}
+		if err := conn.Write(msg); err != nil {
+			fmt.Fprintf(stderr, "wscat: %v\n", err)
+			return
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		fmt.Fprintf(stderr, "wscat: reading stdin: %v\n", err)
+	}
+	conn.WriteClose(websocket.CloseNormalClosure, "")
+}
+
+// parseLine returns the message to send for a line read from stdin.
+func parseLine(line string, binary bool) (*websocket.Message, error) {
+	hexData, ok := strings.CutPrefix(line, binaryPrefix)
+	if !ok && !binary {
+		return &websocket.Message{Type: websocket.MessageText, Data: []byte(line)}, nil
+	}
+	data, err := hex.DecodeString(strings.ReplaceAll(hexData, " ", ""))
+	if err != nil {
+		return nil, fmt.Errorf("a binary message must be hexadecimal: %w", err)
+	}
+	return &websocket.Message{Type: websocket.MessageBinary, Data: data}, nil
+}
+
+// typeName returns the name messages of the type specified are printed
+// with.
+func typeName(t websocket.MessageType) string {
+	return strings.ToLower(strings.TrimPrefix(t.String(), "Message"))
+}
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// lockedBuffer is a bytes.Buffer safe for concurrent use, since wscat
+// writes to stdout and stderr from several goroutines.
+type lockedBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.String()
+}
+
+// startServer starts a server calling handle with every WebSocket
+// connection it accepts, and returns its ws:// URL. The server selects the
+// first subprotocol it is offered, and refuses requests with an X-Token
+// header other than "secret".
+func startServer(t *testing.T, tls bool, handle func(conn *websocket.Conn)) string {
+	t.Helper()
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if token := r.Header.Get("X-Token"); token != "" && token != "secret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if protocol, _, _ := strings.Cut(r.Header.Get("Sec-WebSocket-Protocol"), ","); protocol != "" {
+			w.Header().Set("Sec-WebSocket-Protocol", protocol)
+		}
+		conn, err := websocket.AcceptHTTP(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		handle(conn)
+	})
+	if tls {
+		srv := httptest.NewTLSServer(handler)
+		t.Cleanup(srv.Close)
+		return "wss" + strings.TrimPrefix(srv.URL, "https")
+	}
+	srv := httptest.NewServer(handler)
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// echo echoes every data message read from conn until it ends.
+func echo(conn *websocket.Conn) {
+	for {
+		msg, err := conn.Read()
+		if err != nil {
+			return
+		}
+		if msg.IsData() {
+			conn.Write(msg)
+		}
+	}
+}
+
+// wscat runs wscat with the arguments and stdin specified, and returns
+// its exit status and what it wrote to stdout and stderr.
+func wscat(t *testing.T, stdin io.Reader, args ...string) (int, string, string) {
+	t.Helper()
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	var stdout, stderr lockedBuffer
+	status := run(ctx, args, stdin, &stdout, &stderr)
+	if ctx.Err() != nil {
+		t.Fatalf("expected wscat to exit on its own")
+	}
+	return status, stdout.String(), stderr.String()
+}
+
+// blockingStdin returns a stdin that does not end until the test does.
+func blockingStdin(t *testing.T) io.Reader {
+	r, w := io.Pipe()
+	t.Cleanup(func() { w.Close() })
+	return r
+}
+
+// assertContains fails the test unless every line expected is in output.
+func assertContains(t *testing.T, output string, expected ...string) {
+	t.Helper()
+	for _, s := range expected {
+		if !strings.Contains(output, s) {
+			t.Fatalf("expected the output to contain %q, got:\n%s", s, output)
+		}
+	}
+}
+
+func TestRun(t *testing.T) {
+	url := startServer(t, false, echo)
+	stdin := strings.NewReader("hello\n" + `\bin 01 02 ff` + "\n" + `\bin xyz` + "\nbye\n")
+	status, stdout, stderr := wscat(t, stdin, "-H", "X-Token: secret", "-s", "chat.v2", "-s", "chat.v1", url)
+	if status != exitOK {
+		t.Fatalf("expected status %d, got %d (%s)", exitOK, status, stderr)
+	}
+	assertContains(t, stdout,
+		"connected to "+url+" with subprotocol chat.v2\n",
+		" < text hello\n",
+		" < binary 0102ff\n",
+		" < text bye\n",
+		" closed with code 1000\n",
+	)
+	assertContains(t, stderr, "a binary message must be hexadecimal")
+}
+
+func TestRun_Binary(t *testing.T) {
+	url := startServer(t, false, echo)
+	status, stdout, _ := wscat(t, strings.NewReader("cafe\n"), "-binary", url)
+	if status != exitOK {
+		t.Fatalf("expected status %d, got %d", exitOK, status)
+	}
+	assertContains(t, stdout, " < binary cafe\n")
+}
+
+func TestRun_Close(t *testing.T) {
+	for _, test := range []struct {
+		name   string
+		close  func(conn *websocket.Conn)
+		status int
+		output string
+	}{
+		{"normal", func(conn *websocket.Conn) { conn.CloseWithCode(websocket.CloseGoingAway, "restarting") }, exitOK, " closed with code 1001: restarting\n"},
+		{"code", func(conn *websocket.Conn) { conn.CloseWithCode(4000, "bye") }, exitCloseCode, " closed with code 4000: bye\n"},
+		{"abnormal", func(conn *websocket.Conn) { conn.NetConn().Close() }, exitError, " closed with code 1006\n"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			url := startServer(t, false, test.close)
+			status, stdout, _ := wscat(t, blockingStdin(t), url)
+			if status != test.status {
+				t.Fatalf("expected status %d, got %d", test.status, status)
+			}
+			assertContains(t, stdout, test.output)
+		})
+	}
+}
+
+func TestRun_Errors(t *testing.T) {
+	url := startServer(t, false, echo)
+	for _, test := range []struct {
+		name   string
+		args   []string
+		status int
+		stderr string
+	}{
+		{"no url", nil, exitUsage, "usage: wscat"},
+		{"unknown flag", []string{"-x", url}, exitUsage, "flag provided but not defined"},
+		{"invalid header", []string{"-H", "token", url}, exitUsage, `expected "Name: value"`},
+		{"refused", []string{"-H", "X-Token: wrong", url}, exitError, "403 Forbidden"},
+		{"unreachable", []string{"ws://127.0.0.1:1"}, exitError, "handshake failed"},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			status, _, stderr := wscat(t, strings.NewReader(""), test.args...)
+			if status != test.status {
+				t.Fatalf("expected status %d, got %d (%s)", test.status, status, stderr)
+			}
+			assertContains(t, stderr, test.stderr)
+		})
+	}
+}
+
+func TestRun_Insecure(t *testing.T) {
+	url := startServer(t, true, echo)
+	if status, _, stderr := wscat(t, strings.NewReader("hi\n"), url); status != exitError {
+		t.Fatalf("expected the certificate of the server not to be trusted, got %d (%s)", status, stderr)
+	}
+	status, stdout, stderr := wscat(t, strings.NewReader("hi\n"), "-insecure", url)
+	if status != exitOK {
+		t.Fatalf("expected status %d, got %d (%s)", exitOK, status, stderr)
+	}
+	assertContains(t, stdout, " < text hi\n")
+}
+
+func TestRun_Ping(t *testing.T) {
+	// the server responds to pings while it reads
+	url := startServer(t, false, echo)
+	r, w := io.Pipe()
+	defer w.Close()
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		w.Write([]byte("still there\n"))
+		w.Close()
+	}()
+	status, stdout, _ := wscat(t, r, "-ping", "10ms", url)
+	if status != exitOK {
+		t.Fatalf("expected the pings to be answered, got status %d", status)
+	}
+	assertContains(t, stdout, " < text still there\n", " < pong ")
+}
@@ -0,0 +1,143 @@
+package websocket
+
+import (
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"fmt"
+	"sync"
+)
+
+// Codec converts values to and from the payload of a message, for
+// WriteVia and ReadVia.
+type Codec interface {
+	// Marshal returns the encoding of v and the type of message to send it
+	// in, which must be MessageText or MessageBinary.
+	Marshal(v any) ([]byte, MessageType, error)
+	// Unmarshal decodes the payload of a message of type t into v.
+	Unmarshal(data []byte, t MessageType, v any) error
+}
+
+// JSONCodec is a Codec that encodes values as JSON with encoding/json and
+// sends them in text messages. It decodes both text and binary messages.
+type JSONCodec struct{}
+
+func (JSONCodec) Marshal(v any) ([]byte, MessageType, error) {
+	data, err := json.Marshal(v)
+	return data, MessageText, err
+}
+
+func (JSONCodec) Unmarshal(data []byte, _ MessageType, v any) error {
+	return json.Unmarshal(data, v)
+}
+
+// GobCodec is a Codec that encodes values with encoding/gob and sends them
+// in binary messages. It is created by NewGobCodec.
+//
+// A gob stream describes every type only the first time a value of it is
+// sent, so a GobCodec keeps the state of the stream across messages, and
+// the encoding of a message depends on every message encoded before it.
+// This means:
+//
+//   - Both ends must use a GobCodec for every message of the connection
+//     they encode or decode with it, and each end needs its own GobCodec
+//     for every connection.
+//   - Messages must be written in the order they are marshaled, so WriteVia
+//     must not be called concurrently with the same GobCodec, and a write
+//     queue that drops messages must not be used.
+//   - To use a GobCodec for a new connection, such as after reconnecting,
+//     call Reset first. The peer must use a new or reset GobCodec too.
+//   - After an error, the stream cannot be relied on anymore until both
+//     ends are reset.
+//
+// Interface values must have their concrete types registered with
+// gob.Register on both ends.
+type GobCodec struct {
+	encMx  sync.Mutex
+	encBuf bytes.Buffer
+	enc    *gob.Encoder
+
+	decMx  sync.Mutex
+	decBuf bytes.Buffer
+	dec    *gob.Decoder
+}
+
+// NewGobCodec returns a GobCodec at the start of a stream.
+func NewGobCodec() *GobCodec {
+	g := &GobCodec{}
+	g.Reset()
+	return g
+}
+
+// Reset puts the GobCodec back at the start of a stream, forgetting the
+// types it has sent and received.
+func (g *GobCodec) Reset() {
+	g.encMx.Lock()
+	g.encBuf.Reset()
+	g.enc = gob.NewEncoder(&g.encBuf)
+	g.encMx.Unlock()
+
+	g.decMx.Lock()
+	g.decBuf.Reset()
+	g.dec = gob.NewDecoder(&g.decBuf)
+	g.decMx.Unlock()
+}
+
+func (g *GobCodec) Marshal(v any) ([]byte, MessageType, error) {
+	g.encMx.Lock()
+	defer g.encMx.Unlock()
+	defer g.encBuf.Reset()
+	if err := g.enc.Encode(v); err != nil {
+		return nil, 0, err
+	}
+	return bytes.Clone(g.encBuf.Bytes()), MessageBinary, nil
+}
+
+func (g *GobCodec) Unmarshal(data []byte, _ MessageType, v any) error {
+	g.decMx.Lock()
+	defer g.decMx.Unlock()
+	defer g.decBuf.Reset()
+	g.decBuf.Write(data)
+	if err := g.dec.Decode(v); err != nil {
+		return err
+	}
+	if g.decBuf.Len() != 0 {
+		return fmt.Errorf("gob: %d bytes left after decoding a value", g.decBuf.Len())
+	}
+	return nil
+}
+
+// WriteVia encodes v with codec and writes it as a single message. If codec
+// fails, WriteVia returns a CODEC_ERROR error caused by the codec's error
+// and nothing is written; otherwise, it returns what Write returns.
+func (c *Conn) WriteVia(codec Codec, v any) Error {
+	data, messageType, err := codec.Marshal(v)
+	if err != nil {
+		return errorf(CODEC_ERROR, err)
+	}
+	if messageType != MessageText && messageType != MessageBinary {
+		return errorf(CODEC_ERROR, fmt.Sprintf("marshaled to a message of type %s", messageType))
+	}
+	return c.Write(&Message{Type: messageType, Data: data})
+}
+
+// ReadVia reads the next data message and decodes it into v with codec.
+// Control messages read before it are handled as they are by Read and
+// skipped. If codec fails, ReadVia returns a CODEC_ERROR error caused by
+// the codec's error, and the message is lost; otherwise, it returns what
+// Read returns.
+func (c *Conn) ReadVia(codec Codec, v any) Error {
+	for {
+		msg, err := c.Read()
+		if err != nil {
+			return err
+		}
+		if !msg.IsData() {
+			continue
+		}
+		if err := codec.Unmarshal(msg.Data, msg.Type, v); err != nil {
+			return errorf(CODEC_ERROR, err)
+		}
+		return nil
+	}
+}
@@ -0,0 +1,194 @@
+package websocket_test
+
+import (
+	"encoding/binary"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+type point struct {
+	X, Y int32
+}
+
+// pointCodec is a Codec that encodes points as 8 bytes in binary messages.
+type pointCodec struct{}
+
+func (pointCodec) Marshal(v any) ([]byte, websocket.MessageType, error) {
+	p, ok := v.(*point)
+	if !ok {
+		return nil, 0, fmt.Errorf("cannot marshal %T", v)
+	}
+	data := binary.BigEndian.AppendUint32(nil, uint32(p.X))
+	return binary.BigEndian.AppendUint32(data, uint32(p.Y)), websocket.MessageBinary, nil
+}
+
+func (pointCodec) Unmarshal(data []byte, t websocket.MessageType, v any) error {
+	p, ok := v.(*point)
+	if !ok {
+		return fmt.Errorf("cannot unmarshal into %T", v)
+	}
+	if t != websocket.MessageBinary || len(data) != 8 {
+		return errors.New("not a point")
+	}
+	p.X = int32(binary.BigEndian.Uint32(data))
+	p.Y = int32(binary.BigEndian.Uint32(data[4:]))
+	return nil
+}
+
+func TestCodec(t *testing.T) {
+	codecs := []websocket.Codec{websocket.JSONCodec{}, pointCodec{}}
+	for _, codec := range codecs {
+		conn, peer := pipe()
+		go conn.WriteVia(codec, &point{X: 3, Y: -4})
+
+		var p point
+		if err := peer.ReadVia(codec, &p); err != nil {
+			t.Fatalf("%T: expected no error from ReadVia(), got %v", codec, err)
+		}
+		if p != (point{X: 3, Y: -4}) {
+			t.Fatalf("%T: expected {3 -4}, got %v", codec, p)
+		}
+		conn.Close()
+		peer.Close()
+	}
+}
+
+func TestCodec_SkipsControlMessages(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	go func() {
+		conn.Write(&websocket.Message{Type: websocket.MessagePong, Data: []byte("pong")})
+		conn.WriteVia(websocket.JSONCodec{}, map[string]string{"hello": "world"})
+	}()
+	var v map[string]string
+	if err := peer.ReadVia(websocket.JSONCodec{}, &v); err != nil {
+		t.Fatalf("expected no error from ReadVia(), got %v", err)
+	}
+	if v["hello"] != "world" {
+		t.Fatalf("expected hello: world, got %v", v)
+	}
+}
+
+func TestCodec_Errors(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	err := conn.WriteVia(pointCodec{}, "not a point")
+	if !errors.Is(err, websocket.ErrCodec) {
+		t.Fatalf("expected CODEC_ERROR error, got %v", err)
+	}
+	if errors.Is(err, websocket.ErrWrite) || conn.Closed() {
+		t.Fatalf("expected a codec error to not be a transport error")
+	}
+	if err := conn.WriteVia(websocket.JSONCodec{}, func() {}); !errors.Is(err, websocket.ErrCodec) {
+		t.Fatalf("expected CODEC_ERROR error, got %v", err)
+	}
+
+	go conn.Write(textMessage("not a point"))
+	var p point
+	err = peer.ReadVia(pointCodec{}, &p)
+	if !errors.Is(err, websocket.ErrCodec) {
+		t.Fatalf("expected CODEC_ERROR error, got %v", err)
+	}
+	if errors.Unwrap(err) == nil || errors.Unwrap(err).Error() != "not a point" {
+		t.Fatalf("expected the codec's error to be the cause, got %v", errors.Unwrap(err))
+	}
+	if peer.Closed() {
+		t.Fatalf("expected the connection to stay open after a codec error")
+	}
+}
+
+type shape interface {
+	Area() float64
+}
+
+type square struct{ Side float64 }
+
+func (s square) Area() float64 { return s.Side * s.Side }
+
+type circle struct{ Radius float64 }
+
+func (c circle) Area() float64 { return 3 * c.Radius * c.Radius }
+
+type drawing struct {
+	Name   string
+	Shapes []shape
+}
+
+func TestGobCodec(t *testing.T) {
+	gob.Register(square{})
+	gob.Register(circle{})
+
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+	enc, dec := websocket.NewGobCodec(), websocket.NewGobCodec()
+
+	sent := []drawing{
+		{Name: "one", Shapes: []shape{square{Side: 2}}},
+		{Name: "two", Shapes: []shape{circle{Radius: 1}, square{Side: 3}}},
+		{Name: "three"},
+	}
+	sizes := make(chan int, len(sent))
+	go func() {
+		for i := range sent {
+			data, _, err := enc.Marshal(&sent[i])
+			if err != nil {
+				t.Errorf("expected no error from Marshal(), got %v", err)
+				return
+			}
+			sizes <- len(data)
+			conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: data})
+		}
+	}()
+
+	for i := range sent {
+		var received drawing
+		if err := peer.ReadVia(dec, &received); err != nil {
+			t.Fatalf("expected no error from ReadVia(), got %v", err)
+		}
+		if !reflect.DeepEqual(received, sent[i]) {
+			t.Fatalf("expected %v, got %v", sent[i], received)
+		}
+	}
+
+	// the types are only described in the first message
+	first, second := <-sizes, <-sizes
+	if second >= first {
+		t.Fatalf("expected the second message (%d bytes) to be smaller than the first (%d bytes)", second, first)
+	}
+}
+
+func TestGobCodec_Reset(t *testing.T) {
+	enc, dec := websocket.NewGobCodec(), websocket.NewGobCodec()
+	roundTrip := func() error {
+		data, messageType, err := enc.Marshal(&point{X: 1, Y: 2})
+		if err != nil {
+			return err
+		}
+		var p point
+		return dec.Unmarshal(data, messageType, &p)
+	}
+	if err := roundTrip(); err != nil {
+		t.Fatalf("expected no error, got %v", err)
+	}
+
+	// a new decoder does not know the types described in the first message
+	dec.Reset()
+	if err := roundTrip(); err == nil {
+		t.Fatalf("expected an error decoding with only one end reset")
+	}
+	enc.Reset()
+	dec.Reset()
+	if err := roundTrip(); err != nil {
+		t.Fatalf("expected no error after resetting both ends, got %v", err)
+	}
+}
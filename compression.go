@@ -0,0 +1,700 @@
+package websocket
+
+import (
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// CompressionParams are the parameters of the permessage-deflate extension
+// (RFC 7692) negotiated for a connection, returned by Conn.Compression.
+type CompressionParams struct {
+	// ServerNoContextTakeover and ClientNoContextTakeover report whether
+	// the server and the client compress every message on its own, without
+	// the sliding window of the previous messages. It costs compression,
+	// but the state of the compressor is not kept between messages.
+	ServerNoContextTakeover bool
+	ClientNoContextTakeover bool
+	// ServerMaxWindowBits and ClientMaxWindowBits are the base-2 logarithm
+	// of the size of the sliding window the server and the client compress
+	// with, from 8 to 15. They are 15, a window of 32 KiB, unless a smaller
+	// one was negotiated.
+	ServerMaxWindowBits int
+	ClientMaxWindowBits int
+}
+
+// Compression returns the permessage-deflate parameters negotiated for the
+// connection, and whether it was negotiated at all. The counters of the
+// compressed messages are in Stats.
+func (c *Conn) Compression() (CompressionParams, bool) {
+	if c.compression == nil {
+		return CompressionParams{}, false
+	}
+	return *c.compression, true
+}
+
+// CompressionOptions configure the permessage-deflate extension, see
+// WithCompression.
+type CompressionOptions struct {
+	// ServerNoContextTakeover and ClientNoContextTakeover make the server
+	// and the client compress every message on its own. A server forces
+	// them on the client in its response, and a client asks the server for
+	// them in its offer.
+	//
+	// With context takeover, which is the default, both sides keep a
+	// sliding window of up to 32 KiB of the previous messages for each
+	// direction, and a compressor of several hundred KiB for the messages
+	// they write, for the lifetime of the connection. Without it, the
+	// compressors and decompressors are shared between the connections,
+	// and only used while a message is compressed or decompressed, so an
+	// idle connection keeps no compression state.
+	ServerNoContextTakeover bool
+	ClientNoContextTakeover bool
+	// ServerMaxWindowBits and ClientMaxWindowBits cap the base-2 logarithm
+	// of the size of the sliding window of the server and the client, from
+	// 8 to 15; 0 means 15. A server can only cap the window of a client
+	// that offers client_max_window_bits, as the clients of this package
+	// do.
+	//
+	// Since compress/flate always compresses with a window of 32 KiB, a
+	// Conn limited to a smaller window compresses every message on its own,
+	// and does not compress the messages larger than the window.
+	ServerMaxWindowBits int
+	ClientMaxWindowBits int
+}
+
+// WithCompression enables the permessage-deflate extension (RFC 7692),
+// which compresses the payloads of the text and binary messages. A Conn
+// created by Dial offers it to the server, and one created by AcceptHTTP
+// accepts it if the client offers it, with the options specified. It is
+// negotiated in the handshake, so it has no effect on a Conn created by
+// From; see Conn.Compression for whether it was negotiated.
+//
+// Once negotiated, the messages written with a payload of at least 512
+// bytes are compressed at flate.BestSpeed, see SetCompressionThreshold,
+// SetCompressionLevel, and Message.Compress.
+func WithCompression(opts CompressionOptions) Option {
+	return func(c *Conn) {
+		c.compressionOptions = &opts
+	}
+}
+
+// WithMaxExpansionRatio sets how many times larger than its compressed
+// payload a compressed message read from the connection may be once it is
+// decompressed. If a message expands more, Read returns an
+// EXPANSION_TOO_LARGE error and the connection is closed with
+// CloseMessageTooBig, as soon as the ratio is crossed.
+//
+// The read limit set with WithReadLimit applies to the decompressed size
+// of the messages, so it is what bounds the memory a message can take; a
+// few bytes of deflate can expand to megabytes. The ratio is a second
+// line of defense, for the connections that need a high read limit. A
+// ratio of 0, the default, means there is no maximum. Deflate cannot
+// expand more than about 1032 times.
+func WithMaxExpansionRatio(ratio int) Option {
+	return func(c *Conn) {
+		c.maxExpansionRatio = max(ratio, 0)
+	}
+}
+
+// CompressMode is whether a message written to a connection that
+// negotiated compression is compressed, see Message.Compress.
+type CompressMode uint8
+
+const (
+	// CompressAuto compresses the message if its payload is at least the
+	// compression threshold of the connection (see
+	// Conn.SetCompressionThreshold).
+	CompressAuto CompressMode = iota
+	// CompressAlways compresses the message whatever its size.
+	CompressAlways
+	// CompressNever writes the message uncompressed, such as for a payload
+	// that is already compressed.
+	CompressNever
+)
+
+// defaultCompressionThreshold is the size of the smallest payload
+// compressed by default. Deflate barely shrinks smaller payloads, or makes
+// them larger.
+const defaultCompressionThreshold = 512
+
+// SetCompressionLevel sets the level the messages written to the
+// connection are compressed at, from flate.HuffmanOnly to
+// flate.BestCompression, or flate.DefaultCompression; it is
+// flate.BestSpeed by default. Higher levels compress more, with more CPU.
+// It returns an INVALID_COMPRESSION_LEVEL error for any other level, and
+// has no effect if compression was not negotiated.
+func (c *Conn) SetCompressionLevel(level int) Error {
+	if level < flate.HuffmanOnly || level > flate.BestCompression {
+		return errorf(INVALID_COMPRESSION_LEVEL, level)
+	}
+	if c.deflater != nil {
+		c.deflater.setLevel(level)
+	}
+	return nil
+}
+
+// SetCompressionThreshold sets the size of the smallest payload compressed
+// when compression was negotiated; the text and binary messages with a
+// smaller payload are written uncompressed, unless Message.Compress says
+// otherwise. It is 512 bytes by default. A threshold of 0 compresses every
+// message.
+func (c *Conn) SetCompressionThreshold(n int) {
+	c.compressionThreshold.Store(int64(max(n, 0)))
+}
+
+// windowBits returns the window bits of an option, where 0 means 15.
+func windowBits(n int) int {
+	if n == 0 {
+		return 15
+	}
+	return min(max(n, 8), 15)
+}
+
+// extension is an extension offered or accepted in a
+// Sec-WebSocket-Extensions header, with its parameters in order.
+type extension struct {
+	name   string
+	params [][2]string // name and value, which is empty if there is none
+}
+
+// parseExtensions parses the values of Sec-WebSocket-Extensions headers.
+func parseExtensions(values []string) []extension {
+	var extensions []extension
+	for _, value := range values {
+		for _, e := range strings.Split(value, ",") {
+			parts := strings.Split(e, ";")
+			ext := extension{name: strings.TrimSpace(parts[0])}
+			if ext.name == "" {
+				continue
+			}
+			for _, param := range parts[1:] {
+				name, value, _ := strings.Cut(param, "=")
+				value = strings.Trim(strings.TrimSpace(value), `"`)
+				ext.params = append(ext.params, [2]string{strings.TrimSpace(name), value})
+			}
+			extensions = append(extensions, ext)
+		}
+	}
+	return extensions
+}
+
+// parseWindowBits parses the value of a window bits parameter.
+func parseWindowBits(value string) (int, bool) {
+	n, err := strconv.Atoi(value)
+	return n, err == nil && n >= 8 && n <= 15 && value[0] != '0' && value[0] != '+'
+}
+
+// acceptOffer returns the parameters a server with the options o accepts
+// for the first permessage-deflate offer in the Sec-WebSocket-Extensions
+// headers of a request that it can accept, and its response to it, or
+// false if there is none.
+func (o *CompressionOptions) acceptOffer(header http.Header) (CompressionParams, string, bool) {
+offers:
+	for _, ext := range parseExtensions(header.Values("Sec-WebSocket-Extensions")) {
+		if ext.name != "permessage-deflate" {
+			continue
+		}
+		params := CompressionParams{
+			ServerNoContextTakeover: o.ServerNoContextTakeover,
+			ClientNoContextTakeover: o.ClientNoContextTakeover,
+			ServerMaxWindowBits:     windowBits(o.ServerMaxWindowBits),
+			ClientMaxWindowBits:     15,
+		}
+		clientWindow := 0 // offered by the client, or 0
+		seen := make(map[string]bool, len(ext.params))
+		for _, param := range ext.params {
+			name, value := param[0], param[1]
+			if seen[name] { // parameters may not be repeated
+				continue offers
+			}
+			seen[name] = true
+			switch name {
+			case "server_no_context_takeover", "client_no_context_takeover":
+				if value != "" {
+					continue offers
+				}
+				if name == "server_no_context_takeover" {
+					params.ServerNoContextTakeover = true
+				} else {
+					params.ClientNoContextTakeover = true
+				}
+			case "server_max_window_bits":
+				bits, ok := parseWindowBits(value)
+				if !ok {
+					continue offers
+				}
+				params.ServerMaxWindowBits = min(params.ServerMaxWindowBits, bits)
+			case "client_max_window_bits":
+				clientWindow = 15
+				if value != "" {
+					bits, ok := parseWindowBits(value)
+					if !ok {
+						continue offers
+					}
+					clientWindow = bits
+				}
+			default:
+				continue offers
+			}
+		}
+		if clientWindow != 0 {
+			params.ClientMaxWindowBits = min(clientWindow, windowBits(o.ClientMaxWindowBits))
+		}
+		return params, params.response(clientWindow != 0), true
+	}
+	return CompressionParams{}, "", false
+}
+
+// response returns the Sec-WebSocket-Extensions header of the response of
+// a server accepting the parameters, which includes client_max_window_bits
+// if the client offered it.
+func (p CompressionParams) response(clientWindow bool) string {
+	response := "permessage-deflate"
+	if p.ServerNoContextTakeover {
+		response += "; server_no_context_takeover"
+	}
+	if p.ClientNoContextTakeover {
+		response += "; client_no_context_takeover"
+	}
+	if p.ServerMaxWindowBits < 15 {
+		response += "; server_max_window_bits=" + strconv.Itoa(p.ServerMaxWindowBits)
+	}
+	if clientWindow && p.ClientMaxWindowBits < 15 {
+		response += "; client_max_window_bits=" + strconv.Itoa(p.ClientMaxWindowBits)
+	}
+	return response
+}
+
+// offer returns the Sec-WebSocket-Extensions header of the request of a
+// client with the options o.
+func (o *CompressionOptions) offer() string {
+	offer := "permessage-deflate"
+	if o.ServerNoContextTakeover {
+		offer += "; server_no_context_takeover"
+	}
+	if o.ClientNoContextTakeover {
+		offer += "; client_no_context_takeover"
+	}
+	if bits := windowBits(o.ServerMaxWindowBits); bits < 15 {
+		offer += "; server_max_window_bits=" + strconv.Itoa(bits)
+	}
+	offer += "; client_max_window_bits"
+	if bits := windowBits(o.ClientMaxWindowBits); bits < 15 {
+		offer += "=" + strconv.Itoa(bits)
+	}
+	return offer
+}
+
+// acceptResponse returns the parameters in the Sec-WebSocket-Extensions
+// header of the response of a server to the offer of a client with the
+// options o, or nil if the server declined it. It returns an error if the
+// server accepted an extension that was not offered, or parameters that
+// are not valid for the offer.
+func (o *CompressionOptions) acceptResponse(header http.Header) (*CompressionParams, error) {
+	extensions := parseExtensions(header.Values("Sec-WebSocket-Extensions"))
+	if len(extensions) == 0 {
+		return nil, nil
+	}
+	if o == nil || len(extensions) > 1 || extensions[0].name != "permessage-deflate" {
+		names := make([]string, len(extensions))
+		for i, ext := range extensions {
+			names[i] = ext.name
+		}
+		return nil, fmt.Errorf("the server accepted extensions %q, which were not offered", names)
+	}
+	params := &CompressionParams{
+		ClientNoContextTakeover: o.ClientNoContextTakeover,
+		ServerMaxWindowBits:     15,
+		ClientMaxWindowBits:     windowBits(o.ClientMaxWindowBits),
+	}
+	seen := make(map[string]bool)
+	for _, param := range extensions[0].params {
+		name, value := param[0], param[1]
+		if seen[name] {
+			return nil, fmt.Errorf("the server repeated the permessage-deflate parameter %q", name)
+		}
+		seen[name] = true
+		switch name {
+		case "server_no_context_takeover", "client_no_context_takeover":
+			if value != "" {
+				return nil, fmt.Errorf("the permessage-deflate parameter %q has a value", name)
+			}
+			if name == "server_no_context_takeover" {
+				params.ServerNoContextTakeover = true
+			} else {
+				params.ClientNoContextTakeover = true
+			}
+		case "server_max_window_bits", "client_max_window_bits":
+			bits, ok := parseWindowBits(value)
+			if !ok {
+				return nil, fmt.Errorf("the permessage-deflate parameter %q has the invalid value %q", name, value)
+			}
+			if name == "server_max_window_bits" {
+				if bits > windowBits(o.ServerMaxWindowBits) {
+					return nil, fmt.Errorf("the server's window of %d bits is larger than the one offered", bits)
+				}
+				params.ServerMaxWindowBits = bits
+			} else {
+				params.ClientMaxWindowBits = min(params.ClientMaxWindowBits, bits)
+			}
+		default:
+			return nil, fmt.Errorf("unknown permessage-deflate parameter %q", name)
+		}
+	}
+	return params, nil
+}
+
+// maxWindowSize is the size of the largest sliding window of deflate.
+const maxWindowSize = 1 << 15
+
+// flateTail is appended to a compressed payload before it is
+// decompressed: the 4 bytes the compressor stripped from its end, then an
+// empty final block, so that the decompressor reports the end of it.
+var flateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// defaultCompressionLevel is the level messages are compressed at.
+const defaultCompressionLevel = flate.BestSpeed
+
+// pooledFlateWriter is a flate writer in flateWriterPools, with the buffer
+// it writes to.
+type pooledFlateWriter struct {
+	w   *flate.Writer
+	out sliceWriter
+}
+
+// flateWriterPools hold the flate writers of the connections that compress
+// every message on its own, one pool for every level from
+// flate.HuffmanOnly, since a writer cannot change level. A writer is reset
+// before it is put back.
+var flateWriterPools [flate.BestCompression - flate.HuffmanOnly + 1]sync.Pool
+
+// flateReaderPool holds the flate readers of all the connections, with
+// the payload reader they read from. Connections with context takeover
+// keep the window of the previous messages themselves, and reset a reader
+// with it before every message.
+var flateReaderPool sync.Pool
+
+// pooledFlateReader is a flate reader in flateReaderPool, with the payload
+// reader it reads from.
+type pooledFlateReader struct {
+	r   io.ReadCloser
+	src payloadReader
+}
+
+// sliceWriter is an io.Writer appending to a slice.
+type sliceWriter struct {
+	b []byte
+}
+
+func (w *sliceWriter) Write(p []byte) (int, error) {
+	w.b = append(w.b, p...)
+	return len(p), nil
+}
+
+// payloadReader reads a compressed payload followed by flateTail. It is an
+// io.ByteReader, so that the flate reader does not buffer it.
+type payloadReader struct {
+	data, tail []byte
+}
+
+func (r *payloadReader) reset(data []byte) {
+	r.data, r.tail = data, flateTail
+}
+
+func (r *payloadReader) Read(p []byte) (int, error) {
+	if len(r.data) == 0 {
+		if len(r.tail) == 0 {
+			return 0, io.EOF
+		}
+		r.data, r.tail = r.tail, nil
+	}
+	n := copy(p, r.data)
+	r.data = r.data[n:]
+	return n, nil
+}
+
+func (r *payloadReader) ReadByte() (byte, error) {
+	if len(r.data) == 0 {
+		if len(r.tail) == 0 {
+			return 0, io.EOF
+		}
+		r.data, r.tail = r.tail, nil
+	}
+	b := r.data[0]
+	r.data = r.data[1:]
+	return b, nil
+}
+
+// deflater compresses the payloads of the messages a Conn writes.
+type deflater struct {
+	// held while compressing, and with context takeover until the message
+	// compressed is written, so that they are written in the order they
+	// were compressed in
+	mx    sync.Mutex
+	level int
+	// whether the window is kept between messages, in w, which is nil
+	// otherwise
+	takeover bool
+	w        *pooledFlateWriter
+	// the size of the largest payload compressed for a window smaller than
+	// 32 KiB, or 0
+	maxSize int
+}
+
+// newDeflater returns a deflater for a Conn that compresses with the
+// parameters specified.
+func newDeflater(noContextTakeover bool, windowBits int) *deflater {
+	d := &deflater{level: defaultCompressionLevel, takeover: !noContextTakeover}
+	if windowBits < 15 { // a payload no larger than the window cannot reach beyond it
+		d.takeover = false
+		d.maxSize = 1 << windowBits
+	}
+	return d
+}
+
+// compress appends the payload data compressed to dst, without the 4 bytes
+// that end it, and returns it. It returns false if the payload is too
+// large to be compressed with the window of the deflater. The mutex of
+// the deflater must be held.
+func (d *deflater) compress(dst, data []byte) ([]byte, bool) {
+	if d.maxSize > 0 && len(data) > d.maxSize {
+		return dst, false
+	}
+	pw := d.w
+	if pw == nil {
+		pool := &flateWriterPools[d.level-flate.HuffmanOnly]
+		if v := pool.Get(); v != nil {
+			pw = v.(*pooledFlateWriter)
+		} else {
+			pw = new(pooledFlateWriter)
+			pw.w, _ = flate.NewWriter(&pw.out, d.level) // the level is valid
+		}
+	}
+	pw.out.b = dst
+	pw.w.Write(data)
+	pw.w.Flush()
+	dst, pw.out.b = pw.out.b, nil
+	if d.takeover {
+		d.w = pw
+	} else {
+		pw.w.Reset(&pw.out)
+		flateWriterPools[d.level-flate.HuffmanOnly].Put(pw)
+	}
+	return dst[:len(dst)-4], true // the flush ends with 0x00 0x00 0xff 0xff
+}
+
+// setLevel sets the level of the deflater. With context takeover, the
+// writer compressing at the previous level is put back in its pool, and
+// the next message is compressed without the window of the previous ones,
+// which the peer decompresses all the same.
+func (d *deflater) setLevel(level int) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if level == d.level {
+		return
+	}
+	if d.w != nil {
+		d.w.w.Reset(&d.w.out)
+		flateWriterPools[d.level-flate.HuffmanOnly].Put(d.w)
+		d.w = nil
+	}
+	d.level = level
+}
+
+// writeCompressed writes a data message of the type specified with the
+// payload data like writeData, for a Conn that negotiated compression. The
+// payload is compressed and the first frame has rsv1 set, unless mode or
+// the compression threshold leave it uncompressed, or it is too large for
+// the window of the deflater.
+func writeCompressed[T string | []byte](c *Conn, messageType MessageType, data T, mode CompressMode) Error {
+	if mode == CompressNever || mode == CompressAuto && int64(len(data)) < c.compressionThreshold.Load() {
+		c.countCompressionSkipped()
+		return writeData(c, messageType, data)
+	}
+	d := c.deflater
+	d.mx.Lock()
+	buf := framePool.Get().(*[]byte)
+	compressed, ok := d.compress((*buf)[:0], []byte(data))
+	if !ok {
+		d.mx.Unlock()
+		framePool.Put(buf)
+		c.countCompressionSkipped()
+		return writeData(c, messageType, data)
+	}
+	if !d.takeover { // the messages can be written in any order
+		d.mx.Unlock()
+	}
+	fbuf := framePool.Get().(*[]byte)
+	frames := appendFrames(c, (*fbuf)[:0], messageType, rsv1, compressed)
+	err := c.writeFrames(messageType, len(compressed), frames)
+	if d.takeover {
+		d.mx.Unlock()
+	}
+	putFrameBuffer(buf, compressed)
+	putFrameBuffer(fbuf, frames)
+	if err != nil {
+		return err
+	}
+	c.countCompressed(len(data), len(compressed))
+	return nil
+}
+
+// inflater decompresses the payloads of the messages a Conn reads.
+type inflater struct {
+	// whether the window is kept between messages, in dict, which is the
+	// end of the payloads decompressed so far
+	takeover bool
+	dict     []byte
+}
+
+// newInflater returns an inflater for a Conn reading payloads compressed
+// with the parameters specified.
+func newInflater(noContextTakeover bool) *inflater {
+	return &inflater{takeover: !noContextTakeover}
+}
+
+// errInflateLimit is returned by decompress for a payload that
+// decompresses to more bytes than the limit.
+var errInflateLimit = errors.New("the decompressed payload is larger than the limit")
+
+// decompress appends the compressed payload data decompressed to dst and
+// returns it. If it decompresses to more than limit bytes, it returns
+// errInflateLimit once it has decompressed one more byte, without growing
+// dst beyond that; a negative limit means there is none. Calls must be
+// serialized, in the order the payloads are read in.
+func (f *inflater) decompress(dst, data []byte, limit int) ([]byte, error) {
+	pr, _ := flateReaderPool.Get().(*pooledFlateReader)
+	if pr == nil {
+		pr = new(pooledFlateReader)
+		pr.src.reset(data)
+		pr.r = flate.NewReaderDict(&pr.src, f.dict)
+	} else {
+		pr.src.reset(data)
+		pr.r.(flate.Resetter).Reset(&pr.src, f.dict)
+	}
+	defer func() {
+		pr.src.reset(nil) // not to keep the payload
+		flateReaderPool.Put(pr)
+	}()
+
+	start := len(dst)
+	for {
+		grow := max(len(dst)-start, 512)
+		free := cap(dst) - len(dst)
+		if limit >= 0 { // at most one byte more than the limit
+			remaining := limit - (len(dst) - start) + 1
+			grow, free = min(grow, remaining), min(free, remaining)
+		}
+		if free == 0 {
+			dst = slices.Grow(dst, grow)
+			free = grow
+		}
+		n, err := pr.r.Read(dst[len(dst) : len(dst)+free])
+		dst = dst[:len(dst)+n]
+		if limit >= 0 && len(dst)-start > limit {
+			return dst, errInflateLimit
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return dst, err
+		}
+	}
+	if f.takeover {
+		f.remember(dst[start:])
+	}
+	return dst, nil
+}
+
+// remember appends p to the window kept between messages, keeping the last
+// 32 KiB.
+func (f *inflater) remember(p []byte) {
+	if f.dict == nil {
+		f.dict = make([]byte, 0, maxWindowSize)
+	}
+	if len(p) >= maxWindowSize {
+		f.dict = append(f.dict[:0], p[len(p)-maxWindowSize:]...)
+		return
+	}
+	if len(f.dict)+len(p) > maxWindowSize {
+		keep := maxWindowSize - len(p)
+		f.dict = f.dict[:copy(f.dict, f.dict[len(f.dict)-keep:])]
+	}
+	f.dict = append(f.dict, p...)
+}
+
+// inflate decompresses the payload data of a compressed message read from
+// the connection, appending it to dst. If the message is larger than the
+// read limit or expands more than the maximum expansion ratio, it stops
+// decompressing it and fails the connection with CloseMessageTooBig. The
+// read mutex must be held.
+func (c *Conn) inflate(dst, data []byte) ([]byte, Error) {
+	limit, ratioLimit := -1, false
+	if c.readLimit > 0 {
+		limit = int(min(c.readLimit, math.MaxInt))
+	}
+	if r := c.maxExpansionRatio; r > 0 && len(data) <= math.MaxInt/r {
+		if n := len(data) * r; limit < 0 || n < limit {
+			limit, ratioLimit = n, true
+		}
+	}
+	out, err := c.inflater.decompress(dst, data, limit)
+	switch {
+	case err == errInflateLimit:
+		e := errorf(MESSAGE_TOO_LARGE, "read", c.readLimit)
+		if ratioLimit {
+			e = errorf(EXPANSION_TOO_LARGE, c.maxExpansionRatio)
+		}
+		c.setErr(e)
+		c.closeWithCode(CloseMessageTooBig, "")
+		return nil, e
+	case err != nil:
+		return nil, errorf(MALFORMED_FRAME, "the compressed payload is not valid: "+err.Error())
+	}
+	return out, nil
+}
+
+// decompressMessage decompresses the payload data of a compressed message
+// read from the connection, in the buffer reused by Read if it is reused,
+// and counts it. The read mutex must be held.
+func (c *Conn) decompressMessage(data []byte) ([]byte, Error) {
+	var dst []byte
+	if c.reuseReadBuffer {
+		if cap(c.inflateBuf) > maxRetainedReadBuffer {
+			c.inflateBuf = nil
+		}
+		dst = c.inflateBuf[:0]
+	}
+	out, err := c.inflate(dst, data)
+	if err != nil {
+		return nil, err
+	}
+	if c.reuseReadBuffer {
+		c.inflateBuf = out
+	}
+	c.countDecompressed(len(data), len(out))
+	return out, nil
+}
+
+// setupCompression creates the deflater and the inflater of a Conn for
+// which compression was negotiated.
+func (c *Conn) setupCompression() {
+	p := c.compression
+	c.compressionThreshold.Store(defaultCompressionThreshold)
+	if c.role == RoleClient {
+		c.deflater = newDeflater(p.ClientNoContextTakeover, p.ClientMaxWindowBits)
+		c.inflater = newInflater(p.ServerNoContextTakeover)
+	} else {
+		c.deflater = newDeflater(p.ServerNoContextTakeover, p.ServerMaxWindowBits)
+		c.inflater = newInflater(p.ClientNoContextTakeover)
+	}
+}
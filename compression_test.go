@@ -0,0 +1,726 @@
+package websocket_test
+
+import (
+	"bytes"
+	"compress/flate"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// compressionRequest returns a WebSocket handshake request offering the
+// Sec-WebSocket-Extensions specified, if any.
+func compressionRequest(extensions ...string) *http.Request {
+	req, _ := http.NewRequest("GET", "http://localhost/ws", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	for _, e := range extensions {
+		req.Header.Add("Sec-WebSocket-Extensions", e)
+	}
+	return req
+}
+
+func TestAcceptHTTP_Compression(t *testing.T) {
+	full := websocket.CompressionParams{ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}
+	for _, test := range []struct {
+		name     string
+		offer    []string
+		opts     websocket.CompressionOptions
+		response string
+		params   *websocket.CompressionParams // nil if not negotiated
+	}{
+		{
+			name:     "plain",
+			offer:    []string{"permessage-deflate"},
+			response: "permessage-deflate",
+			params:   &full,
+		},
+		{
+			name:     "forced no context takeover",
+			offer:    []string{"permessage-deflate; client_max_window_bits"},
+			opts:     websocket.CompressionOptions{ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+			response: "permessage-deflate; server_no_context_takeover; client_no_context_takeover",
+			params:   &websocket.CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true, ServerMaxWindowBits: 15, ClientMaxWindowBits: 15},
+		},
+		{
+			name:     "requested no context takeover",
+			offer:    []string{"permessage-deflate; server_no_context_takeover"},
+			response: "permessage-deflate; server_no_context_takeover",
+			params:   &websocket.CompressionParams{ServerNoContextTakeover: true, ServerMaxWindowBits: 15, ClientMaxWindowBits: 15},
+		},
+		{
+			name:     "capped windows",
+			offer:    []string{"permessage-deflate; server_max_window_bits=12; client_max_window_bits"},
+			opts:     websocket.CompressionOptions{ServerMaxWindowBits: 10, ClientMaxWindowBits: 9},
+			response: "permessage-deflate; server_max_window_bits=10; client_max_window_bits=9",
+			params:   &websocket.CompressionParams{ServerMaxWindowBits: 10, ClientMaxWindowBits: 9},
+		},
+		{
+			name:     "client window not offered",
+			offer:    []string{"permessage-deflate; server_max_window_bits=9"},
+			opts:     websocket.CompressionOptions{ClientMaxWindowBits: 9},
+			response: "permessage-deflate; server_max_window_bits=9",
+			params:   &websocket.CompressionParams{ServerMaxWindowBits: 9, ClientMaxWindowBits: 15},
+		},
+		{
+			name:     "first acceptable offer",
+			offer:    []string{`x-webkit-deflate-frame, permessage-deflate; unknown, permessage-deflate; client_max_window_bits="10"`},
+			response: "permessage-deflate; client_max_window_bits=10",
+			params:   &websocket.CompressionParams{ServerMaxWindowBits: 15, ClientMaxWindowBits: 10},
+		},
+		{
+			name:  "invalid window",
+			offer: []string{"permessage-deflate; server_max_window_bits=16", "permessage-deflate; client_max_window_bits=08"},
+		},
+		{
+			name:  "repeated parameter",
+			offer: []string{"permessage-deflate; server_no_context_takeover; server_no_context_takeover"},
+		},
+		{
+			name: "not offered",
+		},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			rec := new(MockResponseWriterHijack)
+			conn, err := websocket.AcceptHTTP(rec, compressionRequest(test.offer...), websocket.WithCompression(test.opts))
+			if err != nil {
+				t.Fatalf("accepting: %v", err)
+			}
+			defer conn.Close()
+			if response := rec.Header().Get("Sec-WebSocket-Extensions"); response != test.response {
+				t.Fatalf("expected the response %q, got %q", test.response, response)
+			}
+			params, ok := conn.Compression()
+			if ok != (test.params != nil) || ok && params != *test.params {
+				t.Fatalf("expected the parameters %+v, got %+v (negotiated: %t)", test.params, params, ok)
+			}
+		})
+	}
+
+	// compression is only negotiated if it is enabled, and never with
+	// WithLowMemory
+	for _, opts := range [][]websocket.Option{
+		nil,
+		{websocket.WithCompression(websocket.CompressionOptions{}), websocket.WithLowMemory(make([]byte, 64), make([]byte, 64))},
+	} {
+		rec := new(MockResponseWriterHijack)
+		conn, err := websocket.AcceptHTTP(rec, compressionRequest("permessage-deflate"), opts...)
+		if err != nil {
+			t.Fatalf("accepting: %v", err)
+		}
+		conn.Close()
+		if _, ok := conn.Compression(); ok || rec.Header().Get("Sec-WebSocket-Extensions") != "" {
+			t.Fatalf("expected compression not to be negotiated")
+		}
+	}
+}
+
+func TestDial_Compression(t *testing.T) {
+	serverOpts := websocket.CompressionOptions{ClientNoContextTakeover: true, ClientMaxWindowBits: 12}
+	negotiated := make(chan websocket.CompressionParams, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Query().Has("other") {
+			w.Header().Set("Sec-WebSocket-Extensions", "x-other")
+		}
+		conn, err := websocket.AcceptHTTP(w, r, websocket.WithCompression(serverOpts))
+		if err != nil {
+			return
+		}
+		params, _ := conn.Compression()
+		negotiated <- params
+		conn.Close()
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	conn, err := websocket.Dial(context.Background(), url, websocket.WithCompression(websocket.CompressionOptions{ServerNoContextTakeover: true, ServerMaxWindowBits: 11}))
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	conn.Close()
+	expected := websocket.CompressionParams{ServerNoContextTakeover: true, ClientNoContextTakeover: true, ServerMaxWindowBits: 11, ClientMaxWindowBits: 12}
+	if params, ok := conn.Compression(); !ok || params != expected {
+		t.Fatalf("expected the client to negotiate %+v, got %+v", expected, params)
+	}
+	if params := <-negotiated; params != expected {
+		t.Fatalf("expected the server to negotiate %+v, got %+v", expected, params)
+	}
+
+	// without WithCompression, nothing is offered
+	conn, err = websocket.Dial(context.Background(), url)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	conn.Close()
+	if _, ok := conn.Compression(); ok {
+		t.Fatalf("expected compression not to be negotiated")
+	}
+	<-negotiated
+
+	// an extension that was not offered fails the handshake
+	if _, err := websocket.Dial(context.Background(), url+"?other"); !errors.Is(err, websocket.ErrHandshake) {
+		t.Fatalf("expected an extension that was not offered to fail the handshake, got %v", err)
+	}
+}
+
+func TestCompression_RoundTrip(t *testing.T) {
+	messages := [][]byte{
+		[]byte(loremIpsum),
+		[]byte(loremIpsum), // compresses to almost nothing with context takeover
+		{},
+		bytes.Repeat([]byte("ab"), 40000),
+	}
+	for name, opts := range map[string]websocket.CompressionOptions{
+		"context takeover":    {},
+		"no context takeover": {ServerNoContextTakeover: true, ClientNoContextTakeover: true},
+	} {
+		t.Run(name, func(t *testing.T) {
+			client, server := websocket.Pipe(websocket.WithCompression(opts))
+			defer client.Close()
+			defer server.Close()
+			var sizes []int
+			for _, data := range messages {
+				for _, conns := range [][2]*websocket.Conn{{client, server}, {server, client}} {
+					compressed, ok := websocket.Deflate(conns[0], nil, data)
+					if !ok {
+						t.Fatalf("expected the payload to be compressed")
+					}
+					sizes = append(sizes, len(compressed))
+					decompressed, err := websocket.Inflate(conns[1], nil, compressed)
+					if err != nil {
+						t.Fatalf("decompressing: %v", err)
+					}
+					if !bytes.Equal(decompressed, data) {
+						t.Fatalf("expected the payload to round-trip, got %d bytes instead of %d", len(decompressed), len(data))
+					}
+				}
+			}
+			takeover := opts == websocket.CompressionOptions{}
+			if repeated := sizes[2] < sizes[0]/4; repeated != takeover {
+				t.Fatalf("expected the window to be kept between messages only with context takeover, got sizes %v", sizes)
+			}
+			writer, window := websocket.CompressionState(server)
+			if takeover != writer || takeover != (window > 0) {
+				t.Fatalf("expected the compression state to only be kept with context takeover, got %t and %d bytes", writer, window)
+			}
+		})
+	}
+}
+
+func TestCompression_Interop(t *testing.T) {
+	// the payloads are what compress/flate produces once its flush marker
+	// is stripped, and it decompresses them with it
+	client, server := websocket.Pipe(websocket.WithCompression(websocket.CompressionOptions{}))
+	defer client.Close()
+	defer server.Close()
+
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	fw.Write([]byte(loremIpsum))
+	fw.Flush()
+	data, err := websocket.Inflate(server, nil, bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff}))
+	if err != nil || string(data) != loremIpsum {
+		t.Fatalf("expected a payload compressed by compress/flate to be decompressed, got %v", err)
+	}
+
+	compressed, _ := websocket.Deflate(server, nil, []byte(loremIpsum))
+	fr := flate.NewReader(io.MultiReader(bytes.NewReader(compressed), bytes.NewReader([]byte{0, 0, 0xff, 0xff, 1, 0, 0, 0xff, 0xff})))
+	if data, err := io.ReadAll(fr); err != nil || string(data) != loremIpsum {
+		t.Fatalf("expected compress/flate to decompress the payload, got %v", err)
+	}
+}
+
+func TestCompression_WindowBits(t *testing.T) {
+	// a smaller window is kept by not compressing larger payloads
+	client, server := websocket.Pipe(websocket.WithCompression(websocket.CompressionOptions{ServerMaxWindowBits: 9}))
+	defer client.Close()
+	defer server.Close()
+	if _, ok := websocket.Deflate(server, nil, make([]byte, 512)); !ok {
+		t.Fatalf("expected a payload as large as the window to be compressed")
+	}
+	if _, ok := websocket.Deflate(server, nil, make([]byte, 513)); ok {
+		t.Fatalf("expected a payload larger than the window not to be compressed")
+	}
+	if _, ok := websocket.Deflate(client, nil, make([]byte, 1<<20)); !ok {
+		t.Fatalf("expected the client to compress payloads of any size")
+	}
+	if writer, _ := websocket.CompressionState(server); writer {
+		t.Fatalf("expected a server with a smaller window to compress every message on its own")
+	}
+}
+
+func TestCompression_PoolReuse(t *testing.T) {
+	if raceEnabled {
+		t.Skip("sync.Pool drops items at random with the race detector")
+	}
+	client, server := websocket.Pipe(websocket.WithCompression(websocket.CompressionOptions{ServerNoContextTakeover: true, ClientNoContextTakeover: true}))
+	defer client.Close()
+	defer server.Close()
+	data := []byte(loremIpsum)
+	compressed := make([]byte, 0, len(data))
+	decompressed := make([]byte, 0, 2*len(data)) // not to grow it to find the end
+	roundTrip := func() {
+		compressed, _ = websocket.Deflate(server, compressed[:0], data)
+		if _, err := websocket.Inflate(client, decompressed[:0], compressed); err != nil {
+			t.Fatalf("decompressing: %v", err)
+		}
+	}
+	roundTrip()
+
+	// a flate writer takes hundreds of KiB and a reader more than its
+	// window of 32 KiB, while decoding the Huffman tables of a message
+	// takes a few small allocations
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	for range 100 {
+		roundTrip()
+	}
+	runtime.ReadMemStats(&after)
+	if allocated := (after.TotalAlloc - before.TotalAlloc) / 100; allocated > 4<<10 {
+		t.Fatalf("expected the flate writers and readers to be reused, %d bytes were allocated per message", allocated)
+	}
+}
+
+// deflateZeros returns n zeros compressed as a payload, without
+// allocating them.
+func deflateZeros(n int) []byte {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestCompression)
+	zeros := make([]byte, 64<<10)
+	for ; n > 0; n -= len(zeros) {
+		fw.Write(zeros[:min(n, len(zeros))])
+	}
+	fw.Flush()
+	return bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff})
+}
+
+// bomb is 64 MiB of zeros compressed to about 64 KiB.
+var bomb = sync.OnceValue(func() []byte { return deflateZeros(64 << 20) })
+
+func TestCompression_Bomb(t *testing.T) {
+	for _, test := range []struct {
+		name  string
+		opts  []websocket.Option
+		limit error
+	}{
+		{"read limit", []websocket.Option{websocket.WithReadLimit(1 << 20)}, websocket.ErrMessageTooLarge},
+		{"expansion ratio", []websocket.Option{websocket.WithMaxExpansionRatio(10)}, websocket.ErrExpansionTooLarge},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			opts := append(test.opts, websocket.WithCompression(websocket.CompressionOptions{}))
+			client, server := websocket.Pipe(opts...)
+			defer client.Close()
+			received := readMessages(client)
+
+			var before, after runtime.MemStats
+			runtime.ReadMemStats(&before)
+			_, err := websocket.Inflate(server, nil, bomb())
+			runtime.ReadMemStats(&after)
+			if !errors.Is(err, test.limit) {
+				t.Fatalf("expected a %v error, got %v", test.limit, err)
+			}
+			if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 8<<20 {
+				t.Fatalf("expected decompressing to stop at the limit, %d bytes were allocated", allocated)
+			}
+			if err := <-received; !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+				t.Fatalf("expected the connection to be closed with 1009, got %v", err)
+			}
+			if !errors.Is(server.Err(), test.limit) {
+				t.Fatalf("expected Err() to be a %v error, got %v", test.limit, server.Err())
+			}
+		})
+	}
+
+	// messages within the limits are decompressed
+	client, server := websocket.Pipe(websocket.WithCompression(websocket.CompressionOptions{}), websocket.WithReadLimit(1<<20), websocket.WithMaxExpansionRatio(1100))
+	defer client.Close()
+	defer server.Close()
+	data, err := websocket.Inflate(server, nil, deflateZeros(1<<20))
+	if err != nil || len(data) != 1<<20 {
+		t.Fatalf("expected a message as large as the limit to be decompressed, got %d bytes and %v", len(data), err)
+	}
+}
+
+// rawFrame encodes an unmasked frame with the first byte specified, which
+// has the fin and rsv bits and the opcode, and the payload specified.
+func rawFrame(first byte, payload []byte) []byte {
+	frame := []byte{first}
+	switch n := len(payload); {
+	case n < 126:
+		frame = append(frame, byte(n))
+	case n < 65536:
+		frame = binary.BigEndian.AppendUint16(append(frame, 126), uint16(n))
+	default:
+		frame = binary.BigEndian.AppendUint64(append(frame, 127), uint64(n))
+	}
+	return append(frame, payload...)
+}
+
+// flateMessages compresses every message with compress/flate at the level
+// specified as payloads, with the same writer if takeover is set.
+func flateMessages(level int, takeover bool, messages ...string) [][]byte {
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, level)
+	payloads := make([][]byte, len(messages))
+	for i, msg := range messages {
+		if !takeover {
+			fw.Reset(&buf)
+		}
+		fw.Write([]byte(msg))
+		fw.Flush()
+		payloads[i] = bytes.Clone(bytes.TrimSuffix(buf.Bytes(), []byte{0, 0, 0xff, 0xff}))
+		buf.Reset()
+	}
+	return payloads
+}
+
+func TestRead_Compressed(t *testing.T) {
+	// the last message is sent in fragments, only the first of which has
+	// rsv1, and is followed by a message that is not compressed
+	messages := []string{loremIpsum, loremIpsum, "", "hello", strings.Repeat("abc", 30000), loremIpsum}
+	for _, level := range []int{flate.BestSpeed, flate.BestCompression, flate.HuffmanOnly, flate.NoCompression} {
+		for _, takeover := range []bool{true, false} {
+			for _, reuse := range []bool{false, true} {
+				mockConn := &MockNetConn{}
+				payloads := flateMessages(level, takeover, messages...)
+				for _, payload := range payloads[:len(payloads)-1] {
+					mockConn.buf.Write(rawFrame(0xC1, payload)) // fin, rsv1, text
+				}
+				last := payloads[len(payloads)-1]
+				mockConn.buf.Write(rawFrame(0x41, last[:10]))
+				mockConn.buf.Write(rawFrame(0x00, last[10:20]))
+				mockConn.buf.Write(rawFrame(0x80, last[20:]))
+				mockConn.buf.Write(rawFrame(0x82, []byte("plain")))
+
+				params := websocket.CompressionParams{ServerNoContextTakeover: !takeover, ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}
+				conn := websocket.From(mockConn, websocket.WithRole(websocket.RoleClient), websocket.WithNegotiatedCompression(params), websocket.WithReadBufferReuse(reuse))
+				for _, expected := range append(messages, "plain") {
+					msg, err := conn.Read()
+					if err != nil {
+						t.Fatalf("reading at level %d (takeover %t, reuse %t): %v", level, takeover, reuse, err)
+					}
+					if string(msg.Data) != expected {
+						t.Fatalf("expected a message of %d bytes at level %d (takeover %t, reuse %t), got %d bytes", len(expected), level, takeover, reuse, len(msg.Data))
+					}
+				}
+				stats := conn.Stats().Compression
+				if stats.MessagesDecompressed != uint64(len(messages)) || stats.BytesAfterDecompression != uint64(len(strings.Join(messages, ""))) {
+					t.Fatalf("expected %d messages to be counted as decompressed, got %+v", len(messages), stats)
+				}
+			}
+		}
+	}
+}
+
+func TestRead_CompressedInvalid(t *testing.T) {
+	payload := flateMessages(flate.BestSpeed, false, "hello")[0]
+	params := websocket.CompressionParams{ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}
+	for _, test := range []struct {
+		name       string
+		negotiated bool
+		frames     [][]byte
+	}{
+		{"not negotiated", false, [][]byte{rawFrame(0xC1, payload)}},
+		{"rsv2", true, [][]byte{rawFrame(0xA1, payload)}},
+		{"rsv1 on a continuation frame", true, [][]byte{rawFrame(0x41, payload[:2]), rawFrame(0xC0, payload[2:])}},
+		{"rsv1 on a ping", true, [][]byte{rawFrame(0xC9, nil)}},
+		{"rsv1 on a close frame", true, [][]byte{rawFrame(0xC8, nil)}},
+		{"corrupt payload", true, [][]byte{rawFrame(0xC1, []byte{0xff, 0xff, 0xff})}},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			mockConn := &MockNetConn{}
+			for _, frame := range test.frames {
+				mockConn.buf.Write(frame)
+			}
+			opts := []websocket.Option{websocket.WithRole(websocket.RoleClient)}
+			if test.negotiated {
+				opts = append(opts, websocket.WithNegotiatedCompression(params))
+			}
+			conn := websocket.From(mockConn, opts...)
+			if _, err := conn.Read(); !errors.Is(err, websocket.ErrMalformedFrame) {
+				t.Fatalf("expected a MALFORMED_FRAME error, got %v", err)
+			}
+		})
+	}
+}
+
+func TestRead_CompressedBomb(t *testing.T) {
+	mockConn := &MockNetConn{}
+	mockConn.buf.Write(rawFrame(0xC2, bomb()))
+	params := websocket.CompressionParams{ServerMaxWindowBits: 15, ClientMaxWindowBits: 15}
+	conn := websocket.From(mockConn, websocket.WithRole(websocket.RoleClient), websocket.WithNegotiatedCompression(params), websocket.WithReadLimit(1<<20))
+	if _, err := conn.Read(); !errors.Is(err, websocket.ErrMessageTooLarge) {
+		t.Fatalf("expected a MESSAGE_TOO_LARGE error, got %v", err)
+	}
+}
+
+// writeAll writes the messages to conn from another goroutine, returning
+// the first error, if any, once they are all written.
+func writeAll(conn *websocket.Conn, messages []*websocket.Message) <-chan websocket.Error {
+	done := make(chan websocket.Error, 1)
+	go func() {
+		for _, msg := range messages {
+			if err := conn.Write(msg); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	return done
+}
+
+func TestWrite_Compressed(t *testing.T) {
+	messages := []struct {
+		msg        *websocket.Message
+		compressed bool
+	}{
+		{textMessage(loremIpsum), true},
+		{textMessage(loremIpsum), true},
+		{textMessage("hello"), false}, // below the threshold
+		{&websocket.Message{Type: websocket.MessageBinary, Data: bytes.Repeat([]byte("abc"), 30000)}, true},
+		{&websocket.Message{Type: websocket.MessageText, Data: []byte("hi"), Compress: websocket.CompressAlways}, true},
+		{&websocket.Message{Type: websocket.MessageText, Compress: websocket.CompressAlways}, true},
+		{&websocket.Message{Type: websocket.MessageBinary, Data: []byte(loremIpsum), Compress: websocket.CompressNever}, false},
+		{textMessage(loremIpsum), true},
+	}
+	for _, takeover := range []bool{true, false} {
+		for _, level := range []int{flate.BestSpeed, flate.BestCompression, flate.HuffmanOnly, flate.NoCompression} {
+			for _, fragmentSize := range []int{0, 1000} {
+				opts := websocket.CompressionOptions{ServerNoContextTakeover: !takeover, ClientNoContextTakeover: !takeover}
+				client, server := websocket.Pipe(websocket.WithCompression(opts), websocket.WithWriteFragmentSize(fragmentSize))
+				defer client.Close()
+				defer server.Close()
+				for _, conns := range [][2]*websocket.Conn{{client, server}, {server, client}} {
+					w, r := conns[0], conns[1]
+					if err := w.SetCompressionLevel(level); err != nil {
+						t.Fatalf("setting the level: %v", err)
+					}
+					var first []bool // whether the first frame of each message had rsv1
+					var continuations int
+					w.SetFrameHooks(nil, func(info websocket.FrameInfo) {
+						if info.Opcode == 0 {
+							continuations++
+							if info.Rsv1 {
+								t.Errorf("expected rsv1 to only be set on the first frame")
+							}
+							return
+						}
+						first = append(first, info.Rsv1)
+					})
+					msgs := make([]*websocket.Message, len(messages))
+					for i, m := range messages {
+						msgs[i] = m.msg
+					}
+					done := writeAll(w, msgs)
+					for i, m := range messages {
+						msg, err := r.Read()
+						if err != nil {
+							t.Fatalf("reading message %d: %v", i, err)
+						}
+						if msg.Type != m.msg.Type || !bytes.Equal(msg.Data, m.msg.Data) {
+							t.Fatalf("expected message %d to round-trip, got %d bytes instead of %d", i, len(msg.Data), len(m.msg.Data))
+						}
+					}
+					if err := <-done; err != nil {
+						t.Fatalf("writing: %v", err)
+					}
+
+					var compressed, skipped uint64
+					for i, m := range messages {
+						if first[i] != m.compressed {
+							t.Fatalf("expected rsv1 to be %t for message %d (takeover %t, level %d)", m.compressed, i, takeover, level)
+						}
+						if m.compressed {
+							compressed++
+						} else {
+							skipped++
+						}
+					}
+					if fragmentSize > 0 && continuations == 0 {
+						t.Fatalf("expected the large messages to be fragmented")
+					}
+					ws, rs := w.Stats().Compression, r.Stats().Compression
+					if ws.MessagesCompressed != compressed || ws.MessagesSkipped != skipped || rs.MessagesDecompressed != compressed {
+						t.Fatalf("expected %d messages compressed and %d skipped, got %+v and %+v", compressed, skipped, ws, rs)
+					}
+					if ws.BytesBeforeCompression != rs.BytesAfterDecompression || ws.BytesAfterCompression != rs.BytesBeforeDecompression {
+						t.Fatalf("expected the counters of both sides to match, got %+v and %+v", ws, rs)
+					}
+					if level != flate.NoCompression && ws.WriteRatio() >= 0.5 {
+						t.Fatalf("expected the messages to be compressed, got a ratio of %v", ws.WriteRatio())
+					}
+				}
+			}
+		}
+	}
+}
+
+func TestWrite_CompressedText(t *testing.T) {
+	// WriteText and WritePrepared compress like Write
+	client, server := websocket.Pipe(websocket.WithCompression(websocket.CompressionOptions{}))
+	defer client.Close()
+	defer server.Close()
+	pm, _ := websocket.NewPreparedMessage(textMessage(loremIpsum))
+	done := make(chan websocket.Error, 1)
+	go func() {
+		for _, write := range []func() websocket.Error{
+			func() websocket.Error { return server.WriteText(loremIpsum) },
+			func() websocket.Error { return server.WriteText("hello") },
+			func() websocket.Error { return server.WritePrepared(pm) },
+		} {
+			if err := write(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for _, expected := range []string{loremIpsum, "hello", loremIpsum} {
+		msg, err := client.Read()
+		if err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+		if string(msg.Data) != expected {
+			t.Fatalf("expected the message to round-trip, got %q", msg.Data)
+		}
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	if s := server.Stats().Compression; s.MessagesCompressed != 2 || s.MessagesSkipped != 1 {
+		t.Fatalf("expected 2 messages compressed and 1 skipped, got %+v", s)
+	}
+}
+
+func TestWrite_CompressedConcurrent(t *testing.T) {
+	// with context takeover, the messages must be written in the order they
+	// are compressed in
+	client, server := websocket.Pipe(websocket.WithCompression(websocket.CompressionOptions{}))
+	defer client.Close()
+	defer server.Close()
+	const writers, perWriter = 8, 20
+	var wg sync.WaitGroup
+	errs := make(chan websocket.Error, writers)
+	for g := range writers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := range perWriter {
+				if err := client.WriteText(fmt.Sprintf("%d %d %s", g, i, loremIpsum)); err != nil {
+					errs <- err
+					return
+				}
+			}
+		}()
+	}
+	seen := make(map[string]bool)
+	for range writers * perWriter {
+		msg, err := server.Read()
+		if err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+		prefix, rest, _ := strings.Cut(string(msg.Data), " ")
+		second, rest, _ := strings.Cut(rest, " ")
+		if rest != loremIpsum || seen[prefix+" "+second] {
+			t.Fatalf("expected every message to round-trip once, got %q", msg.Data[:min(len(msg.Data), 32)])
+		}
+		seen[prefix+" "+second] = true
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+}
+
+func TestWrite_CompressedControl(t *testing.T) {
+	client, server := websocket.Pipe(websocket.WithCompression(websocket.CompressionOptions{}))
+	defer client.Close()
+	defer server.Close()
+	server.SetCompressionThreshold(0)
+	var rsv1 []bool
+	server.SetFrameHooks(nil, func(info websocket.FrameInfo) { rsv1 = append(rsv1, info.Rsv1) })
+	go readLoop(client)
+	go readLoop(server) // for the pong
+	if err := server.Write(&websocket.Message{Type: websocket.MessagePing, Data: bytes.Repeat([]byte{'a'}, 125)}); err != nil {
+		t.Fatalf("writing a ping: %v", err)
+	}
+	if err := server.WriteText(""); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	if len(rsv1) != 2 || rsv1[0] || !rsv1[1] {
+		t.Fatalf("expected only the text message to be compressed, got %v", rsv1)
+	}
+}
+
+func TestSetCompressionLevel(t *testing.T) {
+	for _, level := range []int{flate.HuffmanOnly - 1, flate.BestCompression + 1} {
+		if err := websocket.From(new(CountingConn)).SetCompressionLevel(level); !errors.Is(err, websocket.ErrInvalidCompressionLevel) {
+			t.Fatalf("expected an INVALID_COMPRESSION_LEVEL error for %d, got %v", level, err)
+		}
+	}
+	if err := websocket.From(new(CountingConn)).SetCompressionLevel(flate.BestCompression); err != nil {
+		t.Fatalf("expected the level to be ignored without compression, got %v", err)
+	}
+
+	// changing the level drops the window of the previous messages, which
+	// the peer decompresses all the same
+	client, server := websocket.Pipe(websocket.WithCompression(websocket.CompressionOptions{}))
+	defer client.Close()
+	defer server.Close()
+	go readLoop(client)
+	sizes := make(map[int]uint64)
+	for _, level := range []int{flate.BestCompression, flate.BestCompression, flate.HuffmanOnly, flate.DefaultCompression, flate.NoCompression} {
+		if err := server.SetCompressionLevel(level); err != nil {
+			t.Fatalf("setting the level: %v", err)
+		}
+		before := server.Stats().Compression.BytesAfterCompression
+		if err := server.WriteText(loremIpsum); err != nil {
+			t.Fatalf("writing: %v", err)
+		}
+		if _, ok := sizes[level]; !ok {
+			sizes[level] = server.Stats().Compression.BytesAfterCompression - before
+		}
+	}
+	if !(sizes[flate.BestCompression] < sizes[flate.HuffmanOnly] && sizes[flate.HuffmanOnly] < uint64(len(loremIpsum)) && sizes[flate.NoCompression] > uint64(len(loremIpsum))) {
+		t.Fatalf("expected the payload to be compressed more at higher levels, got %v", sizes)
+	}
+}
+
+func TestSetCompressionThreshold(t *testing.T) {
+	client, server := websocket.Pipe(websocket.WithCompression(websocket.CompressionOptions{}))
+	defer client.Close()
+	defer server.Close()
+	go readLoop(client)
+	for _, test := range []struct {
+		threshold  int
+		data       string
+		compressed uint64
+	}{
+		{512, strings.Repeat("a", 511), 0},
+		{512, strings.Repeat("a", 512), 1},
+		{0, "a", 2},
+		{1 << 20, loremIpsum, 2},
+	} {
+		server.SetCompressionThreshold(test.threshold)
+		if err := server.WriteText(test.data); err != nil {
+			t.Fatalf("writing: %v", err)
+		}
+		if n := server.Stats().Compression.MessagesCompressed; n != test.compressed {
+			t.Fatalf("expected %d messages compressed with a threshold of %d, got %d", test.compressed, test.threshold, n)
+		}
+	}
+}
@@ -1,36 +1,242 @@
 package websocket
 
 import (
+	"bufio"
 	"context"
-	"encoding/binary"
+	"crypto/rand"
 	"io"
 	"log/slog"
+	"net"
+	"slices"
 	"sync"
+	"sync/atomic"
 	"time"
+	"unicode/utf8"
+
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+const (
+	// closeTimeout is how long closeWithCode waits for the close frame to
+	// be written, and Close for the write queue to be drained, before
+	// giving up on them.
+	closeTimeout = time.Second
+
+	// defaultPingTimeout is how long Ping waits for a pong when it is called
+	// with a nil context, unless set with SetPingTimeout.
+	defaultPingTimeout = time.Second * 5
+
+	// maxControlPayloadLength is the maximum payload length of a control
+	// frame.
+	maxControlPayloadLength = 125
 )
 
+// lastConnID is the ID of the most recently created Conn.
+var lastConnID atomic.Uint64
+
 // Conn represents a WebSocket connection. All public methods on Conn
 // are safe to be simultaneously called.
 type Conn struct {
+	id         uint64
 	underlying io.ReadWriteCloser
+	reader     io.Reader // reads from underlying, possibly through a buffer
 	rmx        sync.Mutex
 	wmx        sync.Mutex
 	ctx        context.Context
 	cancel     context.CancelFunc
-	closed     bool
+	closed     atomic.Bool
+	closeOnce  sync.Once
+	closeSent  atomic.Bool  // whether a close frame has been written
+	state      atomic.Int32 // a ConnState
+
+	// held by the data message being written, from NextWriter until its
+	// writer is closed, and by Write meanwhile; see lockMessage
+	messageLock chan struct{}
+
+	// modeMessage or modeFrame once a method of either mode is called,
+	// and whether a close frame was read in frame mode
+	mode          atomic.Int32
+	closeReceived atomic.Bool
+
+	stateHandler atomic.Pointer[func(old, new ConnState)]
+	err          atomic.Pointer[Error] // the error that ended the connection
+
+	// the state changes the state change handler was not called with yet,
+	// guarded by stateMx, which are deferred while the read mutex is held
+	// by a Read that is not blocked reading from the underlying connection
+	stateMx         sync.Mutex
+	stateChanges    []stateChange
+	stateDelivering bool
+	statesDeferred  atomic.Bool
+
+	pings   map[string]*pendingPing
+	pingSeq uint64
+	pingMx  sync.Mutex
+
+	pingTimeout atomic.Int64
+
+	pingHandler atomic.Pointer[func(payload []byte) error]
+	pongHandler atomic.Pointer[func(payload []byte) error]
+
+	keepalive    atomic.Pointer[keepalive]
+	lastRTT      atomic.Int64
+	pongMisses   atomic.Int64
+	onPongMissed atomic.Pointer[func(consecutiveMisses int)]
+
+	queue atomic.Pointer[writeQueue]
+
+	// when the write to the underlying connection holding the write mutex
+	// started in Unix nanoseconds, or 0, and the watch set with
+	// SetStallThreshold
+	writeStart atomic.Int64
+	stallWatch atomic.Pointer[stallWatch]
 
-	pingCtx    context.Context
-	pingCancel context.CancelFunc
-	pingMx     sync.Mutex
+	wbuf         []byte
+	wbufSize     int
+	flushLatency time.Duration
+	flushTimer   *time.Timer
+
+	clock   clock.Clock
+	limiter atomic.Pointer[tokenBucket]
+	// the deadline set with SetWriteDeadline, and a channel closed once it
+	// changes, for the writes waiting for the write rate limit, guarded by
+	// deadlineMx
+	deadlineMx      sync.Mutex
+	writeDeadline   time.Time
+	deadlineChanged chan struct{}
+
+	validateText atomic.Bool
+	// the checks enforced on what is read, and whether they were set with
+	// WithStrictMode rather than left to the default of the role
+	strict     StrictMode
+	strictSet  bool
+	writeLimit atomic.Int64
+
+	values sync.Map // set with Set
+
+	stats    connStats
+	activity connActivity
+
+	// set with WithCompression, and negotiated with permessage-deflate or
+	// nil, with the deflater and inflater created for it
+	compressionOptions *CompressionOptions
+	compression        *CompressionParams
+	deflater           *deflater
+	inflater           *inflater
+	// the size of the smallest payload compressed, see
+	// SetCompressionThreshold
+	compressionThreshold atomic.Int64
+	maxExpansionRatio    int // set with WithMaxExpansionRatio
+
+	// set with SetIdleTimeout, and with WithIdleTimeout until the Conn is
+	// created
+	idleTimeout       atomic.Pointer[idleTimeout]
+	idleTimeoutOption *idleTimeout
+	// set with SetFrameHooks and SetFrameHookPayloadLimit
+	frameHooks       atomic.Pointer[frameHooks]
+	frameHookPayload atomic.Int64
+	accepted         bool // whether the connection was accepted by AcceptHTTP
+
+	logger         *slog.Logger
+	wireLog        io.Writer             // set with WithWireLog
+	tcpOptions     []func(c *Conn) Error // set with WithTCPNoDelay and the like
+	role           Role
+	readLimit      int64
+	readBufferSize int // set with WithReadBufferSize
+	fragmentSize   int
+
+	pauseMx            sync.Mutex
+	resumed            chan struct{} // not nil while reading is paused
+	controlWhilePaused bool
+
+	// the fragmented message being read, guarded by rmx
+	fragmented         bool
+	fragmentType       MessageType
+	fragmentCompressed bool
+	fragments          []byte
+
+	// the header of the frame being read, guarded by rmx: the first two
+	// bytes, the extended payload length, and the mask key
+	rheader [14]byte
+
+	// set with WithLowMemory: fixedWbuf is the buffer data frames are
+	// encoded in, guarded by fixedWmx
+	lowMemory bool
+	fixedWbuf []byte
+	fixedWmx  sync.Mutex
+
+	// set with WithReadBufferReuse, guarded by rmx
+	reuseReadBuffer bool
+	rbuf            []byte  // the payload of the message being read
+	inflateBuf      []byte  // the payload of the message read, once decompressed
+	rmsg            Message // the message returned by Read
 }
 
 // From returns a new WebSocket Conn from a value with a type that
 // implements the io.ReadWriteCloser interface, notably net.Conn.
 // It is expected that this connection will not be read from,
-// written to, or closed once passed into this function.
-func From(c io.ReadWriteCloser) *Conn {
+// written to, or closed once passed into this function. The Conn
+// is configured with the options specified, if any.
+func From(c io.ReadWriteCloser, opts ...Option) *Conn {
+	return newConn(opts).attach(c)
+}
+
+// newConn returns a new Conn configured with the options specified, which
+// has no underlying connection until attach is called. The handshakes
+// create it before they respond, since some options, such as
+// WithCompression, change what they respond.
+func newConn(opts []Option) *Conn {
 	ctx, cancel := context.WithCancel(context.Background())
-	return &Conn{underlying: c, rmx: sync.Mutex{}, wmx: sync.Mutex{}, ctx: ctx, cancel: cancel, closed: false}
+	conn := &Conn{rmx: sync.Mutex{}, wmx: sync.Mutex{}, messageLock: make(chan struct{}, 1), ctx: ctx, cancel: cancel, clock: clock.Real{}}
+	conn.pingTimeout.Store(int64(defaultPingTimeout))
+	for _, opt := range opts {
+		opt(conn)
+	}
+	if !conn.strictSet && conn.role == RoleServer {
+		conn.strict = Strict
+	}
+	return conn
+}
+
+// attach makes rwc the underlying connection of the Conn created by
+// newConn, and applies the options that need it. It returns the Conn.
+func (c *Conn) attach(rwc io.ReadWriteCloser) *Conn {
+	c.id = lastConnID.Add(1)
+	c.underlying, c.reader = rwc, rwc
+	if c.wireLog != nil {
+		c.wrapWireLog()
+	}
+	if c.readBufferSize > 0 {
+		c.reader = bufio.NewReaderSize(c.underlying, c.readBufferSize)
+	}
+	if c.logger == nil {
+		c.logger = slog.Default()
+	}
+	c.logger = c.logger.With("conn_id", c.id)
+	if addr := c.RemoteAddr(); addr != nil {
+		c.logger = c.logger.With("remote_addr", addr.String())
+	}
+	if c.tcpOptions != nil {
+		c.applyTCPOptions()
+	}
+	if c.lowMemory {
+		c.applyLowMemory()
+	}
+	if c.compression != nil {
+		c.setupCompression()
+	}
+	if t := c.idleTimeoutOption; t != nil {
+		c.SetIdleTimeout(t.timeout, t.policy)
+	}
+	return c
+}
+
+// Logger returns the logger the connection logs to, which includes the
+// attributes identifying the connection: its ID and, if there is one, its
+// remote address. Helpers built on top of Conn
+// should log to it too. See WithLogger.
+func (c *Conn) Logger() *slog.Logger {
+	return c.logger
 }
 
 // Context returns the context used for the connection. It should
@@ -39,221 +245,832 @@ func (c *Conn) Context() context.Context {
 	return c.ctx
 }
 
+// LocalAddr returns the local network address of the underlying connection.
+// It returns nil if the underlying connection is not a net.Conn.
+func (c *Conn) LocalAddr() net.Addr {
+	if nc := c.NetConn(); nc != nil {
+		return nc.LocalAddr()
+	}
+	return nil
+}
+
+// RemoteAddr returns the remote network address of the underlying
+// connection. It returns nil if the underlying connection is not a
+// net.Conn.
+func (c *Conn) RemoteAddr() net.Addr {
+	if nc := c.NetConn(); nc != nil {
+		return nc.RemoteAddr()
+	}
+	return nil
+}
+
+// NetConn returns the underlying connection if it is a net.Conn, such as the
+// connection hijacked by AcceptHTTP, or nil otherwise. It is for setting
+// deadlines and tuning TCP options only: do not read from, write to, or
+// close it, as that corrupts the WebSocket connection.
+func (c *Conn) NetConn() net.Conn {
+	nc, _ := c.underlying.(net.Conn)
+	return nc
+}
+
+// Closed reports whether the connection is closed. A connection is closed
+// once Close has been called, the peer has closed it, or reading from the
+// underlying connection failed.
+func (c *Conn) Closed() bool {
+	return c.closed.Load()
+}
+
+// Done returns a channel that is closed once the connection is closed, in
+// whichever way that happens. It is the same channel as Context().Done().
+func (c *Conn) Done() <-chan struct{} {
+	return c.ctx.Done()
+}
+
+// Wait blocks until the connection is closed and returns the error that
+// ended it (see Err), or until ctx is done and returns ctx.Err(). It
+// returns right away if the connection is already closed. Any amount of
+// goroutines may wait at the same time and they all get the same error.
+//
+// Wait does not read from the connection, so pongs and close frames are
+// only noticed if something else is reading.
+func (c *Conn) Wait(ctx context.Context) error {
+	select {
+	case <-c.ctx.Done():
+		return c.Err()
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Err returns nil while the connection is open. Once the connection is
+// closed, it returns the error that ended it, like context.Context.Err:
+//
+//   - ErrConnectionClosed if Close was called.
+//   - A CONNECTION_CLOSED error wrapping a *CloseError if the peer closed the
+//     connection or the underlying connection ended without a close frame.
+//   - The error of whatever else ended the connection, such as a read error,
+//     a PING_TIMEOUT error for missed keepalive pongs, or a write error for a
+//     pong or queued message that could not be written.
+//
+// Read and Write return a CONNECTION_CLOSED error wrapping this error once
+// the connection is closed, so errors.Is and errors.As can find it.
+func (c *Conn) Err() error {
+	if err := c.err.Load(); err != nil {
+		return *err
+	}
+	return nil
+}
+
+// setErr records err as the error that ended the connection, unless one is
+// recorded already.
+func (c *Conn) setErr(err Error) {
+	c.err.CompareAndSwap(nil, &err)
+}
+
+// fail records err as the error that ended the connection and closes it.
+func (c *Conn) fail(err Error) {
+	c.setErr(err)
+	c.Close()
+}
+
+// closedError returns the error for using the connection once it is
+// closed, wrapping the error that ended it.
+func (c *Conn) closedError() Error {
+	p := c.err.Load()
+	switch {
+	case p == nil:
+		return errorf(CONNECTION_CLOSED)
+	case (*p).Kind() == CONNECTION_CLOSED:
+		return *p
+	default:
+		return wrapError(CONNECTION_CLOSED, *p)
+	}
+}
+
+// writable returns the error for writing a message once the connection is
+// closed, or once a close frame was written, after which nothing else may
+// be sent (RFC 6455, section 5.5.1).
+func (c *Conn) writable() Error {
+	if c.closed.Load() || c.closeSent.Load() {
+		return c.closedError()
+	}
+	return nil
+}
+
 // Close marks the connection as closed and closes the underlying
 // connection. It may return an error if there is an issue closing
-// the underlying connection.
+// the underlying connection. Any pending Ping calls return once the
+// connection is closed.
+//
+// Close does not wait for a blocked Read: closing the underlying connection
+// makes it return a CONNECTION_CLOSED error.
+//
+// Close is idempotent: only the first call closes the connection and
+// every later (or concurrent) call returns nil.
 func (c *Conn) Close() error {
-	c.rmx.Lock()
+	c.setErr(ErrConnectionClosed)
+	var err error
+	closed := false
+	c.closeOnce.Do(func() {
+		err = c.close()
+		closed = true
+	})
+	if closed {
+		if c.accepted {
+			acceptStats.closed.Add(1)
+		}
+		c.setState(StateClosed)
+	}
+	return err
+}
+
+// close closes the connection. It must only be called once.
+func (c *Conn) close() error {
+	if q := c.queue.Load(); q != nil {
+		q.close()
+		if !q.wait(closeTimeout) {
+			// the peer stopped reading, so the queued messages are given up
+			// on, and closing the underlying connection makes the blocked
+			// write return
+			q.fail(errorf(CONNECTION_CLOSED))
+			c.closed.Store(true)
+			c.cancel()
+			err := c.underlying.Close()
+			<-q.done
+			return err
+		}
+	}
+	// the read mutex is not held so that closing the underlying connection
+	// can interrupt a blocked Read
+	c.closed.Store(true)
+	c.cancel()
 	c.wmx.Lock()
-	defer c.rmx.Unlock()
 	defer c.wmx.Unlock()
-	c.cancel()
-	c.closed = true
+	if err := c.flush(); err != nil {
+		c.logger.Error("an error occured while flushing the write buffer on close", "error", err.Error())
+	}
+
 	return c.underlying.Close()
 }
 
-// Read reads a WebSocket frame from the underlying connection. If there
-// is an issue reading the frame or the frame is malformed, it may return
-// an error.
+// Read reads a WebSocket message from the underlying connection. If there
+// is an issue reading the message or a frame is malformed, it may return
+// an error; a MALFORMED_FRAME error also closes the connection with
+// CloseProtocolError. The fragments of a fragmented message are put back
+// together, and control messages sent between the fragments are returned
+// as they arrive. If compression was negotiated (see WithCompression),
+// compressed messages are decompressed, so they are returned like any
+// other.
+//
+// When the peer sends a close frame, Read responds with a close frame
+// echoing its code, closes the connection, and returns a CONNECTION_CLOSED
+// error wrapping a *CloseError with the peer's code and reason. If the
+// underlying connection ends without a close frame, the CloseError has
+// code 1006 (abnormal closure). Use IsCloseError and
+// IsUnexpectedCloseError to check how the connection ended.
+//
+// If a read deadline of the underlying connection passes before any of
+// the next frame is read, Read returns a timeout and the connection stays
+// open, so reading may resume. If it passes while a frame is being read,
+// the rest of the frame is lost, so the connection is closed.
 func (c *Conn) Read() (*Message, Error) {
-	c.rmx.Lock()
-	defer c.rmx.Unlock()
-	if c.closed {
-		return nil, errorf(CONNECTION_CLOSED)
+	if err := c.setMode(modeMessage); err != nil {
+		return nil, err
+	}
+	message, err := c.read()
+	if err != nil && err.Kind() != CONNECTION_CLOSED {
+		c.stats.readErrors.Add(1)
+		c.failMalformed(err)
+	}
+	return message, err
+}
+
+// failMalformed closes the connection with CloseProtocolError if err is a
+// MALFORMED_FRAME error, since what the peer sends after a malformed frame
+// cannot be read, unless the connection is closed already, such as after
+// a malformed close frame.
+func (c *Conn) failMalformed(err Error) {
+	if err.Kind() == MALFORMED_FRAME && !c.closed.Load() {
+		c.setErr(err)
+		c.closeWithCode(CloseProtocolError, "")
 	}
-	message := new(Message)
+}
+
+// read reads a message, see Read.
+func (c *Conn) read() (*Message, Error) {
+	c.lockRead()
+	defer c.unlockRead()
+	for {
+		if c.closed.Load() {
+			return nil, c.closedError()
+		}
+		header, err := c.waitPaused()
+		if err != nil {
+			return nil, err
+		}
+		h, payload, err := c.readFrame(header)
+		if err != nil {
+			return nil, err
+		}
+
+		messageType := h.messageType
+		if isControl(messageType) {
+			c.countMessageRead(messageType)
+		}
+		switch messageType {
+		case MessageClose:
+			return nil, c.handleClose(payload)
+		case MessagePing:
+			if err := c.handlePing(payload); err != nil {
+				return nil, errorf(CONTROL_HANDLER_ERROR, err)
+			}
+			return c.message(messageType, payload), nil
+		case MessagePong:
+			if err := c.handlePong(payload); err != nil {
+				return nil, errorf(CONTROL_HANDLER_ERROR, err)
+			}
+			return c.message(messageType, payload), nil
+		case MessageContinuation:
+			if !c.fragmented { // there is no fragmented message to continue
+				return nil, errorf(MALFORMED_FRAME, "unexpected continuation frame")
+			}
+			c.fragments = append(c.fragments, payload...)
+		default:
+			if c.fragmented {
+				return nil, errorf(MALFORMED_FRAME, "expected a continuation frame")
+			}
+			c.fragmentType = messageType
+			c.fragmentCompressed = h.rsv&rsv1 != 0
+			c.fragments = payload
+		}
 
-	header := make([]byte, 2) // includes fin, rsv1, rsv2, rsv3, and opcode
+		if c.reuseReadBuffer { // the payload was read after the fragments
+			c.fragments = c.rbuf
+		}
+		if !h.fin {
+			c.fragmented = true
+			continue
+		}
+		data := c.fragments
+		c.fragmented = false
+		c.fragments = nil
+		if c.fragmentCompressed {
+			if data, err = c.decompressMessage(data); err != nil {
+				return nil, err
+			}
+		}
+		if c.fragmentType == MessageText && c.strict.UTF8 && !utf8.Valid(data) {
+			err := errorf(INVALID_UTF8)
+			c.setErr(err)
+			c.closeWithCode(CloseInvalidFramePayloadData, "")
+			return nil, err
+		}
+		c.countMessageRead(c.fragmentType)
+		return c.message(c.fragmentType, data), nil
+	}
+}
 
-	n, err := c.underlying.Read(header)
+// readHeader reads the first two bytes of a frame, which include fin,
+// rsv1, rsv2, rsv3, the opcode, the mask bit, and the payload length.
+func (c *Conn) readHeader() ([]byte, Error) {
+	header := c.rheader[:2]
+	c.readBlocking(true)
+	n, err := io.ReadFull(c.reader, header)
+	c.readBlocking(false)
 	if err != nil {
-		return nil, errorf(CONNECTION_READ_ERROR, err.Error())
+		return nil, c.readError(err, n > 0)
 	}
-	if n != 2 {
-		return nil, errorf(MALFORMED_FRAME, "read 0 bytes, expected 1")
+	return header, nil
+}
+
+// frameHeader is everything about a frame that comes before its payload.
+type frameHeader struct {
+	fin         bool // whether it is the final fragment of a message
+	opcode      byte
+	rsv         byte // the rsv1, rsv2, and rsv3 bits, in place
+	messageType MessageType
+	length      int64 // of the payload
+	masked      bool
+	// the length of the header: 2 bytes, the extended payload
+	// length, and the mask key
+	headerLength int
+	maskKey      [4]byte
+}
+
+// rsv1 is the bit of the first byte of a frame that marks the first frame
+// of a compressed message.
+const rsv1 = 0x40
+
+// maxRetainedReadBuffer is the capacity above which the buffer reused by
+// Read is dropped once it is not needed anymore, so that a single large
+// message does not keep its memory for the lifetime of the connection.
+const maxRetainedReadBuffer = 1 << 20
+
+// payloadChunkSize is the size of the payloads that are allocated at once.
+// Larger payloads are read into a buffer that grows as their bytes
+// arrive, so that a peer declaring a large payload without sending it
+// does not make the connection allocate it.
+const payloadChunkSize = 64 << 10
+
+// appendPayload appends n bytes read from r to buf. If buf does not have
+// the capacity for them, it grows by at most payloadChunkSize or by as
+// much as was read so far, whichever is larger, as the bytes arrive, so
+// that its capacity is never much more than what was actually read.
+func appendPayload(buf []byte, r io.Reader, n int) ([]byte, error) {
+	for n > 0 {
+		if len(buf) == cap(buf) {
+			buf = slices.Grow(buf, min(n, max(len(buf), payloadChunkSize)))
+		}
+		chunk := min(n, cap(buf)-len(buf))
+		read, err := io.ReadFull(r, buf[len(buf):len(buf)+chunk])
+		buf = buf[:len(buf)+read]
+		n -= read
+		if err != nil {
+			return buf, err
+		}
 	}
+	return buf, nil
+}
 
-	fin := (header[0] & 0x80) != 0
+// message returns the message Read returns, which is the reused message if
+// the read buffer is reused. The read mutex must be held.
+func (c *Conn) message(messageType MessageType, data []byte) *Message {
+	if !c.reuseReadBuffer {
+		return &Message{Type: messageType, Data: data}
+	}
+	c.rmsg = Message{Type: messageType, Data: data}
+	return &c.rmsg
+}
 
-	// FIXME: fragmented frames are not supported
-	if !fin { // if frame is fragmented (0 means fragmented, 1 means final)
-		return nil, errorf(MALFORMED_FRAME, "fragmented frames are not supported")
+// readFrame reads a single frame from the underlying connection and
+// returns its header and its unmasked payload. If header is not nil, it is
+// the first two bytes of the frame, which were already read. The read
+// mutex must be held.
+func (c *Conn) readFrame(header []byte) (frameHeader, []byte, Error) {
+	h, err := c.readFrameHeader(header)
+	if err != nil {
+		return frameHeader{}, nil, err
+	}
+	payload, err := c.readFramePayload(h)
+	if err != nil {
+		return frameHeader{}, nil, err
 	}
+	return h, payload, nil
+}
 
-	rsv1 := (header[0] & 0x40) != 0
-	rsv2 := (header[0] & 0x20) != 0
-	rsv3 := (header[0] & 0x10) != 0
+// readFramePayload reads the payload of the frame with the header h, once
+// it is checked against the read limit, and unmasks it. The read mutex
+// must be held.
+func (c *Conn) readFramePayload(h frameHeader) ([]byte, Error) {
+	if c.readLimit > 0 && !isControl(h.messageType) && int64(len(c.fragments))+h.length > c.readLimit {
+		err := errorf(MESSAGE_TOO_LARGE, "read", c.readLimit)
+		c.setErr(err)
+		c.closeWithCode(CloseMessageTooBig, "")
+		return nil, err
+	}
 
-	if (rsv1 || rsv2 || rsv3) == true { // for extensions
-		return nil, errorf(MALFORMED_FRAME, "rsv1, rsv2, and/or rsv3 are specified")
+	payload, err := c.readPayload(h)
+	if err != nil {
+		return nil, err
 	}
+	c.frameRead(h, payload)
+	return payload, nil
+}
 
-	// op-coding
-	opcode := header[0] & 0x0F
-	switch opcode {
-	case 0x0:
-	case 0x1:
-		message.Type = MessageText
-	case 0x2:
-		message.Type = MessageBinary
-	case 0x8:
-		c.Close()
-		message.Type = MessageClose
-	case 0x9:
-		err := c.Write(&Message{
-			Type: MessagePong,
-			Data: []byte{},
-		})
-		if err != nil {
-			slog.Error("an error occured while sending pong as response to a ping", "error", err.Error())
-		}
-		message.Type = MessagePing
-	case 0xA:
-		c.pingMx.Lock()
-		if c.pingCancel != nil {
-			c.pingCancel()
+// readFrameHeader reads the rest of the header of a frame, up to its
+// payload, and checks it against the extensions negotiated and the
+// strict mode. If header is not nil, it is the first two bytes of the
+// frame, which were already read. The read mutex must be held.
+func (c *Conn) readFrameHeader(header []byte) (frameHeader, Error) {
+	h, err := c.readStructuralHeader(header)
+	if err != nil {
+		return frameHeader{}, err
+	}
+	if h.rsv != 0 && (h.rsv != rsv1 || c.inflater == nil) { // for extensions
+		return frameHeader{}, errorf(MALFORMED_FRAME, "rsv1, rsv2, and/or rsv3 are specified")
+	}
+	if h.rsv == rsv1 && h.messageType != MessageText && h.messageType != MessageBinary {
+		return frameHeader{}, errorf(MALFORMED_FRAME, "rsv1 is only allowed on the first frame of a data message")
+	}
+	if err := c.checkStrictHeader(&h); err != nil {
+		return frameHeader{}, err
+	}
+	return h, nil
+}
+
+// readStructuralHeader is readFrameHeader with only the checks of
+// ParseFrame, which frame mode is limited to. The read mutex must be
+// held.
+func (c *Conn) readStructuralHeader(header []byte) (frameHeader, Error) {
+	if header == nil {
+		var err Error
+		if header, err = c.readHeader(); err != nil {
+			return frameHeader{}, err
 		}
-		c.pingCtx = nil
-		c.pingCancel = nil
-		c.pingMx.Unlock()
-		message.Type = MessagePong
-	default:
-		return nil, errorf(MALFORMED_FRAME, "unknown opcode")
 	}
 
-	// payload length
-	payloadLength := int(header[1] & 0x7F) // extenstion data + application data in bytes
-	switch payloadLength {
-	case 126: // the following 16 bits (or 2 bytes) is the uint payload length
-		extendedPayloadLen := make([]byte, 2)
-		_, err = c.underlying.Read(extendedPayloadLen)
+	h, err := parseFrameStart(header[0], header[1])
+	if err != nil {
+		return frameHeader{}, err
+	}
+	if h.headerLength > 2 { // an extended payload length or a mask key
+		rest := c.rheader[2:h.headerLength]
+		c.readBlocking(true)
+		_, err := io.ReadFull(c.reader, rest)
+		c.readBlocking(false)
 		if err != nil {
-			return nil, errorf(CONNECTION_READ_ERROR, err.Error())
+			return frameHeader{}, c.readError(err, true)
 		}
-		payloadLength = int(binary.BigEndian.Uint16(extendedPayloadLen))
-	case 127: // the following 64 bits (or 8 bytes) is the uint payload length
-		extendedPayloadLen := make([]byte, 8)
-		_, err = c.underlying.Read(extendedPayloadLen)
-		if err != nil {
-			return nil, errorf(CONNECTION_READ_ERROR, err.Error())
+		if err := h.parseRest(rest); err != nil {
+			return frameHeader{}, err
 		}
-		payloadLength = int(binary.BigEndian.Uint64(extendedPayloadLen))
 	}
+	return h, nil
+}
 
-	// mask key
-	isMasked := ((header[1] >> 7) & 1) != 0
-	var maskKey []byte
-	if isMasked {
-		maskKey = make([]byte, 4)
-		_, err = c.underlying.Read(maskKey)
-		if err != nil {
-			return nil, errorf(CONNECTION_READ_ERROR, err)
+// readPayload reads the payload of the frame with the header specified
+// and unmasks it. If the read buffer is reused, the payload of a data
+// frame is read into it, after the fragments of the message read so far.
+// The read mutex must be held.
+func (c *Conn) readPayload(h frameHeader) ([]byte, Error) {
+	var buf []byte
+	reuse := c.reuseReadBuffer && !isControl(h.messageType)
+	if reuse {
+		if h.messageType != MessageContinuation {
+			if cap(c.rbuf) > maxRetainedReadBuffer && !c.lowMemory {
+				c.rbuf = nil
+			}
+			c.rbuf = c.rbuf[:0]
 		}
+		buf = c.rbuf
+	} else if h.length <= payloadChunkSize {
+		buf = make([]byte, 0, h.length)
+	}
+	start := len(buf)
+	c.readBlocking(true)
+	buf, err := appendPayload(buf, c.reader, int(h.length))
+	c.readBlocking(false)
+	if reuse {
+		c.rbuf = buf
 	}
-
-	// the actual payload
-	payload := make([]byte, payloadLength)
-	_, err = c.underlying.Read(payload)
 	if err != nil {
-		return nil, errorf(CONNECTION_READ_ERROR, err)
+		return nil, c.readError(err, true)
 	}
+	payload := buf[start:]
 
-	// unmask with xor
-	if isMasked {
-		for i := range payloadLength {
-			payload[i] ^= maskKey[i%4] // xor =
-		}
+	if h.masked {
+		maskBytes(payload, h.maskKey)
 	}
-
-	message.Data = payload
-	return message, nil
+	return payload, nil
 }
 
 // Write takes in a message and writes it as a WebSocket frame
-// to the underlying connection.
+// to the underlying connection. Control messages (close, ping, and
+// pong) may not have a payload longer than 125 bytes, and data messages
+// may not be larger than the write limit (see SetWriteLimit). Continuation
+// messages cannot be written. If the write queue is enabled, the
+// message is queued instead and written by the connection's writer
+// goroutine. A data message waits for the message of a writer from
+// NextWriter that is being written, if any, to be written first.
+//
+// Writing to a closed connection, or once a close frame was written, such
+// as with WriteClose, returns a CONNECTION_CLOSED error wrapping the error
+// that ended it (see Err), if any.
 func (c *Conn) Write(message *Message) Error {
+	if err := c.setMode(modeMessage); err != nil {
+		return err
+	}
+	if err := validateMessage(message); err != nil {
+		return err
+	}
+	if err := c.checkWriteLimit(message.Type, len(message.Data)); err != nil {
+		return err
+	}
+	if message.Type == MessageText && c.validateText.Load() && !utf8.Valid(message.Data) {
+		return errorf(INVALID_UTF8)
+	}
+	if !isControl(message.Type) {
+		if err := c.lockMessage(); err != nil {
+			return err
+		}
+		defer c.unlockMessage()
+	}
+	if err := c.writable(); err != nil {
+		return err
+	}
+	q := c.queue.Load()
+	if q == nil {
+		return c.write(message)
+	}
+	closeConn, err := q.push(message, c.clock.Now().UnixNano())
+	c.signalStallWatch()
+	if closeConn {
+		code := ClosePolicyViolation
+		if q.policy == OverflowCloseTryAgainLater {
+			code = CloseTryAgainLater
+		}
+		c.setErr(errorf(WRITE_QUEUE_FULL))
+		go c.closeWithCode(code, "write queue is full")
+	}
+	return err
+}
+
+// validateMessage returns an error if message cannot be written to any
+// connection.
+func validateMessage(message *Message) Error {
+	if _, ok := opcodes[message.Type]; !ok || message.Type == MessageContinuation {
+		return errorf(UNSUPPORTED_MESSAGE_TYPE, message.Type)
+	}
+	if isControl(message.Type) && len(message.Data) > maxControlPayloadLength {
+		return errorf(CONTROL_PAYLOAD_TOO_LONG, len(message.Data))
+	}
+	return nil
+}
+
+// WriteText writes a text message with the payload s, like Write. Unlike
+// writing a Message with []byte(s) as its payload, s is encoded as it is,
+// so that writing a small text message does not allocate, unless the write
+// queue is enabled, since queued messages are kept as a Message.
+func (c *Conn) WriteText(s string) Error {
+	if err := c.setMode(modeMessage); err != nil {
+		return err
+	}
+	if c.queue.Load() != nil {
+		return c.Write(&Message{Type: MessageText, Data: []byte(s)})
+	}
+	if err := c.checkWriteLimit(MessageText, len(s)); err != nil {
+		return err
+	}
+	if c.validateText.Load() && !utf8.ValidString(s) {
+		return errorf(INVALID_UTF8)
+	}
+	if err := c.lockMessage(); err != nil {
+		return err
+	}
+	defer c.unlockMessage()
+	if err := c.writable(); err != nil {
+		return err
+	}
+	if c.deflater != nil {
+		return writeCompressed(c, MessageText, s, CompressAuto)
+	}
+	return writeData(c, MessageText, s)
+}
+
+// checkWriteLimit returns an error if a message of the type specified with
+// a payload of n bytes is larger than the write limit.
+func (c *Conn) checkWriteLimit(messageType MessageType, n int) Error {
+	if limit := c.writeLimit.Load(); limit > 0 && !isControl(messageType) && int64(n) > limit {
+		return errorf(MESSAGE_TOO_LARGE, "write", limit)
+	}
+	return nil
+}
+
+// write writes the message as a WebSocket frame directly to the
+// underlying connection. If a fragment size is set, data messages
+// longer than it are written as several frames.
+func (c *Conn) write(message *Message) Error {
+	if c.deflater != nil && !isControl(message.Type) {
+		return writeCompressed(c, message.Type, message.Data, message.Compress)
+	}
+	return writeData(c, message.Type, message.Data)
+}
+
+const (
+	// maxFrameHeaderLength is the length of the longest frame header: two
+	// bytes, a 64 bit extended payload length, and a mask key.
+	maxFrameHeaderLength = 14
+	// smallMessageSize is the size of the largest payload the frame buffers
+	// are created for. Larger payloads are written with a vectored write
+	// when possible.
+	smallMessageSize = 4 << 10
+	// maxPooledFrameSize is the capacity above which a frame buffer is not
+	// put back in the pool, so that the pool does not keep large buffers.
+	maxPooledFrameSize = 64 << 10
+)
+
+// framePool holds the buffers frames are encoded in before they are
+// written, so that writing does not allocate.
+var framePool = sync.Pool{
+	New: func() any {
+		b := make([]byte, 0, smallMessageSize+maxFrameHeaderLength)
+		return &b
+	},
+}
+
+// writeData writes a message of the type specified with the payload data
+// directly to the underlying connection. The frames are encoded in a
+// buffer from framePool, except for the large messages of a server that
+// are written in a single frame to a TCP or Unix connection, whose header
+// and payload are written together with a vectored write, without copying
+// the payload.
+func writeData[T string | []byte](c *Conn, messageType MessageType, data T) Error {
+	if c.lowMemory && !isControl(messageType) {
+		return writeFixed(c, messageType, data)
+	}
+	if len(data) > smallMessageSize && c.role == RoleServer && (c.fragmentSize == 0 || len(data) <= c.fragmentSize) && c.limiter.Load() == nil {
+		switch c.underlying.(type) {
+		case *net.TCPConn, *net.UnixConn:
+			return writeVectored(c, messageType, data)
+		}
+	}
+	buf := framePool.Get().(*[]byte)
+	frames := appendFrames(c, (*buf)[:0], messageType, 0, data)
+	err := c.writeFrames(messageType, len(data), frames)
+	putFrameBuffer(buf, frames)
+	return err
+}
+
+// putFrameBuffer puts buf back in framePool with b, which was appended to
+// it, unless b grew too large to be kept.
+func putFrameBuffer(buf *[]byte, b []byte) {
+	if cap(b) <= maxPooledFrameSize {
+		*buf = b[:0]
+		framePool.Put(buf)
+	}
+}
+
+// writeVectored writes an unmasked data frame with its header and payload
+// in a single vectored write, after flushing the write buffer. If the
+// frame fits in the write buffer, it is buffered instead.
+func writeVectored[T string | []byte](c *Conn, messageType MessageType, data T) Error {
+	header := c.appendFrameHeader(make([]byte, 0, maxFrameHeaderLength), true, messageType.Opcode(), len(data))
+	if err := writeVectoredLocked(c, header, data); err != nil {
+		return err
+	}
+	c.countWrite(messageType, len(data), len(header)+len(data))
+	if hooks := c.frameHooks.Load(); hooks != nil && hooks.onWrite != nil {
+		h := encodedFrameHeader(header)
+		info := h.info()
+		info.Payload = payloadCopy(&c.frameHookPayload, data, [4]byte{})
+		hooks.onWrite(info)
+	}
+	return nil
+}
+
+// writeVectoredLocked writes the frame with the header and payload
+// specified for writeVectored, holding the write mutex.
+func writeVectoredLocked[T string | []byte](c *Conn, header []byte, data T) Error {
 	c.wmx.Lock()
 	defer c.wmx.Unlock()
-	messageType := message.Type
-	data := message.Data
-
-	frame := []byte{}
-	fin := byte(0x80)    // 1000 0000 (indicates final frame)
-	switch messageType { // fin (always 1), rsv1, rsv2, rsv3 (always 0), opcode
-	case MessageText: // 1000 0001 -> 0x81
-		frame = append(frame, fin|0x1)
-	case MessageBinary: // 1000 0010 -> 0x82
-		frame = append(frame, fin|0x2)
-	case MessageClose: // 1000 1000 -> 0x88
-		frame = append(frame, fin|0x8)
-	case MessagePing: // 1000 1001 -> 0x89
-		frame = append(frame, fin|0x9)
-	case MessagePong: // 1000 1010 -> 0x8A
-		frame = append(frame, fin|0xA)
-	}
-
-	payloadLength := len(data)
-	// mask key and payload length
-	if payloadLength < 126 { // the actual payload length
-		frame = append(frame, byte(payloadLength))
-	} else if payloadLength < 65536 { // the following 16 bits is the payload length
-		frame = append(frame, byte(126))
-		extendedPayloadLength := make([]byte, 2)
-		binary.BigEndian.PutUint16(extendedPayloadLength, uint16(payloadLength))
-		frame = append(frame, extendedPayloadLength...)
-	} else { // the following 64 bits is the payload length
-		frame = append(frame, byte(127))
-		extendedPayloadLength := make([]byte, 8)
-		binary.BigEndian.PutUint64(extendedPayloadLength, uint64(payloadLength))
-		frame = append(frame, extendedPayloadLength...)
-	}
-
-	frame = append(frame, data...)
-
-	_, err := c.underlying.Write(frame)
+	if len(header)+len(data) < c.wbufSize {
+		return c.writeFrame(append(header, data...), false)
+	}
+	if err := c.flush(); err != nil {
+		return err
+	}
+	buffers := net.Buffers{header, []byte(data)}
+	c.writeStarted()
+	_, err := buffers.WriteTo(c.underlying)
+	c.writeStart.Store(0)
 	if err != nil {
-		return errorf(CONNECTION_WRITE_ERROR, err.Error())
+		return c.writeError(err)
 	}
 	return nil
 }
 
-// Ping writes a ping frame to the connection. If a nil context is specified,
-// it will default to five seconds. If no response is reached within
-// the duration, it will return false. It may return an error if
-// there is an issue writing to the connection.
-//
-// If there is a ping that has not recieved a pong yet, calling this
-// function will NOT write another ping frame, but will block until it recieves
-// a pong.
-func (c *Conn) Ping(ctx context.Context) (bool, Error) {
-
-	c.pingMx.Lock()
-	if c.pingCtx == nil {
-		var cancel context.CancelFunc
-		if ctx == nil {
-			ctx, cancel = context.WithTimeout(context.Background(), time.Second*5)
-		} else {
-			ctx, cancel = context.WithCancel(ctx)
-		}
-		c.pingCtx = ctx
-		c.pingCancel = cancel
-		err := c.Write(&Message{
-			Type: MessagePing,
-			Data: []byte{},
-		})
-		if err != nil {
-			return false, err
+// appendFrames appends the frames of a message of the type specified with
+// the payload data to dst. If a fragment size is set, data messages longer
+// than it are split into several frames. The rsv bits are set on the first
+// frame only, such as rsv1 for a compressed message.
+func appendFrames[T string | []byte](c *Conn, dst []byte, messageType MessageType, rsv byte, data T) []byte {
+	if isControl(messageType) || c.fragmentSize == 0 || len(data) <= c.fragmentSize {
+		return appendFrame(c, dst, true, messageType.Opcode()|rsv, data)
+	}
+	opcode := messageType.Opcode() | rsv
+	for len(data) > c.fragmentSize {
+		dst = appendFrame(c, dst, false, opcode, data[:c.fragmentSize])
+		data = data[c.fragmentSize:]
+		opcode = MessageContinuation.Opcode()
+	}
+	return appendFrame(c, dst, true, opcode, data)
+}
+
+// writeFrames writes the frames of a message of the type specified, with
+// a payload of payloadLength bytes, directly to the underlying connection.
+func (c *Conn) writeFrames(messageType MessageType, payloadLength int, frames []byte) Error {
+	control := isControl(messageType)
+	if messageType == MessageClose {
+		c.closeSent.Store(true)
+	}
+	if err := c.writeLimited(frames, control); err != nil {
+		return err
+	}
+	if messageType == MessageClose {
+		c.setState(StateClosingLocal)
+	}
+	c.countWrite(messageType, payloadLength, len(frames))
+	if hooks := c.frameHooks.Load(); hooks != nil && hooks.onWrite != nil {
+		c.framesWritten(hooks, frames)
+	}
+	return nil
+}
+
+// appendFrame appends a frame with the opcode and payload specified to
+// dst. Frames written by a client are masked.
+func appendFrame[T string | []byte](c *Conn, dst []byte, fin bool, opcode byte, data T) []byte {
+	dst = c.appendFrameHeader(dst, fin, opcode, len(data))
+	if c.role != RoleClient {
+		return append(dst, data...)
+	}
+	// the mask key is read into dst, which is usually pooled, so that it
+	// does not allocate
+	dst = append(dst, 0, 0, 0, 0)
+	rand.Read(dst[len(dst)-4:])
+	maskKey := [4]byte(dst[len(dst)-4:])
+	start := len(dst)
+	dst = append(dst, data...)
+	maskBytes(dst[start:], maskKey)
+	return dst
+}
+
+// appendFrameHeader appends the header of a frame with the opcode and
+// payload length specified to dst, up to the mask key, which a client
+// appends after it. The opcode may include rsv1, for a compressed message.
+func (c *Conn) appendFrameHeader(dst []byte, fin bool, opcode byte, payloadLength int) []byte {
+	if fin {
+		opcode |= 0x80
+	}
+	return appendHeader(dst, opcode, c.role == RoleClient, payloadLength)
+}
+
+// writeFrame writes an encoded frame to the underlying connection, or to
+// the write buffer if one is set. Control frames always flush the write
+// buffer. The write mutex must be held.
+func (c *Conn) writeFrame(frame []byte, control bool) Error {
+	if c.wbufSize == 0 {
+		return c.writeUnderlying(frame)
+	}
+
+	if len(c.wbuf)+len(frame) > c.wbufSize {
+		if err := c.flush(); err != nil {
+			return err
 		}
 	}
-	c.pingMx.Unlock()
+	if len(frame) >= c.wbufSize { // the frame would fill the buffer by itself
+		return c.writeUnderlying(frame)
+	}
+	c.wbuf = append(c.wbuf, frame...)
+
+	if control {
+		return c.flush()
+	}
+	if c.flushLatency > 0 && c.flushTimer == nil {
+		c.flushTimer = time.AfterFunc(c.flushLatency, c.flushAfterLatency)
+	}
+	return nil
+}
 
-	<-c.pingCtx.Done()
+// writeUnderlying writes p to the underlying connection, recording when
+// the write started for StalledFor. The write mutex must be held.
+func (c *Conn) writeUnderlying(p []byte) Error {
+	c.writeStarted()
+	_, err := c.underlying.Write(p)
+	c.writeStart.Store(0)
+	if err != nil {
+		return c.writeError(err)
+	}
+	return nil
+}
 
-	switch ctx.Err() {
-	case context.Canceled:
-		return true, nil
-	case context.DeadlineExceeded: // a pong was not recieved in a timely manner
-		return false, nil
+// SetValidateOutgoingText sets whether Write checks that the payload of
+// text messages is valid UTF-8 before sending them. If validation is on,
+// Write returns an INVALID_UTF8 error instead of sending an invalid text
+// message. Validation is off by default. Binary messages are never checked.
+func (c *Conn) SetValidateOutgoingText(validate bool) {
+	c.validateText.Store(validate)
+}
+
+// SetWriteLimit sets the maximum size in bytes of a message that can be
+// written. Write returns a MESSAGE_TOO_LARGE error instead of sending a
+// larger message, and the connection stays open. The writers of
+// NextWriter and WriteReader return one once a message grows larger,
+// which fails the connection if part of the message was written already.
+// A limit of 0 (the default) means there is no limit. Control messages
+// are limited to 125 bytes regardless.
+func (c *Conn) SetWriteLimit(n int64) {
+	c.writeLimit.Store(max(n, 0))
+}
+
+// closeWithCode makes a best effort attempt to write a close frame with
+// the code and reason specified, then closes the connection. If the
+// underlying connection supports write deadlines, writing the close
+// frame is given up on after closeTimeout.
+func (c *Conn) closeWithCode(code int, reason string) error {
+	return c.closeWithPayload(FormatCloseMessage(code, reason))
+}
+
+// closeWithPayload is closeWithCode with an already encoded close frame
+// payload. If the write queue is enabled, the close frame is queued after
+// the messages queued before it, and written by the time Close is done
+// waiting for the queue.
+func (c *Conn) closeWithPayload(payload []byte) error {
+	if d, ok := c.underlying.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		d.SetWriteDeadline(time.Now().Add(closeTimeout))
+	}
+	message := &Message{Type: MessageClose, Data: payload}
+	if q := c.queue.Load(); q == nil || !q.pushClose(message, c.clock.Now().UnixNano()) {
+		c.write(message)
 	}
-	return false, nil
+	return c.Close()
 }
@@ -3,18 +3,27 @@ package websocket_test
 import (
 	"bytes"
 	"context"
+	"errors"
+	"fmt"
 	"io"
 	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"runtime"
+	"strings"
 	"sync"
 	"testing"
 	"time"
-	"websocket"
+
+	"github.com/tiredkangaroo/websocket"
 )
 
 // MockNetConn implements net.Conn for testing.
 type MockNetConn struct {
 	buf    bytes.Buffer
 	closed bool
+	closes int
 	mutex  sync.Mutex
 }
 
@@ -36,6 +45,7 @@ func (m *MockNetConn) Close() error {
 	m.mutex.Lock()
 	defer m.mutex.Unlock()
 	m.closed = true
+	m.closes++
 	return nil
 }
 
@@ -83,6 +93,52 @@ func TestClose(t *testing.T) {
 	}
 }
 
+func TestClose_Idempotent(t *testing.T) {
+	mockConn := &MockNetConn{}
+	conn := websocket.From(mockConn)
+
+	var wg sync.WaitGroup
+	for range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := conn.Close(); err != nil {
+				t.Errorf("Expected no error from Close(), got %v", err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("Expected no error from a repeated Close(), got %v", err)
+	}
+	if mockConn.closes != 1 {
+		t.Fatalf("Expected underlying connection to be closed once, closed %d times", mockConn.closes)
+	}
+}
+
+func TestClose_CancelsPing(t *testing.T) {
+	mockConn := &MockNetConn{}
+	conn := websocket.From(mockConn)
+
+	done := make(chan websocket.Error)
+	go func() {
+		_, err := conn.Ping(context.Background(), nil)
+		done <- err
+	}()
+	time.Sleep(50 * time.Millisecond)
+	conn.Close()
+
+	select {
+	case err := <-done:
+		if err == nil || err.Kind() != websocket.CONNECTION_CLOSED {
+			t.Fatalf("Expected CONNECTION_CLOSED error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Close() to unblock Ping()")
+	}
+}
+
 func TestRead_ClosedConnection(t *testing.T) {
 	mockConn := &MockNetConn{}
 	conn := websocket.From(mockConn)
@@ -104,6 +160,43 @@ func TestRead_MalformedFrame(t *testing.T) {
 	if err == nil || err.Kind() != websocket.MALFORMED_FRAME {
 		t.Fatalf("Expected MALFORMED_FRAME error, got %v", err)
 	}
+	// the rest of the stream cannot be read, so the connection is failed
+	if !conn.Closed() || !errors.Is(conn.Err(), websocket.ErrMalformedFrame) {
+		t.Fatalf("expected the connection to be closed with the error, got %v", conn.Err())
+	}
+	if expected := []byte{0x88, 0x02, 0x03, 0xEA}; !bytes.Equal(mockConn.buf.Bytes(), expected) {
+		t.Fatalf("expected a close frame with CloseProtocolError to be written, got %x", mockConn.buf.Bytes())
+	}
+}
+
+func TestRead_Timeout(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := websocket.From(a)
+	defer conn.Close()
+	go io.Copy(io.Discard, b)
+	frame := encodeFrames(t, textMessage("hello"), websocket.RoleClient)
+
+	// a timeout before any of the frame was read leaves the connection open
+	a.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	if _, err := conn.Read(); !errors.Is(err, os.ErrDeadlineExceeded) || conn.Closed() {
+		t.Fatalf("expected a timeout with the connection left open, got %v", err)
+	}
+	a.SetReadDeadline(time.Time{})
+	go b.Write(frame)
+	if msg, err := conn.Read(); err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("expected to read %q after the timeout, got %v, %v", "hello", msg, err)
+	}
+
+	// a timeout in the middle of a frame loses the rest of it
+	go b.Write(frame[:len(frame)-2])
+	a.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(); !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+	if !conn.Closed() || !errors.Is(conn.Err(), websocket.ErrRead) {
+		t.Fatalf("expected the connection to be closed with the error, got %v", conn.Err())
+	}
 }
 
 func TestWrite_MessageText(t *testing.T) {
@@ -122,58 +215,148 @@ func TestWrite_MessageText(t *testing.T) {
 	}
 }
 
-func TestRead_MessageText(t *testing.T) {
+func TestWrite_ControlPayloadLength(t *testing.T) {
+	types := []websocket.MessageType{websocket.MessagePing, websocket.MessagePong, websocket.MessageClose}
+	for _, messageType := range types {
+		mockConn := &MockNetConn{}
+		conn := websocket.From(mockConn)
+
+		err := conn.Write(&websocket.Message{Type: messageType, Data: make([]byte, 125)})
+		if err != nil {
+			t.Fatalf("Expected no error writing a 125 byte %s, got %v", messageType, err)
+		}
+		written := mockConn.buf.Len()
+
+		err = conn.Write(&websocket.Message{Type: messageType, Data: make([]byte, 126)})
+		if err == nil || err.Kind() != websocket.CONTROL_PAYLOAD_TOO_LONG {
+			t.Fatalf("Expected CONTROL_PAYLOAD_TOO_LONG error writing a 126 byte %s, got %v", messageType, err)
+		}
+		if mockConn.buf.Len() != written {
+			t.Fatalf("Expected nothing to be written for a 126 byte %s", messageType)
+		}
+	}
+}
+
+func TestWrite_ValidateOutgoingText(t *testing.T) {
+	invalid := []byte{'h', 'i', 0xff, 0xfe}
+
 	mockConn := &MockNetConn{}
 	conn := websocket.From(mockConn)
 
-	expected := []byte{0x81, 5}
-	expected = append(expected, []byte("hello")...)
-	mockConn.buf.Write(expected)
+	// validation is off by default
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageText, Data: invalid}); err != nil {
+		t.Fatalf("Expected no error from Write() without validation, got %v", err)
+	}
 
-	msg, err := conn.Read()
-	if err != nil {
-		t.Fatal(err.Error())
+	conn.SetValidateOutgoingText(true)
+	written := mockConn.buf.Len()
+	err := conn.Write(&websocket.Message{Type: websocket.MessageText, Data: invalid})
+	if err == nil || err.Kind() != websocket.INVALID_UTF8 {
+		t.Fatalf("Expected INVALID_UTF8 error, got %v", err)
 	}
-	if !bytes.Equal(msg.Data, expected[2:]) {
-		t.Fatalf("Expected %v, got %v", expected[2:], msg.Data)
+	if mockConn.buf.Len() != written {
+		t.Fatalf("Expected nothing to be written for invalid text")
+	}
+
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("héllo")}); err != nil {
+		t.Fatalf("Expected no error writing valid text, got %v", err)
+	}
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: invalid}); err != nil {
+		t.Fatalf("Expected binary messages to not be validated, got %v", err)
 	}
 }
 
-func TestPing_PongReceived(t *testing.T) {
+func TestWrite_WriteLimit(t *testing.T) {
 	mockConn := &MockNetConn{}
 	conn := websocket.From(mockConn)
-	ctx, cancel := context.WithCancel(context.Background())
+	conn.SetWriteLimit(4)
 
-	done := make(chan struct{})
-	go func() {
-		defer close(done)
-		pongReceived, err := conn.Ping(ctx)
+	err := conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: []byte("hello")})
+	if !errors.Is(err, websocket.ErrMessageTooLarge) {
+		t.Fatalf("Expected MESSAGE_TOO_LARGE error, got %v", err)
+	}
+	if mockConn.buf.Len() != 0 {
+		t.Fatalf("Expected nothing to be written for a message over the limit")
+	}
+	if conn.Closed() {
+		t.Fatalf("Expected the connection to stay open")
+	}
+
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("hell")}); err != nil {
+		t.Fatalf("Expected no error writing a message at the limit, got %v", err)
+	}
+	if err := conn.Write(&websocket.Message{Type: websocket.MessagePing, Data: []byte("ping!")}); err != nil {
+		t.Fatalf("Expected control messages to not be limited, got %v", err)
+	}
+	conn.SetWriteLimit(0)
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: []byte("hello")}); err != nil {
+		t.Fatalf("Expected no error without a limit, got %v", err)
+	}
+}
+
+func TestWriteText(t *testing.T) {
+	client, server := websocket.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	for _, data := range []string{"hello", strings.Repeat("x", 70000)} {
+		go client.WriteText(data)
+		msg, err := server.Read()
 		if err != nil {
-			t.Errorf("Unexpected error from Ping: %v", err)
+			t.Fatalf("expected no error from Read(), got %v", err)
 		}
-		if !pongReceived {
-			t.Errorf("Expected pong response")
+		if msg.Type != websocket.MessageText || string(msg.Data) != data {
+			t.Fatalf("expected the text message to be written, got %s of %d bytes", msg.Type, len(msg.Data))
 		}
-	}()
-	// Simulate a pong response
-	time.Sleep(100 * time.Millisecond)
-	cancel()
+	}
 
-	<-done
+	server.SetWriteLimit(3)
+	if err := server.WriteText("hello"); !errors.Is(err, websocket.ErrMessageTooLarge) {
+		t.Fatalf("expected MESSAGE_TOO_LARGE error, got %v", err)
+	}
+	server.SetValidateOutgoingText(true)
+	if err := server.WriteText("\xff"); !errors.Is(err, websocket.ErrInvalidUTF8) {
+		t.Fatalf("expected INVALID_UTF8 error, got %v", err)
+	}
 }
 
-func TestPing_Timeout(t *testing.T) {
+func TestWrite_Allocs(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations cannot be counted with the race detector")
+	}
+	// the message is not queued, but Write cannot know it won't be, so the
+	// messages passed to it escape and are created outside the runs
+	small := &websocket.Message{Type: websocket.MessageText, Data: []byte("hello world")}
+	full := &websocket.Message{Type: websocket.MessageBinary, Data: bytes.Repeat([]byte{1}, 4096)}
+	for _, role := range []websocket.Role{websocket.RoleServer, websocket.RoleClient} {
+		conn := websocket.From(&CountingConn{discard: true}, websocket.WithRole(role))
+		for name, write := range map[string]func(){
+			"Write":      func() { conn.Write(small) },
+			"Write 4KiB": func() { conn.Write(full) },
+			"WriteText":  func() { conn.WriteText("hello world") },
+			"buffered":   func() { conn.SetWriteBuffer(1024); conn.WriteText("hello world"); conn.Flush() },
+		} {
+			if allocs := testing.AllocsPerRun(100, write); allocs != 0 {
+				t.Errorf("expected %s to not allocate for role %d, got %v allocations", name, role, allocs)
+			}
+		}
+	}
+}
+
+func TestRead_MessageText(t *testing.T) {
 	mockConn := &MockNetConn{}
-	conn := websocket.From(mockConn)
-	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
-	defer cancel()
+	conn := websocket.From(mockConn, websocket.WithRole(websocket.RoleClient)) // the frame is not masked
 
-	pongReceived, err := conn.Ping(ctx)
+	expected := []byte{0x81, 5}
+	expected = append(expected, []byte("hello")...)
+	mockConn.buf.Write(expected)
+
+	msg, err := conn.Read()
 	if err != nil {
-		t.Fatalf("Expected no error from Ping, got %v", err)
+		t.Fatal(err.Error())
 	}
-	if pongReceived {
-		t.Fatalf("Expected Ping to timeout, but got pong response")
+	if !bytes.Equal(msg.Data, expected[2:]) {
+		t.Fatalf("Expected %v, got %v", expected[2:], msg.Data)
 	}
 }
 
@@ -194,3 +377,326 @@ func TestRead_UnmaskPayload(t *testing.T) {
 		t.Fatalf("Expected data %v, got %v", expectedData, message.Data)
 	}
 }
+
+func TestRead_ReuseBuffer(t *testing.T) {
+	large := bytes.Repeat([]byte("0123456789abcdef"), 1<<16+1) // over 1 MiB
+	fragmented := &CountingConn{}
+	websocket.From(fragmented, websocket.WithWriteFragmentSize(4)).Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("fragmented")})
+	ping := encodeFrames(t, &websocket.Message{Type: websocket.MessagePing, Data: []byte("ping")}, websocket.RoleClient)
+
+	mockConn := &MockNetConn{}
+	for _, frames := range [][]byte{
+		encodeFrames(t, &websocket.Message{Type: websocket.MessageText, Data: []byte("first message")}, websocket.RoleClient),
+		encodeFrames(t, &websocket.Message{Type: websocket.MessageBinary, Data: large}, websocket.RoleClient),
+		fragmented.buf.Bytes()[:6], // "frag", with the ping in the middle of the message
+		ping,
+		fragmented.buf.Bytes()[6:],
+		encodeFrames(t, &websocket.Message{Type: websocket.MessageText, Data: []byte("x")}, websocket.RoleServer),
+	} {
+		mockConn.buf.Write(frames)
+	}
+	// the last frame is not masked
+	conn := websocket.From(mockConn, websocket.WithReadBufferReuse(true), websocket.WithStrictMode(websocket.Lenient))
+
+	var previous *websocket.Message
+	var pingData []byte
+	for _, expected := range []*websocket.Message{
+		{Type: websocket.MessageText, Data: []byte("first message")},
+		{Type: websocket.MessageBinary, Data: large},
+		{Type: websocket.MessagePing, Data: []byte("ping")},
+		{Type: websocket.MessageText, Data: []byte("fragmented")},
+		{Type: websocket.MessageText, Data: []byte("x")},
+	} {
+		msg, err := conn.Read()
+		if err != nil {
+			t.Fatalf("expected no error from Read(), got %v", err)
+		}
+		if msg.Type != expected.Type || !bytes.Equal(msg.Data, expected.Data) {
+			t.Fatalf("expected %s %.20q, got %s %.20q", expected.Type, expected.Data, msg.Type, msg.Data)
+		}
+		if previous != nil && msg != previous {
+			t.Fatalf("expected the message to be reused")
+		}
+		previous = msg
+		if msg.Type == websocket.MessagePing {
+			pingData = msg.Data
+		}
+	}
+	if string(pingData) != "ping" {
+		t.Fatalf("expected the payloads of control messages not to be reused, got %q", pingData)
+	}
+}
+
+func TestRead_DeclaredLengthNotAllocated(t *testing.T) {
+	for _, reuse := range []bool{false, true} {
+		// a frame declaring a 64 MiB payload, of which 10 bytes are sent
+		mockConn := &MockNetConn{}
+		mockConn.buf.Write([]byte{0x82, 127, 0, 0, 0, 0, 0x04, 0, 0, 0})
+		mockConn.buf.Write([]byte("0123456789"))
+		conn := websocket.From(mockConn, websocket.WithRole(websocket.RoleClient), websocket.WithReadLimit(128<<20), websocket.WithReadBufferReuse(reuse))
+
+		var before, after runtime.MemStats
+		runtime.ReadMemStats(&before)
+		if _, err := conn.Read(); !websocket.IsCloseError(err, websocket.CloseAbnormalClosure) {
+			t.Fatalf("expected the connection to end in the middle of the payload, got %v", err)
+		}
+		runtime.ReadMemStats(&after)
+		if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+			t.Fatalf("expected the payload not to be allocated before it is received, %d bytes were allocated", allocated)
+		}
+	}
+
+	// large payloads are still read whole
+	data := bytes.Repeat([]byte("0123456789abcdef"), 20000)
+	mockConn := &MockNetConn{}
+	mockConn.buf.Write(encodeFrames(t, &websocket.Message{Type: websocket.MessageBinary, Data: data}, websocket.RoleClient))
+	msg, err := websocket.From(mockConn).Read()
+	if err != nil || !bytes.Equal(msg.Data, data) {
+		t.Fatalf("expected to read the large message, got %v", err)
+	}
+}
+
+// assertDone fails the test if conn is not closed.
+func assertDone(t *testing.T, conn *websocket.Conn) {
+	t.Helper()
+	select {
+	case <-conn.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("expected Done() to be closed")
+	}
+	if !conn.Closed() {
+		t.Fatalf("expected Closed() to be true")
+	}
+}
+
+func TestClosed_Done(t *testing.T) {
+	t.Run("Close", func(t *testing.T) {
+		conn, peer := pipe()
+		defer peer.Close()
+		if conn.Closed() {
+			t.Fatalf("expected Closed() to be false before closing")
+		}
+		select {
+		case <-conn.Done():
+			t.Fatalf("expected Done() not to be closed before closing")
+		default:
+		}
+		conn.Close()
+		conn.Close()
+		assertDone(t, conn)
+	})
+	t.Run("PeerCloseFrame", func(t *testing.T) {
+		conn, peer := pipe()
+		go func() {
+			peer.CloseWithCode(websocket.CloseNormalClosure, "")
+		}()
+		conn.Read()
+		assertDone(t, conn)
+		if err := conn.Write(textMessage("hello")); err == nil || err.Kind() != websocket.CONNECTION_CLOSED {
+			t.Fatalf("expected CONNECTION_CLOSED error from Write(), got %v", err)
+		}
+	})
+	t.Run("TransportError", func(t *testing.T) {
+		a, b := net.Pipe()
+		conn := websocket.From(a)
+		b.Close()
+		conn.Read()
+		assertDone(t, conn)
+	})
+}
+
+// PingThenBrokenConn reads a ping frame, then fails like BrokenConn.
+type PingThenBrokenConn struct {
+	BrokenConn
+	r io.Reader
+}
+
+func (m *PingThenBrokenConn) Read(p []byte) (int, error) {
+	return m.r.Read(p)
+}
+
+func TestErr(t *testing.T) {
+	t.Run("Close", func(t *testing.T) {
+		conn, peer := pipe()
+		defer peer.Close()
+		if err := conn.Err(); err != nil {
+			t.Fatalf("expected Err() to be nil while open, got %v", err)
+		}
+		conn.Close()
+		if err := conn.Err(); !errors.Is(err, websocket.ErrConnectionClosed) {
+			t.Fatalf("expected Err() to be CONNECTION_CLOSED, got %v", err)
+		}
+	})
+	t.Run("PeerCloseFrame", func(t *testing.T) {
+		conn, peer := pipe()
+		go peer.CloseWithCode(websocket.CloseGoingAway, "bye")
+		conn.Read()
+		if !websocket.IsCloseError(conn.Err(), websocket.CloseGoingAway) {
+			t.Fatalf("expected Err() to wrap close code 1001, got %v", conn.Err())
+		}
+		// later errors wrap the close error
+		_, err := conn.Read()
+		if !errors.Is(err, websocket.ErrConnectionClosed) || !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Fatalf("expected Read() to wrap close code 1001, got %v", err)
+		}
+		err = conn.Write(textMessage("hello"))
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Fatalf("expected Write() to wrap close code 1001, got %v", err)
+		}
+	})
+	t.Run("TransportEOF", func(t *testing.T) {
+		a, b := net.Pipe()
+		conn := websocket.From(a)
+		b.Close()
+		conn.Read()
+		if !websocket.IsCloseError(conn.Err(), websocket.CloseAbnormalClosure) {
+			t.Fatalf("expected Err() to wrap close code 1006, got %v", conn.Err())
+		}
+	})
+	t.Run("ReadError", func(t *testing.T) {
+		conn := websocket.From(BrokenConn{})
+		conn.Read()
+		if err := conn.Err(); !errors.Is(err, websocket.ErrRead) || !errors.Is(err, errBroken) {
+			t.Fatalf("expected Err() to be the read error, got %v", err)
+		}
+		err := conn.Write(textMessage("hello"))
+		if !errors.Is(err, websocket.ErrConnectionClosed) || !errors.Is(err, errBroken) {
+			t.Fatalf("expected Write() to wrap the read error, got %v", err)
+		}
+	})
+	t.Run("PongWriteError", func(t *testing.T) {
+		frames := new(bytes.Buffer)
+		frames.Write([]byte{0x89, 0x00}) // an empty ping
+		conn := websocket.From(&PingThenBrokenConn{r: frames}, websocket.WithRole(websocket.RoleClient))
+		if _, err := conn.Read(); err != nil {
+			t.Fatalf("expected no error reading the ping, got %v", err)
+		}
+		if !conn.Closed() {
+			t.Fatalf("expected the connection to be closed after the pong could not be written")
+		}
+		if err := conn.Err(); !errors.Is(err, websocket.ErrWrite) || !errors.Is(err, errBroken) {
+			t.Fatalf("expected Err() to be the write error, got %v", err)
+		}
+	})
+}
+
+func TestAddr(t *testing.T) {
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := websocket.From(a)
+	defer conn.Close()
+	if conn.LocalAddr() != a.LocalAddr() || conn.RemoteAddr() != a.RemoteAddr() {
+		t.Fatalf("expected the addresses of the underlying connection, got %v and %v", conn.LocalAddr(), conn.RemoteAddr())
+	}
+	if conn.NetConn() != a {
+		t.Fatalf("expected NetConn() to return the underlying connection")
+	}
+
+	// the underlying connection is not a net.Conn
+	conn = websocket.From(BrokenConn{})
+	if conn.LocalAddr() != nil || conn.RemoteAddr() != nil || conn.NetConn() != nil {
+		t.Fatalf("expected nil addresses and NetConn() for a connection that is not a net.Conn")
+	}
+}
+
+func TestAddr_AcceptHTTP(t *testing.T) {
+	remote := make(chan net.Addr, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.AcceptHTTP(w, r)
+		if err != nil {
+			t.Errorf("expected no error from AcceptHTTP(), got %v", err)
+			return
+		}
+		defer conn.Close()
+		if _, ok := conn.NetConn().(*net.TCPConn); !ok {
+			t.Errorf("expected NetConn() to be the hijacked *net.TCPConn, got %T", conn.NetConn())
+		}
+		remote <- conn.RemoteAddr()
+	}))
+	defer server.Close()
+
+	nc, err := net.Dial("tcp", server.Listener.Addr().String())
+	if err != nil {
+		t.Fatalf("expected no error dialing the server, got %v", err)
+	}
+	defer nc.Close()
+	fmt.Fprintf(nc, "GET / HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", server.Listener.Addr())
+
+	select {
+	case addr := <-remote:
+		if addr.String() != nc.LocalAddr().String() {
+			t.Fatalf("expected RemoteAddr() %s, got %s", nc.LocalAddr(), addr)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected the handler to accept the connection")
+	}
+}
+
+func TestWait(t *testing.T) {
+	conn, peer := pipe()
+
+	// waiters start before the connection is read from
+	results := make(chan error, 4)
+	for range 4 {
+		go func() {
+			results <- conn.Wait(context.Background())
+		}()
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if err := conn.Wait(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Wait() to return the context's error, got %v", err)
+	}
+
+	go peer.CloseWithCode(websocket.CloseGoingAway, "")
+	conn.Read()
+	for range 4 {
+		select {
+		case err := <-results:
+			if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+				t.Fatalf("expected every waiter to get close code 1001, got %v", err)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected Wait() to return once the connection is closed")
+		}
+	}
+
+	// the connection is already closed
+	if err := conn.Wait(context.Background()); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected close code 1001, got %v", err)
+	}
+}
+
+func TestClose_UnblocksRead(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+
+	result := make(chan websocket.Error)
+	go func() {
+		_, err := conn.Read()
+		result <- err
+	}()
+	time.Sleep(10 * time.Millisecond) // let Read block
+
+	closed := make(chan error)
+	go func() {
+		closed <- conn.Close()
+	}()
+	select {
+	case err := <-closed:
+		if err != nil {
+			t.Fatalf("expected no error from Close(), got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected Close() not to wait for the blocked Read")
+	}
+	select {
+	case err := <-result:
+		if !errors.Is(err, websocket.ErrConnectionClosed) || err.Kind() != websocket.CONNECTION_CLOSED {
+			t.Fatalf("expected CONNECTION_CLOSED error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the blocked Read to return")
+	}
+}
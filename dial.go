@@ -0,0 +1,179 @@
+package websocket
+
+import (
+	"bufio"
+	"cmp"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+)
+
+// Dial opens a WebSocket connection to the ws:// or wss:// URL specified,
+// the client counterpart of AcceptHTTP. ctx bounds connecting and the
+// handshake; it has no effect on the connection once Dial returns. The
+// Conn has RoleClient and is configured with the options specified, if
+// any.
+//
+// It returns a HANDSHAKE_FAILED error if the URL is not a WebSocket URL,
+// connecting fails, or the server does not accept the handshake.
+func Dial(ctx context.Context, rawURL string, opts ...Option) (*Conn, Error) {
+	conn, _, err := DialWithOptions(ctx, rawURL, DialOptions{}, opts...)
+	return conn, err
+}
+
+// DialOptions configures the opening handshake of DialWithOptions.
+type DialOptions struct {
+	// Header is sent with the handshake request, such as cookies or an
+	// Origin. The headers of the handshake itself, such as
+	// Sec-WebSocket-Key, are set by DialWithOptions and replace any value
+	// in Header.
+	Header http.Header
+	// Subprotocols are offered to the server in Sec-WebSocket-Protocol, in
+	// order of preference. The subprotocol the server selects, if any, is
+	// in the Sec-WebSocket-Protocol header of the response.
+	Subprotocols []string
+	// TLSConfig configures the TLS connection to a wss:// URL, such as
+	// the root CAs or InsecureSkipVerify for testing. Its ServerName
+	// defaults to the host of the URL. If it is nil, the default
+	// configuration is used.
+	TLSConfig *tls.Config
+}
+
+// DialWithOptions is Dial with the handshake configured by dopts. It also
+// returns the handshake response of the server, if one was received, even
+// if the handshake failed, so that its status can be told apart: a server
+// that refuses the connection with a 403 can be distinguished from one
+// that cannot be reached. The body of the response is already closed.
+//
+// The handshake fails if the server selects a subprotocol that was not
+// offered.
+func DialWithOptions(ctx context.Context, rawURL string, dopts DialOptions, opts ...Option) (*Conn, *http.Response, Error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, nil, errorf(HANDSHAKE_FAILED, err)
+	}
+	var d interface {
+		DialContext(ctx context.Context, network, addr string) (net.Conn, error)
+	}
+	port := u.Port()
+	switch u.Scheme {
+	case "ws":
+		d, port = new(net.Dialer), cmp.Or(port, "80")
+	case "wss":
+		config := new(tls.Config)
+		if dopts.TLSConfig != nil {
+			config = dopts.TLSConfig.Clone()
+		}
+		config.ServerName = cmp.Or(config.ServerName, u.Hostname())
+		d, port = &tls.Dialer{Config: config}, cmp.Or(port, "443")
+	default:
+		return nil, nil, errorf(HANDSHAKE_FAILED, fmt.Sprintf("unsupported scheme %q", u.Scheme))
+	}
+	nc, err := d.DialContext(ctx, "tcp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return nil, nil, errorf(HANDSHAKE_FAILED, err)
+	}
+
+	// the options are applied before the handshake, since compression is
+	// offered in the request
+	conn := newConn(append([]Option{WithRole(RoleClient)}, opts...))
+
+	// closing the connection if ctx is done makes the handshake fail
+	stop := context.AfterFunc(ctx, func() { nc.Close() })
+	hc, resp, herr := handshake(nc, u, dopts, conn)
+	if !stop() {
+		herr = errorf(HANDSHAKE_FAILED, ctx.Err())
+	}
+	if herr != nil {
+		nc.Close()
+		return nil, resp, herr
+	}
+	return conn.attach(hc), resp, nil
+}
+
+// handshake performs the client side of the opening handshake on nc for
+// conn, offering compression if it is enabled and recording whether it
+// was negotiated. The connection it returns reads anything the server
+// sent after its response before reading from nc. The response is
+// returned if one was received.
+func handshake(nc net.Conn, u *url.URL, dopts DialOptions, conn *Conn) (net.Conn, *http.Response, Error) {
+	nonce := make([]byte, 16)
+	rand.Read(nonce)
+	key := base64.StdEncoding.EncodeToString(nonce)
+
+	req := &http.Request{
+		Method:     http.MethodGet,
+		URL:        &url.URL{Path: u.Path, RawPath: u.RawPath, RawQuery: u.RawQuery},
+		Proto:      "HTTP/1.1",
+		ProtoMajor: 1,
+		ProtoMinor: 1,
+		Header:     dopts.Header.Clone(),
+		Host:       u.Host,
+	}
+	if req.Header == nil {
+		req.Header = make(http.Header)
+	}
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", key)
+	req.Header.Del("Sec-WebSocket-Protocol")
+	if len(dopts.Subprotocols) > 0 {
+		req.Header.Set("Sec-WebSocket-Protocol", strings.Join(dopts.Subprotocols, ", "))
+	}
+	offer := conn.compressionOptions
+	if conn.lowMemory {
+		offer = nil
+	}
+	req.Header.Del("Sec-WebSocket-Extensions")
+	if offer != nil {
+		req.Header.Set("Sec-WebSocket-Extensions", offer.offer())
+	}
+	if err := req.Write(nc); err != nil {
+		return nil, nil, errorf(HANDSHAKE_FAILED, err)
+	}
+
+	br := bufio.NewReader(nc)
+	resp, err := http.ReadResponse(br, req)
+	if err != nil {
+		return nil, nil, errorf(HANDSHAKE_FAILED, err)
+	}
+	resp.Body.Close()
+	switch protocol := resp.Header.Get("Sec-WebSocket-Protocol"); {
+	case resp.StatusCode != http.StatusSwitchingProtocols:
+		return nil, resp, errorf(HANDSHAKE_FAILED, fmt.Sprintf("unexpected status %q", resp.Status))
+	case !strings.EqualFold(resp.Header.Get("Upgrade"), "websocket"):
+		return nil, resp, errorf(HANDSHAKE_FAILED, "the response does not upgrade to websocket")
+	case resp.Header.Get("Sec-WebSocket-Accept") != acceptKey(key):
+		return nil, resp, errorf(HANDSHAKE_FAILED, "the Sec-WebSocket-Accept key does not match")
+	case protocol != "" && !slices.Contains(dopts.Subprotocols, protocol):
+		return nil, resp, errorf(HANDSHAKE_FAILED, fmt.Sprintf("the server selected subprotocol %q, which was not offered", protocol))
+	}
+	params, err := offer.acceptResponse(resp.Header)
+	if err != nil {
+		return nil, resp, errorf(HANDSHAKE_FAILED, err)
+	}
+	conn.compression = params
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: nc, r: br}, resp, nil
+	}
+	return nc, resp, nil
+}
+
+// bufferedConn is a net.Conn that reads from r, which buffers the
+// connection.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
@@ -0,0 +1,173 @@
+package websocket_test
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// echoServer starts an HTTP server accepting WebSocket connections and
+// echoing every message, and returns its ws:// URL.
+func echoServer(t *testing.T) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.AcceptHTTP(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := conn.Read()
+			if err != nil {
+				return
+			}
+			if msg.IsData() {
+				conn.Write(msg)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestDial(t *testing.T) {
+	conn, err := websocket.Dial(context.Background(), echoServer(t)+"/echo?x=1")
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	if conn.NetConn() == nil {
+		t.Fatalf("expected the connection to be backed by a net.Conn")
+	}
+
+	for _, data := range []string{"hello", strings.Repeat("x", 70000)} {
+		if err := conn.Write(textMessage(data)); err != nil {
+			t.Fatalf("writing: %v", err)
+		}
+		msg, err := conn.Read()
+		if err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+		if string(msg.Data) != data {
+			t.Fatalf("expected the message to be echoed, got %d bytes", len(msg.Data))
+		}
+	}
+
+	if err := conn.CloseWithCode(websocket.CloseNormalClosure, ""); err != nil {
+		t.Fatalf("closing: %v", err)
+	}
+}
+
+func TestDial_Errors(t *testing.T) {
+	notWebSocket := httptest.NewServer(http.NotFoundHandler())
+	defer notWebSocket.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	for _, url := range []string{
+		"http://localhost",
+		"ws://127.0.0.1:1",
+		"ws" + strings.TrimPrefix(notWebSocket.URL, "http"),
+	} {
+		conn, err := websocket.Dial(ctx, url)
+		if conn != nil || !errors.Is(err, websocket.ErrHandshake) {
+			t.Fatalf("expected dialing %s to fail with a handshake error, got %v", url, err)
+		}
+	}
+}
+
+func TestDial_Context(t *testing.T) {
+	// a server that never responds to the handshake
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		<-r.Context().Done()
+	}))
+	defer srv.Close()
+	defer srv.CloseClientConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	_, err := websocket.Dial(ctx, "ws"+strings.TrimPrefix(srv.URL, "http"))
+	if !errors.Is(err, websocket.ErrHandshake) || !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected a handshake error wrapping context.DeadlineExceeded, got %v", err)
+	}
+}
+
+func TestDialWithOptions(t *testing.T) {
+	// the server requires a cookie, and selects the last subprotocol it is
+	// offered, or one that was not offered if asked to
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if c, err := r.Cookie("session"); err != nil || c.Value != "abc" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		protocols := strings.Split(r.Header.Get("Sec-WebSocket-Protocol"), ", ")
+		w.Header().Set("Sec-WebSocket-Protocol", protocols[len(protocols)-1])
+		if r.URL.Query().Has("other") {
+			w.Header().Set("Sec-WebSocket-Protocol", "other")
+		}
+		conn, err := websocket.AcceptHTTP(w, r)
+		if err != nil {
+			return
+		}
+		conn.Close()
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+	dopts := websocket.DialOptions{
+		Header:       http.Header{"Cookie": {"session=abc"}},
+		Subprotocols: []string{"chat.v2", "chat.v1"},
+	}
+
+	conn, resp, err := websocket.DialWithOptions(context.Background(), url, dopts)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	conn.Close()
+	if protocol := resp.Header.Get("Sec-WebSocket-Protocol"); protocol != "chat.v1" {
+		t.Fatalf("expected the server to select chat.v1, got %q", protocol)
+	}
+
+	if _, _, err := websocket.DialWithOptions(context.Background(), url+"?other", dopts); !errors.Is(err, websocket.ErrHandshake) {
+		t.Fatalf("expected a subprotocol that was not offered to fail the handshake, got %v", err)
+	}
+
+	_, resp, err = websocket.DialWithOptions(context.Background(), url, websocket.DialOptions{})
+	if !errors.Is(err, websocket.ErrHandshake) || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the handshake to fail with the response of the server, got %v and %v", resp, err)
+	}
+}
+
+func TestDialWithOptions_TLS(t *testing.T) {
+	srv := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if conn, err := websocket.AcceptHTTP(w, r); err == nil {
+			conn.Close()
+		}
+	}))
+	defer srv.Close()
+	url := "wss" + strings.TrimPrefix(srv.URL, "https")
+
+	if _, err := websocket.Dial(context.Background(), url); !errors.Is(err, websocket.ErrHandshake) {
+		t.Fatalf("expected the certificate of the server not to be trusted by default, got %v", err)
+	}
+	roots := x509.NewCertPool()
+	roots.AddCert(srv.Certificate())
+	for _, config := range []*tls.Config{{RootCAs: roots}, {InsecureSkipVerify: true}} {
+		conn, _, err := websocket.DialWithOptions(context.Background(), url, websocket.DialOptions{TLSConfig: config})
+		if err != nil {
+			t.Fatalf("dialing: %v", err)
+		}
+		conn.Close()
+		if config.ServerName != "" {
+			t.Fatalf("expected the TLS config not to be modified")
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package websocket
+
+import (
+	"context"
+	"io"
+)
+
+// Drain reads from the connection and discards every data message until the
+// peer sends a close frame, which is useful after writing a close frame
+// during a graceful shutdown: the peer's close frame can only be received
+// once everything it sent before it has been read. Data frames are
+// discarded as they are read instead of being buffered, so a large message
+// does not need to fit in memory. Control frames are handled as they are
+// by Read.
+//
+// Drain returns the same CONNECTION_CLOSED error wrapping a *CloseError
+// that Read returns for the peer's close frame, or any other error reading
+// from the connection. If ctx is done first, Drain closes the connection
+// and returns ctx.Err(). Drain ignores PauseReading, and any partially
+// read fragmented message is discarded.
+func (c *Conn) Drain(ctx context.Context) error {
+	if err := c.setMode(modeMessage); err != nil {
+		return err
+	}
+	stop := context.AfterFunc(ctx, func() {
+		c.Close()
+	})
+	defer stop()
+
+	c.lockRead()
+	defer c.unlockRead()
+	c.fragmented = false
+	c.fragments = nil
+	for {
+		err := c.drainFrame()
+		if err == nil {
+			continue
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		c.failMalformed(err)
+		return err
+	}
+}
+
+// drainFrame reads a single frame, discarding it if it is a data frame and
+// handling it if it is a control frame. It returns the error Read would
+// return for the frame, if any. The read mutex must be held.
+func (c *Conn) drainFrame() Error {
+	if c.closed.Load() {
+		return c.closedError()
+	}
+	h, err := c.readFrameHeader(nil)
+	if err != nil {
+		return err
+	}
+	if !isControl(h.messageType) {
+		c.readBlocking(true)
+		_, err := io.CopyN(io.Discard, c.reader, h.length)
+		c.readBlocking(false)
+		if err != nil {
+			return c.readError(err, true)
+		}
+		c.frameRead(h, nil)
+		return nil
+	}
+
+	payload, err := c.readPayload(h)
+	if err != nil {
+		return err
+	}
+	c.frameRead(h, payload)
+	c.countMessageRead(h.messageType)
+	switch h.messageType {
+	case MessageClose:
+		return c.handleClose(payload)
+	case MessagePing:
+		if err := c.handlePing(payload); err != nil {
+			return errorf(CONTROL_HANDLER_ERROR, err)
+		}
+	case MessagePong:
+		if err := c.handlePong(payload); err != nil {
+			return errorf(CONTROL_HANDLER_ERROR, err)
+		}
+	}
+	return nil
+}
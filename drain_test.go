@@ -0,0 +1,82 @@
+package websocket_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+func TestDrain(t *testing.T) {
+	peer, conn := websocket.Pipe(websocket.WithWriteFragmentSize(16))
+	defer peer.Close()
+
+	go func() {
+		peer.Write(textMessage("one"))
+		peer.Write(&websocket.Message{Type: websocket.MessageBinary, Data: bytes.Repeat([]byte{1}, 100000)})
+		peer.Write(textMessage("three"))
+		peer.CloseWithCode(websocket.CloseGoingAway, "bye")
+	}()
+
+	err := conn.Drain(context.Background())
+	if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected a close error with code %d, got %v", websocket.CloseGoingAway, err)
+	}
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Reason != "bye" {
+		t.Fatalf("expected reason bye, got %q", ce.Reason)
+	}
+	if !conn.Closed() {
+		t.Fatalf("expected the connection to be closed")
+	}
+}
+
+func TestDrain_AfterWritingClose(t *testing.T) {
+	a, b := net.Pipe()
+	conn := websocket.From(a)
+	defer b.Close()
+
+	frames := make(chan []byte)
+	go func() {
+		data, _ := io.ReadAll(b)
+		frames <- data
+	}()
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageClose, Data: websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")}); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+
+	go func() {
+		// masked with a zero key
+		b.Write([]byte{0x81, 0x82, 0, 0, 0, 0, 'h', 'i'})   // text frame
+		b.Write([]byte{0x88, 0x82, 0, 0, 0, 0, 0x03, 0xE8}) // close frame with 1000
+	}()
+	err := conn.Drain(context.Background())
+	if !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected a close error with code %d, got %v", websocket.CloseNormalClosure, err)
+	}
+
+	// the peer's close frame completes the handshake, so it is not echoed
+	expected := []byte{0x88, 0x02, 0x03, 0xE8}
+	if data := <-frames; !bytes.Equal(data, expected) {
+		t.Fatalf("expected only the close frame %x to be written, got %x", expected, data)
+	}
+}
+
+func TestDrain_Context(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if err := conn.Drain(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if !conn.Closed() {
+		t.Fatalf("expected the connection to be closed")
+	}
+}
@@ -1,47 +1,154 @@
 package websocket
 
 import (
+	"errors"
 	"fmt"
 	"net"
+	"os"
 )
 
+// Kind identifies what went wrong in an Error. The value of a Kind is the
+// format used for the message of errors of that kind.
+type Kind string
+
 const (
 	// REQUEST_NOT_WEBSOCKET indicates that the HTTP request provided does not specify
 	// instructions for a WebSocket upgrade.
-	REQUEST_NOT_WEBSOCKET = "the request does not specify a websocket upgrade"
+	REQUEST_NOT_WEBSOCKET Kind = "the request does not specify a websocket upgrade"
 	// VERSION_NOT_SUPPORTED indicates that the version provided in the request is not
 	// supported. Currently supported versions: 13.
-	VERSION_NOT_SUPPORTED = "the request specifies an unsupported version"
+	VERSION_NOT_SUPPORTED Kind = "the request specifies an unsupported version"
 	// KEY_NOT_PROVIDED indicates that there is no Sec-WebSocket-Key passed in by the
 	// client.
-	KEY_NOT_PROVIDED = "the request does not specify a Sec-WebSocket-Key"
+	KEY_NOT_PROVIDED Kind = "the request does not specify a Sec-WebSocket-Key"
 	// HTTP_HIJACKING_FAILED indicates an error with hijacking the underlying connection from
 	// http.ResponseWriter.
-	HTTP_HIJACKING_FAILED = "unable to hijack the http connection"
+	HTTP_HIJACKING_FAILED Kind = "unable to hijack the http connection"
 	// CONNECTION_READ_ERROR indicates an error reading from the underlying connection.
-	CONNECTION_READ_ERROR = "reading from the underlying connection failed: %s"
+	CONNECTION_READ_ERROR Kind = "reading from the underlying connection failed: %s"
 	// CONNECTION_WRITE_ERROR indicates an error writing to the underlying connection.
-	CONNECTION_WRITE_ERROR = "writing to the underlying connection failed: %s"
+	CONNECTION_WRITE_ERROR Kind = "writing to the underlying connection failed: %s"
 	// CONNECTION_CLOSED indicates that the underlying connection is closed. This connection
 	// cannot be read from or written to.
-	CONNECTION_CLOSED = "connection is closed"
+	CONNECTION_CLOSED Kind = "connection is closed"
 	// MALFORMED_FRAME indicates that the server recieved an unexpectedly formed frame.
-	MALFORMED_FRAME = "websocket frame is malformed: %s"
+	MALFORMED_FRAME Kind = "websocket frame is malformed: %s"
+	// WRITE_QUEUE_FULL indicates that the write queue is full and the message was not
+	// queued.
+	WRITE_QUEUE_FULL Kind = "the write queue is full"
+	// CONTROL_PAYLOAD_TOO_LONG indicates that a control message (close, ping, or pong) has
+	// a payload longer than the 125 bytes allowed for control frames.
+	CONTROL_PAYLOAD_TOO_LONG Kind = "control frame payload is %d bytes, the maximum is 125 bytes"
+	// INVALID_UTF8 indicates that the payload of a text message is not valid UTF-8.
+	INVALID_UTF8 Kind = "text message payload is not valid utf-8"
+	// PING_TIMEOUT indicates that a pong was not recieved for a ping before its context
+	// was done.
+	PING_TIMEOUT Kind = "a pong was not recieved in time"
+	// CONTROL_HANDLER_ERROR indicates that a ping or pong handler returned an error.
+	CONTROL_HANDLER_ERROR Kind = "control frame handler failed: %s"
+	// INVALID_CLOSE_CODE indicates that a close code may not be sent in a close frame.
+	INVALID_CLOSE_CODE Kind = "close code %d may not be sent"
+	// UNSUPPORTED_MESSAGE_TYPE indicates that a message of an unknown type or of a type
+	// that cannot be written on its own was written.
+	UNSUPPORTED_MESSAGE_TYPE Kind = "messages of type %s cannot be written"
+	// MESSAGE_TOO_LARGE indicates that a message read from or written to the connection
+	// is larger than the read or write limit.
+	MESSAGE_TOO_LARGE Kind = "message is larger than the %s limit of %d bytes"
+	// DEADLINES_NOT_SUPPORTED indicates that the underlying connection is not a net.Conn,
+	// so deadlines cannot be set on it.
+	DEADLINES_NOT_SUPPORTED Kind = "the underlying connection does not support deadlines"
+	// CODEC_ERROR indicates that a Codec failed to marshal or unmarshal a message.
+	CODEC_ERROR Kind = "codec failed: %s"
+	// HANDSHAKE_FAILED indicates that Dial could not connect to the server or that the
+	// server did not accept the WebSocket handshake.
+	HANDSHAKE_FAILED Kind = "the websocket handshake failed: %s"
+	// WRITE_STALLED indicates that the connection was closed because a write was blocked
+	// on the peer for longer than the stall threshold.
+	WRITE_STALLED Kind = "a write was stalled for %s"
+	// IDLE_TIMEOUT indicates that the connection was closed because it saw no traffic for
+	// longer than the idle timeout.
+	IDLE_TIMEOUT Kind = "the connection was idle for %s"
+	// NOT_TCP indicates that the underlying connection is not a TCP connection, so TCP
+	// options cannot be set on it.
+	NOT_TCP Kind = "the underlying connection is not a tcp connection"
+	// SOCKET_OPTION_FAILED indicates that setting an option of the underlying TCP
+	// connection failed.
+	SOCKET_OPTION_FAILED Kind = "setting a socket option failed: %s"
+	// EXPANSION_TOO_LARGE indicates that a compressed message read from the connection
+	// expanded more than the maximum expansion ratio when it was decompressed.
+	EXPANSION_TOO_LARGE Kind = "compressed message expands more than the maximum ratio of %d"
+	// INVALID_COMPRESSION_LEVEL indicates that a compression level is not one of the
+	// levels of compress/flate.
+	INVALID_COMPRESSION_LEVEL Kind = "compression level %d is not valid"
+	// MODE_MISMATCH indicates that a method of message mode, such as Read or Write, was
+	// called on a connection in frame mode, or the other way around.
+	MODE_MISMATCH Kind = "the connection is in %s mode"
+	// WRITER_CLOSED indicates that a writer returned by NextWriter was written to or
+	// closed after it was closed.
+	WRITER_CLOSED Kind = "the message writer is closed"
+	// MESSAGE_ABORTED indicates that a message could not be written whole, because
+	// reading its payload failed.
+	MESSAGE_ABORTED Kind = "the message was aborted: %s"
+)
+
+// Sentinel errors for every Kind. Any Error matches the sentinel of its
+// Kind with errors.Is, for example errors.Is(err, ErrConnectionClosed).
+var (
+	ErrRequestNotWebSocket     = sentinel(REQUEST_NOT_WEBSOCKET, "the request does not specify a websocket upgrade")
+	ErrVersionNotSupported     = sentinel(VERSION_NOT_SUPPORTED, "the request specifies an unsupported version")
+	ErrKeyNotProvided          = sentinel(KEY_NOT_PROVIDED, "the request does not specify a Sec-WebSocket-Key")
+	ErrHijackingFailed         = sentinel(HTTP_HIJACKING_FAILED, "unable to hijack the http connection")
+	ErrRead                    = sentinel(CONNECTION_READ_ERROR, "reading from the underlying connection failed")
+	ErrWrite                   = sentinel(CONNECTION_WRITE_ERROR, "writing to the underlying connection failed")
+	ErrConnectionClosed        = sentinel(CONNECTION_CLOSED, "connection is closed")
+	ErrMalformedFrame          = sentinel(MALFORMED_FRAME, "websocket frame is malformed")
+	ErrWriteQueueFull          = sentinel(WRITE_QUEUE_FULL, "the write queue is full")
+	ErrControlPayloadTooLong   = sentinel(CONTROL_PAYLOAD_TOO_LONG, "control frame payload is longer than 125 bytes")
+	ErrInvalidUTF8             = sentinel(INVALID_UTF8, "text message payload is not valid utf-8")
+	ErrPingTimeout             = sentinel(PING_TIMEOUT, "a pong was not recieved in time")
+	ErrControlHandler          = sentinel(CONTROL_HANDLER_ERROR, "control frame handler failed")
+	ErrInvalidCloseCode        = sentinel(INVALID_CLOSE_CODE, "close code may not be sent")
+	ErrUnsupportedMessageType  = sentinel(UNSUPPORTED_MESSAGE_TYPE, "messages of this type cannot be written")
+	ErrMessageTooLarge         = sentinel(MESSAGE_TOO_LARGE, "message is larger than the limit")
+	ErrDeadlinesNotSupported   = sentinel(DEADLINES_NOT_SUPPORTED, "the underlying connection does not support deadlines")
+	ErrCodec                   = sentinel(CODEC_ERROR, "codec failed")
+	ErrHandshake               = sentinel(HANDSHAKE_FAILED, "the websocket handshake failed")
+	ErrWriteStalled            = sentinel(WRITE_STALLED, "a write was stalled")
+	ErrIdleTimeout             = sentinel(IDLE_TIMEOUT, "the connection was idle for too long")
+	ErrNotTCP                  = sentinel(NOT_TCP, "the underlying connection is not a tcp connection")
+	ErrSocketOption            = sentinel(SOCKET_OPTION_FAILED, "setting a socket option failed")
+	ErrExpansionTooLarge       = sentinel(EXPANSION_TOO_LARGE, "compressed message expands more than the maximum ratio")
+	ErrInvalidCompressionLevel = sentinel(INVALID_COMPRESSION_LEVEL, "compression level is not valid")
+	ErrModeMismatch            = sentinel(MODE_MISMATCH, "the connection is in another mode")
+	ErrWriterClosed            = sentinel(WRITER_CLOSED, "the message writer is closed")
+	ErrMessageAborted          = sentinel(MESSAGE_ABORTED, "the message was aborted")
 )
 
 // Error implements the error interface and provides
 // the Kind of the error.
+//
+// Errors can be compared with errors.Is against the sentinel of their
+// Kind, and errors.As finds an Error wrapped by another error. If the
+// error was caused by another error, such as one returned by the
+// underlying connection, it is returned by errors.Unwrap.
+//
+// Every Error also implements net.Error. Timeout reports true for errors
+// caused by a timeout, such as a context deadline or a deadline of the
+// underlying connection expiring, and for PING_TIMEOUT and IDLE_TIMEOUT
+// errors of the connection's own timers, and such errors match
+// os.ErrDeadlineExceeded with errors.Is.
 type Error interface {
-	Kind() string
+	Kind() Kind
 	Error() string
 }
 
 type err struct {
-	kind string
-	err  string
+	kind  Kind
+	err   string
+	cause error
 }
 
-func (e err) Kind() string {
+func (e err) Kind() Kind {
 	return e.kind
 }
 
@@ -49,13 +156,78 @@ func (e err) Error() string {
 	return e.err
 }
 
-func errorf(kind string, a ...any) Error {
+// Is reports whether target is an Error of the same Kind, or whether
+// target is os.ErrDeadlineExceeded and the error is a timeout.
+func (e err) Is(target error) bool {
+	if target == os.ErrDeadlineExceeded {
+		return e.Timeout()
+	}
+	t, ok := target.(err)
+	return ok && t.kind == e.kind
+}
+
+// Timeout reports whether the error is the result of a timeout. An error
+// with a cause is a timeout if its cause is, such as a context deadline or
+// a deadline of the underlying connection, so a PING_TIMEOUT error caused
+// by a cancelled context is not. Without a cause, PING_TIMEOUT and
+// IDLE_TIMEOUT errors come from the connection's own timers, and are.
+func (e err) Timeout() bool {
+	if e.cause != nil {
+		return isTimeout(e.cause)
+	}
+	return e.kind == PING_TIMEOUT || e.kind == IDLE_TIMEOUT
+}
+
+// Temporary reports the same as Timeout. It is only implemented to satisfy
+// net.Error.
+func (e err) Temporary() bool {
+	return e.Timeout()
+}
+
+// Unwrap returns the error that caused this error, if any.
+func (e err) Unwrap() error {
+	return e.cause
+}
+
+// errorf returns an Error of the kind specified, formatting its message
+// with the arguments. The first argument that is an error becomes the
+// cause of the Error.
+func errorf(kind Kind, a ...any) Error {
+	var cause error
+	for _, arg := range a {
+		if e, ok := arg.(error); ok {
+			cause = e
+			break
+		}
+	}
 	return err{
-		kind: kind,
-		err:  fmt.Sprintf(kind, a...),
+		kind:  kind,
+		err:   fmt.Sprintf(string(kind), a...),
+		cause: cause,
 	}
 }
 
+// wrapError returns an Error of the kind specified caused by cause. The
+// kind must not have any formatting verbs.
+func wrapError(kind Kind, cause error) Error {
+	return err{
+		kind:  kind,
+		err:   fmt.Sprintf("%s: %s", kind, cause),
+		cause: cause,
+	}
+}
+
+// sentinel returns the Error used to compare against errors of a kind.
+func sentinel(kind Kind, message string) Error {
+	return err{kind: kind, err: message}
+}
+
+// isTimeout reports whether err is a net.Error caused by a timeout.
+func isTimeout(err error) bool {
+	var ne net.Error
+	return errors.As(err, &ne) && ne.Timeout()
+}
+
 // isUseOfClosedNetworkConnectionError determines whether or not the error
 // passed in is a use of closed network connection error.
 func isUseOfClosedNetworkConnectionError(err error) bool {
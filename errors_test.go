@@ -0,0 +1,185 @@
+package websocket_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+var sentinels = []struct {
+	kind websocket.Kind
+	err  websocket.Error
+}{
+	{websocket.REQUEST_NOT_WEBSOCKET, websocket.ErrRequestNotWebSocket},
+	{websocket.VERSION_NOT_SUPPORTED, websocket.ErrVersionNotSupported},
+	{websocket.KEY_NOT_PROVIDED, websocket.ErrKeyNotProvided},
+	{websocket.HTTP_HIJACKING_FAILED, websocket.ErrHijackingFailed},
+	{websocket.CONNECTION_READ_ERROR, websocket.ErrRead},
+	{websocket.CONNECTION_WRITE_ERROR, websocket.ErrWrite},
+	{websocket.CONNECTION_CLOSED, websocket.ErrConnectionClosed},
+	{websocket.MALFORMED_FRAME, websocket.ErrMalformedFrame},
+	{websocket.WRITE_QUEUE_FULL, websocket.ErrWriteQueueFull},
+	{websocket.CONTROL_PAYLOAD_TOO_LONG, websocket.ErrControlPayloadTooLong},
+	{websocket.INVALID_UTF8, websocket.ErrInvalidUTF8},
+	{websocket.PING_TIMEOUT, websocket.ErrPingTimeout},
+	{websocket.CONTROL_HANDLER_ERROR, websocket.ErrControlHandler},
+	{websocket.INVALID_CLOSE_CODE, websocket.ErrInvalidCloseCode},
+	{websocket.UNSUPPORTED_MESSAGE_TYPE, websocket.ErrUnsupportedMessageType},
+	{websocket.MESSAGE_TOO_LARGE, websocket.ErrMessageTooLarge},
+	{websocket.DEADLINES_NOT_SUPPORTED, websocket.ErrDeadlinesNotSupported},
+	{websocket.CODEC_ERROR, websocket.ErrCodec},
+	{websocket.HANDSHAKE_FAILED, websocket.ErrHandshake},
+	{websocket.WRITE_STALLED, websocket.ErrWriteStalled},
+	{websocket.IDLE_TIMEOUT, websocket.ErrIdleTimeout},
+	{websocket.NOT_TCP, websocket.ErrNotTCP},
+	{websocket.SOCKET_OPTION_FAILED, websocket.ErrSocketOption},
+	{websocket.EXPANSION_TOO_LARGE, websocket.ErrExpansionTooLarge},
+	{websocket.INVALID_COMPRESSION_LEVEL, websocket.ErrInvalidCompressionLevel},
+	{websocket.MODE_MISMATCH, websocket.ErrModeMismatch},
+	{websocket.WRITER_CLOSED, websocket.ErrWriterClosed},
+	{websocket.MESSAGE_ABORTED, websocket.ErrMessageAborted},
+}
+
+func TestError_IsAs(t *testing.T) {
+	for _, s := range sentinels {
+		wrapped := fmt.Errorf("doing something: %w", s.err)
+		if !errors.Is(wrapped, s.err) {
+			t.Fatalf("expected errors.Is() to match %s", s.kind)
+		}
+		var e websocket.Error
+		if !errors.As(wrapped, &e) {
+			t.Fatalf("expected errors.As() to find a websocket.Error for %s", s.kind)
+		}
+		if e.Kind() != s.kind {
+			t.Fatalf("expected kind %q, got %q", s.kind, e.Kind())
+		}
+		for _, other := range sentinels {
+			if other.kind != s.kind && errors.Is(wrapped, other.err) {
+				t.Fatalf("expected %s not to match %s", s.kind, other.kind)
+			}
+		}
+	}
+}
+
+var errBroken = errors.New("broken")
+
+// BrokenConn is an io.ReadWriteCloser whose reads and writes always fail.
+type BrokenConn struct{}
+
+func (BrokenConn) Read(p []byte) (int, error)  { return 0, errBroken }
+func (BrokenConn) Write(p []byte) (int, error) { return 0, errBroken }
+func (BrokenConn) Close() error                { return nil }
+
+func TestError_ReturnedErrors(t *testing.T) {
+	conn := websocket.From(BrokenConn{})
+	_, err := conn.Read()
+	if !errors.Is(err, websocket.ErrRead) {
+		t.Fatalf("expected a read error, got %v", err)
+	}
+	if !errors.Is(err, errBroken) {
+		t.Fatalf("expected the read error to wrap the underlying error, got %v", err)
+	}
+
+	// the failed read closed conn
+	err = websocket.From(BrokenConn{}).Write(textMessage("hello"))
+	if !errors.Is(err, websocket.ErrWrite) || !errors.Is(err, errBroken) {
+		t.Fatalf("expected a write error wrapping the underlying error, got %v", err)
+	}
+
+	err = conn.Write(&websocket.Message{Type: websocket.MessagePing, Data: make([]byte, 126)})
+	if !errors.Is(err, websocket.ErrControlPayloadTooLong) {
+		t.Fatalf("expected a control payload too long error, got %v", err)
+	}
+
+	conn.Close()
+	_, err = conn.Read()
+	if !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected a connection closed error, got %v", err)
+	}
+	if err.Kind() != websocket.CONNECTION_CLOSED {
+		t.Fatalf("expected kind CONNECTION_CLOSED, got %q", err.Kind())
+	}
+}
+
+// assertTimeout fails the test if err is not a timeout.
+func assertTimeout(t *testing.T, err error) {
+	t.Helper()
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("expected a net.Error timeout, got %v", err)
+	}
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the error to match os.ErrDeadlineExceeded, got %v", err)
+	}
+}
+
+func TestError_Timeout(t *testing.T) {
+	t.Run("Read", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer b.Close()
+		conn := websocket.From(a)
+		defer conn.Close()
+		a.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+		_, err := conn.Read()
+		assertTimeout(t, err)
+	})
+	t.Run("Write", func(t *testing.T) {
+		a, b := net.Pipe()
+		defer b.Close()
+		conn := websocket.From(a)
+		defer conn.Close()
+		a.SetWriteDeadline(time.Now().Add(10 * time.Millisecond))
+		assertTimeout(t, conn.Write(textMessage("hello")))
+	})
+	t.Run("PingContext", func(t *testing.T) {
+		conn, peer := pipe()
+		defer peer.Close()
+		defer conn.Close() // closed first to unblock the peer writing its pong
+		go peer.Read()     // the peer reads the ping but never reads its pong
+
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err := conn.PingRTT(ctx)
+		assertTimeout(t, err)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Fatalf("expected the error to wrap context.DeadlineExceeded, got %v", err)
+		}
+	})
+	t.Run("PingTimeout", func(t *testing.T) {
+		conn, peer := pipe()
+		defer peer.Close()
+		defer conn.Close() // closed first to unblock the peer writing its pong
+		go peer.Read()
+
+		conn.SetPingTimeout(10 * time.Millisecond)
+		_, err := conn.PingRTT(nil)
+		assertTimeout(t, err)
+	})
+
+	// errors that are not timeouts
+	conn, peer := pipe()
+	defer peer.Close()
+	defer conn.Close()
+	go peer.Read()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	_, cancelled := conn.PingRTT(ctx)
+	if !errors.Is(cancelled, websocket.ErrPingTimeout) {
+		t.Fatalf("expected a PING_TIMEOUT error for a cancelled ping, got %v", cancelled)
+	}
+	for _, err := range []error{websocket.ErrConnectionClosed, websocket.ErrRead, websocket.ErrMalformedFrame, cancelled} {
+		var ne net.Error
+		if !errors.As(err, &ne) || ne.Timeout() {
+			t.Fatalf("expected %v to be a net.Error that is not a timeout", err)
+		}
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			t.Fatalf("expected %v not to match os.ErrDeadlineExceeded", err)
+		}
+	}
+}
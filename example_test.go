@@ -0,0 +1,58 @@
+package websocket_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// echo is the handler under test in the examples: it writes every data
+// message it reads back to the peer until the connection is closed.
+func echo(conn *websocket.Conn) {
+	defer conn.Close()
+	for {
+		msg, err := conn.Read()
+		if err != nil {
+			return
+		}
+		if msg.Type == websocket.MessageText || msg.Type == websocket.MessageBinary {
+			if err := conn.Write(msg); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// A handler is tested by running it on the server end of a pipe and
+// talking to it through the client end, without a listener or a handshake.
+func ExamplePipe() {
+	client, server := websocket.Pipe()
+	defer client.Close()
+	go echo(server)
+
+	if err := client.WriteText("hello"); err != nil {
+		fmt.Println(err)
+		return
+	}
+	msg, err := client.Read()
+	if err != nil {
+		fmt.Println(err)
+		return
+	}
+	fmt.Println(msg.Type, string(msg.Data))
+	// Output: MessageText hello
+}
+
+// A pipe whose connection fails partway through a message tests how a
+// handler copes with a broken connection.
+func ExampleFaultyPipe() {
+	client, server := websocket.FaultyPipe(websocket.PipeFaults{Err: io.ErrUnexpectedEOF, ErrorAt: 8})
+	defer client.Close()
+	go echo(server)
+
+	err := client.WriteText("hello, world")
+	fmt.Println(errors.Is(err, websocket.ErrWrite), errors.Is(err, io.ErrUnexpectedEOF))
+	// Output: true true
+}
@@ -0,0 +1,56 @@
+package websocket
+
+import "github.com/tiredkangaroo/websocket/internal/clock"
+
+// UseClock makes conn use clk for all of its timing.
+func UseClock(conn *Conn, clk clock.Clock) {
+	conn.clock = clk
+}
+
+// WithClock is an Option making the Conn use clk for all of its timing,
+// for the connections whose clock must be set before they are used, such
+// as the ones returned by Pipe.
+func WithClock(clk clock.Clock) Option {
+	return func(c *Conn) {
+		c.clock = clk
+	}
+}
+
+// ParseCloseMessage parses the payload of a close frame.
+func ParseCloseMessage(payload []byte) (*CloseError, Error) {
+	return parseCloseMessage(payload, true)
+}
+
+// Deflate compresses data, appending it to dst, as conn compresses the
+// payloads of the messages it writes, or returns false if conn does not
+// compress it.
+func Deflate(conn *Conn, dst, data []byte) ([]byte, bool) {
+	conn.deflater.mx.Lock()
+	defer conn.deflater.mx.Unlock()
+	return conn.deflater.compress(dst, data)
+}
+
+// Inflate decompresses data, appending it to dst, as conn decompresses the
+// payloads of the messages it reads, with its limits.
+func Inflate(conn *Conn, dst, data []byte) ([]byte, error) {
+	out, err := conn.inflate(dst, data)
+	if err != nil {
+		return out, err
+	}
+	return out, nil
+}
+
+// CompressionState returns whether conn keeps a flate writer between
+// messages, and the size of the window it keeps for decompressing them.
+func CompressionState(conn *Conn) (writer bool, window int) {
+	return conn.deflater.w != nil, len(conn.inflater.dict)
+}
+
+// WithNegotiatedCompression is an Option making the Conn use compression
+// with the parameters specified as if it had been negotiated, for the
+// connections created with From.
+func WithNegotiatedCompression(params CompressionParams) Option {
+	return func(c *Conn) {
+		c.compression = &params
+	}
+}
@@ -0,0 +1,334 @@
+package extended
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// The acknowledged delivery protocol of an AckConn uses the frames of the
+// session protocol, as binary messages:
+//
+//	+------+----------+---------+
+//	| kind | sequence | payload |
+//	| 1 B  | 8 B (BE) | ...     |
+//	+------+----------+---------+
+//
+// The kinds of frames are:
+//
+//   - text (1) and binary (2) carry a message of that type as the payload.
+//     Each end numbers the messages it sends from 1, and sends a message
+//     again with the same sequence until it is acknowledged.
+//   - ack (3) has no payload, and acknowledges the message with its
+//     sequence. Every copy of a message is acknowledged, so that a lost ack
+//     is made up for by the ack of the next copy.
+//
+// A message received with a sequence that was already received is a
+// duplicate of it, and is acknowledged again but not delivered.
+const (
+	ackText   byte = 1
+	ackBinary byte = 2
+	ackAck    byte = 3
+)
+
+// ErrAckConnClosed is returned by AckConn.Send once the connection is
+// closed.
+var ErrAckConnClosed = errors.New("the acknowledged connection is closed")
+
+// AckOptions configures an AckConn. The zero value uses the defaults
+// described on each field.
+type AckOptions struct {
+	// RetryTimeout is how long a message waits for its ack before it is
+	// sent again. Defaults to 5 seconds.
+	RetryTimeout time.Duration
+	// MaxAttempts is the amount of times a message is sent before it is
+	// abandoned, including the first. Defaults to 5.
+	MaxAttempts int
+	// OnMessage is called with every message received from the other end,
+	// with its sequence, once: duplicates are dropped. It is called from
+	// the goroutine reading the connection, and the message is
+	// acknowledged once it returns.
+	OnMessage func(seq uint64, msg *websocket.Message)
+	// OnAcked, if set, is called with every message sent that is
+	// acknowledged.
+	OnAcked func(seq uint64, msg *websocket.Message)
+	// OnAbandoned, if set, is called with every message sent that is not
+	// acknowledged after MaxAttempts attempts, or by the time the
+	// connection is closed, so it can be delivered some other way.
+	OnAbandoned func(seq uint64, msg *websocket.Message)
+
+	clock clock.Clock
+}
+
+// AckConn delivers messages over a connection at least once, as long as
+// the connection stays open: every message sent is kept until the other
+// end acknowledges it, and is sent again after RetryTimeout until it is,
+// up to MaxAttempts times. Both ends of the connection must use an
+// AckConn.
+//
+// Messages are delivered in the order they are received, which is the
+// order they were sent unless a message was lost and sent again. Every
+// message sent ends with a call to OnAcked or OnAbandoned.
+//
+// The zero value is not usable; an AckConn is created by NewAckConn.
+// Every method is safe to call concurrently.
+type AckConn struct {
+	conn *websocket.Conn
+	opts AckOptions
+
+	sendMx sync.Mutex // held while a message is numbered and sent
+	mx     sync.Mutex
+	next   uint64 // the sequence of the next message sent
+	// pending are the messages sent that are waiting for their ack
+	pending map[uint64]*pendingMessage
+	// received is the sequence up to which every message was received,
+	// and ahead are the sequences received after it
+	received uint64
+	ahead    map[uint64]struct{}
+	closed   bool
+
+	wake chan struct{}
+}
+
+// pendingMessage is a message sent by an AckConn that was not
+// acknowledged yet.
+type pendingMessage struct {
+	msg      *websocket.Message
+	frame    []byte
+	attempts int
+	retry    time.Time // when it is sent again
+}
+
+// NewAckConn starts reading from conn in a new goroutine to receive
+// messages and acks, and starts a goroutine to send again the messages
+// that are not acknowledged in time. Nothing else should read from conn.
+// Both stop once the connection is closed.
+func NewAckConn(conn *websocket.Conn, opts AckOptions) *AckConn {
+	if opts.RetryTimeout <= 0 {
+		opts.RetryTimeout = 5 * time.Second
+	}
+	if opts.MaxAttempts <= 0 {
+		opts.MaxAttempts = 5
+	}
+	if opts.clock == nil {
+		opts.clock = clock.Real{}
+	}
+	a := &AckConn{
+		conn:    conn,
+		opts:    opts,
+		next:    1,
+		pending: make(map[uint64]*pendingMessage),
+		ahead:   make(map[uint64]struct{}),
+		wake:    make(chan struct{}, 1),
+	}
+	OnMessage(conn, func(_ context.Context, msg *websocket.Message) { a.receive(msg) }, func(err error) {
+		conn.Close()
+	})
+	go a.retry()
+	return a
+}
+
+// Send sends msg, a text or binary message, and returns its sequence. It
+// returns once the message is written, not once it is acknowledged: the
+// outcome is reported to OnAcked or OnAbandoned. If the write fails, the
+// message is still sent again after RetryTimeout.
+func (a *AckConn) Send(msg *websocket.Message) (uint64, error) {
+	kind := ackText
+	switch msg.Type {
+	case websocket.MessageText:
+	case websocket.MessageBinary:
+		kind = ackBinary
+	default:
+		return 0, errors.New("only text and binary messages can be sent with acknowledgements")
+	}
+
+	a.sendMx.Lock()
+	defer a.sendMx.Unlock()
+	a.mx.Lock()
+	if a.closed {
+		a.mx.Unlock()
+		return 0, ErrAckConnClosed
+	}
+	seq := a.next
+	a.next++
+	p := &pendingMessage{
+		msg:      msg,
+		frame:    encodeSessionFrame(kind, seq, msg.Data),
+		attempts: 1,
+		retry:    a.opts.clock.Now().Add(a.opts.RetryTimeout),
+	}
+	a.pending[seq] = p
+	a.mx.Unlock()
+	select {
+	case a.wake <- struct{}{}:
+	default:
+	}
+	return seq, a.conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: p.frame})
+}
+
+// Pending returns the amount of messages sent that are waiting for their
+// ack.
+func (a *AckConn) Pending() int {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	return len(a.pending)
+}
+
+// Conn returns the underlying connection.
+func (a *AckConn) Conn() *websocket.Conn {
+	return a.conn
+}
+
+// receive handles a frame received from the other end. A frame that is
+// not valid closes the connection with CloseProtocolError.
+func (a *AckConn) receive(msg *websocket.Message) {
+	kind, seq, payload, err := decodeSessionFrame(msg)
+	switch {
+	case err != nil || seq == 0:
+	case kind == ackAck:
+		a.mx.Lock()
+		p, ok := a.pending[seq]
+		delete(a.pending, seq)
+		a.mx.Unlock()
+		if ok && a.opts.OnAcked != nil {
+			a.opts.OnAcked(seq, p.msg)
+		}
+		return
+	case kind == ackText || kind == ackBinary:
+		if !a.markReceived(seq) && a.opts.OnMessage != nil {
+			typ := websocket.MessageText
+			if kind == ackBinary {
+				typ = websocket.MessageBinary
+			}
+			a.opts.OnMessage(seq, &websocket.Message{Type: typ, Data: payload})
+		}
+		if err := a.conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: encodeSessionFrame(ackAck, seq, nil)}); err != nil {
+			a.conn.Logger().Error("an error occured while acknowledging a message", "error", err.Error())
+		}
+		return
+	}
+	a.conn.CloseWithCode(websocket.CloseProtocolError, "")
+}
+
+// markReceived records seq as received, and returns whether it already
+// was.
+func (a *AckConn) markReceived(seq uint64) (duplicate bool) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	if _, ok := a.ahead[seq]; ok || seq <= a.received {
+		return true
+	}
+	a.ahead[seq] = struct{}{}
+	for {
+		if _, ok := a.ahead[a.received+1]; !ok {
+			return false
+		}
+		delete(a.ahead, a.received+1)
+		a.received++
+	}
+}
+
+// retry sends again the messages that are due until the connection is
+// closed, then abandons the messages that are still pending.
+func (a *AckConn) retry() {
+	for {
+		var timeout <-chan time.Time
+		var timer clock.Timer
+		if next, ok := a.nextRetry(); ok {
+			timer = a.opts.clock.NewTimer(next.Sub(a.opts.clock.Now()))
+			timeout = timer.C()
+		}
+		select {
+		case <-timeout:
+			a.resend()
+		case <-a.wake:
+		case <-a.conn.Done():
+			if timer != nil {
+				timer.Stop()
+			}
+			a.close()
+			return
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+	}
+}
+
+// nextRetry returns when the next pending message is sent again, if any.
+func (a *AckConn) nextRetry() (time.Time, bool) {
+	a.mx.Lock()
+	defer a.mx.Unlock()
+	var next time.Time
+	for _, p := range a.pending {
+		if next.IsZero() || p.retry.Before(next) {
+			next = p.retry
+		}
+	}
+	return next, !next.IsZero()
+}
+
+// resend sends again the pending messages that are due, in order, and
+// abandons the ones out of attempts.
+func (a *AckConn) resend() {
+	now := a.opts.clock.Now()
+	var due, abandoned []uint64
+	a.mx.Lock()
+	for seq, p := range a.pending {
+		if p.retry.After(now) {
+			continue
+		}
+		if p.attempts >= a.opts.MaxAttempts {
+			abandoned = append(abandoned, seq)
+			continue
+		}
+		due = append(due, seq)
+	}
+	a.mx.Unlock()
+	slices.Sort(due)
+	for _, seq := range due {
+		a.mx.Lock()
+		p, ok := a.pending[seq]
+		if ok {
+			p.attempts++
+			p.retry = now.Add(a.opts.RetryTimeout)
+		}
+		a.mx.Unlock()
+		if !ok {
+			continue
+		}
+		if err := a.conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: p.frame}); err != nil {
+			break
+		}
+	}
+	a.abandon(abandoned)
+}
+
+// close abandons every pending message once the connection is closed.
+func (a *AckConn) close() {
+	a.mx.Lock()
+	a.closed = true
+	seqs := keys(a.pending)
+	a.mx.Unlock()
+	slices.Sort(seqs)
+	a.abandon(seqs)
+}
+
+// abandon removes the pending messages with the sequences specified and
+// reports them to OnAbandoned.
+func (a *AckConn) abandon(seqs []uint64) {
+	for _, seq := range seqs {
+		a.mx.Lock()
+		p, ok := a.pending[seq]
+		delete(a.pending, seq)
+		a.mx.Unlock()
+		if ok && a.opts.OnAbandoned != nil {
+			a.opts.OnAbandoned(seq, p.msg)
+		}
+	}
+}
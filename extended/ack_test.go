@@ -0,0 +1,231 @@
+package extended_test
+
+import (
+	"encoding/binary"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// ackFrame encodes a frame of the acknowledged delivery protocol.
+func ackFrame(kind byte, seq uint64, payload string) *websocket.Message {
+	data := binary.BigEndian.AppendUint64([]byte{kind}, seq)
+	return &websocket.Message{Type: websocket.MessageBinary, Data: append(data, payload...)}
+}
+
+// readAckFrame reads a frame of the acknowledged delivery protocol.
+func readAckFrame(t *testing.T, conn *websocket.Conn) (kind byte, seq uint64, payload string) {
+	t.Helper()
+	msg, err := conn.Read()
+	if err != nil {
+		t.Fatalf("expected no error from Read(), got %v", err)
+	}
+	if msg.Type != websocket.MessageBinary || len(msg.Data) < 9 {
+		t.Fatalf("expected a frame, got %s %q", msg.Type, msg.Data)
+	}
+	return msg.Data[0], binary.BigEndian.Uint64(msg.Data[1:]), string(msg.Data[9:])
+}
+
+// ackRecorder records the outcome of the messages sent by an AckConn.
+type ackRecorder struct {
+	mx        sync.Mutex
+	acked     []uint64
+	abandoned []uint64
+}
+
+func (r *ackRecorder) options(opts extended.AckOptions) extended.AckOptions {
+	opts.OnAcked = func(seq uint64, msg *websocket.Message) {
+		r.mx.Lock()
+		defer r.mx.Unlock()
+		r.acked = append(r.acked, seq)
+	}
+	opts.OnAbandoned = func(seq uint64, msg *websocket.Message) {
+		r.mx.Lock()
+		defer r.mx.Unlock()
+		r.abandoned = append(r.abandoned, seq)
+	}
+	return opts
+}
+
+func (r *ackRecorder) counts() (acked, abandoned int) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return len(r.acked), len(r.abandoned)
+}
+
+func TestAckConn_Retransmit(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	defer conn.Close()
+	clk := clock.NewFake()
+	var r ackRecorder
+	a := extended.NewAckConn(conn, extended.AckWithClock(r.options(extended.AckOptions{RetryTimeout: time.Second}), clk))
+
+	go a.Send(textMessage("hello"))
+	if kind, seq, payload := readAckFrame(t, peer); kind != 1 || seq != 1 || payload != "hello" {
+		t.Fatalf("expected text message 1, got %d %d %q", kind, seq, payload)
+	}
+	// the ack is lost, so the message is sent again
+	waitForTimer(t, clk, time.Second)
+	go clk.Advance(time.Second)
+	if kind, seq, payload := readAckFrame(t, peer); kind != 1 || seq != 1 || payload != "hello" {
+		t.Fatalf("expected text message 1 again, got %d %d %q", kind, seq, payload)
+	}
+	if err := peer.Write(ackFrame(3, 1, "")); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+	waitFor(t, time.Second, func() bool { return a.Pending() == 0 })
+	if acked, abandoned := r.counts(); acked != 1 || abandoned != 0 {
+		t.Fatalf("expected the message to be acknowledged, got %d acked and %d abandoned", acked, abandoned)
+	}
+}
+
+func TestAckConn_Abandon(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	defer conn.Close()
+	clk := clock.NewFake()
+	var r ackRecorder
+	a := extended.NewAckConn(conn, extended.AckWithClock(r.options(extended.AckOptions{RetryTimeout: time.Second, MaxAttempts: 2}), clk))
+	go readLoop(peer)
+
+	if _, err := a.Send(textMessage("hello")); err != nil {
+		t.Fatalf("expected no error from Send(), got %v", err)
+	}
+	for range 2 {
+		waitForTimer(t, clk, time.Second)
+		clk.Advance(time.Second)
+	}
+	waitFor(t, time.Second, func() bool { return a.Pending() == 0 })
+	if acked, abandoned := r.counts(); acked != 0 || abandoned != 1 {
+		t.Fatalf("expected the message to be abandoned, got %d acked and %d abandoned", acked, abandoned)
+	}
+
+	// the messages pending once the connection is closed are abandoned
+	a.Send(textMessage("bye"))
+	conn.Close()
+	waitFor(t, time.Second, func() bool {
+		_, abandoned := r.counts()
+		return abandoned == 2
+	})
+	if _, err := a.Send(textMessage("late")); err != extended.ErrAckConnClosed {
+		t.Fatalf("expected ErrAckConnClosed, got %v", err)
+	}
+}
+
+func TestAckConn_Duplicates(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	defer conn.Close()
+	received := make(chan string, 8)
+	extended.NewAckConn(conn, extended.AckOptions{
+		OnMessage: func(seq uint64, msg *websocket.Message) {
+			received <- strconv.FormatUint(seq, 10) + " " + msg.Type.String() + " " + string(msg.Data)
+		},
+	})
+
+	// 2 arrives before 1, and both arrive twice
+	for _, f := range []*websocket.Message{ackFrame(2, 2, "b"), ackFrame(1, 1, "a"), ackFrame(2, 2, "b"), ackFrame(1, 1, "a")} {
+		go peer.Write(f)
+		kind, seq, _ := readAckFrame(t, peer)
+		if kind != 3 || seq != binary.BigEndian.Uint64(f.Data[1:]) {
+			t.Fatalf("expected every copy to be acknowledged, got %d %d", kind, seq)
+		}
+	}
+	if got := <-received; got != "2 MessageBinary b" {
+		t.Fatalf("expected binary message 2, got %q", got)
+	}
+	if got := <-received; got != "1 MessageText a" {
+		t.Fatalf("expected text message 1, got %q", got)
+	}
+	select {
+	case got := <-received:
+		t.Fatalf("expected duplicates to be dropped, got %q", got)
+	default:
+	}
+
+	// a frame that is not valid closes the connection
+	go peer.Write(textMessage("hello"))
+	if _, err := peer.Read(); !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+		t.Fatalf("expected the connection to be closed with CloseProtocolError, got %v", err)
+	}
+}
+
+func TestAckConn_LostAcks(t *testing.T) {
+	// the acks from b to a go through a relay that loses every other one
+	aConn, aRelay := pipe()
+	bRelay, bConn := pipe()
+	defer aConn.Close()
+	defer bConn.Close()
+	defer aRelay.Close()
+	defer bRelay.Close()
+	go func() {
+		for {
+			msg, err := aRelay.Read()
+			if err != nil {
+				return
+			}
+			if msg.IsData() {
+				bRelay.Write(msg)
+			}
+		}
+	}()
+	go func() {
+		lose := true
+		for {
+			msg, err := bRelay.Read()
+			if err != nil {
+				return
+			}
+			if lose = !lose; msg.IsData() && !lose {
+				aRelay.Write(msg)
+			}
+		}
+	}()
+
+	clk := clock.NewFake()
+	var r ackRecorder
+	a := extended.NewAckConn(aConn, extended.AckWithClock(r.options(extended.AckOptions{RetryTimeout: time.Second, MaxAttempts: 10}), clk))
+	var mx sync.Mutex
+	var received []string
+	extended.NewAckConn(bConn, extended.AckOptions{
+		OnMessage: func(seq uint64, msg *websocket.Message) {
+			mx.Lock()
+			defer mx.Unlock()
+			received = append(received, string(msg.Data))
+		},
+	})
+
+	for i := range 20 {
+		if _, err := a.Send(textMessage(strconv.Itoa(i))); err != nil {
+			t.Fatalf("expected no error from Send(), got %v", err)
+		}
+	}
+	waitFor(t, 5*time.Second, func() bool {
+		if a.Pending() == 0 {
+			return true
+		}
+		clk.Advance(time.Second)
+		time.Sleep(time.Millisecond)
+		return false
+	})
+
+	if acked, abandoned := r.counts(); acked != 20 || abandoned != 0 {
+		t.Fatalf("expected every message to be acknowledged, got %d acked and %d abandoned", acked, abandoned)
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	for i, got := range received {
+		if got != strconv.Itoa(i) {
+			t.Fatalf("expected the messages once each and in order, got %v", received)
+		}
+	}
+	if len(received) != 20 {
+		t.Fatalf("expected 20 messages, got %v", received)
+	}
+}
@@ -0,0 +1,97 @@
+package extended
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// authReplyTimeout is how long Authenticate waits to write its failure
+// reply before closing the connection.
+const authReplyTimeout = time.Second
+
+// ErrAuthTimeout is returned by Authenticate when no message is received
+// in time.
+var ErrAuthTimeout = errors.New("no authentication message was received in time")
+
+// Authenticate requires the first text or binary message conn receives to
+// authenticate it, since browsers cannot set headers such as Authorization
+// on the opening handshake. It waits up to timeout for the message, and
+// calls validate with it, which returns the identity of the peer, such as
+// its user, or an error if the message is not valid credentials. Any
+// message that is not an authentication message is therefore rejected by
+// validate. The identity is returned as is, usually to be stored on the
+// connection with Set.
+//
+// If no message is received in time, or validate returns an error, the
+// peer is replied to with a message of type "auth_failed" with an
+// ErrorPayload, in the format of a Router:
+//
+//	{"type": "auth_failed", "payload": {"error": "invalid token"}}
+//
+// and conn is closed with 1008 (policy violation). The error of validate
+// is sent to the peer as is, so it should not reveal more than the peer
+// may know. Authenticate then returns ErrAuthTimeout or the error of
+// validate. If ctx is done first, conn is closed with 1001 (going away)
+// and ctx.Err() is returned.
+//
+// The timeout is enforced with a read deadline, which is cleared once the
+// message is received. If the underlying connection does not support
+// deadlines, conn is closed without a reply instead. Nothing else should
+// read from conn until Authenticate returns.
+func Authenticate(ctx context.Context, conn *websocket.Conn, timeout time.Duration, validate func(msg *websocket.Message) (identity any, err error)) (any, error) {
+	authCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	nc := conn.NetConn()
+	if nc != nil {
+		nc.SetReadDeadline(time.Now().Add(timeout))
+	}
+	// a done ctx interrupts reading, either by moving the deadline up or
+	// by closing the connection
+	stop := context.AfterFunc(authCtx, func() {
+		if nc != nil {
+			nc.SetReadDeadline(time.Now())
+			return
+		}
+		conn.Close()
+	})
+	msg, err := readDataMessage(conn)
+	interrupted := !stop()
+
+	switch {
+	case ctx.Err() != nil:
+		conn.CloseWithCode(websocket.CloseGoingAway, "")
+		return nil, ctx.Err()
+	case interrupted || errors.Is(err, os.ErrDeadlineExceeded):
+		rejectAuth(conn, ErrAuthTimeout)
+		return nil, ErrAuthTimeout
+	case err != nil:
+		return nil, err
+	}
+	if nc != nil {
+		nc.SetReadDeadline(time.Time{})
+	}
+	identity, err := validate(msg)
+	if err != nil {
+		rejectAuth(conn, err)
+		return nil, fmt.Errorf("authentication failed: %w", err)
+	}
+	return identity, nil
+}
+
+// rejectAuth replies to the peer of conn that authenticating failed with
+// err, and closes it with 1008 (policy violation).
+func rejectAuth(conn *websocket.Conn, err error) {
+	if nc := conn.NetConn(); nc != nil {
+		nc.SetWriteDeadline(time.Now().Add(authReplyTimeout))
+	}
+	if payload, err := json.Marshal(ErrorPayload{Error: err.Error()}); err == nil && !conn.Closed() {
+		conn.WriteVia(websocket.JSONCodec{}, Envelope{Type: "auth_failed", Payload: payload})
+	}
+	conn.CloseWithCode(websocket.ClosePolicyViolation, "authentication failed")
+}
@@ -0,0 +1,136 @@
+package extended_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+var errInvalidToken = errors.New("invalid token")
+
+// validateToken accepts {"type": "auth", "payload": {"token": "secret"}}
+// as the credentials of alice.
+func validateToken(msg *websocket.Message) (any, error) {
+	var env extended.Envelope
+	if err := json.Unmarshal(msg.Data, &env); err != nil || env.Type != "auth" {
+		return nil, errors.New("expected an auth message")
+	}
+	var creds struct {
+		Token string `json:"token"`
+	}
+	if err := json.Unmarshal(env.Payload, &creds); err != nil || creds.Token != "secret" {
+		return nil, errInvalidToken
+	}
+	return "alice", nil
+}
+
+// authenticate runs Authenticate on server in a new goroutine.
+func authenticate(ctx context.Context, server *websocket.Conn, timeout time.Duration) <-chan error {
+	result := make(chan error, 1)
+	go func() {
+		identity, err := extended.Authenticate(ctx, server, timeout, validateToken)
+		if err == nil && identity != "alice" {
+			err = errors.New("expected alice")
+		}
+		result <- err
+	}()
+	return result
+}
+
+// expectAuthFailed reads the failure reply and the close frame from client.
+func expectAuthFailed(t *testing.T, client *websocket.Conn, reason string) {
+	t.Helper()
+	var env extended.Envelope
+	if err := client.ReadVia(websocket.JSONCodec{}, &env); err != nil {
+		t.Fatalf("expected the failure reply, got %v", err)
+	}
+	var payload extended.ErrorPayload
+	if err := json.Unmarshal(env.Payload, &payload); err != nil || env.Type != "auth_failed" || payload.Error != reason {
+		t.Fatalf("expected auth_failed with %q, got %s %s", reason, env.Type, env.Payload)
+	}
+	if _, err := client.Read(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected the connection to be closed with 1008, got %v", err)
+	}
+}
+
+func TestAuthenticate(t *testing.T) {
+	client, server := pipe()
+	defer client.Close()
+	defer server.Close()
+	result := authenticate(context.Background(), server, 50*time.Millisecond)
+
+	send(t, client, `{"type": "auth", "payload": {"token": "secret"}}`)
+	if err := <-result; err != nil {
+		t.Fatalf("expected alice to be authenticated, got %v", err)
+	}
+	// the deadline is cleared
+	time.Sleep(100 * time.Millisecond)
+	go client.Write(textMessage("hello"))
+	if msg, err := server.Read(); err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("expected the connection to stay usable, got %v and %v", msg, err)
+	}
+}
+
+func TestAuthenticate_InvalidCredentials(t *testing.T) {
+	client, server := pipe()
+	defer client.Close()
+	defer server.Close()
+	result := authenticate(context.Background(), server, time.Second)
+
+	send(t, client, `{"type": "auth", "payload": {"token": "guess"}}`)
+	expectAuthFailed(t, client, "invalid token")
+	if err := <-result; !errors.Is(err, errInvalidToken) {
+		t.Fatalf("expected the error of validate, got %v", err)
+	}
+}
+
+func TestAuthenticate_MessageFirst(t *testing.T) {
+	client, server := pipe()
+	defer client.Close()
+	defer server.Close()
+	result := authenticate(context.Background(), server, time.Second)
+
+	// pings are not messages, and are answered as usual
+	go client.Write(&websocket.Message{Type: websocket.MessagePing})
+	if msg, err := client.Read(); err != nil || msg.Type != websocket.MessagePong {
+		t.Fatalf("expected a pong, got %v and %v", msg, err)
+	}
+	send(t, client, `{"type": "chat.send", "payload": {"text": "hi"}}`)
+	expectAuthFailed(t, client, "expected an auth message")
+	if err := <-result; err == nil {
+		t.Fatalf("expected an error")
+	}
+}
+
+func TestAuthenticate_Timeout(t *testing.T) {
+	client, server := pipe()
+	defer client.Close()
+	defer server.Close()
+	result := authenticate(context.Background(), server, 20*time.Millisecond)
+
+	expectAuthFailed(t, client, extended.ErrAuthTimeout.Error())
+	if err := <-result; !errors.Is(err, extended.ErrAuthTimeout) {
+		t.Fatalf("expected ErrAuthTimeout, got %v", err)
+	}
+}
+
+func TestAuthenticate_ContextDone(t *testing.T) {
+	client, server := pipe()
+	defer client.Close()
+	defer server.Close()
+	ctx, cancel := context.WithCancel(context.Background())
+	result := authenticate(ctx, server, time.Second)
+
+	cancel()
+	if _, err := client.Read(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected the connection to be closed with 1001, got %v", err)
+	}
+	if err := <-result; !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
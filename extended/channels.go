@@ -0,0 +1,163 @@
+package extended
+
+import (
+	"sync"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// FullPolicy is what Channels does with a message read while the in
+// channel is full.
+type FullPolicy int
+
+const (
+	// FullBlock stops reading until there is room in the channel, so a
+	// slow receiver slows down the peer through the backpressure of the
+	// connection.
+	FullBlock FullPolicy = iota
+	// FullDropNewest drops the message that was read.
+	FullDropNewest
+	// FullDropOldest drops the oldest message in the channel to make room
+	// for the message that was read.
+	FullDropOldest
+	// FullClose closes the connection with 1008 (policy violation).
+	FullClose
+)
+
+// ChanOptions configures Channels.
+type ChanOptions struct {
+	// ReadBuffer is the capacity of the in channel.
+	ReadBuffer int
+	// WriteBuffer is the capacity of the out channel.
+	WriteBuffer int
+	// Full is what to do with a message read while the in channel is full.
+	// It defaults to FullBlock.
+	Full FullPolicy
+	// OnDrop, if set, is called with every message dropped by
+	// FullDropNewest or FullDropOldest.
+	OnDrop func(msg *websocket.Message)
+}
+
+// Channels returns channels to use conn with, for code that selects on
+// messages alongside other events. A goroutine reads the text and binary
+// messages from conn into in, and another writes the messages sent on out
+// to conn, in order. Control messages are handled by conn as usual.
+//
+// Closing out closes the connection with 1000 (normal closure) once the
+// messages sent before are written. Either way, once the connection ends,
+// in is closed, and the error that ended it is sent on errs, which is then
+// closed. That is the error reading failed with, such as a
+// CONNECTION_CLOSED error, or the error writing a message failed with,
+// which closes the connection. errs always receives exactly one error, so
+// it can be waited on after in is closed.
+//
+// Once the connection ends, the messages sent on out are not written
+// anymore, so sending on out may block: senders should also select on in
+// or errs. The messages read but not yet delivered when the connection
+// ends are dropped.
+func Channels(conn *websocket.Conn, opts ChanOptions) (in <-chan *websocket.Message, out chan<- *websocket.Message, errs <-chan error) {
+	c := &channels{
+		conn: conn,
+		opts: opts,
+		in:   make(chan *websocket.Message, opts.ReadBuffer),
+		out:  make(chan *websocket.Message, opts.WriteBuffer),
+		errs: make(chan error, 1),
+	}
+	go c.read()
+	go c.write()
+	return c.in, c.out, c.errs
+}
+
+// channels pumps messages between a Conn and the channels returned by
+// Channels.
+type channels struct {
+	conn *websocket.Conn
+	opts ChanOptions
+	in   chan *websocket.Message
+	out  chan *websocket.Message
+
+	once sync.Once
+	errs chan error
+}
+
+// end sends err on errs, unless the connection already ended.
+func (c *channels) end(err error) {
+	c.once.Do(func() {
+		c.errs <- err
+		close(c.errs)
+	})
+}
+
+func (c *channels) read() {
+	defer close(c.in)
+	for {
+		msg, err := c.conn.Read()
+		if err != nil {
+			c.end(err)
+			return
+		}
+		if msg.IsData() {
+			c.deliver(msg)
+		}
+	}
+}
+
+// deliver sends msg on in, applying the policy if it is full.
+func (c *channels) deliver(msg *websocket.Message) {
+	select {
+	case c.in <- msg:
+		return
+	default:
+	}
+	switch c.opts.Full {
+	case FullDropNewest:
+		c.drop(msg)
+	case FullDropOldest:
+		// this is the only goroutine sending on in, so there is room for
+		// msg once the oldest message is dropped
+		select {
+		case oldest := <-c.in:
+			c.drop(oldest)
+		default:
+		}
+		c.send(msg)
+	case FullClose:
+		c.conn.CloseWithCode(websocket.ClosePolicyViolation, "too many messages")
+	default:
+		c.send(msg)
+	}
+}
+
+// send sends msg on in, blocking until there is room or the connection
+// ends.
+func (c *channels) send(msg *websocket.Message) {
+	select {
+	case c.in <- msg:
+	case <-c.conn.Done():
+	}
+}
+
+func (c *channels) drop(msg *websocket.Message) {
+	if c.opts.OnDrop != nil {
+		c.opts.OnDrop(msg)
+	}
+}
+
+func (c *channels) write() {
+	for {
+		select {
+		case msg, ok := <-c.out:
+			if !ok {
+				c.conn.CloseWithCode(websocket.CloseNormalClosure, "")
+				return
+			}
+			if err := c.conn.Write(msg); err != nil {
+				c.end(err)
+				c.conn.Close()
+				return
+			}
+		case <-c.conn.Done():
+			return
+		}
+	}
+}
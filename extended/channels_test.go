@@ -0,0 +1,195 @@
+package extended_test
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// receiveAll returns the text of the messages received from in until it is
+// closed.
+func receiveAll(t *testing.T, in <-chan *websocket.Message) []string {
+	t.Helper()
+	var texts []string
+	for {
+		select {
+		case msg, ok := <-in:
+			if !ok {
+				return texts
+			}
+			texts = append(texts, string(msg.Data))
+		case <-time.After(time.Second):
+			t.Fatalf("expected in to be closed, got %v so far", texts)
+		}
+	}
+}
+
+// expectErr returns the single error sent on errs.
+func expectErr(t *testing.T, errs <-chan error) error {
+	t.Helper()
+	var err error
+	select {
+	case err = <-errs:
+	case <-time.After(time.Second):
+		t.Fatalf("expected an error")
+	}
+	if extra, ok := <-errs; ok {
+		t.Fatalf("expected a single error, got %v too", extra)
+	}
+	return err
+}
+
+func TestChannels(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	defer conn.Close()
+
+	in, out, _ := extended.Channels(conn, extended.ChanOptions{ReadBuffer: 4, WriteBuffer: 4})
+	send(t, peer, "hello")
+	select {
+	case msg := <-in:
+		if string(msg.Data) != "hello" {
+			t.Fatalf("expected hello, got %q", msg.Data)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected a message on in")
+	}
+
+	out <- &websocket.Message{Type: websocket.MessageText, Data: []byte("one")}
+	out <- &websocket.Message{Type: websocket.MessageBinary, Data: []byte("two")}
+	for _, expected := range []string{"one", "two"} {
+		msg, err := peer.Read()
+		if err != nil {
+			t.Fatalf("expected no error from Read(), got %v", err)
+		}
+		if string(msg.Data) != expected {
+			t.Fatalf("expected %q, got %q", expected, msg.Data)
+		}
+	}
+}
+
+func TestChannels_CloseOut(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+
+	in, out, errs := extended.Channels(conn, extended.ChanOptions{WriteBuffer: 1})
+	out <- &websocket.Message{Type: websocket.MessageText, Data: []byte("bye")}
+	close(out)
+
+	if msg, err := peer.Read(); err != nil || string(msg.Data) != "bye" {
+		t.Fatalf("expected the buffered message to be written, got %v and %v", msg, err)
+	}
+	if _, err := peer.Read(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected the connection to be closed with 1000, got %v", err)
+	}
+	receiveAll(t, in)
+	if err := expectErr(t, errs); !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected a CONNECTION_CLOSED error, got %v", err)
+	}
+}
+
+func TestChannels_PeerClose(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+
+	in, _, errs := extended.Channels(conn, extended.ChanOptions{ReadBuffer: 4})
+	go readLoop(peer)
+	send(t, peer, "hello")
+	peer.CloseWithCode(websocket.CloseGoingAway, "")
+
+	if texts := receiveAll(t, in); len(texts) != 1 || texts[0] != "hello" {
+		t.Fatalf("expected the message sent before closing, got %v", texts)
+	}
+	if err := expectErr(t, errs); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected the peer's close error, got %v", err)
+	}
+}
+
+func TestChannels_Full(t *testing.T) {
+	tests := []struct {
+		name     string
+		full     extended.FullPolicy
+		received []string
+		dropped  []string
+	}{
+		{"block", extended.FullBlock, []string{"1", "2", "3", "4"}, nil},
+		{"drop newest", extended.FullDropNewest, []string{"1", "2"}, []string{"3", "4"}},
+		{"drop oldest", extended.FullDropOldest, []string{"3", "4"}, []string{"1", "2"}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			conn, peer := pipe()
+			defer peer.Close()
+			defer conn.Close()
+
+			var mx sync.Mutex
+			var dropped []string
+			in, _, _ := extended.Channels(conn, extended.ChanOptions{
+				ReadBuffer: 2,
+				Full:       test.full,
+				OnDrop: func(msg *websocket.Message) {
+					mx.Lock()
+					defer mx.Unlock()
+					dropped = append(dropped, string(msg.Data))
+				},
+			})
+			sent := make(chan struct{})
+			go func() {
+				defer close(sent)
+				for _, text := range []string{"1", "2", "3", "4"} {
+					send(t, peer, text)
+				}
+			}()
+			if test.full != extended.FullBlock {
+				<-sent
+				waitFor(t, time.Second, func() bool {
+					mx.Lock()
+					defer mx.Unlock()
+					return len(dropped) == len(test.dropped)
+				})
+			}
+
+			var received []string
+			for range test.received {
+				received = append(received, string((<-in).Data))
+			}
+			<-sent
+			if len(received) != len(test.received) || len(dropped) != len(test.dropped) {
+				t.Fatalf("expected to receive %v and drop %v, got %v and %v", test.received, test.dropped, received, dropped)
+			}
+			for i := range received {
+				if received[i] != test.received[i] {
+					t.Fatalf("expected to receive %v, got %v", test.received, received)
+				}
+			}
+			for i := range dropped {
+				if dropped[i] != test.dropped[i] {
+					t.Fatalf("expected to drop %v, got %v", test.dropped, dropped)
+				}
+			}
+		})
+	}
+}
+
+func TestChannels_FullClose(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	defer conn.Close()
+
+	in, _, errs := extended.Channels(conn, extended.ChanOptions{ReadBuffer: 1, Full: extended.FullClose})
+	send(t, peer, "1")
+	send(t, peer, "2")
+	if _, err := peer.Read(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected the connection to be closed with 1008, got %v", err)
+	}
+	if texts := receiveAll(t, in); len(texts) != 1 || texts[0] != "1" {
+		t.Fatalf("expected the message that fit, got %v", texts)
+	}
+	if err := expectErr(t, errs); !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected a CONNECTION_CLOSED error, got %v", err)
+	}
+}
@@ -0,0 +1,187 @@
+package extended
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// DispatchOverflow determines what a Dispatcher does with a message read
+// while the queue it goes to is full.
+type DispatchOverflow uint8
+
+const (
+	// DispatchBlock stops reading from the connection until there is room
+	// in the queue, which slows down the peer.
+	DispatchBlock DispatchOverflow = iota
+	// DispatchDrop discards the message.
+	DispatchDrop
+	// DispatchClose closes the connection with close code 1013 (try again
+	// later).
+	DispatchClose
+)
+
+// DispatchOptions configures a Dispatcher. The zero value uses the
+// defaults described on each field.
+type DispatchOptions struct {
+	// Workers is the amount of goroutines calling the handler. Defaults
+	// to 1.
+	Workers int
+	// QueueSize is the amount of messages that can wait for a worker: in
+	// the queue shared by the workers, or in the queue of each worker if
+	// Ordered is set. Defaults to 64.
+	QueueSize int
+	// Ordered makes every connection's messages go to the same worker, so
+	// they are handled one at a time, in the order they were read. Without
+	// it, any idle worker handles the next message, so the messages of a
+	// connection may be handled concurrently and finish out of order.
+	Ordered bool
+	// Overflow is what to do with a message read while its queue is full.
+	// Defaults to DispatchBlock.
+	Overflow DispatchOverflow
+}
+
+// dispatchJob is a message waiting for a worker.
+type dispatchJob struct {
+	conn *websocket.Conn
+	msg  *websocket.Message
+}
+
+// Dispatcher reads messages from connections and hands them to a pool of
+// workers through bounded queues, so a slow handler does not stall reading
+// and the amount of goroutines stays fixed. It is created by NewDispatcher
+// or Dispatch.
+type Dispatcher struct {
+	handler func(conn *websocket.Conn, msg *websocket.Message)
+	opts    DispatchOptions
+	queues  []chan dispatchJob // one per worker if ordered, a shared one otherwise
+	wg      sync.WaitGroup
+
+	depth   atomic.Int64
+	dropped atomic.Uint64
+
+	mx     sync.RWMutex // held for writing when closing the queues
+	closed bool
+	// closed by Close before the queues, so that the messages waiting for
+	// room in a queue give up and release the read lock of mx
+	done      chan struct{}
+	closeOnce sync.Once
+}
+
+// NewDispatcher starts the workers of a Dispatcher that calls handler with
+// every text and binary message read from the connections added to it
+// with Add.
+func NewDispatcher(handler func(conn *websocket.Conn, msg *websocket.Message), opts DispatchOptions) *Dispatcher {
+	opts.Workers = max(opts.Workers, 1)
+	if opts.QueueSize <= 0 {
+		opts.QueueSize = 64
+	}
+	d := &Dispatcher{handler: handler, opts: opts, done: make(chan struct{})}
+	if opts.Ordered {
+		d.queues = make([]chan dispatchJob, opts.Workers)
+		for i := range d.queues {
+			d.queues[i] = make(chan dispatchJob, opts.QueueSize)
+		}
+	} else {
+		d.queues = []chan dispatchJob{make(chan dispatchJob, opts.QueueSize)}
+	}
+	for i := range opts.Workers {
+		d.wg.Add(1)
+		go d.work(d.queues[i%len(d.queues)])
+	}
+	return d
+}
+
+// Dispatch reads messages from conn in a new goroutine and hands them to
+// the workers of a new Dispatcher, which is closed once conn is closed.
+func Dispatch(conn *websocket.Conn, handler func(conn *websocket.Conn, msg *websocket.Message), opts DispatchOptions) *Dispatcher {
+	d := NewDispatcher(handler, opts)
+	d.Add(conn)
+	go func() {
+		<-conn.Done()
+		d.Close()
+	}()
+	return d
+}
+
+// Add reads messages from conn in a new goroutine and queues them for the
+// workers, like OnMessage, until reading fails or the returned function is
+// called.
+func (d *Dispatcher) Add(conn *websocket.Conn) (stop func()) {
+	return OnMessage(conn, func(_ context.Context, msg *websocket.Message) {
+		d.enqueue(conn, msg)
+	}, nil)
+}
+
+// QueueDepth returns the amount of messages waiting for a worker.
+func (d *Dispatcher) QueueDepth() int {
+	return int(d.depth.Load())
+}
+
+// Dropped returns the amount of messages discarded because their queue was
+// full.
+func (d *Dispatcher) Dropped() uint64 {
+	return d.dropped.Load()
+}
+
+// Close stops queueing messages and waits for the workers to handle the
+// messages already queued. Messages read afterwards, and the ones waiting
+// for room in a queue with DispatchBlock, are discarded. It does not close
+// the connections.
+func (d *Dispatcher) Close() {
+	d.closeOnce.Do(func() { close(d.done) })
+	d.mx.Lock()
+	if !d.closed {
+		d.closed = true
+		for _, q := range d.queues {
+			close(q)
+		}
+	}
+	d.mx.Unlock()
+	d.wg.Wait()
+}
+
+// enqueue queues msg for the workers according to the overflow policy.
+func (d *Dispatcher) enqueue(conn *websocket.Conn, msg *websocket.Message) {
+	d.mx.RLock()
+	defer d.mx.RUnlock()
+	if d.closed {
+		return
+	}
+	q := d.queues[0]
+	if d.opts.Ordered {
+		q = d.queues[conn.ID()%uint64(len(d.queues))]
+	}
+
+	job := dispatchJob{conn: conn, msg: msg}
+	if d.opts.Overflow == DispatchBlock {
+		d.depth.Add(1)
+		select {
+		case q <- job:
+		case <-d.done:
+			d.depth.Add(-1)
+		}
+		return
+	}
+	d.depth.Add(1)
+	select {
+	case q <- job:
+	default:
+		d.depth.Add(-1)
+		d.dropped.Add(1)
+		if d.opts.Overflow == DispatchClose {
+			conn.CloseWithCode(websocket.CloseTryAgainLater, "dispatch queue is full")
+		}
+	}
+}
+
+// work handles the messages of q until it is closed.
+func (d *Dispatcher) work(q chan dispatchJob) {
+	defer d.wg.Done()
+	for job := range q {
+		d.depth.Add(-1)
+		d.handler(job.conn, job.msg)
+	}
+}
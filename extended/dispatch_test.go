@@ -0,0 +1,180 @@
+package extended_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+func TestDispatcher_Ordered(t *testing.T) {
+	const conns, messages = 3, 200
+
+	var mx sync.Mutex
+	received := make(map[*websocket.Conn][]int)
+	var handled sync.WaitGroup
+	handled.Add(conns * messages)
+	d := extended.NewDispatcher(func(conn *websocket.Conn, msg *websocket.Message) {
+		n, _ := strconv.Atoi(string(msg.Data))
+		mx.Lock()
+		received[conn] = append(received[conn], n)
+		mx.Unlock()
+		handled.Done()
+	}, extended.DispatchOptions{Workers: 4, QueueSize: 8, Ordered: true})
+	defer d.Close()
+
+	for range conns {
+		server, client := pipe()
+		defer server.Close()
+		defer client.Close()
+		d.Add(server)
+		go func() {
+			for i := range messages {
+				client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte(strconv.Itoa(i))})
+			}
+		}()
+	}
+
+	handled.Wait()
+	for conn, ns := range received {
+		for i, n := range ns {
+			if n != i {
+				t.Fatalf("expected the messages of connection %d in order, got %v", conn.ID(), ns)
+			}
+		}
+	}
+}
+
+func TestDispatcher_Unordered(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+	defer client.Close()
+
+	// every worker blocks until all of them have a message, so the
+	// messages must be handled concurrently
+	const workers = 4
+	var started sync.WaitGroup
+	started.Add(workers)
+	done := make(chan struct{}, workers)
+	extended.Dispatch(server, func(conn *websocket.Conn, msg *websocket.Message) {
+		started.Done()
+		started.Wait()
+		done <- struct{}{}
+	}, extended.DispatchOptions{Workers: workers})
+
+	for range workers {
+		client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("hello")})
+	}
+	for range workers {
+		select {
+		case <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("expected the messages to be handled concurrently")
+		}
+	}
+}
+
+// blockedDispatcher returns a dispatcher with a single worker blocked on
+// handling the first message, and a queue of one message that is full.
+func blockedDispatcher(t *testing.T, overflow extended.DispatchOverflow) (*extended.Dispatcher, *websocket.Conn, *websocket.Conn, chan struct{}) {
+	t.Helper()
+	server, client := pipe()
+	release := make(chan struct{})
+	d := extended.Dispatch(server, func(conn *websocket.Conn, msg *websocket.Message) {
+		<-release
+	}, extended.DispatchOptions{QueueSize: 1, Overflow: overflow})
+
+	for range 2 {
+		client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("hello")})
+	}
+	waitFor(t, time.Second, func() bool { return d.QueueDepth() == 1 })
+	return d, server, client, release
+}
+
+func TestDispatcher_Block(t *testing.T) {
+	d, server, client, release := blockedDispatcher(t, extended.DispatchBlock)
+	defer server.Close()
+	defer client.Close()
+
+	written := make(chan struct{})
+	go func() {
+		client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("three")})
+		client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("four")})
+		close(written)
+	}()
+	select {
+	case <-written:
+		t.Fatalf("expected reading to stop while the queue is full")
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	close(release)
+	select {
+	case <-written:
+	case <-time.After(time.Second):
+		t.Fatalf("expected reading to go on once the queue has room")
+	}
+	if d.Dropped() != 0 {
+		t.Fatalf("expected no messages to be dropped, got %d", d.Dropped())
+	}
+}
+
+func TestDispatcher_CloseWhileBlocked(t *testing.T) {
+	d, server, client, release := blockedDispatcher(t, extended.DispatchBlock)
+	defer server.Close()
+	defer client.Close()
+
+	go client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("three")})
+	waitFor(t, time.Second, func() bool { return d.QueueDepth() == 2 })
+
+	// the message waiting for room is discarded instead of keeping Close
+	// from closing the queues
+	closed := make(chan struct{})
+	go func() {
+		d.Close()
+		close(closed)
+	}()
+	waitFor(t, time.Second, func() bool { return d.QueueDepth() == 1 })
+	close(release)
+	select {
+	case <-closed:
+	case <-time.After(time.Second):
+		t.Fatalf("expected Close() to return once the queued messages are handled")
+	}
+	if d.QueueDepth() != 0 {
+		t.Fatalf("expected an empty queue once closed, got a depth of %d", d.QueueDepth())
+	}
+}
+
+func TestDispatcher_Drop(t *testing.T) {
+	d, server, client, release := blockedDispatcher(t, extended.DispatchDrop)
+	defer server.Close()
+	defer client.Close()
+	defer close(release)
+
+	for range 3 {
+		client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("dropped")})
+	}
+	waitFor(t, time.Second, func() bool { return d.Dropped() == 3 })
+	if d.QueueDepth() != 1 {
+		t.Fatalf("expected a queue depth of 1, got %d", d.QueueDepth())
+	}
+}
+
+func TestDispatcher_Close(t *testing.T) {
+	d, server, client, release := blockedDispatcher(t, extended.DispatchClose)
+	defer server.Close()
+	defer close(release)
+
+	go client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("overflow")})
+	_, err := client.Read()
+	if !websocket.IsCloseError(err, websocket.CloseTryAgainLater) {
+		t.Fatalf("expected a close error with code %d, got %v", websocket.CloseTryAgainLater, err)
+	}
+	if d.Dropped() != 1 {
+		t.Fatalf("expected 1 dropped message, got %d", d.Dropped())
+	}
+}
@@ -0,0 +1,120 @@
+package extended
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// drainWorkers is the amount of goroutines Drain writes close frames and
+// closes connections from.
+const drainWorkers = 64
+
+// DrainReport is how the connections drained by Drain were closed.
+type DrainReport struct {
+	// Clean is the amount of connections that were closed by a close frame
+	// from the peer, usually the echo of the close frame sent by Drain.
+	Clean int
+	// Cut is the amount of connections that were closed without one,
+	// because the peer did not respond in time, the close frame could not
+	// be written, or the connection was lost.
+	Cut int
+}
+
+// Drain closes conns gracefully, for example to restart a server without
+// dropping messages: it sends every peer a close frame with the code and
+// reason specified, usually CloseGoingAway or CloseServiceRestart, waits
+// for the peers to respond with their own close frame until ctx is done,
+// and then closes the connections that are still open. Connections that
+// are already closed are only counted in the report.
+//
+// The peers' close frames are only received while the connections are
+// being read from, such as by Listen or a Router, which can read the
+// messages the peers sent before closing as usual. The close frames are
+// written and the stragglers closed by a bounded amount of goroutines, so
+// draining many connections does not start a goroutine for each. If ctx
+// has a deadline, writing the close frames is given up on once it passes.
+//
+// Drain returns ctx.Err() if some connections had to be closed because ctx
+// was done first. If the code or reason cannot be sent, Drain returns the
+// error WriteClose returns for them without closing any connection.
+func Drain(ctx context.Context, conns []*websocket.Conn, code int, reason string) (DrainReport, error) {
+	deadline, hasDeadline := ctx.Deadline()
+	var invalid atomic.Pointer[error]
+	forEachConn(conns, func(conn *websocket.Conn) {
+		if conn.Closed() || invalid.Load() != nil {
+			return
+		}
+		if hasDeadline {
+			if nc := conn.NetConn(); nc != nil {
+				nc.SetWriteDeadline(deadline)
+			}
+		}
+		err := conn.WriteClose(code, reason)
+		switch {
+		case errors.Is(err, websocket.ErrInvalidCloseCode) || errors.Is(err, websocket.ErrControlPayloadTooLong):
+			invalid.Store(&err)
+		case err != nil:
+			conn.Close()
+		}
+	})
+	if err := invalid.Load(); err != nil {
+		return DrainReport{}, *err
+	}
+
+	var err error
+wait:
+	for _, conn := range conns {
+		select {
+		case <-conn.Done():
+		case <-ctx.Done():
+			err = ctx.Err()
+			break wait
+		}
+	}
+	if err != nil {
+		forEachConn(conns, func(conn *websocket.Conn) {
+			conn.Close()
+		})
+	}
+
+	var report DrainReport
+	for _, conn := range conns {
+		var ce *websocket.CloseError
+		if errors.As(conn.Err(), &ce) && ce.Code != websocket.CloseAbnormalClosure {
+			report.Clean++
+		} else {
+			report.Cut++
+		}
+	}
+	return report, err
+}
+
+// forEachConn calls f with every connection in conns, from up to
+// drainWorkers goroutines, and waits for the calls to return.
+func forEachConn(conns []*websocket.Conn, f func(conn *websocket.Conn)) {
+	var next atomic.Int64
+	var wg sync.WaitGroup
+	for range min(drainWorkers, len(conns)) {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := next.Add(1) - 1; i < int64(len(conns)); i = next.Add(1) - 1 {
+				f(conns[i])
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+// Drain drains every registered connection with Drain.
+func (h *Hub) Drain(ctx context.Context, code int, reason string) (DrainReport, error) {
+	var conns []*websocket.Conn
+	for _, s := range h.shards {
+		conns = append(conns, s.all()...)
+	}
+	return Drain(ctx, conns, code, reason)
+}
@@ -0,0 +1,113 @@
+package extended_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// cooperativeConn returns a connection, being read from, with a peer that
+// echoes close frames.
+func cooperativeConn(t *testing.T) *websocket.Conn {
+	conn, peer := pipe()
+	t.Cleanup(func() {
+		peer.Close()
+		conn.Close()
+	})
+	go readLoop(conn)
+	go readLoop(peer)
+	return conn
+}
+
+// unresponsiveConn returns a connection, being read from, with a peer that
+// never sends a close frame. If reading is set, the peer reads what is
+// written to it.
+func unresponsiveConn(t *testing.T, reading bool) *websocket.Conn {
+	a, b := net.Pipe()
+	conn := websocket.From(a)
+	t.Cleanup(func() {
+		b.Close()
+		conn.Close()
+	})
+	go readLoop(conn)
+	if reading {
+		go io.Copy(io.Discard, b)
+	}
+	return conn
+}
+
+func TestDrain(t *testing.T) {
+	var conns []*websocket.Conn
+	for range 5 {
+		conns = append(conns, cooperativeConn(t))
+	}
+	for range 3 {
+		conns = append(conns, unresponsiveConn(t, true))
+	}
+	for range 2 {
+		conns = append(conns, unresponsiveConn(t, false))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+	defer cancel()
+	report, err := extended.Drain(ctx, conns, websocket.CloseGoingAway, "restarting")
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected the stragglers to be cut at the deadline, got %v", err)
+	}
+	if report != (extended.DrainReport{Clean: 5, Cut: 5}) {
+		t.Fatalf("expected 5 clean closes and 5 cut, got %+v", report)
+	}
+	for _, conn := range conns {
+		if !conn.Closed() {
+			t.Fatalf("expected every connection to be closed")
+		}
+	}
+}
+
+func TestDrain_AllCooperative(t *testing.T) {
+	var conns []*websocket.Conn
+	for range 200 {
+		conns = append(conns, cooperativeConn(t))
+	}
+	conns[0].Close() // already closed, without a close frame from the peer
+
+	start := time.Now()
+	report, err := extended.Drain(context.Background(), conns, websocket.CloseServiceRestart, "")
+	if err != nil {
+		t.Fatalf("expected no error from Drain(), got %v", err)
+	}
+	if report != (extended.DrainReport{Clean: 199, Cut: 1}) {
+		t.Fatalf("expected 199 clean closes and 1 cut, got %+v", report)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Fatalf("expected Drain() to return once every peer responded, took %v", elapsed)
+	}
+}
+
+func TestDrain_InvalidCode(t *testing.T) {
+	conn := cooperativeConn(t)
+	if _, err := extended.Drain(context.Background(), []*websocket.Conn{conn}, websocket.CloseAbnormalClosure, ""); !errors.Is(err, websocket.ErrInvalidCloseCode) {
+		t.Fatalf("expected an INVALID_CLOSE_CODE error, got %v", err)
+	}
+	if conn.Closed() {
+		t.Fatalf("expected the connection to be left open")
+	}
+}
+
+func TestHub_Drain(t *testing.T) {
+	hub := extended.NewHub(extended.WithShards(4))
+	for range 10 {
+		hub.Register(cooperativeConn(t))
+	}
+	report, err := hub.Drain(context.Background(), websocket.CloseGoingAway, "")
+	if err != nil || report != (extended.DrainReport{Clean: 10}) {
+		t.Fatalf("expected 10 clean closes, got %+v and %v", report, err)
+	}
+	waitFor(t, time.Second, func() bool { return hub.Len() == 0 })
+}
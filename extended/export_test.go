@@ -0,0 +1,84 @@
+package extended
+
+import (
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// WithClock returns opts with clk used for all of its timing.
+func WithClock(opts AdaptiveKeepaliveOptions, clk clock.Clock) AdaptiveKeepaliveOptions {
+	opts.clock = clk
+	return opts
+}
+
+// NewLatencyTrackerWithClock is NewLatencyTracker with clk used for all of its timing.
+func NewLatencyTrackerWithClock(conn *websocket.Conn, interval time.Duration, clk clock.Clock) *LatencyTracker {
+	return newLatencyTracker(conn, interval, clk)
+}
+
+// PendingCalls returns the amount of calls waiting for a response.
+func (r *RPC) PendingCalls() int {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return len(r.pending)
+}
+
+// MuxWindowSize is the amount of bytes that may be sent on a mux stream
+// before it is read.
+const MuxWindowSize = muxWindowSize
+
+// DecodeMuxFrame parses a mux frame.
+func DecodeMuxFrame(data []byte) (typ byte, id uint32, payload []byte, err error) {
+	f, err := decodeMuxFrame(data)
+	return f.typ, f.id, f.payload, err
+}
+
+// EncodeMuxFrame encodes a mux frame.
+func EncodeMuxFrame(typ byte, id uint32, payload []byte) []byte {
+	return encodeMuxFrame(typ, id, payload)
+}
+
+// HeartbeatWithClock returns opts with clk used for all of its timing.
+func HeartbeatWithClock(opts HeartbeatOptions, clk clock.Clock) HeartbeatOptions {
+	opts.clock = clk
+	return opts
+}
+
+// Tick pings the connections in the next slot of the wheel.
+func (m *HeartbeatManager) Tick() {
+	m.tick()
+}
+
+// Awaiting reports whether conn is waiting for a pong.
+func (m *HeartbeatManager) Awaiting(conn *websocket.Conn) bool {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	hb, ok := m.conns[conn]
+	return ok && hb.awaiting.Load()
+}
+
+// RateLimitWithClock returns opts with clk used for all of its timing.
+func RateLimitWithClock(opts RateLimitOptions, clk clock.Clock) RateLimitOptions {
+	opts.clock = clk
+	return opts
+}
+
+// AckWithClock returns opts with clk used for all of its timing.
+func AckWithClock(opts AckOptions, clk clock.Clock) AckOptions {
+	opts.clock = clk
+	return opts
+}
+
+// SocketIOWithClock returns opts with clk used for all of its timing.
+func SocketIOWithClock(opts SocketIOOptions, clk clock.Clock) SocketIOOptions {
+	opts.clock = clk
+	return opts
+}
+
+// FileOutboxWithClock returns opts with clk used for all of its timing.
+func FileOutboxWithClock(opts FileOutboxOptions, clk clock.Clock) FileOutboxOptions {
+	opts.clock = clk
+	return opts
+}
@@ -0,0 +1,3 @@
+// Package extended provides helpers built on top of the websocket package
+// for common tasks that are not part of the WebSocket protocol itself.
+package extended
@@ -0,0 +1,344 @@
+package extended
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"strings"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// A file transfer between SendFile and ReceiveFile goes as follows:
+//
+//  1. The sender sends an offer text message, {"type":"offer","name":...,
+//     "size":...}, with the FileMeta of the file.
+//  2. The receiver responds with an accept text message, {"type":"accept",
+//     "offset":...}, with the offset to start sending from, which is not 0
+//     when resuming a transfer.
+//  3. The sender sends the file from the offset in chunk binary messages,
+//     each made of a 16 byte header, the sequence number of the chunk
+//     (starting at 0), the offset of the chunk in the file, and the CRC-32
+//     (IEEE) of the data, followed by the data. The numbers are big endian,
+//     4, 8, and 4 bytes long.
+//  4. The sender sends a done text message, {"type":"done","offset":...,
+//     "sha256":...}, with the offset the file ended at and the hex encoded
+//     SHA-256 of the data sent in the chunks.
+//  5. The receiver responds with an ack text message, {"type":"ack"},
+//     which has an "error" if the transfer failed on its side, and
+//     "integrity": true if the data did not match what was sent.
+const fileChunkHeaderLength = 16
+
+// ErrFileIntegrity is returned by ReceiveFile, and by SendFile once the
+// receiver reported it, if the data received does not match what was sent.
+var ErrFileIntegrity = errors.New("the file transfer failed its integrity check")
+
+// FileMeta describes a file sent by SendFile.
+type FileMeta struct {
+	Name string
+	// Size is the size of the file in bytes, or -1 if it is not known.
+	Size int64
+}
+
+// SendFileOptions configures SendFile.
+type SendFileOptions struct {
+	// ChunkSize is the maximum size of the data of a chunk. The default is
+	// 64 KiB.
+	ChunkSize int
+	// Progress is called after every chunk is written, with the offset in
+	// the file that has been sent and the size of the file.
+	Progress func(sent, size int64)
+}
+
+// ReceiveFileOptions configures ReceiveFile.
+type ReceiveFileOptions struct {
+	// Resume is called with the FileMeta offered by the sender, and returns
+	// the offset to resume the transfer from, which is usually the amount
+	// of bytes of the file that were written by an interrupted transfer.
+	// If Resume is nil, the whole file is transferred.
+	Resume func(meta FileMeta) int64
+	// Progress is called after every chunk is written to w, with the
+	// offset in the file that has been received and the size of the file.
+	Progress func(received, size int64)
+}
+
+// fileControl is a text message of a file transfer.
+type fileControl struct {
+	Type   string `json:"type"`
+	Name   string `json:"name,omitempty"`
+	Size   int64  `json:"size,omitempty"`
+	Offset int64  `json:"offset,omitempty"`
+	SHA256 string `json:"sha256,omitempty"`
+	Error  string `json:"error,omitempty"`
+	// Integrity is set in an ack if the error is an ErrFileIntegrity.
+	Integrity bool `json:"integrity,omitempty"`
+}
+
+// SendFile sends the file read from r, described by meta, to ReceiveFile
+// on the other side of conn, and returns once the receiver has verified
+// it. r is read from its current position, which is the start of the
+// file. If the receiver resumes the transfer, the part of r before the
+// offset it asks for is skipped, seeking if r is an io.Seeker.
+//
+// Each chunk is checked with a CRC-32 and the data sent with a SHA-256, so
+// the receiver detects corrupted or missing data, which SendFile reports as
+// ErrFileIntegrity. Nothing else may be read from or written to conn
+// during the transfer. If ctx is done before the transfer completes, conn
+// is closed and ctx.Err() is returned.
+func SendFile(ctx context.Context, conn *websocket.Conn, r io.Reader, meta FileMeta, opts SendFileOptions) error {
+	chunkSize := opts.ChunkSize
+	if chunkSize <= 0 {
+		chunkSize = 64 << 10
+	}
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	err := sendFile(ctx, conn, r, meta, chunkSize, opts.Progress)
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+func sendFile(ctx context.Context, conn *websocket.Conn, r io.Reader, meta FileMeta, chunkSize int, progress func(sent, size int64)) error {
+	if err := writeFileControl(conn, fileControl{Type: "offer", Name: meta.Name, Size: meta.Size}); err != nil {
+		return err
+	}
+	accept, err := readFileControl(conn, "accept")
+	if err != nil {
+		return err
+	}
+	offset := accept.Offset
+	if offset < 0 || (meta.Size >= 0 && offset > meta.Size) {
+		return fmt.Errorf("the receiver asked to resume from offset %d, out of the file", offset)
+	}
+	if s, ok := r.(io.Seeker); ok {
+		_, err = s.Seek(offset, io.SeekCurrent)
+	} else {
+		_, err = io.CopyN(io.Discard, r, offset)
+	}
+	if err != nil {
+		return fmt.Errorf("skipping to offset %d: %w", offset, err)
+	}
+
+	sum := sha256.New()
+	buf := make([]byte, fileChunkHeaderLength+chunkSize)
+	for seq := uint32(0); ; seq++ {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		n, err := io.ReadFull(r, buf[fileChunkHeaderLength:])
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return fmt.Errorf("reading the file: %w", err)
+		}
+		data := buf[fileChunkHeaderLength : fileChunkHeaderLength+n]
+		binary.BigEndian.PutUint32(buf[0:], seq)
+		binary.BigEndian.PutUint64(buf[4:], uint64(offset))
+		binary.BigEndian.PutUint32(buf[12:], crc32.ChecksumIEEE(data))
+		chunk := append([]byte(nil), buf[:fileChunkHeaderLength+n]...) // queued writes keep the data
+		if err := conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: chunk}); err != nil {
+			return err
+		}
+		sum.Write(data)
+		offset += int64(n)
+		if progress != nil {
+			progress(offset, meta.Size)
+		}
+		if err == io.ErrUnexpectedEOF {
+			break
+		}
+	}
+
+	if err := writeFileControl(conn, fileControl{Type: "done", Offset: offset, SHA256: hex.EncodeToString(sum.Sum(nil))}); err != nil {
+		return err
+	}
+	ack, err := readFileControl(conn, "ack")
+	if err != nil {
+		return err
+	}
+	switch {
+	case ack.Integrity:
+		return fmt.Errorf("%w: %s", ErrFileIntegrity, strings.TrimPrefix(ack.Error, ErrFileIntegrity.Error()+": "))
+	case ack.Error != "":
+		return fmt.Errorf("the receiver failed the transfer: %s", ack.Error)
+	}
+	return nil
+}
+
+// ReceiveFile receives a file sent by SendFile on the other side of conn,
+// writes it to w, and returns its FileMeta once it has been verified. If
+// opts.Resume asks for an offset, only the part of the file from the
+// offset is written to w.
+//
+// ReceiveFile returns ErrFileIntegrity if a chunk does not match its
+// CRC-32, chunks are missing or out of order, or the data received does not
+// match the SHA-256 of the data sent, and reports the error to the sender.
+// The data of a chunk is only written to w once the chunk is verified, so
+// after an error or interruption, the amount of bytes written to w is the
+// offset to resume from. After an error, the rest of the chunks are read
+// and discarded, so the connection stays usable. Nothing else may be read
+// from or written to conn during the transfer. If ctx is done before the
+// transfer completes, conn is closed and ctx.Err() is returned.
+func ReceiveFile(ctx context.Context, conn *websocket.Conn, w io.Writer, opts ReceiveFileOptions) (FileMeta, error) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	meta, err := receiveFile(conn, w, opts)
+	if ctx.Err() != nil {
+		return meta, ctx.Err()
+	}
+	return meta, err
+}
+
+func receiveFile(conn *websocket.Conn, w io.Writer, opts ReceiveFileOptions) (FileMeta, error) {
+	offer, err := readFileControl(conn, "offer")
+	if err != nil {
+		return FileMeta{}, err
+	}
+	meta := FileMeta{Name: offer.Name, Size: offer.Size}
+	var offset int64
+	if opts.Resume != nil {
+		offset = opts.Resume(meta)
+	}
+	if err := writeFileControl(conn, fileControl{Type: "accept", Offset: offset}); err != nil {
+		return meta, err
+	}
+
+	sum := sha256.New()
+	var failed error
+	for seq := uint32(0); ; seq++ {
+		msg, err := readDataMessage(conn)
+		if err != nil {
+			return meta, err
+		}
+		if msg.Type == websocket.MessageText {
+			if failed == nil {
+				done, err := decodeFileControl(msg.Data, "done")
+				if err == nil {
+					err = verifyFile(done, offset, sum)
+				}
+				failed = err
+			}
+			return meta, ackFile(conn, failed)
+		}
+		if failed != nil { // the rest is read so the connection stays usable
+			continue
+		}
+		data, err := verifyChunk(msg.Data, seq, offset)
+		if err != nil {
+			failed = err
+			continue
+		}
+		if _, err := w.Write(data); err != nil {
+			failed = fmt.Errorf("writing the file: %w", err)
+			continue
+		}
+		sum.Write(data)
+		offset += int64(len(data))
+		if opts.Progress != nil {
+			opts.Progress(offset, meta.Size)
+		}
+	}
+}
+
+// verifyChunk returns the data of a chunk if it is the chunk expected.
+func verifyChunk(chunk []byte, seq uint32, offset int64) ([]byte, error) {
+	if len(chunk) < fileChunkHeaderLength {
+		return nil, fmt.Errorf("%w: chunk %d is shorter than its header", ErrFileIntegrity, seq)
+	}
+	data := chunk[fileChunkHeaderLength:]
+	switch {
+	case binary.BigEndian.Uint32(chunk[0:]) != seq:
+		return nil, fmt.Errorf("%w: expected chunk %d, got chunk %d", ErrFileIntegrity, seq, binary.BigEndian.Uint32(chunk[0:]))
+	case int64(binary.BigEndian.Uint64(chunk[4:])) != offset:
+		return nil, fmt.Errorf("%w: chunk %d is not at offset %d", ErrFileIntegrity, seq, offset)
+	case binary.BigEndian.Uint32(chunk[12:]) != crc32.ChecksumIEEE(data):
+		return nil, fmt.Errorf("%w: chunk %d does not match its checksum", ErrFileIntegrity, seq)
+	}
+	return data, nil
+}
+
+// verifyFile checks the done message against what was received.
+func verifyFile(done fileControl, offset int64, sum hash.Hash) error {
+	switch {
+	case done.Offset != offset:
+		return fmt.Errorf("%w: the file ended at offset %d, but %d was received", ErrFileIntegrity, done.Offset, offset)
+	case done.SHA256 != hex.EncodeToString(sum.Sum(nil)):
+		return fmt.Errorf("%w: the data does not match its SHA-256", ErrFileIntegrity)
+	}
+	return nil
+}
+
+// ackFile reports the outcome of a transfer to the sender, and returns err.
+func ackFile(conn *websocket.Conn, err error) error {
+	ack := fileControl{Type: "ack"}
+	if err != nil {
+		ack.Error = err.Error()
+		ack.Integrity = errors.Is(err, ErrFileIntegrity)
+	}
+	if werr := writeFileControl(conn, ack); err == nil {
+		err = werr
+	}
+	return err
+}
+
+// writeFileControl writes a text message of a file transfer.
+func writeFileControl(conn *websocket.Conn, c fileControl) error {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return err
+	}
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageText, Data: data}); err != nil {
+		return err
+	}
+	return nil
+}
+
+// readFileControl reads a text message of a file transfer of the type
+// specified.
+func readFileControl(conn *websocket.Conn, typ string) (fileControl, error) {
+	msg, err := readDataMessage(conn)
+	if err != nil {
+		return fileControl{}, err
+	}
+	if msg.Type != websocket.MessageText {
+		return fileControl{}, fmt.Errorf("expected a %s message, got a binary message", typ)
+	}
+	return decodeFileControl(msg.Data, typ)
+}
+
+// decodeFileControl decodes a text message of a file transfer of the type
+// specified.
+func decodeFileControl(data []byte, typ string) (fileControl, error) {
+	var c fileControl
+	if err := json.Unmarshal(data, &c); err != nil {
+		return fileControl{}, fmt.Errorf("decoding the %s message: %w", typ, err)
+	}
+	if c.Type != typ {
+		return fileControl{}, fmt.Errorf("expected a %s message, got %q", typ, c.Type)
+	}
+	return c, nil
+}
+
+// readDataMessage reads the next text or binary message from conn.
+func readDataMessage(conn *websocket.Conn) (*websocket.Message, error) {
+	for {
+		msg, err := conn.Read()
+		if err != nil {
+			return nil, err
+		}
+		if msg.IsData() {
+			return msg, nil
+		}
+	}
+}
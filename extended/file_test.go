@@ -0,0 +1,148 @@
+package extended_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// transfer sends data from one side of a pipe to the other, and returns
+// the errors of SendFile and ReceiveFile.
+func transfer(r io.Reader, w io.Writer, sendOpts extended.SendFileOptions, receiveOpts extended.ReceiveFileOptions) (sendErr, receiveErr error) {
+	a, b := pipe()
+	defer a.Close()
+	defer b.Close()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- extended.SendFile(context.Background(), a, r, extended.FileMeta{Name: "data.bin", Size: 3 << 20}, sendOpts)
+	}()
+	meta, receiveErr := extended.ReceiveFile(context.Background(), b, w, receiveOpts)
+	if receiveErr == nil && meta.Name != "data.bin" {
+		receiveErr = errors.New("the file was received with the wrong name")
+	}
+	if receiveErr != nil {
+		a.Close()
+	}
+	return <-errs, receiveErr
+}
+
+func TestFile(t *testing.T) {
+	data := make([]byte, 3<<20)
+	rand.Read(data)
+	var got bytes.Buffer
+	var progress int64
+	sendErr, receiveErr := transfer(bytes.NewReader(data), &got, extended.SendFileOptions{ChunkSize: 100000}, extended.ReceiveFileOptions{
+		Progress: func(received, size int64) {
+			if received <= progress || size != int64(len(data)) {
+				t.Errorf("unexpected progress %d of %d after %d", received, size, progress)
+			}
+			progress = received
+		},
+	})
+	if sendErr != nil || receiveErr != nil {
+		t.Fatalf("transferring: %v, %v", sendErr, receiveErr)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("expected the file to be received unchanged")
+	}
+	if progress != int64(len(data)) {
+		t.Fatalf("expected the progress to reach %d, got %d", len(data), progress)
+	}
+}
+
+func TestFile_Resume(t *testing.T) {
+	data := make([]byte, 3<<20)
+	rand.Read(data)
+	var got bytes.Buffer
+
+	// the connection is interrupted halfway
+	a, b := pipe()
+	go extended.SendFile(context.Background(), a, bytes.NewReader(data), extended.FileMeta{Size: int64(len(data))}, extended.SendFileOptions{
+		Progress: func(sent, size int64) {
+			if sent >= size/2 {
+				a.Close()
+			}
+		},
+	})
+	if _, err := extended.ReceiveFile(context.Background(), b, &got, extended.ReceiveFileOptions{}); err == nil {
+		t.Fatalf("expected the interrupted transfer to fail")
+	}
+	b.Close()
+	if got.Len() == 0 || got.Len() == len(data) || !bytes.Equal(got.Bytes(), data[:got.Len()]) {
+		t.Fatalf("expected part of the file to be received, got %d bytes", got.Len())
+	}
+
+	// readers that cannot seek are skipped through
+	sendErr, receiveErr := transfer(struct{ io.Reader }{bytes.NewReader(data)}, &got, extended.SendFileOptions{}, extended.ReceiveFileOptions{
+		Resume: func(meta extended.FileMeta) int64 { return int64(got.Len()) },
+	})
+	if sendErr != nil || receiveErr != nil {
+		t.Fatalf("resuming: %v, %v", sendErr, receiveErr)
+	}
+	if !bytes.Equal(got.Bytes(), data) {
+		t.Fatalf("expected the resumed file to be received unchanged")
+	}
+}
+
+func TestFile_Integrity(t *testing.T) {
+	a, b := pipe()
+	defer a.Close()
+	defer b.Close()
+	acks := make(chan *websocket.Message, 1)
+	go func() {
+		// a sender whose chunk does not match its checksum
+		a.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte(`{"type":"offer","name":"x","size":5}`)})
+		a.Read()
+		chunk := binary.BigEndian.AppendUint32(make([]byte, 12), 1234)
+		a.Write(&websocket.Message{Type: websocket.MessageBinary, Data: append(chunk, "hello"...)})
+		a.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte(`{"type":"done","offset":5}`)})
+		ack, _ := a.Read()
+		acks <- ack
+	}()
+	var got bytes.Buffer
+	if _, err := extended.ReceiveFile(context.Background(), b, &got, extended.ReceiveFileOptions{}); !errors.Is(err, extended.ErrFileIntegrity) {
+		t.Fatalf("expected an integrity error, got %v", err)
+	}
+	if got.Len() != 0 {
+		t.Fatalf("expected the corrupted chunk not to be written")
+	}
+	if ack := <-acks; ack == nil || !bytes.Contains(ack.Data, []byte(`"integrity":true`)) {
+		t.Fatalf("expected the integrity error to be reported to the sender, got %v", ack)
+	}
+}
+
+// failingWriter is an io.Writer that always fails.
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) { return 0, errors.New("disk full") }
+
+func TestFile_WriteError(t *testing.T) {
+	sendErr, receiveErr := transfer(bytes.NewReader(make([]byte, 1<<20)), failingWriter{}, extended.SendFileOptions{}, extended.ReceiveFileOptions{})
+	if receiveErr == nil || errors.Is(receiveErr, extended.ErrFileIntegrity) {
+		t.Fatalf("expected the receiver to fail writing, got %v", receiveErr)
+	}
+	if sendErr == nil || errors.Is(sendErr, extended.ErrFileIntegrity) {
+		t.Fatalf("expected the sender to report the receiver's error, got %v", sendErr)
+	}
+}
+
+func TestFile_Context(t *testing.T) {
+	a, b := pipe()
+	defer b.Close()
+	go readLoop(b)
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := extended.SendFile(ctx, a, bytes.NewReader(nil), extended.FileMeta{}, extended.SendFileOptions{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+	if !a.Closed() {
+		t.Fatalf("expected the connection to be closed")
+	}
+}
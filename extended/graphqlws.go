@@ -0,0 +1,333 @@
+package extended
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// GraphQLWSProtocol is the subprotocol of the GraphQL over WebSocket
+// protocol served by ServeGraphQLWS.
+const GraphQLWSProtocol = "graphql-transport-ws"
+
+// The close codes of the GraphQL over WebSocket protocol.
+const (
+	GraphQLWSBadRequest             = 4400 // a message is not valid
+	GraphQLWSUnauthorized           = 4401 // subscribe before connection_ack
+	GraphQLWSForbidden              = 4403 // the init callback refused the connection
+	GraphQLWSSubprotocolNotAccepted = 4406
+	GraphQLWSInitTimeout            = 4408 // no connection_init in time
+	GraphQLWSSubscriberExists       = 4409 // subscribe with the ID of an operation in progress
+	GraphQLWSTooManyInitRequests    = 4429
+)
+
+// The types of the messages of the GraphQL over WebSocket protocol.
+const (
+	graphqlwsConnectionInit = "connection_init"
+	graphqlwsConnectionAck  = "connection_ack"
+	graphqlwsPing           = "ping"
+	graphqlwsPong           = "pong"
+	graphqlwsSubscribe      = "subscribe"
+	graphqlwsNext           = "next"
+	graphqlwsError          = "error"
+	graphqlwsComplete       = "complete"
+)
+
+// graphqlwsMessage is a message of the GraphQL over WebSocket protocol,
+// sent as a JSON text message.
+type graphqlwsMessage struct {
+	ID      string          `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// GraphQLRequest is the payload of a subscribe message: the GraphQL
+// operation to execute.
+type GraphQLRequest struct {
+	OperationName string          `json:"operationName,omitempty"`
+	Query         string          `json:"query"`
+	Variables     json.RawMessage `json:"variables,omitempty"`
+	Extensions    json.RawMessage `json:"extensions,omitempty"`
+}
+
+// GraphQLError is a GraphQL error, as sent in the payload of an error
+// message.
+type GraphQLError struct {
+	Message    string         `json:"message"`
+	Extensions map[string]any `json:"extensions,omitempty"`
+}
+
+// GraphQLErrors is the error a GraphQLResolver returns to send specific
+// GraphQL errors, instead of a single error with the message of the error
+// it returns.
+type GraphQLErrors []GraphQLError
+
+func (e GraphQLErrors) Error() string {
+	messages := make([]string, len(e))
+	for i, err := range e {
+		messages[i] = err.Message
+	}
+	return strings.Join(messages, "; ")
+}
+
+// GraphQLResolver executes a GraphQL operation, and returns the channel its
+// execution results are received from, such as {"data": {...}}, each sent
+// to the client as the payload of a next message. Queries and mutations
+// send a single result, and subscriptions any amount. Closing the channel
+// completes the operation.
+//
+// ctx is done once the client completes the operation or the connection
+// ends, after which the results are not received anymore, so the resolver
+// should stop sending them. If the operation cannot be executed, such as
+// when it is not valid, the resolver returns an error, which is sent to
+// the client in an error message.
+type GraphQLResolver func(ctx context.Context, req GraphQLRequest) (<-chan any, error)
+
+// GraphQLWSOptions configures ServeGraphQLWS. The zero value uses the
+// defaults described on each field, except for Resolve, which is required.
+type GraphQLWSOptions struct {
+	// InitTimeout is how long the client has to send connection_init
+	// after connecting. Defaults to 3 seconds.
+	InitTimeout time.Duration
+	// OnConnect, if set, is called with the payload of connection_init,
+	// such as the credentials of the client, and returns the payload of
+	// connection_ack, if any. If it returns an error, the connection is
+	// closed with 4403 (forbidden).
+	OnConnect func(ctx context.Context, conn *websocket.Conn, payload json.RawMessage) (ack any, err error)
+	// Resolve executes the operations the client subscribes to.
+	Resolve GraphQLResolver
+}
+
+// AcceptGraphQLWS accepts a WebSocket connection for the GraphQL over
+// WebSocket protocol, selecting GraphQLWSProtocol. If the client did not
+// offer it, the connection is accepted and closed with 4406, as the
+// protocol requires, and an error is returned.
+func AcceptGraphQLWS(w http.ResponseWriter, r *http.Request, opts ...websocket.Option) (*websocket.Conn, error) {
+	var offered bool
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			offered = offered || strings.TrimSpace(protocol) == GraphQLWSProtocol
+		}
+	}
+	if offered {
+		w.Header().Set("Sec-WebSocket-Protocol", GraphQLWSProtocol)
+	}
+	conn, err := websocket.AcceptHTTP(w, r, opts...)
+	if err != nil {
+		return nil, err
+	}
+	if !offered {
+		conn.CloseWithCode(GraphQLWSSubprotocolNotAccepted, "Subprotocol not acceptable")
+		return nil, fmt.Errorf("the client did not offer the %s subprotocol", GraphQLWSProtocol)
+	}
+	return conn, nil
+}
+
+// graphqlwsServer is the state of a connection served by ServeGraphQLWS.
+type graphqlwsServer struct {
+	conn *websocket.Conn
+	opts GraphQLWSOptions
+	ctx  context.Context
+
+	mx   sync.Mutex
+	init bool                          // whether connection_init was received
+	ack  bool                          // whether connection_ack was sent
+	ops  map[string]context.CancelFunc // the operations in progress by ID
+}
+
+// ServeGraphQLWS serves the server side of the GraphQL over WebSocket
+// protocol (graphql-transport-ws) on conn until it ends, and returns the
+// error reading ended with. Nothing else should read from conn.
+//
+// The client must send connection_init within InitTimeout, which is
+// acknowledged once OnConnect accepts it. Every subscribe message then
+// starts an operation executed by Resolve in its own goroutine, until its
+// results are all sent or the client completes it. Pings are answered
+// with pongs at any time. Once ctx is done or conn ends, every operation
+// in progress is cancelled.
+//
+// A client that breaks the protocol is disconnected with the close code
+// the protocol specifies: 4400 for a message that is not valid, 4401 for
+// subscribing before the connection is acknowledged, 4408 if
+// connection_init is late, 4409 for subscribing with the ID of an
+// operation in progress, and 4429 for a second connection_init.
+func ServeGraphQLWS(ctx context.Context, conn *websocket.Conn, opts GraphQLWSOptions) error {
+	if opts.InitTimeout <= 0 {
+		opts.InitTimeout = 3 * time.Second
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	stop := context.AfterFunc(ctx, func() {
+		conn.CloseWithCode(websocket.CloseGoingAway, "")
+	})
+	defer stop()
+	s := &graphqlwsServer{conn: conn, opts: opts, ctx: ctx, ops: make(map[string]context.CancelFunc)}
+
+	timeout := time.AfterFunc(opts.InitTimeout, func() {
+		s.mx.Lock()
+		defer s.mx.Unlock()
+		if !s.init {
+			conn.CloseWithCode(GraphQLWSInitTimeout, "Connection initialisation timeout")
+		}
+	})
+	defer timeout.Stop()
+
+	for {
+		msg, err := readDataMessage(conn)
+		if err != nil {
+			return err
+		}
+		if code, reason := s.receive(msg); code != 0 {
+			conn.CloseWithCode(code, reason)
+		}
+	}
+}
+
+// receive handles a message from the client, and returns the code and
+// reason to close the connection with if it breaks the protocol.
+func (s *graphqlwsServer) receive(msg *websocket.Message) (int, string) {
+	var m graphqlwsMessage
+	if msg.Type != websocket.MessageText || json.Unmarshal(msg.Data, &m) != nil {
+		return GraphQLWSBadRequest, "Invalid message received"
+	}
+	switch m.Type {
+	case graphqlwsConnectionInit:
+		return s.connectionInit(m.Payload)
+	case graphqlwsPing:
+		s.send(graphqlwsMessage{Type: graphqlwsPong})
+	case graphqlwsPong:
+	case graphqlwsSubscribe:
+		return s.subscribe(m)
+	case graphqlwsComplete:
+		if m.ID == "" {
+			return GraphQLWSBadRequest, "Invalid message received"
+		}
+		s.mx.Lock()
+		if cancel, ok := s.ops[m.ID]; ok {
+			cancel()
+			delete(s.ops, m.ID)
+		}
+		s.mx.Unlock()
+	default:
+		return GraphQLWSBadRequest, fmt.Sprintf("Unexpected message of type %q received", m.Type)
+	}
+	return 0, ""
+}
+
+// connectionInit handles connection_init.
+func (s *graphqlwsServer) connectionInit(payload json.RawMessage) (int, string) {
+	s.mx.Lock()
+	if s.init {
+		s.mx.Unlock()
+		return GraphQLWSTooManyInitRequests, "Too many initialisation requests"
+	}
+	s.init = true
+	s.mx.Unlock()
+
+	var ack any
+	if s.opts.OnConnect != nil {
+		var err error
+		if ack, err = s.opts.OnConnect(s.ctx, s.conn, payload); err != nil {
+			return GraphQLWSForbidden, "Forbidden"
+		}
+	}
+	reply := graphqlwsMessage{Type: graphqlwsConnectionAck}
+	if ack != nil {
+		data, err := json.Marshal(ack)
+		if err != nil {
+			return websocket.CloseInternalServerErr, ""
+		}
+		reply.Payload = data
+	}
+	s.mx.Lock()
+	s.ack = true
+	s.mx.Unlock()
+	s.send(reply)
+	return 0, ""
+}
+
+// subscribe starts the operation of a subscribe message.
+func (s *graphqlwsServer) subscribe(m graphqlwsMessage) (int, string) {
+	var req GraphQLRequest
+	if m.ID == "" || json.Unmarshal(m.Payload, &req) != nil || req.Query == "" {
+		return GraphQLWSBadRequest, "Invalid message received"
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if !s.ack {
+		return GraphQLWSUnauthorized, "Unauthorized"
+	}
+	if _, ok := s.ops[m.ID]; ok {
+		return GraphQLWSSubscriberExists, fmt.Sprintf("Subscriber for %s already exists", m.ID)
+	}
+	ctx, cancel := context.WithCancel(s.ctx)
+	s.ops[m.ID] = cancel
+	go s.execute(ctx, m.ID, req)
+	return 0, ""
+}
+
+// execute executes an operation and sends its results, then completes it
+// unless the client did.
+func (s *graphqlwsServer) execute(ctx context.Context, id string, req GraphQLRequest) {
+	results, err := s.opts.Resolve(ctx, req)
+	if err != nil {
+		var errs GraphQLErrors
+		if !errors.As(err, &errs) {
+			errs = GraphQLErrors{{Message: err.Error()}}
+		}
+		payload, err := json.Marshal(errs)
+		if err != nil {
+			payload = mustMarshal(GraphQLErrors{{Message: errs.Error()}})
+		}
+		if s.end(ctx, id) {
+			s.send(graphqlwsMessage{ID: id, Type: graphqlwsError, Payload: payload})
+		}
+		return
+	}
+	for {
+		select {
+		case result, ok := <-results:
+			if !ok {
+				if s.end(ctx, id) {
+					s.send(graphqlwsMessage{ID: id, Type: graphqlwsComplete})
+				}
+				return
+			}
+			data, err := json.Marshal(result)
+			if err != nil {
+				s.conn.Logger().Error("an error occured while encoding a GraphQL result", "error", err.Error())
+				continue
+			}
+			if ctx.Err() == nil {
+				s.send(graphqlwsMessage{ID: id, Type: graphqlwsNext, Payload: data})
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// end removes the operation id, and returns whether it was still in
+// progress, so that it is not completed twice.
+func (s *graphqlwsServer) end(ctx context.Context, id string) bool {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if ctx.Err() != nil {
+		return false
+	}
+	s.ops[id]()
+	delete(s.ops, id)
+	return true
+}
+
+// send writes m to the client.
+func (s *graphqlwsServer) send(m graphqlwsMessage) {
+	s.conn.WriteVia(websocket.JSONCodec{}, m)
+}
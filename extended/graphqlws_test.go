@@ -0,0 +1,286 @@
+package extended_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// graphqlwsStep is a step of a conversation with a GraphQL over WebSocket
+// server: a message the client sends, a message the server is expected to
+// send, or the close code the server is expected to close with.
+type graphqlwsStep struct {
+	send   string
+	expect string
+	closed int
+}
+
+// graphqlwsResolver resolves a few canned operations, and reports the
+// operations that are cancelled on cancelled.
+func graphqlwsResolver(cancelled chan<- string) extended.GraphQLResolver {
+	return func(ctx context.Context, req extended.GraphQLRequest) (<-chan any, error) {
+		results := make(chan any, 3)
+		switch req.Query {
+		case "{ hello }":
+			results <- map[string]any{"data": map[string]any{"hello": "world"}}
+			close(results)
+		case "subscription { count }":
+			for i := range 3 {
+				results <- map[string]any{"data": map[string]any{"count": i}}
+			}
+			close(results)
+		case "subscription { forever }":
+			go func() {
+				<-ctx.Done()
+				cancelled <- req.OperationName
+			}()
+		case "{ invalid }":
+			return nil, extended.GraphQLErrors{{Message: "Cannot query field \"invalid\""}}
+		default:
+			return nil, errors.New("unknown operation")
+		}
+		return results, nil
+	}
+}
+
+func graphqlwsOptions(cancelled chan<- string) extended.GraphQLWSOptions {
+	return extended.GraphQLWSOptions{
+		OnConnect: func(ctx context.Context, conn *websocket.Conn, payload json.RawMessage) (any, error) {
+			var creds struct {
+				Token string `json:"token"`
+			}
+			if json.Unmarshal(payload, &creds) != nil || creds.Token != "secret" {
+				return nil, errors.New("invalid token")
+			}
+			return map[string]string{"server": "test"}, nil
+		},
+		Resolve: graphqlwsResolver(cancelled),
+	}
+}
+
+const (
+	graphqlwsInit = `{"type": "connection_init", "payload": {"token": "secret"}}`
+	graphqlwsAck  = `{"type": "connection_ack", "payload": {"server": "test"}}`
+)
+
+// expectJSON fails the test unless got and expected are the same JSON.
+func expectJSON(t *testing.T, got []byte, expected string) {
+	t.Helper()
+	var g, e any
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("expected JSON, got %q", got)
+	}
+	if err := json.Unmarshal([]byte(expected), &e); err != nil {
+		t.Fatalf("the expected message %q is not JSON", expected)
+	}
+	if !reflect.DeepEqual(g, e) {
+		t.Fatalf("expected %s, got %s", expected, got)
+	}
+}
+
+// runGraphQLWS plays steps against a server served with opts.
+func runGraphQLWS(t *testing.T, opts extended.GraphQLWSOptions, steps []graphqlwsStep) {
+	t.Helper()
+	client, server := pipe()
+	defer client.Close()
+	defer server.Close()
+	go extended.ServeGraphQLWS(context.Background(), server, opts)
+
+	for _, step := range steps {
+		switch {
+		case step.send != "":
+			if err := client.Write(textMessage(step.send)); err != nil {
+				t.Fatalf("sending %s: %v", step.send, err)
+			}
+		case step.expect != "":
+			msg, err := readData(client)
+			if err != nil {
+				t.Fatalf("expected %s, got %v", step.expect, err)
+			}
+			expectJSON(t, msg.Data, step.expect)
+		default:
+			_, err := readData(client)
+			if !websocket.IsCloseError(err, step.closed) {
+				t.Fatalf("expected the connection to be closed with %d, got %v", step.closed, err)
+			}
+		}
+	}
+}
+
+// readData reads the next text or binary message from conn.
+func readData(conn *websocket.Conn) (*websocket.Message, error) {
+	for {
+		msg, err := conn.Read()
+		if err != nil || msg.IsData() {
+			return msg, err
+		}
+	}
+}
+
+func TestServeGraphQLWS(t *testing.T) {
+	tests := []struct {
+		name  string
+		steps []graphqlwsStep
+	}{
+		{"init", []graphqlwsStep{
+			{send: graphqlwsInit},
+			{expect: graphqlwsAck},
+		}},
+		{"ping before init", []graphqlwsStep{
+			{send: `{"type": "ping"}`},
+			{expect: `{"type": "pong"}`},
+			{send: `{"type": "pong"}`},
+			{send: graphqlwsInit},
+			{expect: graphqlwsAck},
+		}},
+		{"query", []graphqlwsStep{
+			{send: graphqlwsInit},
+			{expect: graphqlwsAck},
+			{send: `{"id": "1", "type": "subscribe", "payload": {"query": "{ hello }"}}`},
+			{expect: `{"id": "1", "type": "next", "payload": {"data": {"hello": "world"}}}`},
+			{expect: `{"id": "1", "type": "complete"}`},
+		}},
+		{"subscription", []graphqlwsStep{
+			{send: graphqlwsInit},
+			{expect: graphqlwsAck},
+			{send: `{"id": "a", "type": "subscribe", "payload": {"query": "subscription { count }"}}`},
+			{expect: `{"id": "a", "type": "next", "payload": {"data": {"count": 0}}}`},
+			{expect: `{"id": "a", "type": "next", "payload": {"data": {"count": 1}}}`},
+			{expect: `{"id": "a", "type": "next", "payload": {"data": {"count": 2}}}`},
+			{expect: `{"id": "a", "type": "complete"}`},
+			// the ID of a completed operation can be reused
+			{send: `{"id": "a", "type": "subscribe", "payload": {"query": "{ hello }"}}`},
+			{expect: `{"id": "a", "type": "next", "payload": {"data": {"hello": "world"}}}`},
+			{expect: `{"id": "a", "type": "complete"}`},
+		}},
+		{"operation error", []graphqlwsStep{
+			{send: graphqlwsInit},
+			{expect: graphqlwsAck},
+			{send: `{"id": "1", "type": "subscribe", "payload": {"query": "{ invalid }"}}`},
+			{expect: `{"id": "1", "type": "error", "payload": [{"message": "Cannot query field \"invalid\""}]}`},
+			{send: `{"id": "2", "type": "subscribe", "payload": {"query": "{ other }"}}`},
+			{expect: `{"id": "2", "type": "error", "payload": [{"message": "unknown operation"}]}`},
+		}},
+		{"forbidden", []graphqlwsStep{
+			{send: `{"type": "connection_init", "payload": {"token": "guess"}}`},
+			{closed: extended.GraphQLWSForbidden},
+		}},
+		{"subscribe before ack", []graphqlwsStep{
+			{send: `{"id": "1", "type": "subscribe", "payload": {"query": "{ hello }"}}`},
+			{closed: extended.GraphQLWSUnauthorized},
+		}},
+		{"duplicate subscriber", []graphqlwsStep{
+			{send: graphqlwsInit},
+			{expect: graphqlwsAck},
+			{send: `{"id": "1", "type": "subscribe", "payload": {"query": "subscription { forever }"}}`},
+			{send: `{"id": "1", "type": "subscribe", "payload": {"query": "subscription { forever }"}}`},
+			{closed: extended.GraphQLWSSubscriberExists},
+		}},
+		{"too many init requests", []graphqlwsStep{
+			{send: graphqlwsInit},
+			{expect: graphqlwsAck},
+			{send: graphqlwsInit},
+			{closed: extended.GraphQLWSTooManyInitRequests},
+		}},
+		{"invalid JSON", []graphqlwsStep{
+			{send: `{"type": `},
+			{closed: extended.GraphQLWSBadRequest},
+		}},
+		{"unknown type", []graphqlwsStep{
+			{send: `{"type": "start"}`},
+			{closed: extended.GraphQLWSBadRequest},
+		}},
+		{"next from the client", []graphqlwsStep{
+			{send: graphqlwsInit},
+			{expect: graphqlwsAck},
+			{send: `{"id": "1", "type": "next", "payload": {}}`},
+			{closed: extended.GraphQLWSBadRequest},
+		}},
+		{"subscribe without an ID", []graphqlwsStep{
+			{send: graphqlwsInit},
+			{expect: graphqlwsAck},
+			{send: `{"type": "subscribe", "payload": {"query": "{ hello }"}}`},
+			{closed: extended.GraphQLWSBadRequest},
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			runGraphQLWS(t, graphqlwsOptions(make(chan string, 4)), test.steps)
+		})
+	}
+}
+
+func TestServeGraphQLWS_Complete(t *testing.T) {
+	cancelled := make(chan string, 4)
+	runGraphQLWS(t, graphqlwsOptions(cancelled), []graphqlwsStep{
+		{send: graphqlwsInit},
+		{expect: graphqlwsAck},
+		{send: `{"id": "1", "type": "subscribe", "payload": {"operationName": "first", "query": "subscription { forever }"}}`},
+		{send: `{"id": "1", "type": "complete"}`},
+		// the ID is free again, and the server does not complete the
+		// operation the client completed
+		{send: `{"id": "1", "type": "subscribe", "payload": {"query": "{ hello }"}}`},
+		{expect: `{"id": "1", "type": "next", "payload": {"data": {"hello": "world"}}}`},
+		{expect: `{"id": "1", "type": "complete"}`},
+	})
+	select {
+	case name := <-cancelled:
+		if name != "first" {
+			t.Fatalf("expected the first operation to be cancelled, got %q", name)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the operation to be cancelled")
+	}
+}
+
+func TestServeGraphQLWS_InitTimeout(t *testing.T) {
+	opts := graphqlwsOptions(nil)
+	opts.InitTimeout = 20 * time.Millisecond
+	runGraphQLWS(t, opts, []graphqlwsStep{{closed: extended.GraphQLWSInitTimeout}})
+}
+
+func TestAcceptGraphQLWS(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := extended.AcceptGraphQLWS(w, r)
+		if err != nil {
+			return
+		}
+		extended.ServeGraphQLWS(r.Context(), conn, graphqlwsOptions(nil))
+	}))
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http")
+
+	conn, resp, err := websocket.DialWithOptions(context.Background(), url, websocket.DialOptions{
+		Subprotocols: []string{extended.GraphQLWSProtocol},
+	})
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	if protocol := resp.Header.Get("Sec-WebSocket-Protocol"); protocol != extended.GraphQLWSProtocol {
+		t.Fatalf("expected %s to be selected, got %q", extended.GraphQLWSProtocol, protocol)
+	}
+	conn.Write(textMessage(graphqlwsInit))
+	if msg, err := readData(conn); err != nil {
+		t.Fatalf("expected connection_ack, got %v", err)
+	} else {
+		expectJSON(t, msg.Data, graphqlwsAck)
+	}
+
+	other, err := websocket.Dial(context.Background(), url)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	if _, err := other.Read(); !websocket.IsCloseError(err, extended.GraphQLWSSubprotocolNotAccepted) {
+		t.Fatalf("expected a client without the subprotocol to be closed with 4406, got %v", err)
+	}
+}
@@ -0,0 +1,220 @@
+package extended
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// HeartbeatOptions configures a HeartbeatManager. The zero value uses the
+// defaults described on each field.
+type HeartbeatOptions struct {
+	// Interval is the time between the pings of a connection, which is
+	// also how long a ping has to receive a pong. Defaults to 30 seconds.
+	Interval time.Duration
+	// Resolution is how often the manager wakes up to ping the connections
+	// that are due, so pings are sent up to Resolution late, and Interval
+	// is rounded to a multiple of it. Defaults to a tenth of Interval.
+	Resolution time.Duration
+	// MaxMisses is the amount of pings in a row that may miss their pong
+	// before the connection is evicted. Defaults to 2.
+	MaxMisses int
+	// OnEvict, if set, is called with every connection that missed
+	// MaxMisses pongs, after it is unregistered. If it is nil, the
+	// connection is closed with 1001 (going away).
+	OnEvict func(conn *websocket.Conn)
+
+	clock clock.Clock
+}
+
+// HeartbeatManager pings many connections from a single goroutine and a
+// single timer, instead of a goroutine and a timer per connection as with
+// EnableKeepalive or AdaptiveKeepalive, and evicts the connections that
+// stop responding.
+//
+// The connections are spread over a timer wheel with a slot for every
+// Resolution of Interval, by the time they are registered. Every
+// Resolution, the manager pings the connections in the next slot. A
+// connection that has not received a pong since its previous ping has
+// missed it, and once it misses MaxMisses pongs in a row, it is evicted.
+// Pongs are only received while a connection is being read from.
+//
+// The pings are written from the manager's goroutine, so a connection that
+// blocks writes delays the pings of the others, unless its write queue is
+// enabled. The zero value is not usable; a HeartbeatManager is created by
+// NewHeartbeatManager. Every method is safe to call concurrently.
+type HeartbeatManager struct {
+	opts HeartbeatOptions
+	ping *websocket.PreparedMessage
+
+	mx     sync.Mutex
+	conns  map[*websocket.Conn]*heartbeat
+	slots  []map[*heartbeat]struct{}
+	cursor int // the slot pinged last
+	due    []*heartbeat
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// heartbeat is the state of a connection registered with a
+// HeartbeatManager.
+type heartbeat struct {
+	conn     *websocket.Conn
+	slot     int
+	awaiting atomic.Bool // whether a ping has not received a pong yet
+	misses   atomic.Int64
+	unwatch  func() bool
+}
+
+// NewHeartbeatManager returns a HeartbeatManager with no connections, and
+// starts its goroutine.
+func NewHeartbeatManager(opts HeartbeatOptions) *HeartbeatManager {
+	if opts.Interval <= 0 {
+		opts.Interval = 30 * time.Second
+	}
+	if opts.Resolution <= 0 || opts.Resolution > opts.Interval {
+		opts.Resolution = max(opts.Interval/10, time.Millisecond)
+	}
+	if opts.MaxMisses <= 0 {
+		opts.MaxMisses = 2
+	}
+	if opts.clock == nil {
+		opts.clock = clock.Real{}
+	}
+	ping, _ := websocket.NewPreparedMessage(&websocket.Message{Type: websocket.MessagePing})
+	m := &HeartbeatManager{
+		opts:  opts,
+		ping:  ping,
+		conns: make(map[*websocket.Conn]*heartbeat),
+		slots: make([]map[*heartbeat]struct{}, max(opts.Interval/opts.Resolution, 1)),
+		stop:  make(chan struct{}),
+	}
+	for i := range m.slots {
+		m.slots[i] = make(map[*heartbeat]struct{})
+	}
+	go m.run()
+	return m
+}
+
+// Register starts pinging conn, with the first ping an Interval from now.
+// It replaces the pong handler of conn, which is removed once conn is
+// unregistered. conn is unregistered once it is closed. Registering a
+// connection that is already registered has no effect.
+func (m *HeartbeatManager) Register(conn *websocket.Conn) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if _, ok := m.conns[conn]; ok {
+		return
+	}
+	// the slot pinged last is pinged again in a full turn of the wheel
+	hb := &heartbeat{conn: conn, slot: m.cursor}
+	conn.SetPongHandler(func(payload []byte) error {
+		hb.awaiting.Store(false)
+		hb.misses.Store(0)
+		return nil
+	})
+	hb.unwatch = context.AfterFunc(conn.Context(), func() {
+		m.Unregister(conn)
+	})
+	m.conns[conn] = hb
+	m.slots[hb.slot][hb] = struct{}{}
+}
+
+// Unregister stops pinging conn. It does not close the connection.
+func (m *HeartbeatManager) Unregister(conn *websocket.Conn) {
+	m.mx.Lock()
+	hb, ok := m.conns[conn]
+	if ok {
+		delete(m.conns, conn)
+		delete(m.slots[hb.slot], hb)
+	}
+	m.mx.Unlock()
+	if ok {
+		hb.unwatch()
+		conn.SetPongHandler(nil)
+	}
+}
+
+// Len returns the amount of registered connections.
+func (m *HeartbeatManager) Len() int {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return len(m.conns)
+}
+
+// Misses returns the amount of pings in a row conn has missed the pong
+// of, and whether it is registered.
+func (m *HeartbeatManager) Misses(conn *websocket.Conn) (int, bool) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	hb, ok := m.conns[conn]
+	if !ok {
+		return 0, false
+	}
+	return int(hb.misses.Load()), true
+}
+
+// Stop stops pinging the connections. It does not close or unregister
+// them.
+func (m *HeartbeatManager) Stop() {
+	m.stopOnce.Do(func() {
+		close(m.stop)
+	})
+}
+
+func (m *HeartbeatManager) run() {
+	for {
+		t := m.opts.clock.NewTimer(m.opts.Resolution)
+		select {
+		case <-t.C():
+		case <-m.stop:
+			t.Stop()
+			return
+		}
+		m.tick()
+	}
+}
+
+// tick pings the connections in the next slot of the wheel, evicting the
+// ones that missed too many pongs.
+func (m *HeartbeatManager) tick() {
+	m.mx.Lock()
+	m.cursor = (m.cursor + 1) % len(m.slots)
+	due := m.due[:0]
+	for hb := range m.slots[m.cursor] {
+		due = append(due, hb)
+	}
+	m.mx.Unlock()
+
+	for _, hb := range due {
+		if hb.awaiting.Load() && hb.misses.Add(1) >= int64(m.opts.MaxMisses) {
+			m.evict(hb.conn)
+			continue
+		}
+		hb.awaiting.Store(true)
+		err := hb.conn.WritePrepared(m.ping)
+		if errors.Is(err, websocket.ErrConnectionClosed) || errors.Is(err, websocket.ErrWrite) {
+			m.Unregister(hb.conn)
+			hb.conn.Close()
+		}
+	}
+	clear(due)
+	m.due = due // only this goroutine uses it
+}
+
+// evict unregisters conn after it missed too many pongs, and closes it
+// unless OnEvict is set.
+func (m *HeartbeatManager) evict(conn *websocket.Conn) {
+	m.Unregister(conn)
+	if m.opts.OnEvict != nil {
+		m.opts.OnEvict(conn)
+		return
+	}
+	conn.CloseWithCode(websocket.CloseGoingAway, "heartbeat timeout")
+}
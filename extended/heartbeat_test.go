@@ -0,0 +1,156 @@
+package extended_test
+
+import (
+	"runtime"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// tick advances clk by n ticks of the heartbeat manager, waiting for each
+// to be handled.
+func tick(t *testing.T, clk *clock.Fake, resolution time.Duration, n int) {
+	t.Helper()
+	for range n {
+		waitForTimer(t, clk, resolution)
+		clk.Advance(resolution)
+	}
+	waitForTimer(t, clk, resolution)
+}
+
+func TestHeartbeatManager_Eviction(t *testing.T) {
+	clk := clock.NewFake()
+	evicted := make(chan *websocket.Conn, 1)
+	m := extended.NewHeartbeatManager(extended.HeartbeatWithClock(extended.HeartbeatOptions{
+		Interval:   10 * time.Second,
+		Resolution: time.Second,
+		MaxMisses:  2,
+		OnEvict:    func(conn *websocket.Conn) { evicted <- conn },
+	}, clk))
+	defer m.Stop()
+
+	conn, cw := newCountingConn()
+	m.Register(conn)
+
+	tick(t, clk, time.Second, 9)
+	if cw.writes.Load() != 0 {
+		t.Fatalf("expected no ping before the interval, got %d", cw.writes.Load())
+	}
+	tick(t, clk, time.Second, 1)
+	if cw.writes.Load() != 1 {
+		t.Fatalf("expected a ping after the interval, got %d", cw.writes.Load())
+	}
+	tick(t, clk, time.Second, 10)
+	if misses, _ := m.Misses(conn); misses != 1 || cw.writes.Load() != 2 {
+		t.Fatalf("expected a miss and another ping, got %d misses and %d pings", misses, cw.writes.Load())
+	}
+
+	tick(t, clk, time.Second, 9)
+	select {
+	case <-evicted:
+		t.Fatalf("expected no eviction before the second miss")
+	default:
+	}
+	tick(t, clk, time.Second, 1)
+	select {
+	case got := <-evicted:
+		if got != conn {
+			t.Fatalf("expected the connection to be evicted, got %v", got)
+		}
+	default:
+		t.Fatalf("expected the connection to be evicted after the second miss")
+	}
+	if m.Len() != 0 || conn.Closed() {
+		t.Fatalf("expected the connection to be unregistered and left open for OnEvict")
+	}
+}
+
+func TestHeartbeatManager_Pongs(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+	go readLoop(conn)
+	go readLoop(peer)
+
+	clk := clock.NewFake()
+	m := extended.NewHeartbeatManager(extended.HeartbeatWithClock(extended.HeartbeatOptions{
+		Interval:   10 * time.Second,
+		Resolution: time.Second,
+		MaxMisses:  1,
+	}, clk))
+	defer m.Stop()
+	m.Register(conn)
+
+	for range 5 {
+		tick(t, clk, time.Second, 10)
+		waitFor(t, time.Second, func() bool { return !m.Awaiting(conn) })
+	}
+	if misses, ok := m.Misses(conn); !ok || misses != 0 || conn.Closed() {
+		t.Fatalf("expected the connection to stay registered without misses, got %d misses", misses)
+	}
+}
+
+func TestHeartbeatManager_DefaultEviction(t *testing.T) {
+	clk := clock.NewFake()
+	m := extended.NewHeartbeatManager(extended.HeartbeatWithClock(extended.HeartbeatOptions{
+		Interval:   time.Second,
+		Resolution: time.Second,
+		MaxMisses:  1,
+	}, clk))
+	defer m.Stop()
+	hub := extended.NewHub(extended.WithHeartbeat(m))
+
+	conn, _ := newCountingConn()
+	hub.Register(conn)
+	if m.Len() != 1 {
+		t.Fatalf("expected the hub to register the connection with the manager")
+	}
+	tick(t, clk, time.Second, 2)
+	if !conn.Closed() {
+		t.Fatalf("expected the connection to be closed after a miss")
+	}
+	waitFor(t, time.Second, func() bool { return hub.Len() == 0 && m.Len() == 0 })
+}
+
+func TestHeartbeatManager_Unregister(t *testing.T) {
+	m := extended.NewHeartbeatManager(extended.HeartbeatOptions{})
+	defer m.Stop()
+	hub := extended.NewHub(extended.WithHeartbeat(m))
+
+	a, _ := newCountingConn()
+	b, _ := newCountingConn()
+	hub.Register(a)
+	m.Register(b)
+	hub.Unregister(a)
+	b.Close()
+	waitFor(t, time.Second, func() bool { return m.Len() == 0 })
+}
+
+func BenchmarkHeartbeatManager(b *testing.B) {
+	clk := clock.NewFake()
+	m := extended.NewHeartbeatManager(extended.HeartbeatWithClock(extended.HeartbeatOptions{
+		Interval:   10 * time.Second,
+		Resolution: time.Second,
+		MaxMisses:  b.N + 1, // the connections never respond
+	}, clk))
+	defer m.Stop()
+
+	goroutines := runtime.NumGoroutine()
+	for range 50000 {
+		conn, _ := newCountingConn()
+		m.Register(conn)
+	}
+	goroutines = runtime.NumGoroutine() - goroutines
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		m.Tick()
+	}
+	// both stay at 0 and 1 however many connections are registered
+	b.ReportMetric(float64(goroutines), "goroutines")
+	b.ReportMetric(float64(clk.Pending()), "timers")
+}
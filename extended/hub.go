@@ -0,0 +1,366 @@
+package extended
+
+import (
+	"context"
+	"errors"
+	"slices"
+	"sync"
+	"sync/atomic"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// Hub keeps track of connections and the named rooms they are in, and
+// broadcasts messages to them. Connections are unregistered from the hub
+// once they are closed. The zero value is not usable; a Hub is created by
+// NewHub. Every method is safe to call concurrently.
+//
+// By default, a Hub keeps everything behind a single lock. For very large
+// amounts of connections, WithShards splits the connections into shards by
+// their ID, each with its own lock and its own part of every room, so
+// registering, joining, and leaving only lock the shard of the connection,
+// and broadcasts lock one shard at a time.
+//
+// Connections that join a room with JoinAs are part of the presence of the
+// room, the list of users in it, which is kept up to date as they join,
+// leave, and are closed. See Presence and WithPresenceEvents.
+type Hub struct {
+	shards    []*hubShard
+	workers   int
+	heartbeat *HeartbeatManager
+
+	registry    *Registry
+	registryKey func(conn *websocket.Conn) (string, bool)
+
+	presence          hubPresence
+	onPresence        func(e PresenceEvent)
+	broadcastPresence bool
+}
+
+// hubShard holds the connections of a Hub with IDs that map to it, and
+// their part of every room.
+type hubShard struct {
+	mx    sync.RWMutex
+	conns map[*websocket.Conn]map[string]struct{} // the rooms of every connection
+	rooms map[string]map[*websocket.Conn]struct{}
+	// the functions that stop unregistering every connection once it is
+	// closed
+	stops map[*websocket.Conn]func() bool
+}
+
+// HubOption configures a Hub created by NewHub.
+type HubOption func(h *Hub)
+
+// WithShards splits the connections of the hub into n shards. n less than
+// 1 is treated as 1, which is the default.
+func WithShards(n int) HubOption {
+	return func(h *Hub) {
+		h.shards = make([]*hubShard, max(n, 1))
+	}
+}
+
+// WithBroadcastWorkers makes broadcasts write to up to n shards at the
+// same time, each from its own goroutine. By default, the shards are
+// written to one after the other from the goroutine broadcasting. It has
+// no effect without WithShards.
+func WithBroadcastWorkers(n int) HubOption {
+	return func(h *Hub) {
+		h.workers = max(n, 1)
+	}
+}
+
+// WithHeartbeat registers every connection registered with the hub with
+// m, and unregisters it from m once it is unregistered from the hub, so
+// the connections of the hub are pinged and the ones that stop responding
+// are evicted.
+func WithHeartbeat(m *HeartbeatManager) HubOption {
+	return func(h *Hub) {
+		h.heartbeat = m
+	}
+}
+
+// WithRegistry adds every connection registered with the hub to r, under
+// the key key returns for it, such as the ID of its user, and removes it
+// from r once it is unregistered from the hub. The connections key returns
+// false for are not added. key is called with the hub's lock of the
+// connection held, so it should only look at the connection, such as with
+// websocket.Conn.Get.
+func WithRegistry(r *Registry, key func(conn *websocket.Conn) (string, bool)) HubOption {
+	return func(h *Hub) {
+		h.registry = r
+		h.registryKey = key
+	}
+}
+
+// NewHub returns an empty Hub configured with the options specified, if
+// any.
+func NewHub(opts ...HubOption) *Hub {
+	h := &Hub{shards: make([]*hubShard, 1), workers: 1}
+	for _, opt := range opts {
+		opt(h)
+	}
+	for i := range h.shards {
+		h.shards[i] = &hubShard{
+			conns: make(map[*websocket.Conn]map[string]struct{}),
+			rooms: make(map[string]map[*websocket.Conn]struct{}),
+			stops: make(map[*websocket.Conn]func() bool),
+		}
+	}
+	return h
+}
+
+// shard returns the shard of conn.
+func (h *Hub) shard(conn *websocket.Conn) *hubShard {
+	return h.shards[conn.ID()%uint64(len(h.shards))]
+}
+
+// Register adds conn to the hub, without joining any room, so it receives
+// BroadcastAll. It is unregistered once it is closed. Registering a
+// connection that is already registered has no effect.
+func (h *Hub) Register(conn *websocket.Conn) {
+	s := h.shard(conn)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	h.register(s, conn)
+}
+
+// register adds conn to its shard s if it is not registered. The mutex of
+// s must be held.
+func (h *Hub) register(s *hubShard, conn *websocket.Conn) {
+	if _, ok := s.conns[conn]; ok {
+		return
+	}
+	s.conns[conn] = make(map[string]struct{})
+	if h.heartbeat != nil {
+		h.heartbeat.Register(conn)
+	}
+	if h.registry != nil {
+		if key, ok := h.registryKey(conn); ok {
+			h.registry.Add(key, conn)
+		}
+	}
+	s.stops[conn] = context.AfterFunc(conn.Context(), func() { h.Unregister(conn) })
+}
+
+// Unregister removes conn from the hub and from every room it is in. It
+// does not close the connection.
+func (h *Hub) Unregister(conn *websocket.Conn) {
+	s := h.shard(conn)
+	s.mx.Lock()
+	rooms, ok := s.conns[conn]
+	for room := range rooms {
+		s.leave(conn, room)
+	}
+	delete(s.conns, conn)
+	if stop, ok := s.stops[conn]; ok {
+		stop()
+		delete(s.stops, conn)
+	}
+	if ok && h.heartbeat != nil {
+		h.heartbeat.Unregister(conn)
+	}
+	if ok && h.registry != nil {
+		if key, ok := h.registryKey(conn); ok {
+			h.registry.Remove(key, conn)
+		}
+	}
+	s.mx.Unlock()
+	if ok {
+		h.unregisterPresence(conn)
+	}
+}
+
+// Join adds conn to room, registering it first if it is not registered.
+func (h *Hub) Join(conn *websocket.Conn, room string) {
+	s := h.shard(conn)
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	h.join(s, conn, room)
+}
+
+// join adds conn to room in its shard s. The mutex of s must be held.
+func (h *Hub) join(s *hubShard, conn *websocket.Conn, room string) {
+	h.register(s, conn)
+	s.conns[conn][room] = struct{}{}
+	members, ok := s.rooms[room]
+	if !ok {
+		members = make(map[*websocket.Conn]struct{})
+		s.rooms[room] = members
+	}
+	members[conn] = struct{}{}
+}
+
+// Leave removes conn from room. It stays registered.
+func (h *Hub) Leave(conn *websocket.Conn, room string) {
+	s := h.shard(conn)
+	s.mx.Lock()
+	if rooms, ok := s.conns[conn]; ok {
+		delete(rooms, room)
+	}
+	s.leave(conn, room)
+	s.mx.Unlock()
+	h.leavePresence(conn, room)
+}
+
+// leave removes conn from the members of room, and removes the room once
+// it is empty. The mutex must be held.
+func (s *hubShard) leave(conn *websocket.Conn, room string) {
+	members := s.rooms[room]
+	delete(members, conn)
+	if len(members) == 0 {
+		delete(s.rooms, room)
+	}
+}
+
+// Rooms returns the rooms conn is in.
+func (h *Hub) Rooms(conn *websocket.Conn) []string {
+	s := h.shard(conn)
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return keys(s.conns[conn])
+}
+
+// Members returns the connections in room.
+func (h *Hub) Members(room string) []*websocket.Conn {
+	var members []*websocket.Conn
+	for _, s := range h.shards {
+		members = append(members, s.members(room)...)
+	}
+	return members
+}
+
+// members returns the connections of the shard in room.
+func (s *hubShard) members(room string) []*websocket.Conn {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return keys(s.rooms[room])
+}
+
+// all returns the connections of the shard.
+func (s *hubShard) all() []*websocket.Conn {
+	s.mx.RLock()
+	defer s.mx.RUnlock()
+	return keys(s.conns)
+}
+
+// Len returns the amount of registered connections.
+func (h *Hub) Len() int {
+	n := 0
+	for _, s := range h.shards {
+		s.mx.RLock()
+		n += len(s.conns)
+		s.mx.RUnlock()
+	}
+	return n
+}
+
+// Broadcast writes msg to every connection in room and returns the amount
+// of connections it was written to. See BroadcastAll.
+func (h *Hub) Broadcast(room string, msg *websocket.Message) int {
+	return h.broadcast(msg, func(s *hubShard) []*websocket.Conn {
+		return s.members(room)
+	})
+}
+
+// BroadcastAll writes msg to every registered connection and returns the
+// amount of connections it was written to.
+//
+// The frames of msg are only encoded once and reused for every connection
+// they can be reused for (see websocket.PreparedMessage). If msg cannot be
+// written to any connection, such as a control message with a payload
+// over 125 bytes, BroadcastAll returns 0.
+//
+// The connections of a shard are written to one at a time, outside of the
+// hub's locks, so connections may join and leave while a broadcast is in
+// progress, and a connection that joins during a broadcast may not
+// receive it. A slow connection delays the connections written to after
+// it, unless its write queue is enabled. A connection that cannot be
+// written to because it is closed or broken is closed and unregistered,
+// and the broadcast goes on with the others.
+func (h *Hub) BroadcastAll(msg *websocket.Message) int {
+	return h.broadcast(msg, (*hubShard).all)
+}
+
+// BroadcastFunc writes msg to every registered connection filter returns
+// true for, and returns the amount of connections it was written to, like
+// BroadcastAll. filter is called outside of the hub's locks, so it may be
+// slow without blocking the hub, and with WithBroadcastWorkers, it may be
+// called from several goroutines at once.
+func (h *Hub) BroadcastFunc(filter func(conn *websocket.Conn) bool, msg *websocket.Message) int {
+	return h.broadcast(msg, func(s *hubShard) []*websocket.Conn {
+		return slices.DeleteFunc(s.all(), func(conn *websocket.Conn) bool {
+			return !filter(conn)
+		})
+	})
+}
+
+// BroadcastWhere is BroadcastFunc with filter called with the value stored
+// under key on every connection (see websocket.Conn.Set), instead of with
+// the connection. The connections without a value under key are skipped.
+func (h *Hub) BroadcastWhere(key string, filter func(v any) bool, msg *websocket.Message) int {
+	return h.BroadcastFunc(func(conn *websocket.Conn) bool {
+		v, ok := conn.Get(key)
+		return ok && filter(v)
+	}, msg)
+}
+
+// broadcast writes msg to the connections conns returns for every shard.
+func (h *Hub) broadcast(msg *websocket.Message, conns func(s *hubShard) []*websocket.Conn) int {
+	pm, err := websocket.NewPreparedMessage(msg)
+	if err != nil {
+		return 0
+	}
+	workers := min(h.workers, len(h.shards))
+	if workers <= 1 {
+		written := 0
+		for _, s := range h.shards {
+			written += h.writeAll(conns(s), pm)
+		}
+		return written
+	}
+
+	var written atomic.Int64
+	shards := make(chan *hubShard)
+	var wg sync.WaitGroup
+	for range workers {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for s := range shards {
+				written.Add(int64(h.writeAll(conns(s), pm)))
+			}
+		}()
+	}
+	for _, s := range h.shards {
+		shards <- s
+	}
+	close(shards)
+	wg.Wait()
+	return int(written.Load())
+}
+
+// writeAll writes pm to conns and returns the amount of connections it was
+// written to, evicting the connections that are closed or broken.
+func (h *Hub) writeAll(conns []*websocket.Conn, pm *websocket.PreparedMessage) int {
+	written := 0
+	for _, conn := range conns {
+		err := conn.WritePrepared(pm)
+		switch {
+		case err == nil:
+			written++
+		case errors.Is(err, websocket.ErrConnectionClosed) || errors.Is(err, websocket.ErrWrite):
+			conn.Close()
+			h.Unregister(conn)
+		}
+	}
+	return written
+}
+
+// keys returns the keys of m.
+func keys[K comparable, V any](m map[K]V) []K {
+	s := make([]K, 0, len(m))
+	for k := range m {
+		s = append(s, k)
+	}
+	return s
+}
@@ -0,0 +1,375 @@
+package extended_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"runtime"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// countingConn is an io.ReadWriteCloser that counts the writes to it.
+// Writing fails once it is closed or if broken is set.
+type countingConn struct {
+	writes atomic.Int64
+	closed atomic.Bool
+	broken bool
+}
+
+func (c *countingConn) Read(p []byte) (int, error) { return 0, io.EOF }
+
+func (c *countingConn) Write(p []byte) (int, error) {
+	if c.broken || c.closed.Load() {
+		return 0, errors.New("broken")
+	}
+	c.writes.Add(1)
+	return len(p), nil
+}
+
+func (c *countingConn) Close() error {
+	c.closed.Store(true)
+	return nil
+}
+
+func newCountingConn() (*websocket.Conn, *countingConn) {
+	c := new(countingConn)
+	return websocket.From(c), c
+}
+
+// hubConfigs are the configurations the Hub tests run with.
+var hubConfigs = []struct {
+	name string
+	opts []extended.HubOption
+}{
+	{"single", nil},
+	{"sharded", []extended.HubOption{extended.WithShards(8)}},
+	{"parallel", []extended.HubOption{extended.WithShards(8), extended.WithBroadcastWorkers(4)}},
+}
+
+// forEachHub runs test with every configuration in hubConfigs.
+func forEachHub(t *testing.T, test func(t *testing.T, opts ...extended.HubOption)) {
+	for _, config := range hubConfigs {
+		t.Run(config.name, func(t *testing.T) {
+			test(t, config.opts...)
+		})
+	}
+}
+
+func TestHub(t *testing.T)                         { forEachHub(t, testHub) }
+func TestHub_UnregisterOnClose(t *testing.T)       { forEachHub(t, testHub_UnregisterOnClose) }
+func TestHub_EvictsBrokenConnections(t *testing.T) { forEachHub(t, testHub_EvictsBrokenConnections) }
+func TestHub_Churn(t *testing.T)                   { forEachHub(t, testHub_Churn) }
+func TestHub_Reregister(t *testing.T)              { forEachHub(t, testHub_Reregister) }
+func TestHub_MixedSettings(t *testing.T)           { forEachHub(t, testHub_MixedSettings) }
+func TestHub_BroadcastFunc(t *testing.T)           { forEachHub(t, testHub_BroadcastFunc) }
+
+var hubMessage = &websocket.Message{Type: websocket.MessageText, Data: []byte("hello")}
+
+func testHub(t *testing.T, opts ...extended.HubOption) {
+	hub := extended.NewHub(opts...)
+	a, aw := newCountingConn()
+	b, bw := newCountingConn()
+	c, cw := newCountingConn()
+
+	hub.Join(a, "lobby")
+	hub.Join(a, "games")
+	hub.Join(b, "lobby")
+	hub.Register(c)
+	if hub.Len() != 3 {
+		t.Fatalf("expected 3 connections, got %d", hub.Len())
+	}
+	rooms := hub.Rooms(a)
+	slices.Sort(rooms)
+	if !slices.Equal(rooms, []string{"games", "lobby"}) {
+		t.Fatalf("expected [games lobby], got %v", rooms)
+	}
+
+	if n := hub.Broadcast("lobby", hubMessage); n != 2 {
+		t.Fatalf("expected the broadcast to reach 2 connections, got %d", n)
+	}
+	if n := hub.Broadcast("games", hubMessage); n != 1 {
+		t.Fatalf("expected the broadcast to reach 1 connection, got %d", n)
+	}
+	if n := hub.BroadcastAll(hubMessage); n != 3 {
+		t.Fatalf("expected the broadcast to reach 3 connections, got %d", n)
+	}
+	if aw.writes.Load() != 3 || bw.writes.Load() != 2 || cw.writes.Load() != 1 {
+		t.Fatalf("expected 3, 2, and 1 writes, got %d, %d, and %d", aw.writes.Load(), bw.writes.Load(), cw.writes.Load())
+	}
+
+	hub.Leave(a, "lobby")
+	if members := hub.Members("lobby"); len(members) != 1 || members[0] != b {
+		t.Fatalf("expected only b to be in the lobby, got %v", members)
+	}
+	hub.Unregister(b)
+	if members := hub.Members("lobby"); len(members) != 0 {
+		t.Fatalf("expected the lobby to be empty, got %v", members)
+	}
+	if hub.Len() != 2 {
+		t.Fatalf("expected 2 connections, got %d", hub.Len())
+	}
+}
+
+func testHub_UnregisterOnClose(t *testing.T, opts ...extended.HubOption) {
+	hub := extended.NewHub(opts...)
+	conn, _ := newCountingConn()
+	hub.Join(conn, "lobby")
+
+	conn.Close()
+	waitFor(t, time.Second, func() bool { return hub.Len() == 0 })
+	if members := hub.Members("lobby"); len(members) != 0 {
+		t.Fatalf("expected the lobby to be empty, got %v", members)
+	}
+}
+
+func testHub_EvictsBrokenConnections(t *testing.T, opts ...extended.HubOption) {
+	hub := extended.NewHub(opts...)
+	a, _ := newCountingConn()
+	b, bw := newCountingConn()
+	c, _ := newCountingConn()
+	bw.broken = true
+	for _, conn := range []*websocket.Conn{a, b, c} {
+		hub.Join(conn, "lobby")
+	}
+
+	if n := hub.Broadcast("lobby", hubMessage); n != 2 {
+		t.Fatalf("expected the broadcast to reach 2 connections, got %d", n)
+	}
+	if !b.Closed() {
+		t.Fatalf("expected the broken connection to be closed")
+	}
+	if hub.Len() != 2 || len(hub.Members("lobby")) != 2 {
+		t.Fatalf("expected the broken connection to be unregistered")
+	}
+}
+
+func testHub_Churn(t *testing.T, opts ...extended.HubOption) {
+	hub := extended.NewHub(opts...)
+	rooms := []string{"a", "b", "c", "d"}
+
+	var wg sync.WaitGroup
+	for i := range 200 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn, _ := newCountingConn()
+			for j := range 20 {
+				room := rooms[(i+j)%len(rooms)]
+				switch j % 4 {
+				case 0:
+					hub.Join(conn, room)
+				case 1:
+					hub.Broadcast(room, hubMessage)
+				case 2:
+					hub.Leave(conn, room)
+				case 3:
+					hub.BroadcastAll(hubMessage)
+				}
+			}
+			if i%2 == 0 {
+				conn.Close()
+			} else {
+				hub.Unregister(conn)
+			}
+		}()
+	}
+	wg.Wait()
+
+	waitFor(t, time.Second, func() bool { return hub.Len() == 0 })
+	for _, room := range rooms {
+		if members := hub.Members(room); len(members) != 0 {
+			t.Fatalf("expected room %s to be empty, got %v", room, members)
+		}
+	}
+}
+
+func testHub_Reregister(t *testing.T, opts ...extended.HubOption) {
+	hub := extended.NewHub(opts...)
+	conn, _ := newCountingConn()
+
+	// registering a connection again does not leave anything waiting for
+	// it to be closed
+	goroutines := runtime.NumGoroutine()
+	for range 100 {
+		hub.Register(conn)
+		hub.Register(conn)
+		hub.Unregister(conn)
+	}
+	if n := runtime.NumGoroutine(); n > goroutines {
+		t.Fatalf("expected no goroutines to be left by registering again, got %d more", n-goroutines)
+	}
+
+	hub.Register(conn)
+	conn.Close()
+	waitFor(t, time.Second, func() bool { return hub.Len() == 0 })
+}
+
+func testHub_MixedSettings(t *testing.T, opts ...extended.HubOption) {
+	hub := extended.NewHub(opts...)
+	msg := &websocket.Message{Type: websocket.MessageText, Data: []byte(strings.Repeat("hello ", 50))}
+
+	// the peers have the other role, since a server rejects unmasked frames
+	settings := []struct {
+		opts     []websocket.Option
+		peerRole websocket.Role
+	}{
+		{nil, websocket.RoleClient},
+		{[]websocket.Option{websocket.WithWriteFragmentSize(64)}, websocket.RoleClient},
+		{[]websocket.Option{websocket.WithRole(websocket.RoleClient)}, websocket.RoleServer},
+		{nil, websocket.RoleClient},
+	}
+	received := make(chan *websocket.Message, len(settings))
+	for _, setting := range settings {
+		a, b := net.Pipe()
+		conn := websocket.From(a, setting.opts...)
+		peer := websocket.From(b, websocket.WithRole(setting.peerRole))
+		defer peer.Close()
+		defer conn.Close()
+		hub.Join(conn, "lobby")
+		go func() {
+			msg, err := peer.Read()
+			if err != nil {
+				t.Errorf("expected no error from Read(), got %v", err)
+			}
+			received <- msg
+		}()
+	}
+
+	if n := hub.Broadcast("lobby", msg); n != len(settings) {
+		t.Fatalf("expected the broadcast to reach %d connections, got %d", len(settings), n)
+	}
+	for range settings {
+		got := <-received
+		if got == nil || got.Type != msg.Type || !bytes.Equal(got.Data, msg.Data) {
+			t.Fatalf("expected %v, got %v", msg, got)
+		}
+	}
+}
+
+// broadcastConns returns 100,000 connections and a message to broadcast
+// to them.
+func broadcastConns() ([]*websocket.Conn, *websocket.Message) {
+	conns := make([]*websocket.Conn, 100000)
+	for i := range conns {
+		conns[i], _ = newCountingConn()
+	}
+	return conns, &websocket.Message{Type: websocket.MessageText, Data: bytes.Repeat([]byte("x"), 1024)}
+}
+
+func benchmarkHubBroadcast(b *testing.B, opts ...extended.HubOption) {
+	conns, msg := broadcastConns()
+	hub := extended.NewHub(opts...)
+	for _, conn := range conns {
+		hub.Register(conn)
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		hub.BroadcastAll(msg)
+	}
+}
+
+func BenchmarkHub_Broadcast(b *testing.B) {
+	benchmarkHubBroadcast(b)
+}
+
+func BenchmarkHub_BroadcastSharded(b *testing.B) {
+	benchmarkHubBroadcast(b, extended.WithShards(64), extended.WithBroadcastWorkers(runtime.GOMAXPROCS(0)))
+}
+
+// BenchmarkHub_WriteEach is the baseline for BenchmarkHub_Broadcast,
+// encoding the frame for every connection.
+func BenchmarkHub_WriteEach(b *testing.B) {
+	conns, msg := broadcastConns()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		for _, conn := range conns {
+			conn.Write(msg)
+		}
+	}
+}
+
+// hubClient is the metadata the BroadcastFunc tests filter connections by.
+type hubClient struct {
+	region  string
+	version int
+}
+
+func testHub_BroadcastFunc(t *testing.T, opts ...extended.HubOption) {
+	hub := extended.NewHub(opts...)
+	var conns []*websocket.Conn
+	var writes []*countingConn
+	for i := range 40 {
+		conn, w := newCountingConn()
+		conn.Set("client", hubClient{region: []string{"eu", "us"}[i%2], version: i % 5})
+		hub.Register(conn)
+		conns = append(conns, conn)
+		writes = append(writes, w)
+	}
+	matches := func(v any) bool {
+		client := v.(hubClient)
+		return client.region == "eu" && client.version >= 3
+	}
+
+	// connections that never match come and go during the broadcasts
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				conn, _ := newCountingConn()
+				conn.Set("client", hubClient{region: "eu", version: 1})
+				hub.Join(conn, "lobby")
+				hub.Leave(conn, "lobby")
+				hub.Unregister(conn)
+			}
+		}()
+	}
+	for range 50 {
+		if n := hub.BroadcastWhere("client", matches, hubMessage); n != 8 {
+			t.Errorf("expected the broadcast to reach 8 connections, got %d", n)
+		}
+		hub.BroadcastFunc(func(conn *websocket.Conn) bool {
+			v, _ := conn.Get("client")
+			return matches(v)
+		}, hubMessage)
+	}
+	close(stop)
+	wg.Wait()
+
+	for i, conn := range conns {
+		v, _ := conn.Get("client")
+		expected := int64(0)
+		if matches(v) {
+			expected = 100
+		}
+		if got := writes[i].writes.Load(); got != expected {
+			t.Fatalf("expected %d writes to %+v, got %d", expected, v, got)
+		}
+	}
+
+	// connections without the key are skipped
+	bare, w := newCountingConn()
+	hub.Register(bare)
+	hub.BroadcastWhere("client", func(v any) bool { return true }, hubMessage)
+	if w.writes.Load() != 0 {
+		t.Fatalf("expected the connection without metadata to be skipped")
+	}
+}
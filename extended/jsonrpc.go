@@ -0,0 +1,354 @@
+package extended
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// The error codes defined by JSON-RPC 2.0.
+const (
+	JSONRPCParseError     = -32700
+	JSONRPCInvalidRequest = -32600
+	JSONRPCMethodNotFound = -32601
+	JSONRPCInvalidParams  = -32602
+	JSONRPCInternalError  = -32603
+)
+
+// JSONRPCError is a JSON-RPC 2.0 error object. It is returned by the calls
+// of a JSONRPC client when the server responds with an error, and can be
+// returned by a JSONRPCHandler to respond with a specific error.
+type JSONRPCError struct {
+	Code    int             `json:"code"`
+	Message string          `json:"message"`
+	Data    json.RawMessage `json:"data,omitempty"`
+}
+
+func (e *JSONRPCError) Error() string {
+	return "json-rpc error " + strconv.Itoa(e.Code) + ": " + e.Message
+}
+
+// ErrJSONRPCMethodNotFound can be returned by a JSONRPCHandler for methods
+// it does not have.
+var ErrJSONRPCMethodNotFound = &JSONRPCError{Code: JSONRPCMethodNotFound, Message: "Method not found"}
+
+// jsonrpcVersion is the value of the jsonrpc member of every object.
+const jsonrpcVersion = "2.0"
+
+// jsonrpcRequest is a JSON-RPC 2.0 request object. ID is nil for
+// notifications, and the JSON null for requests with a null id.
+type jsonrpcRequest struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Method  string          `json:"method"`
+	Params  json.RawMessage `json:"params,omitempty"`
+	ID      json.RawMessage `json:"id,omitempty"`
+}
+
+// jsonrpcResponse is a JSON-RPC 2.0 response object.
+type jsonrpcResponse struct {
+	JSONRPC string          `json:"jsonrpc"`
+	Result  json.RawMessage `json:"result,omitempty"`
+	Error   *JSONRPCError   `json:"error,omitempty"`
+	ID      json.RawMessage `json:"id"`
+}
+
+var jsonrpcNull = json.RawMessage("null")
+
+// JSONRPCHandler handles the JSON-RPC 2.0 requests and notifications
+// served by JSONRPCServer. Its result is encoded as JSON and sent back for
+// requests, and discarded for notifications. If it returns a
+// *JSONRPCError, the error is sent as it is; any other error is sent with
+// the internal error code. ctx is done once the connection is closed.
+type JSONRPCHandler func(ctx context.Context, method string, params json.RawMessage) (any, error)
+
+// JSONRPCServer serves JSON-RPC 2.0 over conn, reading requests from conn
+// in a new goroutine and calling handler for each of them, including every
+// request of a batch. Every text message is handled in its own goroutine,
+// and the requests of a batch are handled one after the other, so their
+// responses are sent together. Nothing else should read from conn.
+//
+// Reading stops once the connection is closed, or when the returned
+// function is called, like with OnMessage.
+func JSONRPCServer(conn *websocket.Conn, handler JSONRPCHandler) (stop func()) {
+	return OnMessage(conn, func(_ context.Context, msg *websocket.Message) {
+		if msg.Type != websocket.MessageText {
+			return
+		}
+		go func() {
+			if response := serveJSONRPC(conn.Context(), handler, msg.Data); response != nil {
+				conn.Write(&websocket.Message{Type: websocket.MessageText, Data: response})
+			}
+		}()
+	}, nil)
+}
+
+// serveJSONRPC handles a request or a batch and returns the encoded
+// response, or nil if there is nothing to respond with.
+func serveJSONRPC(ctx context.Context, handler JSONRPCHandler, data []byte) []byte {
+	data = bytes.TrimSpace(data)
+	if !json.Valid(data) {
+		return mustMarshal(jsonrpcErrorResponse(jsonrpcNull, JSONRPCParseError, "Parse error"))
+	}
+	if len(data) == 0 || data[0] != '[' {
+		response := serveJSONRPCRequest(ctx, handler, data)
+		if response == nil {
+			return nil
+		}
+		return mustMarshal(response)
+	}
+
+	var batch []json.RawMessage
+	json.Unmarshal(data, &batch)
+	if len(batch) == 0 {
+		return mustMarshal(jsonrpcErrorResponse(jsonrpcNull, JSONRPCInvalidRequest, "Invalid Request"))
+	}
+	var responses []*jsonrpcResponse
+	for _, req := range batch {
+		if response := serveJSONRPCRequest(ctx, handler, req); response != nil {
+			responses = append(responses, response)
+		}
+	}
+	if len(responses) == 0 { // a batch of notifications
+		return nil
+	}
+	return mustMarshal(responses)
+}
+
+// serveJSONRPCRequest handles a single request and returns its response,
+// or nil for a notification.
+func serveJSONRPCRequest(ctx context.Context, handler JSONRPCHandler, data []byte) *jsonrpcResponse {
+	var req jsonrpcRequest
+	if err := json.Unmarshal(data, &req); err != nil || req.JSONRPC != jsonrpcVersion || req.Method == "" || !validJSONRPCID(req.ID) {
+		return jsonrpcErrorResponse(jsonrpcNull, JSONRPCInvalidRequest, "Invalid Request")
+	}
+
+	result, err := handler(ctx, req.Method, req.Params)
+	if req.ID == nil {
+		return nil
+	}
+	if err != nil {
+		var rpcErr *JSONRPCError
+		if !errors.As(err, &rpcErr) {
+			rpcErr = &JSONRPCError{Code: JSONRPCInternalError, Message: err.Error()}
+		}
+		return &jsonrpcResponse{JSONRPC: jsonrpcVersion, Error: rpcErr, ID: req.ID}
+	}
+	data, err = json.Marshal(result)
+	if err != nil {
+		return jsonrpcErrorResponse(req.ID, JSONRPCInternalError, err.Error())
+	}
+	return &jsonrpcResponse{JSONRPC: jsonrpcVersion, Result: data, ID: req.ID}
+}
+
+// validJSONRPCID reports whether id is absent, a string, a number, or null.
+func validJSONRPCID(id json.RawMessage) bool {
+	if id == nil {
+		return true
+	}
+	switch id[0] {
+	case '"', 'n', '-', '0', '1', '2', '3', '4', '5', '6', '7', '8', '9':
+		return true
+	default:
+		return false
+	}
+}
+
+func jsonrpcErrorResponse(id json.RawMessage, code int, message string) *jsonrpcResponse {
+	return &jsonrpcResponse{JSONRPC: jsonrpcVersion, Error: &JSONRPCError{Code: code, Message: message}, ID: id}
+}
+
+// mustMarshal encodes a value that always encodes successfully.
+func mustMarshal(v any) []byte {
+	data, err := json.Marshal(v)
+	if err != nil {
+		panic(err)
+	}
+	return data
+}
+
+// JSONRPCCall is a call in a batch made with JSONRPC.Batch.
+type JSONRPCCall struct {
+	Method string
+	Params any
+	// Notification makes the call a notification, which gets no response.
+	Notification bool
+
+	// Result and Err are set by Batch once the response arrives.
+	Result json.RawMessage
+	Err    error
+}
+
+// JSONRPC is a JSON-RPC 2.0 client. It is created by JSONRPCClient.
+type JSONRPC struct {
+	conn *websocket.Conn
+
+	mx      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan *jsonrpcResponse
+	err     error // why reading ended, once it has
+	done    chan struct{}
+}
+
+// JSONRPCClient starts reading responses from conn in a new goroutine and
+// returns a client that makes JSON-RPC 2.0 calls over it. Any amount of
+// calls may be made at the same time. Nothing else should read from conn.
+func JSONRPCClient(conn *websocket.Conn) *JSONRPC {
+	c := &JSONRPC{
+		conn:    conn,
+		pending: make(map[uint64]chan *jsonrpcResponse),
+		done:    make(chan struct{}),
+	}
+	OnMessage(conn, func(_ context.Context, msg *websocket.Message) { c.receive(msg) }, c.fail)
+	return c
+}
+
+// Call calls method with params encoded as JSON and waits for the result,
+// which is returned as it was encoded by the server. If params is nil, or
+// is encoded as null, the request is sent without params. If the server
+// responds with an error, Call returns it as a *JSONRPCError. If ctx is
+// done before the response arrives, Call returns ctx.Err() and the
+// response is discarded whenever it arrives.
+func (c *JSONRPC) Call(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	call := JSONRPCCall{Method: method, Params: params}
+	if err := c.do(ctx, []*JSONRPCCall{&call}, false); err != nil {
+		return nil, err
+	}
+	return call.Result, call.Err
+}
+
+// Notify sends a notification, which gets no response.
+func (c *JSONRPC) Notify(method string, params any) error {
+	return c.do(context.Background(), []*JSONRPCCall{{Method: method, Params: params, Notification: true}}, false)
+}
+
+// Batch sends calls as a single batch and waits for the responses to every
+// call that is not a notification, setting their Result or Err. It returns
+// an error if the batch could not be sent, or if ctx is done or reading
+// ends before every response arrives.
+func (c *JSONRPC) Batch(ctx context.Context, calls []*JSONRPCCall) error {
+	return c.do(ctx, calls, true)
+}
+
+// do sends calls, as a batch or as a single request, and waits for their
+// responses.
+func (c *JSONRPC) do(ctx context.Context, calls []*JSONRPCCall, batch bool) error {
+	reqs := make([]jsonrpcRequest, len(calls))
+	responses := make(map[*JSONRPCCall]chan *jsonrpcResponse)
+	var ids []uint64
+	defer func() {
+		c.mx.Lock()
+		for _, id := range ids {
+			delete(c.pending, id)
+		}
+		c.mx.Unlock()
+	}()
+
+	for i, call := range calls {
+		reqs[i] = jsonrpcRequest{JSONRPC: jsonrpcVersion, Method: call.Method}
+		if call.Params != nil {
+			params, err := json.Marshal(call.Params)
+			if err != nil {
+				return err
+			}
+			if string(params) != "null" { // params must be structured if present
+				reqs[i].Params = params
+			}
+		}
+		if call.Notification {
+			continue
+		}
+
+		c.mx.Lock()
+		if c.err != nil {
+			c.mx.Unlock()
+			return c.err
+		}
+		c.nextID++
+		id := c.nextID
+		response := make(chan *jsonrpcResponse, 1)
+		c.pending[id] = response
+		c.mx.Unlock()
+		ids = append(ids, id)
+		reqs[i].ID = json.RawMessage(strconv.FormatUint(id, 10))
+		responses[call] = response
+	}
+
+	var data []byte
+	if batch {
+		data = mustMarshal(reqs)
+	} else {
+		data = mustMarshal(reqs[0])
+	}
+	if err := c.conn.Write(&websocket.Message{Type: websocket.MessageText, Data: data}); err != nil {
+		return err
+	}
+
+	for call, response := range responses {
+		select {
+		case res := <-response:
+			call.Result = res.Result
+			if res.Error != nil {
+				call.Err = res.Error
+			}
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-c.done:
+			return c.Err()
+		}
+	}
+	return nil
+}
+
+// Err returns nil while reading, and the error that ended reading once it
+// has ended.
+func (c *JSONRPC) Err() error {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.err
+}
+
+// receive handles a response or a batch of responses.
+func (c *JSONRPC) receive(msg *websocket.Message) {
+	var responses []*jsonrpcResponse
+	data := bytes.TrimSpace(msg.Data)
+	var err error
+	if len(data) > 0 && data[0] == '[' {
+		err = json.Unmarshal(data, &responses)
+	} else {
+		var response jsonrpcResponse
+		err = json.Unmarshal(data, &response)
+		responses = append(responses, &response)
+	}
+	if err != nil {
+		c.conn.Logger().Warn("received a malformed json-rpc response", "error", err.Error())
+		return
+	}
+
+	for _, response := range responses {
+		id, err := strconv.ParseUint(string(response.ID), 10, 64)
+		c.mx.Lock()
+		pending, ok := c.pending[id]
+		delete(c.pending, id)
+		c.mx.Unlock()
+		if err != nil || !ok { // the call is not waiting for it anymore
+			if response.Error != nil {
+				c.conn.Logger().Warn("received a json-rpc error for an unknown call", "id", string(response.ID), "error", response.Error.Error())
+			}
+			continue
+		}
+		pending <- response
+	}
+}
+
+// fail records the error that ended reading and fails the pending calls.
+func (c *JSONRPC) fail(err error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.err = err
+	close(c.done)
+}
@@ -0,0 +1,304 @@
+package extended_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"reflect"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// subtractParams accepts both the positional and the named parameters of
+// the subtract method from the examples of the specification.
+type subtractParams struct {
+	Minuend, Subtrahend int
+}
+
+func (p *subtractParams) UnmarshalJSON(data []byte) error {
+	var positional [2]int
+	if err := json.Unmarshal(data, &positional); err == nil {
+		p.Minuend, p.Subtrahend = positional[0], positional[1]
+		return nil
+	}
+	var named struct {
+		Minuend    int `json:"minuend"`
+		Subtrahend int `json:"subtrahend"`
+	}
+	err := json.Unmarshal(data, &named)
+	p.Minuend, p.Subtrahend = named.Minuend, named.Subtrahend
+	return err
+}
+
+// specHandler implements the methods used by the examples of the
+// specification.
+func specHandler(ctx context.Context, method string, params json.RawMessage) (any, error) {
+	switch method {
+	case "subtract":
+		var p subtractParams
+		if err := json.Unmarshal(params, &p); err != nil {
+			return nil, &extended.JSONRPCError{Code: extended.JSONRPCInvalidParams, Message: "Invalid params"}
+		}
+		return p.Minuend - p.Subtrahend, nil
+	case "sum":
+		var ns []int
+		json.Unmarshal(params, &ns)
+		sum := 0
+		for _, n := range ns {
+			sum += n
+		}
+		return sum, nil
+	case "get_data":
+		return []any{"hello", 5}, nil
+	case "update", "notify_hello", "notify_sum":
+		return nil, nil
+	case "fail":
+		return nil, errors.New("boom")
+	default:
+		return nil, extended.ErrJSONRPCMethodNotFound
+	}
+}
+
+// normalizeJSON decodes data so that equal JSON values compare equal, and
+// sorts the elements of a batch, which may be responded to in any order.
+func normalizeJSON(t *testing.T, data string) any {
+	t.Helper()
+	var v any
+	if err := json.Unmarshal([]byte(data), &v); err != nil {
+		t.Fatalf("expected valid JSON, got %s", data)
+	}
+	if batch, ok := v.([]any); ok {
+		slices.SortFunc(batch, func(a, b any) int {
+			x, _ := json.Marshal(a)
+			y, _ := json.Marshal(b)
+			return slices.Compare(x, y)
+		})
+	}
+	return v
+}
+
+// The examples of the JSON-RPC 2.0 specification, with "" as the response
+// when nothing is responded with.
+var jsonrpcFixtures = []struct {
+	name, request, response string
+}{
+	{
+		"positional parameters",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": [42, 23], "id": 1}`,
+		`{"jsonrpc": "2.0", "result": 19, "id": 1}`,
+	},
+	{
+		"named parameters",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": {"subtrahend": 23, "minuend": 42}, "id": 3}`,
+		`{"jsonrpc": "2.0", "result": 19, "id": 3}`,
+	},
+	{
+		"null id",
+		`{"jsonrpc": "2.0", "method": "subtract", "params": [1, 1], "id": null}`,
+		`{"jsonrpc": "2.0", "result": 0, "id": null}`,
+	},
+	{
+		"notification",
+		`{"jsonrpc": "2.0", "method": "update", "params": [1,2,3,4,5]}`,
+		``,
+	},
+	{
+		"non-existent method",
+		`{"jsonrpc": "2.0", "method": "foobar", "id": "1"}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found"}, "id": "1"}`,
+	},
+	{
+		"invalid JSON",
+		`{"jsonrpc": "2.0", "method": "foobar, "params": "bar", "baz]`,
+		`{"jsonrpc": "2.0", "error": {"code": -32700, "message": "Parse error"}, "id": null}`,
+	},
+	{
+		"invalid request object",
+		`{"jsonrpc": "2.0", "method": 1, "params": "bar"}`,
+		`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`,
+	},
+	{
+		"batch with invalid JSON",
+		`[
+		  {"jsonrpc": "2.0", "method": "sum", "params": [1,2,4], "id": "1"},
+		  {"jsonrpc": "2.0", "method"
+		]`,
+		`{"jsonrpc": "2.0", "error": {"code": -32700, "message": "Parse error"}, "id": null}`,
+	},
+	{
+		"empty batch",
+		`[]`,
+		`{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}`,
+	},
+	{
+		"invalid batch",
+		`[1]`,
+		`[{"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}]`,
+	},
+	{
+		"invalid batches",
+		`[1,2,3]`,
+		`[
+		  {"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null},
+		  {"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null},
+		  {"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null}
+		]`,
+	},
+	{
+		"batch",
+		`[
+		  {"jsonrpc": "2.0", "method": "sum", "params": [1,2,4], "id": "1"},
+		  {"jsonrpc": "2.0", "method": "notify_hello", "params": [7]},
+		  {"jsonrpc": "2.0", "method": "subtract", "params": [42,23], "id": "2"},
+		  {"foo": "boo"},
+		  {"jsonrpc": "2.0", "method": "foo.get", "params": {"name": "myself"}, "id": "5"},
+		  {"jsonrpc": "2.0", "method": "get_data", "id": "9"}
+		]`,
+		`[
+		  {"jsonrpc": "2.0", "result": 7, "id": "1"},
+		  {"jsonrpc": "2.0", "result": 19, "id": "2"},
+		  {"jsonrpc": "2.0", "error": {"code": -32600, "message": "Invalid Request"}, "id": null},
+		  {"jsonrpc": "2.0", "error": {"code": -32601, "message": "Method not found"}, "id": "5"},
+		  {"jsonrpc": "2.0", "result": ["hello", 5], "id": "9"}
+		]`,
+	},
+	{
+		"batch of notifications",
+		`[
+		  {"jsonrpc": "2.0", "method": "notify_sum", "params": [1,2,4]},
+		  {"jsonrpc": "2.0", "method": "notify_hello", "params": [7]}
+		]`,
+		``,
+	},
+}
+
+func TestJSONRPCServer(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+	defer client.Close()
+	extended.JSONRPCServer(server, specHandler)
+
+	// sent after every fixture, so that its response shows that nothing
+	// else was responded with
+	const ping = `{"jsonrpc": "2.0", "method": "get_data", "id": "ping"}`
+	pong := normalizeJSON(t, `{"jsonrpc": "2.0", "result": ["hello", 5], "id": "ping"}`)
+
+	for _, fixture := range jsonrpcFixtures {
+		send(t, client, fixture.request)
+		if fixture.response != "" {
+			msg, err := client.Read()
+			if err != nil {
+				t.Fatalf("%s: expected no error from Read(), got %v", fixture.name, err)
+			}
+			if got, expected := normalizeJSON(t, string(msg.Data)), normalizeJSON(t, fixture.response); !reflect.DeepEqual(got, expected) {
+				t.Fatalf("%s: expected %s, got %s", fixture.name, fixture.response, msg.Data)
+			}
+		}
+
+		send(t, client, ping)
+		msg, err := client.Read()
+		if err != nil {
+			t.Fatalf("%s: expected no error from Read(), got %v", fixture.name, err)
+		}
+		if got := normalizeJSON(t, string(msg.Data)); !reflect.DeepEqual(got, pong) {
+			t.Fatalf("%s: expected nothing else to be responded with, got %s", fixture.name, msg.Data)
+		}
+	}
+}
+
+func jsonrpcPair(t *testing.T) *extended.JSONRPC {
+	t.Helper()
+	server, client := pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	extended.JSONRPCServer(server, specHandler)
+	return extended.JSONRPCClient(client)
+}
+
+func TestJSONRPCClient(t *testing.T) {
+	c := jsonrpcPair(t)
+
+	result, err := c.Call(context.Background(), "subtract", []int{42, 23})
+	if err != nil || string(result) != "19" {
+		t.Fatalf("expected 19, got %s (%v)", result, err)
+	}
+
+	var rpcErr *extended.JSONRPCError
+	if _, err := c.Call(context.Background(), "foobar", nil); !errors.As(err, &rpcErr) || rpcErr.Code != extended.JSONRPCMethodNotFound {
+		t.Fatalf("expected a method not found error, got %v", err)
+	}
+	if _, err := c.Call(context.Background(), "fail", nil); !errors.As(err, &rpcErr) || rpcErr.Code != extended.JSONRPCInternalError || rpcErr.Message != "boom" {
+		t.Fatalf("expected an internal error, got %v", err)
+	}
+	if err := c.Notify("update", []int{1, 2}); err != nil {
+		t.Fatalf("expected no error from Notify(), got %v", err)
+	}
+}
+
+func TestJSONRPCClient_NoParams(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+	defer client.Close()
+	c := extended.JSONRPCClient(client)
+
+	var nilMap map[string]int
+	for _, params := range []any{nil, nilMap} {
+		go c.Notify("update", params)
+		msg, err := server.Read()
+		if err != nil {
+			t.Fatalf("expected no error from Read(), got %v", err)
+		}
+		var req map[string]any
+		if err := json.Unmarshal(msg.Data, &req); err != nil {
+			t.Fatalf("expected a JSON request, got %s", msg.Data)
+		}
+		if _, ok := req["params"]; ok {
+			t.Fatalf("expected the request to be sent without params, got %s", msg.Data)
+		}
+	}
+}
+
+func TestJSONRPCClient_Batch(t *testing.T) {
+	c := jsonrpcPair(t)
+
+	calls := []*extended.JSONRPCCall{
+		{Method: "sum", Params: []int{1, 2, 4}},
+		{Method: "notify_hello", Params: []int{7}, Notification: true},
+		{Method: "subtract", Params: map[string]int{"minuend": 42, "subtrahend": 23}},
+		{Method: "foo.get"},
+	}
+	if err := c.Batch(context.Background(), calls); err != nil {
+		t.Fatalf("expected no error from Batch(), got %v", err)
+	}
+	if string(calls[0].Result) != "7" || calls[0].Err != nil {
+		t.Fatalf("expected 7, got %s (%v)", calls[0].Result, calls[0].Err)
+	}
+	if calls[1].Result != nil || calls[1].Err != nil {
+		t.Fatalf("expected no response to the notification, got %s (%v)", calls[1].Result, calls[1].Err)
+	}
+	if string(calls[2].Result) != "19" || calls[2].Err != nil {
+		t.Fatalf("expected 19, got %s (%v)", calls[2].Result, calls[2].Err)
+	}
+	var rpcErr *extended.JSONRPCError
+	if !errors.As(calls[3].Err, &rpcErr) || rpcErr.Code != extended.JSONRPCMethodNotFound {
+		t.Fatalf("expected a method not found error, got %v", calls[3].Err)
+	}
+}
+
+func TestJSONRPCClient_Closed(t *testing.T) {
+	server, client := pipe()
+	defer client.Close()
+	c := extended.JSONRPCClient(client)
+
+	server.Close()
+	waitFor(t, time.Second, func() bool { return c.Err() != nil })
+	if _, err := c.Call(context.Background(), "subtract", []int{1, 1}); !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected CONNECTION_CLOSED error, got %v", err)
+	}
+}
@@ -0,0 +1,217 @@
+package extended
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// AdaptiveKeepaliveOptions configures AdaptiveKeepalive. The zero value
+// uses the defaults described on each field.
+type AdaptiveKeepaliveOptions struct {
+	// MinInterval is the shortest time between pings, used after a pong
+	// is missed. Defaults to 5 seconds.
+	MinInterval time.Duration
+	// MaxInterval is the longest time between pings, reached while the
+	// link is stable. Defaults to 1 minute.
+	MaxInterval time.Duration
+	// Growth is the factor the interval is multiplied by after a pong is
+	// received on a stable link. Defaults to 1.5.
+	Growth float64
+	// Timeout is how long to wait for a pong. If it is 0, four times the
+	// smoothed round-trip time is used, but never less than one second.
+	Timeout time.Duration
+	// MaxMisses is the amount of pings in a row that may miss their pong
+	// before the connection is closed. If it is 0, the connection is never
+	// closed by the keepalive.
+	MaxMisses int
+
+	clock clock.Clock
+}
+
+// rttJitterAllowance is how much a round-trip time may exceed twice the
+// smoothed round-trip time before the link is considered unstable, so that
+// noise on fast links does not hold the interval.
+const rttJitterAllowance = 50 * time.Millisecond
+
+// KeepaliveStats is a snapshot of the state of an adaptive keepalive.
+type KeepaliveStats struct {
+	// Interval is the current time between pings.
+	Interval time.Duration
+	// RTT is the smoothed round-trip time of pings, or 0 if no pong has
+	// been received yet.
+	RTT time.Duration
+	// LastRTT is the round-trip time of the latest ping that received a
+	// pong.
+	LastRTT time.Duration
+	// Misses is the amount of pings in a row that have missed their pong.
+	Misses int
+}
+
+// Keepalive pings a connection at an interval that adapts to the link. It
+// is created by AdaptiveKeepalive.
+type Keepalive struct {
+	conn *websocket.Conn
+	opts AdaptiveKeepaliveOptions
+
+	mx    sync.Mutex
+	stats KeepaliveStats
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// AdaptiveKeepalive starts pinging conn, adjusting the interval between
+// pings to the link: it starts at the minimum interval and backs off toward
+// the maximum interval while pongs arrive with a steady round-trip time, and
+// halves it (down to the minimum interval) after a missed pong. A round-trip
+// time well over twice the smoothed round-trip time is treated as a sign of
+// an unstable link, so the interval is held instead of widened.
+//
+// Pongs are only received while conn is being read from. The keepalive stops
+// when Stop is called or the connection is closed.
+func AdaptiveKeepalive(conn *websocket.Conn, opts AdaptiveKeepaliveOptions) *Keepalive {
+	if opts.MinInterval <= 0 {
+		opts.MinInterval = 5 * time.Second
+	}
+	if opts.MaxInterval < opts.MinInterval {
+		opts.MaxInterval = max(time.Minute, opts.MinInterval)
+	}
+	if opts.Growth <= 1 {
+		opts.Growth = 1.5
+	}
+	if opts.clock == nil {
+		opts.clock = clock.Real{}
+	}
+	k := &Keepalive{
+		conn:  conn,
+		opts:  opts,
+		stats: KeepaliveStats{Interval: opts.MinInterval},
+		stop:  make(chan struct{}),
+	}
+	go k.run()
+	return k
+}
+
+// Stats returns the current interval, round-trip times, and missed pongs.
+func (k *Keepalive) Stats() KeepaliveStats {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	return k.stats
+}
+
+// Stop stops pinging the connection. It does not close the connection.
+func (k *Keepalive) Stop() {
+	k.stopOnce.Do(func() {
+		close(k.stop)
+	})
+}
+
+// timeout returns how long to wait for the next pong.
+func (k *Keepalive) timeout() time.Duration {
+	if k.opts.Timeout > 0 {
+		return k.opts.Timeout
+	}
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	return max(time.Second, 4*k.stats.RTT)
+}
+
+func (k *Keepalive) run() {
+	done := k.conn.Context().Done()
+	for {
+		t := k.opts.clock.NewTimer(k.Stats().Interval)
+		select {
+		case <-t.C():
+		case <-k.stop:
+			t.Stop()
+			return
+		case <-done:
+			t.Stop()
+			return
+		}
+
+		rtt, err := pingTimeout(k.conn, k.opts.clock, k.timeout())
+		switch {
+		case err == nil:
+			k.received(rtt)
+		case err.Kind() == websocket.PING_TIMEOUT:
+			if k.missed() {
+				k.conn.Close()
+				return
+			}
+		default: // the connection is closed or broken
+			return
+		}
+	}
+}
+
+// pingTimeout pings conn, giving up after d has passed on clk. The ping
+// is given a context whose deadline passes then, so that a ping that times
+// out is a missed pong for the connection (see websocket.Conn.OnPongMissed).
+func pingTimeout(conn *websocket.Conn, clk clock.Clock, d time.Duration) (time.Duration, websocket.Error) {
+	ctx := &clockDeadline{deadline: clk.Now().Add(d), done: make(chan struct{})}
+	t := clk.AfterFunc(d, func() { close(ctx.done) })
+	defer t.Stop()
+	return conn.PingRTT(ctx)
+}
+
+// clockDeadline is a context whose deadline passes on a clock.Clock rather
+// than on the wall clock, once done is closed.
+type clockDeadline struct {
+	deadline time.Time
+	done     chan struct{}
+}
+
+func (c *clockDeadline) Deadline() (time.Time, bool) {
+	return c.deadline, true
+}
+
+func (c *clockDeadline) Done() <-chan struct{} {
+	return c.done
+}
+
+func (c *clockDeadline) Err() error {
+	select {
+	case <-c.done:
+		return context.DeadlineExceeded
+	default:
+		return nil
+	}
+}
+
+func (c *clockDeadline) Value(any) any {
+	return nil
+}
+
+// received updates the stats after a pong, widening the interval if the
+// link is stable.
+func (k *Keepalive) received(rtt time.Duration) {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	stable := k.stats.RTT == 0 || rtt <= 2*k.stats.RTT+rttJitterAllowance
+	if k.stats.RTT == 0 {
+		k.stats.RTT = rtt
+	} else {
+		k.stats.RTT += (rtt - k.stats.RTT) / 8
+	}
+	k.stats.LastRTT = rtt
+	k.stats.Misses = 0
+	if stable {
+		interval := time.Duration(float64(k.stats.Interval) * k.opts.Growth)
+		k.stats.Interval = min(k.opts.MaxInterval, interval)
+	}
+}
+
+// missed updates the stats after a missed pong, narrowing the interval. It
+// reports whether the connection should be closed.
+func (k *Keepalive) missed() bool {
+	k.mx.Lock()
+	defer k.mx.Unlock()
+	k.stats.Misses++
+	k.stats.Interval = max(k.opts.MinInterval, k.stats.Interval/2)
+	return k.opts.MaxMisses > 0 && k.stats.Misses >= k.opts.MaxMisses
+}
@@ -0,0 +1,142 @@
+package extended_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// waitFor polls cond until it returns true or the timeout is reached.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within %s", timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// waitForTimer waits until the only pending timer on clk fires in d.
+func waitForTimer(t *testing.T, clk *clock.Fake, d time.Duration) {
+	t.Helper()
+	waitFor(t, time.Second, func() bool {
+		waiting := clk.Waiting()
+		return len(waiting) == 1 && waiting[0] == d
+	})
+}
+
+// readLoop reads from conn until an error occurs.
+func readLoop(conn *websocket.Conn) {
+	for {
+		if _, err := conn.Read(); err != nil {
+			return
+		}
+	}
+}
+
+// pipe returns two connected Conns, a client and a server.
+func pipe(opts ...websocket.Option) (*websocket.Conn, *websocket.Conn) {
+	return websocket.Pipe(opts...)
+}
+
+func TestAdaptiveKeepalive(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+	go readLoop(conn)
+	go readLoop(peer)
+
+	clk := clock.NewFake()
+	k := extended.AdaptiveKeepalive(conn, extended.WithClock(extended.AdaptiveKeepaliveOptions{
+		MinInterval: 10 * time.Second,
+		MaxInterval: 60 * time.Second,
+		Growth:      2,
+		Timeout:     5 * time.Second,
+		MaxMisses:   4,
+	}, clk))
+	defer k.Stop()
+
+	// the interval widens while pongs arrive
+	for _, interval := range []time.Duration{10, 20, 40, 60, 60} {
+		interval *= time.Second
+		waitForTimer(t, clk, interval)
+		if k.Stats().Interval != interval {
+			t.Fatalf("Expected an interval of %s, got %s", interval, k.Stats().Interval)
+		}
+		clk.Advance(interval)
+	}
+	waitForTimer(t, clk, 60*time.Second)
+	if k.Stats().RTT == 0 || k.Stats().Misses != 0 {
+		t.Fatalf("Expected a round-trip time and no misses, got %+v", k.Stats())
+	}
+
+	// the interval narrows once pongs stop
+	peer.SetPingHandler(func(payload []byte) error { return nil })
+	for i, interval := range []time.Duration{60, 30, 15, 10} {
+		interval *= time.Second
+		waitForTimer(t, clk, interval)
+		if k.Stats().Interval != interval || k.Stats().Misses != i {
+			t.Fatalf("Expected an interval of %s after %d misses, got %+v", interval, i, k.Stats())
+		}
+		clk.Advance(interval)
+		waitForTimer(t, clk, 5*time.Second)
+		clk.Advance(5 * time.Second)
+	}
+
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the connection to be closed after 4 missed pongs")
+	}
+}
+
+func TestAdaptiveKeepalive_Stop(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	clk := clock.NewFake()
+	k := extended.AdaptiveKeepalive(conn, extended.WithClock(extended.AdaptiveKeepaliveOptions{}, clk))
+	waitForTimer(t, clk, 5*time.Second)
+	k.Stop()
+	waitFor(t, time.Second, func() bool { return clk.Pending() == 0 })
+	if conn.Context().Err() != nil {
+		t.Fatalf("Expected Stop() to leave the connection open")
+	}
+}
+
+func TestAdaptiveKeepalive_OnPongMissed(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+	go readLoop(conn)
+	go readLoop(peer)
+	peer.SetPingHandler(func(payload []byte) error { return nil })
+
+	missed := make(chan int, 1)
+	conn.OnPongMissed(func(consecutiveMisses int) { missed <- consecutiveMisses })
+	clk := clock.NewFake()
+	k := extended.AdaptiveKeepalive(conn, extended.WithClock(extended.AdaptiveKeepaliveOptions{
+		MinInterval: 10 * time.Second,
+		Timeout:     5 * time.Second,
+	}, clk))
+	defer k.Stop()
+
+	waitForTimer(t, clk, 10*time.Second)
+	clk.Advance(10 * time.Second)
+	waitForTimer(t, clk, 5*time.Second)
+	clk.Advance(5 * time.Second)
+	select {
+	case misses := <-missed:
+		if misses != 1 {
+			t.Fatalf("Expected 1 consecutive miss, got %d", misses)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("Expected OnPongMissed to be called for the ping that timed out")
+	}
+}
@@ -0,0 +1,137 @@
+package extended
+
+import (
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// LatencyTracker pings a connection at a fixed interval and keeps
+// statistics about the round-trip times. It is created by
+// NewLatencyTracker.
+type LatencyTracker struct {
+	conn     *websocket.Conn
+	interval time.Duration
+	clock    clock.Clock
+
+	mx      sync.Mutex
+	average time.Duration
+	last    time.Duration
+	min     time.Duration
+	max     time.Duration
+	samples int
+
+	stop     chan struct{}
+	stopOnce sync.Once
+}
+
+// NewLatencyTracker starts pinging conn every interval to measure its
+// latency. A ping that does not receive a pong within the interval is not
+// counted. Pings carry unique payloads, so pings sent by the application on
+// the same connection do not affect the measurements.
+//
+// An interval of 0 or less defaults to 30 seconds. Pongs are only received
+// while conn is being read from. The tracker stops when Stop is called or
+// the connection is closed.
+func NewLatencyTracker(conn *websocket.Conn, interval time.Duration) *LatencyTracker {
+	return newLatencyTracker(conn, interval, clock.Real{})
+}
+
+func newLatencyTracker(conn *websocket.Conn, interval time.Duration, clk clock.Clock) *LatencyTracker {
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	t := &LatencyTracker{
+		conn:     conn,
+		interval: interval,
+		clock:    clk,
+		stop:     make(chan struct{}),
+	}
+	go t.run()
+	return t
+}
+
+// Average returns the exponentially weighted moving average of the
+// round-trip times, where each new sample has a weight of 1/8 (the same
+// smoothing TCP uses for its round-trip time). It returns 0 if there are
+// no samples yet.
+func (t *LatencyTracker) Average() time.Duration {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.average
+}
+
+// Last returns the most recent round-trip time.
+func (t *LatencyTracker) Last() time.Duration {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.last
+}
+
+// Min returns the shortest round-trip time seen.
+func (t *LatencyTracker) Min() time.Duration {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.min
+}
+
+// Max returns the longest round-trip time seen.
+func (t *LatencyTracker) Max() time.Duration {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.max
+}
+
+// Samples returns the amount of round-trip times measured.
+func (t *LatencyTracker) Samples() int {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.samples
+}
+
+// Stop stops pinging the connection. It does not close the connection.
+func (t *LatencyTracker) Stop() {
+	t.stopOnce.Do(func() {
+		close(t.stop)
+	})
+}
+
+func (t *LatencyTracker) run() {
+	done := t.conn.Context().Done()
+	for {
+		timer := t.clock.NewTimer(t.interval)
+		select {
+		case <-timer.C():
+		case <-t.stop:
+			timer.Stop()
+			return
+		case <-done:
+			timer.Stop()
+			return
+		}
+
+		rtt, err := pingTimeout(t.conn, t.clock, t.interval)
+		if err == nil {
+			t.record(rtt)
+		} else if err.Kind() != websocket.PING_TIMEOUT { // the connection is closed or broken
+			return
+		}
+	}
+}
+
+// record adds a round-trip time to the statistics.
+func (t *LatencyTracker) record(rtt time.Duration) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	if t.samples == 0 {
+		t.average, t.min, t.max = rtt, rtt, rtt
+	} else {
+		t.average += (rtt - t.average) / 8
+		t.min = min(t.min, rtt)
+		t.max = max(t.max, rtt)
+	}
+	t.last = rtt
+	t.samples++
+}
@@ -0,0 +1,77 @@
+package extended_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+func TestLatencyTracker(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	delays := []time.Duration{40, 10, 80, 20, 30}
+	delay := make(chan time.Duration, 1)
+	peer.SetPingHandler(func(payload []byte) error {
+		time.Sleep(<-delay)
+		return peer.Write(&websocket.Message{Type: websocket.MessagePong, Data: payload})
+	})
+	go readLoop(conn)
+	go readLoop(peer)
+
+	clk := clock.NewFake()
+	tracker := extended.NewLatencyTrackerWithClock(conn, 10*time.Second, clk)
+	defer tracker.Stop()
+
+	var average, lo, hi time.Duration
+	for i, d := range delays {
+		d *= time.Millisecond
+		delay <- d
+		waitForTimer(t, clk, 10*time.Second)
+		clk.Advance(10 * time.Second)
+		waitFor(t, time.Second, func() bool { return tracker.Samples() == i+1 })
+
+		last := tracker.Last()
+		if last < d {
+			t.Fatalf("Expected a round-trip time of at least %s, got %s", d, last)
+		}
+		if i == 0 {
+			average, lo, hi = last, last, last
+		} else {
+			average += (last - average) / 8
+			lo, hi = min(lo, last), max(hi, last)
+		}
+		if tracker.Average() != average {
+			t.Fatalf("Expected an average of %s, got %s", average, tracker.Average())
+		}
+	}
+	if tracker.Min() != lo || tracker.Max() != hi {
+		t.Fatalf("Expected min %s and max %s, got %s and %s", lo, hi, tracker.Min(), tracker.Max())
+	}
+}
+
+func TestLatencyTracker_StopsOnClose(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+
+	clk := clock.NewFake()
+	extended.NewLatencyTrackerWithClock(conn, 10*time.Second, clk)
+	waitForTimer(t, clk, 10*time.Second)
+	conn.Close()
+	waitFor(t, time.Second, func() bool { return clk.Pending() == 0 })
+}
+
+func TestLatencyTracker_DefaultInterval(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	clk := clock.NewFake()
+	tracker := extended.NewLatencyTrackerWithClock(conn, 0, clk)
+	defer tracker.Stop()
+	waitForTimer(t, clk, 30*time.Second)
+}
@@ -0,0 +1,116 @@
+package extended
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// Handlers are the functions Listen calls for the events of a connection.
+// Any of them may be nil, in which case the event is skipped.
+type Handlers struct {
+	// OnMessage is called with every text and binary message.
+	OnMessage func(msg *websocket.Message)
+	// OnMessageContext is like OnMessage, with the context of the message,
+	// which carries the values attached by the middleware added with Use.
+	// If it is set, OnMessage is not called.
+	OnMessageContext func(ctx context.Context, msg *websocket.Message)
+	// OnPing is called with the payload of every ping, after it has been
+	// responded to.
+	OnPing func(payload []byte)
+	// OnPong is called with the payload of every pong.
+	OnPong func(payload []byte)
+	// OnClose is called once the connection has been closed by the peer,
+	// with the code and reason of its close frame, or once the underlying
+	// connection ended without a close frame, with code 1006 (abnormal
+	// closure).
+	OnClose func(code int, reason string)
+	// OnError is called with any other error that ends reading, including
+	// the CONNECTION_CLOSED error returned once Close is called.
+	OnError func(err error)
+
+	middleware []MessageMiddleware
+}
+
+// Use adds middleware that every text and binary message goes through
+// before OnMessage or OnMessageContext is called. Middleware added first
+// is the outermost, so it is called first.
+func (h *Handlers) Use(mw ...MessageMiddleware) {
+	h.middleware = append(h.middleware, mw...)
+}
+
+// onMessage returns the handler for text and binary messages, or nil if
+// there is nothing to call for them.
+func (h Handlers) onMessage() MessageHandler {
+	var handle MessageHandler
+	switch {
+	case h.OnMessageContext != nil:
+		handle = func(ctx context.Context, conn *websocket.Conn, msg *websocket.Message) { h.OnMessageContext(ctx, msg) }
+	case h.OnMessage != nil:
+		handle = func(ctx context.Context, conn *websocket.Conn, msg *websocket.Message) { h.OnMessage(msg) }
+	case len(h.middleware) > 0:
+		handle = func(ctx context.Context, conn *websocket.Conn, msg *websocket.Message) {}
+	default:
+		return nil
+	}
+	return Chain(handle, h.middleware...)
+}
+
+// Listen reads from conn in a new goroutine and calls the handlers for
+// every event, so the connection can be used without a read loop of its
+// own. Pings are responded to and pongs are matched to pending pings by
+// conn as usual before the handlers are called.
+//
+// The handlers are called synchronously from the reading goroutine, one at
+// a time, and the next message is not read until they return. Reading
+// stops at the first error, after calling either OnClose or OnError, so
+// exactly one of them is always the last event. If OnError is nil, errors
+// other than the connection being closed are logged to the connection's
+// logger.
+//
+// Calling the returned function stops reading without closing the
+// connection, like the function returned by OnMessage.
+func Listen(conn *websocket.Conn, h Handlers) (stop func()) {
+	var stopped atomic.Bool
+	onMessage := h.onMessage()
+	go func() {
+		for {
+			msg, err := conn.Read()
+			if stopped.Load() {
+				return
+			}
+			if err != nil {
+				listenError(conn, h, err)
+				return
+			}
+			switch {
+			case msg.IsData() && onMessage != nil:
+				onMessage(conn.Context(), conn, msg)
+			case msg.Type == websocket.MessagePing && h.OnPing != nil:
+				h.OnPing(msg.Data)
+			case msg.Type == websocket.MessagePong && h.OnPong != nil:
+				h.OnPong(msg.Data)
+			}
+		}
+	}()
+	return func() {
+		stopped.Store(true)
+	}
+}
+
+// listenError calls the handler for the error that ended reading.
+func listenError(conn *websocket.Conn, h Handlers, err error) {
+	var ce *websocket.CloseError
+	switch {
+	case errors.As(err, &ce):
+		if h.OnClose != nil {
+			h.OnClose(ce.Code, ce.Reason)
+		}
+	case h.OnError != nil:
+		h.OnError(err)
+	case !errors.Is(err, websocket.ErrConnectionClosed):
+		conn.Logger().Error("an error occured while reading a message", "error", err.Error())
+	}
+}
@@ -0,0 +1,121 @@
+package extended_test
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// recordEvents returns Handlers that send a description of every event to
+// the channel returned.
+func recordEvents() (extended.Handlers, chan string) {
+	events := make(chan string, 8)
+	return extended.Handlers{
+		OnMessage: func(msg *websocket.Message) { events <- "message " + string(msg.Data) },
+		OnPing:    func(payload []byte) { events <- "ping " + string(payload) },
+		OnPong:    func(payload []byte) { events <- "pong " + string(payload) },
+		OnClose:   func(code int, reason string) { events <- fmt.Sprintf("close %d %s", code, reason) },
+		OnError:   func(err error) { events <- "error " + string(err.(websocket.Error).Kind()) },
+	}, events
+}
+
+func expectEvents(t *testing.T, events chan string, expected ...string) {
+	t.Helper()
+	for _, e := range expected {
+		select {
+		case event := <-events:
+			if event != e {
+				t.Fatalf("expected event %q, got %q", e, event)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected event %q", e)
+		}
+	}
+	select {
+	case event := <-events:
+		t.Fatalf("expected no more events, got %q", event)
+	case <-time.After(20 * time.Millisecond):
+	}
+}
+
+func TestListen(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+
+	h, events := recordEvents()
+	extended.Listen(server, h)
+
+	pongs := make(chan *websocket.Message, 1)
+	go func() {
+		for {
+			msg, err := client.Read()
+			if err != nil {
+				return
+			}
+			if msg.Type == websocket.MessagePong {
+				pongs <- msg
+			}
+		}
+	}()
+
+	client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("hello")})
+	client.Write(&websocket.Message{Type: websocket.MessagePing, Data: []byte("p1")})
+	if pong := <-pongs; string(pong.Data) != "p1" {
+		t.Fatalf("expected the ping to be responded to, got %v", pong)
+	}
+	client.Write(&websocket.Message{Type: websocket.MessagePong, Data: []byte("p2")})
+	client.CloseWithCode(websocket.CloseGoingAway, "bye")
+
+	expectEvents(t, events, "message hello", "ping p1", "pong p2", "close 1001 bye")
+}
+
+func TestListen_Error(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+	defer client.Close()
+
+	h, events := recordEvents()
+	extended.Listen(server, h)
+
+	// the server closes the connection with the close code of the error
+	go io.Copy(io.Discard, client.NetConn())
+	client.NetConn().Write([]byte{0x83, 0x00}) // unknown opcode
+	expectEvents(t, events, "error "+string(websocket.MALFORMED_FRAME))
+}
+
+func TestListen_ConnectionLost(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+
+	h, events := recordEvents()
+	extended.Listen(server, h)
+
+	client.NetConn().Close()
+	expectEvents(t, events, fmt.Sprintf("close %d ", websocket.CloseAbnormalClosure))
+}
+
+func TestListen_NilHandlers(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+	defer client.Close()
+
+	closed := make(chan error, 1)
+	extended.Listen(server, extended.Handlers{OnError: func(err error) { closed <- err }})
+	client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("ignored")})
+	client.Write(&websocket.Message{Type: websocket.MessagePong, Data: []byte("ignored")})
+
+	server.Close()
+	select {
+	case err := <-closed:
+		if !errors.Is(err, websocket.ErrConnectionClosed) {
+			t.Fatalf("expected CONNECTION_CLOSED error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected OnError to be called once closed")
+	}
+}
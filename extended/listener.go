@@ -0,0 +1,95 @@
+package extended
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// Listener is a net.Listener whose connections are the WebSocket
+// connections accepted by its ServeHTTP method, wrapped by Conn.Stream, so
+// a server written against net.Listener, such as an SSH or TCP proxy
+// server, can be reached by clients that can only speak WebSocket. Clients
+// connect with DialStream. A Listener is created by NewListener, and every
+// method is safe to call concurrently.
+//
+// The connections behave as described by Conn.Stream. WebSocket has no
+// half-close, so they do not implement CloseWrite: Close ends both
+// directions with CloseNormalClosure, and the peer's Read returns io.EOF.
+type Listener struct {
+	addr  net.Addr
+	opts  []websocket.Option
+	conns chan net.Conn
+
+	closeOnce sync.Once
+	done      chan struct{}
+}
+
+// NewListener returns a Listener that accepts connections with the options
+// specified, if any. addr is returned by Addr, and is usually the address
+// of the HTTP server the Listener is mounted on. It may be nil.
+func NewListener(addr net.Addr, opts ...websocket.Option) *Listener {
+	return &Listener{addr: addr, opts: opts, conns: make(chan net.Conn), done: make(chan struct{})}
+}
+
+// ServeHTTP accepts the WebSocket connection of the request and waits for
+// Accept to return it. A request that is not a WebSocket upgrade is
+// responded to with 400 Bad Request. If the Listener is closed, the
+// connection is closed with CloseGoingAway instead.
+func (l *Listener) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	select {
+	case <-l.done:
+		http.Error(w, "the listener is closed", http.StatusServiceUnavailable)
+		return
+	default:
+	}
+	conn, err := websocket.AcceptHTTP(w, r, l.opts...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	select {
+	case l.conns <- conn.Stream():
+	case <-l.done:
+		conn.CloseWithCode(websocket.CloseGoingAway, "")
+	}
+}
+
+// Accept waits for the next connection accepted by ServeHTTP. It returns
+// net.ErrClosed once the Listener is closed.
+func (l *Listener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conns:
+		return conn, nil
+	case <-l.done:
+		return nil, net.ErrClosed
+	}
+}
+
+// Close stops accepting connections. Connections already returned by
+// Accept are left open.
+func (l *Listener) Close() error {
+	l.closeOnce.Do(func() {
+		close(l.done)
+	})
+	return nil
+}
+
+// Addr returns the address passed to NewListener.
+func (l *Listener) Addr() net.Addr {
+	return l.addr
+}
+
+// DialStream dials the WebSocket server at the URL specified, such as one
+// serving a Listener, and returns the connection wrapped by Conn.Stream.
+// See websocket.Dial for the meaning of ctx and the options.
+func DialStream(ctx context.Context, url string, opts ...websocket.Option) (net.Conn, error) {
+	conn, err := websocket.Dial(ctx, url, opts...)
+	if err != nil {
+		return nil, err
+	}
+	return conn.Stream(), nil
+}
@@ -0,0 +1,144 @@
+package extended_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"errors"
+	"io"
+	"net"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// tcpEcho starts a TCP server echoing everything, and returns its address.
+func tcpEcho(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// tunnel starts a Listener forwarding every connection to the TCP server
+// at target, and returns the ws:// URL of the Listener.
+func tunnel(t *testing.T, target string) (*extended.Listener, string) {
+	t.Helper()
+	ln := extended.NewListener(nil)
+	srv := httptest.NewServer(ln)
+	t.Cleanup(srv.Close)
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				tcp, err := net.Dial("tcp", target)
+				if err != nil {
+					return
+				}
+				defer tcp.Close()
+				go io.Copy(tcp, conn)
+				io.Copy(conn, tcp)
+			}()
+		}
+	}()
+	return ln, "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+func TestListener_TCPEcho(t *testing.T) {
+	_, url := tunnel(t, tcpEcho(t))
+	conn, err := extended.DialStream(context.Background(), url)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+
+	data := make([]byte, 1<<20)
+	rand.Read(data)
+	go func() {
+		for i := 0; i < len(data); i += 4096 {
+			if _, err := conn.Write(data[i : i+4096]); err != nil {
+				return
+			}
+		}
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	got := make([]byte, len(data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		t.Fatalf("reading the echo: %v", err)
+	}
+	if !bytes.Equal(got, data) {
+		t.Fatalf("expected the data to be echoed unchanged")
+	}
+}
+
+func TestListener_Deadline(t *testing.T) {
+	_, url := tunnel(t, tcpEcho(t))
+	conn, err := extended.DialStream(context.Background(), url)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+
+	conn.SetReadDeadline(time.Now().Add(10 * time.Millisecond))
+	_, err = conn.Read(make([]byte, 1))
+	var ne net.Error
+	if !errors.As(err, &ne) || !ne.Timeout() {
+		t.Fatalf("expected a timeout, got %v", err)
+	}
+}
+
+func TestListener_Close(t *testing.T) {
+	ln := extended.NewListener(&net.TCPAddr{IP: net.IPv4(127, 0, 0, 1), Port: 8080})
+	if ln.Addr().String() != "127.0.0.1:8080" {
+		t.Fatalf("expected the address passed to NewListener, got %s", ln.Addr())
+	}
+	srv := httptest.NewServer(ln)
+	defer srv.Close()
+
+	// the peer's Read returns io.EOF once the accepted connection is closed
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, _ := ln.Accept()
+		accepted <- conn
+	}()
+	conn, err := extended.DialStream(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"))
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	(<-accepted).Close()
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected io.EOF, got %v", err)
+	}
+
+	ln.Close()
+	if _, err := ln.Accept(); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected net.ErrClosed, got %v", err)
+	}
+	if _, err := extended.DialStream(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http")); err == nil {
+		t.Fatalf("expected dialing a closed listener to fail")
+	}
+}
@@ -0,0 +1,70 @@
+package extended
+
+import (
+	"context"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// MessageHandler handles a text or binary message read from conn. ctx is
+// the context of the message, which is derived from the context of the
+// connection and carries any values attached by MessageMiddleware.
+type MessageHandler func(ctx context.Context, conn *websocket.Conn, msg *websocket.Message)
+
+// MessageMiddleware wraps a MessageHandler to apply a policy to every
+// inbound message, for example to check authentication, to log messages,
+// or to limit their rate or size. It may:
+//
+//   - call next with a context derived from ctx, to attach values to the
+//     message for the handlers after it;
+//   - not call next, to drop the message;
+//   - close conn, which ends reading once it returns.
+//
+// Unlike Middleware, which wraps the handler of a single route of a
+// Router, MessageMiddleware sees every message, before it is parsed.
+type MessageMiddleware func(next MessageHandler) MessageHandler
+
+// Chain returns h wrapped with mw. The first middleware is the outermost,
+// so it is called first, and h is called last.
+func Chain(h MessageHandler, mw ...MessageMiddleware) MessageHandler {
+	for i := len(mw) - 1; i >= 0; i-- {
+		h = mw[i](h)
+	}
+	return h
+}
+
+// RecoverMessages returns middleware that recovers from a panic in the
+// handlers after it, so that a bug in handling a single message does not
+// crash the program. The panic and its stack trace are logged to the
+// connection's logger, and the connection is closed with 1011 (internal
+// server error), since the state of the handler can't be trusted anymore.
+// It is usually the first middleware.
+func RecoverMessages() MessageMiddleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, conn *websocket.Conn, msg *websocket.Message) {
+			defer func() {
+				if v := recover(); v != nil {
+					conn.Logger().Error("a panic occured while handling a message", "panic", fmt.Sprint(v), "stack", string(debug.Stack()))
+					conn.CloseWithCode(websocket.CloseInternalServerErr, "internal error")
+				}
+			}()
+			next(ctx, conn, msg)
+		}
+	}
+}
+
+// LogMessages returns middleware that logs the type and size of every
+// message, and how long the handlers after it took, to the connection's
+// logger at debug level.
+func LogMessages() MessageMiddleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, conn *websocket.Conn, msg *websocket.Message) {
+			start := time.Now()
+			next(ctx, conn, msg)
+			conn.Logger().DebugContext(ctx, "handled a message", "type", msg.Type.String(), "size", len(msg.Data), "duration", time.Since(start))
+		}
+	}
+}
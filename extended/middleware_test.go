@@ -0,0 +1,188 @@
+package extended_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+type middlewareKey struct{}
+
+// tag returns middleware that records its name in calls and attaches it to
+// the context of the message.
+func tag(name string, mx *sync.Mutex, calls *[]string) extended.MessageMiddleware {
+	return func(next extended.MessageHandler) extended.MessageHandler {
+		return func(ctx context.Context, conn *websocket.Conn, msg *websocket.Message) {
+			mx.Lock()
+			*calls = append(*calls, name)
+			mx.Unlock()
+			tags, _ := ctx.Value(middlewareKey{}).(string)
+			next(context.WithValue(ctx, middlewareKey{}, tags+name), conn, msg)
+		}
+	}
+}
+
+// dropText is middleware that drops messages with the text specified.
+func dropText(text string) extended.MessageMiddleware {
+	return func(next extended.MessageHandler) extended.MessageHandler {
+		return func(ctx context.Context, conn *websocket.Conn, msg *websocket.Message) {
+			if string(msg.Data) != text {
+				next(ctx, conn, msg)
+			}
+		}
+	}
+}
+
+func TestChain(t *testing.T) {
+	var mx sync.Mutex
+	var calls []string
+	var tags string
+	h := extended.Chain(func(ctx context.Context, conn *websocket.Conn, msg *websocket.Message) {
+		tags, _ = ctx.Value(middlewareKey{}).(string)
+	}, tag("a", &mx, &calls), tag("b", &mx, &calls), tag("c", &mx, &calls))
+
+	h(context.Background(), nil, &websocket.Message{Type: websocket.MessageText})
+	if strings.Join(calls, "") != "abc" || tags != "abc" {
+		t.Fatalf("expected the middleware to be called in order, got %v and %q", calls, tags)
+	}
+}
+
+func TestListen_Middleware(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+	defer client.Close()
+
+	var mx sync.Mutex
+	var calls []string
+	received := make(chan string, 4)
+	h := extended.Handlers{
+		OnMessageContext: func(ctx context.Context, msg *websocket.Message) {
+			tags, _ := ctx.Value(middlewareKey{}).(string)
+			received <- tags + " " + string(msg.Data)
+		},
+	}
+	h.Use(tag("a", &mx, &calls), dropText("drop"))
+	h.Use(tag("b", &mx, &calls))
+	extended.Listen(server, h)
+
+	send(t, client, "drop")
+	send(t, client, "hello")
+	select {
+	case got := <-received:
+		if got != "ab hello" {
+			t.Fatalf("expected the message to be handled with the tags of both middleware, got %q", got)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the message to be handled")
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	if strings.Join(calls, ",") != "a,a,b" {
+		t.Fatalf("expected the dropped message to stop after the first middleware, got %v", calls)
+	}
+}
+
+func TestListen_MiddlewareClose(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+
+	h, events := recordEvents()
+	h.Use(func(next extended.MessageHandler) extended.MessageHandler {
+		return func(ctx context.Context, conn *websocket.Conn, msg *websocket.Message) {
+			conn.CloseWithCode(websocket.ClosePolicyViolation, "unauthorized")
+		}
+	})
+	extended.Listen(server, h)
+
+	send(t, client, "hello")
+	_, err := client.Read()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.ClosePolicyViolation {
+		t.Fatalf("expected the middleware to close the connection, got %v", err)
+	}
+	expectEvents(t, events, "error connection is closed")
+}
+
+// logLines is an io.Writer that sends every line written to it to the
+// channel.
+type logLines chan string
+
+func (l logLines) Write(p []byte) (int, error) {
+	l <- string(p)
+	return len(p), nil
+}
+
+func TestRecoverMessages(t *testing.T) {
+	logs := make(logLines, 8)
+	server, client := pipe(websocket.WithLogger(slog.New(slog.NewTextHandler(logs, nil))))
+	defer server.Close()
+	defer client.Close()
+
+	h := extended.Handlers{OnMessage: func(msg *websocket.Message) { panic("boom") }}
+	h.Use(extended.RecoverMessages())
+	extended.Listen(server, h)
+
+	send(t, client, "hello")
+	_, err := client.Read()
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Code != websocket.CloseInternalServerErr {
+		t.Fatalf("expected the connection to be closed with 1011, got %v", err)
+	}
+	if line := <-logs; !strings.Contains(line, "panic=boom") {
+		t.Fatalf("expected the panic to be logged, got %q", line)
+	}
+}
+
+func TestLogMessages(t *testing.T) {
+	logs := make(logLines, 8)
+	logger := slog.New(slog.NewTextHandler(logs, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	server, client := pipe(websocket.WithLogger(logger))
+	defer server.Close()
+	defer client.Close()
+
+	h := extended.Handlers{}
+	h.Use(extended.LogMessages())
+	extended.Listen(server, h)
+
+	send(t, client, "hello")
+	select {
+	case line := <-logs:
+		if !strings.Contains(line, "handled a message") || !strings.Contains(line, "size=5") {
+			t.Fatalf("expected the message to be logged, got %q", line)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the message to be logged")
+	}
+}
+
+func TestRouter_MessageMiddleware(t *testing.T) {
+	r := newEchoRouter()
+	r.Handle("whoami", func(ctx context.Context, conn *websocket.Conn, payload json.RawMessage) error {
+		user, _ := ctx.Value(middlewareKey{}).(string)
+		data, _ := json.Marshal(user)
+		return conn.WriteVia(websocket.JSONCodec{}, extended.Envelope{Type: "whoami", Payload: data})
+	})
+	var mx sync.Mutex
+	var calls []string
+	r.UseMessage(dropText("not json"), tag("alice", &mx, &calls))
+	client := serveRouter(t, r)
+
+	send(t, client, "not json")
+	send(t, client, `{"type":"whoami"}`)
+	if env := receive(t, client); env.Type != "whoami" || string(env.Payload) != `"alice"` {
+		t.Fatalf("expected the handler to see the value attached by the middleware, got %s %s", env.Type, env.Payload)
+	}
+	mx.Lock()
+	defer mx.Unlock()
+	if len(calls) != 1 {
+		t.Fatalf("expected the dropped message not to reach the second middleware, got %v", calls)
+	}
+}
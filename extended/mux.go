@@ -0,0 +1,567 @@
+package extended
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// The mux protocol carries any amount of logical streams over a single
+// WebSocket connection. Every frame of the protocol is a binary message:
+//
+//	+------+-----------+---------+
+//	| type | stream ID | payload |
+//	| 1 B  | 4 B (BE)  | ...     |
+//	+------+-----------+---------+
+//
+// The frame types are:
+//
+//   - open (0) opens the stream with the ID, with an empty payload. The
+//     side that passed isClient to NewMuxSession opens streams with odd IDs
+//     and the other side with even IDs, so IDs never collide.
+//   - data (1) carries the bytes of the payload, which is not empty, on
+//     the stream.
+//   - window (2) gives the receiver of the frame permission to send the
+//     amount of bytes in the 4 byte big endian payload on the stream, on
+//     top of what it was allowed to send already.
+//   - close (3) means the sender closed the stream and will not send
+//     anything else on it, with an empty payload.
+//
+// Each side may send muxWindowSize bytes on a stream before it receives a
+// window frame, and the receiver sends window frames as the bytes it
+// received are read. A frame of an unknown type, a malformed frame, or
+// data beyond the window closes the connection with CloseProtocolError.
+const (
+	muxOpen   byte = 0
+	muxData   byte = 1
+	muxWindow byte = 2
+	muxClose  byte = 3
+)
+
+const (
+	// muxHeaderLength is the length of the type and stream ID of a frame.
+	muxHeaderLength = 5
+	// muxWindowSize is the amount of bytes that may be sent on a stream
+	// before it is read by the receiver.
+	muxWindowSize = 256 << 10
+	// muxMaxData is the maximum length of the payload of a data frame.
+	muxMaxData = 32 << 10
+	// muxAcceptBacklog is the amount of streams opened by the peer that
+	// are kept until they are accepted. Streams opened beyond it are closed.
+	muxAcceptBacklog = 256
+)
+
+// ErrMuxSessionClosed is returned by the streams of a MuxSession once it is
+// closed by Close.
+var ErrMuxSessionClosed = errors.New("the mux session is closed")
+
+// muxFrame is a frame of the mux protocol.
+type muxFrame struct {
+	typ     byte
+	id      uint32
+	payload []byte
+}
+
+// encodeMuxFrame returns the binary message payload of a frame.
+func encodeMuxFrame(typ byte, id uint32, payload []byte) []byte {
+	b := make([]byte, muxHeaderLength, muxHeaderLength+len(payload))
+	b[0] = typ
+	binary.BigEndian.PutUint32(b[1:], id)
+	return append(b, payload...)
+}
+
+// decodeMuxFrame parses the binary message payload of a frame. The payload
+// of the frame it returns is part of data.
+func decodeMuxFrame(data []byte) (muxFrame, error) {
+	if len(data) < muxHeaderLength {
+		return muxFrame{}, fmt.Errorf("mux frame is %d bytes, shorter than its header", len(data))
+	}
+	f := muxFrame{typ: data[0], id: binary.BigEndian.Uint32(data[1:]), payload: data[muxHeaderLength:]}
+	switch {
+	case f.typ > muxClose:
+		return muxFrame{}, fmt.Errorf("unknown mux frame type %d", f.typ)
+	case (f.typ == muxOpen || f.typ == muxClose) && len(f.payload) != 0:
+		return muxFrame{}, fmt.Errorf("mux frame of type %d has a payload", f.typ)
+	case f.typ == muxData && len(f.payload) == 0:
+		return muxFrame{}, errors.New("mux data frame is empty")
+	case f.typ == muxWindow && len(f.payload) != 4:
+		return muxFrame{}, fmt.Errorf("mux window frame payload is %d bytes, not 4", len(f.payload))
+	}
+	return f, nil
+}
+
+// MuxSession multiplexes streams over a WebSocket connection, so a single
+// connection can carry any amount of independent byte streams, each a
+// net.Conn with its own flow control: a stream that is not read from only
+// stops its own sender, never the other streams. The protocol is described
+// by the comment of muxOpen.
+//
+// A MuxSession is created by NewMuxSession on both sides of the
+// connection, and reads from the connection until it ends, so the
+// connection must not be read from directly. Every method is safe to call
+// concurrently.
+type MuxSession struct {
+	conn     *websocket.Conn
+	isClient bool
+
+	mx      sync.Mutex
+	streams map[uint32]*muxStream
+	nextID  uint32
+
+	accept    chan *muxStream
+	closeOnce sync.Once
+	done      chan struct{}
+	err       error // the error that ended the session, set before done is closed
+}
+
+// NewMuxSession starts a MuxSession over conn. Exactly one side of the
+// connection must pass true for isClient, usually the side that dialed it.
+func NewMuxSession(conn *websocket.Conn, isClient bool) *MuxSession {
+	s := &MuxSession{
+		conn:     conn,
+		isClient: isClient,
+		streams:  make(map[uint32]*muxStream),
+		nextID:   2,
+		accept:   make(chan *muxStream, muxAcceptBacklog),
+		done:     make(chan struct{}),
+	}
+	if isClient {
+		s.nextID = 1
+	}
+	go s.run()
+	return s
+}
+
+// OpenStream opens a new stream. The peer gets it from AcceptStream.
+func (s *MuxSession) OpenStream() (net.Conn, error) {
+	s.mx.Lock()
+	select {
+	case <-s.done:
+		s.mx.Unlock()
+		return nil, s.err
+	default:
+	}
+	st := newMuxStream(s, s.nextID)
+	s.streams[st.id] = st
+	s.nextID += 2
+	s.mx.Unlock()
+
+	if err := s.write(muxOpen, st.id, nil); err != nil {
+		return nil, err
+	}
+	return st, nil
+}
+
+// AcceptStream waits for the next stream opened by the peer. It returns an
+// error once the session has ended.
+func (s *MuxSession) AcceptStream() (net.Conn, error) {
+	select {
+	case st := <-s.accept:
+		return st, nil
+	case <-s.done:
+		return nil, s.err
+	}
+}
+
+// NumStreams returns the amount of streams that are open on either side.
+func (s *MuxSession) NumStreams() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return len(s.streams)
+}
+
+// Close closes the connection with CloseNormalClosure, which ends every
+// stream. Reading from a stream returns what was already received, then
+// ErrMuxSessionClosed.
+func (s *MuxSession) Close() error {
+	s.end(ErrMuxSessionClosed)
+	return s.conn.CloseWithCode(websocket.CloseNormalClosure, "")
+}
+
+// Done returns a channel that is closed once the session has ended.
+func (s *MuxSession) Done() <-chan struct{} {
+	return s.done
+}
+
+// Err returns the error that ended the session, such as the error reading
+// from the connection, or nil if it has not ended.
+func (s *MuxSession) Err() error {
+	select {
+	case <-s.done:
+		return s.err
+	default:
+		return nil
+	}
+}
+
+// end ends the session with err, unless it has ended already.
+func (s *MuxSession) end(err error) {
+	s.closeOnce.Do(func() {
+		s.err = err
+		close(s.done)
+	})
+}
+
+// run reads and handles the frames of the session until the connection
+// ends.
+func (s *MuxSession) run() {
+	for {
+		msg, err := s.conn.Read()
+		if err != nil {
+			s.end(err)
+			return
+		}
+		if !msg.IsData() {
+			continue
+		}
+		if msg.Type != websocket.MessageBinary {
+			s.protocolError(errors.New("mux frames must be binary messages"))
+			return
+		}
+		f, ferr := decodeMuxFrame(msg.Data)
+		if ferr == nil {
+			ferr = s.handle(f)
+		}
+		if ferr != nil {
+			s.protocolError(ferr)
+			return
+		}
+	}
+}
+
+// protocolError ends the session with err and closes the connection with
+// CloseProtocolError.
+func (s *MuxSession) protocolError(err error) {
+	s.conn.Logger().Warn("received an invalid mux frame", "error", err.Error())
+	s.end(err)
+	s.conn.CloseWithCode(websocket.CloseProtocolError, "")
+}
+
+// handle handles a frame received from the peer.
+func (s *MuxSession) handle(f muxFrame) error {
+	s.mx.Lock()
+	st, ok := s.streams[f.id]
+	if f.typ == muxOpen {
+		if ok || (f.id%2 == 1) == s.isClient || f.id == 0 {
+			s.mx.Unlock()
+			return fmt.Errorf("mux stream %d cannot be opened by the peer", f.id)
+		}
+		st = newMuxStream(s, f.id)
+		s.streams[f.id] = st
+	}
+	s.mx.Unlock()
+
+	switch {
+	case f.typ == muxOpen:
+		select {
+		case s.accept <- st:
+		default: // the backlog is full
+			s.conn.Logger().Warn("closing a mux stream since too many streams are waiting to be accepted")
+			st.Close()
+		}
+	case !ok:
+		// the stream was closed on both sides, but frames the peer sent
+		// before it knew may still arrive
+	case f.typ == muxData:
+		return st.receive(f.payload)
+	case f.typ == muxWindow:
+		st.grow(binary.BigEndian.Uint32(f.payload))
+	case f.typ == muxClose:
+		st.remoteClose()
+	}
+	return nil
+}
+
+// write writes a frame to the connection.
+func (s *MuxSession) write(typ byte, id uint32, payload []byte) error {
+	msg := &websocket.Message{Type: websocket.MessageBinary, Data: encodeMuxFrame(typ, id, payload)}
+	if err := s.conn.Write(msg); err != nil {
+		return err
+	}
+	return nil
+}
+
+// remove forgets a stream that was closed on both sides.
+func (s *MuxSession) remove(id uint32) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	delete(s.streams, id)
+}
+
+// muxStream is a stream of a MuxSession.
+type muxStream struct {
+	session *MuxSession
+	id      uint32
+
+	mx           sync.Mutex
+	buf          []byte // received and not read yet
+	recvWindow   uint32 // how much the peer may still send
+	unacked      uint32 // read since the last window frame was sent
+	sendWindow   uint32 // how much may still be sent
+	localClosed  bool
+	remoteClosed bool
+
+	readable chan struct{} // signaled when buf grows or the stream is closed
+	writable chan struct{} // signaled when sendWindow grows or the stream is closed
+
+	readDeadline  *muxDeadline
+	writeDeadline *muxDeadline
+}
+
+func newMuxStream(s *MuxSession, id uint32) *muxStream {
+	return &muxStream{
+		session:       s,
+		id:            id,
+		recvWindow:    muxWindowSize,
+		sendWindow:    muxWindowSize,
+		readable:      make(chan struct{}, 1),
+		writable:      make(chan struct{}, 1),
+		readDeadline:  newMuxDeadline(),
+		writeDeadline: newMuxDeadline(),
+	}
+}
+
+// signal wakes up the goroutine waiting on ch, if any.
+func signal(ch chan struct{}) {
+	select {
+	case ch <- struct{}{}:
+	default:
+	}
+}
+
+// Read reads what the peer wrote on the stream. It returns io.EOF once the
+// peer closed the stream and everything it wrote has been read.
+func (st *muxStream) Read(p []byte) (int, error) {
+	for {
+		st.mx.Lock()
+		switch {
+		case st.localClosed:
+			st.mx.Unlock()
+			return 0, net.ErrClosed
+		case len(st.buf) > 0:
+			n := copy(p, st.buf)
+			st.buf = st.buf[n:]
+			st.unacked += uint32(n)
+			var update uint32
+			if st.unacked >= muxWindowSize/2 && !st.remoteClosed {
+				update, st.unacked = st.unacked, 0
+				st.recvWindow += update
+			}
+			st.mx.Unlock()
+			if update > 0 {
+				st.session.write(muxWindow, st.id, binary.BigEndian.AppendUint32(nil, update))
+			}
+			return n, nil
+		case st.remoteClosed:
+			st.mx.Unlock()
+			return 0, io.EOF
+		}
+		st.mx.Unlock()
+
+		select {
+		case <-st.readable:
+		case <-st.readDeadline.wait():
+			return 0, os.ErrDeadlineExceeded
+		case <-st.session.done:
+			st.mx.Lock()
+			buffered := len(st.buf) > 0 || st.remoteClosed
+			st.mx.Unlock()
+			if !buffered {
+				return 0, st.session.err
+			}
+		}
+	}
+}
+
+// Write writes p to the stream, waiting for the peer to read from the
+// stream whenever the window is used up.
+func (st *muxStream) Write(p []byte) (int, error) {
+	written := 0
+	for len(p) > 0 {
+		st.mx.Lock()
+		switch {
+		case st.localClosed:
+			st.mx.Unlock()
+			return written, net.ErrClosed
+		case st.remoteClosed:
+			st.mx.Unlock()
+			return written, io.ErrClosedPipe
+		case st.sendWindow == 0:
+			st.mx.Unlock()
+			select {
+			case <-st.writable:
+			case <-st.writeDeadline.wait():
+				return written, os.ErrDeadlineExceeded
+			case <-st.session.done:
+				return written, st.session.err
+			}
+			continue
+		}
+		n := min(len(p), int(st.sendWindow), muxMaxData)
+		st.sendWindow -= uint32(n)
+		st.mx.Unlock()
+
+		if err := st.session.write(muxData, st.id, p[:n]); err != nil {
+			return written, err
+		}
+		written += n
+		p = p[n:]
+	}
+	return written, nil
+}
+
+// receive adds data received from the peer to the buffer. It returns an
+// error if the peer sent more than the window allows.
+func (st *muxStream) receive(data []byte) error {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	if uint32(len(data)) > st.recvWindow {
+		return fmt.Errorf("mux stream %d received more data than its window allows", st.id)
+	}
+	st.recvWindow -= uint32(len(data))
+	if st.localClosed { // nothing reads it anymore
+		return nil
+	}
+	st.buf = append(st.buf, data...)
+	signal(st.readable)
+	return nil
+}
+
+// grow adds n to the send window.
+func (st *muxStream) grow(n uint32) {
+	st.mx.Lock()
+	defer st.mx.Unlock()
+	st.sendWindow = min(st.sendWindow+n, 1<<31)
+	signal(st.writable)
+}
+
+// remoteClose marks the stream as closed by the peer.
+func (st *muxStream) remoteClose() {
+	st.mx.Lock()
+	st.remoteClosed = true
+	closed := st.localClosed
+	st.mx.Unlock()
+	signal(st.readable)
+	signal(st.writable)
+	if closed {
+		st.session.remove(st.id)
+	}
+}
+
+// Close closes the stream. Reading from it and writing to it return
+// net.ErrClosed, and the peer's reads return io.EOF once it has read what
+// was already written.
+func (st *muxStream) Close() error {
+	st.mx.Lock()
+	if st.localClosed {
+		st.mx.Unlock()
+		return nil
+	}
+	st.localClosed = true
+	st.buf = nil
+	closed := st.remoteClosed
+	st.mx.Unlock()
+	signal(st.readable)
+	signal(st.writable)
+	if closed {
+		st.session.remove(st.id)
+	}
+	return st.session.write(muxClose, st.id, nil)
+}
+
+func (st *muxStream) LocalAddr() net.Addr {
+	if addr := st.session.conn.LocalAddr(); addr != nil {
+		return addr
+	}
+	return muxAddr{}
+}
+
+func (st *muxStream) RemoteAddr() net.Addr {
+	if addr := st.session.conn.RemoteAddr(); addr != nil {
+		return addr
+	}
+	return muxAddr{}
+}
+
+func (st *muxStream) SetDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	st.writeDeadline.set(t)
+	return nil
+}
+
+func (st *muxStream) SetReadDeadline(t time.Time) error {
+	st.readDeadline.set(t)
+	return nil
+}
+
+func (st *muxStream) SetWriteDeadline(t time.Time) error {
+	st.writeDeadline.set(t)
+	return nil
+}
+
+// muxAddr is the address of a stream whose connection is not over a
+// net.Conn.
+type muxAddr struct{}
+
+func (muxAddr) Network() string { return "mux" }
+func (muxAddr) String() string  { return "mux" }
+
+// muxDeadline is a deadline of a stream. The channel returned by wait is
+// closed once the deadline has passed.
+type muxDeadline struct {
+	mx     sync.Mutex
+	timer  *time.Timer
+	cancel chan struct{}
+}
+
+func newMuxDeadline() *muxDeadline {
+	return &muxDeadline{cancel: make(chan struct{})}
+}
+
+// set sets the deadline to t. The zero time means there is no deadline.
+func (d *muxDeadline) set(t time.Time) {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	if d.timer != nil && !d.timer.Stop() {
+		<-d.cancel // the timer fired, wait for it to close cancel
+	}
+	d.timer = nil
+
+	expired := false
+	select {
+	case <-d.cancel:
+		expired = true
+	default:
+	}
+	if t.IsZero() {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		return
+	}
+	if dur := time.Until(t); dur > 0 {
+		if expired {
+			d.cancel = make(chan struct{})
+		}
+		cancel := d.cancel
+		d.timer = time.AfterFunc(dur, func() { close(cancel) })
+		return
+	}
+	if !expired {
+		close(d.cancel)
+	}
+}
+
+// wait returns a channel that is closed once the deadline has passed.
+func (d *muxDeadline) wait() <-chan struct{} {
+	d.mx.Lock()
+	defer d.mx.Unlock()
+	return d.cancel
+}
@@ -0,0 +1,190 @@
+package extended_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"os"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// muxPair returns the two sessions of a pipe.
+func muxPair(t *testing.T) (client, server *extended.MuxSession) {
+	t.Helper()
+	a, b := pipe()
+	client, server = extended.NewMuxSession(a, true), extended.NewMuxSession(b, false)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client, server
+}
+
+// echoStreams accepts streams from s and echoes everything written to them.
+func echoStreams(s *extended.MuxSession) {
+	for {
+		st, err := s.AcceptStream()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer st.Close()
+			io.Copy(st, st)
+		}()
+	}
+}
+
+func TestMux_Echo(t *testing.T) {
+	client, server := muxPair(t)
+	go echoStreams(server)
+
+	var wg sync.WaitGroup
+	errs := make(chan error, 16)
+	for i := range 16 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			st, err := client.OpenStream()
+			if err != nil {
+				errs <- err
+				return
+			}
+			defer st.Close()
+			data := make([]byte, 100000+i*1000)
+			rand.Read(data)
+			go st.Write(data)
+			st.SetReadDeadline(time.Now().Add(5 * time.Second))
+			got := make([]byte, len(data))
+			if _, err := io.ReadFull(st, got); err != nil {
+				errs <- fmt.Errorf("stream %d: %w", i, err)
+				return
+			}
+			if !bytes.Equal(got, data) {
+				errs <- fmt.Errorf("stream %d: the data was not echoed unchanged", i)
+			}
+		}()
+	}
+	wg.Wait()
+	close(errs)
+	for err := range errs {
+		t.Fatal(err)
+	}
+	waitFor(t, time.Second, func() bool { return client.NumStreams() == 0 && server.NumStreams() == 0 })
+}
+
+func TestMux_FlowControl(t *testing.T) {
+	client, server := muxPair(t)
+	go echoStreams(server)
+
+	// a stream whose echo is never read stops once the windows are used up
+	hungry, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	hungry.SetWriteDeadline(time.Now().Add(100 * time.Millisecond))
+	n, err := hungry.Write(make([]byte, 4*extended.MuxWindowSize))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected writing to time out, got %v", err)
+	}
+	if n < extended.MuxWindowSize || n >= 4*extended.MuxWindowSize {
+		t.Fatalf("expected the write to stop after the windows were used up, wrote %d bytes", n)
+	}
+
+	// without holding up the other streams
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	go st.Write([]byte("hello"))
+	st.SetReadDeadline(time.Now().Add(time.Second))
+	got := make([]byte, 5)
+	if _, err := io.ReadFull(st, got); err != nil || string(got) != "hello" {
+		t.Fatalf("expected the other stream to echo, got %q, %v", got, err)
+	}
+
+	// reading the hungry stream lets it continue
+	hungry.SetDeadline(time.Time{})
+	go io.Copy(io.Discard, hungry)
+	if _, err := hungry.Write(make([]byte, extended.MuxWindowSize)); err != nil {
+		t.Fatalf("expected writing to continue once the stream is read, got %v", err)
+	}
+}
+
+func TestMux_Close(t *testing.T) {
+	client, server := muxPair(t)
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		st, _ := server.AcceptStream()
+		accepted <- st
+	}()
+	st, err := client.OpenStream()
+	if err != nil {
+		t.Fatalf("opening: %v", err)
+	}
+	peer := <-accepted
+
+	// what was written before Close is still read
+	st.Write([]byte("bye"))
+	st.Close()
+	if data, err := io.ReadAll(peer); err != nil || string(data) != "bye" {
+		t.Fatalf("expected to read %q then io.EOF, got %q, %v", "bye", data, err)
+	}
+	if _, err := peer.Write([]byte("x")); !errors.Is(err, io.ErrClosedPipe) {
+		t.Fatalf("expected writing to a stream closed by the peer to fail, got %v", err)
+	}
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, net.ErrClosed) {
+		t.Fatalf("expected reading a closed stream to fail, got %v", err)
+	}
+	peer.Close()
+	waitFor(t, time.Second, func() bool { return client.NumStreams() == 0 && server.NumStreams() == 0 })
+
+	// closing the session ends the streams on both sides
+	st, _ = client.OpenStream()
+	peer, _ = server.AcceptStream()
+	client.Close()
+	if _, err := st.Read(make([]byte, 1)); !errors.Is(err, extended.ErrMuxSessionClosed) {
+		t.Fatalf("expected reading to fail once the session is closed, got %v", err)
+	}
+	if _, err := peer.Read(make([]byte, 1)); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected the peer's stream to end with the close of the connection, got %v", err)
+	}
+	if _, err := server.AcceptStream(); err == nil {
+		t.Fatalf("expected accepting on an ended session to fail")
+	}
+}
+
+func TestMux_ProtocolError(t *testing.T) {
+	a, b := pipe()
+	defer a.Close()
+	session := extended.NewMuxSession(b, false)
+	go a.Write(&websocket.Message{Type: websocket.MessageBinary, Data: []byte{9, 0, 0, 0, 1}})
+	if _, err := a.Read(); !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+		t.Fatalf("expected the connection to be closed with CloseProtocolError, got %v", err)
+	}
+	<-session.Done()
+}
+
+func FuzzMuxFrame(f *testing.F) {
+	f.Add(extended.EncodeMuxFrame(0, 1, nil))
+	f.Add(extended.EncodeMuxFrame(1, 2, []byte("hello")))
+	f.Add(extended.EncodeMuxFrame(2, 3, []byte{0, 1, 0, 0}))
+	f.Add(extended.EncodeMuxFrame(3, 4, nil))
+	f.Add([]byte{1, 0, 0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		typ, id, payload, err := extended.DecodeMuxFrame(data)
+		if err != nil {
+			return
+		}
+		if encoded := extended.EncodeMuxFrame(typ, id, payload); !bytes.Equal(encoded, data) {
+			t.Fatalf("expected %x to encode back to itself, got %x", data, encoded)
+		}
+	})
+}
@@ -0,0 +1,108 @@
+package extended
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"sync/atomic"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// PanicError is the error OnMessage reports when its callback panics.
+type PanicError struct {
+	// Value is the value the callback panicked with.
+	Value any
+	// Stack is the stack trace of the goroutine at the time of the panic.
+	Stack []byte
+}
+
+func (e *PanicError) Error() string {
+	return fmt.Sprintf("panic while handling a message: %v", e.Value)
+}
+
+// OnMessage reads from conn in a new goroutine and calls f with every text
+// and binary message received. Control messages are handled by conn as
+// usual and are not passed to f.
+//
+// f is called synchronously from the reading goroutine, one message at a
+// time, so it is never called concurrently and the next message is not
+// read until it returns. A slow f therefore slows down the peer through
+// the backpressure of the connection instead of messages piling up. The
+// ctx passed to f is derived from the context of the connection, so it is
+// done once the connection is closed or reading is stopped, and can be
+// passed to the calls f makes on behalf of the peer.
+//
+// Reading stops at the first error, which is passed to onError. That
+// includes the CONNECTION_CLOSED error returned once the connection is
+// closed, which can be told apart with errors.Is(err,
+// websocket.ErrConnectionClosed). If onError is nil, errors other than
+// the connection being closed are logged to the connection's logger.
+//
+// If f panics, the panic is recovered, the connection is closed with 1011
+// (internal server error), since the state of f can't be trusted anymore,
+// and a *PanicError with the stack trace is passed to onError, or logged
+// if onError is nil. Reading stops, and onError is not called again.
+//
+// Calling the returned function stops reading without closing the
+// connection: f and onError are not called anymore. A Read that is in
+// progress cannot be interrupted, so it still completes, and the message
+// it returns, if any, is dropped. Calling it more than once has no effect.
+func OnMessage(conn *websocket.Conn, f func(ctx context.Context, msg *websocket.Message), onError func(err error)) (stop func()) {
+	ctx, cancel := context.WithCancel(conn.Context())
+	var stopped atomic.Bool
+	go func() {
+		defer cancel()
+		for {
+			msg, err := conn.Read()
+			if stopped.Load() {
+				return
+			}
+			if err != nil {
+				switch {
+				case onError != nil:
+					onError(err)
+				case !errors.Is(err, websocket.ErrConnectionClosed):
+					conn.Logger().Error("an error occured while reading a message", "error", err.Error())
+				}
+				return
+			}
+			if !msg.IsData() {
+				continue
+			}
+			if perr := callRecovered(ctx, f, msg); perr != nil {
+				conn.CloseWithCode(websocket.CloseInternalServerErr, "internal error")
+				if onError != nil {
+					onError(perr)
+				} else {
+					conn.Logger().Error("a panic occured while handling a message", "panic", fmt.Sprint(perr.Value), "stack", string(perr.Stack))
+				}
+				return
+			}
+		}
+	}()
+	return func() {
+		stopped.Store(true)
+		cancel()
+	}
+}
+
+// callRecovered calls f with msg, and returns the panic of f, if any.
+func callRecovered(ctx context.Context, f func(ctx context.Context, msg *websocket.Message), msg *websocket.Message) (perr *PanicError) {
+	defer func() {
+		if v := recover(); v != nil {
+			perr = &PanicError{Value: v, Stack: debug.Stack()}
+		}
+	}()
+	f(ctx, msg)
+	return nil
+}
+
+// OnMessageWithoutContext is OnMessage for a callback that does not take a
+// context, as OnMessage did before.
+//
+// Deprecated: use OnMessage.
+func OnMessageWithoutContext(conn *websocket.Conn, f func(msg *websocket.Message), onError func(err error)) (stop func()) {
+	return OnMessage(conn, func(_ context.Context, msg *websocket.Message) { f(msg) }, onError)
+}
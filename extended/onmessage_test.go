@@ -0,0 +1,210 @@
+package extended_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+func TestOnMessage(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+	defer client.Close()
+
+	received := make(chan *websocket.Message, 4)
+	extended.OnMessageWithoutContext(server, func(msg *websocket.Message) {
+		received <- msg
+	}, nil)
+
+	sent := []*websocket.Message{
+		{Type: websocket.MessageText, Data: []byte("one")},
+		{Type: websocket.MessagePong, Data: []byte("ignored")},
+		{Type: websocket.MessageBinary, Data: []byte("two")},
+	}
+	for _, msg := range sent {
+		if err := client.Write(msg); err != nil {
+			t.Fatalf("expected no error from Write(), got %v", err)
+		}
+	}
+
+	for _, expected := range []*websocket.Message{sent[0], sent[2]} {
+		select {
+		case msg := <-received:
+			if msg.Type != expected.Type || string(msg.Data) != string(expected.Data) {
+				t.Fatalf("expected %v, got %v", expected, msg)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected a message")
+		}
+	}
+}
+
+func TestOnMessage_Error(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+	defer client.Close()
+
+	errs := make(chan error, 1)
+	extended.OnMessage(server, func(ctx context.Context, msg *websocket.Message) {
+		t.Errorf("expected no message, got %v", msg)
+	}, func(err error) {
+		errs <- err
+	})
+
+	// the server closes the connection with the close code of the error
+	go io.Copy(io.Discard, client.NetConn())
+	client.NetConn().Write([]byte{0x83, 0x00}) // unknown opcode
+	select {
+	case err := <-errs:
+		if !errors.Is(err, websocket.ErrMalformedFrame) {
+			t.Fatalf("expected MALFORMED_FRAME error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the error to be passed to onError")
+	}
+}
+
+func TestOnMessage_Closed(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+
+	errs := make(chan error, 1)
+	extended.OnMessage(server, func(ctx context.Context, msg *websocket.Message) {}, func(err error) {
+		errs <- err
+	})
+
+	go client.Read() // the echoed close frame
+	client.CloseWithCode(websocket.CloseGoingAway, "")
+	select {
+	case err := <-errs:
+		if !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Fatalf("expected a close error with code %d, got %v", websocket.CloseGoingAway, err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the close error to be passed to onError")
+	}
+}
+
+func TestOnMessage_Stop(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+	defer client.Close()
+
+	received := make(chan *websocket.Message, 2)
+	errs := make(chan error, 1)
+	stop := extended.OnMessage(server, func(ctx context.Context, msg *websocket.Message) {
+		received <- msg
+	}, func(err error) {
+		errs <- err
+	})
+
+	client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("one")})
+	<-received
+	stop()
+	stop()
+	client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("two")})
+	select {
+	case msg := <-received:
+		t.Fatalf("expected no message after stopping, got %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+	if server.Closed() {
+		t.Fatalf("expected stopping to not close the connection")
+	}
+
+	server.Close()
+	select {
+	case err := <-errs:
+		t.Fatalf("expected onError to not be called after stopping, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestOnMessage_Context(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+	defer client.Close()
+
+	contexts := make(chan context.Context, 2)
+	stop := extended.OnMessage(server, func(ctx context.Context, msg *websocket.Message) {
+		contexts <- ctx
+	}, nil)
+	send(t, client, "one")
+	ctx := <-contexts
+	if ctx.Err() != nil {
+		t.Fatalf("expected the context to be live while the connection is open")
+	}
+	stop()
+	if ctx.Err() == nil {
+		t.Fatalf("expected the context to be done once reading is stopped")
+	}
+
+	// the read in progress when reading was stopped would drop a message
+	server, client = pipe()
+	defer client.Close()
+	extended.OnMessage(server, func(ctx context.Context, msg *websocket.Message) {
+		contexts <- ctx
+	}, nil)
+	send(t, client, "two")
+	ctx = <-contexts
+	server.Close()
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatalf("expected the context to be done once the connection is closed")
+	}
+}
+
+func TestOnMessage_Panic(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+	defer client.Close()
+
+	errs := make(chan error, 2)
+	extended.OnMessage(server, func(ctx context.Context, msg *websocket.Message) {
+		panic("boom")
+	}, func(err error) {
+		errs <- err
+	})
+
+	send(t, client, "hello")
+	_, err := client.Read()
+	if !websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+		t.Fatalf("expected the connection to be closed with 1011, got %v", err)
+	}
+	var perr *extended.PanicError
+	if err := <-errs; !errors.As(err, &perr) || perr.Value != "boom" || !strings.Contains(string(perr.Stack), "TestOnMessage_Panic") {
+		t.Fatalf("expected a PanicError with the stack trace of the handler, got %v", err)
+	}
+	waitFor(t, time.Second, server.Closed)
+	select {
+	case err := <-errs:
+		t.Fatalf("expected onError to be called once, got %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestOnMessage_PanicLogged(t *testing.T) {
+	logs := make(logLines, 8)
+	server, client := pipe(websocket.WithLogger(slog.New(slog.NewTextHandler(logs, nil))))
+	defer server.Close()
+	defer client.Close()
+
+	extended.OnMessage(server, func(ctx context.Context, msg *websocket.Message) {
+		panic("boom")
+	}, nil)
+	send(t, client, "hello")
+	if _, err := client.Read(); !websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+		t.Fatalf("expected the connection to be closed with 1011, got %v", err)
+	}
+	if line := <-logs; !strings.Contains(line, "panic=boom") || !strings.Contains(line, "TestOnMessage_PanicLogged") {
+		t.Fatalf("expected the panic to be logged with its stack trace, got %q", line)
+	}
+}
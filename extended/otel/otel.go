@@ -0,0 +1,247 @@
+// Package otel traces WebSocket connections with OpenTelemetry. It is a
+// separate module so that neither the websocket package nor the extended
+// package depend on go.opentelemetry.io/otel.
+package otel
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strings"
+
+	otelglobal "go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// tracerName is the name of the tracer of the instrumentation.
+const tracerName = "github.com/tiredkangaroo/websocket/extended/otel"
+
+// MessageTracing is how the messages of a traced connection are traced.
+type MessageTracing int
+
+const (
+	// MessagesOff does not trace the messages.
+	MessagesOff MessageTracing = iota
+	// MessageEvents adds an event to the span of the connection for every
+	// message read and written.
+	MessageEvents
+	// MessageSpans starts a child span of the span of the connection for
+	// every message read and written.
+	MessageSpans
+)
+
+// Attributes of the spans and events.
+const (
+	AttributeMessageType = attribute.Key("websocket.message.type")
+	AttributeMessageSize = attribute.Key("websocket.message.size")
+	AttributeCloseCode   = attribute.Key("websocket.close.code")
+	AttributeCloseReason = attribute.Key("websocket.close.reason")
+)
+
+// Options configures a Tracer. The zero value uses the defaults described
+// on each field.
+type Options struct {
+	// TracerProvider provides the tracer the spans are started with.
+	// Defaults to the global provider, otel.GetTracerProvider().
+	TracerProvider trace.TracerProvider
+	// Propagator extracts the trace context from the handshake requests
+	// accepted and injects it into the handshake requests dialed. Defaults
+	// to the global propagator, otel.GetTextMapPropagator().
+	Propagator propagation.TextMapPropagator
+	// Messages is how the messages read and written through a Conn are
+	// traced. Defaults to MessagesOff.
+	Messages MessageTracing
+}
+
+// Tracer accepts and dials WebSocket connections that are traced:
+//
+//   - The handshake has a span of its own, "websocket.accept" or
+//     "websocket.dial", which records the error if it fails.
+//   - The connection has a span that lasts until it is closed,
+//     "websocket.conn", a sibling of the span of the handshake, with the
+//     events "connected" and "closed". The "closed" event has the code and
+//     reason of the close frame the peer sent, if one was received.
+//   - Depending on Options.Messages, the messages read and written through
+//     the Conn returned are events of the span of the connection or child
+//     spans of it, "websocket.read" and "websocket.write", with their type
+//     and size.
+//
+// The spans of an accepted connection are children of the span of the
+// request in its context, such as the span started by an instrumented
+// http.Handler, or else of the trace context propagated in the headers of
+// the request. The spans of a dialed connection are children of the span
+// in the context passed to Dial, and the trace context is propagated to the
+// server in the headers of the handshake request. A Tracer is created by
+// NewTracer, and every method is safe to call concurrently.
+type Tracer struct {
+	tracer     trace.Tracer
+	propagator propagation.TextMapPropagator
+	messages   MessageTracing
+}
+
+// NewTracer returns a Tracer with the options specified.
+func NewTracer(opts Options) *Tracer {
+	if opts.TracerProvider == nil {
+		opts.TracerProvider = otelglobal.GetTracerProvider()
+	}
+	if opts.Propagator == nil {
+		opts.Propagator = otelglobal.GetTextMapPropagator()
+	}
+	return &Tracer{
+		tracer:     opts.TracerProvider.Tracer(tracerName),
+		propagator: opts.Propagator,
+		messages:   opts.Messages,
+	}
+}
+
+// Accept accepts the WebSocket request like websocket.AcceptHTTP, and
+// returns the connection traced.
+func (t *Tracer) Accept(w http.ResponseWriter, r *http.Request, opts ...websocket.Option) (*Conn, error) {
+	ctx := r.Context()
+	if !trace.SpanContextFromContext(ctx).IsValid() {
+		ctx = t.propagator.Extract(ctx, propagation.HeaderCarrier(r.Header))
+	}
+	_, span := t.tracer.Start(ctx, "websocket.accept", trace.WithSpanKind(trace.SpanKindServer))
+	conn, err := websocket.AcceptHTTP(w, r, opts...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return nil, err
+	}
+	span.End()
+	return t.trace(ctx, conn), nil
+}
+
+// Dial dials the WebSocket server like websocket.DialWithOptions, with the
+// trace context of ctx in the headers of the handshake request, and
+// returns the connection traced.
+func (t *Tracer) Dial(ctx context.Context, rawURL string, dopts websocket.DialOptions, opts ...websocket.Option) (*Conn, *http.Response, error) {
+	parent := ctx
+	ctx, span := t.tracer.Start(ctx, "websocket.dial", trace.WithSpanKind(trace.SpanKindClient))
+	header := make(http.Header, len(dopts.Header)+1)
+	for k, v := range dopts.Header {
+		header[k] = v
+	}
+	t.propagator.Inject(ctx, propagation.HeaderCarrier(header))
+	dopts.Header = header
+	conn, resp, err := websocket.DialWithOptions(ctx, rawURL, dopts, opts...)
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		span.End()
+		return nil, resp, err
+	}
+	span.End()
+	return t.trace(parent, conn), resp, nil
+}
+
+// trace starts the span of conn as a child of the span of ctx, ending it
+// once conn is closed.
+func (t *Tracer) trace(ctx context.Context, conn *websocket.Conn) *Conn {
+	ctx, span := t.tracer.Start(ctx, "websocket.conn")
+	span.AddEvent("connected")
+	context.AfterFunc(conn.Context(), func() {
+		var ce *websocket.CloseError
+		switch err := conn.Err(); {
+		case errors.As(err, &ce):
+			span.AddEvent("closed", trace.WithAttributes(AttributeCloseCode.Int(ce.Code), AttributeCloseReason.String(ce.Reason)))
+		case err == nil || errors.Is(err, websocket.ErrConnectionClosed):
+			span.AddEvent("closed")
+		default:
+			span.AddEvent("closed")
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		span.End()
+	})
+	return &Conn{Conn: conn, tracer: t, ctx: ctx, span: span}
+}
+
+// Conn is a traced connection. Its Read, Write, and WriteText methods trace
+// the messages as configured by Options.Messages; the messages read and
+// written through the embedded *websocket.Conn directly are not traced.
+type Conn struct {
+	*websocket.Conn
+	tracer *Tracer
+	ctx    context.Context // the context of the span
+	span   trace.Span
+}
+
+// SpanContext returns the context of the span of the connection, so that
+// the spans of the work done for its messages can be its children.
+func (c *Conn) SpanContext() context.Context {
+	return c.ctx
+}
+
+// Read reads a message like websocket.Conn.Read, and traces it.
+func (c *Conn) Read() (*websocket.Message, websocket.Error) {
+	if c.tracer.messages != MessageSpans {
+		msg, err := c.Conn.Read()
+		if err == nil && c.tracer.messages == MessageEvents {
+			c.span.AddEvent("message.read", trace.WithAttributes(messageAttributes(msg.Type, len(msg.Data))...))
+		}
+		return msg, err
+	}
+	_, span := c.tracer.tracer.Start(c.ctx, "websocket.read", trace.WithSpanKind(trace.SpanKindConsumer))
+	defer span.End()
+	msg, err := c.Conn.Read()
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+		return nil, err
+	}
+	span.SetAttributes(messageAttributes(msg.Type, len(msg.Data))...)
+	return msg, nil
+}
+
+// Write writes a message like websocket.Conn.Write, and traces it.
+func (c *Conn) Write(msg *websocket.Message) websocket.Error {
+	return c.traceWrite(msg.Type, len(msg.Data), func() websocket.Error {
+		return c.Conn.Write(msg)
+	})
+}
+
+// WriteText writes a text message like websocket.Conn.WriteText, and
+// traces it.
+func (c *Conn) WriteText(s string) websocket.Error {
+	return c.traceWrite(websocket.MessageText, len(s), func() websocket.Error {
+		return c.Conn.WriteText(s)
+	})
+}
+
+// traceWrite traces a message of the type and size specified written by
+// write.
+func (c *Conn) traceWrite(messageType websocket.MessageType, size int, write func() websocket.Error) websocket.Error {
+	switch c.tracer.messages {
+	case MessageEvents:
+		err := write()
+		if err == nil {
+			c.span.AddEvent("message.written", trace.WithAttributes(messageAttributes(messageType, size)...))
+		}
+		return err
+	case MessageSpans:
+		_, span := c.tracer.tracer.Start(c.ctx, "websocket.write", trace.WithSpanKind(trace.SpanKindProducer), trace.WithAttributes(messageAttributes(messageType, size)...))
+		defer span.End()
+		err := write()
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+		return err
+	default:
+		return write()
+	}
+}
+
+// messageAttributes returns the attributes of a message of the type and
+// size specified. The type is "text", "binary", "close", "ping", or "pong".
+func messageAttributes(messageType websocket.MessageType, size int) []attribute.KeyValue {
+	name := strings.ToLower(strings.TrimPrefix(messageType.String(), "Message"))
+	return []attribute.KeyValue{AttributeMessageType.String(name), AttributeMessageSize.Int(size)}
+}
@@ -0,0 +1,229 @@
+package otel_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/sdk/trace/tracetest"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/tiredkangaroo/websocket"
+	wsotel "github.com/tiredkangaroo/websocket/extended/otel"
+)
+
+// echoServer starts a server accepting connections with tracer and echoing
+// every data message, and returns its ws:// URL. If provider is not nil,
+// every request has a span "http.request" started with it, like an
+// instrumented http.Handler.
+func echoServer(t *testing.T, tracer *wsotel.Tracer, provider trace.TracerProvider) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if provider != nil {
+			ctx, span := provider.Tracer("http").Start(r.Context(), "http.request")
+			defer span.End()
+			r = r.WithContext(ctx)
+		}
+		conn, err := tracer.Accept(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := conn.Read()
+			if err != nil {
+				return
+			}
+			if msg.IsData() {
+				conn.Write(msg)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+// echo writes a message to conn, reads it back, and closes conn with a
+// closing handshake.
+func echo(t *testing.T, conn interface {
+	Write(*websocket.Message) websocket.Error
+	Read() (*websocket.Message, websocket.Error)
+	WriteClose(code int, reason string) error
+}) {
+	t.Helper()
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("hello")}); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	if msg, err := conn.Read(); err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("expected the message to be echoed, got %v and %v", msg, err)
+	}
+	if err := conn.WriteClose(websocket.CloseNormalClosure, "bye"); err != nil {
+		t.Fatalf("writing the close frame: %v", err)
+	}
+	if _, err := conn.Read(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected the server to close the connection, got %v", err)
+	}
+}
+
+// waitForSpans returns the spans exported once there are n of them.
+func waitForSpans(t *testing.T, exporter *tracetest.InMemoryExporter, n int) map[string][]tracetest.SpanStub {
+	t.Helper()
+	deadline := time.Now().Add(time.Second)
+	for len(exporter.GetSpans()) < n {
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %d spans, got %d", n, len(exporter.GetSpans()))
+		}
+		time.Sleep(time.Millisecond)
+	}
+	spans := make(map[string][]tracetest.SpanStub)
+	for _, span := range exporter.GetSpans() {
+		spans[span.Name] = append(spans[span.Name], span)
+	}
+	return spans
+}
+
+func attributes(kvs []attribute.KeyValue) map[attribute.Key]attribute.Value {
+	m := make(map[attribute.Key]attribute.Value)
+	for _, kv := range kvs {
+		m[kv.Key] = kv.Value
+	}
+	return m
+}
+
+func eventNames(span tracetest.SpanStub) []string {
+	var names []string
+	for _, event := range span.Events {
+		names = append(names, event.Name)
+	}
+	return names
+}
+
+func TestTracer_Accept(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	tracer := wsotel.NewTracer(wsotel.Options{TracerProvider: provider, Messages: wsotel.MessageSpans})
+	url := echoServer(t, tracer, provider)
+
+	conn, err := websocket.Dial(context.Background(), url)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	echo(t, conn)
+
+	// http.request, websocket.accept, websocket.conn, a websocket.read for
+	// "hello" and for the close frame, and a websocket.write for "hello"
+	spans := waitForSpans(t, exporter, 6)
+	request := spans["http.request"][0].SpanContext
+	accept := spans["websocket.accept"][0]
+	if accept.Parent.SpanID() != request.SpanID() || accept.SpanKind != trace.SpanKindServer {
+		t.Fatalf("expected websocket.accept to be a server span child of http.request, got %+v", accept)
+	}
+	connSpan := spans["websocket.conn"][0]
+	if connSpan.Parent.SpanID() != request.SpanID() {
+		t.Fatalf("expected websocket.conn to be a child of http.request")
+	}
+	if events := eventNames(connSpan); !slices.Equal(events, []string{"connected", "closed"}) {
+		t.Fatalf("expected the events of websocket.conn to be connected and closed, got %v", events)
+	}
+	closed := attributes(connSpan.Events[1].Attributes)
+	if closed[wsotel.AttributeCloseCode].AsInt64() != websocket.CloseNormalClosure || closed[wsotel.AttributeCloseReason].AsString() != "bye" {
+		t.Fatalf("expected the closed event to have the code and reason of the peer, got %v", connSpan.Events[1].Attributes)
+	}
+
+	reads, writes := spans["websocket.read"], spans["websocket.write"]
+	if len(reads) != 2 || len(writes) != 1 {
+		t.Fatalf("expected 2 websocket.read spans and 1 websocket.write span, got %d and %d", len(reads), len(writes))
+	}
+	for _, span := range append(reads, writes...) {
+		if span.Parent.SpanID() != connSpan.SpanContext.SpanID() {
+			t.Fatalf("expected %s to be a child of websocket.conn", span.Name)
+		}
+	}
+	for _, span := range []tracetest.SpanStub{reads[0], writes[0]} {
+		attrs := attributes(span.Attributes)
+		if attrs[wsotel.AttributeMessageType].AsString() != "text" || attrs[wsotel.AttributeMessageSize].AsInt64() != 5 {
+			t.Fatalf("expected %s to have the type and size of the message, got %v", span.Name, span.Attributes)
+		}
+	}
+	if reads[1].Status.Code != codes.Error {
+		t.Fatalf("expected the read of the close frame to record the error, got %v", reads[1].Status)
+	}
+}
+
+func TestTracer_Dial(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	propagator := propagation.TraceContext{}
+	server := wsotel.NewTracer(wsotel.Options{TracerProvider: provider, Propagator: propagator})
+	client := wsotel.NewTracer(wsotel.Options{TracerProvider: provider, Propagator: propagator, Messages: wsotel.MessageEvents})
+	url := echoServer(t, server, nil)
+
+	ctx, parent := provider.Tracer("test").Start(context.Background(), "test")
+	conn, resp, err := client.Dial(ctx, url, websocket.DialOptions{Header: http.Header{"X-Test": {"1"}}})
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the handshake response to be returned, got %d", resp.StatusCode)
+	}
+	echo(t, conn)
+	conn.Close()
+	parent.End()
+
+	// test, websocket.dial and websocket.conn of the client, and
+	// websocket.accept and websocket.conn of the server
+	spans := waitForSpans(t, exporter, 5)
+	dial := spans["websocket.dial"][0]
+	if dial.Parent.SpanID() != parent.SpanContext().SpanID() || dial.SpanKind != trace.SpanKindClient {
+		t.Fatalf("expected websocket.dial to be a client span child of the span of the context")
+	}
+	// the trace context is propagated to the server in the headers
+	accept := spans["websocket.accept"][0]
+	if accept.Parent.SpanID() != dial.SpanContext.SpanID() || !accept.Parent.IsRemote() {
+		t.Fatalf("expected websocket.accept to be a child of websocket.dial, got parent %v", accept.Parent)
+	}
+
+	var clientConn tracetest.SpanStub
+	for _, span := range spans["websocket.conn"] {
+		if span.Parent.SpanID() == parent.SpanContext().SpanID() {
+			clientConn = span
+		}
+	}
+	expected := []string{"connected", "message.written", "message.read", "closed"}
+	if events := eventNames(clientConn); !slices.Equal(events, expected) {
+		t.Fatalf("expected the events of the websocket.conn of the client to be %v, got %v", expected, events)
+	}
+	if attrs := attributes(clientConn.Events[1].Attributes); attrs[wsotel.AttributeMessageSize].AsInt64() != 5 {
+		t.Fatalf("expected the event of the message to have its size, got %v", clientConn.Events[1].Attributes)
+	}
+}
+
+func TestTracer_Rejected(t *testing.T) {
+	exporter := tracetest.NewInMemoryExporter()
+	provider := sdktrace.NewTracerProvider(sdktrace.WithSyncer(exporter))
+	url := echoServer(t, wsotel.NewTracer(wsotel.Options{TracerProvider: provider}), nil)
+
+	resp, err := http.Get("http" + strings.TrimPrefix(url, "ws"))
+	if err != nil {
+		t.Fatalf("requesting: %v", err)
+	}
+	resp.Body.Close()
+	spans := waitForSpans(t, exporter, 1)
+	if accept := spans["websocket.accept"]; len(accept) != 1 || accept[0].Status.Code != codes.Error {
+		t.Fatalf("expected websocket.accept to record the error, got %v", accept)
+	}
+	if len(spans["websocket.conn"]) != 0 {
+		t.Fatalf("expected no connection span for a rejected request")
+	}
+}
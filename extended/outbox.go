@@ -0,0 +1,436 @@
+package extended
+
+import (
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// OutboxStore persists the messages waiting to be delivered to the clients
+// identified by a key, such as the tokens of sessions, so that they survive
+// restarts of the process. The messages of a key are numbered by their
+// sequence, which increases with every message appended for the key. Every
+// method must be safe to call concurrently.
+type OutboxStore interface {
+	// Append stores msg for key. Its sequence must be greater than the
+	// sequence of every message appended for key before.
+	Append(key string, msg OutboxMessage) error
+	// ReadFrom returns the messages stored for key with a sequence greater
+	// than or equal to seq, in the order of their sequence.
+	ReadFrom(key string, seq uint64) ([]OutboxMessage, error)
+	// Trim drops the messages stored for key with a sequence less than or
+	// equal to seq, such as the messages the client acknowledged.
+	Trim(key string, seq uint64) error
+}
+
+// OutboxMessage is a message stored in an OutboxStore.
+type OutboxMessage struct {
+	Seq     uint64
+	Message *websocket.Message
+}
+
+// A FileOutboxStore keeps the messages of every key in a file of its own,
+// named after the SHA-256 of the key, made of records appended one after
+// another:
+//
+//	+----------+----------+------+----------+-----------+------+
+//	|  length  |  CRC-32  | kind | sequence | unix nano | data |
+//	| 4 B (BE) | 4 B (BE) | 1 B  | 8 B (BE) | 8 B (BE)  | ...  |
+//	+----------+----------+------+----------+-----------+------+
+//
+// where the length and the CRC-32 (IEEE) are of everything after them. The
+// kind is 1 and 2 for text and binary messages, and 0 for a trim record,
+// whose sequence is the sequence the messages were trimmed up to and whose
+// data is empty. A file is rewritten without the records that were trimmed
+// once they take more space than the others.
+const (
+	outboxFileHeaderLength = 8
+	outboxRecordLength     = outboxFileHeaderLength + 17
+	outboxTrim             = 0
+	outboxText             = 1
+	outboxBinary           = 2
+	// outboxCompactThreshold is the amount of bytes of trimmed records
+	// below which a file is never rewritten.
+	outboxCompactThreshold = 64 << 10
+)
+
+// errOutboxOrder is returned by FileOutboxStore.Append for a message that
+// is not after the messages already stored.
+var errOutboxOrder = errors.New("outbox messages must be appended in the order of their sequence")
+
+// FileOutboxOptions configures a FileOutboxStore. The zero value uses the
+// defaults described on each field.
+type FileOutboxOptions struct {
+	// MaxBytes is the maximum size of the data of the messages stored for
+	// a key. Once it is exceeded, the oldest messages are dropped. Defaults
+	// to 64 MiB.
+	MaxBytes int64
+	// MaxAge is how long a message is stored before it is dropped.
+	// Defaults to 24 hours.
+	MaxAge time.Duration
+	// Sync makes Append and Trim flush the file to the disk before
+	// returning, so that the messages also survive a crash of the machine,
+	// not only of the process, at the cost of much slower writes.
+	Sync bool
+
+	clock clock.Clock
+}
+
+// FileOutboxStore is an OutboxStore keeping the messages of every key in
+// an append-only file in a directory. Messages are dropped once they are
+// older than MaxAge, or to keep the messages of a key under MaxBytes.
+//
+// If the process crashed in the middle of a write, the last record of a
+// file may be incomplete or corrupted; the file is truncated before it
+// once the key is next used, losing only that message. The files are only
+// open while they are used, so the amount of keys is not limited by the
+// amount of files the process may open. A FileOutboxStore is created by
+// NewFileOutboxStore, and every method is safe to call concurrently.
+type FileOutboxStore struct {
+	dir  string
+	opts FileOutboxOptions
+
+	mx    sync.Mutex
+	files map[string]*outboxFile
+}
+
+// outboxFile is the index of the file of a key, loaded the first time the
+// key is used.
+type outboxFile struct {
+	path string
+
+	mx      sync.Mutex
+	loaded  bool
+	records []outboxRecord // the messages that were not dropped, in order
+	last    uint64         // the sequence of the last message appended
+	size    int64          // the size of the file
+	live    int64          // the size of the records in records
+	data    int64          // the size of the data of the records in records
+}
+
+// outboxRecord is the index of a record of a message.
+type outboxRecord struct {
+	seq    uint64
+	time   time.Time
+	offset int64
+	length int64 // of the whole record
+}
+
+// NewFileOutboxStore returns a FileOutboxStore keeping its files in dir,
+// creating dir if it does not exist. The files left over from a previous
+// process are used as they are, except that the files of the keys whose
+// messages are all older than MaxAge are removed.
+func NewFileOutboxStore(dir string, opts FileOutboxOptions) (*FileOutboxStore, error) {
+	if opts.MaxBytes <= 0 {
+		opts.MaxBytes = 64 << 20
+	}
+	if opts.MaxAge <= 0 {
+		opts.MaxAge = 24 * time.Hour
+	}
+	if opts.clock == nil {
+		opts.clock = clock.Real{}
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return nil, err
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+	// a file that was last written before MaxAge only has expired messages
+	cutoff := opts.clock.Now().Add(-opts.MaxAge)
+	for _, entry := range entries {
+		if filepath.Ext(entry.Name()) != ".outbox" {
+			continue
+		}
+		if info, err := entry.Info(); err == nil && info.ModTime().Before(cutoff) {
+			os.Remove(filepath.Join(dir, entry.Name()))
+		}
+	}
+	return &FileOutboxStore{dir: dir, opts: opts, files: make(map[string]*outboxFile)}, nil
+}
+
+// file returns the file of key, locked and loaded.
+func (s *FileOutboxStore) file(key string) (*outboxFile, error) {
+	s.mx.Lock()
+	f, ok := s.files[key]
+	if !ok {
+		sum := sha256.Sum256([]byte(key))
+		f = &outboxFile{path: filepath.Join(s.dir, hex.EncodeToString(sum[:])+".outbox")}
+		s.files[key] = f
+	}
+	s.mx.Unlock()
+
+	f.mx.Lock()
+	if !f.loaded {
+		if err := f.load(); err != nil {
+			f.mx.Unlock()
+			return nil, err
+		}
+		f.loaded = true
+	}
+	return f, nil
+}
+
+// Append stores msg for key, dropping the oldest messages of key if they
+// are over MaxBytes or older than MaxAge.
+func (s *FileOutboxStore) Append(key string, msg OutboxMessage) error {
+	kind := byte(outboxText)
+	switch msg.Message.Type {
+	case websocket.MessageText:
+	case websocket.MessageBinary:
+		kind = outboxBinary
+	default:
+		return fmt.Errorf("cannot store messages of type %s in an outbox", msg.Message.Type)
+	}
+	f, err := s.file(key)
+	if err != nil {
+		return err
+	}
+	defer f.mx.Unlock()
+	if msg.Seq <= f.last {
+		return errOutboxOrder
+	}
+
+	now := s.opts.clock.Now()
+	record := encodeOutboxRecord(kind, msg.Seq, now, msg.Message.Data)
+	if err := f.write(record, s.opts.Sync); err != nil {
+		return err
+	}
+	f.records = append(f.records, outboxRecord{seq: msg.Seq, time: now, offset: f.size, length: int64(len(record))})
+	f.last = msg.Seq
+	f.size += int64(len(record))
+	f.live += int64(len(record))
+	f.data += int64(len(msg.Message.Data))
+	f.expire(now, s.opts)
+	return f.compact(s.opts.Sync)
+}
+
+// ReadFrom returns the messages stored for key with a sequence greater
+// than or equal to seq that are not older than MaxAge.
+func (s *FileOutboxStore) ReadFrom(key string, seq uint64) ([]OutboxMessage, error) {
+	f, err := s.file(key)
+	if err != nil {
+		return nil, err
+	}
+	defer f.mx.Unlock()
+	f.expire(s.opts.clock.Now(), s.opts)
+	if err := f.compact(s.opts.Sync); err != nil {
+		return nil, err
+	}
+
+	i := 0
+	for i < len(f.records) && f.records[i].seq < seq {
+		i++
+	}
+	if i == len(f.records) {
+		return nil, nil
+	}
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return nil, err
+	}
+	msgs := make([]OutboxMessage, 0, len(f.records)-i)
+	for _, r := range f.records[i:] {
+		kind, seq, _, data, ok := decodeOutboxRecord(b[r.offset : r.offset+r.length])
+		if !ok {
+			return nil, fmt.Errorf("the outbox file of %q was modified while it was used", key)
+		}
+		msgType := websocket.MessageText
+		if kind == outboxBinary {
+			msgType = websocket.MessageBinary
+		}
+		msgs = append(msgs, OutboxMessage{Seq: seq, Message: &websocket.Message{Type: msgType, Data: data}})
+	}
+	return msgs, nil
+}
+
+// Trim drops the messages stored for key with a sequence less than or
+// equal to seq. The file of key is removed once it has no messages.
+func (s *FileOutboxStore) Trim(key string, seq uint64) error {
+	f, err := s.file(key)
+	if err != nil {
+		return err
+	}
+	defer f.mx.Unlock()
+	if len(f.records) == 0 || f.records[0].seq > seq {
+		return nil
+	}
+	record := encodeOutboxRecord(outboxTrim, seq, s.opts.clock.Now(), nil)
+	if err := f.write(record, s.opts.Sync); err != nil {
+		return err
+	}
+	f.size += int64(len(record))
+	f.drop(func(r outboxRecord) bool { return r.seq <= seq })
+	return f.compact(s.opts.Sync)
+}
+
+// encodeOutboxRecord returns a record.
+func encodeOutboxRecord(kind byte, seq uint64, t time.Time, data []byte) []byte {
+	b := make([]byte, outboxRecordLength, outboxRecordLength+len(data))
+	b[outboxFileHeaderLength] = kind
+	binary.BigEndian.PutUint64(b[outboxFileHeaderLength+1:], seq)
+	binary.BigEndian.PutUint64(b[outboxFileHeaderLength+9:], uint64(t.UnixNano()))
+	b = append(b, data...)
+	binary.BigEndian.PutUint32(b, uint32(len(b)-outboxFileHeaderLength))
+	binary.BigEndian.PutUint32(b[4:], crc32.ChecksumIEEE(b[outboxFileHeaderLength:]))
+	return b
+}
+
+// decodeOutboxRecord parses the record at the start of b, and reports
+// whether it is complete and intact.
+func decodeOutboxRecord(b []byte) (kind byte, seq uint64, t time.Time, data []byte, ok bool) {
+	if len(b) < outboxRecordLength {
+		return 0, 0, time.Time{}, nil, false
+	}
+	length := int64(binary.BigEndian.Uint32(b))
+	if length < outboxRecordLength-outboxFileHeaderLength || int64(len(b)-outboxFileHeaderLength) < length {
+		return 0, 0, time.Time{}, nil, false
+	}
+	body := b[outboxFileHeaderLength : outboxFileHeaderLength+length]
+	if crc32.ChecksumIEEE(body) != binary.BigEndian.Uint32(b[4:]) || body[0] > outboxBinary {
+		return 0, 0, time.Time{}, nil, false
+	}
+	t = time.Unix(0, int64(binary.BigEndian.Uint64(body[9:])))
+	return body[0], binary.BigEndian.Uint64(body[1:]), t, body[17:], true
+}
+
+// load reads the index of the file, truncating the file before the first
+// record that is incomplete or corrupted, which is left by a crash in the
+// middle of a write. The mutex must be held.
+func (f *outboxFile) load() error {
+	f.records, f.last, f.size, f.live, f.data = nil, 0, 0, 0, 0
+	b, err := os.ReadFile(f.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	var offset int64
+	for offset < int64(len(b)) {
+		kind, seq, t, data, ok := decodeOutboxRecord(b[offset:])
+		if !ok {
+			if err := os.Truncate(f.path, offset); err != nil {
+				return err
+			}
+			break
+		}
+		length := outboxRecordLength + int64(len(data))
+		if kind == outboxTrim {
+			f.drop(func(r outboxRecord) bool { return r.seq <= seq })
+		} else {
+			f.records = append(f.records, outboxRecord{seq: seq, time: t, offset: offset, length: length})
+			f.live += length
+			f.data += int64(len(data))
+		}
+		f.last = max(f.last, seq)
+		offset += length
+	}
+	f.size = offset
+	return nil
+}
+
+// write appends record to the file, truncating it back if the write fails
+// part of the way. The mutex must be held.
+func (f *outboxFile) write(record []byte, sync bool) error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE, 0o600)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+	if _, err := file.WriteAt(record, f.size); err != nil {
+		file.Truncate(f.size)
+		return err
+	}
+	if sync {
+		return file.Sync()
+	}
+	return nil
+}
+
+// drop drops the records at the start of the index matching drop. The
+// mutex must be held.
+func (f *outboxFile) drop(drop func(r outboxRecord) bool) {
+	i := 0
+	for i < len(f.records) && drop(f.records[i]) {
+		f.live -= f.records[i].length
+		f.data -= f.records[i].length - outboxRecordLength
+		i++
+	}
+	f.records = f.records[i:]
+}
+
+// expire drops the records older than MaxAge, and the oldest records until
+// the data of the others is at most MaxBytes. Since these records are
+// dropped again when the file is loaded, no trim record is written for
+// them. The mutex must be held.
+func (f *outboxFile) expire(now time.Time, opts FileOutboxOptions) {
+	cutoff := now.Add(-opts.MaxAge)
+	f.drop(func(r outboxRecord) bool {
+		return r.time.Before(cutoff) || f.data > opts.MaxBytes
+	})
+}
+
+// compact removes the file once it has no records, or rewrites it without
+// the records that were dropped once they take more space than the others.
+// The rewritten file starts with a trim record, so that the sequence of
+// the last message appended is not forgotten. The mutex must be held.
+func (f *outboxFile) compact(sync bool) error {
+	if len(f.records) == 0 {
+		if f.size == 0 {
+			return nil
+		}
+		if err := os.Remove(f.path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		f.size = 0
+		return nil
+	}
+	dead := f.size - f.live
+	if dead < outboxCompactThreshold || dead < f.live {
+		return nil
+	}
+
+	b, err := os.ReadFile(f.path)
+	if err != nil {
+		return err
+	}
+	compacted := encodeOutboxRecord(outboxTrim, f.records[0].seq-1, time.Now(), nil)
+	for i, r := range f.records {
+		f.records[i].offset = int64(len(compacted))
+		compacted = append(compacted, b[r.offset:r.offset+r.length]...)
+	}
+	tmp := f.path + ".tmp"
+	file, err := os.OpenFile(tmp, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0o600)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(compacted)
+	if err == nil && sync {
+		err = file.Sync()
+	}
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err == nil {
+		err = os.Rename(tmp, f.path)
+	}
+	if err != nil {
+		os.Remove(tmp)
+		f.loaded = false // the index must be loaded again from the old file
+		return err
+	}
+	f.size = int64(len(compacted))
+	return nil
+}
@@ -0,0 +1,182 @@
+package extended_test
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+func newFileOutboxStore(t *testing.T, dir string, opts extended.FileOutboxOptions) *extended.FileOutboxStore {
+	t.Helper()
+	store, err := extended.NewFileOutboxStore(dir, opts)
+	if err != nil {
+		t.Fatalf("opening the store: %v", err)
+	}
+	return store
+}
+
+func appendOutbox(t *testing.T, store extended.OutboxStore, key string, from, to int) {
+	t.Helper()
+	for i := from; i <= to; i++ {
+		if err := store.Append(key, extended.OutboxMessage{Seq: uint64(i), Message: sessionMessage(i)}); err != nil {
+			t.Fatalf("appending message %d: %v", i, err)
+		}
+	}
+}
+
+// expectOutbox fails the test unless the messages of key from seq are the
+// messages with the numbers from first to last.
+func expectOutbox(t *testing.T, store extended.OutboxStore, key string, seq uint64, first, last int) {
+	t.Helper()
+	msgs, err := store.ReadFrom(key, seq)
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	var got, expected []string
+	for _, msg := range msgs {
+		got = append(got, fmt.Sprint(msg.Seq, ": ", string(msg.Message.Data)))
+	}
+	for i := first; i <= last; i++ {
+		expected = append(expected, fmt.Sprint(i, ": message ", i))
+	}
+	if strings.Join(got, ", ") != strings.Join(expected, ", ") {
+		t.Fatalf("expected [%s], got [%s]", strings.Join(expected, ", "), strings.Join(got, ", "))
+	}
+}
+
+// outboxFiles returns the files of the store in dir.
+func outboxFiles(t *testing.T, dir string) []string {
+	t.Helper()
+	files, err := filepath.Glob(filepath.Join(dir, "*.outbox"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return files
+}
+
+func TestFileOutboxStore(t *testing.T) {
+	dir := t.TempDir()
+	store := newFileOutboxStore(t, dir, extended.FileOutboxOptions{})
+	appendOutbox(t, store, "alice", 1, 10)
+	appendOutbox(t, store, "bob", 1, 3)
+	if err := store.Append("alice", extended.OutboxMessage{Seq: 10, Message: sessionMessage(10)}); err == nil {
+		t.Fatalf("expected appending a message out of order to fail")
+	}
+	if err := store.Append("alice", extended.OutboxMessage{Seq: 11, Message: &websocket.Message{Type: websocket.MessagePing}}); err == nil {
+		t.Fatalf("expected appending a control message to fail")
+	}
+	if err := store.Trim("alice", 3); err != nil {
+		t.Fatalf("trimming: %v", err)
+	}
+	expectOutbox(t, store, "alice", 0, 4, 10)
+	expectOutbox(t, store, "alice", 8, 8, 10)
+	expectOutbox(t, store, "carol", 0, 1, 0)
+
+	// the process is killed, and a new store is opened on the same files
+	store = newFileOutboxStore(t, dir, extended.FileOutboxOptions{})
+	expectOutbox(t, store, "alice", 0, 4, 10)
+	expectOutbox(t, store, "bob", 0, 1, 3)
+	if err := store.Append("alice", extended.OutboxMessage{Seq: 5, Message: sessionMessage(5)}); err == nil {
+		t.Fatalf("expected the sequence of the last message to survive a restart")
+	}
+	appendOutbox(t, store, "alice", 11, 12)
+	expectOutbox(t, store, "alice", 11, 11, 12)
+
+	// the file of a key is removed once it has no messages
+	store.Trim("bob", 3)
+	if files := outboxFiles(t, dir); len(files) != 1 {
+		t.Fatalf("expected only the file of alice to be left, got %v", files)
+	}
+}
+
+func TestFileOutboxStore_Crash(t *testing.T) {
+	for _, tt := range []struct {
+		name    string
+		corrupt func(b []byte) []byte
+	}{
+		{"truncated record", func(b []byte) []byte { return b[:len(b)-3] }},
+		{"truncated header", func(b []byte) []byte { return b[:len(b)-len("message 5")-20] }},
+		{"corrupted record", func(b []byte) []byte { b[len(b)-1] ^= 0xff; return b }},
+		{"garbage", func(b []byte) []byte { return append(b[:len(b)-len("message 5")-25], 0xff, 0xff, 0xff, 0xff, 1, 2, 3) }},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			store := newFileOutboxStore(t, dir, extended.FileOutboxOptions{})
+			appendOutbox(t, store, "alice", 1, 5)
+
+			// the process crashes while writing message 5
+			path := outboxFiles(t, dir)[0]
+			b, err := os.ReadFile(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := os.WriteFile(path, tt.corrupt(b), 0o600); err != nil {
+				t.Fatal(err)
+			}
+
+			store = newFileOutboxStore(t, dir, extended.FileOutboxOptions{})
+			expectOutbox(t, store, "alice", 0, 1, 4)
+			appendOutbox(t, store, "alice", 5, 6)
+			store = newFileOutboxStore(t, dir, extended.FileOutboxOptions{})
+			expectOutbox(t, store, "alice", 0, 1, 6)
+		})
+	}
+}
+
+func TestFileOutboxStore_Limits(t *testing.T) {
+	clk := clock.NewFake()
+	dir := t.TempDir()
+	opts := extended.FileOutboxWithClock(extended.FileOutboxOptions{MaxBytes: 3 * int64(len("message 1")), MaxAge: time.Minute}, clk)
+	store := newFileOutboxStore(t, dir, opts)
+	appendOutbox(t, store, "alice", 1, 5)
+	expectOutbox(t, store, "alice", 0, 3, 5)
+
+	clk.Advance(30 * time.Second)
+	appendOutbox(t, store, "alice", 6, 6)
+	clk.Advance(40 * time.Second)
+	expectOutbox(t, store, "alice", 0, 6, 6)
+	// the messages dropped are dropped again after a restart
+	expectOutbox(t, newFileOutboxStore(t, dir, opts), "alice", 0, 6, 6)
+	clk.Advance(30 * time.Second)
+	expectOutbox(t, store, "alice", 0, 1, 0)
+	if files := outboxFiles(t, dir); len(files) != 0 {
+		t.Fatalf("expected the file to be removed once its messages expired, got %v", files)
+	}
+}
+
+func TestFileOutboxStore_Compaction(t *testing.T) {
+	dir := t.TempDir()
+	store := newFileOutboxStore(t, dir, extended.FileOutboxOptions{})
+	data := strings.Repeat("x", 1024)
+	for i := 1; i <= 1000; i++ {
+		if err := store.Append("alice", extended.OutboxMessage{Seq: uint64(i), Message: &websocket.Message{Type: websocket.MessageBinary, Data: []byte(data)}}); err != nil {
+			t.Fatalf("appending: %v", err)
+		}
+		if err := store.Trim("alice", uint64(max(i-10, 0))); err != nil {
+			t.Fatalf("trimming: %v", err)
+		}
+	}
+	info, err := os.Stat(outboxFiles(t, dir)[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if info.Size() > 200<<10 {
+		t.Fatalf("expected the file to be compacted, got %d bytes", info.Size())
+	}
+
+	store = newFileOutboxStore(t, dir, extended.FileOutboxOptions{})
+	msgs, err := store.ReadFrom("alice", 0)
+	if err != nil || len(msgs) != 10 || msgs[0].Seq != 991 || msgs[0].Message.Type != websocket.MessageBinary || string(msgs[9].Message.Data) != data {
+		t.Fatalf("expected the last 10 messages to survive compaction, got %d messages and %v", len(msgs), err)
+	}
+	if err := store.Append("alice", extended.OutboxMessage{Seq: 1000, Message: sessionMessage(1000)}); err == nil {
+		t.Fatalf("expected the sequence of the last message to survive compaction")
+	}
+}
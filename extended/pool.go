@@ -0,0 +1,296 @@
+package extended
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// healthCheckTimeout is how long the default health check of a Pool waits
+// for a pong.
+const healthCheckTimeout = 5 * time.Second
+
+// ErrPoolClosed is returned by Pool.Get once the pool is closed.
+var ErrPoolClosed = errors.New("the pool is closed")
+
+// PoolOptions configures a Pool. The zero value uses the defaults
+// described on each field.
+type PoolOptions struct {
+	// MaxIdle is the amount of idle connections kept for reuse. Defaults
+	// to 2.
+	MaxIdle int
+	// MaxActive is the amount of connections the pool may have open at
+	// once, idle or not. Get waits for a connection to be put back once it
+	// is reached. If it is 0, there is no limit.
+	MaxActive int
+	// IdleTimeout is how long a connection may be idle before it is
+	// closed. If it is 0, idle connections are kept until they are reused.
+	IdleTimeout time.Duration
+	// HealthCheck, if set, checks an idle connection before it is reused,
+	// which is discarded if it returns an error. By default, the connection
+	// is pinged, and it is healthy if the pong arrives within five seconds
+	// and nothing else is received first.
+	HealthCheck func(ctx context.Context, conn *websocket.Conn) error
+}
+
+// PoolStats is a snapshot of the connections of a Pool.
+type PoolStats struct {
+	// Active is the amount of open connections, idle or not, including the
+	// ones being dialed.
+	Active int
+	// Idle is the amount of idle connections.
+	Idle int
+}
+
+// Pool reuses client connections to the same URL, for many short
+// exchanges that would otherwise pay for a new connection each. It is
+// created by NewPool. Every method is safe to call concurrently.
+//
+// A connection is borrowed with Get and must be returned with Put once the
+// exchange is over, without being closed. While it is idle, a connection
+// is not read from, so the pool is meant for protocols where the server
+// only sends messages in response to the client.
+type Pool struct {
+	dial Dialer
+	url  string
+	opts PoolOptions
+
+	mx      sync.Mutex
+	idle    []idleConn // the most recently used last
+	lent    map[*websocket.Conn]struct{}
+	active  int
+	changed chan struct{} // closed once a connection is put back or discarded
+	closed  bool
+	stop    chan struct{}
+}
+
+// idleConn is an idle connection of a Pool.
+type idleConn struct {
+	conn  *websocket.Conn
+	since time.Time
+}
+
+// NewPool returns a Pool that dials url with dial, or with websocket.Dial
+// if it is nil.
+func NewPool(dial Dialer, url string, opts PoolOptions) *Pool {
+	if dial == nil {
+		dial = func(ctx context.Context, url string) (*websocket.Conn, error) {
+			conn, err := websocket.Dial(ctx, url)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	if opts.MaxIdle <= 0 {
+		opts.MaxIdle = 2
+	}
+	if opts.HealthCheck == nil {
+		opts.HealthCheck = pingHealthCheck
+	}
+	p := &Pool{
+		dial:    dial,
+		url:     url,
+		opts:    opts,
+		lent:    make(map[*websocket.Conn]struct{}),
+		changed: make(chan struct{}),
+		stop:    make(chan struct{}),
+	}
+	if opts.IdleTimeout > 0 {
+		go p.reap()
+	}
+	return p
+}
+
+// Get borrows a connection: the most recently used idle connection that
+// passes the health check, or a new connection if there is none. If
+// MaxActive connections are open, it waits for one to be put back until
+// ctx is done. ctx also bounds dialing and the health check.
+func (p *Pool) Get(ctx context.Context) (*websocket.Conn, error) {
+	for {
+		p.mx.Lock()
+		if p.closed {
+			p.mx.Unlock()
+			return nil, ErrPoolClosed
+		}
+		if n := len(p.idle); n > 0 {
+			conn := p.idle[n-1].conn
+			p.idle = p.idle[:n-1]
+			p.mx.Unlock()
+			if err := p.opts.HealthCheck(ctx, conn); err != nil {
+				p.discard(conn)
+				if ctx.Err() != nil {
+					return nil, ctx.Err()
+				}
+				continue
+			}
+			return p.lend(conn)
+		}
+		if p.opts.MaxActive <= 0 || p.active < p.opts.MaxActive {
+			p.active++
+			p.mx.Unlock()
+			conn, err := p.dial(ctx, p.url)
+			if err != nil {
+				p.release()
+				return nil, err
+			}
+			return p.lend(conn)
+		}
+		changed := p.changed
+		p.mx.Unlock()
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// lend records conn as borrowed.
+func (p *Pool) lend(conn *websocket.Conn) (*websocket.Conn, error) {
+	p.mx.Lock()
+	if p.closed {
+		p.mx.Unlock()
+		p.discard(conn)
+		return nil, ErrPoolClosed
+	}
+	p.lent[conn] = struct{}{}
+	p.mx.Unlock()
+	return conn, nil
+}
+
+// Put returns a connection borrowed with Get. err is the error the
+// exchange failed with, if any: the connection is closed instead of kept
+// if err is not nil, since it may be in an unknown state, and if the
+// connection is closed or MaxIdle connections are already idle. Putting a
+// connection that is not borrowed has no effect.
+func (p *Pool) Put(conn *websocket.Conn, err error) {
+	p.mx.Lock()
+	if _, ok := p.lent[conn]; !ok {
+		p.mx.Unlock()
+		return
+	}
+	delete(p.lent, conn)
+	if err != nil || p.closed || conn.Closed() || len(p.idle) >= p.opts.MaxIdle {
+		p.mx.Unlock()
+		p.discard(conn)
+		return
+	}
+	p.idle = append(p.idle, idleConn{conn: conn, since: time.Now()})
+	p.notify()
+	p.mx.Unlock()
+}
+
+// Stats returns the amount of open and idle connections.
+func (p *Pool) Stats() PoolStats {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	return PoolStats{Active: p.active, Idle: len(p.idle)}
+}
+
+// Close closes the idle connections, and makes Get return ErrPoolClosed.
+// The borrowed connections are closed once they are put back.
+func (p *Pool) Close() error {
+	p.mx.Lock()
+	if p.closed {
+		p.mx.Unlock()
+		return nil
+	}
+	p.closed = true
+	idle := p.idle
+	p.idle = nil
+	close(p.stop)
+	p.notify()
+	p.mx.Unlock()
+	for _, ic := range idle {
+		p.discard(ic.conn)
+	}
+	return nil
+}
+
+// discard closes conn, which is not idle nor borrowed anymore.
+func (p *Pool) discard(conn *websocket.Conn) {
+	conn.Close()
+	p.release()
+}
+
+// release frees the place of a connection that was closed or could not be
+// dialed.
+func (p *Pool) release() {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	p.active--
+	p.notify()
+}
+
+// notify wakes up the calls to Get waiting for a connection. The mutex
+// must be held.
+func (p *Pool) notify() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// reap closes the connections that have been idle for longer than
+// IdleTimeout, until the pool is closed.
+func (p *Pool) reap() {
+	t := time.NewTicker(max(p.opts.IdleTimeout/2, time.Millisecond))
+	defer t.Stop()
+	for {
+		select {
+		case <-t.C:
+		case <-p.stop:
+			return
+		}
+		var expired []*websocket.Conn
+		p.mx.Lock()
+		cutoff := time.Now().Add(-p.opts.IdleTimeout)
+		// the least recently used connections are first
+		n := 0
+		for n < len(p.idle) && p.idle[n].since.Before(cutoff) {
+			expired = append(expired, p.idle[n].conn)
+			n++
+		}
+		p.idle = append(p.idle[:0], p.idle[n:]...)
+		p.mx.Unlock()
+		for _, conn := range expired {
+			p.discard(conn)
+		}
+	}
+}
+
+// pingHealthCheck pings conn, reading from it until the pong arrives. Any
+// other message means the connection is out of sync with the server.
+func pingHealthCheck(ctx context.Context, conn *websocket.Conn) error {
+	ctx, cancel := context.WithTimeout(ctx, healthCheckTimeout)
+	defer cancel()
+	// reading is interrupted by closing the connection, which is discarded
+	// anyway if the pong is late
+	stop := context.AfterFunc(ctx, func() {
+		conn.Close()
+	})
+	defer stop()
+
+	payload := binary.BigEndian.AppendUint64(nil, rand.Uint64())
+	if err := conn.Write(&websocket.Message{Type: websocket.MessagePing, Data: payload}); err != nil {
+		return err
+	}
+	for {
+		msg, err := conn.Read()
+		if err != nil {
+			return err
+		}
+		switch {
+		case msg.Type == websocket.MessagePong && bytes.Equal(msg.Data, payload):
+			return nil
+		case msg.IsData():
+			return fmt.Errorf("an idle connection received a %s message", msg.Type)
+		}
+	}
+}
@@ -0,0 +1,238 @@
+package extended_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// poolServer is an echo server that keeps track of its connections.
+type poolServer struct {
+	url      string
+	accepted chan *websocket.Conn
+	current  atomic.Int64
+	peak     atomic.Int64
+	dials    atomic.Int64
+}
+
+func newPoolServer(t *testing.T) *poolServer {
+	s := &poolServer{accepted: make(chan *websocket.Conn, 64)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.AcceptHTTP(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		n := s.current.Add(1)
+		defer s.current.Add(-1)
+		for peak := s.peak.Load(); n > peak && !s.peak.CompareAndSwap(peak, n); peak = s.peak.Load() {
+		}
+		s.accepted <- conn
+		for {
+			msg, err := conn.Read()
+			if err != nil {
+				return
+			}
+			if msg.IsData() {
+				conn.Write(msg)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	s.url = "ws" + strings.TrimPrefix(srv.URL, "http")
+	return s
+}
+
+// dial dials the server, counting the connections dialed.
+func (s *poolServer) dial(ctx context.Context, url string) (*websocket.Conn, error) {
+	s.dials.Add(1)
+	conn, err := websocket.Dial(ctx, url)
+	if err != nil {
+		return nil, err
+	}
+	return conn, nil
+}
+
+// exchange sends text on conn and checks that it is echoed.
+func exchange(conn *websocket.Conn, text string) error {
+	if err := conn.Write(textMessage(text)); err != nil {
+		return err
+	}
+	msg, err := conn.Read()
+	if err != nil {
+		return err
+	}
+	if string(msg.Data) != text {
+		return errors.New("expected " + text + ", got " + string(msg.Data))
+	}
+	return nil
+}
+
+func TestPool_Concurrent(t *testing.T) {
+	s := newPoolServer(t)
+	pool := extended.NewPool(s.dial, s.url, extended.PoolOptions{MaxIdle: 4, MaxActive: 4})
+	defer pool.Close()
+
+	var mx sync.Mutex
+	borrowed := make(map[*websocket.Conn]bool)
+	var wg sync.WaitGroup
+	for i := range 32 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := range 25 {
+				conn, err := pool.Get(context.Background())
+				if err != nil {
+					t.Errorf("expected no error from Get(), got %v", err)
+					return
+				}
+				mx.Lock()
+				if borrowed[conn] {
+					t.Errorf("expected a connection to be lent once at a time")
+				}
+				borrowed[conn] = true
+				mx.Unlock()
+				if stats := pool.Stats(); stats.Active > 4 {
+					t.Errorf("expected at most 4 connections, got %+v", stats)
+				}
+
+				err = exchange(conn, strconv.Itoa(i*100+j))
+				if err != nil {
+					t.Errorf("expected no error from the exchange, got %v", err)
+				}
+				mx.Lock()
+				borrowed[conn] = false
+				mx.Unlock()
+				pool.Put(conn, err)
+			}
+		}()
+	}
+	wg.Wait()
+
+	if peak := s.peak.Load(); peak > 4 {
+		t.Fatalf("expected at most 4 connections at once, the server had %d", peak)
+	}
+	if dials := s.dials.Load(); dials > 4 {
+		t.Fatalf("expected the connections to be reused, got %d dials", dials)
+	}
+	if stats := pool.Stats(); stats.Active != stats.Idle || stats.Idle > 4 {
+		t.Fatalf("expected every connection to be idle, got %+v", stats)
+	}
+}
+
+func TestPool_HealthCheck(t *testing.T) {
+	s := newPoolServer(t)
+	pool := extended.NewPool(s.dial, s.url, extended.PoolOptions{})
+	defer pool.Close()
+
+	conn, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error from Get(), got %v", err)
+	}
+	pool.Put(conn, nil)
+	// the server drops the idle connection
+	(<-s.accepted).CloseWithCode(websocket.CloseGoingAway, "")
+
+	reused, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error from Get(), got %v", err)
+	}
+	defer pool.Put(reused, nil)
+	if reused == conn || !conn.Closed() {
+		t.Fatalf("expected the broken connection to be discarded")
+	}
+	if err := exchange(reused, "hello"); err != nil {
+		t.Fatalf("expected the new connection to work, got %v", err)
+	}
+	if s.dials.Load() != 2 {
+		t.Fatalf("expected 2 dials, got %d", s.dials.Load())
+	}
+
+	// a healthy idle connection is reused
+	pool.Put(reused, nil)
+	again, err := pool.Get(context.Background())
+	if err != nil || again != reused {
+		t.Fatalf("expected the healthy connection to be reused, got %v", err)
+	}
+	pool.Put(again, nil)
+}
+
+func TestPool_MaxActive(t *testing.T) {
+	s := newPoolServer(t)
+	pool := extended.NewPool(s.dial, s.url, extended.PoolOptions{MaxActive: 1})
+	defer pool.Close()
+
+	conn, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error from Get(), got %v", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := pool.Get(ctx); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected Get() to wait for a connection, got %v", err)
+	}
+
+	go func() {
+		time.Sleep(10 * time.Millisecond)
+		pool.Put(conn, nil)
+		pool.Put(conn, nil) // putting it back twice has no effect
+	}()
+	got, err := pool.Get(context.Background())
+	if err != nil || got != conn {
+		t.Fatalf("expected the connection put back, got %v", err)
+	}
+	if stats := pool.Stats(); stats != (extended.PoolStats{Active: 1}) {
+		t.Fatalf("expected 1 active connection, got %+v", stats)
+	}
+
+	pool.Put(got, errors.New("the exchange failed"))
+	if stats := pool.Stats(); stats != (extended.PoolStats{}) || !got.Closed() {
+		t.Fatalf("expected the connection to be discarded, got %+v", stats)
+	}
+}
+
+func TestPool_IdleTimeout(t *testing.T) {
+	s := newPoolServer(t)
+	pool := extended.NewPool(s.dial, s.url, extended.PoolOptions{IdleTimeout: 20 * time.Millisecond})
+	defer pool.Close()
+
+	conn, err := pool.Get(context.Background())
+	if err != nil {
+		t.Fatalf("expected no error from Get(), got %v", err)
+	}
+	pool.Put(conn, nil)
+	waitFor(t, time.Second, func() bool { return pool.Stats() == extended.PoolStats{} })
+	if !conn.Closed() {
+		t.Fatalf("expected the idle connection to be closed")
+	}
+}
+
+func TestPool_Close(t *testing.T) {
+	s := newPoolServer(t)
+	pool := extended.NewPool(s.dial, s.url, extended.PoolOptions{})
+
+	idle, _ := pool.Get(context.Background())
+	lent, _ := pool.Get(context.Background())
+	pool.Put(idle, nil)
+	pool.Close()
+	if !idle.Closed() || lent.Closed() {
+		t.Fatalf("expected only the idle connection to be closed")
+	}
+	pool.Put(lent, nil)
+	if !lent.Closed() {
+		t.Fatalf("expected the connection to be closed once put back")
+	}
+	if _, err := pool.Get(context.Background()); !errors.Is(err, extended.ErrPoolClosed) {
+		t.Fatalf("expected ErrPoolClosed, got %v", err)
+	}
+}
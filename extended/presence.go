@@ -0,0 +1,199 @@
+package extended
+
+import (
+	"encoding/json"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// Identity identifies the user of a connection in the presence of a room.
+type Identity struct {
+	// ID identifies the user: connections that join a room with the same
+	// ID are the same user, who is present as long as one of them is in
+	// the room.
+	ID string `json:"id"`
+	// Meta is any data shown with the presence of the user, such as a
+	// display name. It is taken from the connection of the user that
+	// joined the room first.
+	Meta any `json:"meta,omitempty"`
+}
+
+// PresenceEvent is a change of the presence of a room.
+type PresenceEvent struct {
+	Room     string   `json:"room"`
+	Identity Identity `json:"identity"`
+	// Joined is true if the user joined the room, and false if they left
+	// it.
+	Joined bool `json:"joined"`
+}
+
+// WithPresenceEvents makes the hub call f with every change of the
+// presence of a room: once a user joins a room they were not in with any
+// connection, and once the last connection of a user leaves a room,
+// including by being closed. f is called synchronously from the goroutine
+// making the change, after the hub's locks are released.
+func WithPresenceEvents(f func(e PresenceEvent)) HubOption {
+	return func(h *Hub) {
+		h.onPresence = f
+	}
+}
+
+// WithPresenceBroadcast makes the hub broadcast every change of the
+// presence of a room to the room, as a message of type "presence" with a
+// PresenceEvent as its payload, in the format of a Router:
+//
+//	{"type": "presence", "payload": {"room": "lobby", "identity": {"id": "alice"}, "joined": true}}
+//
+// The connection joining the room receives the message of its own join.
+func WithPresenceBroadcast() HubOption {
+	return func(h *Hub) {
+		h.broadcastPresence = true
+	}
+}
+
+// hubPresence keeps track of the identities of the connections in every
+// room of a Hub. It is shared by the shards, since the connections of a
+// user may be in different shards.
+type hubPresence struct {
+	mx    sync.Mutex
+	rooms map[string]map[string]*presence         // the users in every room by ID
+	conns map[*websocket.Conn]map[string]Identity // the identity of every connection in every room
+}
+
+// presence is a user present in a room.
+type presence struct {
+	identity Identity
+	conns    int
+}
+
+// JoinAs adds conn to room like Join, as the user with the identity
+// specified, so that the user is in the presence of the room. If conn is
+// already in room as another user, it changes users.
+func (h *Hub) JoinAs(conn *websocket.Conn, room string, id Identity) {
+	s := h.shard(conn)
+	s.mx.Lock()
+	h.join(s, conn, room)
+	// the presence is updated with the shard locked, so that it can't be
+	// updated for a connection after it is unregistered
+	events := h.presence.add(conn, room, id)
+	s.mx.Unlock()
+	h.presenceChanged(events)
+}
+
+// add adds conn to the presence of room as the user with the identity
+// specified, and returns the events of the change.
+func (p *hubPresence) add(conn *websocket.Conn, room string, id Identity) []PresenceEvent {
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	var events []PresenceEvent
+	if old, ok := p.conns[conn][room]; ok {
+		if old.ID == id.ID {
+			return nil
+		}
+		events = p.remove(conn, room, events)
+	}
+	if p.conns == nil {
+		p.rooms = make(map[string]map[string]*presence)
+		p.conns = make(map[*websocket.Conn]map[string]Identity)
+	}
+	if p.conns[conn] == nil {
+		p.conns[conn] = make(map[string]Identity)
+	}
+	p.conns[conn][room] = id
+	users := p.rooms[room]
+	if users == nil {
+		users = make(map[string]*presence)
+		p.rooms[room] = users
+	}
+	user, ok := users[id.ID]
+	if !ok {
+		user = &presence{identity: id}
+		users[id.ID] = user
+		events = append(events, PresenceEvent{Room: room, Identity: id, Joined: true})
+	}
+	user.conns++
+	return events
+}
+
+// Presence returns the users in room, sorted by ID. Every user is only
+// returned once, however many of their connections are in the room.
+func (h *Hub) Presence(room string) []Identity {
+	p := &h.presence
+	p.mx.Lock()
+	defer p.mx.Unlock()
+	identities := make([]Identity, 0, len(p.rooms[room]))
+	for _, user := range p.rooms[room] {
+		identities = append(identities, user.identity)
+	}
+	slices.SortFunc(identities, func(a, b Identity) int {
+		return strings.Compare(a.ID, b.ID)
+	})
+	return identities
+}
+
+// leavePresence removes conn from the presence of room.
+func (h *Hub) leavePresence(conn *websocket.Conn, room string) {
+	p := &h.presence
+	p.mx.Lock()
+	events := p.remove(conn, room, nil)
+	p.mx.Unlock()
+	h.presenceChanged(events)
+}
+
+// unregisterPresence removes conn from the presence of every room.
+func (h *Hub) unregisterPresence(conn *websocket.Conn) {
+	p := &h.presence
+	p.mx.Lock()
+	var events []PresenceEvent
+	for room := range p.conns[conn] {
+		events = p.remove(conn, room, events)
+	}
+	p.mx.Unlock()
+	h.presenceChanged(events)
+}
+
+// remove removes conn from the presence of room, appending the event to
+// events if its user left. The mutex must be held.
+func (p *hubPresence) remove(conn *websocket.Conn, room string, events []PresenceEvent) []PresenceEvent {
+	id, ok := p.conns[conn][room]
+	if !ok {
+		return events
+	}
+	delete(p.conns[conn], room)
+	if len(p.conns[conn]) == 0 {
+		delete(p.conns, conn)
+	}
+	users := p.rooms[room]
+	user := users[id.ID]
+	if user.conns--; user.conns > 0 {
+		return events
+	}
+	delete(users, id.ID)
+	if len(users) == 0 {
+		delete(p.rooms, room)
+	}
+	return append(events, PresenceEvent{Room: room, Identity: user.identity, Joined: false})
+}
+
+// presenceChanged reports the presence events.
+func (h *Hub) presenceChanged(events []PresenceEvent) {
+	for _, e := range events {
+		if h.onPresence != nil {
+			h.onPresence(e)
+		}
+		if h.broadcastPresence {
+			payload, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			data, err := json.Marshal(Envelope{Type: "presence", Payload: payload})
+			if err != nil {
+				continue
+			}
+			h.Broadcast(e.Room, &websocket.Message{Type: websocket.MessageText, Data: data})
+		}
+	}
+}
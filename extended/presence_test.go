@@ -0,0 +1,135 @@
+package extended_test
+
+import (
+	"encoding/json"
+	"fmt"
+	"slices"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// presenceIDs returns the IDs of the users in room.
+func presenceIDs(hub *extended.Hub, room string) []string {
+	var ids []string
+	for _, id := range hub.Presence(room) {
+		ids = append(ids, id.ID)
+	}
+	return ids
+}
+
+func TestHub_Presence(t *testing.T) {
+	forEachHub(t, func(t *testing.T, opts ...extended.HubOption) {
+		var mx sync.Mutex
+		var events []string
+		hub := extended.NewHub(append(opts, extended.WithPresenceEvents(func(e extended.PresenceEvent) {
+			mx.Lock()
+			defer mx.Unlock()
+			events = append(events, fmt.Sprintf("%s %s %t", e.Room, e.Identity.ID, e.Joined))
+		}))...)
+		expectEvents := func(expected ...string) {
+			t.Helper()
+			mx.Lock()
+			defer mx.Unlock()
+			if !slices.Equal(events, expected) {
+				t.Fatalf("expected events %q, got %q", expected, events)
+			}
+			events = nil
+		}
+
+		// alice has two connections, which may be in different shards
+		alice1, _ := newCountingConn()
+		alice2, _ := newCountingConn()
+		bob, _ := newCountingConn()
+		hub.JoinAs(alice1, "lobby", extended.Identity{ID: "alice", Meta: "Alice"})
+		hub.JoinAs(alice2, "lobby", extended.Identity{ID: "alice"})
+		hub.JoinAs(bob, "lobby", extended.Identity{ID: "bob"})
+		hub.Join(alice2, "games") // without an identity
+		expectEvents("lobby alice true", "lobby bob true")
+		if presence := hub.Presence("lobby"); len(presence) != 2 || presence[0].Meta != "Alice" || presence[1].ID != "bob" {
+			t.Fatalf("expected alice and bob to be present once each, got %v", presence)
+		}
+		if ids := presenceIDs(hub, "games"); len(ids) != 0 {
+			t.Fatalf("expected nobody to be present in games, got %v", ids)
+		}
+
+		// alice is present as long as one of her connections is
+		hub.Leave(alice1, "lobby")
+		expectEvents()
+		if ids := presenceIDs(hub, "lobby"); !slices.Equal(ids, []string{"alice", "bob"}) {
+			t.Fatalf("expected alice to still be present, got %v", ids)
+		}
+
+		// her last connection drops
+		alice2.Close()
+		waitFor(t, time.Second, func() bool { return slices.Equal(presenceIDs(hub, "lobby"), []string{"bob"}) })
+		expectEvents("lobby alice false")
+
+		hub.Unregister(bob)
+		expectEvents("lobby bob false")
+		if ids := presenceIDs(hub, "lobby"); len(ids) != 0 {
+			t.Fatalf("expected the lobby to be empty, got %v", ids)
+		}
+	})
+}
+
+func TestHub_PresenceChangeIdentity(t *testing.T) {
+	hub := extended.NewHub()
+	conn, _ := newCountingConn()
+	hub.JoinAs(conn, "lobby", extended.Identity{ID: "guest"})
+	hub.JoinAs(conn, "lobby", extended.Identity{ID: "alice"})
+	if ids := presenceIDs(hub, "lobby"); !slices.Equal(ids, []string{"alice"}) {
+		t.Fatalf("expected the connection to change users, got %v", ids)
+	}
+}
+
+func TestHub_PresenceBroadcast(t *testing.T) {
+	hub := extended.NewHub(extended.WithPresenceBroadcast())
+	received := make(chan extended.PresenceEvent, 8)
+	join := func(id string) *websocket.Conn {
+		conn, peer := pipe()
+		t.Cleanup(func() {
+			peer.Close()
+			conn.Close()
+		})
+		go readLoop(conn)
+		go func() {
+			for {
+				var env extended.Envelope
+				if err := peer.ReadVia(websocket.JSONCodec{}, &env); err != nil {
+					return
+				}
+				var e extended.PresenceEvent
+				if env.Type != "presence" || json.Unmarshal(env.Payload, &e) != nil {
+					t.Errorf("expected a presence message, got %s %s", env.Type, env.Payload)
+				}
+				if id == "alice" {
+					received <- e
+				}
+			}
+		}()
+		hub.JoinAs(conn, "lobby", extended.Identity{ID: id})
+		return peer
+	}
+	expect := func(id string, joined bool) {
+		t.Helper()
+		select {
+		case e := <-received:
+			if e.Room != "lobby" || e.Identity.ID != id || e.Joined != joined {
+				t.Fatalf("expected %s joined=%t, got %+v", id, joined, e)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("expected a presence message for %s", id)
+		}
+	}
+
+	join("alice")
+	expect("alice", true)
+	bob := join("bob")
+	expect("bob", true)
+	bob.Close() // bob's connection drops abruptly
+	expect("bob", false)
+}
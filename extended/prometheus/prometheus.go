@@ -0,0 +1,231 @@
+// Package prometheus provides a prometheus.Collector for the counters of
+// WebSocket connections. It is a separate module so that neither the
+// websocket package nor the extended package depend on
+// github.com/prometheus/client_golang.
+package prometheus
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/tiredkangaroo/websocket"
+)
+
+// CollectorOptions configures a Collector. The zero value uses the
+// defaults described on each field.
+type CollectorOptions struct {
+	// Namespace is the prefix of the names of the metrics. Defaults to
+	// "websocket".
+	Namespace string
+	// HandshakeBuckets are the buckets of the histogram of the handshake
+	// latency, in seconds. Defaults to prometheus.DefBuckets.
+	HandshakeBuckets []float64
+}
+
+// Collector is a prometheus.Collector exposing the counters of the
+// connections it accepts with Accept or tracks with Track, summed over
+// every connection, open or closed:
+//
+//   - <namespace>_connections_open: the connections that are open.
+//   - <namespace>_handshakes_total{result}: the requests Accept accepted
+//     and rejected, with result "accepted" or "rejected".
+//   - <namespace>_handshake_duration_seconds: a histogram of how long Accept
+//     took for the accepted requests.
+//   - <namespace>_messages_total{direction,type}: the messages read and
+//     written, with direction "read" or "written", and type "text",
+//     "binary", "close", "ping", or "pong".
+//   - <namespace>_frames_total{direction} and
+//     <namespace>_bytes_total{direction}: the frames read and written, and
+//     their bytes, headers included.
+//   - <namespace>_errors_total{direction}: the errors reading and writing
+//     (see websocket.Stats).
+//   - <namespace>_closes_total{code}: the connections closed, by the close
+//     code the peer sent. Codes from 3000 to 3999 are reported as "3xxx",
+//     codes from 4000 to 4999 as "4xxx", and connections closed without
+//     receiving a close frame, such as by Close, as "none".
+//
+// No label identifies a connection, so the amount of series does not grow
+// with the amount of connections. A Collector is created by NewCollector
+// and registered like any other collector, and every method is safe to
+// call concurrently.
+type Collector struct {
+	handshake prometheus.Histogram
+
+	connectionsOpen *prometheus.Desc
+	handshakes      *prometheus.Desc
+	messages        *prometheus.Desc
+	frames          *prometheus.Desc
+	bytes           *prometheus.Desc
+	errors          *prometheus.Desc
+	closes          *prometheus.Desc
+
+	mx       sync.Mutex
+	conns    map[*websocket.Conn]struct{}
+	closed   websocket.Stats // the sum of the counters of the closed connections
+	codes    map[string]uint64
+	accepted uint64
+	rejected uint64
+}
+
+var _ prometheus.Collector = (*Collector)(nil)
+
+// NewCollector returns a Collector without any connection.
+func NewCollector(opts CollectorOptions) *Collector {
+	if opts.Namespace == "" {
+		opts.Namespace = "websocket"
+	}
+	if opts.HandshakeBuckets == nil {
+		opts.HandshakeBuckets = prometheus.DefBuckets
+	}
+	name := func(name string) string {
+		return prometheus.BuildFQName(opts.Namespace, "", name)
+	}
+	return &Collector{
+		handshake: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Namespace: opts.Namespace,
+			Name:      "handshake_duration_seconds",
+			Help:      "How long accepting the WebSocket handshakes took.",
+			Buckets:   opts.HandshakeBuckets,
+		}),
+		connectionsOpen: prometheus.NewDesc(name("connections_open"), "The WebSocket connections that are open.", nil, nil),
+		handshakes:      prometheus.NewDesc(name("handshakes_total"), "The WebSocket handshakes accepted and rejected.", []string{"result"}, nil),
+		messages:        prometheus.NewDesc(name("messages_total"), "The WebSocket messages read and written.", []string{"direction", "type"}, nil),
+		frames:          prometheus.NewDesc(name("frames_total"), "The WebSocket frames read and written.", []string{"direction"}, nil),
+		bytes:           prometheus.NewDesc(name("bytes_total"), "The bytes of the WebSocket frames read and written.", []string{"direction"}, nil),
+		errors:          prometheus.NewDesc(name("errors_total"), "The errors reading and writing WebSocket connections.", []string{"direction"}, nil),
+		closes:          prometheus.NewDesc(name("closes_total"), "The WebSocket connections closed, by the close code of the peer.", []string{"code"}, nil),
+		conns:           make(map[*websocket.Conn]struct{}),
+		codes:           make(map[string]uint64),
+	}
+}
+
+// Accept accepts the WebSocket request like websocket.AcceptHTTP, counting
+// the handshake and tracking the connection it returns.
+func (c *Collector) Accept(w http.ResponseWriter, r *http.Request, opts ...websocket.Option) (*websocket.Conn, error) {
+	start := time.Now()
+	conn, err := websocket.AcceptHTTP(w, r, opts...)
+	if err != nil {
+		c.mx.Lock()
+		c.rejected++
+		c.mx.Unlock()
+		return nil, err
+	}
+	c.handshake.Observe(time.Since(start).Seconds())
+	c.mx.Lock()
+	c.accepted++
+	c.mx.Unlock()
+	c.Track(conn)
+	return conn, nil
+}
+
+// Track adds the counters of conn to the metrics, such as for connections
+// created by websocket.Dial. Its counters are kept once it is closed.
+// Tracking a connection twice has no effect.
+func (c *Collector) Track(conn *websocket.Conn) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if _, ok := c.conns[conn]; ok {
+		return
+	}
+	c.conns[conn] = struct{}{}
+	context.AfterFunc(conn.Context(), func() {
+		c.mx.Lock()
+		defer c.mx.Unlock()
+		delete(c.conns, conn)
+		c.closed = add(c.closed, conn.Stats())
+		c.codes[closeCode(conn.Err())]++
+	})
+}
+
+// closeCode returns the label of the close code err wraps.
+func closeCode(err error) string {
+	var ce *websocket.CloseError
+	switch {
+	case !errors.As(err, &ce):
+		return "none"
+	case ce.Code >= websocket.ClosePrivateMin:
+		return "4xxx"
+	case ce.Code >= websocket.CloseRegisteredMin:
+		return "3xxx"
+	default:
+		return strconv.Itoa(ce.Code)
+	}
+}
+
+// add returns the sum of the counters of a and b.
+func add(a, b websocket.Stats) websocket.Stats {
+	return websocket.Stats{
+		BytesRead:       a.BytesRead + b.BytesRead,
+		BytesWritten:    a.BytesWritten + b.BytesWritten,
+		FramesRead:      a.FramesRead + b.FramesRead,
+		FramesWritten:   a.FramesWritten + b.FramesWritten,
+		MessagesRead:    addMessageCounts(a.MessagesRead, b.MessagesRead),
+		MessagesWritten: addMessageCounts(a.MessagesWritten, b.MessagesWritten),
+		ReadErrors:      a.ReadErrors + b.ReadErrors,
+		WriteErrors:     a.WriteErrors + b.WriteErrors,
+	}
+}
+
+func addMessageCounts(a, b websocket.MessageCounts) websocket.MessageCounts {
+	return websocket.MessageCounts{
+		Text:   a.Text + b.Text,
+		Binary: a.Binary + b.Binary,
+		Close:  a.Close + b.Close,
+		Ping:   a.Ping + b.Ping,
+		Pong:   a.Pong + b.Pong,
+	}
+}
+
+// Describe implements prometheus.Collector.
+func (c *Collector) Describe(ch chan<- *prometheus.Desc) {
+	c.handshake.Describe(ch)
+	for _, desc := range []*prometheus.Desc{c.connectionsOpen, c.handshakes, c.messages, c.frames, c.bytes, c.errors, c.closes} {
+		ch <- desc
+	}
+}
+
+// Collect implements prometheus.Collector.
+func (c *Collector) Collect(ch chan<- prometheus.Metric) {
+	c.handshake.Collect(ch)
+
+	c.mx.Lock()
+	stats := c.closed
+	for conn := range c.conns {
+		stats = add(stats, conn.Stats())
+	}
+	open := len(c.conns)
+	accepted, rejected := c.accepted, c.rejected
+	codes := make(map[string]uint64, len(c.codes))
+	for code, n := range c.codes {
+		codes[code] = n
+	}
+	c.mx.Unlock()
+
+	counter := func(desc *prometheus.Desc, v uint64, labels ...string) {
+		ch <- prometheus.MustNewConstMetric(desc, prometheus.CounterValue, float64(v), labels...)
+	}
+	ch <- prometheus.MustNewConstMetric(c.connectionsOpen, prometheus.GaugeValue, float64(open))
+	counter(c.handshakes, accepted, "accepted")
+	counter(c.handshakes, rejected, "rejected")
+	for direction, counts := range map[string]websocket.MessageCounts{"read": stats.MessagesRead, "written": stats.MessagesWritten} {
+		counter(c.messages, counts.Text, direction, "text")
+		counter(c.messages, counts.Binary, direction, "binary")
+		counter(c.messages, counts.Close, direction, "close")
+		counter(c.messages, counts.Ping, direction, "ping")
+		counter(c.messages, counts.Pong, direction, "pong")
+	}
+	counter(c.frames, stats.FramesRead, "read")
+	counter(c.frames, stats.FramesWritten, "written")
+	counter(c.bytes, stats.BytesRead, "read")
+	counter(c.bytes, stats.BytesWritten, "written")
+	counter(c.errors, stats.ReadErrors, "read")
+	counter(c.errors, stats.WriteErrors, "written")
+	for code, n := range codes {
+		counter(c.closes, n, code)
+	}
+}
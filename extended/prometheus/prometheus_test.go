@@ -0,0 +1,167 @@
+package prometheus_test
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"github.com/tiredkangaroo/websocket"
+	wsprometheus "github.com/tiredkangaroo/websocket/extended/prometheus"
+)
+
+// scrape returns the samples of the metrics of reg in the text format,
+// such as `websocket_bytes_total{direction="read"}`, with their values.
+func scrape(t *testing.T, reg *prometheus.Registry) map[string]string {
+	t.Helper()
+	rec := httptest.NewRecorder()
+	promhttp.HandlerFor(reg, promhttp.HandlerOpts{}).ServeHTTP(rec, httptest.NewRequest("GET", "/metrics", nil))
+	samples := make(map[string]string)
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		i := strings.LastIndexByte(line, ' ')
+		samples[line[:i]] = line[i+1:]
+	}
+	return samples
+}
+
+// scrapeOnce returns the samples of the metrics of reg once sample has
+// value, since connections are only counted as closed right after they
+// are closed.
+func scrapeOnce(t *testing.T, reg *prometheus.Registry, sample, value string) map[string]string {
+	t.Helper()
+	for deadline := time.Now().Add(time.Second); ; {
+		samples := scrape(t, reg)
+		if samples[sample] == value {
+			return samples
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("expected %s to be %s, got %q", sample, value, samples[sample])
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func TestCollector(t *testing.T) {
+	collector := wsprometheus.NewCollector(wsprometheus.CollectorOptions{})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collector)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := collector.Accept(w, r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := conn.Read()
+			if err != nil {
+				return
+			}
+			if msg.IsData() {
+				conn.Write(msg)
+			}
+		}
+	}))
+	defer srv.Close()
+
+	// a request that is not a websocket upgrade is rejected
+	resp, err := http.Get(srv.URL)
+	if err != nil {
+		t.Fatalf("requesting: %v", err)
+	}
+	resp.Body.Close()
+
+	conn, err := websocket.Dial(context.Background(), "ws"+strings.TrimPrefix(srv.URL, "http"))
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	for _, msg := range []*websocket.Message{
+		{Type: websocket.MessageText, Data: []byte("hello")},
+		{Type: websocket.MessageBinary, Data: []byte{1, 2, 3}},
+	} {
+		if err := conn.Write(msg); err != nil {
+			t.Fatalf("writing: %v", err)
+		}
+		if _, err := conn.Read(); err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+	}
+	if samples := scrape(t, reg); samples["websocket_connections_open"] != "1" {
+		t.Fatalf("expected a connection to be open, got %q", samples["websocket_connections_open"])
+	}
+
+	// the client waits for the close frame of the server, so that the
+	// server does not fail writing it
+	if err := conn.WriteClose(websocket.CloseNormalClosure, ""); err != nil {
+		t.Fatalf("writing the close frame: %v", err)
+	}
+	if _, err := conn.Read(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected the server to close the connection, got %v", err)
+	}
+	samples := scrapeOnce(t, reg, "websocket_connections_open", "0")
+
+	// the frames of the client are masked: it sent "hello" in 2+4+5 bytes,
+	// the binary message in 2+4+3 bytes, and its close frame in 2+4+2 bytes
+	for sample, value := range map[string]string{
+		`websocket_handshakes_total{result="accepted"}`:              "1",
+		`websocket_handshakes_total{result="rejected"}`:              "1",
+		`websocket_handshake_duration_seconds_count`:                 "1",
+		`websocket_messages_total{direction="read",type="text"}`:     "1",
+		`websocket_messages_total{direction="read",type="binary"}`:   "1",
+		`websocket_messages_total{direction="read",type="close"}`:    "1",
+		`websocket_messages_total{direction="read",type="ping"}`:     "0",
+		`websocket_messages_total{direction="written",type="text"}`:  "1",
+		`websocket_messages_total{direction="written",type="close"}`: "1",
+		`websocket_frames_total{direction="read"}`:                   "3",
+		`websocket_frames_total{direction="written"}`:                "3",
+		`websocket_bytes_total{direction="read"}`:                    "28",
+		`websocket_bytes_total{direction="written"}`:                 "16",
+		`websocket_errors_total{direction="read"}`:                   "0",
+		`websocket_errors_total{direction="written"}`:                "0",
+		`websocket_closes_total{code="1000"}`:                        "1",
+	} {
+		if samples[sample] != value {
+			t.Errorf("expected %s to be %s, got %q", sample, value, samples[sample])
+		}
+	}
+}
+
+func TestCollector_CloseCodes(t *testing.T) {
+	collector := wsprometheus.NewCollector(wsprometheus.CollectorOptions{Namespace: "ws"})
+	reg := prometheus.NewRegistry()
+	reg.MustRegister(collector)
+
+	for _, code := range []int{websocket.CloseGoingAway, 4001, 4002, 3000} {
+		client, server := websocket.Pipe()
+		collector.Track(server)
+		collector.Track(server) // tracking twice has no effect
+		go client.CloseWithCode(code, "")
+		server.Read()
+		client.Close()
+	}
+	client, server := websocket.Pipe()
+	collector.Track(server)
+	server.Close()
+	client.Close()
+
+	samples := scrapeOnce(t, reg, "ws_connections_open", "0")
+	for sample, value := range map[string]string{
+		`ws_closes_total{code="1001"}`: "1",
+		`ws_closes_total{code="3xxx"}`: "1",
+		`ws_closes_total{code="4xxx"}`: "2",
+		`ws_closes_total{code="none"}`: "1",
+	} {
+		if samples[sample] != value {
+			t.Errorf("expected %s to be %s, got %q", sample, value, samples[sample])
+		}
+	}
+}
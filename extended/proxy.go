@@ -0,0 +1,142 @@
+package extended
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// ReverseProxyOptions configures a reverse proxy created by
+// NewReverseProxy. The zero value uses the defaults described on each
+// field.
+type ReverseProxyOptions struct {
+	// ForwardHeaders are the request headers copied to the backend, such
+	// as Authorization or Origin, in addition to Sec-WebSocket-Protocol and
+	// Cookie, which always are.
+	ForwardHeaders []string
+	// DialTimeout bounds connecting to the backend and its handshake.
+	// Defaults to 10 seconds.
+	DialTimeout time.Duration
+	// ConnOptions configure both the client and the backend connections.
+	ConnOptions []websocket.Option
+}
+
+// reverseProxy is the http.Handler returned by NewReverseProxy.
+type reverseProxy struct {
+	target *url.URL
+	opts   ReverseProxyOptions
+}
+
+// NewReverseProxy returns an http.Handler that forwards WebSocket
+// connections to the ws:// or wss:// URL target, such as an internal
+// backend. The path and query of every request are appended to the ones
+// of target.
+//
+// For every request, the proxy first dials the backend, offering it the
+// subprotocols the client offered, and sending it the cookies of the
+// client, the headers of ForwardHeaders, and X-Forwarded-For,
+// X-Forwarded-Host, and X-Forwarded-Proto. If the backend refuses the
+// handshake with a 4xx status, such as 403, the client is responded to with
+// the same status; if it cannot be reached or fails otherwise, the client
+// is responded to with 502 (bad gateway), or 504 (gateway timeout) if it
+// did not respond within DialTimeout. Otherwise, the proxy accepts the
+// client with the subprotocol the backend selected, and relays the messages
+// between them with Relay, until either ends, closing the other with the
+// same close code and reason.
+func NewReverseProxy(target *url.URL, opts ReverseProxyOptions) http.Handler {
+	if opts.DialTimeout <= 0 {
+		opts.DialTimeout = 10 * time.Second
+	}
+	return &reverseProxy{target: target, opts: opts}
+}
+
+func (p *reverseProxy) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !strings.EqualFold(r.Header.Get("Upgrade"), "websocket") || r.Header.Get("Sec-WebSocket-Key") == "" {
+		http.Error(w, "expected a WebSocket request", http.StatusBadRequest)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(r.Context(), p.opts.DialTimeout)
+	defer cancel()
+	backend, resp, err := websocket.DialWithOptions(ctx, p.backendURL(r), p.dialOptions(r), p.opts.ConnOptions...)
+	if err != nil {
+		switch {
+		case resp != nil && resp.StatusCode >= 400 && resp.StatusCode < 500:
+			http.Error(w, http.StatusText(resp.StatusCode), resp.StatusCode)
+		case errors.Is(err, context.DeadlineExceeded):
+			http.Error(w, http.StatusText(http.StatusGatewayTimeout), http.StatusGatewayTimeout)
+		default:
+			http.Error(w, http.StatusText(http.StatusBadGateway), http.StatusBadGateway)
+		}
+		return
+	}
+
+	if protocol := resp.Header.Get("Sec-WebSocket-Protocol"); protocol != "" {
+		w.Header().Set("Sec-WebSocket-Protocol", protocol)
+	}
+	for _, cookie := range resp.Header.Values("Set-Cookie") {
+		w.Header().Add("Set-Cookie", cookie)
+	}
+	client, err := websocket.AcceptHTTP(w, r, p.opts.ConnOptions...)
+	if err != nil {
+		backend.CloseWithCode(websocket.CloseGoingAway, "")
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	// the request's context is not used, since the connection outlives
+	// the request once it is hijacked
+	Relay(context.Background(), client, backend)
+}
+
+// backendURL returns the URL of the backend for r.
+func (p *reverseProxy) backendURL(r *http.Request) string {
+	u := *p.target
+	u.Path = strings.TrimSuffix(u.Path, "/") + "/" + strings.TrimPrefix(r.URL.Path, "/")
+	u.RawPath = ""
+	switch {
+	case u.RawQuery == "":
+		u.RawQuery = r.URL.RawQuery
+	case r.URL.RawQuery != "":
+		u.RawQuery += "&" + r.URL.RawQuery
+	}
+	return u.String()
+}
+
+// dialOptions returns the handshake of the backend for r.
+func (p *reverseProxy) dialOptions(r *http.Request) websocket.DialOptions {
+	var dopts websocket.DialOptions
+	for _, value := range r.Header.Values("Sec-WebSocket-Protocol") {
+		for _, protocol := range strings.Split(value, ",") {
+			if protocol = strings.TrimSpace(protocol); protocol != "" {
+				dopts.Subprotocols = append(dopts.Subprotocols, protocol)
+			}
+		}
+	}
+
+	header := make(http.Header)
+	for _, name := range append([]string{"Cookie"}, p.opts.ForwardHeaders...) {
+		for _, value := range r.Header.Values(name) {
+			header.Add(name, value)
+		}
+	}
+	if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+		if prior := r.Header.Values("X-Forwarded-For"); len(prior) > 0 {
+			ip = strings.Join(prior, ", ") + ", " + ip
+		}
+		header.Set("X-Forwarded-For", ip)
+	}
+	header.Set("X-Forwarded-Host", r.Host)
+	if r.TLS != nil {
+		header.Set("X-Forwarded-Proto", "https")
+	} else {
+		header.Set("X-Forwarded-Proto", "http")
+	}
+	dopts.Header = header
+	return dopts
+}
@@ -0,0 +1,155 @@
+package extended_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// proxyBackend is an echo server behind a reverse proxy, which records the
+// requests it receives and the error its connections end with.
+type proxyBackend struct {
+	requests chan *http.Request
+	ended    chan error
+}
+
+func newProxyBackend(t *testing.T) (*proxyBackend, *url.URL) {
+	b := &proxyBackend{requests: make(chan *http.Request, 4), ended: make(chan error, 4)}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b.requests <- r
+		if r.Header.Get("Authorization") != "Bearer token" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		w.Header().Set("Sec-WebSocket-Protocol", "chat.v1")
+		conn, err := websocket.AcceptHTTP(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for {
+			msg, err := conn.Read()
+			if err != nil {
+				b.ended <- err
+				return
+			}
+			if string(msg.Data) == "close" {
+				conn.CloseWithCode(4000, "bye")
+				return
+			}
+			if msg.IsData() {
+				conn.Write(msg)
+			}
+		}
+	}))
+	t.Cleanup(srv.Close)
+	u, _ := url.Parse("ws" + strings.TrimPrefix(srv.URL, "http") + "/ws")
+	return b, u
+}
+
+// newProxy starts a reverse proxy to target and returns its ws:// URL.
+func newProxy(t *testing.T, target *url.URL) string {
+	srv := httptest.NewServer(extended.NewReverseProxy(target, extended.ReverseProxyOptions{
+		ForwardHeaders: []string{"Authorization"},
+	}))
+	t.Cleanup(srv.Close)
+	return "ws" + strings.TrimPrefix(srv.URL, "http")
+}
+
+var proxyDialOptions = websocket.DialOptions{
+	Header: http.Header{
+		"Authorization": {"Bearer token"},
+		"Cookie":        {"session=abc"},
+		"X-Private":     {"secret"},
+	},
+	Subprotocols: []string{"chat.v2", "chat.v1"},
+}
+
+func TestReverseProxy(t *testing.T) {
+	backend, target := newProxyBackend(t)
+	proxy := newProxy(t, target)
+
+	conn, resp, err := websocket.DialWithOptions(context.Background(), proxy+"/chat?room=1", proxyDialOptions)
+	if err != nil {
+		t.Fatalf("dialing through the proxy: %v", err)
+	}
+	defer conn.Close()
+	if protocol := resp.Header.Get("Sec-WebSocket-Protocol"); protocol != "chat.v1" {
+		t.Fatalf("expected the subprotocol of the backend, got %q", protocol)
+	}
+	r := <-backend.requests
+	switch {
+	case r.URL.Path != "/ws/chat" || r.URL.RawQuery != "room=1":
+		t.Fatalf("expected the path and query to be appended to the target, got %s", r.URL)
+	case r.Header.Get("Cookie") != "session=abc" || r.Header.Get("X-Private") != "":
+		t.Fatalf("expected only the cookies and the allowed headers to be forwarded, got %v", r.Header)
+	case r.Header.Get("X-Forwarded-For") != "127.0.0.1":
+		t.Fatalf("expected X-Forwarded-For to be the client, got %q", r.Header.Get("X-Forwarded-For"))
+	case r.Header.Get("Sec-WebSocket-Protocol") != "chat.v2, chat.v1":
+		t.Fatalf("expected the subprotocols of the client, got %q", r.Header.Get("Sec-WebSocket-Protocol"))
+	}
+
+	for _, msg := range []*websocket.Message{
+		textMessage("hello"),
+		{Type: websocket.MessageBinary, Data: []byte(strings.Repeat("x", 100000))},
+	} {
+		if err := conn.Write(msg); err != nil {
+			t.Fatalf("expected no error from Write(), got %v", err)
+		}
+		got, err := conn.Read()
+		if err != nil || got.Type != msg.Type || string(got.Data) != string(msg.Data) {
+			t.Fatalf("expected the message to be echoed through the proxy, got %v", err)
+		}
+	}
+
+	// the backend closes with its own code
+	conn.Write(textMessage("close"))
+	if _, err := conn.Read(); !websocket.IsCloseError(err, 4000) || !strings.Contains(err.Error(), "bye") {
+		t.Fatalf("expected the close code of the backend, got %v", err)
+	}
+}
+
+func TestReverseProxy_ClientClose(t *testing.T) {
+	backend, target := newProxyBackend(t)
+	conn, _, err := websocket.DialWithOptions(context.Background(), newProxy(t, target), proxyDialOptions)
+	if err != nil {
+		t.Fatalf("dialing through the proxy: %v", err)
+	}
+	conn.CloseWithCode(4001, "leaving")
+	select {
+	case err := <-backend.ended:
+		if !websocket.IsCloseError(err, 4001) {
+			t.Fatalf("expected the close code of the client, got %v", err)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the backend connection to be closed")
+	}
+}
+
+func TestReverseProxy_HandshakeErrors(t *testing.T) {
+	_, target := newProxyBackend(t)
+	_, resp, err := websocket.DialWithOptions(context.Background(), newProxy(t, target), websocket.DialOptions{})
+	if !errors.Is(err, websocket.ErrHandshake) || resp == nil || resp.StatusCode != http.StatusForbidden {
+		t.Fatalf("expected the 403 of the backend, got %v and %v", resp, err)
+	}
+
+	unreachable, _ := url.Parse("ws://127.0.0.1:1")
+	_, resp, err = websocket.DialWithOptions(context.Background(), newProxy(t, unreachable), websocket.DialOptions{})
+	if !errors.Is(err, websocket.ErrHandshake) || resp == nil || resp.StatusCode != http.StatusBadGateway {
+		t.Fatalf("expected 502, got %v and %v", resp, err)
+	}
+
+	plain, herr := http.Get("http" + strings.TrimPrefix(newProxy(t, target), "ws"))
+	if herr != nil || plain.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected a request that is not a WebSocket request to be refused, got %v and %v", plain, herr)
+	}
+	plain.Body.Close()
+}
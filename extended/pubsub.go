@@ -0,0 +1,190 @@
+package extended
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// PubSub delivers messages published to dot-separated topics, such as
+// "orders.eu.created", to the connections subscribed to patterns matching
+// them. In a pattern, "*" matches exactly one segment and "#", which may
+// only be the last segment, matches any amount of segments, including
+// none: "orders.*.created" and "orders.#" both match "orders.eu.created",
+// and "orders.#" also matches "orders".
+//
+// Patterns are kept in a trie, so publishing only looks at the patterns
+// that can match the topic. Connections are unsubscribed from every
+// pattern once they are closed. A PubSub is created by NewPubSub, and
+// every method is safe to call concurrently.
+type PubSub struct {
+	mx    sync.RWMutex
+	root  *topicNode
+	conns map[*websocket.Conn]map[string]struct{} // the patterns of every connection
+}
+
+// topicNode is a node of the trie of patterns, for a segment of the
+// patterns that go through it.
+type topicNode struct {
+	children map[string]*topicNode
+	subs     map[*websocket.Conn]struct{} // subscribed to the pattern ending here
+}
+
+func newTopicNode() *topicNode {
+	return &topicNode{children: make(map[string]*topicNode), subs: make(map[*websocket.Conn]struct{})}
+}
+
+// NewPubSub returns a PubSub without subscriptions.
+func NewPubSub() *PubSub {
+	return &PubSub{root: newTopicNode(), conns: make(map[*websocket.Conn]map[string]struct{})}
+}
+
+// Subscribe subscribes conn to the topics matching pattern. It returns an
+// error if pattern has an empty segment or a "#" that is not the last
+// segment. Subscribing to a pattern conn is already subscribed to has no
+// effect.
+func (ps *PubSub) Subscribe(conn *websocket.Conn, pattern string) error {
+	segments := strings.Split(pattern, ".")
+	for i, segment := range segments {
+		if segment == "" {
+			return fmt.Errorf("pattern %q has an empty segment", pattern)
+		}
+		if segment == "#" && i != len(segments)-1 {
+			return errors.New(`"#" may only be the last segment of a pattern`)
+		}
+	}
+
+	ps.mx.Lock()
+	defer ps.mx.Unlock()
+	patterns, ok := ps.conns[conn]
+	if !ok {
+		patterns = make(map[string]struct{})
+		ps.conns[conn] = patterns
+		go func() {
+			<-conn.Done()
+			ps.UnsubscribeAll(conn)
+		}()
+	}
+	patterns[pattern] = struct{}{}
+
+	node := ps.root
+	for _, segment := range segments {
+		child, ok := node.children[segment]
+		if !ok {
+			child = newTopicNode()
+			node.children[segment] = child
+		}
+		node = child
+	}
+	node.subs[conn] = struct{}{}
+	return nil
+}
+
+// Unsubscribe unsubscribes conn from pattern.
+func (ps *PubSub) Unsubscribe(conn *websocket.Conn, pattern string) {
+	ps.mx.Lock()
+	defer ps.mx.Unlock()
+	ps.unsubscribe(conn, pattern)
+}
+
+// UnsubscribeAll unsubscribes conn from every pattern.
+func (ps *PubSub) UnsubscribeAll(conn *websocket.Conn) {
+	ps.mx.Lock()
+	defer ps.mx.Unlock()
+	for pattern := range ps.conns[conn] {
+		ps.unsubscribe(conn, pattern)
+	}
+}
+
+// unsubscribe unsubscribes conn from pattern, removing the nodes of the
+// trie that are not needed anymore. The mutex must be held.
+func (ps *PubSub) unsubscribe(conn *websocket.Conn, pattern string) {
+	patterns, ok := ps.conns[conn]
+	if !ok {
+		return
+	}
+	if _, ok := patterns[pattern]; !ok {
+		return
+	}
+	delete(patterns, pattern)
+	if len(patterns) == 0 {
+		delete(ps.conns, conn)
+	}
+
+	segments := strings.Split(pattern, ".")
+	path := []*topicNode{ps.root}
+	for _, segment := range segments {
+		path = append(path, path[len(path)-1].children[segment])
+	}
+	delete(path[len(path)-1].subs, conn)
+	for i := len(segments) - 1; i >= 0; i-- {
+		node := path[i+1]
+		if len(node.subs) != 0 || len(node.children) != 0 {
+			break
+		}
+		delete(path[i].children, segments[i])
+	}
+}
+
+// Subscribers returns the connections subscribed to a pattern that
+// matches topic.
+func (ps *PubSub) Subscribers(topic string) []*websocket.Conn {
+	ps.mx.RLock()
+	defer ps.mx.RUnlock()
+	matched := make(map[*websocket.Conn]struct{})
+	ps.root.match(strings.Split(topic, "."), matched)
+	return keys(matched)
+}
+
+// match adds the connections subscribed to the patterns under the node
+// that match segments to matched.
+func (n *topicNode) match(segments []string, matched map[*websocket.Conn]struct{}) {
+	if rest, ok := n.children["#"]; ok {
+		for conn := range rest.subs {
+			matched[conn] = struct{}{}
+		}
+	}
+	if len(segments) == 0 {
+		for conn := range n.subs {
+			matched[conn] = struct{}{}
+		}
+		return
+	}
+	if child, ok := n.children[segments[0]]; ok {
+		child.match(segments[1:], matched)
+	}
+	if child, ok := n.children["*"]; ok {
+		child.match(segments[1:], matched)
+	}
+}
+
+// Publish writes msg to every connection subscribed to a pattern that
+// matches topic, once even if several of its patterns match, and returns
+// the amount of connections it was written to. Like Hub.BroadcastAll, the
+// frames of msg are only encoded once, and connections that are closed or
+// broken are closed and unsubscribed.
+//
+// Connections are written to one at a time, so a slow subscriber delays
+// the others and the publisher, unless its write queue is enabled (see
+// websocket.Conn.EnableWriteQueue), which is recommended for subscribers.
+func (ps *PubSub) Publish(topic string, msg *websocket.Message) int {
+	pm, err := websocket.NewPreparedMessage(msg)
+	if err != nil {
+		return 0
+	}
+	written := 0
+	for _, conn := range ps.Subscribers(topic) {
+		err := conn.WritePrepared(pm)
+		switch {
+		case err == nil:
+			written++
+		case errors.Is(err, websocket.ErrConnectionClosed) || errors.Is(err, websocket.ErrWrite):
+			conn.Close()
+			ps.UnsubscribeAll(conn)
+		}
+	}
+	return written
+}
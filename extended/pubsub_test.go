@@ -0,0 +1,186 @@
+package extended_test
+
+import (
+	"fmt"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+func TestPubSub_Matching(t *testing.T) {
+	tests := []struct {
+		pattern string
+		match   []string
+		noMatch []string
+	}{
+		{"orders.created", []string{"orders.created"}, []string{"orders", "orders.deleted", "orders.created.eu"}},
+		{"orders.*", []string{"orders.created", "orders.deleted"}, []string{"orders", "orders.created.eu", "users.created"}},
+		{"*.created", []string{"orders.created", "users.created"}, []string{"created", "orders.eu.created"}},
+		{"orders.*.created", []string{"orders.eu.created"}, []string{"orders.created", "orders.eu.deleted"}},
+		{"orders.#", []string{"orders", "orders.created", "orders.eu.created"}, []string{"users.created", "ordersx"}},
+		{"#", []string{"orders", "orders.eu.created"}, nil},
+		{"*.*.#", []string{"orders.eu", "orders.eu.created"}, []string{"orders"}},
+	}
+	for _, test := range tests {
+		ps := extended.NewPubSub()
+		conn, _ := newCountingConn()
+		if err := ps.Subscribe(conn, test.pattern); err != nil {
+			t.Fatalf("subscribing to %q: %v", test.pattern, err)
+		}
+		for _, topic := range test.match {
+			if subs := ps.Subscribers(topic); len(subs) != 1 {
+				t.Fatalf("expected %q to match %q", test.pattern, topic)
+			}
+		}
+		for _, topic := range test.noMatch {
+			if subs := ps.Subscribers(topic); len(subs) != 0 {
+				t.Fatalf("expected %q not to match %q", test.pattern, topic)
+			}
+		}
+	}
+}
+
+func TestPubSub_InvalidPattern(t *testing.T) {
+	ps := extended.NewPubSub()
+	conn, _ := newCountingConn()
+	for _, pattern := range []string{"", "orders.", "orders..created", "#.created", "orders.#.created"} {
+		if err := ps.Subscribe(conn, pattern); err == nil {
+			t.Fatalf("expected subscribing to %q to fail", pattern)
+		}
+	}
+}
+
+func TestPubSub_Publish(t *testing.T) {
+	ps := extended.NewPubSub()
+	a, aw := newCountingConn()
+	b, bw := newCountingConn()
+	c, cw := newCountingConn()
+	ps.Subscribe(a, "orders.*")
+	ps.Subscribe(a, "orders.#") // a matching twice still gets the message once
+	ps.Subscribe(b, "orders.created")
+	ps.Subscribe(c, "users.*")
+
+	if n := ps.Publish("orders.created", hubMessage); n != 2 {
+		t.Fatalf("expected the message to be published to 2 connections, got %d", n)
+	}
+	if aw.writes.Load() != 1 || bw.writes.Load() != 1 || cw.writes.Load() != 0 {
+		t.Fatalf("expected 1, 1 and 0 writes, got %d, %d and %d", aw.writes.Load(), bw.writes.Load(), cw.writes.Load())
+	}
+
+	ps.Unsubscribe(a, "orders.*")
+	if n := ps.Publish("orders.created", hubMessage); n != 2 {
+		t.Fatalf("expected a to still be subscribed to orders.#, got %d connections", n)
+	}
+	ps.Unsubscribe(a, "orders.#")
+	if n := ps.Publish("orders.created", hubMessage); n != 1 {
+		t.Fatalf("expected the message to be published to 1 connection, got %d", n)
+	}
+}
+
+func TestPubSub_UnsubscribeOnClose(t *testing.T) {
+	ps := extended.NewPubSub()
+	conn, _ := newCountingConn()
+	ps.Subscribe(conn, "orders.*")
+	ps.Subscribe(conn, "users.#")
+
+	conn.Close()
+	waitFor(t, time.Second, func() bool {
+		return len(ps.Subscribers("orders.created")) == 0 && len(ps.Subscribers("users")) == 0
+	})
+}
+
+func TestPubSub_EvictsBrokenConnections(t *testing.T) {
+	ps := extended.NewPubSub()
+	a, _ := newCountingConn()
+	b, bw := newCountingConn()
+	bw.broken = true
+	ps.Subscribe(a, "orders.*")
+	ps.Subscribe(b, "orders.*")
+
+	if n := ps.Publish("orders.created", hubMessage); n != 1 {
+		t.Fatalf("expected the message to be published to 1 connection, got %d", n)
+	}
+	if !b.Closed() {
+		t.Fatalf("expected the broken connection to be closed")
+	}
+	if subs := ps.Subscribers("orders.created"); !slices.Equal(subs, []*websocket.Conn{a}) {
+		t.Fatalf("expected the broken connection to be unsubscribed")
+	}
+}
+
+func TestPubSub_SlowSubscriber(t *testing.T) {
+	ps := extended.NewPubSub()
+	slow, peer := pipe() // the peer never reads
+	defer slow.Close()
+	defer peer.Close() // closed first to unblock the write queue
+	slow.EnableWriteQueue(4, websocket.OverflowDropOldest)
+	fast, fw := newCountingConn()
+	ps.Subscribe(slow, "orders.*")
+	ps.Subscribe(fast, "orders.*")
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for range 100 {
+			ps.Publish("orders.created", hubMessage)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("expected the slow subscriber not to block publishing")
+	}
+	if fw.writes.Load() != 100 {
+		t.Fatalf("expected the fast subscriber to get 100 messages, got %d", fw.writes.Load())
+	}
+}
+
+func TestPubSub_Concurrent(t *testing.T) {
+	ps := extended.NewPubSub()
+	done := make(chan struct{})
+	for i := range 8 {
+		go func() {
+			defer func() { done <- struct{}{} }()
+			for j := range 100 {
+				conn, _ := newCountingConn()
+				pattern := fmt.Sprintf("orders.%d.*", (i+j)%10)
+				ps.Subscribe(conn, pattern)
+				ps.Publish(fmt.Sprintf("orders.%d.created", j%10), hubMessage)
+				ps.Unsubscribe(conn, pattern)
+			}
+		}()
+	}
+	for range 8 {
+		<-done
+	}
+	if subs := ps.Subscribers("orders.1.created"); len(subs) != 0 {
+		t.Fatalf("expected no subscribers left, got %d", len(subs))
+	}
+}
+
+// BenchmarkPubSub_Publish publishes to a topic matched by 1 of 10000
+// subscriptions.
+func BenchmarkPubSub_Publish(b *testing.B) {
+	ps := extended.NewPubSub()
+	for i := range 10000 {
+		conn, _ := newCountingConn()
+		switch i % 4 {
+		case 0:
+			ps.Subscribe(conn, fmt.Sprintf("orders.%d.created", i))
+		case 1:
+			ps.Subscribe(conn, fmt.Sprintf("orders.%d.*", i))
+		case 2:
+			ps.Subscribe(conn, fmt.Sprintf("users.%d.#", i))
+		case 3:
+			ps.Subscribe(conn, fmt.Sprintf("*.%d.deleted", i))
+		}
+	}
+	b.ReportAllocs()
+	b.ResetTimer()
+	for range b.N {
+		ps.Publish("orders.4.created", hubMessage)
+	}
+}
@@ -0,0 +1,209 @@
+package extended
+
+import (
+	"context"
+	"encoding/json"
+	"math"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// RateLimitPolicy is what a RateLimiter does with a message over the limit
+// of its connection.
+type RateLimitPolicy int
+
+const (
+	// RateLimitDrop drops the message.
+	RateLimitDrop RateLimitPolicy = iota
+	// RateLimitReply drops the message and replies with a message of type
+	// "slow_down" with a SlowDownPayload, in the format of a Router.
+	RateLimitReply
+	// RateLimitClose closes the connection with 1008 (policy violation).
+	RateLimitClose
+)
+
+// SlowDownPayload is the payload of the messages of type "slow_down" a
+// RateLimiter replies with under RateLimitReply:
+//
+//	{"type": "slow_down", "payload": {"retry_after_ms": 250}}
+type SlowDownPayload struct {
+	// RetryAfterMS is how many milliseconds until the next message is
+	// allowed.
+	RetryAfterMS int64 `json:"retry_after_ms"`
+}
+
+// RateLimitOptions configures a RateLimiter. The zero value uses the
+// defaults described on each field.
+type RateLimitOptions struct {
+	// Rate is the amount of messages per second a connection may send in
+	// the long run. Defaults to 10.
+	Rate float64
+	// Burst is the amount of messages a connection may send at once after
+	// being quiet. Defaults to Rate, rounded up.
+	Burst int
+	// Policy is what is done with a message over the limit. Defaults to
+	// RateLimitDrop.
+	Policy RateLimitPolicy
+	// OnLimit, if set, is called with every message over the limit, before
+	// the policy is applied.
+	OnLimit func(conn *websocket.Conn, msg *websocket.Message)
+
+	clock clock.Clock
+}
+
+// RateLimiter limits the rate of the messages read from every connection
+// with a token bucket per connection: a bucket holds up to Burst tokens and
+// is refilled at Rate tokens per second, and every message takes a token.
+// A message that finds the bucket empty is over the limit.
+//
+// The limits can be changed per connection with SetLimit, for example to
+// give some users more. The bucket of a connection is removed once it is
+// closed. The zero value is not usable; a RateLimiter is created by
+// NewRateLimiter. Every method is safe to call concurrently.
+type RateLimiter struct {
+	opts RateLimitOptions
+
+	mx      sync.Mutex
+	buckets map[*websocket.Conn]*bucket
+}
+
+// bucket is the token bucket of a connection. Instead of the tokens, it
+// keeps the time the bucket will be full again, so that it is refilled
+// exactly, without accumulating rounding errors.
+type bucket struct {
+	interval time.Duration // the time to refill a token
+	burst    int
+	full     time.Time
+}
+
+// NewRateLimiter returns a RateLimiter with the options specified.
+func NewRateLimiter(opts RateLimitOptions) *RateLimiter {
+	if opts.Rate <= 0 {
+		opts.Rate = 10
+	}
+	if opts.Burst <= 0 {
+		opts.Burst = int(math.Ceil(opts.Rate))
+	}
+	if opts.clock == nil {
+		opts.clock = clock.Real{}
+	}
+	return &RateLimiter{opts: opts, buckets: make(map[*websocket.Conn]*bucket)}
+}
+
+// Middleware returns middleware that applies the limits of l to every
+// message, so that only the messages within the limit reach the handlers
+// after it.
+func (l *RateLimiter) Middleware() MessageMiddleware {
+	return func(next MessageHandler) MessageHandler {
+		return func(ctx context.Context, conn *websocket.Conn, msg *websocket.Message) {
+			wait, ok := l.take(conn)
+			if ok {
+				next(ctx, conn, msg)
+				return
+			}
+			if l.opts.OnLimit != nil {
+				l.opts.OnLimit(conn, msg)
+			}
+			switch l.opts.Policy {
+			case RateLimitReply:
+				payload, err := json.Marshal(SlowDownPayload{RetryAfterMS: int64(math.Ceil(float64(wait) / float64(time.Millisecond)))})
+				if err != nil {
+					return
+				}
+				if err := conn.WriteVia(websocket.JSONCodec{}, Envelope{Type: "slow_down", Payload: payload}); err != nil {
+					conn.Logger().Error("an error occured while replying to a message over the rate limit", "error", err.Error())
+				}
+			case RateLimitClose:
+				conn.CloseWithCode(websocket.ClosePolicyViolation, "rate limit exceeded")
+			}
+		}
+	}
+}
+
+// Allow reports whether conn may send another message, taking a token from
+// its bucket if it may.
+func (l *RateLimiter) Allow(conn *websocket.Conn) bool {
+	_, ok := l.take(conn)
+	return ok
+}
+
+// take takes a token from the bucket of conn, and returns whether there
+// was one. If there was not, it also returns how long until there is.
+func (l *RateLimiter) take(conn *websocket.Conn) (time.Duration, bool) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	now := l.opts.clock.Now()
+	b := l.bucket(conn, now)
+	full := b.full
+	if full.Before(now) {
+		full = now
+	}
+	// the bucket is empty once it is more than burst tokens from full
+	if wait := full.Add(b.interval).Sub(now) - time.Duration(b.burst)*b.interval; wait > 0 {
+		return wait, false
+	}
+	b.full = full.Add(b.interval)
+	return 0, true
+}
+
+// SetLimit changes the rate and burst of conn, keeping the amount of tokens
+// it has taken, so that a full bucket stays full. rate less than or equal
+// to 0 and burst less than 1 are replaced with the defaults of the limiter.
+func (l *RateLimiter) SetLimit(conn *websocket.Conn, rate float64, burst int) {
+	if rate <= 0 {
+		rate = l.opts.Rate
+	}
+	if burst < 1 {
+		burst = l.opts.Burst
+	}
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	now := l.opts.clock.Now()
+	b := l.bucket(conn, now)
+	taken := min(float64(burst), float64(b.burst)-b.tokens(now))
+	b.interval = interval(rate)
+	b.burst = burst
+	b.full = now.Add(time.Duration(taken * float64(b.interval)))
+}
+
+// Tokens returns the amount of tokens in the bucket of conn, which is the
+// amount of messages it may send at once right now. A connection that has
+// not sent any message has a full bucket.
+func (l *RateLimiter) Tokens(conn *websocket.Conn) float64 {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	if b, ok := l.buckets[conn]; ok {
+		return b.tokens(l.opts.clock.Now())
+	}
+	return float64(l.opts.Burst)
+}
+
+// bucket returns the bucket of conn, creating a full one if conn has none.
+// The mutex must be held.
+func (l *RateLimiter) bucket(conn *websocket.Conn, now time.Time) *bucket {
+	if b, ok := l.buckets[conn]; ok {
+		return b
+	}
+	b := &bucket{interval: interval(l.opts.Rate), burst: l.opts.Burst, full: now}
+	l.buckets[conn] = b
+	context.AfterFunc(conn.Context(), func() {
+		l.mx.Lock()
+		defer l.mx.Unlock()
+		delete(l.buckets, conn)
+	})
+	return b
+}
+
+// tokens returns the amount of tokens in the bucket at now.
+func (b *bucket) tokens(now time.Time) float64 {
+	missing := max(b.full.Sub(now), 0)
+	return float64(b.burst) - float64(missing)/float64(b.interval)
+}
+
+// interval returns the time to refill a token at rate tokens per second.
+func interval(rate float64) time.Duration {
+	return max(time.Duration(float64(time.Second)/rate), 1)
+}
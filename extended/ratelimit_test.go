@@ -0,0 +1,147 @@
+package extended_test
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// limited returns a handler limited by l that counts the messages it lets
+// through.
+func limited(l *extended.RateLimiter, handled *int) extended.MessageHandler {
+	return extended.Chain(func(ctx context.Context, conn *websocket.Conn, msg *websocket.Message) {
+		*handled++
+	}, l.Middleware())
+}
+
+func TestRateLimiter_Steady(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	defer conn.Close()
+	clk := clock.NewFake()
+	l := extended.NewRateLimiter(extended.RateLimitWithClock(extended.RateLimitOptions{Rate: 10, Burst: 1}, clk))
+	handled := 0
+	h := limited(l, &handled)
+
+	// a client sending 100 messages per second only gets 10 through
+	for range 1000 {
+		h(context.Background(), conn, textMessage("hello"))
+		clk.Advance(10 * time.Millisecond)
+	}
+	if handled != 100 {
+		t.Fatalf("expected 100 messages in 10 seconds, got %d", handled)
+	}
+}
+
+func TestRateLimiter_Burst(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	defer conn.Close()
+	clk := clock.NewFake()
+	l := extended.NewRateLimiter(extended.RateLimitWithClock(extended.RateLimitOptions{Rate: 2, Burst: 5}, clk))
+	handled := 0
+	h := limited(l, &handled)
+
+	if tokens := l.Tokens(conn); tokens != 5 {
+		t.Fatalf("expected a full bucket, got %v tokens", tokens)
+	}
+	for range 8 {
+		h(context.Background(), conn, textMessage("hello"))
+	}
+	if handled != 5 || l.Tokens(conn) != 0 {
+		t.Fatalf("expected the burst to be absorbed, got %d messages and %v tokens", handled, l.Tokens(conn))
+	}
+
+	clk.Advance(time.Second)
+	if tokens := l.Tokens(conn); tokens != 2 {
+		t.Fatalf("expected 2 tokens after a second, got %v", tokens)
+	}
+	clk.Advance(time.Minute)
+	if tokens := l.Tokens(conn); tokens != 5 {
+		t.Fatalf("expected the bucket to be refilled up to the burst, got %v", tokens)
+	}
+}
+
+func TestRateLimiter_SetLimit(t *testing.T) {
+	basic, basicPeer := pipe()
+	premium, premiumPeer := pipe()
+	defer basicPeer.Close()
+	defer premiumPeer.Close()
+	clk := clock.NewFake()
+	l := extended.NewRateLimiter(extended.RateLimitWithClock(extended.RateLimitOptions{Rate: 1}, clk))
+	l.SetLimit(premium, 10, 10)
+
+	allowed := func(conn *websocket.Conn) int {
+		n := 0
+		for range 20 {
+			if l.Allow(conn) {
+				n++
+			}
+		}
+		return n
+	}
+	if basic, premium := allowed(basic), allowed(premium); basic != 1 || premium != 10 {
+		t.Fatalf("expected 1 basic and 10 premium messages, got %d and %d", basic, premium)
+	}
+	clk.Advance(time.Second)
+	if basic, premium := allowed(basic), allowed(premium); basic != 1 || premium != 10 {
+		t.Fatalf("expected the buckets to be refilled at their rates, got %d and %d", basic, premium)
+	}
+
+	// the limit of a connection is forgotten once it is closed
+	premium.Close()
+	waitFor(t, time.Second, func() bool { return l.Tokens(premium) == 1 })
+	basic.Close()
+}
+
+func TestRateLimiter_Reply(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	defer conn.Close()
+	clk := clock.NewFake()
+	l := extended.NewRateLimiter(extended.RateLimitWithClock(extended.RateLimitOptions{Rate: 4, Policy: extended.RateLimitReply}, clk))
+	l.SetLimit(conn, 4, 1)
+	handled := 0
+	h := limited(l, &handled)
+
+	h(context.Background(), conn, textMessage("hello"))
+	go h(context.Background(), conn, textMessage("hello"))
+	var env extended.Envelope
+	if err := peer.ReadVia(websocket.JSONCodec{}, &env); err != nil {
+		t.Fatalf("expected no error from ReadVia(), got %v", err)
+	}
+	var payload extended.SlowDownPayload
+	if err := json.Unmarshal(env.Payload, &payload); err != nil || env.Type != "slow_down" || payload.RetryAfterMS != 250 {
+		t.Fatalf("expected to be told to retry after 250ms, got %s %s", env.Type, env.Payload)
+	}
+}
+
+func TestRateLimiter_Close(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	var limitedMessages []string
+	l := extended.NewRateLimiter(extended.RateLimitWithClock(extended.RateLimitOptions{
+		Rate:   1,
+		Policy: extended.RateLimitClose,
+		OnLimit: func(conn *websocket.Conn, msg *websocket.Message) {
+			limitedMessages = append(limitedMessages, string(msg.Data))
+		},
+	}, clock.NewFake()))
+	handled := 0
+	h := limited(l, &handled)
+
+	h(context.Background(), conn, textMessage("a"))
+	go h(context.Background(), conn, textMessage("b"))
+	if _, err := peer.Read(); !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected the connection to be closed with 1008, got %v", err)
+	}
+	waitFor(t, time.Second, conn.Closed)
+	if handled != 1 || len(limitedMessages) != 1 || limitedMessages[0] != "b" {
+		t.Fatalf("expected only b to be over the limit, got %d messages and %v", handled, limitedMessages)
+	}
+}
@@ -0,0 +1,349 @@
+package extended
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand/v2"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// Dialer opens a connection to url, such as websocket.Dial with options.
+type Dialer func(ctx context.Context, url string) (*websocket.Conn, error)
+
+// DisconnectedPolicy is what a Reconnector does with the messages written
+// while it is not connected.
+type DisconnectedPolicy int
+
+const (
+	// DisconnectedError returns ErrDisconnected.
+	DisconnectedError DisconnectedPolicy = iota
+	// DisconnectedBuffer buffers the message, to be written once connected,
+	// unless the buffer is full, in which case ErrReconnectBufferFull is
+	// returned.
+	DisconnectedBuffer
+)
+
+var (
+	// ErrDisconnected is returned by Reconnector.Write for a message
+	// written while it is not connected, with DisconnectedError.
+	ErrDisconnected = errors.New("the reconnector is not connected")
+	// ErrReconnectBufferFull is returned by Reconnector.Write for a message
+	// written while it is not connected and its buffer is full, with
+	// DisconnectedBuffer.
+	ErrReconnectBufferFull = errors.New("the reconnector's buffer is full")
+	// ErrReconnectorClosed is returned by the methods of a Reconnector once
+	// it is closed.
+	ErrReconnectorClosed = errors.New("the reconnector is closed")
+)
+
+// ReconnectOptions configures a Reconnector. The zero value uses the
+// defaults described on each field.
+type ReconnectOptions struct {
+	// InitialBackoff is how long to wait before redialing after the
+	// connection dropped. Defaults to 500 milliseconds.
+	InitialBackoff time.Duration
+	// MaxBackoff is the longest to wait between two attempts. Defaults to
+	// 30 seconds.
+	MaxBackoff time.Duration
+	// Multiplier is the factor the wait is multiplied by after every
+	// attempt that fails. Defaults to 2.
+	Multiplier float64
+	// Jitter is the fraction of every wait that is randomized away, so
+	// that clients that lost their connections at the same time do not
+	// redial at the same time. Defaults to 0.5, and a negative value
+	// disables it.
+	Jitter float64
+	// MaxAttempts is the amount of attempts in a row that may fail before
+	// the Reconnector fails permanently. If it is 0, it never gives up.
+	MaxAttempts int
+
+	// Disconnected is what to do with the messages written while not
+	// connected. It defaults to DisconnectedError.
+	Disconnected DisconnectedPolicy
+	// BufferSize is the amount of messages DisconnectedBuffer buffers.
+	// Defaults to 256.
+	BufferSize int
+
+	// OnConnect, if set, is called with every new connection, once it is
+	// used by Read and Write.
+	OnConnect func(conn *websocket.Conn)
+	// OnDisconnect, if set, is called with the error that ended every
+	// connection, such as a CONNECTION_CLOSED error.
+	OnDisconnect func(err error)
+	// Resubscribe, if set, is called with every connection but the first
+	// before it is used by Read and Write, and before the buffered messages
+	// are written to it, to restore the state the server keeps for the
+	// connection, such as subscriptions. It must not read from conn, since
+	// the responses are returned by Read. If it returns an error, the
+	// connection is closed and redialed.
+	Resubscribe func(conn *websocket.Conn) error
+}
+
+// Reconnector is a client connection that redials when it drops, for
+// clients that must stay connected through server restarts. It is created
+// by NewReconnector.
+//
+// Read returns the messages of the current connection, waiting through
+// reconnects. Write writes to the current connection, and the messages
+// written while not connected are handled according to the
+// DisconnectedPolicy. Messages in flight when a connection drops may be
+// lost, so protocols that can't lose messages should acknowledge them, for
+// example with SessionClient.
+type Reconnector struct {
+	dial Dialer
+	url  string
+	opts ReconnectOptions
+
+	messages chan *websocket.Message
+	ctx      context.Context
+	cancel   context.CancelFunc
+	done     chan struct{}
+
+	mx     sync.Mutex
+	conn   *websocket.Conn
+	buffer []*websocket.Message
+	err    error
+}
+
+// NewReconnector returns a Reconnector that dials url with dial, or with
+// websocket.Dial if it is nil, and starts connecting in a new goroutine.
+func NewReconnector(dial Dialer, url string, opts ReconnectOptions) *Reconnector {
+	if dial == nil {
+		dial = func(ctx context.Context, url string) (*websocket.Conn, error) {
+			conn, err := websocket.Dial(ctx, url)
+			if err != nil {
+				return nil, err
+			}
+			return conn, nil
+		}
+	}
+	if opts.InitialBackoff <= 0 {
+		opts.InitialBackoff = 500 * time.Millisecond
+	}
+	if opts.MaxBackoff < opts.InitialBackoff {
+		opts.MaxBackoff = max(30*time.Second, opts.InitialBackoff)
+	}
+	if opts.Multiplier < 1 {
+		opts.Multiplier = 2
+	}
+	switch {
+	case opts.Jitter == 0:
+		opts.Jitter = 0.5
+	case opts.Jitter < 0:
+		opts.Jitter = 0
+	}
+	opts.Jitter = min(opts.Jitter, 1)
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 256
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	r := &Reconnector{
+		dial:     dial,
+		url:      url,
+		opts:     opts,
+		messages: make(chan *websocket.Message),
+		ctx:      ctx,
+		cancel:   cancel,
+		done:     make(chan struct{}),
+	}
+	go r.run()
+	return r
+}
+
+// Read returns the next text or binary message, waiting for a connection
+// if there is none. It returns an error once the Reconnector is closed or
+// has failed permanently. Only one goroutine should call Read at a time,
+// and like with a Conn, pings are only responded to while Read is called.
+func (r *Reconnector) Read() (*websocket.Message, error) {
+	select {
+	case msg := <-r.messages:
+		return msg, nil
+	case <-r.done:
+		return nil, r.Err()
+	}
+}
+
+// Write writes msg to the current connection. If there is none, msg is
+// handled according to the DisconnectedPolicy.
+func (r *Reconnector) Write(msg *websocket.Message) error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	switch {
+	case r.err != nil:
+		return r.err
+	case r.conn != nil:
+		if err := r.conn.Write(msg); err != nil {
+			return err
+		}
+		return nil
+	case r.opts.Disconnected != DisconnectedBuffer:
+		return ErrDisconnected
+	case len(r.buffer) >= r.opts.BufferSize:
+		return ErrReconnectBufferFull
+	}
+	r.buffer = append(r.buffer, msg)
+	return nil
+}
+
+// Conn returns the current connection, or nil if there is none.
+func (r *Reconnector) Conn() *websocket.Conn {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.conn
+}
+
+// Done returns a channel that is closed once the Reconnector is closed or
+// has failed permanently.
+func (r *Reconnector) Done() <-chan struct{} {
+	return r.done
+}
+
+// Err returns ErrReconnectorClosed once the Reconnector is closed, or the
+// error it failed permanently with, which wraps the error of the last
+// attempt. It returns nil while it is running.
+func (r *Reconnector) Err() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.err
+}
+
+// Close stops reconnecting and closes the current connection, if any,
+// with 1000 (normal closure). The buffered messages are dropped.
+func (r *Reconnector) Close() error {
+	r.fail(ErrReconnectorClosed)
+	r.cancel()
+	<-r.done
+	return nil
+}
+
+// fail records err as the error of the Reconnector, unless it already has
+// one.
+func (r *Reconnector) fail(err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if r.err == nil {
+		r.err = err
+		r.buffer = nil
+	}
+}
+
+func (r *Reconnector) run() {
+	defer close(r.done)
+	failures := 0
+	for reconnect := false; ; reconnect = true {
+		conn, err := r.dial(r.ctx, r.url)
+		if err == nil {
+			err = r.connected(conn, reconnect)
+		}
+		if err == nil {
+			failures = 0
+			err = r.serve(conn)
+			r.disconnected(conn, err)
+		} else {
+			failures++
+			if r.ctx.Err() == nil && r.opts.MaxAttempts > 0 && failures >= r.opts.MaxAttempts {
+				r.fail(fmt.Errorf("giving up after %d attempts: %w", failures, err))
+				return
+			}
+		}
+		if !r.sleep(r.backoff(failures)) {
+			return
+		}
+	}
+}
+
+// connected makes conn the current connection, resubscribing and writing
+// the buffered messages first.
+func (r *Reconnector) connected(conn *websocket.Conn, reconnect bool) error {
+	if reconnect && r.opts.Resubscribe != nil {
+		if err := r.opts.Resubscribe(conn); err != nil {
+			conn.Close()
+			return err
+		}
+	}
+	r.mx.Lock()
+	for len(r.buffer) > 0 {
+		if err := conn.Write(r.buffer[0]); err != nil {
+			r.mx.Unlock()
+			conn.Close()
+			return err
+		}
+		r.buffer = r.buffer[1:]
+	}
+	r.buffer = nil
+	if r.err != nil { // closed while connecting
+		r.mx.Unlock()
+		conn.Close()
+		return r.err
+	}
+	r.conn = conn
+	r.mx.Unlock()
+	if r.opts.OnConnect != nil {
+		r.opts.OnConnect(conn)
+	}
+	return nil
+}
+
+// serve passes the messages of conn to Read until reading fails, closing
+// conn once the Reconnector is closed.
+func (r *Reconnector) serve(conn *websocket.Conn) error {
+	stop := context.AfterFunc(r.ctx, func() {
+		conn.CloseWithCode(websocket.CloseNormalClosure, "")
+	})
+	defer stop()
+	for {
+		msg, err := conn.Read()
+		if err != nil {
+			return err
+		}
+		if !msg.IsData() {
+			continue
+		}
+		select {
+		case r.messages <- msg:
+		case <-r.ctx.Done():
+			return r.ctx.Err()
+		}
+	}
+}
+
+// disconnected stops using conn after it ended with err.
+func (r *Reconnector) disconnected(conn *websocket.Conn, err error) {
+	r.mx.Lock()
+	r.conn = nil
+	r.mx.Unlock()
+	conn.Close()
+	if r.opts.OnDisconnect != nil {
+		r.opts.OnDisconnect(err)
+	}
+}
+
+// backoff returns how long to wait before the next attempt after the
+// amount of failed attempts specified.
+func (r *Reconnector) backoff(failures int) time.Duration {
+	d := float64(r.opts.InitialBackoff)
+	for range failures {
+		d *= r.opts.Multiplier
+		if d >= float64(r.opts.MaxBackoff) {
+			break
+		}
+	}
+	d = min(d, float64(r.opts.MaxBackoff))
+	return time.Duration(d * (1 - r.opts.Jitter*rand.Float64()))
+}
+
+// sleep waits for d, and reports whether the Reconnector is still running.
+func (r *Reconnector) sleep(d time.Duration) bool {
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return true
+	case <-r.ctx.Done():
+		return false
+	}
+}
@@ -0,0 +1,208 @@
+package extended_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// pipeDialer returns a Dialer that waits for a value on allow, then returns
+// the client end of a pipe and sends the server end on the channel
+// returned.
+func pipeDialer(allow <-chan struct{}) (extended.Dialer, <-chan *websocket.Conn) {
+	servers := make(chan *websocket.Conn, 1)
+	return func(ctx context.Context, url string) (*websocket.Conn, error) {
+		select {
+		case <-allow:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		client, server := pipe()
+		servers <- server
+		return client, nil
+	}, servers
+}
+
+func textMessage(text string) *websocket.Message {
+	return &websocket.Message{Type: websocket.MessageText, Data: []byte(text)}
+}
+
+func TestReconnector_Sustained(t *testing.T) {
+	// the server echoes five messages per connection, then closes it
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.AcceptHTTP(w, r)
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		for range 5 {
+			msg, err := conn.Read()
+			if err != nil {
+				return
+			}
+			conn.Write(msg)
+		}
+		conn.CloseWithCode(websocket.CloseServiceRestart, "")
+	}))
+	defer srv.Close()
+
+	var connects, disconnects atomic.Int64
+	r := extended.NewReconnector(nil, "ws"+strings.TrimPrefix(srv.URL, "http"), extended.ReconnectOptions{
+		InitialBackoff: 5 * time.Millisecond,
+		OnConnect:      func(conn *websocket.Conn) { connects.Add(1) },
+		OnDisconnect:   func(err error) { disconnects.Add(1) },
+	})
+	defer r.Close()
+
+	echoes := make(chan string, 64)
+	go func() {
+		for {
+			msg, err := r.Read()
+			if err != nil {
+				return
+			}
+			echoes <- string(msg.Data)
+		}
+	}()
+
+	deadline := time.After(5 * time.Second)
+	for i := range 40 {
+		want := strconv.Itoa(i)
+	send:
+		for {
+			r.Write(textMessage(want)) // messages written while disconnected are resent
+			retry := time.After(50 * time.Millisecond)
+			for {
+				select {
+				case got := <-echoes:
+					if got == want {
+						break send
+					}
+				case <-retry:
+					continue send
+				case <-deadline:
+					t.Fatalf("expected the reconnector to keep going, stuck at message %d", i)
+				}
+			}
+		}
+	}
+	if connects.Load() < 8 || disconnects.Load() < 7 {
+		t.Fatalf("expected at least 8 connections, got %d connects and %d disconnects", connects.Load(), disconnects.Load())
+	}
+}
+
+func TestReconnector_Buffer(t *testing.T) {
+	allow := make(chan struct{}, 1)
+	dial, servers := pipeDialer(allow)
+	resubscribed := make(chan struct{}, 1)
+	r := extended.NewReconnector(dial, "", extended.ReconnectOptions{
+		InitialBackoff: time.Millisecond,
+		Disconnected:   extended.DisconnectedBuffer,
+		BufferSize:     2,
+		Resubscribe: func(conn *websocket.Conn) error {
+			resubscribed <- struct{}{}
+			return conn.Write(textMessage("subscribe"))
+		},
+	})
+	defer r.Close()
+
+	allow <- struct{}{}
+	first := <-servers
+	waitFor(t, time.Second, func() bool { return r.Conn() != nil })
+	select {
+	case <-resubscribed:
+		t.Fatalf("expected Resubscribe not to be called for the first connection")
+	default:
+	}
+	first.Close()
+	waitFor(t, time.Second, func() bool { return r.Conn() == nil })
+
+	for _, text := range []string{"a", "b"} {
+		if err := r.Write(textMessage(text)); err != nil {
+			t.Fatalf("expected the message to be buffered, got %v", err)
+		}
+	}
+	if err := r.Write(textMessage("c")); !errors.Is(err, extended.ErrReconnectBufferFull) {
+		t.Fatalf("expected ErrReconnectBufferFull, got %v", err)
+	}
+
+	allow <- struct{}{}
+	second := <-servers
+	defer second.Close()
+	for _, want := range []string{"subscribe", "a", "b"} {
+		msg, err := second.Read()
+		if err != nil {
+			t.Fatalf("expected no error from Read(), got %v", err)
+		}
+		if string(msg.Data) != want {
+			t.Fatalf("expected %q, got %q", want, msg.Data)
+		}
+	}
+
+	go second.Write(textMessage("hello"))
+	if msg, err := r.Read(); err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("expected to read from the new connection, got %v and %v", msg, err)
+	}
+}
+
+func TestReconnector_DisconnectedError(t *testing.T) {
+	dial, _ := pipeDialer(nil)
+	r := extended.NewReconnector(dial, "", extended.ReconnectOptions{})
+	defer r.Close()
+
+	if err := r.Write(textMessage("hello")); !errors.Is(err, extended.ErrDisconnected) {
+		t.Fatalf("expected ErrDisconnected, got %v", err)
+	}
+}
+
+func TestReconnector_MaxAttempts(t *testing.T) {
+	refused := errors.New("connection refused")
+	var attempts atomic.Int64
+	r := extended.NewReconnector(func(ctx context.Context, url string) (*websocket.Conn, error) {
+		attempts.Add(1)
+		return nil, refused
+	}, "", extended.ReconnectOptions{InitialBackoff: time.Millisecond, MaxAttempts: 3})
+	defer r.Close()
+
+	if _, err := r.Read(); !errors.Is(err, refused) {
+		t.Fatalf("expected the error of the last attempt, got %v", err)
+	}
+	if attempts.Load() != 3 {
+		t.Fatalf("expected 3 attempts, got %d", attempts.Load())
+	}
+	if err := r.Write(textMessage("hello")); !errors.Is(err, refused) {
+		t.Fatalf("expected Write() to fail permanently, got %v", err)
+	}
+}
+
+func TestReconnector_Close(t *testing.T) {
+	allow := make(chan struct{}, 1)
+	dial, servers := pipeDialer(allow)
+	r := extended.NewReconnector(dial, "", extended.ReconnectOptions{})
+	allow <- struct{}{}
+	server := <-servers
+	defer server.Close()
+	waitFor(t, time.Second, func() bool { return r.Conn() != nil })
+
+	closed := make(chan error, 1)
+	go func() {
+		_, err := server.Read()
+		closed <- err
+	}()
+	r.Close()
+	if err := <-closed; !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected the connection to be closed with 1000, got %v", err)
+	}
+	if _, err := r.Read(); !errors.Is(err, extended.ErrReconnectorClosed) {
+		t.Fatalf("expected ErrReconnectorClosed, got %v", err)
+	}
+}
@@ -0,0 +1,174 @@
+package extended
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// ErrNoConnections is returned by Registry.SendToKey when no connection is
+// registered under the key.
+var ErrNoConnections = errors.New("no connections are registered under the key")
+
+// Registry maps keys, such as user IDs, to the connections registered
+// under them, so that all the connections of a user can be written to or
+// closed at once. A connection may be registered under several keys, and
+// is removed from every key once it is closed.
+//
+// A Registry is usable on its own, or with a Hub through WithRegistry. It
+// is created by NewRegistry, and every method is safe to call
+// concurrently.
+type Registry struct {
+	mx    sync.RWMutex
+	keys  map[string]map[*websocket.Conn]struct{}
+	conns map[*websocket.Conn]*registered
+}
+
+// registered is the state of a connection in a Registry.
+type registered struct {
+	keys    map[string]struct{}
+	unwatch func() bool
+}
+
+// NewRegistry returns an empty Registry.
+func NewRegistry() *Registry {
+	return &Registry{
+		keys:  make(map[string]map[*websocket.Conn]struct{}),
+		conns: make(map[*websocket.Conn]*registered),
+	}
+}
+
+// Add registers conn under key. Adding a connection that is already
+// registered under key has no effect. A connection that is already closed
+// is not added.
+func (r *Registry) Add(key string, conn *websocket.Conn) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if conn.Closed() {
+		return
+	}
+	reg, ok := r.conns[conn]
+	if !ok {
+		reg = &registered{keys: make(map[string]struct{})}
+		r.conns[conn] = reg
+		reg.unwatch = context.AfterFunc(conn.Context(), func() {
+			r.removeConn(conn)
+		})
+	}
+	reg.keys[key] = struct{}{}
+	conns, ok := r.keys[key]
+	if !ok {
+		conns = make(map[*websocket.Conn]struct{})
+		r.keys[key] = conns
+	}
+	conns[conn] = struct{}{}
+}
+
+// Remove unregisters conn from key. It does not close the connection.
+func (r *Registry) Remove(key string, conn *websocket.Conn) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.remove(key, conn)
+}
+
+// removeConn unregisters conn from every key.
+func (r *Registry) removeConn(conn *websocket.Conn) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	if reg, ok := r.conns[conn]; ok {
+		for key := range reg.keys {
+			r.remove(key, conn)
+		}
+	}
+}
+
+// remove unregisters conn from key. The mutex must be held.
+func (r *Registry) remove(key string, conn *websocket.Conn) {
+	reg, ok := r.conns[conn]
+	if !ok {
+		return
+	}
+	delete(reg.keys, key)
+	if len(reg.keys) == 0 {
+		reg.unwatch()
+		delete(r.conns, conn)
+	}
+	conns := r.keys[key]
+	delete(conns, conn)
+	if len(conns) == 0 {
+		delete(r.keys, key)
+	}
+}
+
+// Conns returns the connections registered under key.
+func (r *Registry) Conns(key string) []*websocket.Conn {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return keys(r.keys[key])
+}
+
+// Keys returns the keys conn is registered under.
+func (r *Registry) Keys(conn *websocket.Conn) []string {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	if reg, ok := r.conns[conn]; ok {
+		return keys(reg.keys)
+	}
+	return nil
+}
+
+// Len returns the amount of keys with at least one connection.
+func (r *Registry) Len() int {
+	r.mx.RLock()
+	defer r.mx.RUnlock()
+	return len(r.keys)
+}
+
+// SendToKey writes msg to every connection registered under key. The
+// frames of msg are only encoded once, and the connections are written to
+// one at a time, outside of the registry's lock. A connection that cannot
+// be written to because it is closed or broken is closed and removed.
+//
+// The error joins the errors of every connection that could not be written
+// to, each prefixed with the ID of the connection, so it is nil only if
+// msg was written to every connection. It is ErrNoConnections if there is
+// none.
+func (r *Registry) SendToKey(key string, msg *websocket.Message) error {
+	pm, err := websocket.NewPreparedMessage(msg)
+	if err != nil {
+		return err
+	}
+	conns := r.Conns(key)
+	if len(conns) == 0 {
+		return ErrNoConnections
+	}
+	var errs []error
+	for _, conn := range conns {
+		err := conn.WritePrepared(pm)
+		if err == nil {
+			continue
+		}
+		errs = append(errs, fmt.Errorf("connection %d: %w", conn.ID(), err))
+		if errors.Is(err, websocket.ErrConnectionClosed) || errors.Is(err, websocket.ErrWrite) {
+			conn.Close()
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// CloseKey closes every connection registered under key with code and
+// reason, for example once the account of a user is suspended. The error
+// joins the errors of the connections that could not be closed cleanly,
+// like SendToKey.
+func (r *Registry) CloseKey(key string, code int, reason string) error {
+	var errs []error
+	for _, conn := range r.Conns(key) {
+		if err := conn.CloseWithCode(code, reason); err != nil {
+			errs = append(errs, fmt.Errorf("connection %d: %w", conn.ID(), err))
+		}
+	}
+	return errors.Join(errs...)
+}
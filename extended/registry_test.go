@@ -0,0 +1,173 @@
+package extended_test
+
+import (
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+func TestRegistry(t *testing.T) {
+	r := extended.NewRegistry()
+	var peers []*websocket.Conn
+	var conns []*websocket.Conn
+	for range 3 {
+		conn, peer := pipe()
+		defer conn.Close()
+		defer peer.Close()
+		go readLoop(conn)
+		r.Add("alice", conn)
+		conns = append(conns, conn)
+		peers = append(peers, peer)
+	}
+	bob, bobPeer := pipe()
+	defer bob.Close()
+	defer bobPeer.Close()
+	r.Add("bob", bob)
+	r.Add("admins", conns[0])
+
+	if n := len(r.Conns("alice")); n != 3 || r.Len() != 3 {
+		t.Fatalf("expected alice to have 3 connections out of 3 keys, got %d out of %d", n, r.Len())
+	}
+	// the connections are written to in any order
+	received := make(chan string, 3)
+	for _, peer := range peers {
+		go func() {
+			msg, err := peer.Read()
+			if err != nil {
+				received <- err.Error()
+				return
+			}
+			received <- string(msg.Data)
+		}()
+	}
+	if err := r.SendToKey("alice", textMessage("hello")); err != nil {
+		t.Fatalf("expected no error from SendToKey(), got %v", err)
+	}
+	for range peers {
+		if got := <-received; got != "hello" {
+			t.Fatalf("expected every connection of alice to receive the message, got %q", got)
+		}
+	}
+	if err := r.SendToKey("carol", textMessage("hello")); !errors.Is(err, extended.ErrNoConnections) {
+		t.Fatalf("expected ErrNoConnections, got %v", err)
+	}
+
+	// a connection is removed from every key once it is closed
+	conns[0].Close()
+	waitFor(t, time.Second, func() bool { return len(r.Conns("alice")) == 2 && len(r.Conns("admins")) == 0 })
+
+	// the account of alice is suspended
+	closed := make(chan error, 2)
+	for _, peer := range peers[1:] {
+		go func() {
+			_, err := peer.Read()
+			closed <- err
+		}()
+	}
+	if err := r.CloseKey("alice", websocket.ClosePolicyViolation, "suspended"); err != nil {
+		t.Fatalf("expected no error from CloseKey(), got %v", err)
+	}
+	for range 2 {
+		if err := <-closed; !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+			t.Fatalf("expected the connections of alice to be closed with 1008, got %v", err)
+		}
+	}
+	waitFor(t, time.Second, func() bool { return r.Len() == 1 })
+	if bob.Closed() {
+		t.Fatalf("expected the connection of bob to stay open")
+	}
+}
+
+func TestRegistry_SendErrors(t *testing.T) {
+	r := extended.NewRegistry()
+	ok, okw := newCountingConn()
+	broken, brokenw := newCountingConn()
+	brokenw.broken = true
+	r.Add("alice", ok)
+	r.Add("alice", broken)
+
+	err := r.SendToKey("alice", hubMessage)
+	if !errors.Is(err, websocket.ErrWrite) || !strings.Contains(err.Error(), "connection ") {
+		t.Fatalf("expected the error of the broken connection, got %v", err)
+	}
+	if okw.writes.Load() != 1 {
+		t.Fatalf("expected the message to be written to the other connection")
+	}
+	waitFor(t, time.Second, func() bool { return len(r.Conns("alice")) == 1 })
+}
+
+func TestRegistry_Churn(t *testing.T) {
+	r := extended.NewRegistry()
+	stable, stablew := newCountingConn()
+	r.Add("alice", stable)
+
+	// alice connects and disconnects rapidly from other tabs while messages
+	// are sent to her
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; ; j++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				conn, _ := newCountingConn()
+				r.Add("alice", conn)
+				if (i+j)%2 == 0 {
+					conn.Close()
+				} else {
+					r.Remove("alice", conn)
+				}
+			}
+		}()
+	}
+	for range 500 {
+		err := r.SendToKey("alice", hubMessage)
+		if err != nil && !errors.Is(err, websocket.ErrConnectionClosed) && !errors.Is(err, websocket.ErrWrite) {
+			t.Errorf("expected only errors of closed connections, got %v", err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+
+	if got := stablew.writes.Load(); got != 500 {
+		t.Fatalf("expected the stable connection to receive every message, got %d", got)
+	}
+	waitFor(t, time.Second, func() bool {
+		conns := r.Conns("alice")
+		return len(conns) == 1 && conns[0] == stable
+	})
+}
+
+func TestHub_WithRegistry(t *testing.T) {
+	r := extended.NewRegistry()
+	hub := extended.NewHub(extended.WithRegistry(r, func(conn *websocket.Conn) (string, bool) {
+		user, ok := conn.Get("user")
+		if !ok {
+			return "", false
+		}
+		return user.(string), true
+	}))
+	alice, _ := newCountingConn()
+	alice.Set("user", "alice")
+	anonymous, _ := newCountingConn()
+	hub.Join(alice, "lobby")
+	hub.Join(anonymous, "lobby")
+
+	if conns := r.Conns("alice"); len(conns) != 1 || conns[0] != alice || r.Len() != 1 {
+		t.Fatalf("expected only alice to be in the registry, got %v", conns)
+	}
+	hub.Unregister(alice)
+	if r.Len() != 0 {
+		t.Fatalf("expected alice to be removed from the registry")
+	}
+}
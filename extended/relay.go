@@ -0,0 +1,177 @@
+package extended
+
+import (
+	"context"
+	"errors"
+	"sync"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// RelayOption configures a relay started by Relay.
+type RelayOption func(r *relay)
+
+// WithRelayFilter makes the relay call f with every message read from one
+// connection before it is written to the other. f returns the message to
+// write instead, which may be msg itself, or nil to drop it. f is called
+// from the goroutine relaying that direction, so it is called concurrently
+// for the two directions.
+func WithRelayFilter(f func(from, to *websocket.Conn, msg *websocket.Message) *websocket.Message) RelayOption {
+	return func(r *relay) {
+		r.filter = f
+	}
+}
+
+// WithRelayFrames makes the relay forward every frame read from one
+// connection to the other as it is, with ReadFrame and WriteFrame, instead
+// of messages: fragments, rsv bits, and the masks of a client's frames
+// are kept, and control frames are forwarded in the order they arrive,
+// so that the bytes written by a peer are the bytes the other peer
+// reads. The filter set with WithRelayFilter is not called.
+//
+// Pings and close frames are forwarded like any other frame, so the
+// peers respond to each other: once a peer sends a close frame, the
+// relay waits for the other peer to respond to it, so that the closing
+// handshake completes across the relay, and returns the CONNECTION_CLOSED
+// error wrapping the first peer's *websocket.CloseError.
+func WithRelayFrames() RelayOption {
+	return func(r *relay) {
+		r.frames = true
+	}
+}
+
+type relay struct {
+	filter func(from, to *websocket.Conn, msg *websocket.Message) *websocket.Message
+	frames bool // set with WithRelayFrames
+	once   sync.Once
+	err    error // the error that ended the relay
+}
+
+// Relay writes every text and binary message read from a to b, and every
+// one read from b to a, until either connection ends or ctx is done, and
+// closes both connections before returning.
+//
+// Pings and pongs are not relayed: each connection responds to the pings
+// of its own peer as usual, so keepalives work on both sides of the relay
+// independently. Once a peer closes its connection, the other connection
+// is closed with the same code and reason, and Relay returns the error
+// Read returned for the close, which wraps the peer's *websocket.CloseError.
+// A close frame without a code is relayed as CloseNormalClosure, and a
+// connection ending without a close frame or with any other error makes
+// the other connection close with CloseGoingAway. If writing a message
+// fails, both connections are closed with CloseGoingAway and the error is
+// returned. If ctx is done first,
+// both connections are closed with CloseGoingAway and ctx.Err() is
+// returned. WithRelayFrames relays frames instead, including pings and
+// close frames.
+func Relay(ctx context.Context, a, b *websocket.Conn, opts ...RelayOption) error {
+	r := new(relay)
+	for _, opt := range opts {
+		opt(r)
+	}
+
+	stop := context.AfterFunc(ctx, func() {
+		a.CloseWithCode(websocket.CloseGoingAway, "")
+		b.CloseWithCode(websocket.CloseGoingAway, "")
+	})
+	defer stop()
+
+	// done receives whether each direction ended by forwarding a close
+	// frame, in which case the other is left to forward the response
+	done := make(chan bool, 2)
+	run := r.run
+	if r.frames {
+		run = r.runFrames
+	}
+	go func() { done <- run(a, b) }()
+	go func() { done <- run(b, a) }()
+	if closing := <-done; !closing {
+		a.Close()
+		b.Close()
+	}
+	<-done
+	a.Close()
+	b.Close()
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return r.err
+}
+
+// run relays the messages read from from to to until either connection
+// ends. If reading from from fails, to is closed with the close code of
+// from; if writing to to fails, both are closed. It always returns false,
+// since close frames are not forwarded.
+func (r *relay) run(from, to *websocket.Conn) bool {
+	for {
+		msg, err := from.Read()
+		if err != nil {
+			r.end(err)
+			to.CloseWithCode(relayCloseCode(err))
+			return false
+		}
+		if !msg.IsData() {
+			continue
+		}
+		if r.filter != nil {
+			if msg = r.filter(from, to, msg); msg == nil {
+				continue
+			}
+		}
+		if err := to.Write(msg); err != nil {
+			r.end(err)
+			to.CloseWithCode(websocket.CloseGoingAway, "")
+			from.CloseWithCode(websocket.CloseGoingAway, "")
+			return false
+		}
+	}
+}
+
+// runFrames is run for WithRelayFrames, forwarding frames instead of
+// messages. It returns true once it forwards a close frame, since the
+// connections close themselves once the response is forwarded too.
+func (r *relay) runFrames(from, to *websocket.Conn) bool {
+	for {
+		f, err := from.ReadFrame()
+		if err != nil {
+			r.end(err)
+			to.CloseWithCode(relayCloseCode(err))
+			return false
+		}
+		if err := to.WriteFrame(f); err != nil {
+			r.end(err)
+			to.CloseWithCode(websocket.CloseGoingAway, "")
+			from.CloseWithCode(websocket.CloseGoingAway, "")
+			return false
+		}
+		if f.Opcode == websocket.MessageClose.Opcode() {
+			r.end(from.Err())
+			return true
+		}
+	}
+}
+
+// end records err as the error that ended the relay, unless the other
+// direction ended first. It must be called before closing either
+// connection, since that ends the other direction too.
+func (r *relay) end(err error) {
+	r.once.Do(func() {
+		r.err = err
+	})
+}
+
+// relayCloseCode returns the code and reason to close a connection with
+// when relaying err from the other connection.
+func relayCloseCode(err error) (int, string) {
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) {
+		return websocket.CloseGoingAway, ""
+	}
+	switch ce.Code {
+	case websocket.CloseNoStatusReceived:
+		return websocket.CloseNormalClosure, ""
+	case websocket.CloseAbnormalClosure, websocket.CloseTLSHandshake:
+		return websocket.CloseGoingAway, ""
+	}
+	return ce.Code, ce.Reason
+}
@@ -0,0 +1,212 @@
+package extended_test
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// startRelay relays between two pipes and returns their other ends, and a
+// channel receiving the error Relay returns.
+func startRelay(ctx context.Context, opts ...extended.RelayOption) (*websocket.Conn, *websocket.Conn, <-chan error) {
+	a, relayA := pipe()
+	relayB, b := pipe()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- extended.Relay(ctx, relayA, relayB, opts...)
+	}()
+	return a, b, errs
+}
+
+// relayed writes msg to from and fails the test unless it is read from to.
+func relayed(t *testing.T, from, to *websocket.Conn, msg *websocket.Message) {
+	t.Helper()
+	go from.Write(msg)
+	got, err := to.Read()
+	if err != nil {
+		t.Fatalf("reading the relayed message: %v", err)
+	}
+	if got.Type != msg.Type || string(got.Data) != string(msg.Data) {
+		t.Fatalf("expected %s %q, got %s %q", msg.Type, msg.Data, got.Type, got.Data)
+	}
+}
+
+// relayError waits for the error Relay returns.
+func relayError(t *testing.T, errs <-chan error) error {
+	t.Helper()
+	select {
+	case err := <-errs:
+		return err
+	case <-time.After(2 * time.Second):
+		t.Fatalf("expected the relay to end")
+		return nil
+	}
+}
+
+func TestRelay(t *testing.T) {
+	a, b, errs := startRelay(context.Background())
+	defer a.Close()
+	defer b.Close()
+
+	relayed(t, a, b, &websocket.Message{Type: websocket.MessageText, Data: []byte("hello")})
+	relayed(t, b, a, &websocket.Message{Type: websocket.MessageBinary, Data: []byte{1, 2, 3}})
+	relayed(t, a, b, &websocket.Message{Type: websocket.MessageBinary, Data: []byte(strings.Repeat("x", 100000))})
+
+	go a.CloseWithCode(4001, "done")
+	_, err := b.Read()
+	if !websocket.IsCloseError(err, 4001) {
+		t.Fatalf("expected b to be closed with code 4001, got %v", err)
+	}
+	var ce *websocket.CloseError
+	if !errors.As(err, &ce) || ce.Reason != "done" {
+		t.Fatalf("expected the close reason to be relayed, got %v", err)
+	}
+
+	if err := relayError(t, errs); !websocket.IsCloseError(err, 4001) {
+		t.Fatalf("expected the relay to end with the close error of a, got %v", err)
+	}
+}
+
+func TestRelay_Ping(t *testing.T) {
+	a, b, _ := startRelay(context.Background())
+	defer a.Close()
+	defer b.Close()
+
+	// pings are responded to by the relay, not relayed to a
+	go readLoop(b)
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := b.PingRTT(ctx); err != nil {
+		t.Fatalf("expected the relay to respond to the ping, got %v", err)
+	}
+}
+
+func TestRelay_CloseCodes(t *testing.T) {
+	tests := []struct {
+		name  string
+		close func(conn *websocket.Conn)
+		code  int
+	}{
+		{"code", func(conn *websocket.Conn) { conn.CloseWithCode(websocket.CloseServiceRestart, "") }, websocket.CloseServiceRestart},
+		{"abnormal", func(conn *websocket.Conn) { conn.Close() }, websocket.CloseGoingAway},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			a, b, errs := startRelay(context.Background())
+			defer b.Close()
+			go test.close(a)
+			if _, err := b.Read(); !websocket.IsCloseError(err, test.code) {
+				t.Fatalf("expected b to be closed with code %d, got %v", test.code, err)
+			}
+			relayError(t, errs)
+		})
+	}
+}
+
+func TestRelay_Context(t *testing.T) {
+	ctx, cancel := context.WithCancel(context.Background())
+	a, b, errs := startRelay(ctx)
+	go readLoop(a)
+
+	cancel()
+	if _, err := b.Read(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected b to be closed with CloseGoingAway, got %v", err)
+	}
+	if err := relayError(t, errs); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected the relay to return context.Canceled, got %v", err)
+	}
+	waitFor(t, time.Second, a.Closed)
+}
+
+func TestRelay_Filter(t *testing.T) {
+	filter := func(from, to *websocket.Conn, msg *websocket.Message) *websocket.Message {
+		switch string(msg.Data) {
+		case "secret":
+			return nil
+		case "lower":
+			return &websocket.Message{Type: msg.Type, Data: []byte("LOWER")}
+		}
+		return msg
+	}
+	a, b, _ := startRelay(context.Background(), extended.WithRelayFilter(filter))
+	defer a.Close()
+	defer b.Close()
+
+	go func() {
+		for _, data := range []string{"secret", "lower", "hello"} {
+			a.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte(data)})
+		}
+	}()
+	for _, want := range []string{"LOWER", "hello"} {
+		msg, err := b.Read()
+		if err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+		if string(msg.Data) != want {
+			t.Fatalf("expected %q, got %q", want, msg.Data)
+		}
+	}
+}
+
+// forwarded writes b to from and fails the test unless the same bytes are
+// read from to.
+func forwarded(t *testing.T, from, to net.Conn, b []byte) {
+	t.Helper()
+	go from.Write(b)
+	got := make([]byte, len(b))
+	if _, err := io.ReadFull(to, got); err != nil {
+		t.Fatalf("reading the forwarded bytes: %v", err)
+	}
+	if !bytes.Equal(got, b) {
+		t.Fatalf("expected the bytes to be forwarded unchanged")
+	}
+}
+
+func TestRelay_Frames(t *testing.T) {
+	client, relayClient := net.Pipe()
+	relayServer, server := net.Pipe()
+	defer client.Close()
+	defer server.Close()
+	errs := make(chan error, 1)
+	go func() {
+		a := websocket.From(relayClient)
+		b := websocket.From(relayServer, websocket.WithRole(websocket.RoleClient))
+		errs <- extended.Relay(context.Background(), a, b, extended.WithRelayFrames())
+	}()
+
+	// a fragmented message with rsv1 set and a ping between its fragments,
+	// although compression was not negotiated
+	key := [4]byte{1, 2, 3, 4}
+	var fromClient []byte
+	for _, f := range []websocket.Frame{
+		{Rsv: [3]bool{true}, Opcode: 0x1, Masked: true, MaskKey: key, Payload: []byte("compressed")},
+		{Fin: true, Opcode: 0x9, Masked: true, MaskKey: key, Payload: []byte("ping")},
+		{Opcode: 0x0, Masked: true, MaskKey: key, Payload: bytes.Repeat([]byte("x"), 70000)},
+		{Fin: true, Opcode: 0x0, Masked: true, MaskKey: key, Payload: []byte("end")},
+	} {
+		fromClient = f.AppendMarshal(fromClient)
+	}
+	forwarded(t, client, server, fromClient)
+	pong := websocket.Frame{Fin: true, Opcode: 0xA, Payload: []byte("ping")}
+	forwarded(t, server, client, pong.AppendMarshal(nil))
+
+	closeFrame := websocket.Frame{Fin: true, Opcode: 0x8, Masked: true, MaskKey: key, Payload: binary.BigEndian.AppendUint16(nil, 4001)}
+	forwarded(t, client, server, closeFrame.AppendMarshal(nil))
+	closeFrame.Masked = false
+	forwarded(t, server, client, closeFrame.AppendMarshal(nil))
+	if err := relayError(t, errs); !websocket.IsCloseError(err, 4001) {
+		t.Fatalf("expected the relay to end with the close error of the client, got %v", err)
+	}
+	if _, err := client.Read(make([]byte, 1)); err != io.EOF {
+		t.Fatalf("expected the relay to close the connections once the closing handshake completed, got %v", err)
+	}
+}
@@ -0,0 +1,205 @@
+package extended
+
+import (
+	"context"
+	"encoding/json"
+	"sync"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// Envelope is the shape of the messages routed by a Router:
+//
+//	{"type": "chat.send", "payload": {...}}
+type Envelope struct {
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
+}
+
+// ErrorPayload is the payload of the messages of type "error" a Router
+// replies with when a message cannot be handled.
+type ErrorPayload struct {
+	// Type is the type of the message that could not be handled. It is
+	// empty if the message is not a valid envelope.
+	Type  string `json:"type,omitempty"`
+	Error string `json:"error"`
+}
+
+// HandlerFunc handles the payload of a message routed by a Router. If it
+// returns an error, the error is sent back to the peer.
+type HandlerFunc func(ctx context.Context, conn *websocket.Conn, payload json.RawMessage) error
+
+// Middleware wraps a HandlerFunc, for example to check authentication or to
+// log messages. The type of the message being handled is available with
+// RouteType.
+type Middleware func(next HandlerFunc) HandlerFunc
+
+// MalformedPolicy is what a Router does with a message that is not a valid
+// envelope.
+type MalformedPolicy int
+
+const (
+	// MalformedReply replies with an error message and keeps serving.
+	MalformedReply MalformedPolicy = iota
+	// MalformedIgnore drops the message and keeps serving.
+	MalformedIgnore
+	// MalformedClose closes the connection with 1007 (invalid frame
+	// payload data).
+	MalformedClose
+)
+
+type routeTypeKey struct{}
+
+// RouteType returns the type of the message being handled, from the
+// context passed to a HandlerFunc by a Router.
+func RouteType(ctx context.Context) string {
+	typ, _ := ctx.Value(routeTypeKey{}).(string)
+	return typ
+}
+
+// Router dispatches JSON messages to handlers by the type field of their
+// envelope. Handlers and middleware may be added while it is serving.
+type Router struct {
+	// Malformed is what to do with messages that are not a valid envelope.
+	// It defaults to MalformedReply.
+	Malformed MalformedPolicy
+	// Validator, if set, checks the payload of every message with a
+	// handler before the handler is called.
+	Validator Validator
+	// Invalid is what to do with messages Validator rejects. It defaults to
+	// InvalidReply.
+	Invalid InvalidPolicy
+	// OnInvalid, if set, is called with the type of every message Validator
+	// rejects and the reason, for example to count them.
+	OnInvalid func(messageType string, err error)
+
+	mx                sync.RWMutex
+	handlers          map[string]HandlerFunc
+	middleware        []Middleware
+	messageMiddleware []MessageMiddleware
+}
+
+// NewRouter returns a Router with no handlers.
+func NewRouter() *Router {
+	return &Router{handlers: make(map[string]HandlerFunc)}
+}
+
+// Handle registers h for messages of the type specified, replacing any
+// handler already registered for it.
+func (r *Router) Handle(typ string, h HandlerFunc) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.handlers[typ] = h
+}
+
+// Use adds middleware that wraps every handler. Middleware added first is
+// the outermost, so it is called first.
+func (r *Router) Use(mw ...Middleware) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.middleware = append(r.middleware, mw...)
+}
+
+// UseMessage adds middleware that every text and binary message goes
+// through before it is parsed, in the order it is added. Unlike the
+// middleware added with Use, it sees messages without a handler and
+// malformed messages too, and it can drop a message by not calling next.
+// The values it attaches to the context of a message are available to
+// the handler of the message.
+func (r *Router) UseMessage(mw ...MessageMiddleware) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.messageMiddleware = append(r.messageMiddleware, mw...)
+}
+
+// Serve reads messages from conn and dispatches them until reading fails,
+// returning the error. Messages are handled one at a time, in the order
+// they are received. Control messages are handled by conn as usual, and
+// binary messages are ignored after going through the middleware added
+// with UseMessage.
+//
+// A message with a type that has no handler, that is rejected by the
+// Validator (unless Invalid is InvalidClose), or for which the handler
+// returns an error, is replied to with a message of type "error" with an
+// ErrorPayload. If the reply cannot be written, Serve returns the error.
+func (r *Router) Serve(conn *websocket.Conn) error {
+	var dispatchErr error
+	dispatch := func(ctx context.Context, conn *websocket.Conn, msg *websocket.Message) {
+		if msg.Type == websocket.MessageText {
+			dispatchErr = r.dispatch(ctx, conn, msg.Data)
+		}
+	}
+	for {
+		msg, err := conn.Read()
+		if err != nil {
+			return err
+		}
+		if !msg.IsData() {
+			continue
+		}
+		r.mx.RLock()
+		handle := Chain(dispatch, r.messageMiddleware...)
+		r.mx.RUnlock()
+		if handle(conn.Context(), conn, msg); dispatchErr != nil {
+			return dispatchErr
+		}
+	}
+}
+
+// dispatch handles a single message. It returns an error if a reply could
+// not be written or the connection was closed.
+func (r *Router) dispatch(ctx context.Context, conn *websocket.Conn, data []byte) error {
+	var env Envelope
+	if err := json.Unmarshal(data, &env); err != nil || env.Type == "" {
+		switch r.Malformed {
+		case MalformedIgnore:
+			return nil
+		case MalformedClose:
+			conn.CloseWithCode(websocket.CloseInvalidFramePayloadData, "malformed message")
+			return conn.Err()
+		default:
+			return r.reply(conn, ErrorPayload{Error: "malformed message"})
+		}
+	}
+
+	r.mx.RLock()
+	h, ok := r.handlers[env.Type]
+	middleware := r.middleware
+	r.mx.RUnlock()
+	if !ok {
+		return r.reply(conn, ErrorPayload{Type: env.Type, Error: "unknown message type"})
+	}
+	if r.Validator != nil {
+		if err := r.Validator.Validate(env.Type, env.Payload); err != nil {
+			if r.OnInvalid != nil {
+				r.OnInvalid(env.Type, err)
+			}
+			if r.Invalid == InvalidClose {
+				conn.CloseWithCode(websocket.ClosePolicyViolation, "invalid message")
+				return conn.Err()
+			}
+			return r.reply(conn, ErrorPayload{Type: env.Type, Error: "invalid message: " + err.Error()})
+		}
+	}
+	for i := len(middleware) - 1; i >= 0; i-- {
+		h = middleware[i](h)
+	}
+
+	ctx = context.WithValue(ctx, routeTypeKey{}, env.Type)
+	if err := h(ctx, conn, env.Payload); err != nil {
+		return r.reply(conn, ErrorPayload{Type: env.Type, Error: err.Error()})
+	}
+	return nil
+}
+
+// reply sends an error message to conn.
+func (r *Router) reply(conn *websocket.Conn, payload ErrorPayload) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	if err := conn.WriteVia(websocket.JSONCodec{}, Envelope{Type: "error", Payload: data}); err != nil {
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,147 @@
+package extended_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strings"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// serveRouter serves r on one end of a pipe and returns the other end.
+func serveRouter(t *testing.T, r *extended.Router) *websocket.Conn {
+	t.Helper()
+	server, client := pipe()
+	go r.Serve(server)
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	return client
+}
+
+func send(t *testing.T, conn *websocket.Conn, data string) {
+	t.Helper()
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte(data)}); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+}
+
+func receive(t *testing.T, conn *websocket.Conn) extended.Envelope {
+	t.Helper()
+	var env extended.Envelope
+	if err := conn.ReadVia(websocket.JSONCodec{}, &env); err != nil {
+		t.Fatalf("expected no error from ReadVia(), got %v", err)
+	}
+	return env
+}
+
+func receiveError(t *testing.T, conn *websocket.Conn) extended.ErrorPayload {
+	t.Helper()
+	env := receive(t, conn)
+	if env.Type != "error" {
+		t.Fatalf("expected an error message, got %s", env.Type)
+	}
+	var payload extended.ErrorPayload
+	if err := json.Unmarshal(env.Payload, &payload); err != nil {
+		t.Fatalf("expected an ErrorPayload, got %s", env.Payload)
+	}
+	return payload
+}
+
+func newEchoRouter() *extended.Router {
+	r := extended.NewRouter()
+	r.Handle("echo", func(ctx context.Context, conn *websocket.Conn, payload json.RawMessage) error {
+		return conn.WriteVia(websocket.JSONCodec{}, extended.Envelope{Type: "echo", Payload: payload})
+	})
+	r.Handle("fail", func(ctx context.Context, conn *websocket.Conn, payload json.RawMessage) error {
+		return errors.New("boom")
+	})
+	return r
+}
+
+func TestRouter(t *testing.T) {
+	client := serveRouter(t, newEchoRouter())
+
+	send(t, client, `{"type":"echo","payload":{"text":"hi"}}`)
+	if env := receive(t, client); env.Type != "echo" || string(env.Payload) != `{"text":"hi"}` {
+		t.Fatalf("expected the payload to be echoed, got %s %s", env.Type, env.Payload)
+	}
+
+	send(t, client, `{"type":"fail"}`)
+	if payload := receiveError(t, client); payload.Type != "fail" || payload.Error != "boom" {
+		t.Fatalf("expected the handler's error, got %+v", payload)
+	}
+
+	send(t, client, `{"type":"missing"}`)
+	if payload := receiveError(t, client); payload.Type != "missing" || payload.Error != "unknown message type" {
+		t.Fatalf("expected an unknown message type error, got %+v", payload)
+	}
+
+	send(t, client, `not json`)
+	if payload := receiveError(t, client); payload.Error != "malformed message" {
+		t.Fatalf("expected a malformed message error, got %+v", payload)
+	}
+}
+
+func TestRouter_Middleware(t *testing.T) {
+	r := newEchoRouter()
+	r.Handle("admin.echo", func(ctx context.Context, conn *websocket.Conn, payload json.RawMessage) error {
+		return conn.WriteVia(websocket.JSONCodec{}, extended.Envelope{Type: "admin.echo"})
+	})
+	var calls []string
+	r.Use(func(next extended.HandlerFunc) extended.HandlerFunc {
+		return func(ctx context.Context, conn *websocket.Conn, payload json.RawMessage) error {
+			calls = append(calls, extended.RouteType(ctx))
+			return next(ctx, conn, payload)
+		}
+	}, func(next extended.HandlerFunc) extended.HandlerFunc {
+		return func(ctx context.Context, conn *websocket.Conn, payload json.RawMessage) error {
+			if strings.HasPrefix(extended.RouteType(ctx), "admin.") {
+				return errors.New("unauthorized")
+			}
+			return next(ctx, conn, payload)
+		}
+	})
+	client := serveRouter(t, r)
+
+	send(t, client, `{"type":"admin.echo"}`)
+	if payload := receiveError(t, client); payload.Error != "unauthorized" {
+		t.Fatalf("expected the middleware to reject the message, got %+v", payload)
+	}
+	send(t, client, `{"type":"echo"}`)
+	if env := receive(t, client); env.Type != "echo" {
+		t.Fatalf("expected the message to be handled, got %s", env.Type)
+	}
+	if len(calls) != 2 || calls[0] != "admin.echo" || calls[1] != "echo" {
+		t.Fatalf("expected the outer middleware to see both messages, got %v", calls)
+	}
+}
+
+func TestRouter_MalformedIgnore(t *testing.T) {
+	r := newEchoRouter()
+	r.Malformed = extended.MalformedIgnore
+	client := serveRouter(t, r)
+
+	send(t, client, `not json`)
+	send(t, client, `{"payload":1}`)
+	send(t, client, `{"type":"echo","payload":2}`)
+	if env := receive(t, client); env.Type != "echo" || string(env.Payload) != "2" {
+		t.Fatalf("expected malformed messages to be ignored, got %s %s", env.Type, env.Payload)
+	}
+}
+
+func TestRouter_MalformedClose(t *testing.T) {
+	r := newEchoRouter()
+	r.Malformed = extended.MalformedClose
+	client := serveRouter(t, r)
+
+	send(t, client, `not json`)
+	_, err := client.Read()
+	if !websocket.IsCloseError(err, websocket.CloseInvalidFramePayloadData) {
+		t.Fatalf("expected a close error with code %d, got %v", websocket.CloseInvalidFramePayloadData, err)
+	}
+}
@@ -0,0 +1,177 @@
+package extended
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// rpcMessage is a request or a response of an RPC, sent as a JSON text
+// message. Requests have a method and responses do not.
+type rpcMessage struct {
+	ID     uint64          `json:"id"`
+	Method string          `json:"method,omitempty"`
+	Params json.RawMessage `json:"params,omitempty"`
+	Result json.RawMessage `json:"result,omitempty"`
+	Error  *RPCError       `json:"error,omitempty"`
+}
+
+// RPCError is the error returned by Call when the handler of the call on
+// the other end returns an error, or when it has no handler for the
+// method.
+type RPCError struct {
+	Message string `json:"message"`
+}
+
+func (e *RPCError) Error() string {
+	return e.Message
+}
+
+// RPCHandler handles a call. Its result is encoded as JSON and sent back
+// to the caller. ctx is done once the connection is closed.
+type RPCHandler func(ctx context.Context, params json.RawMessage) (any, error)
+
+// RPC makes and serves request/response calls over a connection, in both
+// directions at once. It is created by NewRPC.
+type RPC struct {
+	conn *websocket.Conn
+
+	handlersMx sync.RWMutex
+	handlers   map[string]RPCHandler
+
+	mx      sync.Mutex
+	nextID  uint64
+	pending map[uint64]chan rpcMessage
+	err     error // why reading ended, once it has
+	done    chan struct{}
+}
+
+// NewRPC starts reading from conn in a new goroutine to receive calls and
+// responses. Nothing else should read from conn. Reading stops once the
+// connection is closed or reading fails, which fails every pending call.
+func NewRPC(conn *websocket.Conn) *RPC {
+	r := &RPC{
+		conn:     conn,
+		handlers: make(map[string]RPCHandler),
+		pending:  make(map[uint64]chan rpcMessage),
+		done:     make(chan struct{}),
+	}
+	OnMessage(conn, func(_ context.Context, msg *websocket.Message) { r.receive(msg) }, r.fail)
+	return r
+}
+
+// Handle registers h for calls of method, replacing any handler already
+// registered for it. Calls are handled concurrently, each in its own
+// goroutine.
+func (r *RPC) Handle(method string, h RPCHandler) {
+	r.handlersMx.Lock()
+	defer r.handlersMx.Unlock()
+	r.handlers[method] = h
+}
+
+// Call calls method on the other end with params encoded as JSON, and
+// waits for the result, which is returned as it was encoded by the other
+// end. Any amount of calls may be made at the same time.
+//
+// If the handler on the other end fails, Call returns an *RPCError. If ctx
+// is done before the response arrives, Call returns ctx.Err() and the
+// response is discarded whenever it arrives. If reading from the
+// connection ends, Call returns the error that ended it.
+func (r *RPC) Call(ctx context.Context, method string, params any) (json.RawMessage, error) {
+	data, err := json.Marshal(params)
+	if err != nil {
+		return nil, err
+	}
+
+	r.mx.Lock()
+	if r.err != nil {
+		r.mx.Unlock()
+		return nil, r.err
+	}
+	r.nextID++
+	id := r.nextID
+	response := make(chan rpcMessage, 1)
+	r.pending[id] = response
+	r.mx.Unlock()
+	defer func() {
+		r.mx.Lock()
+		delete(r.pending, id)
+		r.mx.Unlock()
+	}()
+
+	if err := r.conn.WriteVia(websocket.JSONCodec{}, rpcMessage{ID: id, Method: method, Params: data}); err != nil {
+		return nil, err
+	}
+	select {
+	case msg := <-response:
+		if msg.Error != nil {
+			return nil, msg.Error
+		}
+		return msg.Result, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-r.done:
+		return nil, r.Err()
+	}
+}
+
+// Err returns nil while reading, and the error that ended reading once it
+// has ended.
+func (r *RPC) Err() error {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.err
+}
+
+// receive handles a message read from the connection.
+func (r *RPC) receive(m *websocket.Message) {
+	var msg rpcMessage
+	if err := json.Unmarshal(m.Data, &msg); err != nil {
+		r.conn.Logger().Warn("received a malformed rpc message", "error", err.Error())
+		return
+	}
+	if msg.Method != "" {
+		go r.serve(msg)
+		return
+	}
+
+	r.mx.Lock()
+	response, ok := r.pending[msg.ID]
+	delete(r.pending, msg.ID)
+	r.mx.Unlock()
+	if !ok { // the call is not waiting for it anymore
+		r.conn.Logger().Debug("received a response to an unknown rpc call", "id", msg.ID)
+		return
+	}
+	response <- msg
+}
+
+// serve handles a call and sends its response.
+func (r *RPC) serve(req rpcMessage) {
+	res := rpcMessage{ID: req.ID}
+	r.handlersMx.RLock()
+	h, ok := r.handlers[req.Method]
+	r.handlersMx.RUnlock()
+	if !ok {
+		res.Error = &RPCError{Message: "unknown method " + req.Method}
+	} else if result, err := h(r.conn.Context(), req.Params); err != nil {
+		res.Error = &RPCError{Message: err.Error()}
+	} else if res.Result, err = json.Marshal(result); err != nil {
+		res.Error = &RPCError{Message: err.Error()}
+	}
+
+	if err := r.conn.WriteVia(websocket.JSONCodec{}, res); err != nil && !errors.Is(err, websocket.ErrConnectionClosed) {
+		r.conn.Logger().Error("an error occured while sending an rpc response", "error", err.Error())
+	}
+}
+
+// fail records the error that ended reading and fails the pending calls.
+func (r *RPC) fail(err error) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.err = err
+	close(r.done)
+}
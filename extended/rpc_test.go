@@ -0,0 +1,131 @@
+package extended_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// rpcPair returns two RPCs connected to each other, both serving "add".
+func rpcPair(t *testing.T) (*extended.RPC, *extended.RPC, *websocket.Conn) {
+	t.Helper()
+	server, client := pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	a, b := extended.NewRPC(server), extended.NewRPC(client)
+	for _, r := range []*extended.RPC{a, b} {
+		r.Handle("add", func(ctx context.Context, params json.RawMessage) (any, error) {
+			var n [2]int
+			if err := json.Unmarshal(params, &n); err != nil {
+				return nil, err
+			}
+			return n[0] + n[1], nil
+		})
+	}
+	return a, b, client
+}
+
+func TestRPC(t *testing.T) {
+	a, b, _ := rpcPair(t)
+
+	var wg sync.WaitGroup
+	for i := range 100 {
+		caller := a
+		if i%2 == 0 {
+			caller = b
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			result, err := caller.Call(context.Background(), "add", [2]int{i, 1000})
+			if err != nil {
+				t.Errorf("expected no error from Call(), got %v", err)
+				return
+			}
+			if string(result) != strconv.Itoa(i+1000) {
+				t.Errorf("expected %d, got %s", i+1000, result)
+			}
+		}()
+	}
+	wg.Wait()
+	if a.PendingCalls() != 0 || b.PendingCalls() != 0 {
+		t.Fatalf("expected no pending calls, got %d and %d", a.PendingCalls(), b.PendingCalls())
+	}
+}
+
+func TestRPC_Errors(t *testing.T) {
+	a, b, _ := rpcPair(t)
+	b.Handle("fail", func(ctx context.Context, params json.RawMessage) (any, error) {
+		return nil, errors.New("boom")
+	})
+
+	var rpcErr *extended.RPCError
+	if _, err := a.Call(context.Background(), "fail", nil); !errors.As(err, &rpcErr) || rpcErr.Message != "boom" {
+		t.Fatalf("expected the handler's error, got %v", err)
+	}
+	if _, err := a.Call(context.Background(), "missing", nil); !errors.As(err, &rpcErr) || rpcErr.Message != "unknown method missing" {
+		t.Fatalf("expected an unknown method error, got %v", err)
+	}
+}
+
+func TestRPC_Timeout(t *testing.T) {
+	a, b, _ := rpcPair(t)
+	release := make(chan struct{})
+	b.Handle("slow", func(ctx context.Context, params json.RawMessage) (any, error) {
+		<-release
+		return "late", nil
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 20*time.Millisecond)
+	defer cancel()
+	if _, err := a.Call(ctx, "slow", nil); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("expected context.DeadlineExceeded, got %v", err)
+	}
+	if a.PendingCalls() != 0 {
+		t.Fatalf("expected the timed out call to not be pending, got %d", a.PendingCalls())
+	}
+
+	// the late response is discarded and the connection keeps working
+	close(release)
+	result, err := a.Call(context.Background(), "add", [2]int{1, 2})
+	if err != nil || string(result) != "3" {
+		t.Fatalf("expected 3, got %s (%v)", result, err)
+	}
+}
+
+func TestRPC_Closed(t *testing.T) {
+	a, b, client := rpcPair(t)
+	b.Handle("never", func(ctx context.Context, params json.RawMessage) (any, error) {
+		<-ctx.Done()
+		return nil, ctx.Err()
+	})
+
+	result := make(chan error)
+	go func() {
+		_, err := a.Call(context.Background(), "never", nil)
+		result <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	client.Close()
+
+	select {
+	case err := <-result:
+		if !errors.Is(err, websocket.ErrConnectionClosed) {
+			t.Fatalf("expected CONNECTION_CLOSED error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected the pending call to fail once the connection is closed")
+	}
+	if _, err := a.Call(context.Background(), "add", [2]int{1, 2}); !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected CONNECTION_CLOSED error, got %v", err)
+	}
+}
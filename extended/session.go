@@ -0,0 +1,621 @@
+package extended
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// The session protocol lets a client resume a session over a new
+// connection without losing the messages the server sent in between.
+// Every frame of the protocol is a binary message:
+//
+//	+------+----------+---------+
+//	| kind | sequence | payload |
+//	| 1 B  | 8 B (BE) | ...     |
+//	+------+----------+---------+
+//
+// The kinds of frames are:
+//
+//   - resume (4) is the first frame the client sends on every connection.
+//     Its sequence is the sequence of the last message the client received
+//     in the session, or 0, and its payload is the version of the protocol
+//     (1 byte, currently 1) followed by the session token.
+//   - resumed (5) is the response of the server to resume. Its sequence is
+//     the sequence of the next message the client gets, and its payload is
+//     one byte of flags: 1 if an existing session was resumed, and 2 if
+//     messages after the client's last message were evicted and are lost.
+//   - text (1) and binary (2) carry a message of that type as the payload.
+//     The server numbers its messages from 1; the client sends its
+//     messages with sequence 0, since they are not buffered.
+//   - ack (3) is sent by the client for the messages it received, with the
+//     sequence of the last one, so the server stops buffering them.
+//
+// The server replays the messages after the sequence of resume before any
+// other message, and the client drops any message with a sequence it has
+// already received, so no message is lost or duplicated as long as the
+// server buffers it.
+const (
+	sessionText    byte = 1
+	sessionBinary  byte = 2
+	sessionAck     byte = 3
+	sessionResume  byte = 4
+	sessionResumed byte = 5
+)
+
+const (
+	// sessionVersion is the version of the session protocol.
+	sessionVersion = 1
+	// sessionHeaderLength is the length of the kind and sequence of a
+	// frame.
+	sessionHeaderLength = 9
+
+	sessionFlagResumed byte = 1
+	sessionFlagGap     byte = 2
+)
+
+var (
+	// ErrSessionClosed is returned by Session.Send once the session is
+	// closed or has expired.
+	ErrSessionClosed = errors.New("the session is closed")
+	// errSessionFrame is the error for a frame that is not valid.
+	errSessionFrame = errors.New("malformed session frame")
+)
+
+// encodeSessionFrame returns the binary message payload of a frame.
+func encodeSessionFrame(kind byte, seq uint64, payload []byte) []byte {
+	b := make([]byte, sessionHeaderLength, sessionHeaderLength+len(payload))
+	b[0] = kind
+	binary.BigEndian.PutUint64(b[1:], seq)
+	return append(b, payload...)
+}
+
+// decodeSessionFrame parses the payload of a message as a frame.
+func decodeSessionFrame(msg *websocket.Message) (kind byte, seq uint64, payload []byte, err error) {
+	if msg.Type != websocket.MessageBinary || len(msg.Data) < sessionHeaderLength {
+		return 0, 0, nil, errSessionFrame
+	}
+	return msg.Data[0], binary.BigEndian.Uint64(msg.Data[1:]), msg.Data[sessionHeaderLength:], nil
+}
+
+// SessionEviction determines what a Session does when its buffer is full.
+type SessionEviction uint8
+
+const (
+	// SessionEvictOldest drops the oldest buffered message. A client that
+	// resumes after it was dropped is told that messages were lost.
+	SessionEvictOldest SessionEviction = iota
+	// SessionEvictSession closes the session, so a client that resumes it
+	// starts a new session instead.
+	SessionEvictSession
+)
+
+// SessionOptions configures a SessionManager.
+type SessionOptions struct {
+	// BufferSize is the maximum amount of messages a session keeps until
+	// the client acknowledges them. The default is 1024.
+	BufferSize int
+	// Eviction determines what happens when the buffer is full.
+	Eviction SessionEviction
+	// Expiry is how long a session is kept without a connection before it
+	// is closed. The default is one minute.
+	Expiry time.Duration
+	// OnMessage is called with every text and binary message the client
+	// sends, from the goroutine reading its connection.
+	OnMessage func(s *Session, msg *websocket.Message)
+	// Store, if set, persists the messages of every session until the
+	// client acknowledges them, keyed by the token of the session, so that
+	// clients can resume their sessions after the process restarts. Only
+	// the last BufferSize messages of a session are kept in memory, and
+	// the messages before them are replayed from the store, so Eviction
+	// does not apply; the store decides how many messages are kept. Expiry
+	// still applies to the sessions in memory, and a session that expires
+	// or is closed is trimmed from the store.
+	Store OutboxStore
+}
+
+// SessionManager keeps the sessions of a server, keyed by the tokens
+// clients resume them with. A SessionManager is created by
+// NewSessionManager, and every method is safe to call concurrently.
+type SessionManager struct {
+	opts SessionOptions
+
+	mx       sync.Mutex
+	sessions map[string]*Session
+}
+
+// NewSessionManager returns a SessionManager without sessions.
+func NewSessionManager(opts SessionOptions) *SessionManager {
+	if opts.BufferSize <= 0 {
+		opts.BufferSize = 1024
+	}
+	if opts.Expiry <= 0 {
+		opts.Expiry = time.Minute
+	}
+	return &SessionManager{opts: opts, sessions: make(map[string]*Session)}
+}
+
+// Attach reads the resume frame of a client from conn, and attaches conn to
+// the session with its token, creating the session if there is none. The
+// messages the client has not received yet are written to conn before
+// Attach returns, and conn is read from until it ends, so it must not be
+// read from directly. If the session already has a connection, it is
+// closed with CloseGoingAway.
+//
+// If ctx is done before the client's resume frame is read, conn is closed
+// and ctx.Err() is returned. conn is closed with CloseProtocolError if the
+// frame is not valid.
+func (m *SessionManager) Attach(ctx context.Context, conn *websocket.Conn) (*Session, error) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	msg, err := readDataMessage(conn)
+	if !stop() {
+		return nil, ctx.Err()
+	}
+	if err != nil {
+		return nil, err
+	}
+	kind, ack, payload, ferr := decodeSessionFrame(msg)
+	switch {
+	case ferr != nil || kind != sessionResume || len(payload) < 2:
+		conn.CloseWithCode(websocket.CloseProtocolError, "")
+		return nil, fmt.Errorf("%w: expected a resume frame", errSessionFrame)
+	case payload[0] != sessionVersion:
+		conn.CloseWithCode(websocket.CloseProtocolError, "unsupported session protocol version")
+		return nil, fmt.Errorf("unsupported session protocol version %d", payload[0])
+	}
+	token := string(payload[1:])
+
+	m.mx.Lock()
+	s, resumed := m.sessions[token]
+	m.mx.Unlock()
+	if !resumed {
+		restored, err := m.restore(token)
+		if err != nil {
+			conn.CloseWithCode(websocket.CloseInternalServerErr, "")
+			return nil, err
+		}
+		m.mx.Lock()
+		if s, resumed = m.sessions[token]; !resumed {
+			s, resumed = restored, restored != nil
+			if s == nil {
+				s = &Session{manager: m, token: token, next: 1}
+			}
+			m.sessions[token] = s
+		}
+		m.mx.Unlock()
+	}
+
+	if err := s.attach(conn, ack, resumed); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// restore returns the session with token from the messages of the store,
+// or nil if it has none, such as when the process restarted since the
+// session was created.
+func (m *SessionManager) restore(token string) (*Session, error) {
+	if m.opts.Store == nil {
+		return nil, nil
+	}
+	stored, err := m.opts.Store.ReadFrom(token, 0)
+	if err != nil || len(stored) == 0 {
+		return nil, err
+	}
+	s := &Session{manager: m, token: token, next: stored[len(stored)-1].Seq + 1}
+	for _, msg := range stored[max(len(stored)-m.opts.BufferSize, 0):] {
+		s.buf = append(s.buf, newSessionMessage(msg.Seq, msg.Message))
+	}
+	return s, nil
+}
+
+// Session returns the session with the token specified, if there is one.
+// With a Store, a session that is not in memory is restored from the
+// messages of the store, so that messages can be sent to a client that has
+// not resumed its session since the process restarted; it expires like a
+// session whose connection ended.
+func (m *SessionManager) Session(token string) (*Session, bool) {
+	m.mx.Lock()
+	s, ok := m.sessions[token]
+	m.mx.Unlock()
+	if ok {
+		return s, true
+	}
+	restored, err := m.restore(token)
+	if err != nil || restored == nil {
+		return nil, false
+	}
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if s, ok := m.sessions[token]; ok {
+		return s, true
+	}
+	restored.expiry = time.AfterFunc(m.opts.Expiry, restored.expire)
+	m.sessions[token] = restored
+	return restored, true
+}
+
+// Len returns the amount of sessions.
+func (m *SessionManager) Len() int {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	return len(m.sessions)
+}
+
+// remove forgets s.
+func (m *SessionManager) remove(s *Session) {
+	m.mx.Lock()
+	defer m.mx.Unlock()
+	if m.sessions[s.token] == s {
+		delete(m.sessions, s.token)
+	}
+}
+
+// Session is a session of a client that outlives its connections. It is
+// created by SessionManager.Attach.
+type Session struct {
+	manager *SessionManager
+	token   string
+
+	// wmx is held while writing, so messages are written in the order of
+	// their sequence and replayed messages come before new ones
+	wmx sync.Mutex
+
+	mx     sync.Mutex
+	conn   *websocket.Conn // nil while detached
+	buf    []sessionMessage
+	next   uint64 // the sequence of the next message
+	closed bool
+	expiry *time.Timer
+}
+
+// sessionMessage is a buffered message of a session.
+type sessionMessage struct {
+	seq   uint64
+	frame []byte
+}
+
+// Token returns the token of the session.
+func (s *Session) Token() string {
+	return s.token
+}
+
+// Conn returns the connection attached to the session, or nil if there is
+// none.
+func (s *Session) Conn() *websocket.Conn {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return s.conn
+}
+
+// Buffered returns the amount of messages the client has not acknowledged
+// that are kept in memory.
+func (s *Session) Buffered() int {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	return len(s.buf)
+}
+
+// newSessionMessage returns the buffered message for msg, which must be a
+// data message.
+func newSessionMessage(seq uint64, msg *websocket.Message) sessionMessage {
+	kind := sessionText
+	if msg.Type == websocket.MessageBinary {
+		kind = sessionBinary
+	}
+	return sessionMessage{seq: seq, frame: encodeSessionFrame(kind, seq, msg.Data)}
+}
+
+// Send sends a text or binary message to the client. The message is
+// buffered until the client acknowledges it, and written to the connection
+// if one is attached; if writing fails, the connection is detached and the
+// message is written once the client resumes the session. Send only
+// returns an error if msg is not a data message, the session is closed, or
+// the message could not be appended to the store.
+func (s *Session) Send(msg *websocket.Message) error {
+	if msg.Type != websocket.MessageText && msg.Type != websocket.MessageBinary {
+		return fmt.Errorf("cannot send messages of type %s in a session", msg.Type)
+	}
+
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		return ErrSessionClosed
+	}
+	store := s.manager.opts.Store
+	if store != nil {
+		if err := store.Append(s.token, OutboxMessage{Seq: s.next, Message: msg}); err != nil {
+			s.mx.Unlock()
+			return err
+		}
+	}
+	m := newSessionMessage(s.next, msg)
+	s.next++
+	if len(s.buf) == s.manager.opts.BufferSize {
+		if store == nil && s.manager.opts.Eviction == SessionEvictSession {
+			s.mx.Unlock()
+			s.Close()
+			return ErrSessionClosed
+		}
+		s.buf = s.buf[1:]
+	}
+	s.buf = append(s.buf, m)
+	conn := s.conn
+	s.mx.Unlock()
+
+	if conn != nil {
+		if err := conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: m.frame}); err != nil {
+			s.detach(conn)
+		}
+	}
+	return nil
+}
+
+// attach makes conn the connection of the session, responds to the resume
+// frame of the client, and replays the messages after ack.
+func (s *Session) attach(conn *websocket.Conn, ack uint64, resumed bool) error {
+	s.wmx.Lock()
+	defer s.wmx.Unlock()
+	s.mx.Lock()
+	if s.closed {
+		s.mx.Unlock()
+		conn.CloseWithCode(websocket.CloseGoingAway, "")
+		return ErrSessionClosed
+	}
+	old := s.conn
+	s.conn = conn // Send waits for wmx, so it writes after the replay
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	s.ack(ack)
+	first := s.next
+	if len(s.buf) > 0 {
+		first = s.buf[0].seq
+	}
+	replay := append([]sessionMessage(nil), s.buf...)
+	next := s.next
+	s.mx.Unlock()
+
+	if old != nil {
+		old.CloseWithCode(websocket.CloseGoingAway, "")
+	}
+	if store := s.manager.opts.Store; store != nil {
+		s.trim(conn, ack)
+		// the messages before the ones in memory are replayed from the
+		// store, which has the messages after them too
+		if first > ack+1 && next > ack+1 {
+			stored, err := store.ReadFrom(s.token, ack+1)
+			if err != nil {
+				s.detach(conn)
+				return err
+			}
+			first, replay = next, replay[:0]
+			if len(stored) > 0 {
+				first = stored[0].Seq
+			}
+			for _, msg := range stored {
+				replay = append(replay, newSessionMessage(msg.Seq, msg.Message))
+			}
+		}
+	}
+	var flags byte
+	if resumed {
+		flags |= sessionFlagResumed
+	}
+	if resumed && first > ack+1 {
+		flags |= sessionFlagGap
+	}
+	// acks are read while replaying, since the client may wait for them
+	// to be read before reading more
+	go s.read(conn)
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: encodeSessionFrame(sessionResumed, first, []byte{flags})}); err != nil {
+		s.detach(conn)
+		return err
+	}
+	for _, m := range replay {
+		if err := conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: m.frame}); err != nil {
+			s.detach(conn)
+			return err
+		}
+	}
+	return nil
+}
+
+// read handles the frames the client sends on conn until it ends.
+func (s *Session) read(conn *websocket.Conn) {
+	defer s.detach(conn)
+	for {
+		msg, err := readDataMessage(conn)
+		if err != nil {
+			return
+		}
+		kind, seq, payload, err := decodeSessionFrame(msg)
+		switch {
+		case err != nil:
+		case kind == sessionAck:
+			s.mx.Lock()
+			s.ack(seq)
+			s.mx.Unlock()
+			s.trim(conn, seq)
+			continue
+		case kind == sessionText && s.manager.opts.OnMessage != nil:
+			s.manager.opts.OnMessage(s, &websocket.Message{Type: websocket.MessageText, Data: payload})
+			continue
+		case kind == sessionBinary && s.manager.opts.OnMessage != nil:
+			s.manager.opts.OnMessage(s, &websocket.Message{Type: websocket.MessageBinary, Data: payload})
+			continue
+		case kind == sessionText || kind == sessionBinary:
+			continue
+		}
+		conn.CloseWithCode(websocket.CloseProtocolError, "")
+		return
+	}
+}
+
+// ack drops the buffered messages up to seq. The mutex must be held.
+func (s *Session) ack(seq uint64) {
+	i := 0
+	for i < len(s.buf) && s.buf[i].seq <= seq {
+		i++
+	}
+	s.buf = s.buf[i:]
+}
+
+// trim drops the messages up to seq from the store, if any.
+func (s *Session) trim(conn *websocket.Conn, seq uint64) {
+	if store := s.manager.opts.Store; store != nil && seq > 0 {
+		if err := store.Trim(s.token, seq); err != nil {
+			conn.Logger().Error("an error occured while trimming the messages of a session from the store", "error", err.Error())
+		}
+	}
+}
+
+// detach detaches conn from the session if it is attached, closes it, and
+// closes the session if it is not resumed before it expires.
+func (s *Session) detach(conn *websocket.Conn) {
+	conn.Close()
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.conn != conn {
+		return
+	}
+	s.conn = nil
+	if !s.closed {
+		s.expiry = time.AfterFunc(s.manager.opts.Expiry, s.expire)
+	}
+}
+
+// expire closes the session if it still has no connection.
+func (s *Session) expire() {
+	s.mx.Lock()
+	detached := s.conn == nil
+	s.mx.Unlock()
+	if detached {
+		s.Close()
+	}
+}
+
+// Close closes the session and its connection, if any, with
+// CloseNormalClosure. A client that resumes it starts a new session.
+func (s *Session) Close() error {
+	s.manager.remove(s)
+	s.mx.Lock()
+	s.closed = true
+	s.buf = nil
+	conn := s.conn
+	s.conn = nil
+	if s.expiry != nil {
+		s.expiry.Stop()
+	}
+	last := s.next - 1
+	s.mx.Unlock()
+	var err error
+	if store := s.manager.opts.Store; store != nil {
+		err = store.Trim(s.token, last)
+	}
+	if conn != nil {
+		return errors.Join(err, conn.CloseWithCode(websocket.CloseNormalClosure, ""))
+	}
+	return err
+}
+
+// SessionClient is the client side of a session of a SessionManager. It
+// keeps the token and the sequence of the last message received across
+// the connections it is attached to. A SessionClient is created by
+// NewSessionClient, and is not safe to use from several goroutines at
+// once.
+type SessionClient struct {
+	token string
+	last  uint64 // the sequence of the last message received
+	conn  *websocket.Conn
+}
+
+// NewSessionClient returns a SessionClient for the session with the token
+// specified, which should be random and long enough not to be guessed.
+func NewSessionClient(token string) *SessionClient {
+	return &SessionClient{token: token}
+}
+
+// Attach resumes the session over conn, which is used by Read and Write
+// from then on. It reports whether the session continues without any lost
+// messages: false means the server started a new session, or dropped
+// messages the client had not received. If ctx is done before the server
+// responds, conn is closed and ctx.Err() is returned.
+func (c *SessionClient) Attach(ctx context.Context, conn *websocket.Conn) (continuous bool, err error) {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+
+	payload := append([]byte{sessionVersion}, c.token...)
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: encodeSessionFrame(sessionResume, c.last, payload)}); err != nil {
+		return false, err
+	}
+	msg, rerr := readDataMessage(conn)
+	if ctx.Err() != nil {
+		return false, ctx.Err()
+	}
+	if rerr != nil {
+		return false, rerr
+	}
+	kind, first, flags, ferr := decodeSessionFrame(msg)
+	if ferr != nil || kind != sessionResumed || len(flags) != 1 {
+		conn.CloseWithCode(websocket.CloseProtocolError, "")
+		return false, fmt.Errorf("%w: expected a resumed frame", errSessionFrame)
+	}
+	if flags[0]&sessionFlagResumed == 0 {
+		c.last = first - 1 // a new session starts from its first message
+	}
+	c.conn = conn
+	return flags[0]&sessionFlagResumed != 0 && flags[0]&sessionFlagGap == 0, nil
+}
+
+// Read reads the next message of the session from the attached connection
+// and acknowledges it, skipping messages that were already received.
+func (c *SessionClient) Read() (*websocket.Message, error) {
+	for {
+		msg, err := readDataMessage(c.conn)
+		if err != nil {
+			return nil, err
+		}
+		kind, seq, payload, err := decodeSessionFrame(msg)
+		if err != nil || (kind != sessionText && kind != sessionBinary) {
+			c.conn.CloseWithCode(websocket.CloseProtocolError, "")
+			return nil, errSessionFrame
+		}
+		if seq <= c.last { // replayed after it was received
+			continue
+		}
+		c.last = seq
+		if err := c.conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: encodeSessionFrame(sessionAck, seq, nil)}); err != nil {
+			return nil, err
+		}
+		msgType := websocket.MessageText
+		if kind == sessionBinary {
+			msgType = websocket.MessageBinary
+		}
+		return &websocket.Message{Type: msgType, Data: payload}, nil
+	}
+}
+
+// Write writes a text or binary message to the server over the attached
+// connection. Messages from the client are not buffered.
+func (c *SessionClient) Write(msg *websocket.Message) error {
+	kind := sessionText
+	switch msg.Type {
+	case websocket.MessageText:
+	case websocket.MessageBinary:
+		kind = sessionBinary
+	default:
+		return fmt.Errorf("cannot send messages of type %s in a session", msg.Type)
+	}
+	if err := c.conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: encodeSessionFrame(kind, 0, msg.Data)}); err != nil {
+		return err
+	}
+	return nil
+}
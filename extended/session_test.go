@@ -0,0 +1,262 @@
+package extended_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+// attachSession attaches client to its session of m over a new pipe, and
+// returns a channel receiving the session once Attach has replayed the
+// messages of the session, the client's side of the pipe, and whether the
+// session continued without lost messages.
+func attachSession(t *testing.T, m *extended.SessionManager, client *extended.SessionClient) (<-chan *extended.Session, *websocket.Conn, bool) {
+	t.Helper()
+	a, b := pipe()
+	sessions := make(chan *extended.Session, 1)
+	go func() {
+		s, err := m.Attach(context.Background(), b)
+		if err != nil {
+			t.Errorf("attaching: %v", err)
+		}
+		sessions <- s
+	}()
+	continuous, err := client.Attach(context.Background(), a)
+	if err != nil {
+		t.Fatalf("resuming: %v", err)
+	}
+	return sessions, a, continuous
+}
+
+// readSession reads n messages from client and fails the test unless they
+// are the messages with the numbers from first.
+func readSession(t *testing.T, client *extended.SessionClient, first, n int) {
+	t.Helper()
+	for i := first; i < first+n; i++ {
+		msg, err := client.Read()
+		if err != nil {
+			t.Fatalf("reading message %d: %v", i, err)
+		}
+		if want := fmt.Sprint("message ", i); string(msg.Data) != want {
+			t.Fatalf("expected %q, got %q", want, msg.Data)
+		}
+	}
+}
+
+func sessionMessage(i int) *websocket.Message {
+	return &websocket.Message{Type: websocket.MessageText, Data: []byte(fmt.Sprint("message ", i))}
+}
+
+func TestSession_Resume(t *testing.T) {
+	m := extended.NewSessionManager(extended.SessionOptions{})
+	client := extended.NewSessionClient("token")
+	sessions, conn, continuous := attachSession(t, m, client)
+	if continuous {
+		t.Fatalf("expected a new session not to be continuous")
+	}
+	s := <-sessions
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 1; i <= 100; i++ {
+			if err := s.Send(sessionMessage(i)); err != nil {
+				t.Errorf("sending: %v", err)
+			}
+		}
+	}()
+	readSession(t, client, 1, 30)
+	conn.Close() // the connection drops while messages are being sent
+	<-sent
+
+	sessions, conn, continuous = attachSession(t, m, client)
+	defer conn.Close()
+	if !continuous {
+		t.Fatalf("expected the session to be resumed without lost messages")
+	}
+	readSession(t, client, 31, 70)
+	if <-sessions != s {
+		t.Fatalf("expected the same session to be resumed")
+	}
+	go s.Send(sessionMessage(101))
+	readSession(t, client, 101, 1)
+	waitFor(t, time.Second, func() bool { return s.Buffered() == 0 })
+}
+
+func TestSession_Replaced(t *testing.T) {
+	m := extended.NewSessionManager(extended.SessionOptions{})
+	client := extended.NewSessionClient("token")
+	sessions, old, _ := attachSession(t, m, client)
+	s := <-sessions
+	go readLoop(old)
+
+	// the client reconnects before the old connection is noticed to drop
+	sessions, conn, continuous := attachSession(t, m, client)
+	defer conn.Close()
+	if !continuous {
+		t.Fatalf("expected the session to be continuous")
+	}
+	<-sessions
+	waitFor(t, time.Second, old.Closed)
+	if s.Conn() == nil {
+		t.Fatalf("expected the new connection to stay attached")
+	}
+	go s.Send(sessionMessage(1))
+	readSession(t, client, 1, 1)
+}
+
+func TestSession_Eviction(t *testing.T) {
+	m := extended.NewSessionManager(extended.SessionOptions{BufferSize: 5})
+	client := extended.NewSessionClient("token")
+	sessions, conn, _ := attachSession(t, m, client)
+	s := <-sessions
+	conn.Close()
+	waitFor(t, time.Second, func() bool { return s.Conn() == nil })
+	for i := 1; i <= 10; i++ {
+		s.Send(sessionMessage(i))
+	}
+
+	_, conn, continuous := attachSession(t, m, client)
+	defer conn.Close()
+	if continuous {
+		t.Fatalf("expected the session not to be continuous after messages were evicted")
+	}
+	readSession(t, client, 6, 5)
+}
+
+func TestSession_EvictSession(t *testing.T) {
+	m := extended.NewSessionManager(extended.SessionOptions{BufferSize: 2, Eviction: extended.SessionEvictSession})
+	client := extended.NewSessionClient("token")
+	sessions, conn, _ := attachSession(t, m, client)
+	s := <-sessions
+	conn.Close()
+	waitFor(t, time.Second, func() bool { return s.Conn() == nil })
+	s.Send(sessionMessage(1))
+	s.Send(sessionMessage(2))
+	if err := s.Send(sessionMessage(3)); !errors.Is(err, extended.ErrSessionClosed) {
+		t.Fatalf("expected the session to be closed once its buffer overflows, got %v", err)
+	}
+
+	sessions, conn, continuous := attachSession(t, m, client)
+	defer conn.Close()
+	resumed := <-sessions
+	if resumed == s || continuous {
+		t.Fatalf("expected a new session")
+	}
+	go resumed.Send(sessionMessage(1))
+	readSession(t, client, 1, 1)
+}
+
+func TestSession_Expiry(t *testing.T) {
+	m := extended.NewSessionManager(extended.SessionOptions{Expiry: 20 * time.Millisecond})
+	sessions, conn, _ := attachSession(t, m, extended.NewSessionClient("token"))
+	s := <-sessions
+	conn.Close()
+	waitFor(t, time.Second, func() bool { return m.Len() == 0 })
+	if err := s.Send(sessionMessage(1)); !errors.Is(err, extended.ErrSessionClosed) {
+		t.Fatalf("expected sending to an expired session to fail, got %v", err)
+	}
+}
+
+func TestSession_OnMessage(t *testing.T) {
+	received := make(chan string, 1)
+	m := extended.NewSessionManager(extended.SessionOptions{
+		OnMessage: func(s *extended.Session, msg *websocket.Message) {
+			received <- s.Token() + ": " + string(msg.Data)
+		},
+	})
+	client := extended.NewSessionClient("token")
+	_, conn, _ := attachSession(t, m, client)
+	defer conn.Close()
+	if err := client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("hello")}); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	if got := <-received; got != "token: hello" {
+		t.Fatalf("expected the message to reach OnMessage, got %q", got)
+	}
+}
+
+func TestSession_ProtocolError(t *testing.T) {
+	m := extended.NewSessionManager(extended.SessionOptions{})
+	a, b := pipe()
+	defer a.Close()
+	errs := make(chan error, 1)
+	go func() {
+		a.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("hello")})
+		_, err := a.Read()
+		errs <- err
+	}()
+	if _, err := m.Attach(context.Background(), b); err == nil {
+		t.Fatalf("expected attaching without a resume frame to fail")
+	}
+	if err := <-errs; !websocket.IsCloseError(err, websocket.CloseProtocolError) {
+		t.Fatalf("expected the connection to be closed with CloseProtocolError, got %v", err)
+	}
+}
+
+func TestSession_Store(t *testing.T) {
+	dir := t.TempDir()
+	start := func() *extended.SessionManager {
+		store, err := extended.NewFileOutboxStore(dir, extended.FileOutboxOptions{})
+		if err != nil {
+			t.Fatalf("opening the store: %v", err)
+		}
+		return extended.NewSessionManager(extended.SessionOptions{BufferSize: 10, Store: store})
+	}
+	m := start()
+	client := extended.NewSessionClient("token")
+	sessions, conn, _ := attachSession(t, m, client)
+	s := <-sessions
+
+	sent := make(chan struct{})
+	go func() {
+		defer close(sent)
+		for i := 1; i <= 100; i++ {
+			if err := s.Send(sessionMessage(i)); err != nil {
+				t.Errorf("sending: %v", err)
+			}
+		}
+	}()
+	readSession(t, client, 1, 30)
+	conn.Close()
+	<-sent
+
+	// the process is killed and restarted, and messages are sent to the
+	// client before it resumes its session
+	m = start()
+	s, ok := m.Session("token")
+	if !ok {
+		t.Fatalf("expected the session to be restored from the store")
+	}
+	for i := 101; i <= 110; i++ {
+		if err := s.Send(sessionMessage(i)); err != nil {
+			t.Fatalf("sending: %v", err)
+		}
+	}
+	sessions, conn, continuous := attachSession(t, m, client)
+	if !continuous {
+		t.Fatalf("expected the session to be resumed without lost messages")
+	}
+	readSession(t, client, 31, 80)
+	if <-sessions != s {
+		t.Fatalf("expected the restored session to be resumed")
+	}
+	// the store is trimmed once every message is acknowledged
+	waitFor(t, time.Second, func() bool { return len(outboxFiles(t, dir)) == 0 })
+	conn.Close()
+
+	// the client resumes after another restart, with every message read
+	m = start()
+	sessions, conn, continuous = attachSession(t, m, client)
+	defer conn.Close()
+	if continuous {
+		t.Fatalf("expected a new session once every message was acknowledged")
+	}
+	go (<-sessions).Send(sessionMessage(1))
+	readSession(t, client, 1, 1)
+}
@@ -0,0 +1,602 @@
+package extended
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// The packet types of Engine.IO v4, the first byte of every text message.
+const (
+	engineioOpen    = '0'
+	engineioClose   = '1'
+	engineioPing    = '2'
+	engineioPong    = '3'
+	engineioMessage = '4'
+	engineioUpgrade = '5'
+	engineioNoop    = '6'
+)
+
+// The packet types of Socket.IO v5, sent in Engine.IO message packets.
+const (
+	socketioConnect      = '0'
+	socketioDisconnect   = '1'
+	socketioEvent        = '2'
+	socketioAck          = '3'
+	socketioConnectError = '4'
+	socketioBinaryEvent  = '5'
+	socketioBinaryAck    = '6'
+)
+
+var (
+	// ErrSocketIODisconnected is returned by the methods of a
+	// SocketIOSocket once it is disconnected.
+	ErrSocketIODisconnected = errors.New("the socket.io socket is disconnected")
+	// errSocketIOPacket is the error for a packet that is not valid.
+	errSocketIOPacket = errors.New("malformed socket.io packet")
+)
+
+// SocketIOOptions configures a SocketIOServer. The zero value uses the
+// defaults described on each field.
+type SocketIOOptions struct {
+	// PingInterval is the time between the Engine.IO pings of a
+	// connection. Defaults to 25 seconds.
+	PingInterval time.Duration
+	// PingTimeout is how long a ping has to receive a pong before the
+	// connection is closed. Defaults to 20 seconds.
+	PingTimeout time.Duration
+	// MaxPayload is the size of the largest message the clients may send.
+	// Defaults to 1000000 bytes.
+	MaxPayload int64
+
+	clock clock.Clock
+}
+
+// SocketIOServer serves Socket.IO v5 clients over the WebSocket transport
+// of Engine.IO v4, so that Socket.IO clients can connect without the
+// long-polling transport (with the transports option of the client set to
+// ["websocket"]). Binary attachments are not supported: events are sent
+// and received with JSON arguments only.
+//
+// Clients connect to namespaces, which are created with Namespace, and
+// exchange events with the sockets of the namespaces. A SocketIOServer is
+// created by NewSocketIOServer, and every method is safe to call
+// concurrently.
+type SocketIOServer struct {
+	opts SocketIOOptions
+
+	mx         sync.Mutex
+	namespaces map[string]*SocketIONamespace
+}
+
+// SocketIONamespace is a namespace of a SocketIOServer, such as "/" or
+// "/admin".
+type SocketIONamespace struct {
+	name string
+
+	mx        sync.Mutex
+	onConnect func(s *SocketIOSocket, auth json.RawMessage) error
+}
+
+// SocketIOHandler handles an event received by a SocketIOSocket, with its
+// arguments as JSON. If the client asked for an acknowledgement, ack sends
+// it with the arguments specified, encoded as JSON; otherwise ack does
+// nothing. ack may be called once.
+type SocketIOHandler func(args []json.RawMessage, ack func(args ...any) error)
+
+// NewSocketIOServer returns a SocketIOServer with the main namespace "/".
+func NewSocketIOServer(opts SocketIOOptions) *SocketIOServer {
+	if opts.PingInterval <= 0 {
+		opts.PingInterval = 25 * time.Second
+	}
+	if opts.PingTimeout <= 0 {
+		opts.PingTimeout = 20 * time.Second
+	}
+	if opts.MaxPayload <= 0 {
+		opts.MaxPayload = 1000000
+	}
+	if opts.clock == nil {
+		opts.clock = clock.Real{}
+	}
+	s := &SocketIOServer{opts: opts, namespaces: make(map[string]*SocketIONamespace)}
+	s.Namespace("/")
+	return s
+}
+
+// Namespace returns the namespace with the name specified, creating it if
+// there is none. Clients can only connect to the namespaces that exist.
+func (s *SocketIOServer) Namespace(name string) *SocketIONamespace {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	ns, ok := s.namespaces[name]
+	if !ok {
+		ns = &SocketIONamespace{name: name}
+		s.namespaces[name] = ns
+	}
+	return ns
+}
+
+// OnConnect sets the function called with every socket that connects to
+// the namespace, with the auth payload of the client, if any. It usually
+// registers the handlers of the socket with On. If it returns an error,
+// the client is refused with a connect error with its message. Events are
+// not handled until it returns.
+func (ns *SocketIONamespace) OnConnect(f func(s *SocketIOSocket, auth json.RawMessage) error) {
+	ns.mx.Lock()
+	defer ns.mx.Unlock()
+	ns.onConnect = f
+}
+
+// ServeHTTP accepts the WebSocket connection of an Engine.IO v4 client,
+// such as on "/socket.io/", and serves it until it ends. It responds with
+// 400 to the requests that are not for the WebSocket transport of Engine.IO
+// v4, including the requests of the long-polling transport.
+func (s *SocketIOServer) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	q := r.URL.Query()
+	if q.Get("EIO") != "4" || q.Get("transport") != "websocket" {
+		http.Error(w, "only the websocket transport of Engine.IO v4 is supported", http.StatusBadRequest)
+		return
+	}
+	conn, err := websocket.AcceptHTTP(w, r, websocket.WithReadLimit(s.opts.MaxPayload))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	s.Serve(conn)
+}
+
+// Serve serves the Engine.IO v4 client of conn until the connection ends,
+// starting with the open packet. Nothing else should read from conn.
+func (s *SocketIOServer) Serve(conn *websocket.Conn) error {
+	c := &socketioConn{
+		server:  s,
+		conn:    conn,
+		sid:     socketioID(),
+		sockets: make(map[string]*SocketIOSocket),
+		pong:    make(chan struct{}, 1),
+	}
+	defer c.close()
+	open, _ := json.Marshal(map[string]any{
+		"sid":          c.sid,
+		"upgrades":     []string{},
+		"pingInterval": s.opts.PingInterval.Milliseconds(),
+		"pingTimeout":  s.opts.PingTimeout.Milliseconds(),
+		"maxPayload":   s.opts.MaxPayload,
+	})
+	if err := c.write(engineioOpen, string(open)); err != nil {
+		return err
+	}
+	go c.heartbeat()
+
+	for {
+		msg, err := readDataMessage(conn)
+		if err != nil {
+			return err
+		}
+		if msg.Type != websocket.MessageText || len(msg.Data) == 0 {
+			continue // binary attachments are not supported
+		}
+		switch msg.Data[0] {
+		case engineioPing:
+			c.write(engineioPong, string(msg.Data[1:]))
+		case engineioPong:
+			select {
+			case c.pong <- struct{}{}:
+			default:
+			}
+		case engineioMessage:
+			if err := c.receive(msg.Data[1:]); err != nil {
+				conn.Logger().Error("an error occured while handling a socket.io packet", "error", err.Error())
+			}
+		case engineioClose:
+			conn.CloseWithCode(websocket.CloseNormalClosure, "")
+		case engineioUpgrade, engineioNoop:
+		}
+	}
+}
+
+// socketioConn is an Engine.IO connection served by a SocketIOServer, and
+// the Socket.IO sockets connected over it.
+type socketioConn struct {
+	server *SocketIOServer
+	conn   *websocket.Conn
+	sid    string
+	pong   chan struct{}
+
+	mx      sync.Mutex
+	sockets map[string]*SocketIOSocket // by namespace
+}
+
+// socketioID returns a random session ID.
+func socketioID() string {
+	b := make([]byte, 15)
+	rand.Read(b)
+	return base64.RawURLEncoding.EncodeToString(b)
+}
+
+// write writes an Engine.IO packet.
+func (c *socketioConn) write(typ byte, data string) error {
+	return c.conn.Write(&websocket.Message{Type: websocket.MessageText, Data: append([]byte{typ}, data...)})
+}
+
+// heartbeat pings the client every PingInterval, and closes the connection
+// if a ping is not answered within PingTimeout.
+func (c *socketioConn) heartbeat() {
+	opts := c.server.opts
+	for {
+		t := opts.clock.NewTimer(opts.PingInterval)
+		select {
+		case <-t.C():
+		case <-c.conn.Done():
+			t.Stop()
+			return
+		}
+		// a pong that was not asked for does not answer the next ping
+		select {
+		case <-c.pong:
+		default:
+		}
+		if err := c.write(engineioPing, ""); err != nil {
+			return
+		}
+		t = opts.clock.NewTimer(opts.PingTimeout)
+		select {
+		case <-c.pong:
+			t.Stop()
+		case <-t.C():
+			c.conn.CloseWithCode(websocket.CloseGoingAway, "ping timeout")
+			return
+		case <-c.conn.Done():
+			t.Stop()
+			return
+		}
+	}
+}
+
+// socketioPacket is a Socket.IO packet.
+type socketioPacket struct {
+	typ       byte
+	namespace string
+	id        int64 // the ack ID, or -1
+	data      json.RawMessage
+}
+
+// decodeSocketIOPacket parses a Socket.IO packet:
+//
+//	<type>[<namespace>,][<ack id>][<JSON data>]
+//
+// where the namespace is only present if it is not "/".
+func decodeSocketIOPacket(data []byte) (socketioPacket, error) {
+	if len(data) == 0 {
+		return socketioPacket{}, errSocketIOPacket
+	}
+	p := socketioPacket{typ: data[0], namespace: "/", id: -1}
+	data = data[1:]
+	if p.typ == socketioBinaryEvent || p.typ == socketioBinaryAck {
+		return p, fmt.Errorf("%w: binary attachments are not supported", errSocketIOPacket)
+	}
+	if len(data) > 0 && data[0] == '/' {
+		end := bytes.IndexByte(data, ',')
+		if end < 0 {
+			end = len(data)
+		}
+		p.namespace = string(data[:end])
+		data = data[min(end+1, len(data)):]
+	}
+	n := 0
+	for n < len(data) && data[n] >= '0' && data[n] <= '9' {
+		n++
+	}
+	if n > 0 {
+		id, err := strconv.ParseInt(string(data[:n]), 10, 64)
+		if err != nil {
+			return p, errSocketIOPacket
+		}
+		p.id = id
+	}
+	if data = data[n:]; len(data) > 0 {
+		if !json.Valid(data) {
+			return p, errSocketIOPacket
+		}
+		p.data = data
+	}
+	return p, nil
+}
+
+// encodeSocketIOPacket encodes a Socket.IO packet.
+func encodeSocketIOPacket(p socketioPacket) string {
+	b := []byte{p.typ}
+	if p.namespace != "/" {
+		b = append(b, p.namespace...)
+		b = append(b, ',')
+	}
+	if p.id >= 0 {
+		b = strconv.AppendInt(b, p.id, 10)
+	}
+	return string(append(b, p.data...))
+}
+
+// send writes a Socket.IO packet in an Engine.IO message packet.
+func (c *socketioConn) send(p socketioPacket) error {
+	return c.write(engineioMessage, encodeSocketIOPacket(p))
+}
+
+// receive handles a Socket.IO packet.
+func (c *socketioConn) receive(data []byte) error {
+	p, err := decodeSocketIOPacket(data)
+	if err != nil {
+		return err
+	}
+	if p.typ == socketioConnect {
+		return c.connect(p)
+	}
+	c.mx.Lock()
+	s, ok := c.sockets[p.namespace]
+	c.mx.Unlock()
+	if !ok {
+		return nil // the socket was disconnected
+	}
+	switch p.typ {
+	case socketioDisconnect:
+		s.disconnect("client namespace disconnect")
+	case socketioEvent:
+		return s.event(p)
+	case socketioAck:
+		s.acked(p)
+	default:
+		return fmt.Errorf("%w: unexpected packet type %q", errSocketIOPacket, p.typ)
+	}
+	return nil
+}
+
+// connect connects a socket to the namespace of p.
+func (c *socketioConn) connect(p socketioPacket) error {
+	c.server.mx.Lock()
+	ns, ok := c.server.namespaces[p.namespace]
+	c.server.mx.Unlock()
+	if !ok {
+		return c.send(socketioPacket{typ: socketioConnectError, namespace: p.namespace, id: -1, data: mustMarshal(map[string]string{"message": "Invalid namespace"})})
+	}
+
+	c.mx.Lock()
+	if _, ok := c.sockets[p.namespace]; ok {
+		c.mx.Unlock()
+		return nil
+	}
+	ctx, cancel := context.WithCancel(c.conn.Context())
+	s := &SocketIOSocket{
+		conn:     c,
+		id:       socketioID(),
+		ns:       p.namespace,
+		ctx:      ctx,
+		cancel:   cancel,
+		handlers: make(map[string]SocketIOHandler),
+		acks:     make(map[int64]chan []json.RawMessage),
+	}
+	c.sockets[p.namespace] = s
+	c.mx.Unlock()
+
+	ns.mx.Lock()
+	onConnect := ns.onConnect
+	ns.mx.Unlock()
+	if onConnect != nil {
+		if err := onConnect(s, p.data); err != nil {
+			c.remove(s)
+			return c.send(socketioPacket{typ: socketioConnectError, namespace: p.namespace, id: -1, data: mustMarshal(map[string]string{"message": err.Error()})})
+		}
+	}
+	return c.send(socketioPacket{typ: socketioConnect, namespace: p.namespace, id: -1, data: mustMarshal(map[string]string{"sid": s.id})})
+}
+
+// remove removes s from the sockets of the connection.
+func (c *socketioConn) remove(s *SocketIOSocket) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.sockets[s.ns] == s {
+		delete(c.sockets, s.ns)
+	}
+	s.cancel()
+}
+
+// close disconnects every socket once the connection ends.
+func (c *socketioConn) close() {
+	c.conn.Close()
+	c.mx.Lock()
+	sockets := make([]*SocketIOSocket, 0, len(c.sockets))
+	for _, s := range c.sockets {
+		sockets = append(sockets, s)
+	}
+	c.mx.Unlock()
+	for _, s := range sockets {
+		s.disconnect("transport close")
+	}
+}
+
+// SocketIOSocket is a client connected to a namespace of a SocketIOServer.
+// Every method is safe to call concurrently.
+type SocketIOSocket struct {
+	conn   *socketioConn
+	id     string
+	ns     string
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	mx           sync.Mutex
+	handlers     map[string]SocketIOHandler
+	onDisconnect func(reason string)
+	nextAck      int64
+	acks         map[int64]chan []json.RawMessage
+	disconnected bool
+}
+
+// ID returns the ID of the socket.
+func (s *SocketIOSocket) ID() string {
+	return s.id
+}
+
+// Namespace returns the name of the namespace of the socket.
+func (s *SocketIOSocket) Namespace() string {
+	return s.ns
+}
+
+// Conn returns the WebSocket connection of the socket, which may be shared
+// with the sockets of other namespaces.
+func (s *SocketIOSocket) Conn() *websocket.Conn {
+	return s.conn.conn
+}
+
+// Context returns a context that is done once the socket is disconnected.
+func (s *SocketIOSocket) Context() context.Context {
+	return s.ctx
+}
+
+// On sets the handler of event, replacing any handler already set for it.
+// The events without a handler are dropped. Handlers are called one at a
+// time, from the goroutine reading the connection.
+func (s *SocketIOSocket) On(event string, h SocketIOHandler) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.handlers[event] = h
+}
+
+// OnDisconnect sets the function called once the socket is disconnected,
+// with the reason: "client namespace disconnect" if the client
+// disconnected from the namespace, "server namespace disconnect" if
+// Disconnect was called, or "transport close" if the connection ended.
+func (s *SocketIOSocket) OnDisconnect(f func(reason string)) {
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	s.onDisconnect = f
+}
+
+// Emit sends event to the client with args, each encoded as JSON.
+func (s *SocketIOSocket) Emit(event string, args ...any) error {
+	return s.emit(-1, event, args)
+}
+
+// EmitWithAck sends event to the client with args like Emit, asking for an
+// acknowledgement, and waits for it until ctx is done. It returns the
+// arguments of the acknowledgement, as JSON.
+func (s *SocketIOSocket) EmitWithAck(ctx context.Context, event string, args ...any) ([]json.RawMessage, error) {
+	s.mx.Lock()
+	if s.disconnected {
+		s.mx.Unlock()
+		return nil, ErrSocketIODisconnected
+	}
+	id := s.nextAck
+	s.nextAck++
+	acked := make(chan []json.RawMessage, 1)
+	s.acks[id] = acked
+	s.mx.Unlock()
+	defer func() {
+		s.mx.Lock()
+		delete(s.acks, id)
+		s.mx.Unlock()
+	}()
+
+	if err := s.emit(id, event, args); err != nil {
+		return nil, err
+	}
+	select {
+	case args := <-acked:
+		return args, nil
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	case <-s.ctx.Done():
+		return nil, ErrSocketIODisconnected
+	}
+}
+
+// emit sends an event packet with the ack ID id, or -1 for none.
+func (s *SocketIOSocket) emit(id int64, event string, args []any) error {
+	if s.ctx.Err() != nil {
+		return ErrSocketIODisconnected
+	}
+	data, err := json.Marshal(append([]any{event}, args...))
+	if err != nil {
+		return err
+	}
+	return s.conn.send(socketioPacket{typ: socketioEvent, namespace: s.ns, id: id, data: data})
+}
+
+// Disconnect disconnects the socket from its namespace, leaving the
+// connection and the sockets of other namespaces connected.
+func (s *SocketIOSocket) Disconnect() error {
+	if s.ctx.Err() != nil {
+		return nil
+	}
+	err := s.conn.send(socketioPacket{typ: socketioDisconnect, namespace: s.ns, id: -1})
+	s.disconnect("server namespace disconnect")
+	return err
+}
+
+// disconnect removes the socket and calls OnDisconnect, once.
+func (s *SocketIOSocket) disconnect(reason string) {
+	s.conn.remove(s)
+	s.mx.Lock()
+	if s.disconnected {
+		s.mx.Unlock()
+		return
+	}
+	s.disconnected = true
+	f := s.onDisconnect
+	s.mx.Unlock()
+	if f != nil {
+		f(reason)
+	}
+}
+
+// event calls the handler of an event packet.
+func (s *SocketIOSocket) event(p socketioPacket) error {
+	var args []json.RawMessage
+	var event string
+	if json.Unmarshal(p.data, &args) != nil || len(args) == 0 || json.Unmarshal(args[0], &event) != nil {
+		return fmt.Errorf("%w: expected an event name and its arguments", errSocketIOPacket)
+	}
+	s.mx.Lock()
+	h, ok := s.handlers[event]
+	s.mx.Unlock()
+	if !ok {
+		return nil
+	}
+	var once sync.Once
+	h(args[1:], func(ackArgs ...any) error {
+		if p.id < 0 {
+			return nil
+		}
+		err := errors.New("the event was already acknowledged")
+		once.Do(func() {
+			var data []byte
+			if data, err = json.Marshal(append([]any{}, ackArgs...)); err == nil {
+				err = s.conn.send(socketioPacket{typ: socketioAck, namespace: s.ns, id: p.id, data: data})
+			}
+		})
+		return err
+	})
+	return nil
+}
+
+// acked delivers the arguments of an ack packet to EmitWithAck.
+func (s *SocketIOSocket) acked(p socketioPacket) {
+	var args []json.RawMessage
+	if p.id < 0 || json.Unmarshal(p.data, &args) != nil {
+		return
+	}
+	s.mx.Lock()
+	acked, ok := s.acks[p.id]
+	s.mx.Unlock()
+	if ok {
+		acked <- args
+	}
+}
@@ -0,0 +1,271 @@
+package extended_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// The packets below were recorded from socket.io-client 4.7 connecting
+// with transports: ["websocket"], as the text frames sent on the wire.
+
+// socketioServer returns a server with a "/chat" namespace whose sockets
+// echo events, and an "/admin" namespace requiring the token "secret".
+func socketioServer(clk *clock.Fake, connected chan<- *extended.SocketIOSocket) *extended.SocketIOServer {
+	s := extended.NewSocketIOServer(extended.SocketIOWithClock(extended.SocketIOOptions{
+		PingInterval: 25 * time.Second,
+		PingTimeout:  20 * time.Second,
+	}, clk))
+	onConnect := func(sock *extended.SocketIOSocket, auth json.RawMessage) error {
+		sock.On("echo", func(args []json.RawMessage, ack func(args ...any) error) {
+			ack(args[0])
+		})
+		sock.On("chat message", func(args []json.RawMessage, ack func(args ...any) error) {
+			var text string
+			json.Unmarshal(args[0], &text)
+			sock.Emit("chat message", strings.ToUpper(text))
+		})
+		if connected != nil {
+			connected <- sock
+		}
+		return nil
+	}
+	s.Namespace("/").OnConnect(onConnect)
+	s.Namespace("/chat").OnConnect(onConnect)
+	s.Namespace("/admin").OnConnect(func(sock *extended.SocketIOSocket, auth json.RawMessage) error {
+		var creds struct {
+			Token string `json:"token"`
+		}
+		if json.Unmarshal(auth, &creds) != nil || creds.Token != "secret" {
+			return errors.New("not authorized")
+		}
+		return onConnect(sock, auth)
+	})
+	return s
+}
+
+// socketioClient starts serving a pipe with s and returns the client end,
+// after reading the open packet.
+func socketioClient(t *testing.T, s *extended.SocketIOServer) *websocket.Conn {
+	t.Helper()
+	client, server := pipe()
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	go s.Serve(server)
+	expectPacketPrefix(t, client, "0")
+	return client
+}
+
+// expectPacket fails the test unless the next data message of conn is
+// expected.
+func expectPacket(t *testing.T, conn *websocket.Conn, expected string) {
+	t.Helper()
+	msg, err := readData(conn)
+	if err != nil {
+		t.Fatalf("expected %s, got %v", expected, err)
+	}
+	if string(msg.Data) != expected {
+		t.Fatalf("expected %s, got %s", expected, msg.Data)
+	}
+}
+
+// expectPacketPrefix fails the test unless the next data message of conn
+// starts with prefix, and returns the rest of it.
+func expectPacketPrefix(t *testing.T, conn *websocket.Conn, prefix string) string {
+	t.Helper()
+	msg, err := readData(conn)
+	if err != nil {
+		t.Fatalf("expected %s..., got %v", prefix, err)
+	}
+	rest, ok := strings.CutPrefix(string(msg.Data), prefix)
+	if !ok {
+		t.Fatalf("expected %s..., got %s", prefix, msg.Data)
+	}
+	return rest
+}
+
+func TestSocketIOServer_Handshake(t *testing.T) {
+	s := socketioServer(clock.NewFake(), nil)
+	srv := httptest.NewServer(s)
+	defer srv.Close()
+	url := "ws" + strings.TrimPrefix(srv.URL, "http") + "/socket.io/"
+
+	if _, resp, err := websocket.DialWithOptions(context.Background(), url+"?EIO=4&transport=polling", websocket.DialOptions{}); err == nil || resp.StatusCode != http.StatusBadRequest {
+		t.Fatalf("expected the polling transport to be refused with 400, got %v", err)
+	}
+
+	conn, err := websocket.Dial(context.Background(), url+"?EIO=4&transport=websocket")
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	defer conn.Close()
+	var open struct {
+		SID          string   `json:"sid"`
+		Upgrades     []string `json:"upgrades"`
+		PingInterval int      `json:"pingInterval"`
+		PingTimeout  int      `json:"pingTimeout"`
+		MaxPayload   int      `json:"maxPayload"`
+	}
+	if err := json.Unmarshal([]byte(expectPacketPrefix(t, conn, "0")), &open); err != nil {
+		t.Fatalf("expected the open packet to be JSON: %v", err)
+	}
+	if open.SID == "" || open.Upgrades == nil || open.PingInterval != 25000 || open.PingTimeout != 20000 || open.MaxPayload != 1000000 {
+		t.Fatalf("unexpected open packet: %+v", open)
+	}
+
+	send(t, conn, "40")
+	var connected struct {
+		SID string `json:"sid"`
+	}
+	if err := json.Unmarshal([]byte(expectPacketPrefix(t, conn, "40")), &connected); err != nil || connected.SID == "" || connected.SID == open.SID {
+		t.Fatalf("expected a connect packet with a socket ID, got %+v and %v", connected, err)
+	}
+}
+
+func TestSocketIOServer_Heartbeat(t *testing.T) {
+	clk := clock.NewFake()
+	client := socketioClient(t, socketioServer(clk, nil))
+
+	// the client may ping too
+	send(t, client, "2probe")
+	expectPacket(t, client, "3probe")
+
+	for range 2 {
+		waitForTimer(t, clk, 25*time.Second)
+		clk.Advance(25 * time.Second)
+		expectPacket(t, client, "2")
+		send(t, client, "3")
+	}
+
+	waitForTimer(t, clk, 25*time.Second)
+	clk.Advance(25 * time.Second)
+	expectPacket(t, client, "2")
+	waitForTimer(t, clk, 20*time.Second)
+	clk.Advance(20 * time.Second)
+	if _, err := readData(client); err == nil {
+		t.Fatalf("expected the connection to be closed once the ping timed out")
+	}
+}
+
+func TestSocketIOServer_Namespaces(t *testing.T) {
+	client := socketioClient(t, socketioServer(clock.NewFake(), nil))
+
+	send(t, client, `40/admin,{"token":"wrong"}`)
+	expectPacket(t, client, `44/admin,{"message":"not authorized"}`)
+	send(t, client, `40/unknown,`)
+	expectPacket(t, client, `44/unknown,{"message":"Invalid namespace"}`)
+
+	send(t, client, `40/admin,{"token":"secret"}`)
+	expectPacketPrefix(t, client, `40/admin,{"sid":`)
+	send(t, client, `40/chat,`)
+	expectPacketPrefix(t, client, `40/chat,{"sid":`)
+
+	send(t, client, `42/chat,["chat message","hi"]`)
+	expectPacket(t, client, `42/chat,["chat message","HI"]`)
+	send(t, client, `42/admin,1["echo",{"a":[1,2]}]`)
+	expectPacket(t, client, `43/admin,1[{"a":[1,2]}]`)
+
+	// events for a namespace that was disconnected are dropped
+	send(t, client, `41/chat,`)
+	send(t, client, `42/chat,["chat message","hi"]`)
+	send(t, client, `42/admin,2["echo","still here"]`)
+	expectPacket(t, client, `43/admin,2["still here"]`)
+}
+
+func TestSocketIOServer_Events(t *testing.T) {
+	connected := make(chan *extended.SocketIOSocket, 1)
+	client := socketioClient(t, socketioServer(clock.NewFake(), connected))
+	send(t, client, "40")
+	expectPacketPrefix(t, client, "40")
+	sock := <-connected
+	reasons := make(chan string, 1)
+	sock.OnDisconnect(func(reason string) { reasons <- reason })
+
+	send(t, client, `42["chat message","hello"]`)
+	expectPacket(t, client, `42["chat message","HELLO"]`)
+	send(t, client, `4213["echo",["nested"]]`)
+	expectPacket(t, client, `4313[["nested"]]`)
+	// events without a handler are dropped
+	send(t, client, `42["unknown"]`)
+
+	// the pipe is synchronous, so the server writes from another goroutine
+	go func() {
+		if err := sock.Emit("news", map[string]string{"hello": "world"}, 2); err != nil {
+			t.Errorf("emitting: %v", err)
+		}
+	}()
+	expectPacket(t, client, `42["news",{"hello":"world"},2]`)
+
+	answers := make(chan []json.RawMessage, 1)
+	go func() {
+		args, err := sock.EmitWithAck(context.Background(), "question", "ready?")
+		if err != nil {
+			t.Errorf("emitting with an ack: %v", err)
+		}
+		answers <- args
+	}()
+	expectPacket(t, client, `420["question","ready?"]`)
+	send(t, client, `430["yes",42]`)
+	if args := <-answers; len(args) != 2 || string(args[0]) != `"yes"` || string(args[1]) != "42" {
+		t.Fatalf("expected the arguments of the ack, got %s", args)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	go func() {
+		_, err := sock.EmitWithAck(ctx, "question", "again?")
+		answers <- nil
+		if !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("expected the ack to time out, got %v", err)
+		}
+	}()
+	expectPacket(t, client, `421["question","again?"]`)
+	<-answers
+
+	send(t, client, "41")
+	if reason := <-reasons; reason != "client namespace disconnect" {
+		t.Fatalf("expected the client to disconnect, got %q", reason)
+	}
+	if err := sock.Emit("news"); !errors.Is(err, extended.ErrSocketIODisconnected) {
+		t.Fatalf("expected emitting on a disconnected socket to fail, got %v", err)
+	}
+}
+
+func TestSocketIOServer_Disconnect(t *testing.T) {
+	connected := make(chan *extended.SocketIOSocket, 2)
+	client := socketioClient(t, socketioServer(clock.NewFake(), connected))
+	send(t, client, "40")
+	expectPacketPrefix(t, client, "40")
+	send(t, client, "40/chat,")
+	expectPacketPrefix(t, client, "40/chat,")
+	main, chat := <-connected, <-connected
+	reasons := make(chan string, 2)
+	main.OnDisconnect(func(reason string) { reasons <- reason })
+	chat.OnDisconnect(func(reason string) { reasons <- reason })
+
+	go main.Disconnect()
+	expectPacket(t, client, "41")
+	if reason := <-reasons; reason != "server namespace disconnect" {
+		t.Fatalf("expected the server to disconnect, got %q", reason)
+	}
+	if main.Context().Err() == nil || chat.Context().Err() != nil {
+		t.Fatalf("expected only the disconnected socket to be done")
+	}
+
+	// the Engine.IO close packet
+	send(t, client, "1")
+	if reason := <-reasons; reason != "transport close" {
+		t.Fatalf("expected the transport to close, got %q", reason)
+	}
+}
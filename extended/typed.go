@@ -0,0 +1,161 @@
+package extended
+
+import (
+	"context"
+	"errors"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// Typed sends and receives values of type T over a connection, encoded
+// with a websocket.Codec. It is created by NewTyped.
+type Typed[T any] struct {
+	conn  *websocket.Conn
+	codec websocket.Codec
+	recv  chan T
+
+	onDecodeError atomic.Pointer[func(err error)]
+
+	mx  sync.Mutex
+	err error
+
+	sendMx sync.Mutex
+}
+
+// NewTyped starts reading values of type T from conn in a new goroutine,
+// decoding every data message with codec, and returns a Typed that
+// receives them on Recv and sends values with Send. Nothing else should
+// read from conn.
+//
+// A message that cannot be decoded is skipped: it is passed to the handler
+// set with OnDecodeError, or logged if there is none, and reading goes on.
+// Any other error reading from conn ends reading, closes the Recv channel,
+// and is returned by Err.
+func NewTyped[T any](conn *websocket.Conn, codec websocket.Codec) *Typed[T] {
+	t := &Typed[T]{
+		conn:  conn,
+		codec: codec,
+		recv:  make(chan T),
+	}
+	go t.run()
+	return t
+}
+
+// Send encodes v with the codec and writes it as a single message. Sends
+// are written one at a time, in the order Send is called.
+//
+// While the message is written, the deadline of ctx, if any, is the write
+// deadline of the connection (see websocket.Conn.SetWriteDeadline), which
+// also bounds waiting for a write rate limit, and if ctx is done before the
+// message is written, the write is interrupted by moving the deadline to
+// the past. Send then returns ctx.Err() and closes the connection, since
+// part of the message may have been written, and nothing is written once
+// Send returns. If the underlying connection does not support deadlines
+// (see websocket.Conn.NetConn), ctx is only checked before writing.
+func (t *Typed[T]) Send(ctx context.Context, v T) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	t.sendMx.Lock()
+	defer t.sendMx.Unlock()
+	nc := t.conn.NetConn()
+	if nc == nil || ctx.Done() == nil {
+		if err := t.conn.WriteVia(t.codec, v); err != nil {
+			return err
+		}
+		return nil
+	}
+
+	deadline, _ := ctx.Deadline()
+	t.conn.SetWriteDeadline(deadline)
+	interrupted := make(chan struct{})
+	stop := context.AfterFunc(ctx, func() {
+		t.conn.SetWriteDeadline(time.Unix(1, 0))
+		close(interrupted)
+	})
+	err := t.conn.WriteVia(t.codec, v)
+	if !stop() {
+		<-interrupted
+	}
+	t.conn.SetWriteDeadline(time.Time{})
+	if err == nil {
+		return nil
+	}
+	if errors.Is(err, websocket.ErrWrite) && (ctx.Err() != nil || errors.Is(err, os.ErrDeadlineExceeded)) {
+		t.conn.Close()
+		if ctx.Err() == nil { // the deadline passed before ctx noticed
+			return context.DeadlineExceeded
+		}
+		return ctx.Err()
+	}
+	return err
+}
+
+// Recv returns the channel values are received on, in the order they were
+// sent. It is closed once reading ends, after which Err returns why.
+// Values are read one at a time, so reading waits for the channel to be
+// received from.
+func (t *Typed[T]) Recv() <-chan T {
+	return t.recv
+}
+
+// Err returns nil while reading, and the error that ended reading once the
+// Recv channel is closed. If the connection was closed, it is a
+// CONNECTION_CLOSED error (see websocket.Conn.Err).
+func (t *Typed[T]) Err() error {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	return t.err
+}
+
+// OnDecodeError sets the function called with the CODEC_ERROR error of
+// every message that cannot be decoded. Passing nil restores logging the
+// errors to the connection's logger.
+func (t *Typed[T]) OnDecodeError(f func(err error)) {
+	if f == nil {
+		t.onDecodeError.Store(nil)
+		return
+	}
+	t.onDecodeError.Store(&f)
+}
+
+func (t *Typed[T]) run() {
+	defer close(t.recv)
+	done := t.conn.Done()
+	for {
+		var v T
+		if err := t.conn.ReadVia(t.codec, &v); err != nil {
+			if errors.Is(err, websocket.ErrCodec) {
+				t.decodeError(err)
+				continue
+			}
+			t.setErr(err)
+			return
+		}
+		select {
+		case t.recv <- v:
+		case <-done:
+			t.setErr(t.conn.Err())
+			return
+		}
+	}
+}
+
+// decodeError reports a message that could not be decoded.
+func (t *Typed[T]) decodeError(err error) {
+	if f := t.onDecodeError.Load(); f != nil {
+		(*f)(err)
+		return
+	}
+	t.conn.Logger().Warn("a message could not be decoded", "error", err.Error())
+}
+
+func (t *Typed[T]) setErr(err error) {
+	t.mx.Lock()
+	defer t.mx.Unlock()
+	t.err = err
+}
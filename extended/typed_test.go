@@ -0,0 +1,144 @@
+package extended_test
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+type item struct {
+	N int `json:"n"`
+}
+
+func TestTyped(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+	defer client.Close()
+
+	const n = 5000
+	sender := extended.NewTyped[item](client, websocket.JSONCodec{})
+	receiver := extended.NewTyped[item](server, websocket.JSONCodec{})
+	go func() {
+		for i := range n {
+			if err := sender.Send(context.Background(), item{N: i}); err != nil {
+				t.Errorf("expected no error from Send(), got %v", err)
+				return
+			}
+		}
+		client.CloseWithCode(websocket.CloseNormalClosure, "")
+	}()
+
+	i := 0
+	for v := range receiver.Recv() {
+		if v.N != i {
+			t.Fatalf("expected %d, got %d", i, v.N)
+		}
+		i++
+	}
+	if i != n {
+		t.Fatalf("expected %d values, got %d", n, i)
+	}
+	if err := receiver.Err(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected a close error with code %d, got %v", websocket.CloseNormalClosure, err)
+	}
+}
+
+func TestTyped_DecodeError(t *testing.T) {
+	server, client := pipe()
+	defer server.Close()
+	defer client.Close()
+
+	receiver := extended.NewTyped[item](server, websocket.JSONCodec{})
+	decodeErrors := make(chan error, 1)
+	receiver.OnDecodeError(func(err error) {
+		decodeErrors <- err
+	})
+
+	go func() {
+		client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("not json")})
+		client.WriteVia(websocket.JSONCodec{}, item{N: 1})
+	}()
+	select {
+	case v := <-receiver.Recv():
+		if v.N != 1 {
+			t.Fatalf("expected 1, got %d", v.N)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected a value after the decode error")
+	}
+	if err := <-decodeErrors; !errors.Is(err, websocket.ErrCodec) {
+		t.Fatalf("expected CODEC_ERROR error, got %v", err)
+	}
+	if receiver.Err() != nil {
+		t.Fatalf("expected no error while reading, got %v", receiver.Err())
+	}
+}
+
+func TestTyped_Close(t *testing.T) {
+	server, client := pipe()
+	defer client.Close()
+
+	receiver := extended.NewTyped[item](server, websocket.JSONCodec{})
+	server.Close()
+	select {
+	case _, ok := <-receiver.Recv():
+		if ok {
+			t.Fatalf("expected no values")
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected Recv() to be closed once the connection is closed")
+	}
+	if err := receiver.Err(); !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected CONNECTION_CLOSED error, got %v", err)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := receiver.Send(ctx, item{}); !errors.Is(err, context.Canceled) {
+		t.Fatalf("expected context.Canceled, got %v", err)
+	}
+}
+
+func TestTyped_SendInterrupted(t *testing.T) {
+	for _, test := range []struct {
+		name     string
+		ctx      func() (context.Context, context.CancelFunc)
+		expected error
+	}{
+		{"Cancel", func() (context.Context, context.CancelFunc) {
+			ctx, cancel := context.WithCancel(context.Background())
+			time.AfterFunc(20*time.Millisecond, cancel)
+			return ctx, cancel
+		}, context.Canceled},
+		{"Deadline", func() (context.Context, context.CancelFunc) {
+			return context.WithTimeout(context.Background(), 20*time.Millisecond)
+		}, context.DeadlineExceeded},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			a, b := net.Pipe()
+			defer b.Close()
+			conn := websocket.From(a)
+			sender := extended.NewTyped[item](conn, websocket.JSONCodec{})
+
+			// the peer does not read, so the write blocks until it is
+			// interrupted
+			ctx, cancel := test.ctx()
+			defer cancel()
+			if err := sender.Send(ctx, item{N: 1}); !errors.Is(err, test.expected) {
+				t.Fatalf("expected %v, got %v", test.expected, err)
+			}
+			if !conn.Closed() {
+				t.Fatalf("expected the connection to be closed once a write is interrupted")
+			}
+			b.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+			if n, _ := b.Read(make([]byte, 64)); n != 0 {
+				t.Fatalf("expected nothing to be written once Send returned, got %d bytes", n)
+			}
+		})
+	}
+}
@@ -0,0 +1,120 @@
+package extended
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+)
+
+// Validator checks the payload of a message before a Router hands it to
+// its handler, so handlers only see payloads of the shape they expect. An
+// implementation may check against a JSON Schema, or decode the payload
+// like StructValidator does.
+type Validator interface {
+	// Validate returns an error describing why the payload of a message of
+	// the type specified is not valid, or nil if it is.
+	Validate(messageType string, raw json.RawMessage) error
+}
+
+// ValidatorFunc is a function that implements Validator.
+type ValidatorFunc func(messageType string, raw json.RawMessage) error
+
+func (f ValidatorFunc) Validate(messageType string, raw json.RawMessage) error {
+	return f(messageType, raw)
+}
+
+// InvalidPolicy is what a Router does with a message its Validator
+// rejects.
+type InvalidPolicy int
+
+const (
+	// InvalidReply replies with an error message and keeps serving.
+	InvalidReply InvalidPolicy = iota
+	// InvalidClose closes the connection with 1008 (policy violation).
+	InvalidClose
+)
+
+// StructValidator is a Validator that decodes payloads into the struct
+// registered for their message type. A payload is not valid if it cannot
+// be decoded into the struct, such as when a field has the wrong JSON type
+// or, if DisallowUnknownFields is set, when it has a field the struct does
+// not. Fields tagged `validate:"required"` must not be the zero value, and
+// if a pointer to the struct implements interface{ Validate() error }, it
+// is called last. Payloads of types without a registered struct are valid.
+type StructValidator struct {
+	// DisallowUnknownFields rejects payloads with fields the struct does
+	// not have.
+	DisallowUnknownFields bool
+
+	mx    sync.RWMutex
+	types map[string]reflect.Type
+}
+
+// Register sets the struct payloads of the message type specified are
+// decoded into. v is a value of the struct type, such as ChatSend{}.
+func (s *StructValidator) Register(messageType string, v any) {
+	t := reflect.TypeOf(v)
+	for t.Kind() == reflect.Pointer {
+		t = t.Elem()
+	}
+	s.mx.Lock()
+	defer s.mx.Unlock()
+	if s.types == nil {
+		s.types = make(map[string]reflect.Type)
+	}
+	s.types[messageType] = t
+}
+
+func (s *StructValidator) Validate(messageType string, raw json.RawMessage) error {
+	s.mx.RLock()
+	t, ok := s.types[messageType]
+	s.mx.RUnlock()
+	if !ok {
+		return nil
+	}
+
+	v := reflect.New(t)
+	if len(raw) == 0 {
+		raw = json.RawMessage("null")
+	}
+	dec := json.NewDecoder(bytes.NewReader(raw))
+	if s.DisallowUnknownFields {
+		dec.DisallowUnknownFields()
+	}
+	if err := dec.Decode(v.Interface()); err != nil {
+		return err
+	}
+	if t.Kind() == reflect.Struct {
+		if err := checkRequired(v.Elem()); err != nil {
+			return err
+		}
+	}
+	if validator, ok := v.Interface().(interface{ Validate() error }); ok {
+		return validator.Validate()
+	}
+	return nil
+}
+
+// checkRequired returns an error if a field of v tagged as required is the
+// zero value.
+func checkRequired(v reflect.Value) error {
+	t := v.Type()
+	for i := range t.NumField() {
+		field := t.Field(i)
+		if !slices.Contains(strings.Split(field.Tag.Get("validate"), ","), "required") {
+			continue
+		}
+		if v.Field(i).IsZero() {
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if name == "" {
+				name = field.Name
+			}
+			return fmt.Errorf("%s is required", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,115 @@
+package extended_test
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"sync"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/extended"
+)
+
+type chatSend struct {
+	Room string `json:"room" validate:"required"`
+	Text string `json:"text"`
+}
+
+func (c *chatSend) Validate() error {
+	if len(c.Text) > 10 {
+		return errors.New("text is too long")
+	}
+	return nil
+}
+
+func newValidatingRouter() (*extended.Router, func() []string) {
+	v := &extended.StructValidator{DisallowUnknownFields: true}
+	v.Register("echo", chatSend{})
+
+	r := newEchoRouter()
+	r.Validator = v
+	var mx sync.Mutex
+	var invalid []string
+	r.OnInvalid = func(messageType string, err error) {
+		mx.Lock()
+		defer mx.Unlock()
+		invalid = append(invalid, messageType)
+	}
+	return r, func() []string {
+		mx.Lock()
+		defer mx.Unlock()
+		return invalid
+	}
+}
+
+func TestValidator(t *testing.T) {
+	r, invalid := newValidatingRouter()
+	client := serveRouter(t, r)
+
+	send(t, client, `{"type":"echo","payload":{"room":"lobby","text":"hi"}}`)
+	if env := receive(t, client); env.Type != "echo" {
+		t.Fatalf("expected a valid message to be handled, got %s", env.Type)
+	}
+
+	rejected := []string{
+		`{"type":"echo","payload":{"room":7}}`,                            // wrong type
+		`{"type":"echo","payload":{"text":"hi"}}`,                         // missing required field
+		`{"type":"echo","payload":{"room":"lobby","extra":true}}`,         // unknown field
+		`{"type":"echo","payload":{"room":"lobby","text":"hello world"}}`, // Validate method
+	}
+	for _, data := range rejected {
+		send(t, client, data)
+		payload := receiveError(t, client)
+		if payload.Type != "echo" {
+			t.Fatalf("expected %s to be rejected, got %+v", data, payload)
+		}
+	}
+	if n := len(invalid()); n != len(rejected) {
+		t.Fatalf("expected OnInvalid to be called %d times, got %d", len(rejected), n)
+	}
+
+	// types without a registered struct are not validated
+	send(t, client, `{"type":"fail","payload":{"room":7}}`)
+	if payload := receiveError(t, client); payload.Error != "boom" {
+		t.Fatalf("expected the handler to be called, got %+v", payload)
+	}
+}
+
+func TestValidator_Close(t *testing.T) {
+	r, invalid := newValidatingRouter()
+	r.Invalid = extended.InvalidClose
+	client := serveRouter(t, r)
+
+	send(t, client, `{"type":"echo","payload":{"room":7}}`)
+	_, err := client.Read()
+	if !websocket.IsCloseError(err, websocket.ClosePolicyViolation) {
+		t.Fatalf("expected a close error with code %d, got %v", websocket.ClosePolicyViolation, err)
+	}
+	if n := len(invalid()); n != 1 {
+		t.Fatalf("expected OnInvalid to be called once, got %d", n)
+	}
+}
+
+func TestValidatorFunc(t *testing.T) {
+	r := extended.NewRouter()
+	r.Validator = extended.ValidatorFunc(func(messageType string, raw json.RawMessage) error {
+		if string(raw) != `"ok"` {
+			return errors.New("not ok")
+		}
+		return nil
+	})
+	r.Handle("check", func(ctx context.Context, conn *websocket.Conn, payload json.RawMessage) error {
+		return conn.WriteVia(websocket.JSONCodec{}, extended.Envelope{Type: "checked"})
+	})
+	client := serveRouter(t, r)
+
+	send(t, client, `{"type":"check","payload":"no"}`)
+	if payload := receiveError(t, client); payload.Error != "invalid message: not ok" {
+		t.Fatalf("expected the message to be rejected, got %+v", payload)
+	}
+	send(t, client, `{"type":"check","payload":"ok"}`)
+	if env := receive(t, client); env.Type != "checked" {
+		t.Fatalf("expected the message to be handled, got %s", env.Type)
+	}
+}
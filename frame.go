@@ -0,0 +1,253 @@
+package websocket
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+)
+
+// Frame is a single WebSocket frame (RFC 6455, section 5.2), for tools that
+// encode or decode frames without a Conn, such as fuzzers and packet
+// analyzers. A Conn encodes and decodes its frames with the same code.
+type Frame struct {
+	// Fin reports whether the frame is the final fragment of a message.
+	Fin bool
+	// Rsv are the rsv1, rsv2, and rsv3 bits, which are reserved for
+	// extensions; rsv1 marks a compressed message with permessage-deflate.
+	Rsv    [3]bool
+	Opcode byte
+	// Masked reports whether the payload is masked with MaskKey on the
+	// wire, which is the case for the frames written by a client. MaskKey
+	// is ignored otherwise.
+	Masked  bool
+	MaskKey [4]byte
+	// Payload is the payload of the frame, unmasked.
+	Payload []byte
+}
+
+// AppendMarshal appends the frame encoded as it is sent on the wire to dst
+// and returns it. Only the low 4 bits of the opcode are encoded, and the
+// payload is masked if the frame is masked. The frame is not validated,
+// so that invalid frames can be encoded for testing.
+func (f *Frame) AppendMarshal(dst []byte) []byte {
+	first := f.Opcode & 0x0F
+	if f.Fin {
+		first |= 0x80
+	}
+	for i, set := range f.Rsv {
+		if set {
+			first |= 0x40 >> i
+		}
+	}
+	dst = appendHeader(dst, first, f.Masked, len(f.Payload))
+	if !f.Masked {
+		return append(dst, f.Payload...)
+	}
+	dst = append(dst, f.MaskKey[:]...)
+	start := len(dst)
+	dst = append(dst, f.Payload...)
+	maskBytes(dst[start:], f.MaskKey)
+	return dst
+}
+
+// ParseFrame reads a single frame from r. It returns io.EOF if r ends
+// before the frame starts and io.ErrUnexpectedEOF if it ends in the middle
+// of it, and a MALFORMED_FRAME error if the frame is not valid: if its
+// opcode is reserved, if it is a fragmented control frame or a control
+// frame with a payload longer than 125 bytes, or if its payload length
+// does not fit in an int. The rsv bits are not checked, since they depend
+// on the extensions negotiated. The payload is read as it arrives, so a
+// frame declaring a large payload without sending it does not allocate it.
+func ParseFrame(r io.Reader) (*Frame, error) {
+	var header [maxFrameHeaderLength]byte
+	if _, err := io.ReadFull(r, header[:2]); err != nil {
+		return nil, err
+	}
+	h, err := parseFrameStart(header[0], header[1])
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, header[2:h.headerLength]); err != nil {
+		return nil, unexpectedEOF(err)
+	}
+	if err := h.parseRest(header[2:h.headerLength]); err != nil {
+		return nil, err
+	}
+	var payload []byte
+	if h.length <= payloadChunkSize {
+		payload = make([]byte, 0, h.length)
+	}
+	payload, readErr := appendPayload(payload, r, int(h.length))
+	if readErr != nil {
+		return nil, unexpectedEOF(readErr)
+	}
+	if h.masked {
+		maskBytes(payload, h.maskKey)
+	}
+	return h.frame(payload), nil
+}
+
+// ParseFrameBytes parses the frame at the start of b and returns it with
+// the amount of bytes it takes. It returns io.ErrUnexpectedEOF if b does
+// not hold the whole frame, and the errors of ParseFrame otherwise. The
+// payload of the frame is a copy, so b can be reused.
+func ParseFrameBytes(b []byte) (*Frame, int, error) {
+	if len(b) < 2 {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	h, err := parseFrameStart(b[0], b[1])
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(b) < h.headerLength {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if err := h.parseRest(b[2:h.headerLength]); err != nil {
+		return nil, 0, err
+	}
+	if h.length > int64(len(b)-h.headerLength) {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	n := h.headerLength + int(h.length)
+	payload := append([]byte{}, b[h.headerLength:n]...)
+	if h.masked {
+		maskBytes(payload, h.maskKey)
+	}
+	return h.frame(payload), n, nil
+}
+
+// unexpectedEOF returns io.ErrUnexpectedEOF for io.EOF, for a frame that
+// ends before its header or its payload do.
+func unexpectedEOF(err error) error {
+	if errors.Is(err, io.EOF) {
+		return io.ErrUnexpectedEOF
+	}
+	return err
+}
+
+// frame returns the frame with the header h and payload, which must be
+// unmasked already.
+func (h *frameHeader) frame(payload []byte) *Frame {
+	return &Frame{
+		Fin:     h.fin,
+		Rsv:     [3]bool{h.rsv&0x40 != 0, h.rsv&0x20 != 0, h.rsv&0x10 != 0},
+		Opcode:  h.opcode,
+		Masked:  h.masked,
+		MaskKey: h.maskKey,
+		Payload: payload,
+	}
+}
+
+// parseFrameStart parses the first two bytes of a frame, which include
+// fin, the rsv bits, the opcode, the mask bit, and the payload length, and
+// returns the header they start, once it is validated. The payload length
+// is only set if it is not an extended one, which parseRest parses with
+// the mask key from the rest of the header.
+func parseFrameStart(b0, b1 byte) (frameHeader, Error) {
+	h, ok := decodeFrameStart(b0, b1)
+	if !ok {
+		return frameHeader{}, errorf(MALFORMED_FRAME, "unknown opcode")
+	}
+	if isControl(h.messageType) {
+		if !h.fin {
+			return frameHeader{}, errorf(MALFORMED_FRAME, "control frames may not be fragmented")
+		}
+		if h.length > 125 {
+			return frameHeader{}, errorf(MALFORMED_FRAME, "control frame payload is longer than 125 bytes")
+		}
+	}
+	return h, nil
+}
+
+// decodeFrameStart is parseFrameStart without the validation, for frames
+// that were encoded by the Conn. It returns false if the opcode is not
+// valid.
+func decodeFrameStart(b0, b1 byte) (frameHeader, bool) {
+	h := frameHeader{
+		fin:          b0&0x80 != 0, // 0 means fragmented, 1 means final
+		rsv:          b0 & 0x70,
+		opcode:       b0 & 0x0F,
+		masked:       b1&0x80 != 0,
+		length:       int64(b1 & 0x7F),
+		headerLength: 2,
+	}
+	messageType, ok := MessageTypeFromOpcode(h.opcode)
+	h.messageType = messageType
+	switch h.length {
+	case 126: // the following 16 bits is the payload length
+		h.headerLength += 2
+	case 127: // the following 64 bits is the payload length
+		h.headerLength += 8
+	}
+	if h.masked {
+		h.headerLength += 4
+	}
+	return h, ok
+}
+
+// parseRest parses the rest of the header started by parseFrameStart, b,
+// which is the extended payload length and the mask key, if any.
+func (h *frameHeader) parseRest(b []byte) Error {
+	switch h.length {
+	case 126:
+		h.length = int64(binary.BigEndian.Uint16(b))
+		b = b[2:]
+	case 127:
+		length := binary.BigEndian.Uint64(b)
+		if length > math.MaxInt {
+			return errorf(MALFORMED_FRAME, "payload length is too large")
+		}
+		h.length = int64(length)
+		b = b[8:]
+	}
+	if h.masked {
+		h.maskKey = [4]byte(b)
+	}
+	return nil
+}
+
+// minimalLength reports whether the payload length of the header is
+// encoded in the fewest bytes. It must be called after parseRest.
+func (h *frameHeader) minimalLength() bool {
+	extended := h.headerLength - 2
+	if h.masked {
+		extended -= 4
+	}
+	switch extended {
+	case 2:
+		return h.length >= 126
+	case 8:
+		return h.length >= 65536
+	}
+	return true
+}
+
+// appendHeader appends the header of a frame starting with the byte
+// first, which holds fin, the rsv bits, and the opcode, with the payload
+// length specified to dst, up to the mask key.
+func appendHeader(dst []byte, first byte, masked bool, payloadLength int) []byte {
+	dst = append(dst, first)
+	var mask byte
+	if masked {
+		mask = 0x80
+	}
+	// mask bit and payload length
+	if payloadLength < 126 { // the actual payload length
+		dst = append(dst, mask|byte(payloadLength))
+	} else if payloadLength < 65536 { // the following 16 bits is the payload length
+		dst = append(dst, mask|126)
+		dst = binary.BigEndian.AppendUint16(dst, uint16(payloadLength))
+	} else { // the following 64 bits is the payload length
+		dst = append(dst, mask|127)
+		dst = binary.BigEndian.AppendUint64(dst, uint64(payloadLength))
+	}
+	return dst
+}
+
+// maskBytes masks or unmasks b in place with maskKey.
+func maskBytes(b []byte, maskKey [4]byte) {
+	for i := range b {
+		b[i] ^= maskKey[i%4]
+	}
+}
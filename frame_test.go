@@ -0,0 +1,177 @@
+package websocket_test
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+func TestFrame_AppendMarshal(t *testing.T) {
+	// the frames of a server are not masked, so they are what Conn writes
+	for _, msg := range []*websocket.Message{
+		textMessage("hello"),
+		textMessage(loremIpsum),
+		{Type: websocket.MessageBinary, Data: make([]byte, 70000)},
+		{Type: websocket.MessagePing},
+	} {
+		f := websocket.Frame{Fin: true, Opcode: msg.Type.Opcode(), Payload: msg.Data}
+		if got, expected := f.AppendMarshal(nil), encodeFrames(t, msg, websocket.RoleServer); !bytes.Equal(got, expected) {
+			t.Fatalf("expected the %s frame to be encoded like Conn encodes it", msg.Type)
+		}
+	}
+
+	f := websocket.Frame{Fin: true, Rsv: [3]bool{true, false, true}, Opcode: 0x1, Masked: true, MaskKey: [4]byte{1, 2, 3, 4}, Payload: []byte("abcde")}
+	expected := []byte{0xD1, 0x85, 1, 2, 3, 4, 'a' ^ 1, 'b' ^ 2, 'c' ^ 3, 'd' ^ 4, 'e' ^ 1}
+	if got := f.AppendMarshal([]byte{0xFF}); !bytes.Equal(got, append([]byte{0xFF}, expected...)) {
+		t.Fatalf("expected %x, got %x", expected, got[1:])
+	}
+	if string(f.Payload) != "abcde" {
+		t.Fatalf("expected the payload to be left unmasked, got %q", f.Payload)
+	}
+}
+
+func TestParseFrame(t *testing.T) {
+	masked := websocket.Frame{Fin: true, Opcode: 0x2, Masked: true, MaskKey: [4]byte{9, 8, 7, 6}, Payload: []byte(loremIpsum)}
+	b := masked.AppendMarshal(nil)
+	b = (&websocket.Frame{Opcode: 0x1, Rsv: [3]bool{true}, Payload: []byte("hi")}).AppendMarshal(b)
+
+	r := bytes.NewReader(b)
+	for _, expected := range []websocket.Frame{masked, {Opcode: 0x1, Rsv: [3]bool{true}, Payload: []byte("hi")}} {
+		f, err := websocket.ParseFrame(r)
+		if err != nil {
+			t.Fatalf("parsing: %v", err)
+		}
+		assertFrame(t, f, &expected)
+	}
+	if _, err := websocket.ParseFrame(r); err != io.EOF {
+		t.Fatalf("expected io.EOF once the frames are read, got %v", err)
+	}
+
+	first, n, err := websocket.ParseFrameBytes(b)
+	if err != nil {
+		t.Fatalf("parsing: %v", err)
+	}
+	assertFrame(t, first, &masked)
+	if _, m, err := websocket.ParseFrameBytes(b[n:]); err != nil || n+m != len(b) {
+		t.Fatalf("expected the second frame to take the rest of the bytes, got %d of %d and %v", n+m, len(b), err)
+	}
+	b[n-1] = 0 // the payload of the first frame is a copy
+	assertFrame(t, first, &masked)
+}
+
+func TestParseFrame_Invalid(t *testing.T) {
+	tooLong := binary.BigEndian.AppendUint64([]byte{0x82, 127}, 1<<63)
+	for _, test := range []struct {
+		name      string
+		b         []byte
+		malformed bool
+	}{
+		{"empty header", []byte{0x81}, false},
+		{"short extended length", []byte{0x81, 126, 1}, false},
+		{"short mask key", []byte{0x81, 0x85, 1, 2}, false},
+		{"short payload", []byte{0x81, 5, 'a', 'b'}, false},
+		{"declared large payload", binary.BigEndian.AppendUint64([]byte{0x82, 127}, 1<<40), false},
+		{"reserved opcode", []byte{0x83, 0}, true},
+		{"fragmented control frame", []byte{0x09, 0}, true},
+		{"control frame too long", []byte{0x89, 126, 0, 126}, true},
+		{"payload length too large", tooLong, true},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := websocket.ParseFrame(bytes.NewReader(test.b))
+			_, _, errBytes := websocket.ParseFrameBytes(test.b)
+			for _, err := range []error{err, errBytes} {
+				if test.malformed && !errors.Is(err, websocket.ErrMalformedFrame) {
+					t.Fatalf("expected a MALFORMED_FRAME error, got %v", err)
+				}
+				if !test.malformed && err != io.ErrUnexpectedEOF {
+					t.Fatalf("expected io.ErrUnexpectedEOF, got %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestRead_ControlFrameTooLong(t *testing.T) {
+	mockConn := &MockNetConn{}
+	mockConn.buf.Write(rawFrame(0x89, make([]byte, 126)))
+	conn := websocket.From(mockConn, websocket.WithRole(websocket.RoleClient))
+	if _, err := conn.Read(); !errors.Is(err, websocket.ErrMalformedFrame) {
+		t.Fatalf("expected a MALFORMED_FRAME error, got %v", err)
+	}
+}
+
+// assertFrame fails the test if f is not the frame expected.
+func assertFrame(t *testing.T, f, expected *websocket.Frame) {
+	t.Helper()
+	if f.Fin != expected.Fin || f.Rsv != expected.Rsv || f.Opcode != expected.Opcode || f.Masked != expected.Masked ||
+		f.MaskKey != expected.MaskKey || !bytes.Equal(f.Payload, expected.Payload) {
+		t.Fatalf("expected frame %+v, got %+v", *expected, *f)
+	}
+}
+
+func FuzzParseFrame(f *testing.F) {
+	for _, msg := range []*websocket.Message{textMessage("hello"), textMessage(loremIpsum), {Type: websocket.MessageClose, Data: []byte{3, 232}}} {
+		for _, role := range []websocket.Role{websocket.RoleServer, websocket.RoleClient} {
+			f.Add(encodeFrames(f, msg, role))
+		}
+	}
+	f.Add([]byte{0x82, 127, 0x7F, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF, 0xFF})
+	f.Add([]byte{0x89, 0xFE, 0, 126, 1, 2, 3, 4})
+	f.Fuzz(func(t *testing.T, b []byte) {
+		frame, n, err := websocket.ParseFrameBytes(b)
+		fromReader, readErr := websocket.ParseFrame(bytes.NewReader(b))
+		if err != nil {
+			if readErr == nil || (readErr == io.EOF) != (len(b) == 0) {
+				t.Fatalf("expected ParseFrame to fail like ParseFrameBytes with %v, got %v", err, readErr)
+			}
+			return
+		}
+		if readErr != nil {
+			t.Fatalf("expected ParseFrame to parse the frame, got %v", readErr)
+		}
+		assertFrame(t, fromReader, frame)
+		if n > len(b) || n < 2+len(frame.Payload) {
+			t.Fatalf("expected the frame to take between %d and %d bytes, got %d", 2+len(frame.Payload), len(b), n)
+		}
+		reparsed, _, err := websocket.ParseFrameBytes(frame.AppendMarshal(nil))
+		if err != nil {
+			t.Fatalf("expected the frame to be parsed once marshaled, got %v", err)
+		}
+		assertFrame(t, reparsed, frame)
+	})
+}
+
+func FuzzFrameRoundTrip(f *testing.F) {
+	f.Add(true, byte(0), byte(0x1), false, uint32(0), []byte("hello"))
+	f.Add(false, byte(4), byte(0x2), true, uint32(0xdeadbeef), []byte(loremIpsum))
+	f.Add(true, byte(0), byte(0x9), true, uint32(1), make([]byte, 125))
+	f.Add(true, byte(0), byte(0x0), false, uint32(0), make([]byte, 70000))
+	f.Fuzz(func(t *testing.T, fin bool, rsv, opcode byte, masked bool, key uint32, payload []byte) {
+		frame := websocket.Frame{
+			Fin:     fin,
+			Rsv:     [3]bool{rsv&4 != 0, rsv&2 != 0, rsv&1 != 0},
+			Opcode:  opcode & 0x0F,
+			Masked:  masked,
+			Payload: payload,
+		}
+		if masked {
+			binary.BigEndian.PutUint32(frame.MaskKey[:], key)
+		}
+		b := frame.AppendMarshal(nil)
+		parsed, n, err := websocket.ParseFrameBytes(b)
+		if err != nil {
+			if !errors.Is(err, websocket.ErrMalformedFrame) {
+				t.Fatalf("expected a valid frame or a MALFORMED_FRAME error, got %v", err)
+			}
+			return
+		}
+		if n != len(b) {
+			t.Fatalf("expected the frame to take the %d bytes marshaled, got %d", len(b), n)
+		}
+		assertFrame(t, parsed, &frame)
+	})
+}
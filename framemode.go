@@ -0,0 +1,150 @@
+package websocket
+
+// The modes of a Conn. A Conn is in message mode once Read, Write, or
+// another method reading or writing messages is called, and in frame mode
+// once ReadFrame or WriteFrame is.
+const (
+	modeNone int32 = iota
+	modeMessage
+	modeFrame
+)
+
+// setMode puts the Conn in the mode specified, unless it is in the other
+// mode already, in which case it returns a MODE_MISMATCH error.
+func (c *Conn) setMode(mode int32) Error {
+	if c.mode.Load() == mode || c.mode.CompareAndSwap(modeNone, mode) {
+		return nil
+	}
+	if mode == modeFrame {
+		return errorf(MODE_MISMATCH, "message")
+	}
+	return errorf(MODE_MISMATCH, "frame")
+}
+
+// ReadFrame reads a single frame from the underlying connection and
+// returns it as it arrived, with its payload unmasked, for tools that
+// forward frames without reassembling them, such as a transparent proxy.
+//
+// ReadFrame puts the connection in frame mode: once it or WriteFrame is
+// called, Read, Write, WriteText, WritePrepared, and Drain return a
+// MODE_MISMATCH error, and ReadFrame returns one if any of them was
+// called first. Frames are only checked like ParseFrame checks them:
+// the rsv bits, masking, the order of fragments, and the payload of
+// close and text frames are left to the caller, and so are the checks of
+// the strict mode. Compressed frames are not decompressed. The read
+// limit applies to the payload of each frame.
+//
+// Control frames are returned like any other frame: pings are not
+// responded to and pongs are not matched with the pings of Ping, so
+// keepalive does not work in frame mode. Once a close frame is read,
+// ReadFrame returns a CONNECTION_CLOSED error wrapping a *CloseError with
+// its code and reason, and the connection is closed once a close frame
+// is written too, with WriteFrame or CloseWithCode.
+func (c *Conn) ReadFrame() (*Frame, Error) {
+	if err := c.setMode(modeFrame); err != nil {
+		return nil, err
+	}
+	c.lockRead()
+	defer c.unlockRead()
+	if c.closed.Load() || c.closeReceived.Load() {
+		return nil, c.closedError()
+	}
+	header, err := c.waitPaused()
+	if err != nil {
+		return nil, err
+	}
+	h, err := c.readStructuralHeader(header)
+	if err != nil {
+		return nil, err
+	}
+	payload, err := c.readFramePayload(h)
+	if err != nil {
+		return nil, err
+	}
+
+	if !isControl(h.messageType) && h.messageType != MessageContinuation {
+		c.fragmentType = h.messageType
+	}
+	switch {
+	case isControl(h.messageType):
+		c.countMessageRead(h.messageType)
+	case h.fin:
+		c.countMessageRead(c.fragmentType)
+	}
+	if h.messageType == MessageClose {
+		c.frameCloseRead(payload)
+	}
+	return h.frame(payload), nil
+}
+
+// frameCloseRead records the close frame with the payload specified, read
+// in frame mode, and closes the connection if a close frame was written
+// already. The read mutex must be held.
+func (c *Conn) frameCloseRead(payload []byte) {
+	c.closeReceived.Store(true)
+	if ce, err := parseCloseMessage(payload, false); err != nil {
+		c.setErr(err)
+	} else {
+		c.setErr(wrapError(CONNECTION_CLOSED, ce))
+	}
+	if c.closeSent.Load() {
+		c.Close()
+		return
+	}
+	c.setState(StateClosingRemote)
+}
+
+// WriteFrame writes f as it is to the underlying connection, including
+// its rsv bits and, if it is masked, its mask key, so that the frames read
+// with ReadFrame are forwarded unchanged. It puts the connection in frame
+// mode, see ReadFrame.
+//
+// WriteFrame returns a MALFORMED_FRAME error for a frame that ParseFrame
+// would reject, and only checks that: a client writing frames it creates
+// must mask them itself, and the write limit does not apply. Frames are
+// written directly, even if the write queue is enabled. Once a close
+// frame is written, the connection is closed as soon as one is read, or
+// right away if one was read already.
+func (c *Conn) WriteFrame(f *Frame) Error {
+	if err := c.setMode(modeFrame); err != nil {
+		return err
+	}
+	if f.Opcode > 0x0F {
+		return errorf(MALFORMED_FRAME, "unknown opcode")
+	}
+	buf := framePool.Get().(*[]byte)
+	frame := f.AppendMarshal((*buf)[:0])
+	err := c.writeEncodedFrame(frame)
+	putFrameBuffer(buf, frame)
+	return err
+}
+
+// writeEncodedFrame writes a frame encoded by WriteFrame once it is
+// checked, like writeFrames writes the frames of a message.
+func (c *Conn) writeEncodedFrame(frame []byte) Error {
+	h, err := parseFrameStart(frame[0], frame[1])
+	if err != nil {
+		return err
+	}
+	if c.closed.Load() {
+		return c.closedError()
+	}
+	control := isControl(h.messageType)
+	if h.messageType == MessageClose {
+		c.closeSent.Store(true)
+	}
+	if err := c.writeLimited(frame, control); err != nil {
+		return err
+	}
+	if h.messageType == MessageClose {
+		c.setState(StateClosingLocal)
+	}
+	c.countFramesWritten(h.messageType, 1, len(frame))
+	if hooks := c.frameHooks.Load(); hooks != nil && hooks.onWrite != nil {
+		c.framesWritten(hooks, frame)
+	}
+	if h.messageType == MessageClose && c.closeReceived.Load() {
+		c.Close()
+	}
+	return nil
+}
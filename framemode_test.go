@@ -0,0 +1,132 @@
+package websocket_test
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+func TestReadFrame(t *testing.T) {
+	key := [4]byte{1, 2, 3, 4}
+	frames := []websocket.Frame{
+		{Rsv: [3]bool{true}, Opcode: 0x1, Masked: true, MaskKey: key, Payload: []byte("hel")},
+		{Fin: true, Opcode: 0x9, Masked: true, MaskKey: key, Payload: []byte("ping")},
+		{Fin: true, Opcode: 0x0, Masked: true, MaskKey: key, Payload: []byte("lo")},
+		// neither the rsv bits nor masking are checked, even by a server
+		{Fin: true, Rsv: [3]bool{false, true, true}, Opcode: 0x2, Payload: []byte{0xff}},
+	}
+	mockConn := &MockNetConn{}
+	for _, f := range frames {
+		mockConn.buf.Write(f.AppendMarshal(nil))
+	}
+	conn := websocket.From(mockConn)
+	for _, expected := range frames {
+		f, err := conn.ReadFrame()
+		if err != nil {
+			t.Fatalf("reading a frame: %v", err)
+		}
+		assertFrame(t, f, &expected)
+	}
+	// the ping was not responded to, or the pong would be read back
+	if _, err := conn.ReadFrame(); !websocket.IsCloseError(err, websocket.CloseAbnormalClosure) {
+		t.Fatalf("expected the connection to end once the frames are read, got %v", err)
+	}
+	expected := websocket.MessageCounts{Text: 1, Binary: 1, Ping: 1}
+	if stats := conn.Stats(); stats.FramesRead != 4 || stats.MessagesRead != expected {
+		t.Fatalf("expected 4 frames with %+v read, got %d with %+v", expected, stats.FramesRead, stats.MessagesRead)
+	}
+}
+
+func TestWriteFrame(t *testing.T) {
+	frames := []websocket.Frame{
+		{Rsv: [3]bool{true}, Opcode: 0x1, Payload: []byte("hel")},
+		{Fin: true, Opcode: 0xA, Masked: true, MaskKey: [4]byte{9, 9, 9, 9}, Payload: []byte("pong")},
+		{Fin: true, Opcode: 0x0, Payload: []byte("lo")},
+	}
+	mockConn := &CountingConn{}
+	conn := websocket.From(mockConn, websocket.WithRole(websocket.RoleClient))
+	var expected []byte
+	for _, f := range frames {
+		if err := conn.WriteFrame(&f); err != nil {
+			t.Fatalf("writing a frame: %v", err)
+		}
+		expected = f.AppendMarshal(expected)
+	}
+	if !bytes.Equal(mockConn.buf.Bytes(), expected) {
+		t.Fatalf("expected the frames to be written as they are, got %x", mockConn.buf.Bytes())
+	}
+
+	for _, f := range []websocket.Frame{
+		{Fin: true, Opcode: 0x3},
+		{Fin: true, Opcode: 0x11},
+		{Opcode: 0x9},
+		{Fin: true, Opcode: 0x8, Payload: make([]byte, 126)},
+	} {
+		if err := conn.WriteFrame(&f); !errors.Is(err, websocket.ErrMalformedFrame) {
+			t.Fatalf("expected a MALFORMED_FRAME error writing %+v, got %v", f, err)
+		}
+	}
+}
+
+func TestFrameMode_Exclusive(t *testing.T) {
+	frame := &websocket.Frame{Fin: true, Opcode: 0x1, Payload: []byte("hi")}
+	conn := websocket.From(&CountingConn{})
+	if err := conn.WriteFrame(frame); err != nil {
+		t.Fatalf("writing a frame: %v", err)
+	}
+	for name, err := range map[string]error{
+		"Read":      func() error { _, err := conn.Read(); return err }(),
+		"Write":     conn.Write(textMessage("hi")),
+		"WriteText": conn.WriteText("hi"),
+		"Drain":     conn.Drain(context.Background()),
+	} {
+		if !errors.Is(err, websocket.ErrModeMismatch) {
+			t.Fatalf("expected %s to return a MODE_MISMATCH error in frame mode, got %v", name, err)
+		}
+	}
+
+	conn = websocket.From(&CountingConn{})
+	if err := conn.WriteText("hi"); err != nil {
+		t.Fatalf("writing a message: %v", err)
+	}
+	if _, err := conn.ReadFrame(); !errors.Is(err, websocket.ErrModeMismatch) {
+		t.Fatalf("expected ReadFrame to return a MODE_MISMATCH error in message mode, got %v", err)
+	}
+	if err := conn.WriteFrame(frame); !errors.Is(err, websocket.ErrModeMismatch) {
+		t.Fatalf("expected WriteFrame to return a MODE_MISMATCH error in message mode, got %v", err)
+	}
+}
+
+func TestFrameMode_Close(t *testing.T) {
+	client, server := pipe()
+	defer client.Close()
+	go client.WriteClose(4000, "bye")
+
+	f, err := server.ReadFrame()
+	if err != nil || f.Opcode != 0x8 {
+		t.Fatalf("expected the close frame to be read, got %+v and %v", f, err)
+	}
+	if server.Closed() || server.State() != websocket.StateClosingRemote {
+		t.Fatalf("expected the server to wait for the close frame to be written, got %s", server.State())
+	}
+	if _, err := server.ReadFrame(); !websocket.IsCloseError(err, 4000) {
+		t.Fatalf("expected ReadFrame to return the close error once the close frame is read, got %v", err)
+	}
+
+	errs := make(chan websocket.Error, 1)
+	go func() {
+		errs <- server.WriteFrame(&websocket.Frame{Fin: true, Opcode: 0x8, Payload: f.Payload})
+	}()
+	if _, err := client.Read(); !websocket.IsCloseError(err, 4000) {
+		t.Fatalf("expected the client to read the close frame written, got %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("writing the close frame: %v", err)
+	}
+	if !server.Closed() {
+		t.Fatalf("expected the server to be closed once close frames were read and written")
+	}
+}
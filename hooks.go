@@ -0,0 +1,119 @@
+package websocket
+
+import (
+	"sync/atomic"
+)
+
+// FrameInfo describes a frame read from or written to the connection, for
+// the hooks set with SetFrameHooks.
+type FrameInfo struct {
+	Fin    bool
+	Opcode byte
+	Rsv1   bool
+	Rsv2   bool
+	Rsv3   bool
+	// Masked reports whether the payload is masked on the wire, which is
+	// the case for the frames written by a client.
+	Masked bool
+	// PayloadLength is the length of the payload on the wire.
+	PayloadLength int64
+	// Payload is a copy of the start of the payload, unmasked, of at most
+	// the amount of bytes set with SetFrameHookPayloadLimit. It is nil by
+	// default, and for the frames Drain discards.
+	Payload []byte
+}
+
+// frameHooks are the hooks set with SetFrameHooks.
+type frameHooks struct {
+	onRead  func(FrameInfo)
+	onWrite func(FrameInfo)
+}
+
+// SetFrameHooks sets the functions called with every frame read from and
+// written to the connection, for example to debug a peer that does not
+// interoperate. Either may be nil, and passing two nil functions removes
+// the hooks; a connection without hooks only pays for checking that they
+// are not set.
+//
+// onRead is called by Read (or Drain) once the frame is read, before its
+// message is returned, with the read lock held: it must not call Read.
+// onWrite is called once the frame is written to the underlying
+// connection or to the write buffer, without any lock held, so the frames
+// of concurrent writes may be reported in a different order than they
+// were written in. The frames of a fragmented message are reported one by
+// one, in order. The hooks should not block, since they hold up reading
+// and writing.
+func (c *Conn) SetFrameHooks(onRead, onWrite func(FrameInfo)) {
+	if onRead == nil && onWrite == nil {
+		c.frameHooks.Store(nil)
+		return
+	}
+	c.frameHooks.Store(&frameHooks{onRead: onRead, onWrite: onWrite})
+}
+
+// SetFrameHookPayloadLimit sets the maximum amount of bytes of the payload
+// of a frame copied into FrameInfo.Payload for the frame hooks. A limit of
+// 0, the default, copies nothing.
+func (c *Conn) SetFrameHookPayloadLimit(n int) {
+	c.frameHookPayload.Store(int64(max(n, 0)))
+}
+
+// frameRead counts the frame read with the header h and calls the read
+// hook with it. payload is its payload, unmasked, if it was kept.
+func (c *Conn) frameRead(h frameHeader, payload []byte) {
+	c.countRead(h)
+	if hooks := c.frameHooks.Load(); hooks != nil && hooks.onRead != nil {
+		info := h.info()
+		info.Payload = payloadCopy(&c.frameHookPayload, payload, [4]byte{})
+		hooks.onRead(info)
+	}
+}
+
+// framesWritten calls the write hook with every frame in frames, which
+// were just written.
+func (c *Conn) framesWritten(hooks *frameHooks, frames []byte) {
+	for len(frames) > 0 {
+		h := encodedFrameHeader(frames)
+		payload := frames[h.headerLength : h.headerLength+int(h.length)]
+		info := h.info()
+		info.Payload = payloadCopy(&c.frameHookPayload, payload, h.maskKey)
+		hooks.onWrite(info)
+		frames = frames[h.headerLength+len(payload):]
+	}
+}
+
+// encodedFrameHeader returns the header of the frame at the start of b,
+// which must be a complete header encoded by appendFrameHeader.
+func encodedFrameHeader(b []byte) frameHeader {
+	h, _ := decodeFrameStart(b[0], b[1])
+	h.parseRest(b[2:h.headerLength])
+	return h
+}
+
+// info returns the FrameInfo of the frame with the header h, without its
+// payload.
+func (h *frameHeader) info() FrameInfo {
+	return FrameInfo{
+		Fin:           h.fin,
+		Opcode:        h.opcode,
+		Rsv1:          h.rsv&0x40 != 0,
+		Rsv2:          h.rsv&0x20 != 0,
+		Rsv3:          h.rsv&0x10 != 0,
+		Masked:        h.masked,
+		PayloadLength: h.length,
+	}
+}
+
+// payloadCopy returns a copy of the start of payload, unmasked with
+// maskKey, of at most the limit, or nil if the limit is 0.
+func payloadCopy[T string | []byte](limit *atomic.Int64, payload T, maskKey [4]byte) []byte {
+	n := min(int64(len(payload)), limit.Load())
+	if n == 0 {
+		return nil
+	}
+	p := make([]byte, n)
+	for i := range p {
+		p[i] = payload[i] ^ maskKey[i%4]
+	}
+	return p
+}
@@ -0,0 +1,134 @@
+package websocket_test
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"sync"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// frameRecorder records the frames reported to frame hooks.
+type frameRecorder struct {
+	mx     sync.Mutex
+	frames []websocket.FrameInfo
+}
+
+func (r *frameRecorder) record(info websocket.FrameInfo) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.frames = append(r.frames, info)
+}
+
+func (r *frameRecorder) get() []websocket.FrameInfo {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return r.frames
+}
+
+func TestSetFrameHooks(t *testing.T) {
+	client, server := websocket.Pipe(websocket.WithWriteFragmentSize(3))
+	defer client.Close()
+	defer server.Close()
+	var clientRead, clientWritten, serverRead, serverWritten frameRecorder
+	client.SetFrameHooks(clientRead.record, clientWritten.record)
+	server.SetFrameHooks(serverRead.record, serverWritten.record)
+	client.SetFrameHookPayloadLimit(2)
+	server.SetFrameHookPayloadLimit(2)
+
+	written := make(chan struct{})
+	go func() {
+		client.WriteText("hello")
+		client.Write(&websocket.Message{Type: websocket.MessagePing, Data: []byte("p")})
+		close(written)
+	}()
+	if msg, err := server.Read(); err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("expected to read hello, got %v and %v", msg, err)
+	}
+	// the server responds to the ping with a pong while reading it, and
+	// reports the pong once it is written
+	pinged := make(chan struct{})
+	go func() {
+		server.Read()
+		close(pinged)
+	}()
+	if msg, err := client.Read(); err != nil || msg.Type != websocket.MessagePong {
+		t.Fatalf("expected to read a pong, got %v and %v", msg, err)
+	}
+	<-pinged
+	<-written
+
+	// the payloads are copied unmasked, up to the limit
+	sent := []websocket.FrameInfo{
+		{Fin: false, Opcode: 0x1, Masked: true, PayloadLength: 3, Payload: []byte("he")},
+		{Fin: true, Opcode: 0x0, Masked: true, PayloadLength: 2, Payload: []byte("lo")},
+		{Fin: true, Opcode: 0x9, Masked: true, PayloadLength: 1, Payload: []byte("p")},
+	}
+	if frames := clientWritten.get(); !reflect.DeepEqual(frames, sent) {
+		t.Fatalf("expected the client to write %+v, got %+v", sent, frames)
+	}
+	if frames := serverRead.get(); !reflect.DeepEqual(frames, sent) {
+		t.Fatalf("expected the server to read %+v, got %+v", sent, frames)
+	}
+	pong := []websocket.FrameInfo{{Fin: true, Opcode: 0xA, PayloadLength: 1, Payload: []byte("p")}}
+	if frames := serverWritten.get(); !reflect.DeepEqual(frames, pong) {
+		t.Fatalf("expected the server to write %+v, got %+v", pong, frames)
+	}
+	if frames := clientRead.get(); !reflect.DeepEqual(frames, pong) {
+		t.Fatalf("expected the client to read %+v, got %+v", pong, frames)
+	}
+
+	// the hooks are removed, and the payloads are not copied by default
+	server.SetFrameHooks(nil, nil)
+	client.SetFrameHookPayloadLimit(0)
+	go server.Read()
+	client.WriteText("bye")
+	if frames := clientWritten.get(); len(frames) != 4 || frames[3].Payload != nil {
+		t.Fatalf("expected the last frame to be reported without its payload, got %+v", frames)
+	}
+	if frames := serverRead.get(); len(frames) != 3 {
+		t.Fatalf("expected the read hook to be removed, got %d frames", len(frames))
+	}
+}
+
+func TestSetFrameHooks_Vectored(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer ln.Close()
+	nc, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accepting: %v", err)
+	}
+	client := websocket.From(nc, websocket.WithRole(websocket.RoleClient))
+	server := websocket.From(accepted)
+	defer client.Close()
+	defer server.Close()
+
+	// a large message of a server is written with a vectored write
+	var frames frameRecorder
+	server.SetFrameHooks(nil, frames.record)
+	server.SetFrameHookPayloadLimit(4)
+	data := bytes.Repeat([]byte("abcd"), 2000)
+	written := make(chan websocket.Error, 1)
+	go func() {
+		written <- server.Write(&websocket.Message{Type: websocket.MessageBinary, Data: data})
+	}()
+	if msg, err := client.Read(); err != nil || !bytes.Equal(msg.Data, data) {
+		t.Fatalf("expected to read the message, got %v", err)
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	expected := []websocket.FrameInfo{{Fin: true, Opcode: 0x2, PayloadLength: 8000, Payload: []byte("abcd")}}
+	if frames := frames.get(); !reflect.DeepEqual(frames, expected) {
+		t.Fatalf("expected the server to write %+v, got %+v", expected, frames)
+	}
+}
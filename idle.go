@@ -0,0 +1,119 @@
+package websocket
+
+import "time"
+
+// IdlePolicy determines what counts as traffic for the idle timeout set
+// with SetIdleTimeout, and what happens once it expires. Policies are
+// combined with |, such as IdleAnyTraffic|IdlePingFirst.
+type IdlePolicy uint8
+
+const (
+	// IdleInbound only counts the frames read from the peer as traffic,
+	// so a connection that is only written to is idle.
+	IdleInbound IdlePolicy = 0
+	// IdleAnyTraffic counts the frames read and the messages written as
+	// traffic.
+	IdleAnyTraffic IdlePolicy = 1 << 0
+	// IdlePingFirst pings the peer once the idle timeout expires, and only
+	// closes the connection if no pong is received within the ping timeout
+	// (see SetPingTimeout), giving the peer one chance to show that it is
+	// still there. A pong resets the idle timeout.
+	IdlePingFirst IdlePolicy = 1 << 1
+)
+
+// idleTimeout closes a connection that has been idle for too long.
+type idleTimeout struct {
+	timeout time.Duration
+	policy  IdlePolicy
+	started int64 // when it was set, in Unix nanoseconds
+	stop    chan struct{}
+}
+
+// WithIdleTimeout sets the idle timeout of the Conn, like SetIdleTimeout,
+// from when it is created.
+func WithIdleTimeout(timeout time.Duration, policy IdlePolicy) Option {
+	return func(c *Conn) {
+		c.idleTimeoutOption = &idleTimeout{timeout: timeout, policy: policy}
+	}
+}
+
+// SetIdleTimeout closes the connection with close code 1001 (going away)
+// once it has seen no traffic for the timeout specified, so that the
+// connections of peers that went away without closing them do not pile
+// up. The policy decides what counts as traffic, and whether the peer is
+// pinged before the connection is closed. Err then returns an
+// IDLE_TIMEOUT error.
+//
+// The idle timeout is checked against the times returned by LastActivity
+// with a timer that only fires once per timeout, so it costs nothing per
+// frame. Frames are only read while the connection is being read from,
+// so a connection that is not read from is idle unless the policy counts
+// the messages written. Calling SetIdleTimeout again replaces the current
+// settings and starts counting from then, and a timeout of 0 or less
+// disables it.
+func (c *Conn) SetIdleTimeout(timeout time.Duration, policy IdlePolicy) {
+	var t *idleTimeout
+	if timeout > 0 {
+		t = &idleTimeout{
+			timeout: timeout,
+			policy:  policy,
+			started: c.clock.Now().UnixNano(),
+			stop:    make(chan struct{}),
+		}
+	}
+	if old := c.idleTimeout.Swap(t); old != nil {
+		close(old.stop)
+	}
+	if t != nil {
+		go c.runIdleTimeout(t)
+	}
+}
+
+// lastTraffic returns when the connection last saw traffic that counts
+// for t, in Unix nanoseconds.
+func (c *Conn) lastTraffic(t *idleTimeout) int64 {
+	last := max(t.started, c.activity.lastRead.Load())
+	if t.policy&IdleAnyTraffic != 0 {
+		last = max(last, c.activity.lastWrite.Load())
+	}
+	return last
+}
+
+// runIdleTimeout closes the connection once it has been idle for the
+// timeout of t, until t is stopped or the connection is closed.
+func (c *Conn) runIdleTimeout(t *idleTimeout) {
+	for {
+		idle := c.clock.Now().Sub(time.Unix(0, c.lastTraffic(t)))
+		if idle < t.timeout {
+			timer := c.clock.NewTimer(t.timeout - idle)
+			select {
+			case <-timer.C():
+				continue
+			case <-t.stop:
+			case <-c.ctx.Done():
+			}
+			timer.Stop()
+			return
+		}
+
+		if t.policy&IdlePingFirst != 0 {
+			_, err := c.ping(nil, nil, nil)
+			switch {
+			case err == nil: // the pong was read, which is traffic
+				continue
+			case err.Kind() != PING_TIMEOUT:
+				return
+			}
+			select {
+			case <-t.stop:
+				return
+			default:
+			}
+			idle = c.clock.Now().Sub(time.Unix(0, c.lastTraffic(t)))
+		}
+		c.logger.Error("closing idle connection", "idle", idle)
+		c.setErr(errorf(IDLE_TIMEOUT, idle))
+		c.closeWithCode(CloseGoingAway, "idle timeout")
+		return
+	}
+}
@@ -0,0 +1,178 @@
+package websocket_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// closeCodeWritten returns the code of the close frame written last to
+// mockConn by a server.
+func closeCodeWritten(t *testing.T, mockConn *CountingConn) int {
+	t.Helper()
+	mockConn.mutex.Lock()
+	defer mockConn.mutex.Unlock()
+	b := mockConn.buf.Bytes()
+	for len(b) > 0 && b[0] != 0x88 { // skip the frames before the close frame
+		b = b[2+b[1]:]
+	}
+	if len(b) < 2 {
+		t.Fatalf("expected a close frame to be written")
+	}
+	closeErr, err := websocket.ParseCloseMessage(b[2 : 2+b[1]])
+	if err != nil {
+		t.Fatalf("parsing the close frame: %v", err)
+	}
+	return closeErr.Code
+}
+
+// readMessages reads from conn until an error occurs, sending every
+// message and the error to the channel returned.
+func readMessages(conn *websocket.Conn) <-chan websocket.Error {
+	errs := make(chan websocket.Error, 16)
+	go func() {
+		for {
+			_, err := conn.Read()
+			errs <- err
+			if err != nil {
+				return
+			}
+		}
+	}()
+	return errs
+}
+
+func TestSetIdleTimeout(t *testing.T) {
+	clk := clock.NewFake()
+	mockConn := new(CountingConn)
+	conn := websocket.From(mockConn, websocket.WithClock(clk), websocket.WithIdleTimeout(time.Minute, websocket.IdleInbound))
+	defer conn.Close()
+
+	waitForTimer(t, clk, time.Minute)
+	clk.Advance(59 * time.Second)
+	if conn.Context().Err() != nil {
+		t.Fatalf("expected the connection to stay open before the idle timeout")
+	}
+	clk.Advance(time.Second)
+	<-conn.Context().Done()
+	err := conn.Err()
+	if !errors.Is(err, websocket.ErrIdleTimeout) {
+		t.Fatalf("expected Err() to be an IDLE_TIMEOUT error, got %v", err)
+	}
+	assertTimeout(t, err)
+	if code := closeCodeWritten(t, mockConn); code != websocket.CloseGoingAway {
+		t.Fatalf("expected the connection to be closed with 1001, got %d", code)
+	}
+}
+
+func TestSetIdleTimeout_Activity(t *testing.T) {
+	for _, policy := range []websocket.IdlePolicy{websocket.IdleInbound, websocket.IdleAnyTraffic} {
+		clk := clock.NewFake()
+		client, server := websocket.Pipe(websocket.WithClock(clk))
+		received := readMessages(client)
+		server.SetIdleTimeout(time.Minute, policy)
+
+		// a frame read 30s in resets the idle timeout
+		waitForTimer(t, clk, time.Minute)
+		clk.Advance(30 * time.Second)
+		go client.WriteText("hello")
+		if _, err := server.Read(); err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+		clk.Advance(30 * time.Second)
+		waitForTimer(t, clk, 30*time.Second)
+
+		// a message written 60s in only resets it if writes count
+		if err := server.WriteText("hello"); err != nil {
+			t.Fatalf("writing: %v", err)
+		}
+		if err := <-received; err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+		clk.Advance(30 * time.Second)
+		if policy == websocket.IdleAnyTraffic {
+			waitForTimer(t, clk, 30*time.Second)
+			if server.Context().Err() != nil {
+				t.Fatalf("expected the write to keep the connection open")
+			}
+			client.Close()
+			server.Close()
+			continue
+		}
+		if err := <-received; !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+			t.Fatalf("expected the connection to be closed with 1001, got %v", err)
+		}
+		<-server.Context().Done()
+		if !errors.Is(server.Err(), websocket.ErrIdleTimeout) {
+			t.Fatalf("expected Err() to be an IDLE_TIMEOUT error, got %v", server.Err())
+		}
+		client.Close()
+	}
+}
+
+func TestSetIdleTimeout_PingFirst(t *testing.T) {
+	t.Run("Pong", func(t *testing.T) {
+		clk := clock.NewFake()
+		client, server := websocket.Pipe(websocket.WithClock(clk))
+		defer client.Close()
+		defer server.Close()
+		go readLoop(client) // responds to pings
+		go readLoop(server)
+		server.SetIdleTimeout(time.Minute, websocket.IdleInbound|websocket.IdlePingFirst)
+
+		// the pong resets the idle timeout
+		waitForTimer(t, clk, time.Minute)
+		clk.Advance(time.Minute)
+		waitForTimer(t, clk, time.Minute)
+		if server.Context().Err() != nil {
+			t.Fatalf("expected the pong to keep the connection open")
+		}
+		if pongs := server.Stats().MessagesRead.Pong; pongs != 1 {
+			t.Fatalf("expected the server to read 1 pong, got %d", pongs)
+		}
+	})
+	t.Run("NoPong", func(t *testing.T) {
+		clk := clock.NewFake()
+		mockConn := new(CountingConn)
+		conn := websocket.From(mockConn, websocket.WithClock(clk))
+		defer conn.Close()
+		conn.SetIdleTimeout(time.Minute, websocket.IdleAnyTraffic|websocket.IdlePingFirst)
+
+		// the peer gets the ping timeout to respond
+		waitForTimer(t, clk, time.Minute)
+		clk.Advance(time.Minute)
+		waitForTimer(t, clk, 5*time.Second)
+		if conn.Context().Err() != nil {
+			t.Fatalf("expected the connection to stay open while waiting for the pong")
+		}
+		clk.Advance(5 * time.Second)
+		<-conn.Context().Done()
+		if !errors.Is(conn.Err(), websocket.ErrIdleTimeout) {
+			t.Fatalf("expected Err() to be an IDLE_TIMEOUT error, got %v", conn.Err())
+		}
+		if pings := conn.Stats().MessagesWritten.Ping; pings != 1 {
+			t.Fatalf("expected 1 ping to be written, got %d", pings)
+		}
+		if code := closeCodeWritten(t, mockConn); code != websocket.CloseGoingAway {
+			t.Fatalf("expected the connection to be closed with 1001, got %d", code)
+		}
+	})
+}
+
+func TestSetIdleTimeout_Disable(t *testing.T) {
+	clk := clock.NewFake()
+	conn := websocket.From(&CountingConn{discard: true}, websocket.WithClock(clk))
+	defer conn.Close()
+
+	conn.SetIdleTimeout(time.Minute, websocket.IdleInbound)
+	waitForTimer(t, clk, time.Minute)
+	conn.SetIdleTimeout(0, websocket.IdleInbound)
+	waitFor(t, time.Second, func() bool { return clk.Pending() == 0 })
+	clk.Advance(time.Hour)
+	if conn.Context().Err() != nil {
+		t.Fatalf("expected the connection to stay open once the idle timeout is disabled")
+	}
+}
@@ -0,0 +1,353 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"syscall"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// A recorded case is the frames a case of the fuzzingclient sends, in
+// order, and the messages the server is expected to send in response:
+// data messages once reassembled and decompressed, and control frames as
+// they are, up to the close frame of the server, after which it must
+// close the connection.
+type recordedCase struct {
+	id string
+	// extensions is the Sec-WebSocket-Extensions header of the handshake,
+	// if any, in which case the data frames with rsv1 set are compressed
+	// before they are sent
+	extensions string
+	frames     []websocket.Frame
+	expected   []message
+}
+
+// message is a message sent by the server.
+type message struct {
+	opcode byte
+	data   string
+}
+
+func frame(opcode byte, fin bool, payload string) websocket.Frame {
+	return websocket.Frame{Fin: fin, Opcode: opcode, Payload: []byte(payload)}
+}
+
+func text(s string) websocket.Frame        { return frame(0x1, true, s) }
+func binaryFrame(s string) websocket.Frame { return frame(0x2, true, s) }
+func ping(s string) websocket.Frame        { return frame(0x9, true, s) }
+
+// compressed is a text frame with rsv1 set, compressed when it is sent.
+func compressed(s string) websocket.Frame {
+	f := text(s)
+	f.Rsv[0] = true
+	return f
+}
+
+// closeFrame is a close frame with the code and reason specified, even
+// codes that may not be sent.
+func closeFrame(code uint16, reason string) websocket.Frame {
+	return frame(0x8, true, string(binary16(code))+reason)
+}
+
+func binary16(n uint16) []byte {
+	return binary.BigEndian.AppendUint16(nil, n)
+}
+
+func echoed(f websocket.Frame) message { return message{f.Opcode, string(f.Payload)} }
+func pong(s string) message            { return message{0xA, s} }
+
+// closed is the close frame the server responds with.
+func closed(code uint16) message {
+	if code == websocket.CloseNoStatusReceived {
+		return message{0x8, ""}
+	}
+	return message{0x8, string(binary16(code))}
+}
+
+// failed is how the server fails the connection for a protocol violation.
+var failed = closed(websocket.CloseProtocolError)
+
+func unhex(s string) string {
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// normalClose is the close frame the fuzzingclient ends every case with
+// that does not fail the connection, and the response to it.
+var normalClose, normalClosed = closeFrame(websocket.CloseNormalClosure, ""), closed(websocket.CloseNormalClosure)
+
+// recordedCases are the critical cases of the suite, reproduced from the
+// frames the fuzzingclient sends for them.
+var recordedCases = func() []recordedCase {
+	payload64k := strings.Repeat("*", 65536)
+	var fragmented64k []websocket.Frame
+	for i := 0; i < len(payload64k); i += 1300 {
+		opcode := byte(0x1)
+		if i > 0 {
+			opcode = 0x0
+		}
+		fragmented64k = append(fragmented64k, frame(opcode, i+1300 >= len(payload64k), payload64k[i:min(i+1300, len(payload64k))]))
+	}
+	var compressed16, compressed1k []websocket.Frame
+	var echoed16, echoed1k []message
+	for i := 0; i < 1000; i++ {
+		small := fmt.Sprintf("message %08d", i)
+		compressed16 = append(compressed16, compressed(small))
+		echoed16 = append(echoed16, message{0x1, small})
+		if i < 100 {
+			large := strings.Repeat(small+" ", 64)
+			compressed1k = append(compressed1k, compressed(large))
+			echoed1k = append(echoed1k, message{0x1, large})
+		}
+	}
+	utf8Text := "Hello-µ@ßöäüàá-UTF-8!!"
+	invalidUTF8 := unhex("cebae1bdb9cf83cebcceb5eda080656469746564")
+
+	return []recordedCase{
+		// 1: framing
+		{id: "1.1.1", frames: []websocket.Frame{text(""), normalClose}, expected: []message{echoed(text("")), normalClosed}},
+		{id: "1.1.6", frames: []websocket.Frame{text(payload64k[:65535]), normalClose}, expected: []message{echoed(text(payload64k[:65535])), normalClosed}},
+		{id: "1.2.3", frames: []websocket.Frame{binaryFrame(strings.Repeat("\xfe", 126)), normalClose}, expected: []message{echoed(binaryFrame(strings.Repeat("\xfe", 126))), normalClosed}},
+		// 2: pings and pongs
+		{id: "2.1", frames: []websocket.Frame{ping(""), normalClose}, expected: []message{pong(""), normalClosed}},
+		{id: "2.3", frames: []websocket.Frame{ping(unhex("00fffefdfcfb00ff")), normalClose}, expected: []message{pong(unhex("00fffefdfcfb00ff")), normalClosed}},
+		{id: "2.5", frames: []websocket.Frame{ping(strings.Repeat("\xfe", 126)), normalClose}, expected: []message{failed}},
+		{id: "2.10", frames: append(repeat(ping("payload"), 10), normalClose), expected: append(repeatMessage(pong("payload"), 10), normalClosed)},
+		// 3: reserved bits
+		{id: "3.1", frames: []websocket.Frame{{Fin: true, Rsv: [3]bool{true}, Opcode: 0x1, Payload: []byte("Hello, world!")}}, expected: []message{failed}},
+		{id: "3.2", frames: []websocket.Frame{text("Hello, world!"), {Fin: true, Rsv: [3]bool{false, true}, Opcode: 0x1, Payload: []byte("Hello, world!")}, ping("")},
+			expected: []message{echoed(text("Hello, world!")), failed}},
+		// 4: reserved opcodes
+		{id: "4.1.1", frames: []websocket.Frame{frame(0x3, true, "")}, expected: []message{failed}},
+		{id: "4.2.1", frames: []websocket.Frame{frame(0xB, true, "")}, expected: []message{failed}},
+		// 5: fragmentation
+		{id: "5.1", frames: []websocket.Frame{frame(0x9, false, "fragment1"), frame(0x0, true, "fragment2")}, expected: []message{failed}},
+		{id: "5.3", frames: []websocket.Frame{frame(0x1, false, "fragment1"), frame(0x0, true, "fragment2"), normalClose},
+			expected: []message{{0x1, "fragment1fragment2"}, normalClosed}},
+		{id: "5.6", frames: []websocket.Frame{frame(0x1, false, "fragment1"), ping("ping payload"), frame(0x0, true, "fragment2"), normalClose},
+			expected: []message{pong("ping payload"), {0x1, "fragment1fragment2"}, normalClosed}},
+		{id: "5.9", frames: []websocket.Frame{frame(0x0, true, "non-continuation payload"), text("Hello, world!")}, expected: []message{failed}},
+		{id: "5.15", frames: []websocket.Frame{frame(0x1, false, "fragment1"), frame(0x0, true, "fragment2"), frame(0x0, false, "fragment3"), text("fragment4")},
+			expected: []message{{0x1, "fragment1fragment2"}, failed}},
+		// 6: UTF-8 handling
+		{id: "6.2.1", frames: []websocket.Frame{text(utf8Text), normalClose}, expected: []message{echoed(text(utf8Text)), normalClosed}},
+		{id: "6.3.1", frames: []websocket.Frame{text(invalidUTF8)}, expected: []message{closed(websocket.CloseInvalidFramePayloadData)}},
+		{id: "6.4.1", frames: []websocket.Frame{frame(0x1, false, unhex("cebae1bdb9cf83cebcceb5")), frame(0x0, false, unhex("f4908080")), frame(0x0, true, unhex("656469746564"))},
+			expected: []message{closed(websocket.CloseInvalidFramePayloadData)}},
+		// 7: close handling
+		{id: "7.1.1", frames: []websocket.Frame{text("Hello World!"), normalClose}, expected: []message{echoed(text("Hello World!")), normalClosed}},
+		{id: "7.1.3", frames: []websocket.Frame{normalClose, ping("")}, expected: []message{normalClosed}},
+		{id: "7.1.5", frames: []websocket.Frame{frame(0x1, false, "fragment1"), normalClose, frame(0x0, true, "fragment2")}, expected: []message{normalClosed}},
+		{id: "7.3.1", frames: []websocket.Frame{frame(0x8, true, "")}, expected: []message{closed(websocket.CloseNoStatusReceived)}},
+		{id: "7.3.2", frames: []websocket.Frame{frame(0x8, true, "a")}, expected: []message{failed}},
+		{id: "7.3.6", frames: []websocket.Frame{closeFrame(websocket.CloseNormalClosure, strings.Repeat("*", 124))}, expected: []message{failed}},
+		{id: "7.5.1", frames: []websocket.Frame{closeFrame(websocket.CloseNormalClosure, invalidUTF8)}, expected: []message{failed}},
+		{id: "7.7.1", frames: []websocket.Frame{closeFrame(1000, "")}, expected: []message{closed(1000)}},
+		{id: "7.7.10", frames: []websocket.Frame{closeFrame(3000, "")}, expected: []message{closed(3000)}},
+		{id: "7.7.13", frames: []websocket.Frame{closeFrame(4999, "")}, expected: []message{closed(4999)}},
+		{id: "7.9.1", frames: []websocket.Frame{closeFrame(0, "")}, expected: []message{failed}},
+		{id: "7.9.2", frames: []websocket.Frame{closeFrame(999, "")}, expected: []message{failed}},
+		{id: "7.9.3", frames: []websocket.Frame{closeFrame(1004, "")}, expected: []message{failed}},
+		{id: "7.9.4", frames: []websocket.Frame{closeFrame(1005, "")}, expected: []message{failed}},
+		{id: "7.9.5", frames: []websocket.Frame{closeFrame(1006, "")}, expected: []message{failed}},
+		{id: "7.9.6", frames: []websocket.Frame{closeFrame(1016, "")}, expected: []message{failed}},
+		{id: "7.9.9", frames: []websocket.Frame{closeFrame(2999, "")}, expected: []message{failed}},
+		// 9 and 10: large and auto-fragmented messages
+		{id: "9.1.1", frames: []websocket.Frame{text(payload64k), normalClose}, expected: []message{{0x1, payload64k}, normalClosed}},
+		{id: "10.1.1", frames: append(fragmented64k, normalClose), expected: []message{{0x1, payload64k}, normalClosed}},
+		// 12 and 13: permessage-deflate, with the 16 byte messages echoed
+		// uncompressed and the 1 KiB ones compressed
+		{id: "12.1.1", extensions: "permessage-deflate; client_max_window_bits",
+			frames: append(compressed16, normalClose), expected: append(echoed16, normalClosed)},
+		{id: "12.1.4", extensions: "permessage-deflate; client_max_window_bits",
+			frames: append(compressed1k, normalClose), expected: append(echoed1k, normalClosed)},
+		{id: "13.2.4", extensions: "permessage-deflate; server_no_context_takeover",
+			frames: append(compressed1k, normalClose), expected: append(echoed1k, normalClosed)},
+	}
+}()
+
+func repeat(f websocket.Frame, n int) []websocket.Frame {
+	frames := make([]websocket.Frame, n)
+	for i := range frames {
+		frames[i] = f
+	}
+	return frames
+}
+
+func repeatMessage(m message, n int) []message {
+	messages := make([]message, n)
+	for i := range messages {
+		messages[i] = m
+	}
+	return messages
+}
+
+func TestRecordedCases(t *testing.T) {
+	srv := httptest.NewServer(defaultConfig.handler())
+	defer srv.Close()
+	for _, c := range recordedCases {
+		t.Run(c.id, func(t *testing.T) {
+			conn, r := handshake(t, srv.Listener.Addr().String(), c.extensions)
+			defer conn.Close()
+			go sendFrames(conn, c.frames, c.extensions != "")
+
+			got, err := readMessages(r, strings.Contains(c.extensions, "server_no_context_takeover"))
+			if err != nil {
+				t.Fatalf("reading the messages of the server: %v", err)
+			}
+			if len(got) != len(c.expected) {
+				t.Fatalf("expected %d messages, got %d: %s", len(c.expected), len(got), summary(got))
+			}
+			for i := range got {
+				if got[i] != c.expected[i] {
+					t.Fatalf("expected message %d to be %s, got %s", i, summary(c.expected[i:i+1]), summary(got[i:i+1]))
+				}
+			}
+		})
+	}
+}
+
+// handshake opens a connection to the server at addr, offering the
+// extensions specified, and returns it with the reader the frames of the
+// server are read from.
+func handshake(t *testing.T, addr, extensions string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	req, _ := http.NewRequest(http.MethodGet, "http://"+addr+"/", nil)
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	if extensions != "" {
+		req.Header.Set("Sec-WebSocket-Extensions", extensions)
+	}
+	if err := req.Write(conn); err != nil {
+		t.Fatalf("writing the handshake: %v", err)
+	}
+	r := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(r, req)
+	if err != nil || resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("expected the handshake to succeed, got %v (%v)", resp, err)
+	}
+	if extensions != "" && !strings.HasPrefix(resp.Header.Get("Sec-WebSocket-Extensions"), "permessage-deflate") {
+		t.Fatalf("expected permessage-deflate to be negotiated, got %q", resp.Header.Get("Sec-WebSocket-Extensions"))
+	}
+	return conn, r
+}
+
+// sendFrames writes the frames of a case to w, masked like the frames of
+// a client, compressing the frames with rsv1 set if deflate is set. The
+// compressor keeps its window between messages, as the server does not
+// forbid it.
+func sendFrames(w io.Writer, frames []websocket.Frame, deflate bool) {
+	var compressedBuf bytes.Buffer
+	fw, _ := flate.NewWriter(&compressedBuf, flate.BestSpeed)
+	var b []byte
+	for _, f := range frames {
+		if deflate && f.Rsv[0] {
+			compressedBuf.Reset()
+			fw.Write(f.Payload)
+			fw.Flush()
+			f.Payload = bytes.TrimSuffix(compressedBuf.Bytes(), []byte{0, 0, 0xff, 0xff})
+		}
+		f.Masked = true
+		f.MaskKey = [4]byte{0x12, 0x34, 0x56, 0x78}
+		b = f.AppendMarshal(b)
+	}
+	w.Write(b)
+}
+
+// readMessages reads the messages of the server from r until its close
+// frame, and checks that the connection ends after it. Compressed
+// messages are decompressed with the window of the messages the server
+// compressed before them, unless noContextTakeover is set.
+func readMessages(r io.Reader, noContextTakeover bool) ([]message, error) {
+	var messages []message
+	var fragments []byte
+	var compressedMessage bool
+	var window []byte
+	for {
+		f, err := websocket.ParseFrame(r)
+		if err != nil {
+			return messages, err
+		}
+		if f.Masked {
+			return messages, errors.New("the frames of a server must not be masked")
+		}
+		switch f.Opcode {
+		case 0x8:
+			messages = append(messages, message{f.Opcode, string(f.Payload)})
+			// the server resets the connection if it closes it with frames
+			// of the client left unread
+			if _, err := websocket.ParseFrame(r); err != io.EOF && !errors.Is(err, syscall.ECONNRESET) {
+				return messages, fmt.Errorf("expected the connection to end after the close frame, got %v", err)
+			}
+			return messages, nil
+		case 0x9, 0xA:
+			messages = append(messages, message{f.Opcode, string(f.Payload)})
+			continue
+		case 0x1, 0x2:
+			fragments, compressedMessage = f.Payload, f.Rsv[0]
+			messages = append(messages, message{opcode: f.Opcode})
+		default:
+			fragments = append(fragments, f.Payload...)
+		}
+		if !f.Fin {
+			continue
+		}
+		data := fragments
+		if compressedMessage {
+			if noContextTakeover {
+				window = nil
+			}
+			if data, err = inflate(data, window); err != nil {
+				return messages, err
+			}
+			window = append(window, data...)
+			window = window[max(0, len(window)-32<<10):]
+		}
+		messages[len(messages)-1].data = string(data)
+	}
+}
+
+// inflate decompresses the payload of a compressed message with the
+// window specified.
+func inflate(payload, window []byte) ([]byte, error) {
+	// the tail removed by the server, and an empty final block
+	stream := append(payload[:len(payload):len(payload)], 0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff)
+	return io.ReadAll(flate.NewReaderDict(bytes.NewReader(stream), window))
+}
+
+// summary describes messages for the failures of the tests, without their
+// large payloads.
+func summary(messages []message) string {
+	var b strings.Builder
+	for _, m := range messages {
+		data := m.data
+		if len(data) > 32 {
+			data = fmt.Sprintf("%s... (%d bytes)", data[:32], len(data))
+		}
+		fmt.Fprintf(&b, "[opcode %#x %q] ", m.opcode, data)
+	}
+	return b.String()
+}
@@ -0,0 +1,99 @@
+// Autobahn is the server the fuzzingclient of the Autobahn test suite
+// (https://github.com/crossbario/autobahn-testsuite) tests the package
+// against. It accepts WebSocket connections on every path and echoes
+// every text and binary message, with permessage-deflate enabled and
+// every check of the strict mode.
+//
+// To run the whole suite, start the server and run the fuzzingclient with
+// the spec in this directory, which writes its report to reports/servers:
+//
+//	go run ./internal/autobahn &
+//	docker run --rm --net=host -v "$PWD/internal/autobahn:/config" \
+//		crossbario/autobahn-testsuite \
+//		wstest -m fuzzingclient -s /config/fuzzingclient.json
+//
+// The flags are:
+//
+//	-addr address
+//		listen on address, 127.0.0.1:9001 by default
+//	-lenient
+//		use websocket.Lenient instead of websocket.Strict
+//	-read-limit n
+//		the read limit of the connections, 64 MiB by default, which is
+//		more than the largest message of the suite
+//	-compression
+//		accept permessage-deflate, true by default
+//
+// The critical cases of the suite are recorded in cases_test.go, and are
+// run by go test without the suite.
+package main
+
+import (
+	"flag"
+	"log"
+	"net/http"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// config configures the echo server.
+type config struct {
+	strict      websocket.StrictMode
+	readLimit   int64
+	compression bool
+}
+
+// defaultConfig is the config the suite is run with.
+var defaultConfig = config{strict: websocket.Strict, readLimit: 64 << 20, compression: true}
+
+func main() {
+	cfg := defaultConfig
+	addr := flag.String("addr", "127.0.0.1:9001", "listen on `address`")
+	lenient := flag.Bool("lenient", false, "use websocket.Lenient instead of websocket.Strict")
+	flag.Int64Var(&cfg.readLimit, "read-limit", cfg.readLimit, "the read limit of the connections in bytes")
+	flag.BoolVar(&cfg.compression, "compression", cfg.compression, "accept permessage-deflate")
+	flag.Parse()
+	if *lenient {
+		cfg.strict = websocket.Lenient
+	}
+
+	log.Printf("listening on %s", *addr)
+	log.Fatal(http.ListenAndServe(*addr, cfg.handler()))
+}
+
+// handler returns the handler accepting the connections of the suite and
+// echoing their messages.
+func (cfg config) handler() http.Handler {
+	opts := []websocket.Option{websocket.WithStrictMode(cfg.strict), websocket.WithReadLimit(cfg.readLimit)}
+	if cfg.compression {
+		opts = append(opts, websocket.WithCompression(websocket.CompressionOptions{}))
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, err := websocket.AcceptHTTP(w, r, opts...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		defer conn.Close()
+		echo(conn)
+	})
+}
+
+// echo writes every data message read from conn back to it, until the
+// connection ends. The Conn responds to pings and close frames itself,
+// and closes the connection with the close code of any violation of the
+// protocol.
+func echo(conn *websocket.Conn) {
+	for {
+		msg, err := conn.Read()
+		if err != nil {
+			return
+		}
+		if !msg.IsData() {
+			continue
+		}
+		if err := conn.Write(msg); err != nil {
+			return
+		}
+	}
+}
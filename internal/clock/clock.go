@@ -0,0 +1,54 @@
+// Package clock provides the time source used by the websocket packages,
+// so that timing logic can be driven by a fake clock in tests.
+package clock
+
+import "time"
+
+// Clock provides the current time and timers.
+type Clock interface {
+	Now() time.Time
+	NewTimer(d time.Duration) Timer
+	// After returns a channel that receives the time once d has passed,
+	// for waits that are never stopped early.
+	After(d time.Duration) <-chan time.Time
+	// AfterFunc calls f in its own goroutine once d has passed, unless the
+	// returned Timer is stopped first. The channel of the Timer is nil.
+	AfterFunc(d time.Duration, f func()) Timer
+}
+
+// Timer is the subset of *time.Timer used by the websocket packages.
+type Timer interface {
+	C() <-chan time.Time
+	Stop() bool
+}
+
+// Real is the Clock backed by the time package.
+type Real struct{}
+
+func (Real) Now() time.Time {
+	return time.Now()
+}
+
+func (Real) NewTimer(d time.Duration) Timer {
+	return realTimer{time.NewTimer(d)}
+}
+
+func (Real) After(d time.Duration) <-chan time.Time {
+	return time.After(d)
+}
+
+func (Real) AfterFunc(d time.Duration, f func()) Timer {
+	return realTimer{time.AfterFunc(d, f)}
+}
+
+type realTimer struct {
+	t *time.Timer
+}
+
+func (t realTimer) C() <-chan time.Time {
+	return t.t.C
+}
+
+func (t realTimer) Stop() bool {
+	return t.t.Stop()
+}
@@ -0,0 +1,135 @@
+package clock
+
+import (
+	"sync"
+	"time"
+)
+
+// Fake is a Clock for tests. Time only moves when Advance or FireNext
+// is called.
+type Fake struct {
+	mx     sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+type fakeTimer struct {
+	clock *Fake
+	when  time.Time
+	c     chan time.Time
+	f     func() // set for the timers of AfterFunc, which have no channel
+}
+
+// NewFake returns a Fake clock set to the start of 2000, so that the times
+// it returns are never mistaken for a zero Unix time.
+func NewFake() *Fake {
+	return &Fake{now: time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC)}
+}
+
+func (c *Fake) Now() time.Time {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return c.now
+}
+
+func (c *Fake) NewTimer(d time.Duration) Timer {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), c: make(chan time.Time, 1)}
+	if d <= 0 {
+		t.c <- c.now
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+func (c *Fake) After(d time.Duration) <-chan time.Time {
+	return c.NewTimer(d).C()
+}
+
+func (c *Fake) AfterFunc(d time.Duration, f func()) Timer {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	t := &fakeTimer{clock: c, when: c.now.Add(d), f: f}
+	if d <= 0 {
+		go f()
+		return t
+	}
+	c.timers = append(c.timers, t)
+	return t
+}
+
+// Pending returns the amount of timers that have not fired or been stopped.
+func (c *Fake) Pending() int {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	return len(c.timers)
+}
+
+// Waiting returns how long until each pending timer fires.
+func (c *Fake) Waiting() []time.Duration {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	waiting := make([]time.Duration, 0, len(c.timers))
+	for _, t := range c.timers {
+		waiting = append(waiting, t.when.Sub(c.now))
+	}
+	return waiting
+}
+
+// Advance moves the clock forward by d, firing any timers that expire.
+func (c *Fake) Advance(d time.Duration) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	c.now = c.now.Add(d)
+	pending := c.timers[:0]
+	for _, t := range c.timers {
+		if t.when.After(c.now) {
+			pending = append(pending, t)
+			continue
+		}
+		if t.f != nil {
+			go t.f()
+			continue
+		}
+		t.c <- c.now
+	}
+	c.timers = pending
+}
+
+// FireNext advances the clock to the earliest pending timer and returns how far
+// the clock moved.
+func (c *Fake) FireNext() time.Duration {
+	c.mx.Lock()
+	if len(c.timers) == 0 {
+		c.mx.Unlock()
+		return 0
+	}
+	next := c.timers[0].when
+	for _, t := range c.timers[1:] {
+		if t.when.Before(next) {
+			next = t.when
+		}
+	}
+	d := next.Sub(c.now)
+	c.mx.Unlock()
+	c.Advance(d)
+	return d
+}
+
+func (t *fakeTimer) C() <-chan time.Time {
+	return t.c
+}
+
+func (t *fakeTimer) Stop() bool {
+	t.clock.mx.Lock()
+	defer t.clock.mx.Unlock()
+	for i, pending := range t.clock.timers {
+		if pending == t {
+			t.clock.timers = append(t.clock.timers[:i], t.clock.timers[i+1:]...)
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,112 @@
+package websocket
+
+import (
+	"context"
+	"time"
+
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// keepalive periodically pings the peer of a connection.
+type keepalive struct {
+	interval  time.Duration
+	timeout   time.Duration
+	maxMisses int
+	stop      chan struct{}
+}
+
+// EnableKeepalive starts pinging the peer every interval. If a pong is not
+// received within timeout, the ping counts as missed; once maxMisses pings
+// in a row are missed, the connection is closed without a close handshake,
+// since the peer is assumed to be gone (an abnormal closure, 1006). A pong
+// resets the count of missed pings, and every miss is reported to the
+// OnPongMissed function. The round-trip time of the latest ping
+// is available from LastRTT.
+//
+// Pongs are only received while the connection is being read from, so the
+// connection must be read from for keepalive pings to succeed. Keepalive
+// stops once the closing handshake starts or the connection is closed, and
+// a ping waiting for its pong then no longer counts. Calling
+// EnableKeepalive again replaces the current settings, and an interval of 0
+// or less disables it.
+func (c *Conn) EnableKeepalive(interval, timeout time.Duration, maxMisses int) {
+	var k *keepalive
+	if interval > 0 {
+		k = &keepalive{
+			interval:  interval,
+			timeout:   timeout,
+			maxMisses: max(maxMisses, 1),
+			stop:      make(chan struct{}),
+		}
+	}
+	if old := c.keepalive.Swap(k); old != nil {
+		close(old.stop)
+	}
+	if k != nil {
+		go c.runKeepalive(k)
+	}
+}
+
+// LastRTT returns the round-trip time of the most recent ping that received
+// a pong, whether it was sent by Ping, PingRTT or keepalive. It returns 0 if
+// no ping has received a pong yet.
+func (c *Conn) LastRTT() time.Duration {
+	return time.Duration(c.lastRTT.Load())
+}
+
+// runKeepalive pings the peer every interval until k is stopped or the
+// connection is closed.
+func (c *Conn) runKeepalive(k *keepalive) {
+	for {
+		t := c.clock.NewTimer(k.interval)
+		select {
+		case <-t.C():
+		case <-k.stop:
+			t.Stop()
+			return
+		case <-c.ctx.Done():
+			t.Stop()
+			return
+		}
+		if c.closing() {
+			return
+		}
+
+		var timeout <-chan time.Time
+		var timeoutTimer clock.Timer
+		if k.timeout > 0 {
+			timeoutTimer = c.clock.NewTimer(k.timeout)
+			timeout = timeoutTimer.C()
+		}
+		_, err := c.ping(context.Background(), nil, timeout)
+		if timeoutTimer != nil {
+			timeoutTimer.Stop()
+		}
+
+		switch {
+		case err == nil:
+		case err.Kind() == PING_TIMEOUT:
+			if c.closing() {
+				return
+			}
+			if int(c.pongMisses.Load()) >= k.maxMisses {
+				c.logger.Error("closing connection after missed keepalive pongs", "misses", k.maxMisses)
+				c.fail(err)
+				return
+			}
+		case err.Kind() == CONNECTION_CLOSED:
+			return
+		default:
+			c.logger.Error("an error occured while sending a keepalive ping", "error", err.Error())
+			c.fail(err)
+			return
+		}
+	}
+}
+
+// closing reports whether the closing handshake started, after which
+// keepalive stops, so that a missed pong does not fail the connection
+// while the peer responds to the close frame.
+func (c *Conn) closing() bool {
+	return c.closeSent.Load() || c.State() != StateOpen
+}
@@ -0,0 +1,165 @@
+package websocket_test
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// waitForTimer waits until the only pending timer on clk fires in d.
+func waitForTimer(t *testing.T, clk *clock.Fake, d time.Duration) {
+	t.Helper()
+	waitFor(t, time.Second, func() bool {
+		waiting := clk.Waiting()
+		return len(waiting) == 1 && waiting[0] == d
+	})
+}
+
+// readLoop reads from conn until an error occurs.
+func readLoop(conn *websocket.Conn) {
+	for {
+		if _, err := conn.Read(); err != nil {
+			return
+		}
+	}
+}
+
+func TestKeepalive_PongsFlow(t *testing.T) {
+	conn, peer := websocket.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+	clk := clock.NewFake()
+	websocket.UseClock(conn, clk)
+
+	var pings atomic.Int64
+	release := make(chan struct{})
+	peer.SetPingHandler(func(payload []byte) error {
+		pings.Add(1)
+		<-release
+		return peer.Write(&websocket.Message{Type: websocket.MessagePong, Data: payload})
+	})
+	go readLoop(conn)
+	go readLoop(peer)
+
+	conn.EnableKeepalive(10*time.Second, 5*time.Second, 2)
+	for i := range 5 {
+		waitForTimer(t, clk, 10*time.Second)
+		clk.Advance(10 * time.Second)
+		waitFor(t, time.Second, func() bool { return pings.Load() == int64(i+1) })
+		clk.Advance(250 * time.Millisecond)
+		release <- struct{}{}
+	}
+	waitForTimer(t, clk, 10*time.Second)
+
+	if conn.Context().Err() != nil {
+		t.Fatalf("Expected the connection to stay open while pongs flow")
+	}
+	if conn.LastRTT() != 250*time.Millisecond {
+		t.Fatalf("Expected the last round-trip time to be 250ms, got %s", conn.LastRTT())
+	}
+}
+
+func TestKeepalive_MissedPongs(t *testing.T) {
+	a, b := net.Pipe()
+	conn := websocket.From(a)
+	defer conn.Close()
+	clk := clock.NewFake()
+	websocket.UseClock(conn, clk)
+	go func() { // the peer reads but never responds
+		buf := make([]byte, 512)
+		for {
+			if _, err := b.Read(buf); err != nil {
+				return
+			}
+		}
+	}()
+	go readLoop(conn)
+
+	var misses []int
+	conn.OnPongMissed(func(consecutiveMisses int) {
+		misses = append(misses, consecutiveMisses)
+	})
+
+	conn.EnableKeepalive(10*time.Second, 5*time.Second, 3)
+	for i := range 3 {
+		if conn.Context().Err() != nil {
+			t.Fatalf("Expected the connection to stay open before the last miss")
+		}
+		waitForTimer(t, clk, 10*time.Second)
+		clk.Advance(10 * time.Second)
+		waitForTimer(t, clk, 5*time.Second)
+		clk.Advance(5 * time.Second)
+		if i < 2 {
+			waitForTimer(t, clk, 10*time.Second)
+			if len(misses) != i+1 || misses[i] != i+1 {
+				t.Fatalf("Expected OnPongMissed to count %d misses, got %v", i+1, misses)
+			}
+		}
+	}
+
+	select {
+	case <-conn.Context().Done():
+	case <-time.After(time.Second):
+		t.Fatalf("Expected the connection to be closed after 3 missed pongs")
+	}
+	if len(misses) != 3 || misses[2] != 3 {
+		t.Fatalf("Expected OnPongMissed to count 3 misses before closing, got %v", misses)
+	}
+	if err := conn.Err(); !errors.Is(err, websocket.ErrPingTimeout) {
+		t.Fatalf("Expected Err() to be a PING_TIMEOUT error, got %v", err)
+	}
+}
+
+func TestKeepalive_StopsOnClose(t *testing.T) {
+	conn := websocket.From(&CountingConn{discard: true})
+	clk := clock.NewFake()
+	websocket.UseClock(conn, clk)
+
+	conn.EnableKeepalive(10*time.Second, 5*time.Second, 3)
+	waitForTimer(t, clk, 10*time.Second)
+	conn.Close()
+	waitFor(t, time.Second, func() bool { return clk.Pending() == 0 })
+}
+
+func TestKeepalive_StopsOnClosingHandshake(t *testing.T) {
+	mockConn := &CountingConn{discard: true}
+	conn := websocket.From(mockConn)
+	clk := clock.NewFake()
+	websocket.UseClock(conn, clk)
+
+	// the closing handshake starts while a ping waits for its pong
+	conn.EnableKeepalive(10*time.Second, 5*time.Second, 1)
+	waitForTimer(t, clk, 10*time.Second)
+	clk.Advance(10 * time.Second)
+	waitForTimer(t, clk, 5*time.Second)
+	if err := conn.WriteClose(websocket.CloseNormalClosure, ""); err != nil {
+		t.Fatalf("writing the close frame: %v", err)
+	}
+	clk.Advance(5 * time.Second)
+	waitFor(t, time.Second, func() bool { return clk.Pending() == 0 })
+	select {
+	case <-conn.Context().Done():
+		t.Fatalf("expected the missed pong not to fail the connection, got %v", conn.Err())
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	// no ping is sent once the closing handshake started
+	conn = websocket.From(mockConn)
+	websocket.UseClock(conn, clk)
+	if err := conn.WriteClose(websocket.CloseNormalClosure, ""); err != nil {
+		t.Fatalf("writing the close frame: %v", err)
+	}
+	writes := mockConn.Writes()
+	conn.EnableKeepalive(10*time.Second, 5*time.Second, 1)
+	waitForTimer(t, clk, 10*time.Second)
+	clk.Advance(10 * time.Second)
+	waitFor(t, time.Second, func() bool { return clk.Pending() == 0 })
+	if mockConn.Writes() != writes {
+		t.Fatalf("expected no ping to be written after the close frame")
+	}
+}
@@ -0,0 +1,112 @@
+package websocket_test
+
+import (
+	"bytes"
+	"context"
+	"log/slog"
+	"net"
+	"sync"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// RecordingHandler is a slog.Handler that keeps every record with the
+// attributes added to its logger.
+type RecordingHandler struct {
+	mx      *sync.Mutex
+	attrs   []slog.Attr
+	records *[]map[string]string
+}
+
+func NewRecordingHandler() *RecordingHandler {
+	return &RecordingHandler{mx: new(sync.Mutex), records: new([]map[string]string)}
+}
+
+func (h *RecordingHandler) Enabled(context.Context, slog.Level) bool { return true }
+
+func (h *RecordingHandler) Handle(_ context.Context, r slog.Record) error {
+	record := map[string]string{"msg": r.Message}
+	for _, attr := range h.attrs {
+		record[attr.Key] = attr.Value.String()
+	}
+	r.Attrs(func(attr slog.Attr) bool {
+		record[attr.Key] = attr.Value.String()
+		return true
+	})
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	*h.records = append(*h.records, record)
+	return nil
+}
+
+func (h *RecordingHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	return &RecordingHandler{mx: h.mx, attrs: append(h.attrs[:len(h.attrs):len(h.attrs)], attrs...), records: h.records}
+}
+
+func (h *RecordingHandler) WithGroup(string) slog.Handler { return h }
+
+func (h *RecordingHandler) Records() []map[string]string {
+	h.mx.Lock()
+	defer h.mx.Unlock()
+	return append([]map[string]string(nil), *h.records...)
+}
+
+// failPong makes conn read a ping whose pong cannot be written, which is
+// logged.
+func failPong(t *testing.T, opts ...websocket.Option) {
+	t.Helper()
+	a, b := net.Pipe()
+	ping := []byte{0x89, 0x80, 0, 0, 0, 0} // an empty ping, masked
+	conn := websocket.From(&PingThenBrokenNetConn{Conn: a, r: bytes.NewReader(ping)}, opts...)
+	defer conn.Close()
+	defer b.Close()
+	if _, err := conn.Read(); err != nil {
+		t.Fatalf("expected no error reading the ping, got %v", err)
+	}
+}
+
+// PingThenBrokenNetConn is a net.Conn that reads from r and fails to write.
+type PingThenBrokenNetConn struct {
+	net.Conn
+	r *bytes.Reader
+}
+
+func (m *PingThenBrokenNetConn) Read(p []byte) (int, error)  { return m.r.Read(p) }
+func (m *PingThenBrokenNetConn) Write(p []byte) (int, error) { return 0, errBroken }
+
+func TestWithLogger(t *testing.T) {
+	h := NewRecordingHandler()
+	failPong(t, websocket.WithLogger(slog.New(h)))
+
+	records := h.Records()
+	if len(records) != 1 {
+		t.Fatalf("expected 1 record, got %v", records)
+	}
+	if records[0]["remote_addr"] != "pipe" {
+		t.Fatalf("expected the record to include the remote address, got %v", records[0])
+	}
+	if records[0]["conn_id"] == "" {
+		t.Fatalf("expected the record to include the connection ID, got %v", records[0])
+	}
+	if records[0]["error"] == "" {
+		t.Fatalf("expected the record to include the error, got %v", records[0])
+	}
+}
+
+func TestWithLogger_Default(t *testing.T) {
+	h := NewRecordingHandler()
+	defer slog.SetDefault(slog.Default())
+	slog.SetDefault(slog.New(h))
+
+	failPong(t)
+	if len(h.Records()) != 1 {
+		t.Fatalf("expected the default logger to be used, got %v", h.Records())
+	}
+
+	// a nil logger silences the connection
+	failPong(t, websocket.WithLogger(nil))
+	if len(h.Records()) != 1 {
+		t.Fatalf("expected no records with a nil logger, got %v", h.Records())
+	}
+}
@@ -0,0 +1,61 @@
+package websocket
+
+// WithLowMemory configures the Conn for a predictable memory ceiling, for
+// devices that serve a few connections with little memory. The Conn then
+// reads the payloads of text and binary messages into read, and encodes
+// the frames of the ones it writes into write, instead of growing buffers
+// of its own:
+//
+//   - the read buffer is reused as with WithReadBufferReuse, so a Message
+//     returned by Read is only valid until the next call to Read, unless
+//     it is copied with Message.Clone;
+//   - the read limit is the length of read, so a larger message is
+//     rejected and the connection is closed with CloseMessageTooBig;
+//   - writing a message whose frames do not fit in write returns a
+//     MESSAGE_TOO_LARGE error, without closing the connection;
+//   - compression is not negotiated, even with WithCompression.
+//
+// The buffers must not be used by anything else while the Conn is open.
+// The Conn starts no goroutines of its own. EnableKeepalive,
+// EnableWriteQueue, SetIdleTimeout, SetStallThreshold, and the flush
+// latency start some, and the write queue and the write buffer keep memory
+// of their own, so they should be left off to keep the ceiling. The
+// payloads of control messages are small and are not read into read.
+func WithLowMemory(read, write []byte) Option {
+	return func(c *Conn) {
+		c.lowMemory = true
+		c.reuseReadBuffer = true
+		c.rbuf = read[:0]
+		c.fixedWbuf = write[:0]
+	}
+}
+
+// applyLowMemory caps the limits of the Conn to the buffers set with
+// WithLowMemory, whatever the options applied after it set them to. It is
+// called by From once the options are applied.
+func (c *Conn) applyLowMemory() {
+	c.reuseReadBuffer = true
+	if n := int64(cap(c.rbuf)); c.readLimit == 0 || c.readLimit > n {
+		c.readLimit = n
+	}
+	if n := int64(cap(c.fixedWbuf) - maxFrameHeaderLength); n > 0 {
+		c.writeLimit.Store(n)
+	}
+}
+
+// writeFixed writes a message of the type specified with the payload data
+// like writeData, encoding its frames in the write buffer set with
+// WithLowMemory. Control frames are encoded in a buffer from framePool
+// instead, so that closing and answering pings work with any buffer.
+func writeFixed[T string | []byte](c *Conn, messageType MessageType, data T) Error {
+	c.fixedWmx.Lock()
+	defer c.fixedWmx.Unlock()
+	frames := 1
+	if c.fragmentSize > 0 && len(data) > c.fragmentSize {
+		frames = (len(data) + c.fragmentSize - 1) / c.fragmentSize
+	}
+	if len(data)+frames*maxFrameHeaderLength > cap(c.fixedWbuf) {
+		return errorf(MESSAGE_TOO_LARGE, "write", max(cap(c.fixedWbuf)-frames*maxFrameHeaderLength, 0))
+	}
+	return c.writeFrames(messageType, len(data), appendFrames(c, c.fixedWbuf[:0], messageType, 0, data))
+}
@@ -0,0 +1,116 @@
+package websocket_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// lowMemoryPair returns a client and a server Conn over net.Pipe, each with
+// buffers of n bytes set with WithLowMemory.
+func lowMemoryPair(n int) (client, server *websocket.Conn) {
+	a, b := net.Pipe()
+	client = websocket.From(a, websocket.WithRole(websocket.RoleClient), websocket.WithLowMemory(make([]byte, n), make([]byte, n)))
+	server = websocket.From(b, websocket.WithLowMemory(make([]byte, n), make([]byte, n)))
+	return client, server
+}
+
+func TestWithLowMemory_Echo(t *testing.T) {
+	if raceEnabled {
+		t.Skip("allocations cannot be counted with the race detector")
+	}
+	client, server := lowMemoryPair(16 << 10)
+	defer client.Close()
+	defer server.Close()
+	go func() { // echoes every message, reusing the one read
+		for {
+			msg, err := server.Read()
+			if err != nil {
+				return
+			}
+			if err := server.Write(msg); err != nil {
+				return
+			}
+		}
+	}()
+
+	// the messages escape, so they are created outside the runs; the large
+	// one would otherwise be written with a vectored write
+	for name, msg := range map[string]*websocket.Message{
+		"small": {Type: websocket.MessageText, Data: []byte("hello world")},
+		"large": {Type: websocket.MessageBinary, Data: bytes.Repeat([]byte{1}, 8<<10)},
+	} {
+		echo := func() {
+			if err := client.Write(msg); err != nil {
+				t.Fatalf("writing: %v", err)
+			}
+			reply, err := client.Read()
+			if err != nil {
+				t.Fatalf("reading: %v", err)
+			}
+			if !bytes.Equal(reply.Data, msg.Data) {
+				t.Fatalf("expected the message to be echoed")
+			}
+		}
+		echo() // the first message is not steady state
+		if allocs := testing.AllocsPerRun(100, echo); allocs != 0 {
+			t.Errorf("expected echoing a %s message to not allocate, got %v allocations", name, allocs)
+		}
+	}
+}
+
+func TestWithLowMemory_ReadTooLarge(t *testing.T) {
+	// the read limit set after it is capped to the read buffer
+	a, b := net.Pipe()
+	client := websocket.From(a, websocket.WithRole(websocket.RoleClient))
+	defer client.Close()
+	read := make([]byte, 8)
+	server := websocket.From(b, websocket.WithLowMemory(read, make([]byte, 64)), websocket.WithReadLimit(1024))
+	defer server.Close()
+
+	go client.WriteText("12345678")
+	msg, err := server.Read()
+	if err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if &msg.Data[0] != &read[0] {
+		t.Fatalf("expected the message to be read into the buffer")
+	}
+
+	go client.WriteText("123456789")
+	received := readMessages(client)
+	if _, err := server.Read(); !errors.Is(err, websocket.ErrMessageTooLarge) {
+		t.Fatalf("expected a MESSAGE_TOO_LARGE error, got %v", err)
+	}
+	if err := <-received; !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("expected the connection to be closed with 1009, got %v", err)
+	}
+}
+
+func TestWithLowMemory_WriteTooLarge(t *testing.T) {
+	for name, opts := range map[string][]websocket.Option{
+		"unfragmented": nil,
+		"fragmented":   {websocket.WithWriteFragmentSize(10)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			mockConn := &CountingConn{discard: true}
+			conn := websocket.From(mockConn, append(opts, websocket.WithLowMemory(make([]byte, 64), make([]byte, 64)))...)
+			defer conn.Close()
+			conn.SetWriteLimit(1 << 20) // the write buffer still limits the messages
+
+			if err := conn.WriteText(string(make([]byte, 65))); !errors.Is(err, websocket.ErrMessageTooLarge) {
+				t.Fatalf("expected a MESSAGE_TOO_LARGE error, got %v", err)
+			}
+			if err := conn.WriteText("hello world"); err != nil {
+				t.Fatalf("expected the connection to stay usable, got %v", err)
+			}
+			// control frames do not need the write buffer
+			if err := conn.Write(&websocket.Message{Type: websocket.MessagePing, Data: make([]byte, 125)}); err != nil {
+				t.Fatalf("expected pings to be written, got %v", err)
+			}
+		})
+	}
+}
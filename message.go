@@ -1,6 +1,19 @@
 package websocket
 
-import "fmt"
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"unicode/utf8"
+)
+
+// MessageStringLimit is the maximum amount of payload bytes included by
+// Message.String and Message.MarshalJSON. Longer payloads are cut short so
+// logging a large message does not log the entire payload. It should only be
+// changed during initialization.
+var MessageStringLimit = 128
 
 // MessageType represents the possible types of messages.
 type MessageType uint8
@@ -18,18 +31,161 @@ const (
 	// MessagePong represents a pong message (usually
 	// in return to a ping message).
 	MessagePong MessageType = 4
+	// MessageContinuation represents a continuation frame
+	// of a fragmented message.
+	MessageContinuation MessageType = 5
 )
 
+// opcodes maps every MessageType to the opcode of its frames.
+var opcodes = map[MessageType]byte{
+	MessageContinuation: 0x0,
+	MessageText:         0x1,
+	MessageBinary:       0x2,
+	MessageClose:        0x8,
+	MessagePing:         0x9,
+	MessagePong:         0xA,
+}
+
+// Opcode returns the opcode of frames of the MessageType. It returns 0xFF,
+// which is not a valid opcode, if the MessageType is unknown.
+func (t MessageType) Opcode() byte {
+	opcode, ok := opcodes[t]
+	if !ok {
+		return 0xFF
+	}
+	return opcode
+}
+
+// opcodeTypes is the inverse of opcodes, indexed by opcode, so that the
+// type of every frame read is found without iterating opcodes.
+var opcodeTypes = func() (types [16]struct {
+	t  MessageType
+	ok bool
+}) {
+	for t, op := range opcodes {
+		types[op].t, types[op].ok = t, true
+	}
+	return types
+}()
+
+// MessageTypeFromOpcode returns the MessageType of frames with the opcode
+// specified. It returns false if the opcode is reserved or not valid.
+func MessageTypeFromOpcode(opcode byte) (MessageType, bool) {
+	if opcode >= byte(len(opcodeTypes)) {
+		return 0, false
+	}
+	return opcodeTypes[opcode].t, opcodeTypes[opcode].ok
+}
+
 // Message represents a WebSocket message.
 type Message struct {
 	Type MessageType
 	Data []byte
+	// Compress overrides whether the message is compressed when it is
+	// written to a connection that negotiated compression (see
+	// WithCompression). It is ignored for control messages, and Read
+	// leaves it CompressAuto.
+	Compress CompressMode
 }
 
 // String returns the message as string formatted as:
-// type: MessageType || data: MessageDataAsString
+// type: MessageType || len: PayloadLength || data: Payload
+//
+// The payload of text messages is included as text and the payload of any
+// other message is hex encoded. Only the first MessageStringLimit bytes of
+// the payload are included, followed by "..." if it was cut short.
 func (m Message) String() string {
-	return fmt.Sprintf("type: %s || data: %s", m.Type.String(), m.Data)
+	data, truncated := m.limitedData()
+	var s string
+	if m.Type == MessageText && utf8.Valid(data) {
+		s = fmt.Sprintf("type: %s || len: %d || data: %s", m.Type, len(m.Data), data)
+	} else {
+		s = fmt.Sprintf("type: %s || len: %d || data: %s", m.Type, len(m.Data), hex.EncodeToString(data))
+	}
+	if truncated {
+		s += "..."
+	}
+	return s
+}
+
+// MarshalJSON implements json.Marshaler. The message is encoded as an object
+// with the type, the length of the payload, and the payload, for example
+// {"type":"MessageText","len":5,"data":"hello"}. The payload of text messages
+// is encoded as a string and the payload of any other message is base64
+// encoded. Like String, only the first MessageStringLimit bytes of the
+// payload are included; "truncated" is set to true if it was cut short.
+func (m Message) MarshalJSON() ([]byte, error) {
+	data, truncated := m.limitedData()
+	v := struct {
+		Type      string `json:"type"`
+		Len       int    `json:"len"`
+		Data      string `json:"data"`
+		Truncated bool   `json:"truncated,omitempty"`
+	}{
+		Type:      m.Type.String(),
+		Len:       len(m.Data),
+		Truncated: truncated,
+	}
+	if m.Type == MessageText {
+		v.Data = string(data)
+	} else {
+		v.Data = base64.StdEncoding.EncodeToString(data)
+	}
+	return json.Marshal(v)
+}
+
+// limitedData returns at most MessageStringLimit bytes of the payload and
+// whether it was cut short. The payload of text messages is only cut at the
+// start of a UTF-8 character.
+func (m Message) limitedData() ([]byte, bool) {
+	limit := max(MessageStringLimit, 0)
+	if len(m.Data) <= limit {
+		return m.Data, false
+	}
+	n := limit
+	if m.Type == MessageText {
+		for n > 0 && !utf8.RuneStart(m.Data[n]) {
+			n--
+		}
+	}
+	return m.Data[:n], true
+}
+
+// Clone returns a deep copy of the message, which shares no memory with
+// it. A message returned by Read on a Conn that reuses its read buffer
+// (see WithReadBufferReuse) must be cloned to be kept past the next call to
+// Read or handed to another goroutine.
+func (m Message) Clone() *Message {
+	m.Data = bytes.Clone(m.Data)
+	return &m
+}
+
+// Equal reports whether the message has the same type, payload, and
+// compression mode as other. A nil and an empty payload are equal. It
+// returns false if other is nil.
+func (m Message) Equal(other *Message) bool {
+	return other != nil && m.Type == other.Type && m.Compress == other.Compress && bytes.Equal(m.Data, other.Data)
+}
+
+// IsControl reports whether the message is a control message (close, ping,
+// or pong).
+func (m Message) IsControl() bool {
+	return isControl(m.Type)
+}
+
+// IsData reports whether the message is a data message (text, binary, or a
+// continuation of either).
+func (m Message) IsData() bool {
+	opcode, ok := opcodes[m.Type]
+	return ok && opcode&0x8 == 0
+}
+
+// isControl reports whether messages of type t are sent as control frames.
+// Control frames are the frames with the most significant bit of the
+// opcode set.
+func isControl(t MessageType) bool {
+	opcode, ok := opcodes[t]
+	return ok && opcode&0x8 != 0
 }
 
 // String returns the MessageType as a string.
@@ -45,6 +201,8 @@ func (t MessageType) String() string {
 		return "MessagePing"
 	case MessagePong:
 		return "MessagePong"
+	case MessageContinuation:
+		return "MessageContinuation"
 	default:
 		return "Unknown"
 	}
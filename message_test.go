@@ -0,0 +1,183 @@
+package websocket_test
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+func TestMessageType_Opcode(t *testing.T) {
+	tests := []struct {
+		messageType websocket.MessageType
+		opcode      byte
+		control     bool
+	}{
+		{websocket.MessageContinuation, 0x0, false},
+		{websocket.MessageText, 0x1, false},
+		{websocket.MessageBinary, 0x2, false},
+		{websocket.MessageClose, 0x8, true},
+		{websocket.MessagePing, 0x9, true},
+		{websocket.MessagePong, 0xA, true},
+	}
+	for _, test := range tests {
+		if op := test.messageType.Opcode(); op != test.opcode {
+			t.Fatalf("expected opcode %#x for %s, got %#x", test.opcode, test.messageType, op)
+		}
+		messageType, ok := websocket.MessageTypeFromOpcode(test.opcode)
+		if !ok || messageType != test.messageType {
+			t.Fatalf("expected %s for opcode %#x, got %s (%v)", test.messageType, test.opcode, messageType, ok)
+		}
+		msg := websocket.Message{Type: test.messageType}
+		if msg.IsControl() != test.control || msg.IsData() == test.control {
+			t.Fatalf("expected IsControl() %v and IsData() %v for %s", test.control, !test.control, test.messageType)
+		}
+	}
+
+	for _, opcode := range []byte{0x3, 0x4, 0x5, 0x6, 0x7, 0xB, 0xC, 0xD, 0xE, 0xF, 0x10, 0xFF} {
+		if messageType, ok := websocket.MessageTypeFromOpcode(opcode); ok {
+			t.Fatalf("expected reserved opcode %#x to have no message type, got %s", opcode, messageType)
+		}
+	}
+
+	unknown := websocket.Message{Type: websocket.MessageType(42)}
+	if unknown.Type.Opcode() != 0xFF || unknown.IsControl() || unknown.IsData() {
+		t.Fatalf("expected an unknown message type to have no opcode and be neither control nor data")
+	}
+}
+
+func TestRead_ReservedOpcode(t *testing.T) {
+	for _, opcode := range []byte{0x0, 0x3, 0x7, 0xB, 0xF} {
+		mockConn := new(MockNetConn)
+		mockConn.buf.Write([]byte{0x80 | opcode, 0x00})
+		_, err := websocket.From(mockConn).Read()
+		if err == nil || err.Kind() != websocket.MALFORMED_FRAME {
+			t.Fatalf("expected MALFORMED_FRAME error for opcode %#x, got %v", opcode, err)
+		}
+	}
+}
+
+func TestWrite_UnsupportedMessageType(t *testing.T) {
+	conn := websocket.From(new(MockNetConn))
+	for _, messageType := range []websocket.MessageType{websocket.MessageContinuation, websocket.MessageType(42)} {
+		err := conn.Write(&websocket.Message{Type: messageType})
+		if !errors.Is(err, websocket.ErrUnsupportedMessageType) {
+			t.Fatalf("expected UNSUPPORTED_MESSAGE_TYPE error for %s, got %v", messageType, err)
+		}
+	}
+}
+
+func TestMessage_String(t *testing.T) {
+	text := websocket.Message{Type: websocket.MessageText, Data: []byte("hello")}
+	if s := text.String(); s != "type: MessageText || len: 5 || data: hello" {
+		t.Fatalf("unexpected String() for a text message: %q", s)
+	}
+
+	binary := websocket.Message{Type: websocket.MessageBinary, Data: []byte{0x00, 0xff, 0x10}}
+	if s := binary.String(); s != "type: MessageBinary || len: 3 || data: 00ff10" {
+		t.Fatalf("unexpected String() for a binary message: %q", s)
+	}
+
+	large := websocket.Message{Type: websocket.MessageText, Data: []byte(strings.Repeat("a", 2<<20))}
+	expected := "type: MessageText || len: 2097152 || data: " + strings.Repeat("a", websocket.MessageStringLimit) + "..."
+	if s := large.String(); s != expected {
+		t.Fatalf("expected an oversized payload to be cut short, got %d bytes", len(s))
+	}
+
+	largeBinary := websocket.Message{Type: websocket.MessageBinary, Data: make([]byte, 1000)}
+	expected = "type: MessageBinary || len: 1000 || data: " + strings.Repeat("00", websocket.MessageStringLimit) + "..."
+	if s := largeBinary.String(); s != expected {
+		t.Fatalf("expected an oversized binary payload to be cut short, got %q", s)
+	}
+}
+
+func TestMessage_StringRuneBoundary(t *testing.T) {
+	data := strings.Repeat("a", websocket.MessageStringLimit-1) + "é"
+	s := websocket.Message{Type: websocket.MessageText, Data: []byte(data)}.String()
+	if !utf8.ValidString(s) || !strings.HasSuffix(s, strings.Repeat("a", websocket.MessageStringLimit-1)+"...") {
+		t.Fatalf("expected text to be cut short before the last character, got %q", s)
+	}
+}
+
+func TestMessage_MarshalJSON(t *testing.T) {
+	tests := []struct {
+		message  websocket.Message
+		expected string
+	}{
+		{
+			websocket.Message{Type: websocket.MessageText, Data: []byte("hello")},
+			`{"type":"MessageText","len":5,"data":"hello"}`,
+		},
+		{
+			websocket.Message{Type: websocket.MessageBinary, Data: []byte("hello")},
+			`{"type":"MessageBinary","len":5,"data":"aGVsbG8="}`,
+		},
+		{
+			websocket.Message{Type: websocket.MessageText, Data: []byte(strings.Repeat("a", websocket.MessageStringLimit+1))},
+			`{"type":"MessageText","len":` + strconv.Itoa(websocket.MessageStringLimit+1) + `,"data":"` + strings.Repeat("a", websocket.MessageStringLimit) + `","truncated":true}`,
+		},
+	}
+	for _, test := range tests {
+		b, err := json.Marshal(&test.message)
+		if err != nil {
+			t.Fatalf("expected no error from json.Marshal(), got %v", err)
+		}
+		if string(b) != test.expected {
+			t.Fatalf("expected %s, got %s", test.expected, b)
+		}
+	}
+}
+
+func TestMessage_Clone(t *testing.T) {
+	mockConn := &MockNetConn{}
+	for _, data := range []string{"first message", "second"} {
+		mockConn.buf.Write(encodeFrames(t, &websocket.Message{Type: websocket.MessageText, Data: []byte(data)}, websocket.RoleClient))
+	}
+	conn := websocket.From(mockConn, websocket.WithReadBufferReuse(true))
+
+	msg, err := conn.Read()
+	if err != nil {
+		t.Fatalf("expected no error from Read(), got %v", err)
+	}
+	clone := msg.Clone()
+	if _, err := conn.Read(); err != nil {
+		t.Fatalf("expected no error from Read(), got %v", err)
+	}
+	// the buffer is overwritten by the second message, and then poisoned
+	data := msg.Data[:cap(msg.Data)]
+	for i := range data {
+		data[i] = 0xff
+	}
+	expected := &websocket.Message{Type: websocket.MessageText, Data: []byte("first message")}
+	if !clone.Equal(expected) {
+		t.Fatalf("expected the clone to survive the buffer being reused, got %s", clone)
+	}
+	if nilData := (websocket.Message{Type: websocket.MessagePing}).Clone(); nilData.Data != nil {
+		t.Fatalf("expected a nil payload to be cloned as nil, got %q", nilData.Data)
+	}
+}
+
+func TestMessage_Equal(t *testing.T) {
+	msg := websocket.Message{Type: websocket.MessageText, Data: []byte("hi")}
+	for _, test := range []struct {
+		other    *websocket.Message
+		expected bool
+	}{
+		{&websocket.Message{Type: websocket.MessageText, Data: []byte("hi")}, true},
+		{&websocket.Message{Type: websocket.MessageBinary, Data: []byte("hi")}, false},
+		{&websocket.Message{Type: websocket.MessageText, Data: []byte("ho")}, false},
+		{&websocket.Message{Type: websocket.MessageText, Data: []byte("hi"), Compress: websocket.CompressNever}, false},
+		{nil, false},
+	} {
+		if equal := msg.Equal(test.other); equal != test.expected {
+			t.Fatalf("expected Equal(%v) to be %t, got %t", test.other, test.expected, equal)
+		}
+	}
+	if !(websocket.Message{Type: websocket.MessagePing}).Equal(&websocket.Message{Type: websocket.MessagePing, Data: []byte{}}) {
+		t.Fatalf("expected a nil and an empty payload to be equal")
+	}
+}
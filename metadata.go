@@ -0,0 +1,30 @@
+package websocket
+
+// ID returns the identifier of the connection. Every Conn created in the
+// process gets a different ID, starting from 1 and increasing with every
+// Conn created, so it can be used to correlate log records, metrics, and
+// other data about a single connection. The connection's log records
+// include it as the conn_id attribute.
+func (c *Conn) ID() uint64 {
+	return c.id
+}
+
+// Set stores the value v under key on the connection, replacing any value
+// already stored under key. It is meant for data about the connection,
+// such as the authenticated user or the rooms it has joined, so it does not
+// have to be kept in a separate map. It is safe to call concurrently with
+// every other method.
+func (c *Conn) Set(key string, v any) {
+	c.values.Store(key, v)
+}
+
+// Get returns the value stored under key on the connection, and whether
+// there is one.
+func (c *Conn) Get(key string) (any, bool) {
+	return c.values.Load(key)
+}
+
+// Delete removes the value stored under key on the connection, if any.
+func (c *Conn) Delete(key string) {
+	c.values.Delete(key)
+}
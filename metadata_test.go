@@ -0,0 +1,96 @@
+package websocket_test
+
+import (
+	"strconv"
+	"sync"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+func TestMetadata(t *testing.T) {
+	conn := websocket.From(new(MockNetConn))
+	if _, ok := conn.Get("user"); ok {
+		t.Fatalf("expected no value before Set()")
+	}
+	conn.Set("user", "alice")
+	if v, ok := conn.Get("user"); !ok || v != "alice" {
+		t.Fatalf("expected alice, got %v (%v)", v, ok)
+	}
+	conn.Set("user", "bob")
+	if v, _ := conn.Get("user"); v != "bob" {
+		t.Fatalf("expected Set() to replace the value, got %v", v)
+	}
+	conn.Delete("user")
+	if _, ok := conn.Get("user"); ok {
+		t.Fatalf("expected no value after Delete()")
+	}
+}
+
+func TestMetadata_Concurrent(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	defer conn.Close()
+
+	var wg sync.WaitGroup
+	for i := range 8 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			key := strconv.Itoa(i)
+			for j := range 1000 {
+				conn.Set(key, j)
+				conn.Set("shared", j)
+				if v, ok := conn.Get(key); !ok || v != j {
+					t.Errorf("expected %d, got %v", j, v)
+					return
+				}
+				conn.Get("shared")
+				if j%10 == 0 {
+					conn.Delete(key)
+				}
+			}
+		}()
+	}
+
+	// the connection is used at the same time
+	go func() {
+		for {
+			if _, err := peer.Read(); err != nil {
+				return
+			}
+		}
+	}()
+	for range 100 {
+		if err := conn.Write(textMessage("hello")); err != nil {
+			t.Fatalf("expected no error from Write(), got %v", err)
+		}
+	}
+	wg.Wait()
+}
+
+func TestID(t *testing.T) {
+	const n = 1000
+	ids := make(chan uint64, n)
+	var wg sync.WaitGroup
+	for range n {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			ids <- websocket.From(new(MockNetConn)).ID()
+		}()
+	}
+	wg.Wait()
+	close(ids)
+
+	seen := make(map[uint64]bool, n)
+	for id := range ids {
+		if id == 0 {
+			t.Fatalf("expected IDs to start from 1")
+		}
+		if seen[id] {
+			t.Fatalf("expected unique IDs, got %d twice", id)
+		}
+		seen[id] = true
+	}
+}
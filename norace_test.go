@@ -0,0 +1,7 @@
+//go:build !race
+
+package websocket_test
+
+// raceEnabled reports whether the race detector is enabled, which makes
+// sync.Pool drop items at random, so allocations cannot be counted.
+const raceEnabled = false
@@ -0,0 +1,108 @@
+package websocket
+
+import (
+	"context"
+	"log/slog"
+)
+
+// Option configures a Conn. Options are passed to From or AcceptHTTP.
+type Option func(c *Conn)
+
+// Role is the side of the WebSocket connection a Conn is on.
+type Role uint8
+
+const (
+	// RoleServer is the side that accepted the connection. Frames written
+	// by a server are not masked.
+	RoleServer Role = 0
+	// RoleClient is the side that opened the connection. Frames written by
+	// a client are masked with a random key, as required by RFC 6455.
+	RoleClient Role = 1
+)
+
+// WithRole sets the side of the connection the Conn is on. The default is
+// RoleServer.
+func WithRole(role Role) Option {
+	return func(c *Conn) {
+		c.role = role
+	}
+}
+
+// WithReadLimit sets the maximum size in bytes of a message read from the
+// connection, counting every fragment of a fragmented message. If the peer
+// sends a larger message, Read returns a MESSAGE_TOO_LARGE error and the
+// connection is closed with CloseMessageTooBig. The limit applies to
+// compressed messages once they are decompressed, and decompressing one
+// stops as soon as it crosses it. A limit of 0, the default, means there is
+// no limit.
+func WithReadLimit(n int64) Option {
+	return func(c *Conn) {
+		c.readLimit = max(n, 0)
+	}
+}
+
+// WithReadBufferSize makes the Conn read from the underlying connection
+// through a buffer of n bytes, which reduces the amount of reads from the
+// underlying connection for small frames. By default, reads are not
+// buffered.
+func WithReadBufferSize(n int) Option {
+	return func(c *Conn) {
+		c.readBufferSize = max(n, 0)
+	}
+}
+
+// WithReadBufferReuse sets whether Read reuses the same buffer for the
+// payloads of the text and binary messages it returns, and the same
+// Message, so that reading does not allocate once the buffer has grown to
+// the size of the messages. It is off by default.
+//
+// When it is on, the Message returned by Read and its Data are only valid
+// until the next call to Read, which overwrites them, so they must be
+// copied with Message.Clone to be kept or handed to another goroutine. It
+// should only be turned on for code that is done with every message before
+// reading the next one. The buffer grows to the largest message read, and
+// is dropped after a message larger than 1 MiB. The payloads of control
+// messages are not read into the buffer.
+func WithReadBufferReuse(enabled bool) Option {
+	return func(c *Conn) {
+		c.reuseReadBuffer = enabled
+	}
+}
+
+// WithWriteFragmentSize makes the Conn split text and binary messages with
+// a payload longer than n bytes into fragments of at most n bytes. Control
+// messages are never fragmented. By default, messages are not fragmented.
+func WithWriteFragmentSize(n int) Option {
+	return func(c *Conn) {
+		c.fragmentSize = max(n, 0)
+	}
+}
+
+// WithControlWhilePaused sets whether control frames are still read and
+// handled while reading is paused with PauseReading. It is off by default.
+func WithControlWhilePaused(enabled bool) Option {
+	return func(c *Conn) {
+		c.controlWhilePaused = enabled
+	}
+}
+
+// WithLogger sets the logger the Conn logs to, such as when a pong or a
+// queued message cannot be written. Every record includes the remote
+// address of the connection, if it has one. The default is slog.Default()
+// at the time the Conn is created. A nil logger discards every record.
+func WithLogger(logger *slog.Logger) Option {
+	return func(c *Conn) {
+		if logger == nil {
+			logger = slog.New(discardHandler{})
+		}
+		c.logger = logger
+	}
+}
+
+// discardHandler is a slog.Handler that discards every record.
+type discardHandler struct{}
+
+func (discardHandler) Enabled(context.Context, slog.Level) bool  { return false }
+func (discardHandler) Handle(context.Context, slog.Record) error { return nil }
+func (h discardHandler) WithAttrs([]slog.Attr) slog.Handler      { return h }
+func (h discardHandler) WithGroup(string) slog.Handler           { return h }
@@ -0,0 +1,182 @@
+package websocket_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// ReadCountingConn counts the reads from a MockNetConn.
+type ReadCountingConn struct {
+	MockNetConn
+	reads int
+}
+
+func (m *ReadCountingConn) Read(p []byte) (int, error) {
+	m.reads++
+	return m.MockNetConn.Read(p)
+}
+
+func TestFrom_Defaults(t *testing.T) {
+	mockConn := new(MockNetConn)
+	conn := websocket.From(mockConn)
+	large := bytes.Repeat([]byte("a"), 70000)
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: large}); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+
+	// a single unmasked frame with a 64 bit payload length
+	expected := append([]byte{0x82, 127, 0, 0, 0, 0, 0, 1, 0x11, 0x70}, large...)
+	if !bytes.Equal(mockConn.buf.Bytes(), expected) {
+		t.Fatalf("expected a single unmasked frame")
+	}
+	msg, err := websocket.From(mockConn, websocket.WithRole(websocket.RoleClient)).Read()
+	if err != nil || !bytes.Equal(msg.Data, large) {
+		t.Fatalf("expected to read the message back without a read limit, got %v", err)
+	}
+}
+
+func TestWithRole(t *testing.T) {
+	mockConn := new(MockNetConn)
+	client := websocket.From(mockConn, websocket.WithRole(websocket.RoleClient))
+	if err := client.Write(textMessage("hello")); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+	frame := mockConn.buf.Bytes()
+	if frame[1] != 0x80|5 || len(frame) != 2+4+5 {
+		t.Fatalf("expected a masked frame, got %v", frame)
+	}
+	if bytes.Contains(frame, []byte("hello")) && frame[2] == 0 && frame[3] == 0 && frame[4] == 0 && frame[5] == 0 {
+		t.Fatalf("expected a random mask key")
+	}
+
+	server := websocket.From(&MockNetConn{buf: *bytes.NewBuffer(frame)})
+	msg, err := server.Read()
+	if err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("expected the server to unmask hello, got %v (%v)", msg, err)
+	}
+}
+
+func TestWithReadLimit(t *testing.T) {
+	a, b := net.Pipe()
+	limited := websocket.From(a, websocket.WithReadLimit(8))
+	peer := websocket.From(b, websocket.WithRole(websocket.RoleClient))
+	defer peer.Close()
+
+	received := make(chan websocket.Error)
+	go func() {
+		_, err := peer.Read()
+		received <- err
+	}()
+	go func() {
+		peer.Write(textMessage("12345678"))
+		peer.Write(textMessage("123456789"))
+	}()
+
+	msg, err := limited.Read()
+	if err != nil || string(msg.Data) != "12345678" {
+		t.Fatalf("expected a message at the limit to be read, got %v (%v)", msg, err)
+	}
+	_, err = limited.Read()
+	if !errors.Is(err, websocket.ErrMessageTooLarge) {
+		t.Fatalf("expected MESSAGE_TOO_LARGE error, got %v", err)
+	}
+	if err := <-received; !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("expected the peer to receive close code 1009, got %v", err)
+	}
+	if !limited.Closed() {
+		t.Fatalf("expected the connection to be closed")
+	}
+}
+
+func TestWithReadLimit_Fragmented(t *testing.T) {
+	mockConn := new(MockNetConn)
+	writer := websocket.From(mockConn, websocket.WithRole(websocket.RoleClient), websocket.WithWriteFragmentSize(4))
+	writer.Write(textMessage("123456789"))
+
+	_, err := websocket.From(mockConn, websocket.WithReadLimit(8)).Read()
+	if !errors.Is(err, websocket.ErrMessageTooLarge) {
+		t.Fatalf("expected the fragments to count towards the limit, got %v", err)
+	}
+}
+
+func TestWithReadBufferSize(t *testing.T) {
+	unbuffered := &ReadCountingConn{}
+	buffered := &ReadCountingConn{}
+	for _, conn := range []*ReadCountingConn{unbuffered, buffered} {
+		for range 10 {
+			conn.buf.Write([]byte{0x81, 5})
+			conn.buf.WriteString("hello")
+		}
+	}
+
+	for _, test := range []struct {
+		conn *websocket.Conn
+		mock *ReadCountingConn
+	}{
+		{websocket.From(unbuffered, websocket.WithRole(websocket.RoleClient)), unbuffered},
+		{websocket.From(buffered, websocket.WithRole(websocket.RoleClient), websocket.WithReadBufferSize(4096)), buffered},
+	} {
+		for range 10 {
+			msg, err := test.conn.Read()
+			if err != nil || string(msg.Data) != "hello" {
+				t.Fatalf("expected hello, got %v (%v)", msg, err)
+			}
+		}
+	}
+	if unbuffered.reads != 20 {
+		t.Fatalf("expected 20 reads without a buffer, got %d", unbuffered.reads)
+	}
+	if buffered.reads != 1 {
+		t.Fatalf("expected 1 read with a buffer, got %d", buffered.reads)
+	}
+}
+
+func TestWithWriteFragmentSize(t *testing.T) {
+	mockConn := new(MockNetConn)
+	conn := websocket.From(mockConn, websocket.WithWriteFragmentSize(4))
+	if err := conn.Write(textMessage("0123456789")); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+	expected := []byte{0x01, 4, '0', '1', '2', '3', 0x00, 4, '4', '5', '6', '7', 0x80, 2, '8', '9'}
+	if !bytes.Equal(mockConn.buf.Bytes(), expected) {
+		t.Fatalf("expected frames %v, got %v", expected, mockConn.buf.Bytes())
+	}
+
+	// control messages are not fragmented
+	conn.Write(&websocket.Message{Type: websocket.MessagePing, Data: []byte("ping!")})
+	if !bytes.Equal(mockConn.buf.Bytes()[len(expected):], []byte{0x89, 5, 'p', 'i', 'n', 'g', '!'}) {
+		t.Fatalf("expected an unfragmented ping")
+	}
+
+	msg, err := websocket.From(mockConn, websocket.WithRole(websocket.RoleClient)).Read()
+	if err != nil || msg.Type != websocket.MessageText || string(msg.Data) != "0123456789" {
+		t.Fatalf("expected the fragments to be put back together, got %v (%v)", msg, err)
+	}
+}
+
+func TestRead_FragmentedWithControl(t *testing.T) {
+	mockConn := new(MockNetConn)
+	mockConn.buf.Write([]byte{0x02, 2, 'a', 'b'})
+	mockConn.buf.Write([]byte{0x8A, 1, 'x'}) // a pong between the fragments
+	mockConn.buf.Write([]byte{0x80, 2, 'c', 'd'})
+	conn := websocket.From(mockConn, websocket.WithRole(websocket.RoleClient))
+
+	msg, err := conn.Read()
+	if err != nil || msg.Type != websocket.MessagePong {
+		t.Fatalf("expected the pong first, got %v (%v)", msg, err)
+	}
+	msg, err = conn.Read()
+	if err != nil || msg.Type != websocket.MessageBinary || string(msg.Data) != "abcd" {
+		t.Fatalf("expected abcd, got %v (%v)", msg, err)
+	}
+
+	// a new message may not start before the fragmented message ends
+	mockConn.buf.Write([]byte{0x01, 1, 'a', 0x81, 1, 'b'})
+	if _, err := conn.Read(); err == nil || err.Kind() != websocket.MALFORMED_FRAME {
+		t.Fatalf("expected MALFORMED_FRAME error, got %v", err)
+	}
+}
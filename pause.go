@@ -0,0 +1,76 @@
+package websocket
+
+// PauseReading stops Read from reading data frames from the underlying
+// connection until ResumeReading is called. A Read that is called while
+// reading is paused waits until it is resumed or the connection is closed,
+// so the peer is slowed down by the backpressure of the underlying
+// connection instead of messages piling up in memory. A Read that is in
+// the middle of reading a frame finishes reading it first.
+//
+// By default, nothing at all is read while reading is paused, so pings are
+// not answered and pongs are not received either. With
+// WithControlWhilePaused, control frames are still read and handled while
+// reading is paused, so keepalives survive a short pause.
+//
+// Calling PauseReading while reading is already paused has no effect.
+func (c *Conn) PauseReading() {
+	c.pauseMx.Lock()
+	defer c.pauseMx.Unlock()
+	if c.resumed == nil {
+		c.resumed = make(chan struct{})
+	}
+}
+
+// ResumeReading resumes reading after PauseReading. Calling it while
+// reading is not paused has no effect.
+func (c *Conn) ResumeReading() {
+	c.pauseMx.Lock()
+	defer c.pauseMx.Unlock()
+	if c.resumed != nil {
+		close(c.resumed)
+		c.resumed = nil
+	}
+}
+
+// ReadingPaused reports whether reading is paused.
+func (c *Conn) ReadingPaused() bool {
+	c.pauseMx.Lock()
+	defer c.pauseMx.Unlock()
+	return c.resumed != nil
+}
+
+// waitPaused waits until reading is not paused. If control frames are read
+// while paused, the header of the next frame is read as soon as it arrives,
+// and waitPaused only waits if it is the header of a data frame. It
+// returns that header, or nil if no header was read. The read mutex must
+// be held.
+func (c *Conn) waitPaused() ([]byte, Error) {
+	var header []byte
+	for {
+		c.pauseMx.Lock()
+		resumed := c.resumed
+		c.pauseMx.Unlock()
+		if resumed == nil {
+			return header, nil
+		}
+
+		if c.controlWhilePaused && header == nil {
+			var err Error
+			if header, err = c.readHeader(); err != nil {
+				return nil, err
+			}
+			if header[0]&0x08 != 0 { // control frames are read right away
+				return header, nil
+			}
+		}
+
+		c.readBlocking(true)
+		select {
+		case <-resumed:
+		case <-c.ctx.Done():
+			c.readBlocking(false)
+			return nil, c.closedError()
+		}
+		c.readBlocking(false)
+	}
+}
@@ -0,0 +1,124 @@
+package websocket_test
+
+import (
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+func TestPauseReading(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	defer conn.Close()
+
+	conn.PauseReading()
+	conn.PauseReading()
+	if !conn.ReadingPaused() {
+		t.Fatalf("expected ReadingPaused() to be true")
+	}
+
+	written := make(chan websocket.Error, 1)
+	go func() {
+		written <- peer.Write(textMessage("hello"))
+	}()
+	received := make(chan *websocket.Message, 1)
+	go func() {
+		msg, _ := conn.Read()
+		received <- msg
+	}()
+
+	select {
+	case err := <-written:
+		t.Fatalf("expected the peer's Write() to block while paused, returned %v", err)
+	case msg := <-received:
+		t.Fatalf("expected Read() to block while paused, got %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn.ResumeReading()
+	conn.ResumeReading()
+	if conn.ReadingPaused() {
+		t.Fatalf("expected ReadingPaused() to be false")
+	}
+	select {
+	case msg := <-received:
+		if msg == nil || string(msg.Data) != "hello" {
+			t.Fatalf("expected hello after resuming, got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected Read() to return after resuming")
+	}
+	if err := <-written; err != nil {
+		t.Fatalf("expected no error from the peer's Write(), got %v", err)
+	}
+}
+
+func TestPauseReading_ControlWhilePaused(t *testing.T) {
+	peer, conn := websocket.Pipe(websocket.WithControlWhilePaused(true))
+	defer peer.Close()
+	defer conn.Close()
+
+	conn.PauseReading()
+	received := make(chan *websocket.Message, 2)
+	go func() {
+		for {
+			msg, err := conn.Read()
+			if err != nil {
+				return
+			}
+			received <- msg
+		}
+	}()
+	go peer.Read() // reads the pong
+
+	pong, err := peer.PingRTT(nil)
+	if err != nil {
+		t.Fatalf("expected the ping to be answered while paused, got %v (%v)", pong, err)
+	}
+	if msg := <-received; msg.Type != websocket.MessagePing {
+		t.Fatalf("expected the ping to be returned, got %v", msg)
+	}
+
+	written := make(chan websocket.Error, 1)
+	go func() {
+		written <- peer.Write(textMessage("hello"))
+	}()
+	select {
+	case msg := <-received:
+		t.Fatalf("expected data not to be read while paused, got %v", msg)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	conn.ResumeReading()
+	select {
+	case msg := <-received:
+		if string(msg.Data) != "hello" {
+			t.Fatalf("expected hello after resuming, got %v", msg)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected Read() to return after resuming")
+	}
+}
+
+func TestPauseReading_Close(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	conn.PauseReading()
+
+	result := make(chan websocket.Error)
+	go func() {
+		_, err := conn.Read()
+		result <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+	conn.Close()
+	select {
+	case err := <-result:
+		if err == nil || err.Kind() != websocket.CONNECTION_CLOSED {
+			t.Fatalf("expected CONNECTION_CLOSED error, got %v", err)
+		}
+	case <-time.After(time.Second):
+		t.Fatalf("expected Read() to return once closed")
+	}
+}
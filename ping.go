@@ -0,0 +1,250 @@
+package websocket
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"time"
+)
+
+// pendingPing is a ping that is waiting for a pong with the same payload.
+type pendingPing struct {
+	done    chan struct{}
+	waiters int
+	sent    time.Time
+	rtt     time.Duration // set before done is closed
+	err     Error         // set before done is closed if writing the ping failed
+}
+
+// Ping writes a ping frame with data as its payload to the connection and
+// waits for a pong with the same payload. If data is nil, a unique 8 byte
+// payload is generated. If a nil context is specified, the connection's ping
+// timeout is used (five seconds unless set with SetPingTimeout). If no
+// response is received before the context is done, it will return false.
+// It may return an error if there is an issue writing to the connection or
+// the connection is closed while waiting.
+//
+// Pongs are only received while the connection is being read from. A pong
+// only resolves the ping with a matching payload, so unsolicited pongs and
+// late pongs for an earlier ping are ignored.
+//
+// If there is a ping with the same payload that has not recieved a pong
+// yet, calling this function will NOT write another ping frame, but will
+// wait for the same pong. Concurrent callers each honor their own context:
+// a caller whose context is done stops waiting without affecting the other
+// callers, and every caller still waiting is woken when the pong arrives.
+func (c *Conn) Ping(ctx context.Context, data []byte) (bool, Error) {
+	_, err := c.ping(ctx, data, nil)
+	if err != nil {
+		if err.Kind() == PING_TIMEOUT {
+			return false, nil
+		}
+		return false, err
+	}
+	return true, nil
+}
+
+// PingRTT writes a ping frame with a unique payload to the connection and
+// returns the round-trip time once the matching pong is received. The
+// round-trip time is measured from when the ping is written until the
+// pong is read. If a nil context is specified, the connection's ping timeout
+// is used. If no pong is received before the context is done, it returns
+// a PING_TIMEOUT error, which is a net.Error whose Timeout method reports
+// true.
+func (c *Conn) PingRTT(ctx context.Context) (time.Duration, Error) {
+	return c.ping(ctx, nil, nil)
+}
+
+// ping writes a ping frame and waits for the matching pong, returning the
+// round-trip time. If ctx is nil, the connection's ping timeout is used.
+// Waiting also stops with a PING_TIMEOUT error when timeout fires, if it
+// is not nil.
+func (c *Conn) ping(ctx context.Context, data []byte, timeout <-chan time.Time) (time.Duration, Error) {
+	if ctx == nil {
+		ctx = context.Background()
+		if d := time.Duration(c.pingTimeout.Load()); d > 0 && timeout == nil {
+			t := c.clock.NewTimer(d)
+			defer t.Stop()
+			timeout = t.C()
+		}
+	}
+
+	c.pingMx.Lock()
+	if data == nil {
+		c.pingSeq++
+		data = binary.BigEndian.AppendUint64(nil, c.pingSeq)
+	}
+	key := string(data)
+	if c.pings == nil {
+		c.pings = make(map[string]*pendingPing)
+	}
+	p, ok := c.pings[key]
+	if !ok {
+		p = &pendingPing{done: make(chan struct{}), sent: c.clock.Now()}
+		c.pings[key] = p
+	}
+	p.waiters++
+	c.pingMx.Unlock()
+
+	if !ok {
+		err := c.Write(&Message{
+			Type: MessagePing,
+			Data: data,
+		})
+		if err != nil {
+			c.failPing(key, p, err)
+			return 0, err
+		}
+	}
+
+	select {
+	case <-p.done:
+		return p.rtt, p.err
+	case <-ctx.Done(): // a pong was not recieved in a timely manner
+		c.abandonPing(key, p)
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) { // not cancelled
+			c.pongMissed()
+		}
+		return 0, wrapError(PING_TIMEOUT, ctx.Err())
+	case <-timeout:
+		c.abandonPing(key, p)
+		c.pongMissed()
+		return 0, errorf(PING_TIMEOUT)
+	case <-c.ctx.Done(): // the connection was closed while waiting
+		c.abandonPing(key, p)
+		return 0, c.closedError()
+	}
+}
+
+// abandonPing removes a waiter from the ping. The ping is forgotten once it
+// has no waiters left, so a late pong for it is ignored.
+func (c *Conn) abandonPing(key string, p *pendingPing) {
+	c.pingMx.Lock()
+	defer c.pingMx.Unlock()
+	p.waiters--
+	if p.waiters == 0 && c.pings[key] == p {
+		delete(c.pings, key)
+	}
+}
+
+// failPing forgets a ping that could not be written and wakes up anyone
+// who joined it with the error, unless a pong with the same payload
+// resolved it first.
+func (c *Conn) failPing(key string, p *pendingPing, err Error) {
+	c.pingMx.Lock()
+	defer c.pingMx.Unlock()
+	if c.pings[key] != p {
+		return
+	}
+	delete(c.pings, key)
+	p.err = err
+	close(p.done)
+}
+
+// resolvePing wakes up everyone waiting on the ping with the payload
+// specified. It does nothing if there is no such ping.
+func (c *Conn) resolvePing(payload []byte) {
+	c.pingMx.Lock()
+	defer c.pingMx.Unlock()
+	p, ok := c.pings[string(payload)]
+	if !ok {
+		return
+	}
+	delete(c.pings, string(payload))
+	p.rtt = c.clock.Now().Sub(p.sent)
+	c.lastRTT.Store(int64(p.rtt))
+	c.pongMisses.Store(0)
+	close(p.done)
+}
+
+// OnPongMissed sets a function that is called whenever a ping sent by Ping,
+// PingRTT or keepalive does not receive a pong in time, with the amount of
+// pings in a row that have missed their pong. A ping whose context is
+// cancelled, rather than past its deadline, is not a miss. The count resets
+// once a pong for a ping arrives. The function is called without any of
+// the connection's locks held. Passing nil removes it.
+func (c *Conn) OnPongMissed(f func(consecutiveMisses int)) {
+	if f == nil {
+		c.onPongMissed.Store(nil)
+		return
+	}
+	c.onPongMissed.Store(&f)
+}
+
+// pongMissed counts a missed pong and calls the OnPongMissed function.
+func (c *Conn) pongMissed() {
+	misses := int(c.pongMisses.Add(1))
+	if f := c.onPongMissed.Load(); f != nil {
+		(*f)(misses)
+	}
+}
+
+// SetPingTimeout sets how long Ping and PingRTT wait for a pong when they are
+// called with a nil context. A duration of 0 means they wait until the pong
+// arrives or the connection is closed. The default is five seconds.
+func (c *Conn) SetPingTimeout(d time.Duration) {
+	c.pingTimeout.Store(int64(max(d, 0)))
+}
+
+// SetPingHandler sets the function called by Read when a ping is received,
+// with the ping's payload. The default handler responds with a pong echoing
+// the payload, and closes the connection if the pong cannot be written; a
+// custom handler replaces it and is responsible for sending
+// the pong. Passing nil restores the default handler.
+//
+// The handler is called from Read before the ping message is returned, and
+// may write to the connection. If it returns an error, Read returns a
+// CONTROL_HANDLER_ERROR error.
+func (c *Conn) SetPingHandler(h func(payload []byte) error) {
+	if h == nil {
+		c.pingHandler.Store(nil)
+		return
+	}
+	c.pingHandler.Store(&h)
+}
+
+// SetPongHandler sets the function called by Read when a pong is received,
+// with the pong's payload. Pongs are always matched against pending pings
+// before the handler is called, so Ping keeps working with a custom handler.
+// Passing nil removes the handler.
+//
+// The handler is called from Read before the pong message is returned, and
+// may write to the connection. If it returns an error, Read returns a
+// CONTROL_HANDLER_ERROR error.
+func (c *Conn) SetPongHandler(h func(payload []byte) error) {
+	if h == nil {
+		c.pongHandler.Store(nil)
+		return
+	}
+	c.pongHandler.Store(&h)
+}
+
+// handlePing calls the ping handler, or responds with a pong echoing the
+// payload if there is none, unless a close frame was written already.
+func (c *Conn) handlePing(payload []byte) error {
+	if h := c.pingHandler.Load(); h != nil {
+		return (*h)(payload)
+	}
+	if c.closeSent.Load() {
+		return nil
+	}
+	err := c.Write(&Message{
+		Type: MessagePong,
+		Data: payload,
+	})
+	if err != nil {
+		c.logger.Error("an error occured while sending pong as response to a ping", "error", err.Error())
+		c.fail(err)
+	}
+	return nil
+}
+
+// handlePong resolves the ping matching the payload and calls the pong
+// handler if there is one.
+func (c *Conn) handlePong(payload []byte) error {
+	c.resolvePing(payload)
+	if h := c.pongHandler.Load(); h != nil {
+		return (*h)(payload)
+	}
+	return nil
+}
@@ -0,0 +1,486 @@
+package websocket_test
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// pipe returns two connected Conns, a client and a server.
+func pipe() (*websocket.Conn, *websocket.Conn) {
+	return websocket.Pipe()
+}
+
+// readUntil reads from conn until a message of the type specified is read.
+func readUntil(t *testing.T, conn *websocket.Conn, messageType websocket.MessageType) *websocket.Message {
+	t.Helper()
+	for {
+		msg, err := conn.Read()
+		if err != nil {
+			t.Errorf("Unexpected error from Read: %v", err)
+			return nil
+		}
+		if msg.Type == messageType {
+			return msg
+		}
+	}
+}
+
+func TestPing_PongReceived(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		pongReceived, err := conn.Ping(context.Background(), nil)
+		if err != nil {
+			t.Errorf("Unexpected error from Ping: %v", err)
+		}
+		if !pongReceived {
+			t.Errorf("Expected pong response")
+		}
+	}()
+
+	// the peer responds to the ping automatically while reading
+	go readUntil(t, peer, websocket.MessagePing)
+	pong := readUntil(t, conn, websocket.MessagePong)
+	if len(pong.Data) != 8 {
+		t.Fatalf("Expected a generated 8 byte payload, got %v", pong.Data)
+	}
+
+	<-done
+}
+
+func TestPing_Timeout(t *testing.T) {
+	clk := clock.NewFake()
+	conn := websocket.From(&MockNetConn{}, websocket.WithClock(clk))
+	conn.SetPingTimeout(50 * time.Millisecond)
+
+	type result struct {
+		pongReceived bool
+		err          websocket.Error
+	}
+	done := make(chan result)
+	go func() {
+		pongReceived, err := conn.Ping(nil, nil)
+		done <- result{pongReceived, err}
+	}()
+	waitForTimer(t, clk, 50*time.Millisecond)
+	clk.Advance(50 * time.Millisecond)
+	r := <-done
+	if r.err != nil {
+		t.Fatalf("Expected no error from Ping, got %v", r.err)
+	}
+	if r.pongReceived {
+		t.Fatalf("Expected Ping to timeout, but got pong response")
+	}
+}
+
+// FailingConn is an io.ReadWriteCloser whose writes fail until fail is false.
+type FailingConn struct {
+	CountingConn
+	fail atomic.Bool
+}
+
+func (m *FailingConn) Write(p []byte) (int, error) {
+	if m.fail.Load() {
+		return 0, errors.New("write failed")
+	}
+	return m.CountingConn.Write(p)
+}
+
+func TestPing_WriteFailure(t *testing.T) {
+	mockConn := new(FailingConn)
+	mockConn.fail.Store(true)
+	conn := websocket.From(mockConn)
+
+	_, err := conn.Ping(context.Background(), []byte("ping"))
+	if err == nil || err.Kind() != websocket.CONNECTION_WRITE_ERROR {
+		t.Fatalf("Expected CONNECTION_WRITE_ERROR error, got %v", err)
+	}
+
+	// the failed ping must not be left behind: the next Ping with the same
+	// payload writes a new frame and does not hang
+	mockConn.fail.Store(false)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		pongReceived, err := conn.Ping(ctx, []byte("ping"))
+		if err != nil || pongReceived {
+			t.Errorf("Expected Ping to time out, got %v, %v", pongReceived, err)
+		}
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatalf("Expected Ping after a failed write to not hang")
+	}
+	if mockConn.Writes() != 1 {
+		t.Fatalf("Expected a new ping frame to be written, got %d writes", mockConn.Writes())
+	}
+}
+
+func TestPing_WriteFailureAfterPong(t *testing.T) {
+	// the ping waits for room in the queue, which it never gets, while a
+	// pong with its payload arrives
+	conn, client := stalledQueueConn(t, websocket.OverflowBlock)
+	errs := make(chan websocket.Error, 1)
+	go func() {
+		_, err := conn.Ping(context.Background(), []byte("ping"))
+		errs <- err
+	}()
+	time.Sleep(10 * time.Millisecond)
+
+	pong := websocket.Frame{Fin: true, Opcode: 0xA, Masked: true, Payload: []byte("ping")}
+	go client.Write(pong.AppendMarshal(nil))
+	if msg, err := conn.Read(); err != nil || msg.Type != websocket.MessagePong {
+		t.Fatalf("expected the pong to be read, got %v and %v", msg, err)
+	}
+	conn.Close() // the ping fails to be queued after it was resolved
+	if err := <-errs; err == nil {
+		t.Fatalf("expected the ping to fail")
+	}
+}
+
+func TestPing_PayloadCorrelation(t *testing.T) {
+	a, b := net.Pipe()
+	conn, peer := websocket.From(a), websocket.From(b, websocket.WithRole(websocket.RoleClient))
+	defer conn.Close()
+	defer peer.Close()
+
+	done := make(chan bool)
+	go func() {
+		pongReceived, err := conn.Ping(context.Background(), []byte("current"))
+		if err != nil {
+			t.Errorf("Unexpected error from Ping: %v", err)
+		}
+		done <- pongReceived
+	}()
+
+	// read the ping frame without responding to it
+	frame := make([]byte, 2+len("current"))
+	if _, err := io.ReadFull(b, frame); err != nil {
+		t.Fatal(err)
+	}
+	if string(frame[2:]) != "current" {
+		t.Fatalf("Expected ping payload %q, got %q", "current", frame[2:])
+	}
+
+	go func() {
+		peer.Write(&websocket.Message{Type: websocket.MessagePong, Data: []byte("stale")})
+		peer.Write(&websocket.Message{Type: websocket.MessagePong, Data: []byte("current")})
+	}()
+
+	msg, err := conn.Read()
+	if err != nil || string(msg.Data) != "stale" {
+		t.Fatalf("Expected the stale pong, got %v, %v", msg, err)
+	}
+	select {
+	case <-done:
+		t.Fatalf("Expected Ping to ignore the stale pong")
+	case <-time.After(20 * time.Millisecond):
+	}
+
+	msg, err = conn.Read()
+	if err != nil || string(msg.Data) != "current" {
+		t.Fatalf("Expected the matching pong, got %v, %v", msg, err)
+	}
+	if !<-done {
+		t.Fatalf("Expected Ping to complete on the matching pong")
+	}
+}
+
+func TestPingRTT(t *testing.T) {
+	clk := clock.NewFake()
+	a, b := net.Pipe()
+	conn, peer := websocket.From(a, websocket.WithClock(clk)), websocket.From(b, websocket.WithRole(websocket.RoleClient))
+	defer conn.Close()
+	defer peer.Close()
+
+	go func() {
+		frame := make([]byte, 2+8) // ping with the generated 8 byte payload
+		if _, err := io.ReadFull(b, frame); err != nil {
+			return
+		}
+		clk.Advance(50 * time.Millisecond)
+		peer.Write(&websocket.Message{Type: websocket.MessagePong, Data: frame[2:]})
+	}()
+	go conn.Read()
+
+	rtt, err := conn.PingRTT(context.Background())
+	if err != nil {
+		t.Fatalf("Unexpected error from PingRTT: %v", err)
+	}
+	if rtt != 50*time.Millisecond {
+		t.Fatalf("Expected a round-trip time of 50ms, got %s", rtt)
+	}
+}
+
+func TestPingRTT_Timeout(t *testing.T) {
+	clk := clock.NewFake()
+	conn := websocket.From(&MockNetConn{}, websocket.WithClock(clk))
+	conn.SetPingTimeout(20 * time.Millisecond)
+
+	done := make(chan websocket.Error)
+	go func() {
+		_, err := conn.PingRTT(nil)
+		done <- err
+	}()
+	waitForTimer(t, clk, 20*time.Millisecond)
+	clk.Advance(20 * time.Millisecond)
+	if err := <-done; err == nil || err.Kind() != websocket.PING_TIMEOUT {
+		t.Fatalf("Expected PING_TIMEOUT error, got %v", err)
+	}
+}
+
+func TestPing_ConcurrentCallers(t *testing.T) {
+	payloads := map[string][2]string{
+		"shared ping":    {"same", "same"},
+		"separate pings": {"short", "long"},
+	}
+	for name, payload := range payloads {
+		t.Run(name, func(t *testing.T) {
+			a, b := net.Pipe()
+			conn, peer := websocket.From(a), websocket.From(b, websocket.WithRole(websocket.RoleClient))
+			defer conn.Close()
+			defer peer.Close()
+			go io.Copy(io.Discard, b) // the peer never responds on its own
+			go func() {
+				for {
+					if _, err := conn.Read(); err != nil {
+						return
+					}
+				}
+			}()
+
+			short := make(chan bool)
+			long := make(chan bool)
+			go func() {
+				ctx, cancel := context.WithTimeout(context.Background(), 30*time.Millisecond)
+				defer cancel()
+				pongReceived, err := conn.Ping(ctx, []byte(payload[0]))
+				if err != nil {
+					t.Errorf("Unexpected error from Ping: %v", err)
+				}
+				short <- pongReceived
+			}()
+			go func() {
+				pongReceived, err := conn.Ping(context.Background(), []byte(payload[1]))
+				if err != nil {
+					t.Errorf("Unexpected error from Ping: %v", err)
+				}
+				long <- pongReceived
+			}()
+
+			select {
+			case pongReceived := <-short:
+				if pongReceived {
+					t.Fatalf("Expected the caller with a short deadline to time out")
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Expected the caller with a short deadline to return by its deadline")
+			}
+
+			peer.Write(&websocket.Message{Type: websocket.MessagePong, Data: []byte(payload[1])})
+			select {
+			case pongReceived := <-long:
+				if !pongReceived {
+					t.Fatalf("Expected the caller without a deadline to receive the pong")
+				}
+			case <-time.After(time.Second):
+				t.Fatalf("Expected the caller without a deadline to be woken by the pong")
+			}
+		})
+	}
+}
+
+func TestPingPongHandlers(t *testing.T) {
+	conn, peer := websocket.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	var events []string
+	conn.SetPingHandler(func(payload []byte) error {
+		events = append(events, "ping "+string(payload))
+		return nil
+	})
+	conn.SetPongHandler(func(payload []byte) error {
+		events = append(events, "pong "+string(payload))
+		return nil
+	})
+
+	go func() {
+		peer.Write(&websocket.Message{Type: websocket.MessagePing, Data: []byte("a")})
+		peer.Write(&websocket.Message{Type: websocket.MessagePong, Data: []byte("b")})
+		peer.Write(&websocket.Message{Type: websocket.MessagePing, Data: []byte("c")})
+		peer.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("done")})
+	}()
+	// the custom ping handler replaces the automatic pong, so nothing is
+	// written back to the peer while conn reads
+	readUntil(t, conn, websocket.MessageText)
+
+	expected := []string{"ping a", "pong b", "ping c"}
+	if len(events) != len(expected) {
+		t.Fatalf("Expected %v, got %v", expected, events)
+	}
+	for i := range expected {
+		if events[i] != expected[i] {
+			t.Fatalf("Expected %v, got %v", expected, events)
+		}
+	}
+}
+
+func TestPingPongHandlers_Error(t *testing.T) {
+	conn, peer := websocket.Pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	conn.SetPongHandler(func(payload []byte) error {
+		return errors.New("unexpected pong")
+	})
+	go peer.Write(&websocket.Message{Type: websocket.MessagePong, Data: []byte("a")})
+
+	_, err := conn.Read()
+	if err == nil || err.Kind() != websocket.CONTROL_HANDLER_ERROR {
+		t.Fatalf("Expected CONTROL_HANDLER_ERROR error, got %v", err)
+	}
+
+	// restoring the default ping handler responds with a pong again
+	conn.SetPingHandler(func(payload []byte) error { return nil })
+	conn.SetPingHandler(nil)
+	go peer.Write(&websocket.Message{Type: websocket.MessagePing, Data: []byte("b")})
+	go conn.Read()
+	pong := readUntil(t, peer, websocket.MessagePong)
+	if string(pong.Data) != "b" {
+		t.Fatalf("Expected a pong echoing %q, got %q", "b", pong.Data)
+	}
+}
+
+func TestSetPingTimeout(t *testing.T) {
+	timeouts := map[string]time.Duration{
+		"default": 0,
+		"30s":     30 * time.Second,
+		"500ms":   500 * time.Millisecond,
+	}
+	for name, timeout := range timeouts {
+		t.Run(name, func(t *testing.T) {
+			conn := websocket.From(&CountingConn{discard: true})
+			clk := clock.NewFake()
+			websocket.UseClock(conn, clk)
+			expected := 5 * time.Second
+			if timeout != 0 {
+				conn.SetPingTimeout(timeout)
+				expected = timeout
+			}
+
+			done := make(chan bool)
+			go func() {
+				pongReceived, _ := conn.Ping(nil, nil)
+				done <- pongReceived
+			}()
+			waitForTimer(t, clk, expected)
+			clk.Advance(expected)
+			if <-done {
+				t.Fatalf("Expected Ping to time out")
+			}
+		})
+	}
+}
+
+func TestSetPingTimeout_Zero(t *testing.T) {
+	mockConn := &CountingConn{discard: true}
+	clk := clock.NewFake()
+	conn := websocket.From(mockConn, websocket.WithClock(clk))
+	conn.SetPingTimeout(0)
+
+	done := make(chan websocket.Error)
+	go func() {
+		_, err := conn.Ping(nil, nil)
+		done <- err
+	}()
+	// the timeout would be started before the ping is written
+	waitFor(t, time.Second, func() bool { return mockConn.Writes() == 1 })
+	if clk.Pending() != 0 {
+		t.Fatalf("Expected no timeout with a ping timeout of 0")
+	}
+	conn.Close()
+	if err := <-done; err == nil || err.Kind() != websocket.CONNECTION_CLOSED {
+		t.Fatalf("Expected CONNECTION_CLOSED error, got %v", err)
+	}
+}
+
+func TestOnPongMissed(t *testing.T) {
+	clk := clock.NewFake()
+	a, b := net.Pipe()
+	conn, peer := websocket.From(a, websocket.WithClock(clk)), websocket.From(b, websocket.WithRole(websocket.RoleClient))
+	defer conn.Close()
+	defer peer.Close()
+	go io.Copy(io.Discard, b) // the peer never responds on its own
+	go readLoop(conn)
+
+	misses := make(chan int, 3)
+	conn.OnPongMissed(func(consecutiveMisses int) {
+		misses <- consecutiveMisses
+	})
+	// pings time out after the ping timeout, five seconds
+	missPing := func() {
+		go conn.Ping(nil, nil)
+		waitForTimer(t, clk, 5*time.Second)
+		clk.Advance(5 * time.Second)
+	}
+
+	for i := range 2 {
+		missPing()
+		if n := <-misses; n != i+1 {
+			t.Fatalf("Expected %d consecutive misses, got %d", i+1, n)
+		}
+	}
+
+	// a pong for a ping resets the count
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.Ping(context.Background(), []byte("reset"))
+	}()
+waiting:
+	for {
+		select {
+		case <-done:
+			break waiting
+		case <-time.After(10 * time.Millisecond): // the ping may not be sent yet
+			peer.Write(&websocket.Message{Type: websocket.MessagePong, Data: []byte("reset")})
+		}
+	}
+
+	missPing()
+	if n := <-misses; n != 1 {
+		t.Fatalf("Expected the count to reset after a pong, got %d", n)
+	}
+
+	// a ping cancelled by its caller is not a miss
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if pongReceived, _ := conn.Ping(ctx, nil); pongReceived {
+		t.Fatalf("Expected the cancelled ping not to receive a pong")
+	}
+	select {
+	case n := <-misses:
+		t.Fatalf("Expected the cancelled ping not to count as a miss, got %d misses", n)
+	default:
+	}
+	missPing()
+	if n := <-misses; n != 2 {
+		t.Fatalf("Expected the cancelled ping not to count as a miss, got %d misses", n)
+	}
+}
@@ -0,0 +1,131 @@
+package websocket
+
+import (
+	"net"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Pipe returns two connected Conns backed by net.Pipe, for testing code
+// that uses a Conn without a network or an HTTP server. client has
+// RoleClient and masks the frames it writes, and server has RoleServer.
+// Both are configured with the options specified, if any, except for the
+// role. With WithCompression, compression is negotiated as if the client
+// had dialed the server.
+//
+// Like net.Pipe, the pipe has no buffering: a write blocks until the other
+// side reads it, so each side needs a goroutine reading from it for the
+// other side's writes to complete. For example, a handler that echoes
+// messages can be tested with:
+//
+//	client, server := websocket.Pipe()
+//	defer client.Close()
+//	go handler(server)
+//
+//	client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("hello")})
+//	msg, err := client.Read()
+//	// check that msg is the echo of "hello"
+//
+// See FaultyPipe for a pipe with latency or errors.
+func Pipe(opts ...Option) (client, server *Conn) {
+	return FaultyPipe(PipeFaults{}, opts...)
+}
+
+// PipeFaults are the faults FaultyPipe injects into the underlying
+// connections of both Conns.
+type PipeFaults struct {
+	// Latency delays every write to the underlying connection by the
+	// duration.
+	Latency time.Duration
+	// Err, if not nil, is returned by the underlying connection once
+	// ErrorAt bytes have been written to it or read from it. A write that
+	// crosses the offset writes the bytes before it, and reads return the
+	// bytes before it, so the error happens at that exact byte of the
+	// stream. Since the Conn closes the connection after a read error, the
+	// error usually ends the connection.
+	Err     error
+	ErrorAt int64
+}
+
+// FaultyPipe is Pipe with the faults specified injected into the
+// underlying connections, for testing how code handles slow or failing
+// connections. For example, the following pipe delays every write by 10
+// milliseconds, and fails once 1000 bytes have been sent either way:
+//
+//	client, server := websocket.FaultyPipe(websocket.PipeFaults{
+//		Latency: 10 * time.Millisecond,
+//		Err:     io.ErrUnexpectedEOF,
+//		ErrorAt: 1000,
+//	})
+func FaultyPipe(faults PipeFaults, opts ...Option) (client, server *Conn) {
+	a, b := net.Pipe()
+	if faults.Latency != 0 || faults.Err != nil {
+		a, b = &faultyConn{Conn: a, faults: faults}, &faultyConn{Conn: b, faults: faults}
+	}
+	client = newConn(append(opts[:len(opts):len(opts)], WithRole(RoleClient)))
+	server = newConn(append(opts[:len(opts):len(opts)], WithRole(RoleServer)))
+	if o := server.compressionOptions; o != nil && !server.lowMemory {
+		header := make(http.Header)
+		header.Set("Sec-WebSocket-Extensions", o.offer())
+		if params, response, ok := o.acceptOffer(header); ok {
+			server.compression = &params
+			header.Set("Sec-WebSocket-Extensions", response)
+			client.compression, _ = o.acceptResponse(header)
+		}
+	}
+	return client.attach(a), server.attach(b)
+}
+
+// faultyConn is a net.Conn that injects faults into another.
+type faultyConn struct {
+	net.Conn
+	faults PipeFaults
+
+	mx      sync.Mutex
+	read    int64
+	written int64
+}
+
+// allow returns how much of n bytes may pass when count bytes already
+// have, and the error to return if that is not all of them.
+func (c *faultyConn) allow(count *int64, n int) (int, error) {
+	c.mx.Lock()
+	defer c.mx.Unlock()
+	if c.faults.Err == nil || int64(n) <= c.faults.ErrorAt-*count {
+		*count += int64(n)
+		return n, nil
+	}
+	allowed := int(max(c.faults.ErrorAt-*count, 0))
+	*count += int64(allowed)
+	return allowed, c.faults.Err
+}
+
+func (c *faultyConn) Read(p []byte) (int, error) {
+	allowed, ferr := c.allow(&c.read, len(p))
+	if allowed == 0 && ferr != nil {
+		return 0, ferr
+	}
+	n, err := c.Conn.Read(p[:allowed])
+	if n < allowed { // give back what was not read
+		c.mx.Lock()
+		c.read -= int64(allowed - n)
+		c.mx.Unlock()
+	}
+	return n, err
+}
+
+func (c *faultyConn) Write(p []byte) (int, error) {
+	if c.faults.Latency > 0 {
+		time.Sleep(c.faults.Latency)
+	}
+	allowed, ferr := c.allow(&c.written, len(p))
+	if allowed == 0 && ferr != nil { // net.Pipe waits for a reader even for nothing
+		return 0, ferr
+	}
+	n, err := c.Conn.Write(p[:allowed])
+	if err == nil {
+		err = ferr
+	}
+	return n, err
+}
@@ -0,0 +1,103 @@
+package websocket_test
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+func TestPipe(t *testing.T) {
+	client, server := websocket.Pipe()
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		msg, err := server.Read()
+		if err != nil {
+			t.Errorf("Unexpected error from Read: %v", err)
+			return
+		}
+		server.Write(msg)
+	}()
+
+	sent := &websocket.Message{Type: websocket.MessageText, Data: []byte("hello")}
+	if err := client.Write(sent); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+	msg, err := client.Read()
+	if err != nil {
+		t.Fatalf("Unexpected error from Read: %v", err)
+	}
+	if msg.Type != sent.Type || !bytes.Equal(msg.Data, sent.Data) {
+		t.Fatalf("Expected %v, got %v", sent, msg)
+	}
+}
+
+func TestFaultyPipe_Error(t *testing.T) {
+	injected := errors.New("injected")
+	// a short masked text frame is 6 bytes of header and its payload
+	client, server := websocket.FaultyPipe(websocket.PipeFaults{Err: injected, ErrorAt: 6 + 5 + 3})
+	defer client.Close()
+	defer server.Close()
+
+	go func() {
+		if err := client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("hello")}); err != nil {
+			t.Errorf("Unexpected error from the first Write: %v", err)
+		}
+		err := client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("world")})
+		if !errors.Is(err, websocket.ErrWrite) || !errors.Is(err, injected) {
+			t.Errorf("Expected the injected write error, got %v", err)
+		}
+	}()
+
+	msg, err := server.Read()
+	if err != nil {
+		t.Fatalf("Unexpected error from the first Read: %v", err)
+	}
+	if string(msg.Data) != "hello" {
+		t.Fatalf("Expected hello, got %q", msg.Data)
+	}
+	if _, err := server.Read(); !errors.Is(err, websocket.ErrRead) || !errors.Is(err, injected) {
+		t.Fatalf("Expected the injected read error, got %v", err)
+	}
+}
+
+// listError is an error that cannot be compared with ==.
+type listError struct {
+	causes []string
+}
+
+func (e listError) Error() string {
+	return strings.Join(e.causes, ", ")
+}
+
+func TestFaultyPipe_UncomparableError(t *testing.T) {
+	client, server := websocket.FaultyPipe(websocket.PipeFaults{Err: listError{causes: []string{"injected"}}})
+	defer client.Close()
+	defer server.Close()
+
+	var injected listError
+	if err := client.WriteText("hello"); !errors.As(err, &injected) {
+		t.Fatalf("Expected the injected write error, got %v", err)
+	}
+}
+
+func TestFaultyPipe_Latency(t *testing.T) {
+	const latency = 50 * time.Millisecond
+	client, server := websocket.FaultyPipe(websocket.PipeFaults{Latency: latency})
+	defer client.Close()
+	defer server.Close()
+
+	go server.Read()
+	start := time.Now()
+	if err := client.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("hello")}); err != nil {
+		t.Fatalf("Unexpected error from Write: %v", err)
+	}
+	if elapsed := time.Since(start); elapsed < latency {
+		t.Fatalf("Expected the write to take at least %v, got %v", latency, elapsed)
+	}
+}
@@ -0,0 +1,80 @@
+package websocket
+
+import (
+	"sync"
+	"unicode/utf8"
+)
+
+// PreparedMessage is a message whose frames are encoded once and reused
+// for every connection it is written to with WritePrepared, which saves
+// encoding the same frames over and over when broadcasting. It is created
+// by NewPreparedMessage and is safe to write to any amount of connections
+// concurrently.
+type PreparedMessage struct {
+	message   *Message
+	validUTF8 bool
+
+	mx     sync.Mutex
+	frames map[int][]byte // by fragment size
+}
+
+// NewPreparedMessage returns a PreparedMessage for message. It returns the
+// same errors Write returns for a message that cannot be written to any
+// connection. message must not be modified afterwards.
+func NewPreparedMessage(message *Message) (*PreparedMessage, Error) {
+	if err := validateMessage(message); err != nil {
+		return nil, err
+	}
+	return &PreparedMessage{
+		message:   message,
+		validUTF8: message.Type != MessageText || utf8.Valid(message.Data),
+		frames:    make(map[int][]byte),
+	}, nil
+}
+
+// Message returns the message that was prepared.
+func (pm *PreparedMessage) Message() *Message {
+	return pm.message
+}
+
+// framesFor returns the frames of the message for c, encoding them the first
+// time they are needed for the fragment size of c. c must be a server.
+func (pm *PreparedMessage) framesFor(c *Conn) []byte {
+	pm.mx.Lock()
+	defer pm.mx.Unlock()
+	frames, ok := pm.frames[c.fragmentSize]
+	if !ok {
+		frames = appendFrames(c, nil, pm.message.Type, 0, pm.message.Data)
+		pm.frames[c.fragmentSize] = frames
+	}
+	return frames
+}
+
+// WritePrepared writes a prepared message to the connection, like Write,
+// reusing its frames if they were already encoded for a connection with
+// the same settings. The frames written by a client are masked with a new
+// key every time, so they cannot be reused, and a client writes the
+// message like Write does. So does a connection with the write queue
+// enabled or that negotiated compression.
+func (c *Conn) WritePrepared(pm *PreparedMessage) Error {
+	if err := c.setMode(modeMessage); err != nil {
+		return err
+	}
+	if c.role == RoleClient || c.queue.Load() != nil || c.deflater != nil {
+		return c.Write(pm.message)
+	}
+	if err := c.checkWriteLimit(pm.message.Type, len(pm.message.Data)); err != nil {
+		return err
+	}
+	if !pm.validUTF8 && c.validateText.Load() {
+		return errorf(INVALID_UTF8)
+	}
+	if err := c.lockMessage(); err != nil {
+		return err
+	}
+	defer c.unlockMessage()
+	if err := c.writable(); err != nil {
+		return err
+	}
+	return c.writeFrames(pm.message.Type, len(pm.message.Data), pm.framesFor(c))
+}
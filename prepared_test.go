@@ -0,0 +1,77 @@
+package websocket_test
+
+import (
+	"bytes"
+	"errors"
+	"net"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+func TestWritePrepared(t *testing.T) {
+	msg := &websocket.Message{Type: websocket.MessageBinary, Data: bytes.Repeat([]byte("0123456789"), 10)}
+	pm, err := websocket.NewPreparedMessage(msg)
+	if err != nil {
+		t.Fatalf("expected no error from NewPreparedMessage(), got %v", err)
+	}
+
+	settings := [][]websocket.Option{
+		nil,
+		nil, // reuses the frames of the first connection
+		{websocket.WithWriteFragmentSize(16)},
+		{websocket.WithRole(websocket.RoleClient)},
+		{websocket.WithRole(websocket.RoleClient), websocket.WithWriteFragmentSize(7)},
+	}
+	for _, opts := range settings {
+		a, b := net.Pipe()
+		conn := websocket.From(a, opts...)
+		peer := websocket.From(b, websocket.WithStrictMode(websocket.Lenient)) // reads the frames of either role
+
+		go func() {
+			if err := conn.WritePrepared(pm); err != nil {
+				t.Errorf("expected no error from WritePrepared(), got %v", err)
+			}
+		}()
+		received, err := peer.Read()
+		if err != nil {
+			t.Fatalf("expected no error from Read(), got %v", err)
+		}
+		if received.Type != msg.Type || !bytes.Equal(received.Data, msg.Data) {
+			t.Fatalf("expected %v, got %v", msg, received)
+		}
+		peer.Close()
+		conn.Close()
+	}
+}
+
+func TestWritePrepared_Errors(t *testing.T) {
+	if _, err := websocket.NewPreparedMessage(&websocket.Message{Type: websocket.MessagePing, Data: make([]byte, 126)}); !errors.Is(err, websocket.ErrControlPayloadTooLong) {
+		t.Fatalf("expected CONTROL_PAYLOAD_TOO_LONG error, got %v", err)
+	}
+	if _, err := websocket.NewPreparedMessage(&websocket.Message{Type: websocket.MessageContinuation}); !errors.Is(err, websocket.ErrUnsupportedMessageType) {
+		t.Fatalf("expected UNSUPPORTED_MESSAGE_TYPE error, got %v", err)
+	}
+
+	pm, _ := websocket.NewPreparedMessage(&websocket.Message{Type: websocket.MessageText, Data: []byte{'h', 'i', 0xff}})
+	mockConn := &MockNetConn{}
+	conn := websocket.From(mockConn)
+	conn.SetValidateOutgoingText(true)
+	if err := conn.WritePrepared(pm); !errors.Is(err, websocket.ErrInvalidUTF8) {
+		t.Fatalf("expected INVALID_UTF8 error, got %v", err)
+	}
+	conn.SetValidateOutgoingText(false)
+	conn.SetWriteLimit(2)
+	if err := conn.WritePrepared(pm); !errors.Is(err, websocket.ErrMessageTooLarge) {
+		t.Fatalf("expected MESSAGE_TOO_LARGE error, got %v", err)
+	}
+	if mockConn.buf.Len() != 0 {
+		t.Fatalf("expected nothing to be written")
+	}
+
+	conn.Close()
+	conn.SetWriteLimit(0)
+	if err := conn.WritePrepared(pm); !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected CONNECTION_CLOSED error, got %v", err)
+	}
+}
@@ -0,0 +1,10 @@
+module github.com/tiredkangaroo/websocket/protobuf
+
+go 1.22.5
+
+require (
+	github.com/tiredkangaroo/websocket v0.0.0
+	google.golang.org/protobuf v1.34.2
+)
+
+replace github.com/tiredkangaroo/websocket => ../
@@ -0,0 +1,41 @@
+// Package protobuf provides a websocket.Codec for protocol buffers. It is
+// a separate module so that the websocket package does not depend on
+// google.golang.org/protobuf.
+package protobuf
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/tiredkangaroo/websocket"
+	"google.golang.org/protobuf/proto"
+)
+
+// ErrNotProtoMessage is returned by Codec when the value to marshal or
+// unmarshal into is not a proto.Message.
+var ErrNotProtoMessage = errors.New("value is not a proto.Message")
+
+// Codec is a websocket.Codec that encodes proto.Message values in the
+// protobuf wire format and sends them in binary messages. The value
+// passed to ReadVia must be a pointer to a generated message, such as
+// &pb.Event{}.
+type Codec struct{}
+
+var _ websocket.Codec = Codec{}
+
+func (Codec) Marshal(v any) ([]byte, websocket.MessageType, error) {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return nil, 0, fmt.Errorf("%w: %T", ErrNotProtoMessage, v)
+	}
+	data, err := proto.Marshal(m)
+	return data, websocket.MessageBinary, err
+}
+
+func (Codec) Unmarshal(data []byte, _ websocket.MessageType, v any) error {
+	m, ok := v.(proto.Message)
+	if !ok {
+		return fmt.Errorf("%w: %T", ErrNotProtoMessage, v)
+	}
+	return proto.Unmarshal(data, m)
+}
@@ -0,0 +1,93 @@
+package protobuf_test
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/protobuf"
+	"google.golang.org/protobuf/proto"
+	"google.golang.org/protobuf/types/known/timestamppb"
+	"google.golang.org/protobuf/types/known/wrapperspb"
+)
+
+// pipe returns two connected Conns, a client and a server.
+func pipe() (*websocket.Conn, *websocket.Conn) {
+	return websocket.Pipe()
+}
+
+func TestCodec(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	sent := timestamppb.New(time.Date(2024, 5, 1, 12, 30, 0, 42, time.UTC))
+	go conn.WriteVia(protobuf.Codec{}, sent)
+
+	received := new(timestamppb.Timestamp)
+	if err := peer.ReadVia(protobuf.Codec{}, received); err != nil {
+		t.Fatalf("expected no error from ReadVia(), got %v", err)
+	}
+	if !proto.Equal(sent, received) {
+		t.Fatalf("expected %v, got %v", sent, received)
+	}
+}
+
+func TestCodec_MessageType(t *testing.T) {
+	_, messageType, err := protobuf.Codec{}.Marshal(wrapperspb.String("hello"))
+	if err != nil {
+		t.Fatalf("expected no error from Marshal(), got %v", err)
+	}
+	if messageType != websocket.MessageBinary {
+		t.Fatalf("expected MessageBinary, got %v", messageType)
+	}
+}
+
+func TestCodec_NotProtoMessage(t *testing.T) {
+	conn, peer := pipe()
+	defer conn.Close()
+	defer peer.Close()
+
+	err := conn.WriteVia(protobuf.Codec{}, "hello")
+	if !errors.Is(err, websocket.ErrCodec) || !errors.Is(err, protobuf.ErrNotProtoMessage) {
+		t.Fatalf("expected a CODEC_ERROR error caused by ErrNotProtoMessage, got %v", err)
+	}
+
+	go conn.WriteVia(protobuf.Codec{}, wrapperspb.String("hello"))
+	var s string
+	err = peer.ReadVia(protobuf.Codec{}, &s)
+	if !errors.Is(err, websocket.ErrCodec) || !errors.Is(err, protobuf.ErrNotProtoMessage) {
+		t.Fatalf("expected a CODEC_ERROR error caused by ErrNotProtoMessage, got %v", err)
+	}
+}
+
+// event is the JSON equivalent of the protobuf message used in the
+// benchmarks.
+type event struct {
+	Seconds int64 `json:"seconds"`
+	Nanos   int32 `json:"nanos"`
+}
+
+func benchmarkCodec(b *testing.B, codec websocket.Codec, v any, into func() any) {
+	b.ReportAllocs()
+	for range b.N {
+		data, messageType, err := codec.Marshal(v)
+		if err != nil {
+			b.Fatal(err)
+		}
+		if err := codec.Unmarshal(data, messageType, into()); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkCodec_Protobuf(b *testing.B) {
+	v := &timestamppb.Timestamp{Seconds: 1714566600, Nanos: 42}
+	benchmarkCodec(b, protobuf.Codec{}, v, func() any { return new(timestamppb.Timestamp) })
+}
+
+func BenchmarkCodec_JSON(b *testing.B) {
+	v := &event{Seconds: 1714566600, Nanos: 42}
+	benchmarkCodec(b, websocket.JSONCodec{}, v, func() any { return new(event) })
+}
@@ -0,0 +1,192 @@
+package websocket
+
+import (
+	"os"
+	"sync"
+	"time"
+
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// tokenBucket limits the rate at which bytes are written. Tokens may be
+// reserved ahead of time, in which case the bucket goes into debt and
+// the caller waits until the debt is repaid.
+type tokenBucket struct {
+	mx     sync.Mutex
+	clock  clock.Clock
+	rate   float64 // tokens added per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newTokenBucket(c clock.Clock, rate, burst int) *tokenBucket {
+	return &tokenBucket{
+		clock:  c,
+		rate:   float64(rate),
+		burst:  float64(burst),
+		tokens: float64(burst),
+		last:   c.Now(),
+	}
+}
+
+// reserve takes n tokens from the bucket and returns how long the caller
+// must wait before using them.
+func (b *tokenBucket) reserve(n int) time.Duration {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	now := b.clock.Now()
+	b.tokens = min(b.burst, b.tokens+now.Sub(b.last).Seconds()*b.rate)
+	b.last = now
+	b.tokens -= float64(n)
+	if b.tokens >= 0 {
+		return 0
+	}
+	return time.Duration(-b.tokens / b.rate * float64(time.Second))
+}
+
+// unreserve gives back n tokens reserved for bytes that were not written.
+func (b *tokenBucket) unreserve(n int) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	b.tokens = min(b.burst, b.tokens+float64(n))
+}
+
+// SetWriteRateLimit limits the rate at which data frames are written to
+// bytesPerSec, allowing bursts of up to burst bytes. Frames are written in
+// chunks of at most burst bytes, each once enough of the budget is
+// available, so that a large message is paced rather than written at once.
+// A write waits until the connection is closed or the deadline set with
+// SetWriteDeadline passes at most, and returns a timeout error then.
+// Control frames are not limited and do not use up the budget, but they
+// cannot be written in the middle of a data frame, so they wait for the
+// frame being written; WithWriteFragmentSize lets them be written between
+// the frames of a large message.
+//
+// A bytesPerSec of 0 or less removes the limit. A burst of 0 or less
+// defaults to bytesPerSec.
+func (c *Conn) SetWriteRateLimit(bytesPerSec int, burst int) {
+	if bytesPerSec <= 0 {
+		c.limiter.Store(nil)
+		return
+	}
+	if burst <= 0 {
+		burst = bytesPerSec
+	}
+	c.limiter.Store(newTokenBucket(c.clock, bytesPerSec, burst))
+}
+
+// SetWriteDeadline sets the write deadline of the underlying connection,
+// like net.Conn, if it supports deadlines. The deadline also bounds how
+// long a write waits for the write rate limit (see SetWriteRateLimit),
+// which a deadline set directly on NetConn does not. The zero time means
+// there is no deadline.
+func (c *Conn) SetWriteDeadline(t time.Time) error {
+	c.deadlineMx.Lock()
+	c.writeDeadline = t
+	if c.deadlineChanged != nil {
+		close(c.deadlineChanged)
+		c.deadlineChanged = nil
+	}
+	c.deadlineMx.Unlock()
+	if d, ok := c.underlying.(interface{ SetWriteDeadline(time.Time) error }); ok {
+		return d.SetWriteDeadline(t)
+	}
+	return nil
+}
+
+// deadline returns the deadline set with SetWriteDeadline, and a channel
+// that is closed once it changes.
+func (c *Conn) deadline() (time.Time, <-chan struct{}) {
+	c.deadlineMx.Lock()
+	defer c.deadlineMx.Unlock()
+	if c.deadlineChanged == nil {
+		c.deadlineChanged = make(chan struct{})
+	}
+	return c.writeDeadline, c.deadlineChanged
+}
+
+// writeLimited writes frames, holding the write mutex. Unless they are
+// control frames, they are written under the write rate limit, if any, in
+// chunks of at most the burst of the limit. Waiting for the first chunk
+// does not hold the write mutex, so that control frames can be written
+// meanwhile. If waiting for a later chunk fails, the connection is failed,
+// since the peer would wait for the rest of the frame.
+func (c *Conn) writeLimited(frames []byte, control bool) Error {
+	limiter := c.limiter.Load()
+	if control || limiter == nil {
+		c.wmx.Lock()
+		err := c.writeFrame(frames, control)
+		c.wmx.Unlock()
+		return err
+	}
+
+	chunk := int(limiter.burst)
+	n := min(len(frames), chunk)
+	if err := c.waitWriteRate(limiter, n); err != nil {
+		return err
+	}
+	c.wmx.Lock()
+	err := c.writeFrame(frames[:n], false)
+	aborted := false
+	for frames = frames[n:]; err == nil && len(frames) > 0; frames = frames[n:] {
+		n = min(len(frames), chunk)
+		if err = c.waitWriteRate(limiter, n); err != nil {
+			aborted = true
+			break
+		}
+		err = c.writeFrame(frames[:n], false)
+	}
+	c.wmx.Unlock()
+	if aborted {
+		c.fail(err)
+	}
+	return err
+}
+
+// waitWriteRate waits until n bytes may be written under the write rate
+// limit of limiter. It returns a CONNECTION_CLOSED error if the connection
+// is closed while waiting, and a timeout error if the deadline set with
+// SetWriteDeadline passes first, in which case the budget is given back.
+func (c *Conn) waitWriteRate(limiter *tokenBucket, n int) Error {
+	d := limiter.reserve(n)
+	if d <= 0 {
+		return nil
+	}
+	t := c.clock.NewTimer(d)
+	defer t.Stop()
+	for {
+		// the deadline is waited for with a timer of its own, which is
+		// replaced whenever the deadline changes
+		deadline, changed := c.deadline()
+		var expired <-chan time.Time
+		var dt clock.Timer
+		if !deadline.IsZero() {
+			remaining := deadline.Sub(c.clock.Now())
+			if remaining <= 0 {
+				limiter.unreserve(n)
+				return c.writeError(os.ErrDeadlineExceeded)
+			}
+			dt = c.clock.NewTimer(remaining)
+			expired = dt.C()
+		}
+		var err Error
+		select {
+		case <-t.C():
+		case <-c.ctx.Done():
+			err = c.closedError()
+		case <-expired:
+			limiter.unreserve(n)
+			err = c.writeError(os.ErrDeadlineExceeded)
+		case <-changed:
+			if dt != nil {
+				dt.Stop()
+			}
+			continue
+		}
+		if dt != nil {
+			dt.Stop()
+		}
+		return err
+	}
+}
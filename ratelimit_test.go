@@ -0,0 +1,163 @@
+package websocket_test
+
+import (
+	"errors"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+const mib = 1 << 20
+
+func TestWriteRateLimit_SimulatedTime(t *testing.T) {
+	clk := clock.NewFake()
+	mockConn := &CountingConn{discard: true}
+	conn := websocket.From(mockConn)
+	websocket.UseClock(conn, clk)
+	conn.SetWriteRateLimit(mib, mib)
+
+	start := clk.Now()
+	done := make(chan websocket.Error)
+	go func() {
+		done <- conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: make([]byte, 10*mib)})
+	}()
+
+	// the frame is written a MiB at a time, the last chunk being the bytes
+	// of its header
+	for i := 1; i <= 10; i++ {
+		waitFor(t, time.Second, func() bool { return clk.Pending() == 1 })
+		if writes := mockConn.Writes(); writes != i {
+			t.Fatalf("expected %d chunks to be written before waiting again, got %d", i, writes)
+		}
+		clk.FireNext()
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+
+	// the first MiB is covered by the burst, the other 9 MiB take a second each
+	elapsed := clk.Now().Sub(start)
+	if elapsed < 9*time.Second || elapsed > 10*time.Second {
+		t.Fatalf("expected the write to take about 9s, took %s", elapsed)
+	}
+}
+
+func TestWriteRateLimit_WithinBurst(t *testing.T) {
+	clk := clock.NewFake()
+	mockConn := new(CountingConn)
+	conn := websocket.From(mockConn)
+	websocket.UseClock(conn, clk)
+	conn.SetWriteRateLimit(1024, 1024)
+
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: make([]byte, 1000)}); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+	if clk.Pending() != 0 || mockConn.Writes() != 1 {
+		t.Fatalf("expected a write within the burst to not wait")
+	}
+
+	// the bucket is nearly empty, but control frames are exempt
+	if err := conn.Write(&websocket.Message{Type: websocket.MessagePing, Data: make([]byte, 125)}); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+	if clk.Pending() != 0 || mockConn.Writes() != 2 {
+		t.Fatalf("expected control frames to not wait")
+	}
+
+	// the bucket refills over time
+	clk.Advance(time.Second)
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: make([]byte, 1000)}); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+	if clk.Pending() != 0 || mockConn.Writes() != 3 {
+		t.Fatalf("expected a write after the bucket refilled to not wait")
+	}
+}
+
+func TestWriteRateLimit_Close(t *testing.T) {
+	clk := clock.NewFake()
+	conn := websocket.From(&CountingConn{discard: true})
+	websocket.UseClock(conn, clk)
+	conn.SetWriteRateLimit(1, 1)
+
+	done := make(chan websocket.Error)
+	go func() {
+		done <- conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: make([]byte, 100)})
+	}()
+	waitFor(t, time.Second, func() bool { return clk.Pending() == 1 })
+	conn.Close()
+
+	err := <-done
+	if err == nil || err.Kind() != websocket.CONNECTION_CLOSED {
+		t.Fatalf("expected CONNECTION_CLOSED error, got %v", err)
+	}
+}
+
+func TestWriteRateLimit_Disable(t *testing.T) {
+	clk := clock.NewFake()
+	conn := websocket.From(&CountingConn{discard: true})
+	websocket.UseClock(conn, clk)
+	conn.SetWriteRateLimit(1, 1)
+	conn.SetWriteRateLimit(0, 0)
+
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: make([]byte, 100)}); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+	if clk.Pending() != 0 {
+		t.Fatalf("expected no wait once the limit is removed")
+	}
+}
+
+func TestWriteRateLimit_WriteDeadline(t *testing.T) {
+	clk := clock.NewFake()
+	mockConn := &CountingConn{discard: true}
+	conn := websocket.From(mockConn)
+	websocket.UseClock(conn, clk)
+	conn.SetWriteRateLimit(100, 100)
+	message := &websocket.Message{Type: websocket.MessageBinary, Data: make([]byte, 50)}
+	if err := conn.Write(message); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+
+	// a deadline set while waiting for the budget ends the wait, and the
+	// connection stays open since nothing was written
+	done := make(chan websocket.Error)
+	go func() { done <- conn.Write(message) }()
+	waitFor(t, time.Second, func() bool { return clk.Pending() == 1 })
+	conn.SetWriteDeadline(clk.Now().Add(10 * time.Millisecond))
+	waitFor(t, time.Second, func() bool { return clk.Pending() == 2 })
+	clk.Advance(10 * time.Millisecond)
+	assertTimeout(t, <-done)
+	if conn.Closed() || mockConn.Writes() != 1 {
+		t.Fatalf("expected the connection to stay open with nothing written")
+	}
+
+	// the budget of the frame that timed out was given back
+	conn.SetWriteDeadline(time.Time{})
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: make([]byte, 40)}); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+	if clk.Pending() != 0 || mockConn.Writes() != 2 {
+		t.Fatalf("expected a write within the budget given back to not wait")
+	}
+
+	// a deadline passing between the chunks of a frame fails the
+	// connection, since the rest of the frame cannot be written
+	conn.SetWriteDeadline(clk.Now().Add(time.Second))
+	go func() {
+		done <- conn.Write(&websocket.Message{Type: websocket.MessageBinary, Data: make([]byte, 300)})
+	}()
+	waitFor(t, time.Second, func() bool { return clk.Pending() == 2 })
+	clk.FireNext() // the budget for the first chunk
+	waitFor(t, time.Second, func() bool { return mockConn.Writes() == 3 && clk.Pending() == 2 })
+	clk.FireNext() // the deadline
+	if err := <-done; !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected a timeout error, got %v", err)
+	}
+	if !conn.Closed() || !errors.Is(conn.Err(), os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the connection to be failed with the timeout, got %v", conn.Err())
+	}
+}
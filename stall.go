@@ -0,0 +1,167 @@
+package websocket
+
+import (
+	"time"
+
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// StallPolicy determines what happens when a write to a Conn stalls for
+// longer than the threshold set with SetStallThreshold.
+type StallPolicy uint8
+
+const (
+	// StallReport only calls the OnStall function.
+	StallReport StallPolicy = 0
+	// StallClosePolicyViolation calls the OnStall function, then closes
+	// the connection with close code 1008 (policy violation).
+	StallClosePolicyViolation StallPolicy = 1
+	// StallCloseTryAgainLater calls the OnStall function, then closes
+	// the connection with close code 1013 (try again later).
+	StallCloseTryAgainLater StallPolicy = 2
+)
+
+// stallWatch watches the writes of a connection for stalls.
+type stallWatch struct {
+	threshold time.Duration
+	policy    StallPolicy
+	onStall   func(stalledFor time.Duration)
+	signal    chan struct{} // a write started or a message was queued
+	stop      chan struct{}
+}
+
+// SetStallThreshold starts watching for writes that stall, such as writes
+// to a peer that stopped reading. Once a write has been blocked for longer
+// than threshold, the stall is reported to onStall, if it is not nil, with
+// how long the write has been blocked, and the policy decides whether the
+// connection is then closed. A stall is only reported once, however long
+// it lasts.
+//
+// With the write queue enabled (see EnableWriteQueue), the age of the
+// oldest message that is not written yet is watched instead, so a peer
+// reading too slowly to keep up with the queue is reported too. The
+// function is called without any of the connection's locks held, from a
+// goroutine owned by the connection. Calling SetStallThreshold again
+// replaces the current settings, and a threshold of 0 or less stops
+// watching.
+func (c *Conn) SetStallThreshold(threshold time.Duration, policy StallPolicy, onStall func(stalledFor time.Duration)) {
+	var w *stallWatch
+	if threshold > 0 {
+		w = &stallWatch{
+			threshold: threshold,
+			policy:    policy,
+			onStall:   onStall,
+			signal:    make(chan struct{}, 1),
+			stop:      make(chan struct{}),
+		}
+	}
+	if old := c.stallWatch.Swap(w); old != nil {
+		close(old.stop)
+	}
+	if w != nil {
+		go c.watchStalls(w)
+	}
+}
+
+// StalledFor returns how long the write in progress has been blocked on
+// the underlying connection, or, with the write queue enabled, how long
+// the oldest message that is not written yet has been waiting. It returns
+// 0 if nothing is being written.
+func (c *Conn) StalledFor() time.Duration {
+	since := c.stalledSince()
+	if since == 0 {
+		return 0
+	}
+	return c.clock.Now().Sub(time.Unix(0, since))
+}
+
+// stalledSince returns when the stall reported by StalledFor started, in
+// Unix nanoseconds, or 0 if nothing is being written.
+func (c *Conn) stalledSince() int64 {
+	since := c.writeStart.Load()
+	if q := c.queue.Load(); q != nil {
+		if queued := q.oldest(); queued != 0 && (since == 0 || queued < since) {
+			since = queued
+		}
+	}
+	return since
+}
+
+// writeStarted records that a write to the underlying connection started.
+// The write mutex must be held.
+func (c *Conn) writeStarted() {
+	c.writeStart.Store(c.clock.Now().UnixNano())
+	c.signalStallWatch()
+}
+
+// signalStallWatch wakes up the stall watch, if there is one, after a
+// write started or a message was queued.
+func (c *Conn) signalStallWatch() {
+	if w := c.stallWatch.Load(); w != nil {
+		select {
+		case w.signal <- struct{}{}:
+		default:
+		}
+	}
+}
+
+// watchStalls reports the stalls of the connection to w until w is stopped
+// or the connection is closed.
+func (c *Conn) watchStalls(w *stallWatch) {
+	var reported int64 // when the last stall reported started
+	for {
+		// while a timer is set for the current stall, later writes can
+		// only stall later, so they are checked once it fires
+		var timer clock.Timer
+		var fired <-chan time.Time
+		signal := w.signal
+		if since := c.stalledSince(); since != 0 && since != reported {
+			stalledFor := c.clock.Now().Sub(time.Unix(0, since))
+			if stalledFor >= w.threshold {
+				reported = since
+				if c.stalled(w, stalledFor) {
+					return
+				}
+				continue
+			}
+			timer = c.clock.NewTimer(w.threshold - stalledFor)
+			fired, signal = timer.C(), nil
+		}
+
+		select {
+		case <-fired:
+		case <-signal:
+		case <-w.stop:
+		case <-c.ctx.Done():
+		}
+		if timer != nil {
+			timer.Stop()
+		}
+		select {
+		case <-w.stop:
+			return
+		case <-c.ctx.Done():
+			return
+		default:
+		}
+	}
+}
+
+// stalled reports a stall of the duration specified and applies the
+// policy of w. It reports whether the connection is being closed.
+func (c *Conn) stalled(w *stallWatch, stalledFor time.Duration) bool {
+	if w.onStall != nil {
+		w.onStall(stalledFor)
+	}
+	if w.policy == StallReport {
+		return false
+	}
+	code := ClosePolicyViolation
+	if w.policy == StallCloseTryAgainLater {
+		code = CloseTryAgainLater
+	}
+	c.logger.Error("closing connection after a write stalled", "stalled_for", stalledFor)
+	c.setErr(errorf(WRITE_STALLED, stalledFor))
+	go c.closeWithCode(code, "write stalled")
+	return true
+}
@@ -0,0 +1,178 @@
+package websocket_test
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+	"github.com/tiredkangaroo/websocket/internal/clock"
+)
+
+// stallRecorder records the stalls reported to an OnStall function.
+type stallRecorder struct {
+	mx     sync.Mutex
+	stalls []time.Duration
+}
+
+func (r *stallRecorder) record(stalledFor time.Duration) {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	r.stalls = append(r.stalls, stalledFor)
+}
+
+func (r *stallRecorder) get() []time.Duration {
+	r.mx.Lock()
+	defer r.mx.Unlock()
+	return append([]time.Duration(nil), r.stalls...)
+}
+
+func TestSetStallThreshold(t *testing.T) {
+	peer, conn := websocket.Pipe()
+	defer conn.Close()
+	clk := clock.NewFake()
+	websocket.UseClock(conn, clk)
+
+	var stalls stallRecorder
+	conn.SetStallThreshold(time.Second, websocket.StallReport, stalls.record)
+	if d := conn.StalledFor(); d != 0 {
+		t.Fatalf("expected StalledFor() to be 0 before writing, got %s", d)
+	}
+
+	// the peer is not read from, so the write blocks
+	done := make(chan websocket.Error)
+	go func() {
+		done <- conn.WriteText("hello")
+	}()
+	waitForTimer(t, clk, time.Second)
+	clk.Advance(999 * time.Millisecond)
+	if d := conn.StalledFor(); d != 999*time.Millisecond {
+		t.Fatalf("expected StalledFor() to be 999ms, got %s", d)
+	}
+	if s := stalls.get(); len(s) != 0 {
+		t.Fatalf("expected no stall before the threshold, got %v", s)
+	}
+	clk.Advance(time.Millisecond)
+	waitFor(t, time.Second, func() bool { return len(stalls.get()) == 1 })
+	if s := stalls.get(); s[0] != time.Second {
+		t.Fatalf("expected a stall of 1s, got %v", s)
+	}
+
+	// a stall is only reported once
+	clk.Advance(time.Minute)
+	if msg, err := peer.Read(); err != nil || string(msg.Data) != "hello" {
+		t.Fatalf("expected to read hello, got %v and %v", msg, err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("expected no error from WriteText(), got %v", err)
+	}
+	if d := conn.StalledFor(); d != 0 {
+		t.Fatalf("expected StalledFor() to be 0 once the write is done, got %s", d)
+	}
+	if s := stalls.get(); len(s) != 1 {
+		t.Fatalf("expected the stall to be reported once, got %v", s)
+	}
+	if conn.Context().Err() != nil {
+		t.Fatalf("expected StallReport to keep the connection open")
+	}
+
+	// the next write is watched again
+	go conn.WriteText("again")
+	waitForTimer(t, clk, time.Second)
+	clk.Advance(time.Second)
+	waitFor(t, time.Second, func() bool { return len(stalls.get()) == 2 })
+	peer.Read()
+}
+
+func TestSetStallThreshold_WriteQueue(t *testing.T) {
+	peer, conn := websocket.Pipe()
+	defer conn.Close()
+	clk := clock.NewFake()
+	websocket.UseClock(conn, clk)
+	conn.EnableWriteQueue(4, websocket.OverflowBlock)
+
+	var stalls stallRecorder
+	conn.SetStallThreshold(time.Second, websocket.StallReport, stalls.record)
+	if err := conn.WriteText("one"); err != nil {
+		t.Fatalf("expected no error from WriteText(), got %v", err)
+	}
+	waitForTimer(t, clk, time.Second)
+	clk.Advance(500 * time.Millisecond)
+	if err := conn.WriteText("two"); err != nil {
+		t.Fatalf("expected no error from WriteText(), got %v", err)
+	}
+
+	// the age of the oldest message that is not written yet is watched
+	clk.Advance(500 * time.Millisecond)
+	waitFor(t, time.Second, func() bool { return len(stalls.get()) == 1 })
+	if s := stalls.get(); s[0] != time.Second {
+		t.Fatalf("expected a stall of 1s, got %v", s)
+	}
+	if msg, err := peer.Read(); err != nil || string(msg.Data) != "one" {
+		t.Fatalf("expected to read one, got %v and %v", msg, err)
+	}
+	// two was queued 500ms ago
+	waitForTimer(t, clk, 500*time.Millisecond)
+	if d := conn.StalledFor(); d != 500*time.Millisecond {
+		t.Fatalf("expected StalledFor() to be the age of two, got %s", d)
+	}
+	clk.Advance(500 * time.Millisecond)
+	waitFor(t, time.Second, func() bool { return len(stalls.get()) == 2 })
+	if msg, err := peer.Read(); err != nil || string(msg.Data) != "two" {
+		t.Fatalf("expected to read two, got %v and %v", msg, err)
+	}
+	waitFor(t, time.Second, func() bool { return conn.StalledFor() == 0 })
+}
+
+func TestSetStallThreshold_Close(t *testing.T) {
+	for policy, code := range map[websocket.StallPolicy]int{
+		websocket.StallClosePolicyViolation: websocket.ClosePolicyViolation,
+		websocket.StallCloseTryAgainLater:   websocket.CloseTryAgainLater,
+	} {
+		peer, conn := websocket.Pipe()
+
+		var stalls stallRecorder
+		conn.SetStallThreshold(20*time.Millisecond, policy, stalls.record)
+		go conn.WriteText("hello")
+		waitFor(t, time.Second, func() bool { return len(stalls.get()) == 1 })
+		if s := stalls.get(); s[0] < 20*time.Millisecond {
+			t.Fatalf("expected a stall of at least 20ms, got %v", s)
+		}
+
+		// the stalled message is followed by the close frame
+		if msg, err := peer.Read(); err != nil || string(msg.Data) != "hello" {
+			t.Fatalf("expected to read hello, got %v and %v", msg, err)
+		}
+		if _, err := peer.Read(); !websocket.IsCloseError(err, code) {
+			t.Fatalf("expected the connection to be closed with %d, got %v", code, err)
+		}
+		<-conn.Context().Done()
+		if err := conn.Err(); !errors.Is(err, websocket.ErrWriteStalled) {
+			t.Fatalf("expected Err() to be a WRITE_STALLED error, got %v", err)
+		}
+		peer.Close()
+	}
+}
+
+func TestSetStallThreshold_Disable(t *testing.T) {
+	a, b := net.Pipe()
+	conn := websocket.From(a)
+	clk := clock.NewFake()
+	websocket.UseClock(conn, clk)
+
+	conn.SetStallThreshold(time.Second, websocket.StallReport, func(time.Duration) {
+		t.Errorf("expected no stall to be reported once watching stopped")
+	})
+	go conn.WriteText("hello")
+	waitForTimer(t, clk, time.Second)
+	conn.SetStallThreshold(0, websocket.StallReport, nil)
+	waitFor(t, time.Second, func() bool { return clk.Pending() == 0 })
+	clk.Advance(time.Minute)
+	if d := conn.StalledFor(); d != time.Minute {
+		t.Fatalf("expected StalledFor() to still be tracked, got %s", d)
+	}
+	b.Close()
+	conn.Close()
+}
@@ -0,0 +1,130 @@
+package websocket
+
+// ConnState is the state of a connection in the closing handshake.
+type ConnState int32
+
+const (
+	// StateOpen means no close frame has been sent or received.
+	StateOpen ConnState = iota
+	// StateClosingLocal means a close frame was written and the peer's
+	// close frame has not been received yet.
+	StateClosingLocal
+	// StateClosingRemote means the peer's close frame was received and the
+	// close frame echoing it is being written.
+	StateClosingRemote
+	// StateClosed means the connection is closed.
+	StateClosed
+)
+
+func (s ConnState) String() string {
+	switch s {
+	case StateOpen:
+		return "StateOpen"
+	case StateClosingLocal:
+		return "StateClosingLocal"
+	case StateClosingRemote:
+		return "StateClosingRemote"
+	case StateClosed:
+		return "StateClosed"
+	default:
+		return "Unknown"
+	}
+}
+
+// State returns the state of the connection.
+func (c *Conn) State() ConnState {
+	return ConnState(c.state.Load())
+}
+
+// SetStateChangeHandler sets the function called every time the state of
+// the connection changes, with the old and the new state. A connection
+// starts out open and only moves forward: from StateOpen to one of the
+// closing states, and from any state to StateClosed. A connection that
+// ends without a closing handshake, such as when Close is called or the
+// underlying connection fails, moves from StateOpen to StateClosed
+// directly. Every transition calls the handler exactly once, in order.
+// Passing nil removes the handler.
+//
+// The handler is called without any of the connection's locks held, so it
+// may call any method of the Conn. It is usually called from the goroutine
+// that made the transition before the method that made it returns, such as
+// a Read that received a close frame, once Read has released its lock, but
+// a transition made while the handler is being called for an earlier one
+// is delivered by the goroutine calling it. It should not block.
+func (c *Conn) SetStateChangeHandler(h func(old, new ConnState)) {
+	if h == nil {
+		c.stateHandler.Store(nil)
+		return
+	}
+	c.stateHandler.Store(&h)
+}
+
+// stateChange is a transition the state change handler is called with.
+type stateChange struct {
+	old, new ConnState
+}
+
+// setState moves the connection to the state specified, if it is allowed
+// to move there from its current state, and calls the state change handler
+// once no lock is held (see deliverStates).
+func (c *Conn) setState(s ConnState) {
+	c.stateMx.Lock()
+	old := ConnState(c.state.Load())
+	if old == StateClosed || (old != StateOpen && s != StateClosed) {
+		c.stateMx.Unlock()
+		return
+	}
+	c.state.Store(int32(s))
+	if c.stateHandler.Load() != nil {
+		c.stateChanges = append(c.stateChanges, stateChange{old, s})
+	}
+	c.stateMx.Unlock()
+	c.deliverStates()
+}
+
+// deliverStates calls the state change handler with the state changes it
+// was not called with yet, unless they are deferred because the read mutex
+// is held, or another goroutine is calling it already, in which case that
+// goroutine calls it with them too.
+func (c *Conn) deliverStates() {
+	c.stateMx.Lock()
+	defer c.stateMx.Unlock()
+	if c.statesDeferred.Load() || c.stateDelivering {
+		return
+	}
+	c.stateDelivering = true
+	for len(c.stateChanges) > 0 {
+		change := c.stateChanges[0]
+		c.stateChanges = c.stateChanges[1:]
+		c.stateMx.Unlock()
+		if h := c.stateHandler.Load(); h != nil {
+			(*h)(change.old, change.new)
+		}
+		c.stateMx.Lock()
+	}
+	c.stateChanges = nil
+	c.stateDelivering = false
+}
+
+// lockRead locks the read mutex, deferring the state changes made while it
+// is held until unlockRead releases it.
+func (c *Conn) lockRead() {
+	c.rmx.Lock()
+	c.statesDeferred.Store(true)
+}
+
+// unlockRead releases the read mutex and delivers the state changes made
+// while it was held.
+func (c *Conn) unlockRead() {
+	c.statesDeferred.Store(false)
+	c.rmx.Unlock()
+	c.deliverStates()
+}
+
+// readBlocking is called with the read mutex held before reading from the
+// underlying connection, and with false once the read returns, so that the
+// state changes other goroutines make while a Read is blocked are not
+// deferred until it returns.
+func (c *Conn) readBlocking(blocking bool) {
+	c.statesDeferred.Store(!blocking)
+}
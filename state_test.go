@@ -0,0 +1,186 @@
+package websocket_test
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+type transition struct {
+	old, new websocket.ConnState
+}
+
+// recordTransitions sets a state change handler on conn that records every
+// transition.
+func recordTransitions(conn *websocket.Conn) func() []transition {
+	var mx sync.Mutex
+	var transitions []transition
+	conn.SetStateChangeHandler(func(old, new websocket.ConnState) {
+		mx.Lock()
+		defer mx.Unlock()
+		transitions = append(transitions, transition{old, new})
+	})
+	return func() []transition {
+		mx.Lock()
+		defer mx.Unlock()
+		return append([]transition(nil), transitions...)
+	}
+}
+
+func assertTransitions(t *testing.T, got []transition, expected ...transition) {
+	t.Helper()
+	if len(got) != len(expected) {
+		t.Fatalf("expected transitions %v, got %v", expected, got)
+	}
+	for i := range expected {
+		if got[i] != expected[i] {
+			t.Fatalf("expected transitions %v, got %v", expected, got)
+		}
+	}
+}
+
+func TestState_LocalClose(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	transitions := recordTransitions(conn)
+	if conn.State() != websocket.StateOpen {
+		t.Fatalf("expected StateOpen, got %v", conn.State())
+	}
+
+	go peer.Read()
+	if err := conn.CloseWithCode(websocket.CloseNormalClosure, ""); err != nil {
+		t.Fatalf("expected no error from CloseWithCode(), got %v", err)
+	}
+	if conn.State() != websocket.StateClosed {
+		t.Fatalf("expected StateClosed, got %v", conn.State())
+	}
+	assertTransitions(t, transitions(),
+		transition{websocket.StateOpen, websocket.StateClosingLocal},
+		transition{websocket.StateClosingLocal, websocket.StateClosed},
+	)
+}
+
+func TestState_LocalCloseHandshake(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	transitions := recordTransitions(conn)
+
+	// the peer echoes the close frame
+	go peer.Read()
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageClose, Data: websocket.FormatCloseMessage(websocket.CloseGoingAway, "")}); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+	if conn.State() != websocket.StateClosingLocal {
+		t.Fatalf("expected StateClosingLocal, got %v", conn.State())
+	}
+	if err := conn.Drain(context.Background()); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected a close error with code %d, got %v", websocket.CloseGoingAway, err)
+	}
+	assertTransitions(t, transitions(),
+		transition{websocket.StateOpen, websocket.StateClosingLocal},
+		transition{websocket.StateClosingLocal, websocket.StateClosed},
+	)
+}
+
+func TestState_RemoteClose(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	transitions := recordTransitions(conn)
+
+	go func() {
+		peer.Write(&websocket.Message{Type: websocket.MessageClose, Data: websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")})
+		peer.Read() // the echoed close frame
+	}()
+	if _, err := conn.Read(); !websocket.IsCloseError(err, websocket.CloseNormalClosure) {
+		t.Fatalf("expected a close error with code %d, got %v", websocket.CloseNormalClosure, err)
+	}
+	assertTransitions(t, transitions(),
+		transition{websocket.StateOpen, websocket.StateClosingRemote},
+		transition{websocket.StateClosingRemote, websocket.StateClosed},
+	)
+}
+
+func TestState_TransportError(t *testing.T) {
+	conn, peer := pipe()
+	transitions := recordTransitions(conn)
+
+	peer.NetConn().Close()
+	if _, err := conn.Read(); err == nil {
+		t.Fatalf("expected an error from Read()")
+	}
+	assertTransitions(t, transitions(),
+		transition{websocket.StateOpen, websocket.StateClosed},
+	)
+}
+
+func TestState_ConcurrentClose(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+	transitions := recordTransitions(conn)
+
+	var wg sync.WaitGroup
+	for range 10 {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			conn.Close()
+		}()
+	}
+	wg.Wait()
+	assertTransitions(t, transitions(),
+		transition{websocket.StateOpen, websocket.StateClosed},
+	)
+}
+
+func TestState_HandlerReads(t *testing.T) {
+	conn, peer := pipe()
+	defer peer.Close()
+
+	// a handler that reads from the connection must not deadlock with the
+	// Read that observed the close frame
+	drained := make(chan error, 1)
+	conn.SetStateChangeHandler(func(old, new websocket.ConnState) {
+		if new == websocket.StateClosingRemote {
+			drained <- conn.Drain(context.Background())
+		}
+	})
+	go func() {
+		peer.Write(&websocket.Message{Type: websocket.MessageClose, Data: websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")})
+		peer.Read() // the echoed close frame
+	}()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		conn.Read()
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Read() to return when the handler reads")
+	}
+	if err := <-drained; err == nil {
+		t.Fatalf("expected an error from Drain() in the handler")
+	}
+}
+
+func TestState_ClosingLocalAfterWrite(t *testing.T) {
+	mockConn := &CountingConn{discard: true}
+	conn := websocket.From(mockConn)
+	writes := -1
+	conn.SetStateChangeHandler(func(old, new websocket.ConnState) {
+		if new == websocket.StateClosingLocal {
+			writes = mockConn.Writes()
+		}
+	})
+
+	if err := conn.Write(&websocket.Message{Type: websocket.MessageClose, Data: websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")}); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+	if writes != 1 {
+		t.Fatalf("expected StateClosingLocal to be reported after the close frame was written, got %d writes", writes)
+	}
+}
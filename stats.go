@@ -0,0 +1,295 @@
+package websocket
+
+import "sync/atomic"
+
+// Stats are the counters of a connection, returned by Conn.Stats. Every
+// counter only goes up, from 0 when the connection is created, so rates
+// are the difference between two snapshots divided by the time between
+// them. They are plain integers so that they can be exported to any
+// metrics library.
+type Stats struct {
+	// BytesRead and BytesWritten are the amounts of bytes of the frames
+	// read from and written to the connection, headers included. A frame
+	// that is buffered (see SetWriteBuffer) is counted once it is in the
+	// buffer.
+	BytesRead    uint64
+	BytesWritten uint64
+	// FramesRead and FramesWritten are the amounts of frames read and
+	// written, which is more than the amount of messages when messages are
+	// fragmented.
+	FramesRead    uint64
+	FramesWritten uint64
+	// MessagesRead and MessagesWritten are the amounts of messages of every
+	// type read and written. A fragmented message is counted once, when its
+	// last fragment is read. Data messages discarded by Drain are not
+	// counted.
+	MessagesRead    MessageCounts
+	MessagesWritten MessageCounts
+	// ReadErrors is the amount of errors returned by Read, except for the
+	// CONNECTION_CLOSED errors returned once the connection is closed, such
+	// as after the peer's close frame.
+	ReadErrors uint64
+	// WriteErrors is the amount of errors writing to the underlying
+	// connection, including writing the write buffer and queued messages.
+	WriteErrors uint64
+	// Compression are the counters of permessage-deflate. They stay 0 for
+	// a connection that did not negotiate it (see Conn.Compression).
+	Compression CompressionStats
+}
+
+// MessageCounts are amounts of messages by type.
+type MessageCounts struct {
+	Text   uint64
+	Binary uint64
+	Close  uint64
+	Ping   uint64
+	Pong   uint64
+}
+
+// Total returns the amount of messages of every type.
+func (m MessageCounts) Total() uint64 {
+	return m.Text + m.Binary + m.Close + m.Ping + m.Pong
+}
+
+// CompressionStats are the counters of the data messages compressed with
+// permessage-deflate, to tell whether compressing them is worth the CPU.
+// The byte counts are of payloads, without frame headers.
+type CompressionStats struct {
+	// MessagesCompressed is the amount of messages written compressed.
+	// BytesBeforeCompression and BytesAfterCompression are the sizes of
+	// their payloads before and after compressing them.
+	MessagesCompressed     uint64
+	BytesBeforeCompression uint64
+	BytesAfterCompression  uint64
+	// MessagesSkipped is the amount of messages written uncompressed
+	// although compression was negotiated, because they were smaller than
+	// the compression threshold or compression was turned off for them.
+	MessagesSkipped uint64
+	// MessagesDecompressed is the amount of compressed messages read.
+	// BytesBeforeDecompression and BytesAfterDecompression are the sizes
+	// of their payloads as read and once decompressed.
+	MessagesDecompressed     uint64
+	BytesBeforeDecompression uint64
+	BytesAfterDecompression  uint64
+}
+
+// WriteRatio returns the size of the messages written compressed divided
+// by their size before compression, such as 0.25 for messages compressed
+// to a quarter of their size. It returns 1 if no message was compressed.
+func (s CompressionStats) WriteRatio() float64 {
+	return compressionRatio(s.BytesAfterCompression, s.BytesBeforeCompression)
+}
+
+// ReadRatio returns the size of the compressed messages read divided by
+// their size once decompressed. It returns 1 if no message was
+// decompressed.
+func (s CompressionStats) ReadRatio() float64 {
+	return compressionRatio(s.BytesBeforeDecompression, s.BytesAfterDecompression)
+}
+
+func compressionRatio(compressed, uncompressed uint64) float64 {
+	if uncompressed == 0 {
+		return 1
+	}
+	return float64(compressed) / float64(uncompressed)
+}
+
+// compressionCounters are the counters behind CompressionStats.
+type compressionCounters struct {
+	messagesCompressed       atomic.Uint64
+	bytesBeforeCompression   atomic.Uint64
+	bytesAfterCompression    atomic.Uint64
+	messagesSkipped          atomic.Uint64
+	messagesDecompressed     atomic.Uint64
+	bytesBeforeDecompression atomic.Uint64
+	bytesAfterDecompression  atomic.Uint64
+}
+
+func (c *compressionCounters) load() CompressionStats {
+	return CompressionStats{
+		MessagesCompressed:       c.messagesCompressed.Load(),
+		BytesBeforeCompression:   c.bytesBeforeCompression.Load(),
+		BytesAfterCompression:    c.bytesAfterCompression.Load(),
+		MessagesSkipped:          c.messagesSkipped.Load(),
+		MessagesDecompressed:     c.messagesDecompressed.Load(),
+		BytesBeforeDecompression: c.bytesBeforeDecompression.Load(),
+		BytesAfterDecompression:  c.bytesAfterDecompression.Load(),
+	}
+}
+
+// connStats are the counters behind Stats, updated with atomics so that
+// counting is cheap and does not need any of the connection's locks.
+type connStats struct {
+	bytesRead       atomic.Uint64
+	bytesWritten    atomic.Uint64
+	framesRead      atomic.Uint64
+	framesWritten   atomic.Uint64
+	messagesRead    [MessagePong + 1]atomic.Uint64 // by type
+	messagesWritten [MessagePong + 1]atomic.Uint64
+	readErrors      atomic.Uint64
+	writeErrors     atomic.Uint64
+	compression     compressionCounters
+}
+
+// Stats returns a snapshot of the counters of the connection. It may be
+// called at any time, including after the connection is closed, and is
+// cheap enough to be called for every scrape of a metrics endpoint.
+func (c *Conn) Stats() Stats {
+	s := &c.stats
+	return Stats{
+		BytesRead:       s.bytesRead.Load(),
+		BytesWritten:    s.bytesWritten.Load(),
+		FramesRead:      s.framesRead.Load(),
+		FramesWritten:   s.framesWritten.Load(),
+		MessagesRead:    loadMessageCounts(&s.messagesRead),
+		MessagesWritten: loadMessageCounts(&s.messagesWritten),
+		ReadErrors:      s.readErrors.Load(),
+		WriteErrors:     s.writeErrors.Load(),
+		Compression:     s.compression.load(),
+	}
+}
+
+func loadMessageCounts(counts *[MessagePong + 1]atomic.Uint64) MessageCounts {
+	return MessageCounts{
+		Text:   counts[MessageText].Load(),
+		Binary: counts[MessageBinary].Load(),
+		Close:  counts[MessageClose].Load(),
+		Ping:   counts[MessagePing].Load(),
+		Pong:   counts[MessagePong].Load(),
+	}
+}
+
+// countRead counts a frame read with the header specified, once its
+// payload was read, and records when it was read.
+func (c *Conn) countRead(h frameHeader) {
+	c.stats.framesRead.Add(1)
+	c.stats.bytesRead.Add(uint64(h.headerLength) + uint64(h.length))
+	c.activity.lastRead.Store(c.clock.Now().UnixNano())
+}
+
+// countMessageRead counts a message of the type specified read. Its last
+// frame was just read, so data messages and pongs are recorded as read
+// then.
+func (c *Conn) countMessageRead(messageType MessageType) {
+	if messageType <= MessagePong {
+		c.stats.messagesRead[messageType].Add(1)
+	}
+	switch messageType {
+	case MessageText, MessageBinary:
+		c.activity.lastMessage.Store(c.activity.lastRead.Load())
+	case MessagePong:
+		c.activity.lastPong.Store(c.activity.lastRead.Load())
+	}
+}
+
+// countDecompressed counts a compressed message read, with a payload of
+// before bytes that decompressed to after bytes, for the connection and,
+// if it was accepted by AcceptHTTP, for AcceptHTTPStats.
+func (c *Conn) countDecompressed(before, after int) {
+	c.stats.compression.countDecompressed(before, after)
+	if c.accepted {
+		acceptStats.compression.countDecompressed(before, after)
+	}
+}
+
+func (s *compressionCounters) countDecompressed(before, after int) {
+	s.messagesDecompressed.Add(1)
+	s.bytesBeforeDecompression.Add(uint64(before))
+	s.bytesAfterDecompression.Add(uint64(after))
+}
+
+// countCompressed counts a message written compressed, with a payload of
+// before bytes compressed to after bytes, like countDecompressed.
+func (c *Conn) countCompressed(before, after int) {
+	c.stats.compression.countCompressed(before, after)
+	if c.accepted {
+		acceptStats.compression.countCompressed(before, after)
+	}
+}
+
+func (s *compressionCounters) countCompressed(before, after int) {
+	s.messagesCompressed.Add(1)
+	s.bytesBeforeCompression.Add(uint64(before))
+	s.bytesAfterCompression.Add(uint64(after))
+}
+
+// countCompressionSkipped counts a data message written uncompressed
+// although compression was negotiated, like countDecompressed.
+func (c *Conn) countCompressionSkipped() {
+	c.stats.compression.messagesSkipped.Add(1)
+	if c.accepted {
+		acceptStats.compression.messagesSkipped.Add(1)
+	}
+}
+
+// countWrite counts a message of the type specified, with a payload of
+// payloadLength bytes, written in frames of n bytes altogether, and
+// records when it was written.
+func (c *Conn) countWrite(messageType MessageType, payloadLength, n int) {
+	frames := 1
+	if !isControl(messageType) && c.fragmentSize > 0 && payloadLength > c.fragmentSize {
+		frames = (payloadLength + c.fragmentSize - 1) / c.fragmentSize
+	}
+	c.countFramesWritten(messageType, frames, n)
+}
+
+// countFramesWritten counts the frames of a message of the type specified
+// written, n bytes in all. WriteFrame counts every frame on its own, and
+// a continuation frame does not count as a message.
+func (c *Conn) countFramesWritten(messageType MessageType, frames, n int) {
+	c.activity.lastWrite.Store(c.clock.Now().UnixNano())
+	c.stats.framesWritten.Add(uint64(frames))
+	c.stats.bytesWritten.Add(uint64(n))
+	if messageType <= MessagePong {
+		c.stats.messagesWritten[messageType].Add(1)
+	}
+}
+
+// writeError returns the error for err, returned by the underlying
+// connection for a write, and counts it.
+func (c *Conn) writeError(err error) Error {
+	c.stats.writeErrors.Add(1)
+	return errorf(CONNECTION_WRITE_ERROR, err)
+}
+
+// AcceptStats are the counters of the connections accepted by AcceptHTTP
+// across the process, returned by AcceptHTTPStats. Like Stats, they only go
+// up, except for Open.
+type AcceptStats struct {
+	// Accepted is the amount of requests AcceptHTTP accepted.
+	Accepted uint64
+	// Rejected is the amount of requests AcceptHTTP returned an error for,
+	// such as requests that are not WebSocket upgrades.
+	Rejected uint64
+	// Closed is the amount of accepted connections that were closed.
+	Closed uint64
+	// Open is the amount of accepted connections that are not closed yet.
+	Open uint64
+	// Compression are the compression counters of every accepted
+	// connection added up.
+	Compression CompressionStats
+}
+
+// acceptStats are the counters behind AcceptStats.
+var acceptStats struct {
+	accepted    atomic.Uint64
+	rejected    atomic.Uint64
+	closed      atomic.Uint64
+	compression compressionCounters
+}
+
+// AcceptHTTPStats returns a snapshot of the counters of the connections
+// accepted by AcceptHTTP. Connections created with From or Dial are not
+// counted.
+func AcceptHTTPStats() AcceptStats {
+	// closed is loaded first so that it is never more than accepted
+	closed := acceptStats.closed.Load()
+	accepted := acceptStats.accepted.Load()
+	return AcceptStats{
+		Accepted:    accepted,
+		Rejected:    acceptStats.rejected.Load(),
+		Closed:      closed,
+		Open:        accepted - closed,
+		Compression: acceptStats.compression.load(),
+	}
+}
@@ -0,0 +1,171 @@
+package websocket_test
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+func TestStats(t *testing.T) {
+	client, server := websocket.Pipe(websocket.WithWriteFragmentSize(100))
+	defer server.Close()
+
+	done := make(chan error, 1)
+	go func() {
+		for _, msg := range []*websocket.Message{
+			textMessage("hello"),
+			{Type: websocket.MessageBinary, Data: bytes.Repeat([]byte{1}, 250)},
+			{Type: websocket.MessagePing, Data: []byte("p")},
+		} {
+			if err := client.Write(msg); err != nil {
+				done <- err
+				return
+			}
+		}
+		for range 2 { // the pong, then "bye"
+			if _, err := client.Read(); err != nil {
+				done <- err
+				return
+			}
+		}
+		done <- nil
+	}()
+	for range 3 {
+		if _, err := server.Read(); err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+	}
+	if err := server.WriteText("bye"); err != nil {
+		t.Fatalf("writing: %v", err)
+	}
+	if err := <-done; err != nil {
+		t.Fatalf("exchanging messages: %v", err)
+	}
+
+	// the frames of the client are masked, so their headers are 4 bytes
+	// longer: "hello" is 2+4+5 bytes, the binary message is split into
+	// frames of 100, 100, and 50 bytes, and the ping is 2+4+1 bytes
+	sent := websocket.Stats{
+		BytesRead:       3 + 5,
+		BytesWritten:    11 + 106 + 106 + 56 + 7,
+		FramesRead:      2,
+		FramesWritten:   5,
+		MessagesRead:    websocket.MessageCounts{Text: 1, Pong: 1},
+		MessagesWritten: websocket.MessageCounts{Text: 1, Binary: 1, Ping: 1},
+	}
+	if stats := client.Stats(); stats != sent {
+		t.Fatalf("expected the stats of the client to be %+v, got %+v", sent, stats)
+	}
+	received := websocket.Stats{
+		BytesRead:       sent.BytesWritten,
+		BytesWritten:    sent.BytesRead,
+		FramesRead:      sent.FramesWritten,
+		FramesWritten:   sent.FramesRead,
+		MessagesRead:    sent.MessagesWritten,
+		MessagesWritten: sent.MessagesRead,
+	}
+	if stats := server.Stats(); stats != received {
+		t.Fatalf("expected the stats of the server to be %+v, got %+v", received, stats)
+	}
+	if total := received.MessagesRead.Total(); total != 3 {
+		t.Fatalf("expected the server to have read 3 messages in total, got %d", total)
+	}
+
+	// the connection ending is not an error
+	client.Close()
+	if _, err := server.Read(); err == nil {
+		t.Fatalf("expected reading from a closed connection to fail")
+	}
+	if stats := server.Stats(); stats.ReadErrors != 0 {
+		t.Fatalf("expected the connection ending to not be counted as a read error, got %d", stats.ReadErrors)
+	}
+}
+
+func TestStats_Errors(t *testing.T) {
+	client, server := websocket.FaultyPipe(websocket.PipeFaults{Err: errors.New("broken"), ErrorAt: 0})
+	defer client.Close()
+	defer server.Close()
+
+	if _, err := server.Read(); !errors.Is(err, websocket.ErrRead) {
+		t.Fatalf("expected a read error, got %v", err)
+	}
+	if err := client.WriteText("hello"); !errors.Is(err, websocket.ErrWrite) {
+		t.Fatalf("expected a write error, got %v", err)
+	}
+	if stats := client.Stats(); stats.WriteErrors != 1 || stats.BytesWritten != 0 || stats.MessagesWritten.Total() != 0 {
+		t.Fatalf("expected a write error and nothing written, got %+v", stats)
+	}
+	if stats := server.Stats(); stats.ReadErrors != 1 || stats.BytesRead != 0 {
+		t.Fatalf("expected a read error and nothing read, got %+v", stats)
+	}
+}
+
+func TestCompressionStats(t *testing.T) {
+	// a connection that did not negotiate compression counts nothing
+	client, server := websocket.Pipe()
+	defer client.Close()
+	defer server.Close()
+	go client.WriteText(strings.Repeat("compressible ", 100))
+	if _, err := server.Read(); err != nil {
+		t.Fatalf("reading: %v", err)
+	}
+	if _, ok := server.Compression(); ok {
+		t.Fatalf("expected compression not to be negotiated")
+	}
+	stats := server.Stats().Compression
+	if stats != (websocket.CompressionStats{}) {
+		t.Fatalf("expected no compression counters, got %+v", stats)
+	}
+	if stats.WriteRatio() != 1 || stats.ReadRatio() != 1 {
+		t.Fatalf("expected the ratios to be 1 without compression, got %v and %v", stats.WriteRatio(), stats.ReadRatio())
+	}
+
+	stats = websocket.CompressionStats{
+		MessagesCompressed:       2,
+		BytesBeforeCompression:   1000,
+		BytesAfterCompression:    250,
+		MessagesDecompressed:     1,
+		BytesBeforeDecompression: 90,
+		BytesAfterDecompression:  100,
+	}
+	if stats.WriteRatio() != 0.25 || stats.ReadRatio() != 0.9 {
+		t.Fatalf("expected the ratios to be 0.25 and 0.9, got %v and %v", stats.WriteRatio(), stats.ReadRatio())
+	}
+}
+
+func TestAcceptHTTPStats(t *testing.T) {
+	before := websocket.AcceptHTTPStats()
+
+	var conns []*websocket.Conn
+	for range 2 {
+		conn, err := websocket.AcceptHTTP(new(MockResponseWriterHijack), req)
+		if err != nil {
+			t.Fatalf("accepting: %v", err)
+		}
+		conns = append(conns, conn)
+	}
+	notWebSocket, _ := http.NewRequest("GET", "http://localhost/ws", nil)
+	if _, err := websocket.AcceptHTTP(new(MockResponseWriterHijack), notWebSocket); err == nil {
+		t.Fatalf("expected a request that is not a websocket upgrade to be rejected")
+	}
+	conns[0].Close()
+	conns[0].Close() // closing again is not counted
+	defer conns[1].Close()
+	// connections that are not accepted are not counted
+	websocket.From(&MockNetConn{}).Close()
+
+	after := websocket.AcceptHTTPStats()
+	expected := websocket.AcceptStats{
+		Accepted: before.Accepted + 2,
+		Rejected: before.Rejected + 1,
+		Closed:   before.Closed + 1,
+		Open:     before.Open + 1,
+	}
+	if after != expected {
+		t.Fatalf("expected the accept stats to be %+v, got %+v", expected, after)
+	}
+}
@@ -0,0 +1,124 @@
+package websocket
+
+import (
+	"errors"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// Stream returns a net.Conn that reads and writes the connection as a
+// stream of bytes, for tunneling a protocol that expects a net.Conn over
+// the WebSocket connection. Every Write sends a binary message. Read
+// returns the payloads of text and binary messages in order, keeping
+// whatever does not fit in the caller's buffer for the next Read, so
+// message boundaries are not preserved. Control messages are handled as
+// usual and are not returned.
+//
+// Read returns io.EOF once the peer closes the connection, and
+// net.ErrClosed once the connection is closed by Close. Close closes the
+// connection with CloseNormalClosure. Deadlines are set on the underlying
+// connection, and return an error if it is not a net.Conn. A read deadline
+// that passes in the middle of a frame closes the connection, as with
+// Conn.Read.
+//
+// The connection should not be read from directly while the stream is
+// being read from, since messages read directly are not part of the
+// stream.
+func (c *Conn) Stream() net.Conn {
+	return &stream{conn: c}
+}
+
+// stream is the net.Conn returned by Conn.Stream.
+type stream struct {
+	conn *Conn
+
+	rmx sync.Mutex
+	buf []byte // the part of the last message that has not been read yet
+}
+
+func (s *stream) Read(p []byte) (int, error) {
+	s.rmx.Lock()
+	defer s.rmx.Unlock()
+	for len(s.buf) == 0 {
+		msg, err := s.conn.Read()
+		if err != nil {
+			var ce *CloseError
+			if errors.As(err, &ce) && ce.Code != CloseAbnormalClosure {
+				return 0, io.EOF
+			}
+			if s.conn.Err() == ErrConnectionClosed { // closed by Close
+				return 0, net.ErrClosed
+			}
+			return 0, err
+		}
+		if msg.IsData() {
+			s.buf = msg.Data
+		}
+	}
+	n := copy(p, s.buf)
+	s.buf = s.buf[n:]
+	return n, nil
+}
+
+func (s *stream) Write(p []byte) (int, error) {
+	data := p
+	if s.conn.queue.Load() != nil { // queued messages are written after Write returns
+		data = append([]byte(nil), p...)
+	}
+	if err := s.conn.Write(&Message{Type: MessageBinary, Data: data}); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (s *stream) Close() error {
+	return s.conn.CloseWithCode(CloseNormalClosure, "")
+}
+
+func (s *stream) LocalAddr() net.Addr {
+	if addr := s.conn.LocalAddr(); addr != nil {
+		return addr
+	}
+	return streamAddr{}
+}
+
+func (s *stream) RemoteAddr() net.Addr {
+	if addr := s.conn.RemoteAddr(); addr != nil {
+		return addr
+	}
+	return streamAddr{}
+}
+
+func (s *stream) SetDeadline(t time.Time) error {
+	nc := s.conn.NetConn()
+	if nc == nil {
+		return errorf(DEADLINES_NOT_SUPPORTED)
+	}
+	s.conn.SetWriteDeadline(t)
+	return nc.SetDeadline(t)
+}
+
+func (s *stream) SetReadDeadline(t time.Time) error {
+	nc := s.conn.NetConn()
+	if nc == nil {
+		return errorf(DEADLINES_NOT_SUPPORTED)
+	}
+	return nc.SetReadDeadline(t)
+}
+
+func (s *stream) SetWriteDeadline(t time.Time) error {
+	nc := s.conn.NetConn()
+	if nc == nil {
+		return errorf(DEADLINES_NOT_SUPPORTED)
+	}
+	return s.conn.SetWriteDeadline(t)
+}
+
+// streamAddr is the address of a stream whose underlying connection is not
+// a net.Conn.
+type streamAddr struct{}
+
+func (streamAddr) Network() string { return "websocket" }
+func (streamAddr) String() string  { return "websocket" }
@@ -0,0 +1,135 @@
+package websocket_test
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+func TestStream_Copy(t *testing.T) {
+	a, b := pipe()
+	sa, sb := a.Stream(), b.Stream()
+
+	// a sends more data than b sends, so a finishes writing last
+	aData := make([]byte, 300<<10)
+	bData := make([]byte, 200<<10)
+	rand.Read(aData)
+	rand.Read(bData)
+
+	type result struct {
+		sum [32]byte
+		err error
+	}
+	receive := func(s net.Conn) chan result {
+		ch := make(chan result, 1)
+		go func() {
+			h := sha256.New()
+			_, err := io.Copy(h, s)
+			var r result
+			copy(r.sum[:], h.Sum(nil))
+			r.err = err
+			ch <- r
+		}()
+		return ch
+	}
+	atB := receive(sb)
+	atA := receive(sa)
+
+	errs := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(sa, bytes.NewReader(aData))
+		errs <- err
+	}()
+	go func() {
+		_, err := io.Copy(sb, bytes.NewReader(bData))
+		errs <- err
+	}()
+	for range 2 {
+		if err := <-errs; err != nil {
+			t.Fatalf("expected no error copying to the stream, got %v", err)
+		}
+	}
+
+	// b has received everything once a's copy is done, since writes on a
+	// pipe wait for the reader
+	sa.Close()
+	for _, check := range []struct {
+		ch       chan result
+		expected []byte
+	}{{atB, aData}, {atA, bData}} {
+		select {
+		case r := <-check.ch:
+			// the side that closed may still be reading when it closes
+			if r.err != nil && !errors.Is(r.err, net.ErrClosed) {
+				t.Fatalf("expected io.Copy() to end with io.EOF or net.ErrClosed, got %v", r.err)
+			}
+			if r.sum != sha256.Sum256(check.expected) {
+				t.Fatalf("expected the received data to match the data sent")
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected the copy to finish")
+		}
+	}
+}
+
+func TestStream_ReadBuffer(t *testing.T) {
+	mockConn := new(MockNetConn)
+	writer := websocket.From(mockConn, websocket.WithRole(websocket.RoleClient))
+	writer.Write(&websocket.Message{Type: websocket.MessageBinary, Data: []byte("hello world")})
+	writer.Write(&websocket.Message{Type: websocket.MessagePong, Data: []byte("ignored")})
+	writer.Write(&websocket.Message{Type: websocket.MessageText, Data: []byte("!")})
+	writer.Write(&websocket.Message{Type: websocket.MessageClose, Data: websocket.FormatCloseMessage(websocket.CloseNormalClosure, "")})
+
+	s := websocket.From(mockConn).Stream()
+	buf := make([]byte, 4)
+	var got []byte
+	for {
+		n, err := s.Read(buf)
+		got = append(got, buf[:n]...)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatalf("expected no error from Read(), got %v", err)
+		}
+		if n > len(buf) {
+			t.Fatalf("expected Read() to fill at most the buffer")
+		}
+	}
+	if string(got) != "hello world!" {
+		t.Fatalf("expected \"hello world!\", got %q", got)
+	}
+}
+
+func TestStream_Addr(t *testing.T) {
+	a, b := net.Pipe()
+	s := websocket.From(a).Stream()
+	defer s.Close()
+	defer b.Close() // closed first so the close frame is not waited on
+	if s.LocalAddr() != a.LocalAddr() || s.RemoteAddr() != a.RemoteAddr() {
+		t.Fatalf("expected the addresses of the underlying connection")
+	}
+	if err := s.SetReadDeadline(time.Now().Add(10 * time.Millisecond)); err != nil {
+		t.Fatalf("expected no error setting a deadline, got %v", err)
+	}
+	_, err := s.Read(make([]byte, 1))
+	if !errors.Is(err, os.ErrDeadlineExceeded) {
+		t.Fatalf("expected the read deadline to be passed through, got %v", err)
+	}
+
+	s = websocket.From(BrokenConn{}).Stream()
+	if s.RemoteAddr() == nil || s.LocalAddr() == nil {
+		t.Fatalf("expected non-nil addresses")
+	}
+	if err := s.SetDeadline(time.Now()); !errors.Is(err, websocket.ErrDeadlinesNotSupported) {
+		t.Fatalf("expected DEADLINES_NOT_SUPPORTED error, got %v", err)
+	}
+}
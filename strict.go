@@ -0,0 +1,71 @@
+package websocket
+
+// StrictMode is the set of checks of RFC 6455 a Conn enforces on what it
+// reads. Each check rejects a peer that violates the protocol, closing
+// the connection with the close code of the violation; talking to
+// one that violates it harmlessly, such as old embedded firmware, needs
+// the check off. See WithStrictMode.
+type StrictMode struct {
+	// Masking requires the frames read by a server to be masked, and the
+	// frames read by a client to not be. Read returns a MALFORMED_FRAME
+	// error for a frame that is not.
+	Masking bool
+	// MinimalLength requires the payload length of the frames read to be
+	// encoded in the fewest bytes, such as a 100 byte payload not using a
+	// 16 bit extended length. Read returns a MALFORMED_FRAME error for a
+	// frame whose length is not.
+	MinimalLength bool
+	// CloseCodes requires the close frames read to have a code that may be
+	// sent and a reason that is valid UTF-8. Read returns a MALFORMED_FRAME
+	// error for a close frame that does not, and it is answered with
+	// CloseProtocolError. Without the check, the code and the reason are
+	// reported as they are, and a code that may not be sent is answered
+	// with CloseNormalClosure.
+	CloseCodes bool
+	// UTF8 requires the text messages read to be valid UTF-8. Read returns
+	// an INVALID_UTF8 error for a message that is not, and the connection is
+	// closed with CloseInvalidFramePayloadData.
+	UTF8 bool
+}
+
+var (
+	// Strict is the StrictMode with every check. It should not be
+	// modified.
+	Strict = StrictMode{Masking: true, MinimalLength: true, CloseCodes: true, UTF8: true}
+	// Lenient is the StrictMode without any check. It should not be
+	// modified.
+	Lenient = StrictMode{}
+)
+
+// WithStrictMode sets the checks the Conn enforces on what it reads, such
+// as Strict or Lenient, or either with some checks changed:
+//
+//	mode := websocket.Strict
+//	mode.MinimalLength = false // for a peer that always uses a 64 bit length
+//	conn := websocket.From(rwc, websocket.WithStrictMode(mode))
+//
+// A server defaults to Strict, and a client to Lenient, since a client
+// usually does not choose the server it talks to. The payloads the Conn
+// writes are always valid, except for text messages, see
+// SetValidateOutgoingText.
+func WithStrictMode(mode StrictMode) Option {
+	return func(c *Conn) {
+		c.strict = mode
+		c.strictSet = true
+	}
+}
+
+// checkStrictHeader returns a MALFORMED_FRAME error if the header of a
+// frame read fails the masking or minimal length checks of the Conn.
+func (c *Conn) checkStrictHeader(h *frameHeader) Error {
+	if c.strict.Masking && h.masked != (c.role == RoleServer) {
+		if c.role == RoleServer {
+			return errorf(MALFORMED_FRAME, "the frames of a client must be masked")
+		}
+		return errorf(MALFORMED_FRAME, "the frames of a server must not be masked")
+	}
+	if c.strict.MinimalLength && !h.minimalLength() {
+		return errorf(MALFORMED_FRAME, "payload length is not encoded in the fewest bytes")
+	}
+	return nil
+}
@@ -0,0 +1,145 @@
+package websocket_test
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"net"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// strictFrame returns an encoded final frame with the opcode and payload
+// specified, masked with a fixed key if masked is true.
+func strictFrame(opcode byte, payload []byte, masked bool) []byte {
+	f := websocket.Frame{Fin: true, Opcode: opcode, Masked: masked, MaskKey: [4]byte{1, 2, 3, 4}, Payload: payload}
+	return f.AppendMarshal(nil)
+}
+
+func TestWithStrictMode(t *testing.T) {
+	closeFrame := func(code uint16, reason string) []byte {
+		return strictFrame(0x8, append(binary.BigEndian.AppendUint16(nil, code), reason...), true)
+	}
+	for _, test := range []struct {
+		name  string
+		role  websocket.Role
+		frame []byte
+		// the outcome in strict mode: the error kind of Read and the code
+		// the connection is closed with, if any
+		kind websocket.Kind
+		code uint16
+		// the outcome in lenient mode: the message read, or the close code
+		// read and the code it is answered with
+		lenientData string
+		lenientCode uint16
+		reply       uint16
+	}{
+		{name: "unmasked frame read by a server", role: websocket.RoleServer, frame: strictFrame(0x1, []byte("hi"), false),
+			kind: websocket.MALFORMED_FRAME, code: websocket.CloseProtocolError, lenientData: "hi"},
+		{name: "masked frame read by a client", role: websocket.RoleClient, frame: strictFrame(0x1, []byte("hi"), true),
+			kind: websocket.MALFORMED_FRAME, code: websocket.CloseProtocolError, lenientData: "hi"},
+		{name: "length not minimally encoded", role: websocket.RoleClient, frame: []byte{0x81, 126, 0, 2, 'h', 'i'},
+			kind: websocket.MALFORMED_FRAME, code: websocket.CloseProtocolError, lenientData: "hi"},
+		{name: "64 bit length not minimally encoded", role: websocket.RoleClient, frame: []byte{0x81, 127, 0, 0, 0, 0, 0, 0, 0, 2, 'h', 'i'},
+			kind: websocket.MALFORMED_FRAME, code: websocket.CloseProtocolError, lenientData: "hi"},
+		{name: "invalid UTF-8", role: websocket.RoleServer, frame: strictFrame(0x1, []byte{'h', 0xff}, true),
+			kind: websocket.INVALID_UTF8, code: websocket.CloseInvalidFramePayloadData, lenientData: "h\xff"},
+		{name: "close code that may not be sent", role: websocket.RoleServer, frame: closeFrame(1006, ""),
+			kind: websocket.MALFORMED_FRAME, code: websocket.CloseProtocolError, lenientCode: 1006, reply: websocket.CloseNormalClosure},
+		{name: "close reason not UTF-8", role: websocket.RoleServer, frame: closeFrame(1000, "\xff"),
+			kind: websocket.MALFORMED_FRAME, code: websocket.CloseProtocolError, lenientCode: 1000, reply: websocket.CloseNormalClosure},
+	} {
+		t.Run(test.name, func(t *testing.T) {
+			for _, strict := range []bool{true, false} {
+				mode := websocket.Lenient
+				if strict {
+					mode = websocket.Strict
+				}
+				msg, err, reply := readStrict(t, test.role, mode, test.frame)
+				switch {
+				case strict:
+					if err == nil || err.Kind() != test.kind {
+						t.Fatalf("expected a %s error in strict mode, got %v", test.kind, err)
+					}
+					if reply != test.code {
+						t.Fatalf("expected the connection to be closed with %d in strict mode, got %d", test.code, reply)
+					}
+				case test.lenientCode != 0:
+					if !websocket.IsCloseError(err, int(test.lenientCode)) || reply != test.reply {
+						t.Fatalf("expected close code %d answered with %d in lenient mode, got %v and %d", test.lenientCode, test.reply, err, reply)
+					}
+				default:
+					if err != nil || string(msg.Data) != test.lenientData {
+						t.Fatalf("expected %q in lenient mode, got %v (%v)", test.lenientData, msg, err)
+					}
+				}
+			}
+		})
+	}
+}
+
+// readStrict reads frame with a Conn with the role and mode specified, and
+// returns what Read returns and the code of the close frame the Conn wrote
+// in response, or 0 if it did not write one.
+func readStrict(t *testing.T, role websocket.Role, mode websocket.StrictMode, frame []byte) (*websocket.Message, websocket.Error, uint16) {
+	t.Helper()
+	a, b := net.Pipe()
+	defer b.Close()
+	conn := websocket.From(a, websocket.WithRole(role), websocket.WithStrictMode(mode))
+	go b.Write(frame)
+	replies := make(chan uint16, 1)
+	go func() {
+		f, err := websocket.ParseFrame(b)
+		if err != nil || f.Opcode != 0x8 || len(f.Payload) < 2 {
+			replies <- 0
+			return
+		}
+		replies <- binary.BigEndian.Uint16(f.Payload)
+	}()
+	msg, err := conn.Read()
+	conn.Close()
+	return msg, err, <-replies
+}
+
+func TestWithStrictMode_Defaults(t *testing.T) {
+	unmasked := strictFrame(0x1, []byte("hi"), false)
+	masked := strictFrame(0x1, []byte("hi"), true)
+	for _, test := range []struct {
+		name  string
+		opts  []websocket.Option
+		frame []byte
+		fails bool
+	}{
+		{"server", nil, unmasked, true},
+		{"client", []websocket.Option{websocket.WithRole(websocket.RoleClient)}, masked, false},
+		// the mode is not reset by the role set after it
+		{"lenient server", []websocket.Option{websocket.WithStrictMode(websocket.Lenient), websocket.WithRole(websocket.RoleServer)}, unmasked, false},
+		{"strict client", []websocket.Option{websocket.WithStrictMode(websocket.Strict), websocket.WithRole(websocket.RoleClient)}, masked, true},
+	} {
+		a, b := net.Pipe()
+		conn := websocket.From(a, test.opts...)
+		go b.Write(test.frame)
+		go io.Copy(io.Discard, b)
+		_, err := conn.Read()
+		if fails := errors.Is(err, websocket.ErrMalformedFrame); fails != test.fails {
+			t.Fatalf("expected the %s to fail to read the frame: %t, got %v", test.name, test.fails, err)
+		}
+		conn.Close()
+		b.Close()
+	}
+}
+
+func TestWithStrictMode_Override(t *testing.T) {
+	// a single check can be turned off, leaving the others on
+	mode := websocket.Strict
+	mode.Masking = false
+	msg, err, _ := readStrict(t, websocket.RoleServer, mode, strictFrame(0x1, []byte("hi"), false))
+	if err != nil || string(msg.Data) != "hi" {
+		t.Fatalf("expected the unmasked frame to be read, got %v", err)
+	}
+	_, err, reply := readStrict(t, websocket.RoleServer, mode, strictFrame(0x1, []byte{0xff}, false))
+	if !errors.Is(err, websocket.ErrInvalidUTF8) || reply != websocket.CloseInvalidFramePayloadData {
+		t.Fatalf("expected the invalid text message to be rejected, got %v and %d", err, reply)
+	}
+}
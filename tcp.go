@@ -0,0 +1,133 @@
+package websocket
+
+import (
+	"crypto/tls"
+	"net"
+	"time"
+)
+
+// tcpConn returns the TCP connection under the connection, looking through
+// TLS and the wrappers of the package, or a NOT_TCP error if there is none.
+func (c *Conn) tcpConn() (*net.TCPConn, Error) {
+	nc := c.NetConn()
+	for {
+		switch conn := nc.(type) {
+		case *net.TCPConn:
+			return conn, nil
+		case *tls.Conn:
+			nc = conn.NetConn()
+		case *bufferedConn:
+			nc = conn.Conn
+		case *wireLogConn:
+			nc = conn.Conn
+		default:
+			return nil, errorf(NOT_TCP)
+		}
+	}
+}
+
+// SetTCPNoDelay sets whether the operating system delays the segments of
+// the underlying TCP connection to send fewer of them (Nagle's algorithm).
+// Go turns the delay off for every TCP connection, so that small messages
+// are sent right away; turning it on trades latency for fewer segments.
+// It returns a NOT_TCP error if the underlying connection is not a TCP
+// connection, directly or under TLS.
+func (c *Conn) SetTCPNoDelay(noDelay bool) Error {
+	tc, err := c.tcpConn()
+	if err != nil {
+		return err
+	}
+	if err := tc.SetNoDelay(noDelay); err != nil {
+		return errorf(SOCKET_OPTION_FAILED, err)
+	}
+	return nil
+}
+
+// SetTCPKeepAlive makes the operating system send TCP keep-alive probes
+// on the underlying TCP connection once it has been idle for period, so
+// that a peer that went away is noticed even if nothing is written. A
+// period of 0 or less turns the probes off. TCP keep-alives are cheaper
+// than WebSocket pings, but go no further than the first proxy; see
+// EnableKeepalive for pings. It returns a NOT_TCP error if the underlying
+// connection is not a TCP connection.
+func (c *Conn) SetTCPKeepAlive(period time.Duration) Error {
+	tc, err := c.tcpConn()
+	if err != nil {
+		return err
+	}
+	if err := tc.SetKeepAlive(period > 0); err != nil {
+		return errorf(SOCKET_OPTION_FAILED, err)
+	}
+	if period > 0 {
+		if err := tc.SetKeepAlivePeriod(period); err != nil {
+			return errorf(SOCKET_OPTION_FAILED, err)
+		}
+	}
+	return nil
+}
+
+// SetSocketBuffers sets the sizes in bytes of the buffers the operating
+// system keeps for reading from and writing to the underlying TCP
+// connection. Larger buffers let a connection with a high bandwidth and
+// latency keep more data in flight. A size of 0 or less leaves that buffer
+// as it is. The operating system may round the sizes or cap them. It
+// returns a NOT_TCP error if the underlying connection is not a TCP
+// connection.
+func (c *Conn) SetSocketBuffers(read, write int) Error {
+	tc, err := c.tcpConn()
+	if err != nil {
+		return err
+	}
+	if read > 0 {
+		if err := tc.SetReadBuffer(read); err != nil {
+			return errorf(SOCKET_OPTION_FAILED, err)
+		}
+	}
+	if write > 0 {
+		if err := tc.SetWriteBuffer(write); err != nil {
+			return errorf(SOCKET_OPTION_FAILED, err)
+		}
+	}
+	return nil
+}
+
+// WithTCPNoDelay calls SetTCPNoDelay when the Conn is created, such as by
+// AcceptHTTP or Dial. Like the other TCP options, an error is logged
+// instead of returned, including when the connection is not a TCP
+// connection.
+func WithTCPNoDelay(noDelay bool) Option {
+	return func(c *Conn) {
+		c.tcpOptions = append(c.tcpOptions, func(c *Conn) Error {
+			return c.SetTCPNoDelay(noDelay)
+		})
+	}
+}
+
+// WithTCPKeepAlive calls SetTCPKeepAlive when the Conn is created.
+func WithTCPKeepAlive(period time.Duration) Option {
+	return func(c *Conn) {
+		c.tcpOptions = append(c.tcpOptions, func(c *Conn) Error {
+			return c.SetTCPKeepAlive(period)
+		})
+	}
+}
+
+// WithSocketBuffers calls SetSocketBuffers when the Conn is created.
+func WithSocketBuffers(read, write int) Option {
+	return func(c *Conn) {
+		c.tcpOptions = append(c.tcpOptions, func(c *Conn) Error {
+			return c.SetSocketBuffers(read, write)
+		})
+	}
+}
+
+// applyTCPOptions applies the TCP options of the Conn, logging the ones
+// that fail. It is called by From once the options are applied.
+func (c *Conn) applyTCPOptions() {
+	for _, apply := range c.tcpOptions {
+		if err := apply(c); err != nil {
+			c.logger.Warn("an error occured while setting a tcp option", "error", err.Error())
+		}
+	}
+	c.tcpOptions = nil
+}
@@ -0,0 +1,108 @@
+package websocket_test
+
+import (
+	"crypto/tls"
+	"errors"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// tcpPair returns the two ends of a localhost TCP connection.
+func tcpPair(t *testing.T) (net.Conn, net.Conn) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("listening: %v", err)
+	}
+	defer ln.Close()
+	dialed, err := net.Dial("tcp", ln.Addr().String())
+	if err != nil {
+		t.Fatalf("dialing: %v", err)
+	}
+	accepted, err := ln.Accept()
+	if err != nil {
+		t.Fatalf("accepting: %v", err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+func TestTCPOptions(t *testing.T) {
+	dialed, accepted := tcpPair(t)
+	conns := map[string]*websocket.Conn{
+		"TCP":      websocket.From(accepted),
+		"TLS":      websocket.From(tls.Client(dialed, &tls.Config{InsecureSkipVerify: true})),
+		"wire log": websocket.From(dialed, websocket.WithWireLog(new(syncBuffer))),
+	}
+	for name, conn := range conns {
+		t.Run(name, func(t *testing.T) {
+			if err := conn.SetTCPNoDelay(true); err != nil {
+				t.Fatalf("SetTCPNoDelay: %v", err)
+			}
+			if err := conn.SetTCPKeepAlive(30 * time.Second); err != nil {
+				t.Fatalf("SetTCPKeepAlive: %v", err)
+			}
+			if err := conn.SetTCPKeepAlive(0); err != nil {
+				t.Fatalf("SetTCPKeepAlive(0): %v", err)
+			}
+			if err := conn.SetSocketBuffers(1<<20, 1<<20); err != nil {
+				t.Fatalf("SetSocketBuffers: %v", err)
+			}
+			if err := conn.SetSocketBuffers(0, 0); err != nil {
+				t.Fatalf("SetSocketBuffers(0, 0): %v", err)
+			}
+		})
+	}
+}
+
+func TestTCPOptions_NotTCP(t *testing.T) {
+	client, server := websocket.Pipe()
+	defer client.Close()
+	defer server.Close()
+	for name, err := range map[string]websocket.Error{
+		"SetTCPNoDelay":    server.SetTCPNoDelay(true),
+		"SetTCPKeepAlive":  server.SetTCPKeepAlive(time.Second),
+		"SetSocketBuffers": server.SetSocketBuffers(1024, 1024),
+	} {
+		if !errors.Is(err, websocket.ErrNotTCP) {
+			t.Fatalf("expected %s to return a NOT_TCP error, got %v", name, err)
+		}
+	}
+	conn := websocket.From(new(CountingConn))
+	if err := conn.SetTCPNoDelay(true); !errors.Is(err, websocket.ErrNotTCP) {
+		t.Fatalf("expected a NOT_TCP error for a connection that is not a net.Conn, got %v", err)
+	}
+}
+
+func TestWithTCPOptions(t *testing.T) {
+	opts := []websocket.Option{
+		websocket.WithTCPNoDelay(true),
+		websocket.WithTCPKeepAlive(time.Minute),
+		websocket.WithSocketBuffers(1<<20, 1<<20),
+	}
+	dialed, _ := tcpPair(t)
+	h := NewRecordingHandler()
+	conn := websocket.From(dialed, append(opts, websocket.WithLogger(slog.New(h)))...)
+	defer conn.Close()
+	if records := h.Records(); len(records) != 0 {
+		t.Fatalf("expected the options to be applied without errors, got %v", records)
+	}
+
+	// the options are logged for connections that are not TCP
+	a, b := net.Pipe()
+	defer b.Close()
+	h = NewRecordingHandler()
+	conn = websocket.From(a, append(opts, websocket.WithLogger(slog.New(h)))...)
+	defer conn.Close()
+	records := h.Records()
+	if len(records) != 3 || records[0]["error"] != string(websocket.NOT_TCP) {
+		t.Fatalf("expected every option to log a NOT_TCP error, got %v", records)
+	}
+}
@@ -0,0 +1,117 @@
+package websocket
+
+import (
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+)
+
+// wireLogLimit is the maximum amount of bytes of a chunk read or written
+// that is dumped by the wire log. The rest of the chunk is only counted.
+const wireLogLimit = 256
+
+// WithWireLog makes the Conn write a dump of every chunk of bytes read from
+// and written to the underlying connection to w, for debugging what
+// crosses the wire, such as frames corrupted by a proxy. Every chunk is
+// dumped as a line with the time, the ID of the connection, the direction,
+// and the amount of bytes, followed by a hex and ASCII dump like the one of
+// hex.Dump of its first 256 bytes:
+//
+//	2024-05-01T10:00:00.000000Z conn 1 write 7 bytes
+//	00000000  81 05 68 65 6c 6c 6f                              |..hello|
+//
+// Errors of the underlying connection are dumped too. Dumps of concurrent
+// reads and writes are not interleaved, but w should not block, since it
+// holds up reading and writing. Since the dump is of the chunks read and
+// written, the frames read through a buffer (see WithReadBufferSize) are
+// dumped as the buffer is filled, and large frames are cut short.
+//
+// The underlying connection is wrapped to dump its bytes, so it is still
+// returned by NetConn if it is a net.Conn, but writes are never vectored.
+// The wire log is off by default, and costs nothing then.
+func WithWireLog(w io.Writer) Option {
+	return func(c *Conn) {
+		c.wireLog = w
+	}
+}
+
+// wireLogger dumps the chunks read from and written to a connection.
+type wireLogger struct {
+	id uint64
+
+	mx sync.Mutex
+	w  io.Writer
+}
+
+// dump dumps a chunk of bytes of the direction specified, and err if it is
+// not nil.
+func (l *wireLogger) dump(direction string, p []byte, err error) {
+	l.mx.Lock()
+	defer l.mx.Unlock()
+	now := time.Now().UTC().Format("2006-01-02T15:04:05.000000Z")
+	if len(p) > 0 {
+		fmt.Fprintf(l.w, "%s conn %d %s %d bytes\n", now, l.id, direction, len(p))
+		io.WriteString(l.w, hex.Dump(p[:min(len(p), wireLogLimit)]))
+		if len(p) > wireLogLimit {
+			fmt.Fprintf(l.w, "... %d more bytes\n", len(p)-wireLogLimit)
+		}
+	}
+	if err != nil {
+		fmt.Fprintf(l.w, "%s conn %d %s error: %v\n", now, l.id, direction, err)
+	}
+}
+
+// wireLogRWC is an io.ReadWriteCloser dumping what is read from and written
+// to the io.ReadWriteCloser it wraps.
+type wireLogRWC struct {
+	io.ReadWriteCloser
+	log *wireLogger
+}
+
+func (c *wireLogRWC) Read(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Read(p)
+	c.log.dump("read", p[:n], err)
+	return n, err
+}
+
+func (c *wireLogRWC) Write(p []byte) (int, error) {
+	n, err := c.ReadWriteCloser.Write(p)
+	c.log.dump("write", p[:n], err)
+	return n, err
+}
+
+// wireLogConn is a net.Conn dumping what is read from and written to the
+// net.Conn it wraps.
+type wireLogConn struct {
+	net.Conn
+	log *wireLogger
+}
+
+func (c *wireLogConn) Read(p []byte) (int, error) {
+	n, err := c.Conn.Read(p)
+	c.log.dump("read", p[:n], err)
+	return n, err
+}
+
+func (c *wireLogConn) Write(p []byte) (int, error) {
+	n, err := c.Conn.Write(p)
+	c.log.dump("write", p[:n], err)
+	return n, err
+}
+
+// wrapWireLog wraps the underlying connection to dump what is read from and
+// written to it to the wire log, and makes the reader read from it. It is
+// called by From once the options are applied, before the read buffer is
+// set up.
+func (c *Conn) wrapWireLog() {
+	log := &wireLogger{id: c.id, w: c.wireLog}
+	if nc, ok := c.underlying.(net.Conn); ok {
+		c.underlying = &wireLogConn{Conn: nc, log: log}
+	} else {
+		c.underlying = &wireLogRWC{ReadWriteCloser: c.underlying, log: log}
+	}
+	c.reader = c.underlying
+}
@@ -0,0 +1,77 @@
+package websocket_test
+
+import (
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// syncBuffer is a bytes.Buffer that is safe to use concurrently.
+type syncBuffer struct {
+	mx  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.mx.Lock()
+	defer b.mx.Unlock()
+	return b.buf.String()
+}
+
+func TestWithWireLog(t *testing.T) {
+	for _, opts := range [][]websocket.Option{nil, {websocket.WithReadBufferSize(1024)}} {
+		var log syncBuffer
+		a, b := net.Pipe()
+		client := websocket.From(a, websocket.WithRole(websocket.RoleClient))
+		server := websocket.From(b, append(opts, websocket.WithWireLog(&log))...)
+		if server.NetConn() == nil {
+			t.Fatalf("expected the wrapped connection to still be a net.Conn")
+		}
+
+		go server.WriteText("hello")
+		if msg, err := client.Read(); err != nil || string(msg.Data) != "hello" {
+			t.Fatalf("expected to read hello, got %v and %v", msg, err)
+		}
+		// a frame of 304 bytes, cut short
+		go server.Write(&websocket.Message{Type: websocket.MessageBinary, Data: make([]byte, 300)})
+		if _, err := client.Read(); err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+		go client.WriteText("hi")
+		if _, err := server.Read(); err != nil {
+			t.Fatalf("reading: %v", err)
+		}
+		client.Close()
+		server.Read()
+		server.Close()
+
+		dump := log.String()
+		for _, expected := range []string{
+			fmt.Sprintf("Z conn %d write 7 bytes\n", server.ID()),
+			"00000000  81 05 68 65 6c 6c 6f                              |..hello|\n",
+			"write 304 bytes\n",
+			"00000000  82 7e 01 2c 00 00",
+			"... 48 more bytes\n",
+			"read error: EOF\n",
+		} {
+			if !strings.Contains(dump, expected) {
+				t.Fatalf("expected the dump to contain %q, got:\n%s", expected, dump)
+			}
+		}
+		// the frame of the client is masked, so only its header is known
+		if !strings.Contains(dump, "00000000  81 82") {
+			t.Fatalf("expected the dump to contain the header of the frame read, got:\n%s", dump)
+		}
+	}
+}
@@ -0,0 +1,77 @@
+package websocket
+
+import (
+	"time"
+)
+
+// SetWriteBuffer enables buffered writes. Frames are collected in a buffer
+// of n bytes and written to the underlying connection together when the
+// buffer fills, when Flush is called, when the flush latency passes, or
+// when a control frame is written. Frames that do not fit in the buffer
+// by themselves are written directly.
+//
+// A size of 0 disables buffering (the default) after flushing anything
+// that is currently buffered.
+func (c *Conn) SetWriteBuffer(n int) Error {
+	c.wmx.Lock()
+	defer c.wmx.Unlock()
+	if n < 0 {
+		n = 0
+	}
+	if len(c.wbuf) > n {
+		if err := c.flush(); err != nil {
+			return err
+		}
+	}
+	c.wbufSize = n
+	if n == 0 {
+		c.wbuf = nil
+	} else if cap(c.wbuf) < n {
+		wbuf := make([]byte, len(c.wbuf), n)
+		copy(wbuf, c.wbuf)
+		c.wbuf = wbuf
+	}
+	return nil
+}
+
+// SetFlushLatency sets the maximum amount of time a frame may wait in the
+// write buffer before it is flushed. A duration of 0 (the default) means
+// buffered frames are only written when the buffer fills or Flush is called.
+func (c *Conn) SetFlushLatency(d time.Duration) {
+	c.wmx.Lock()
+	defer c.wmx.Unlock()
+	c.flushLatency = d
+}
+
+// Flush writes any buffered frames to the underlying connection.
+func (c *Conn) Flush() Error {
+	c.wmx.Lock()
+	defer c.wmx.Unlock()
+	return c.flush()
+}
+
+// flush writes the write buffer to the underlying connection. The write
+// mutex must be held.
+func (c *Conn) flush() Error {
+	if c.flushTimer != nil {
+		c.flushTimer.Stop()
+		c.flushTimer = nil
+	}
+	if len(c.wbuf) == 0 {
+		return nil
+	}
+	err := c.writeUnderlying(c.wbuf)
+	c.wbuf = c.wbuf[:0]
+	return err
+}
+
+// flushAfterLatency is called by the flush timer once the flush latency
+// has passed.
+func (c *Conn) flushAfterLatency() {
+	c.wmx.Lock()
+	defer c.wmx.Unlock()
+	c.flushTimer = nil
+	if err := c.flush(); err != nil {
+		c.logger.Error("an error occured while flushing the write buffer", "error", err.Error())
+	}
+}
@@ -0,0 +1,156 @@
+package websocket_test
+
+import (
+	"bytes"
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// CountingConn is an io.ReadWriteCloser that records every write made to it.
+// If discard is set, the written bytes are only counted.
+type CountingConn struct {
+	mutex   sync.Mutex
+	buf     bytes.Buffer
+	writes  int
+	discard bool
+}
+
+func (m *CountingConn) Read(p []byte) (int, error) {
+	return 0, io.EOF
+}
+
+func (m *CountingConn) Write(p []byte) (int, error) {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	m.writes++
+	if m.discard {
+		return len(p), nil
+	}
+	return m.buf.Write(p)
+}
+
+func (m *CountingConn) Close() error {
+	return nil
+}
+
+func (m *CountingConn) Writes() int {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return m.writes
+}
+
+func (m *CountingConn) Bytes() []byte {
+	m.mutex.Lock()
+	defer m.mutex.Unlock()
+	return bytes.Clone(m.buf.Bytes())
+}
+
+func TestWriteBuffer_Flush(t *testing.T) {
+	mockConn := new(CountingConn)
+	conn := websocket.From(mockConn)
+	conn.SetWriteBuffer(1024)
+
+	for range 10 {
+		if err := conn.Write(textMessage("hello")); err != nil {
+			t.Fatalf("expected no error from Write(), got %v", err)
+		}
+	}
+	if mockConn.Writes() != 0 {
+		t.Fatalf("expected no writes before Flush(), got %d", mockConn.Writes())
+	}
+	if err := conn.Flush(); err != nil {
+		t.Fatalf("expected no error from Flush(), got %v", err)
+	}
+	if mockConn.Writes() != 1 {
+		t.Fatalf("expected 1 write after Flush(), got %d", mockConn.Writes())
+	}
+
+	expected := bytes.Repeat([]byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o'}, 10)
+	if !bytes.Equal(mockConn.Bytes(), expected) {
+		t.Fatalf("expected %v, got %v", expected, mockConn.Bytes())
+	}
+}
+
+func TestWriteBuffer_Full(t *testing.T) {
+	mockConn := new(CountingConn)
+	conn := websocket.From(mockConn)
+	conn.SetWriteBuffer(16) // fits two 7 byte frames
+
+	for range 3 {
+		conn.Write(textMessage("hello"))
+	}
+	if mockConn.Writes() != 1 {
+		t.Fatalf("expected the full buffer to be written once, got %d writes", mockConn.Writes())
+	}
+	if len(mockConn.Bytes()) != 14 {
+		t.Fatalf("expected 14 bytes written, got %d", len(mockConn.Bytes()))
+	}
+
+	// frames larger than the buffer are written directly
+	conn.Write(textMessage("this frame is larger than the buffer"))
+	if mockConn.Writes() != 3 {
+		t.Fatalf("expected 3 writes, got %d", mockConn.Writes())
+	}
+}
+
+func TestWriteBuffer_ControlFrameFlushes(t *testing.T) {
+	mockConn := new(CountingConn)
+	conn := websocket.From(mockConn)
+	conn.SetWriteBuffer(1024)
+
+	conn.Write(textMessage("hello"))
+	conn.Write(&websocket.Message{Type: websocket.MessagePong, Data: []byte{}})
+	if mockConn.Writes() != 1 {
+		t.Fatalf("expected the control frame to flush the buffer, got %d writes", mockConn.Writes())
+	}
+	expected := []byte{0x81, 0x05, 'h', 'e', 'l', 'l', 'o', 0x8A, 0x00}
+	if !bytes.Equal(mockConn.Bytes(), expected) {
+		t.Fatalf("expected %v, got %v", expected, mockConn.Bytes())
+	}
+}
+
+func TestWriteBuffer_FlushLatency(t *testing.T) {
+	mockConn := new(CountingConn)
+	conn := websocket.From(mockConn)
+	conn.SetWriteBuffer(1024)
+	conn.SetFlushLatency(10 * time.Millisecond)
+
+	conn.Write(textMessage("hello"))
+	conn.Write(textMessage("hello"))
+	waitFor(t, time.Second, func() bool { return mockConn.Writes() == 1 })
+	if len(mockConn.Bytes()) != 14 {
+		t.Fatalf("expected 14 bytes written, got %d", len(mockConn.Bytes()))
+	}
+}
+
+func TestWriteBuffer_CloseFlushes(t *testing.T) {
+	mockConn := new(CountingConn)
+	conn := websocket.From(mockConn)
+	conn.SetWriteBuffer(1024)
+
+	conn.Write(textMessage("hello"))
+	conn.Close()
+	if mockConn.Writes() != 1 {
+		t.Fatalf("expected Close() to flush the buffer, got %d writes", mockConn.Writes())
+	}
+}
+
+func TestWriteBuffer_Disable(t *testing.T) {
+	mockConn := new(CountingConn)
+	conn := websocket.From(mockConn)
+	conn.SetWriteBuffer(1024)
+
+	conn.Write(textMessage("hello"))
+	conn.SetWriteBuffer(0)
+	if mockConn.Writes() != 1 {
+		t.Fatalf("expected disabling the buffer to flush it, got %d writes", mockConn.Writes())
+	}
+	conn.Write(textMessage("hello"))
+	if mockConn.Writes() != 2 {
+		t.Fatalf("expected an unbuffered write, got %d writes", mockConn.Writes())
+	}
+}
@@ -0,0 +1,256 @@
+package websocket
+
+import (
+	"sync"
+	"time"
+)
+
+// OverflowPolicy determines what happens when a message is written
+// to a Conn whose write queue is full.
+type OverflowPolicy uint8
+
+const (
+	// OverflowBlock blocks the writer until there is room in the queue.
+	OverflowBlock OverflowPolicy = 0
+	// OverflowError returns a WRITE_QUEUE_FULL error without queueing
+	// the message.
+	OverflowError OverflowPolicy = 1
+	// OverflowDropOldest discards the oldest queued message to make room
+	// for the new one.
+	OverflowDropOldest OverflowPolicy = 2
+	// OverflowClosePolicyViolation closes the connection with close code
+	// 1008 (policy violation).
+	OverflowClosePolicyViolation OverflowPolicy = 3
+	// OverflowCloseTryAgainLater closes the connection with close code
+	// 1013 (try again later).
+	OverflowCloseTryAgainLater OverflowPolicy = 4
+)
+
+// queuedMessage is a message in a write queue, with the time it was
+// queued at in Unix nanoseconds.
+type queuedMessage struct {
+	message *Message
+	queued  int64
+}
+
+// writeQueue is a bounded FIFO of messages drained by a single goroutine.
+type writeQueue struct {
+	mx       sync.Mutex
+	notEmpty *sync.Cond
+	notFull  *sync.Cond
+
+	messages []queuedMessage
+	inflight int64 // when the message being written was queued, or 0
+	size     int
+	policy   OverflowPolicy
+	closed   bool
+	err      Error
+
+	done chan struct{}
+}
+
+func newWriteQueue(size int, policy OverflowPolicy) *writeQueue {
+	q := &writeQueue{
+		messages: make([]queuedMessage, 0, size),
+		size:     size,
+		policy:   policy,
+		done:     make(chan struct{}),
+	}
+	q.notEmpty = sync.NewCond(&q.mx)
+	q.notFull = sync.NewCond(&q.mx)
+	return q
+}
+
+// push adds a message queued at now, in Unix nanoseconds, to the queue,
+// applying the overflow policy if the queue is full. It reports whether
+// the overflow policy requires the connection to be closed.
+func (q *writeQueue) push(message *Message, now int64) (bool, Error) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	if q.err != nil {
+		return false, q.err
+	}
+	if q.closed {
+		return false, errorf(CONNECTION_CLOSED)
+	}
+
+	if len(q.messages) >= q.size {
+		switch q.policy {
+		case OverflowBlock:
+			for len(q.messages) >= q.size && !q.closed && q.err == nil {
+				q.notFull.Wait()
+			}
+			if q.err != nil {
+				return false, q.err
+			}
+			if q.closed {
+				return false, errorf(CONNECTION_CLOSED)
+			}
+		case OverflowError:
+			return false, errorf(WRITE_QUEUE_FULL)
+		case OverflowDropOldest:
+			q.messages[0] = queuedMessage{}
+			q.messages = q.messages[1:]
+		case OverflowClosePolicyViolation, OverflowCloseTryAgainLater:
+			q.closed = true
+			q.messages = nil
+			q.notEmpty.Broadcast()
+			q.notFull.Broadcast()
+			return true, errorf(CONNECTION_CLOSED)
+		}
+	}
+
+	q.messages = append(q.messages, queuedMessage{message: message, queued: now})
+	q.notEmpty.Signal()
+	return false, nil
+}
+
+// pushClose queues message, a close frame, after the messages already
+// queued, even if the queue is full, and stops the queue from accepting
+// new messages. It reports false if the queue is closed already, such as
+// after an overflow that discarded its messages.
+func (q *writeQueue) pushClose(message *Message, now int64) bool {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	if q.closed {
+		return false
+	}
+	q.messages = append(q.messages, queuedMessage{message: message, queued: now})
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+	return true
+}
+
+// pop removes the oldest message from the queue, blocking until one is
+// available, and marks it as being written until sent is called. It
+// returns nil once the queue is closed and empty.
+func (q *writeQueue) pop() *Message {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	for len(q.messages) == 0 && !q.closed {
+		q.notEmpty.Wait()
+	}
+	if len(q.messages) == 0 {
+		return nil
+	}
+	message := q.messages[0]
+	q.messages[0] = queuedMessage{}
+	q.messages = q.messages[1:]
+	q.inflight = message.queued
+	q.notFull.Signal()
+	return message.message
+}
+
+// sent marks the message returned by pop as written.
+func (q *writeQueue) sent() {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	q.inflight = 0
+}
+
+// oldest returns when the oldest message that is not written yet was
+// queued, in Unix nanoseconds, or 0 if every message is written.
+func (q *writeQueue) oldest() int64 {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	if q.inflight != 0 || len(q.messages) == 0 {
+		return q.inflight
+	}
+	return q.messages[0].queued
+}
+
+// close stops the queue from accepting new messages. Messages that are
+// already queued are still written.
+func (q *writeQueue) close() {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	q.closed = true
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// wait waits for the queue to be drained for at most timeout, and reports
+// whether it was.
+func (q *writeQueue) wait(timeout time.Duration) bool {
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case <-q.done:
+		return true
+	case <-timer.C:
+		return false
+	}
+}
+
+// fail records a write error, discards every queued message, and
+// stops the queue.
+func (q *writeQueue) fail(err Error) {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	q.err = err
+	q.closed = true
+	q.messages = nil
+	q.inflight = 0
+	q.notEmpty.Broadcast()
+	q.notFull.Broadcast()
+}
+
+// len returns the amount of messages waiting in the queue.
+func (q *writeQueue) len() int {
+	q.mx.Lock()
+	defer q.mx.Unlock()
+	return len(q.messages)
+}
+
+// drain writes queued messages to the connection until the queue is
+// closed and empty.
+func (q *writeQueue) drain(c *Conn) {
+	defer close(q.done)
+	for {
+		message := q.pop()
+		if message == nil {
+			return
+		}
+		if err := c.write(message); err != nil {
+			c.logger.Error("an error occured while writing a queued message", "error", err.Error())
+			q.fail(err)
+			go c.fail(err) // Close waits for drain to return
+			return
+		}
+		q.sent()
+	}
+}
+
+// EnableWriteQueue switches the connection to buffered writer mode. Messages
+// passed to Write are placed in a queue holding up to size messages and are
+// written in order by a goroutine owned by the connection, so Write no longer
+// waits for the peer. The policy decides what Write does when the queue is full.
+//
+// Messages passed to Write must not be modified after Write returns. Close
+// writes any messages left in the queue before closing the underlying
+// connection, and gives up on them after one second if the peer does not
+// read them. A close frame written by CloseWithCode, or in response to the
+// peer's, is queued after the messages queued before it, unless the queue
+// overflowed with a policy that closes the connection, which discards the
+// queued messages. Calling EnableWriteQueue more than once has no effect.
+func (c *Conn) EnableWriteQueue(size int, policy OverflowPolicy) {
+	if size < 1 {
+		size = 1
+	}
+	q := newWriteQueue(size, policy)
+	if !c.queue.CompareAndSwap(nil, q) {
+		return
+	}
+	go q.drain(c)
+}
+
+// WriteQueueDepth returns the amount of messages waiting in the write queue.
+// It returns 0 if the write queue is not enabled.
+func (c *Conn) WriteQueueDepth() int {
+	q := c.queue.Load()
+	if q == nil {
+		return 0
+	}
+	return q.len()
+}
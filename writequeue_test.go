@@ -0,0 +1,217 @@
+package websocket_test
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+// waitFor polls cond until it returns true or the timeout is reached.
+func waitFor(t *testing.T, timeout time.Duration, cond func() bool) {
+	t.Helper()
+	deadline := time.Now().Add(timeout)
+	for !cond() {
+		if time.Now().After(deadline) {
+			t.Fatalf("condition not met within %s", timeout)
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+func textMessage(s string) *websocket.Message {
+	return &websocket.Message{Type: websocket.MessageText, Data: []byte(s)}
+}
+
+// stalledQueueConn returns a Conn with its write queue enabled whose peer is not
+// read from. One message is in-flight (blocked on the peer) and the queue is full.
+func stalledQueueConn(t *testing.T, policy websocket.OverflowPolicy) (*websocket.Conn, net.Conn) {
+	t.Helper()
+	server, client := net.Pipe()
+	conn := websocket.From(server)
+	conn.EnableWriteQueue(1, policy)
+
+	if err := conn.Write(textMessage("one")); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+	waitFor(t, time.Second, func() bool { return conn.WriteQueueDepth() == 0 })
+	if err := conn.Write(textMessage("two")); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+	if conn.WriteQueueDepth() != 1 {
+		t.Fatalf("expected queue depth 1, got %d", conn.WriteQueueDepth())
+	}
+	return conn, client
+}
+
+func readTexts(t *testing.T, peer *websocket.Conn, n int) []string {
+	t.Helper()
+	texts := make([]string, 0, n)
+	for range n {
+		msg, err := peer.Read()
+		if err != nil {
+			t.Fatalf("expected no error from Read(), got %v", err)
+		}
+		texts = append(texts, string(msg.Data))
+	}
+	return texts
+}
+
+func TestWriteQueue_Block(t *testing.T) {
+	conn, client := stalledQueueConn(t, websocket.OverflowBlock)
+	defer conn.Close()
+
+	done := make(chan websocket.Error)
+	go func() {
+		done <- conn.Write(textMessage("three"))
+	}()
+	select {
+	case err := <-done:
+		t.Fatalf("expected Write() to block, returned %v", err)
+	case <-time.After(50 * time.Millisecond):
+	}
+
+	texts := readTexts(t, websocket.From(client, websocket.WithRole(websocket.RoleClient)), 3)
+	if err := <-done; err != nil {
+		t.Fatalf("expected no error from blocked Write(), got %v", err)
+	}
+	expected := []string{"one", "two", "three"}
+	for i := range expected {
+		if texts[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, texts)
+		}
+	}
+}
+
+func TestWriteQueue_Error(t *testing.T) {
+	conn, client := stalledQueueConn(t, websocket.OverflowError)
+	defer conn.Close()
+
+	err := conn.Write(textMessage("three"))
+	if err == nil || err.Kind() != websocket.WRITE_QUEUE_FULL {
+		t.Fatalf("expected WRITE_QUEUE_FULL error, got %v", err)
+	}
+
+	texts := readTexts(t, websocket.From(client, websocket.WithRole(websocket.RoleClient)), 2)
+	if texts[0] != "one" || texts[1] != "two" {
+		t.Fatalf("expected [one two], got %v", texts)
+	}
+}
+
+func TestWriteQueue_DropOldest(t *testing.T) {
+	conn, client := stalledQueueConn(t, websocket.OverflowDropOldest)
+	defer conn.Close()
+
+	if err := conn.Write(textMessage("three")); err != nil {
+		t.Fatalf("expected no error from Write(), got %v", err)
+	}
+	if conn.WriteQueueDepth() != 1 {
+		t.Fatalf("expected queue depth 1, got %d", conn.WriteQueueDepth())
+	}
+
+	texts := readTexts(t, websocket.From(client, websocket.WithRole(websocket.RoleClient)), 2)
+	if texts[0] != "one" || texts[1] != "three" {
+		t.Fatalf("expected [one three], got %v", texts)
+	}
+}
+
+func TestWriteQueue_Close(t *testing.T) {
+	policies := []websocket.OverflowPolicy{
+		websocket.OverflowClosePolicyViolation,
+		websocket.OverflowCloseTryAgainLater,
+	}
+	for _, policy := range policies {
+		conn, _ := stalledQueueConn(t, policy)
+
+		err := conn.Write(textMessage("three"))
+		if err == nil || err.Kind() != websocket.CONNECTION_CLOSED {
+			t.Fatalf("expected CONNECTION_CLOSED error, got %v", err)
+		}
+		select {
+		case <-conn.Context().Done():
+		case <-time.After(5 * time.Second):
+			t.Fatalf("expected connection to be closed")
+		}
+		if err := conn.Write(textMessage("four")); err == nil {
+			t.Fatalf("expected an error writing to a closed queue")
+		}
+	}
+}
+
+func TestWriteQueue_FlushOnClose(t *testing.T) {
+	server, client := net.Pipe()
+	conn := websocket.From(server)
+	conn.EnableWriteQueue(8, websocket.OverflowBlock)
+
+	expected := []string{"one", "two", "three", "four"}
+	for _, text := range expected {
+		if err := conn.Write(textMessage(text)); err != nil {
+			t.Fatalf("expected no error from Write(), got %v", err)
+		}
+	}
+
+	received := make(chan []string)
+	go func() {
+		peer := websocket.From(client, websocket.WithRole(websocket.RoleClient))
+		var texts []string
+		for {
+			msg, err := peer.Read()
+			if err != nil {
+				received <- texts
+				return
+			}
+			texts = append(texts, string(msg.Data))
+		}
+	}()
+
+	if err := conn.Close(); err != nil {
+		t.Fatalf("expected no error from Close(), got %v", err)
+	}
+	texts := <-received
+	if len(texts) != len(expected) {
+		t.Fatalf("expected %v, got %v", expected, texts)
+	}
+	for i := range expected {
+		if texts[i] != expected[i] {
+			t.Fatalf("expected %v, got %v", expected, texts)
+		}
+	}
+	if conn.WriteQueueDepth() != 0 {
+		t.Fatalf("expected empty queue after Close(), got %d", conn.WriteQueueDepth())
+	}
+}
+
+func TestWriteQueue_CloseFrameAfterQueued(t *testing.T) {
+	server, client := net.Pipe()
+	conn := websocket.From(server)
+	conn.EnableWriteQueue(8, websocket.OverflowBlock)
+	for _, text := range []string{"one", "two"} {
+		if err := conn.Write(textMessage(text)); err != nil {
+			t.Fatalf("expected no error from Write(), got %v", err)
+		}
+	}
+
+	peer := websocket.From(client, websocket.WithRole(websocket.RoleClient))
+	go conn.CloseWithCode(websocket.CloseGoingAway, "bye")
+	if texts := readTexts(t, peer, 2); texts[0] != "one" || texts[1] != "two" {
+		t.Fatalf("expected the queued messages before the close frame, got %v", texts)
+	}
+	if _, err := peer.Read(); !websocket.IsCloseError(err, websocket.CloseGoingAway) {
+		t.Fatalf("expected the close frame after the queued messages, got %v", err)
+	}
+}
+
+func TestWriteQueue_CloseStalled(t *testing.T) {
+	conn, _ := stalledQueueConn(t, websocket.OverflowBlock)
+	closed := make(chan error, 1)
+	go func() { closed <- conn.Close() }()
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Fatalf("expected Close to give up on the queue when the peer does not read")
+	}
+	if conn.WriteQueueDepth() != 0 {
+		t.Fatalf("expected the queued messages to be discarded, got %d", conn.WriteQueueDepth())
+	}
+}
@@ -0,0 +1,212 @@
+package websocket
+
+import "io"
+
+// NextWriter returns a writer for a text or binary message of the type
+// specified, for writing a message whose length is not known in advance,
+// such as one encoded as it is written, without holding it whole. The
+// message is written in frames of the fragment size (see
+// WithWriteFragmentSize), or of 4KB if none is set, as the writer fills
+// them, and ends once the writer is closed. Data messages written until
+// then, with Write, WriteText, WritePrepared or another writer, wait for
+// the writer to be closed or to fail, but control messages, such as the
+// pings of keepalive, may be written between its frames. The writer must
+// be closed even if writing the message is given up on.
+//
+// If the write queue is enabled, compression was negotiated, the Conn was
+// created with WithLowMemory, or the message is a text message and
+// outgoing text is validated, the message is held whole instead, and
+// written like Write once the writer is closed.
+//
+// The write limit (see SetWriteLimit) applies to the whole message. A
+// Write that would make the message larger than the limit returns a
+// MESSAGE_TOO_LARGE error. If none of the frames of the message was
+// written yet, the connection stays open, as with Write. Otherwise the
+// message cannot be ended, so the connection is failed with
+// CloseMessageTooBig. Once a Write fails, the writer returns its error
+// from then on, and Close does not write anything.
+func (c *Conn) NextWriter(messageType MessageType) (io.WriteCloser, Error) {
+	if err := c.setMode(modeMessage); err != nil {
+		return nil, err
+	}
+	if messageType != MessageText && messageType != MessageBinary {
+		return nil, errorf(UNSUPPORTED_MESSAGE_TYPE, messageType)
+	}
+	if err := c.writable(); err != nil {
+		return nil, err
+	}
+	w := &messageWriter{conn: c, messageType: messageType, frameSize: c.fragmentSize}
+	w.buffered = c.queue.Load() != nil || c.deflater != nil || c.lowMemory ||
+		messageType == MessageText && c.validateText.Load()
+	if w.frameSize == 0 {
+		w.frameSize = smallMessageSize
+	}
+	if !w.buffered {
+		if err := c.lockMessage(); err != nil {
+			return nil, err
+		}
+		w.locked = true
+		w.buf = make([]byte, 0, w.frameSize)
+	}
+	return w, nil
+}
+
+// lockMessage waits for the data message being written, if any, to be
+// written, so that its frames are not interleaved with those of another
+// data message, and holds the message lock until unlockMessage is called.
+// It returns a CONNECTION_CLOSED error if the connection is closed while
+// waiting.
+func (c *Conn) lockMessage() Error {
+	select {
+	case c.messageLock <- struct{}{}:
+		return nil
+	case <-c.ctx.Done():
+		return c.closedError()
+	}
+}
+
+// unlockMessage releases the message lock held since lockMessage.
+func (c *Conn) unlockMessage() {
+	<-c.messageLock
+}
+
+// WriteReader writes a text or binary message of the type specified with
+// the bytes read from r until io.EOF as its payload, with a writer from
+// NextWriter. If r has a Len method, like *bytes.Reader, *bytes.Buffer,
+// and *strings.Reader, a message larger than the write limit is refused
+// before anything is read from r or written, and the connection stays
+// open.
+//
+// If reading from r fails, WriteReader returns a MESSAGE_ABORTED error
+// wrapping the error. If frames of the message were written already, the
+// message cannot be ended, so the connection is failed with
+// CloseInternalServerErr.
+func (c *Conn) WriteReader(messageType MessageType, r io.Reader) Error {
+	if lr, ok := r.(interface{ Len() int }); ok {
+		if err := c.checkWriteLimit(messageType, lr.Len()); err != nil {
+			return err
+		}
+	}
+	wc, err := c.NextWriter(messageType)
+	if err != nil {
+		return err
+	}
+	w := wc.(*messageWriter)
+	if _, err := io.Copy(w, r); err != nil {
+		if w.err == nil { // the error is r's
+			w.abort(errorf(MESSAGE_ABORTED, err), CloseInternalServerErr)
+		}
+		return w.err
+	}
+	if err := w.Close(); err != nil {
+		return err.(Error)
+	}
+	return nil
+}
+
+// messageWriter is the writer returned by Conn.NextWriter.
+type messageWriter struct {
+	conn        *Conn
+	messageType MessageType
+	// whether the message is held whole and written on Close
+	buffered  bool
+	frameSize int
+
+	// the part of the message that was not written yet, the length of
+	// the message so far, and whether its first frame was written
+	buf     []byte
+	n       int64
+	started bool
+	// the error the writer returns, once a Write failed or it was closed
+	err Error
+	// whether the writer holds the message lock, which it does from
+	// NextWriter until it ends, unless it is buffered
+	locked bool
+}
+
+func (w *messageWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if limit := w.conn.writeLimit.Load(); limit > 0 && w.n+int64(len(p)) > limit {
+		w.abort(errorf(MESSAGE_TOO_LARGE, "write", limit), CloseMessageTooBig)
+		return 0, w.err
+	}
+	w.n += int64(len(p))
+	written := 0
+	for !w.buffered && len(w.buf)+len(p)-written > w.frameSize {
+		// the frame is only written once more follows it, so that Close
+		// has a frame to end the message with
+		k := w.frameSize - len(w.buf)
+		w.buf = append(w.buf, p[written:written+k]...)
+		if err := w.writeFrame(false); err != nil {
+			return written, err
+		}
+		written += k
+	}
+	w.buf = append(w.buf, p[written:]...)
+	return len(p), nil
+}
+
+// Close writes the rest of the message and ends it. Closing the writer
+// again returns a WRITER_CLOSED error.
+func (w *messageWriter) Close() error {
+	if w.err != nil {
+		return w.err
+	}
+	if w.buffered {
+		w.end(errorf(WRITER_CLOSED))
+		return w.conn.Write(&Message{Type: w.messageType, Data: w.buf})
+	}
+	if err := w.writeFrame(true); err != nil {
+		return err
+	}
+	w.end(errorf(WRITER_CLOSED))
+	return nil
+}
+
+// end makes the writer return err from then on, and releases the message
+// lock, so that other data messages may be written.
+func (w *messageWriter) end(err Error) {
+	w.err = err
+	if w.locked {
+		w.locked = false
+		w.conn.unlockMessage()
+	}
+}
+
+// writeFrame writes the part of the message held in the buffer as a frame,
+// the last one of the message if fin is set.
+func (w *messageWriter) writeFrame(fin bool) Error {
+	c := w.conn
+	if err := c.writable(); err != nil {
+		w.end(err)
+		return err
+	}
+	messageType := w.messageType
+	if w.started {
+		messageType = MessageContinuation
+	}
+	buf := framePool.Get().(*[]byte)
+	frame := appendFrame(c, (*buf)[:0], fin, messageType.Opcode(), w.buf)
+	err := c.writeFrames(messageType, len(w.buf), frame)
+	putFrameBuffer(buf, frame)
+	w.buf = w.buf[:0]
+	w.started = true
+	if err != nil {
+		w.end(err)
+	}
+	return err
+}
+
+// abort ends the writer with err. If a frame of the message was written
+// already, the connection is failed with the close code specified, since
+// the peer would wait for the rest of the message.
+func (w *messageWriter) abort(err Error, code int) {
+	w.buf = nil
+	if w.started {
+		w.conn.setErr(err)
+		w.conn.closeWithCode(code, "")
+	}
+	w.end(err)
+}
@@ -0,0 +1,241 @@
+package websocket_test
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+
+	"github.com/tiredkangaroo/websocket"
+)
+
+func TestNextWriter(t *testing.T) {
+	client, server := websocket.Pipe(websocket.WithWriteFragmentSize(4))
+	defer client.Close()
+	defer server.Close()
+
+	for _, parts := range [][]string{{"hello, ", "world"}, {"hell", "o"}, {}} {
+		errs := make(chan error, 1)
+		go func() {
+			w, err := client.NextWriter(websocket.MessageText)
+			if err != nil {
+				errs <- err
+				return
+			}
+			for _, part := range parts {
+				if _, err := io.WriteString(w, part); err != nil {
+					errs <- err
+					return
+				}
+			}
+			errs <- w.Close()
+		}()
+		msg, err := server.Read()
+		if err != nil {
+			t.Fatalf("expected no error from Read(), got %v", err)
+		}
+		if err := <-errs; err != nil {
+			t.Fatalf("expected no error writing the message, got %v", err)
+		}
+		if expected := strings.Join(parts, ""); msg.Type != websocket.MessageText || string(msg.Data) != expected {
+			t.Fatalf("expected the text message %q, got %s %q", expected, msg.Type, msg.Data)
+		}
+	}
+	// 3 frames for "hello, world", 2 for "hello", and 1 for the empty message
+	if stats := client.Stats(); stats.FramesWritten != 6 || stats.MessagesWritten.Text != 3 {
+		t.Fatalf("expected 6 frames and 3 messages to be written, got %d frames and %d messages", stats.FramesWritten, stats.MessagesWritten.Text)
+	}
+}
+
+func TestNextWriter_WriteWhileOpen(t *testing.T) {
+	client, server := websocket.Pipe(websocket.WithWriteFragmentSize(2))
+	defer client.Close()
+	defer server.Close()
+
+	messages := make(chan *websocket.Message, 2)
+	go func() {
+		for {
+			msg, err := server.Read()
+			if err != nil {
+				close(messages)
+				return
+			}
+			messages <- msg
+		}
+	}()
+
+	w, err := client.NextWriter(websocket.MessageText)
+	if err != nil {
+		t.Fatalf("expected no error from NextWriter(), got %v", err)
+	}
+	if _, err := io.WriteString(w, "hello"); err != nil { // writes the first frames
+		t.Fatalf("expected no error writing the message, got %v", err)
+	}
+	errs := make(chan error, 1)
+	go func() { errs <- client.WriteText("other") }()
+	select {
+	case err := <-errs:
+		t.Fatalf("expected WriteText() to wait for the open message, got %v", err)
+	case <-time.After(20 * time.Millisecond):
+	}
+	if _, err := io.WriteString(w, ", world"); err != nil {
+		t.Fatalf("expected no error writing the message, got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected no error from Close(), got %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("expected no error from WriteText(), got %v", err)
+	}
+	for _, expected := range []string{"hello, world", "other"} {
+		if msg := <-messages; msg == nil || string(msg.Data) != expected {
+			t.Fatalf("expected the message %q, got %v", expected, msg)
+		}
+	}
+}
+
+func TestNextWriter_Closed(t *testing.T) {
+	conn := websocket.From(&MockNetConn{})
+	w, err := conn.NextWriter(websocket.MessageBinary)
+	if err != nil {
+		t.Fatalf("expected no error from NextWriter(), got %v", err)
+	}
+	if err := w.Close(); err != nil {
+		t.Fatalf("expected no error from Close(), got %v", err)
+	}
+	if _, err := w.Write([]byte("late")); !errors.Is(err, websocket.ErrWriterClosed) {
+		t.Fatalf("expected WRITER_CLOSED error writing to a closed writer, got %v", err)
+	}
+	if _, err := conn.NextWriter(websocket.MessagePing); !errors.Is(err, websocket.ErrUnsupportedMessageType) {
+		t.Fatalf("expected UNSUPPORTED_MESSAGE_TYPE error for a ping, got %v", err)
+	}
+	conn.Close()
+	if _, err := conn.NextWriter(websocket.MessageBinary); !errors.Is(err, websocket.ErrConnectionClosed) {
+		t.Fatalf("expected CONNECTION_CLOSED error from NextWriter() once closed, got %v", err)
+	}
+}
+
+func TestNextWriter_WriteLimit(t *testing.T) {
+	mockConn := &MockNetConn{}
+	conn := websocket.From(mockConn)
+	conn.SetWriteLimit(8)
+
+	w, err := conn.NextWriter(websocket.MessageBinary)
+	if err != nil {
+		t.Fatalf("expected no error from NextWriter(), got %v", err)
+	}
+	if _, err := w.Write([]byte("hello")); err != nil {
+		t.Fatalf("expected no error writing below the limit, got %v", err)
+	}
+	if _, err := w.Write([]byte("world")); !errors.Is(err, websocket.ErrMessageTooLarge) {
+		t.Fatalf("expected MESSAGE_TOO_LARGE error, got %v", err)
+	}
+	if err := w.Close(); !errors.Is(err, websocket.ErrMessageTooLarge) {
+		t.Fatalf("expected MESSAGE_TOO_LARGE error from Close(), got %v", err)
+	}
+	if mockConn.buf.Len() != 0 {
+		t.Fatalf("expected nothing to be written for a message over the limit")
+	}
+	if conn.Closed() {
+		t.Fatalf("expected the connection to stay open")
+	}
+}
+
+func TestNextWriter_WriteLimitStreaming(t *testing.T) {
+	client, server := websocket.Pipe(websocket.WithWriteFragmentSize(4))
+	defer client.Close()
+	defer server.Close()
+	server.SetWriteLimit(6)
+
+	errs := make(chan error, 1)
+	go func() {
+		w, err := server.NextWriter(websocket.MessageBinary)
+		if err != nil {
+			errs <- err
+			return
+		}
+		if _, err := w.Write([]byte("hello")); err != nil { // writes the first frame
+			errs <- err
+			return
+		}
+		_, werr := w.Write([]byte("!!"))
+		errs <- werr
+	}()
+	if _, err := client.Read(); !websocket.IsCloseError(err, websocket.CloseMessageTooBig) {
+		t.Fatalf("expected a close error with code %d, got %v", websocket.CloseMessageTooBig, err)
+	}
+	if err := <-errs; !errors.Is(err, websocket.ErrMessageTooLarge) {
+		t.Fatalf("expected MESSAGE_TOO_LARGE error, got %v", err)
+	}
+	if !errors.Is(server.Err(), websocket.ErrMessageTooLarge) {
+		t.Fatalf("expected the connection to be failed with MESSAGE_TOO_LARGE, got %v", server.Err())
+	}
+}
+
+func TestWriteReader(t *testing.T) {
+	client, server := websocket.Pipe(websocket.WithWriteFragmentSize(4))
+	defer client.Close()
+	defer server.Close()
+
+	errs := make(chan error, 1)
+	go func() {
+		errs <- client.WriteReader(websocket.MessageBinary, iotest.OneByteReader(strings.NewReader("hello, world")))
+	}()
+	msg, err := server.Read()
+	if err != nil {
+		t.Fatalf("expected no error from Read(), got %v", err)
+	}
+	if err := <-errs; err != nil {
+		t.Fatalf("expected no error from WriteReader(), got %v", err)
+	}
+	if msg.Type != websocket.MessageBinary || string(msg.Data) != "hello, world" {
+		t.Fatalf("expected the binary message %q, got %s %q", "hello, world", msg.Type, msg.Data)
+	}
+}
+
+func TestWriteReader_WriteLimit(t *testing.T) {
+	mockConn := &MockNetConn{}
+	conn := websocket.From(mockConn)
+	conn.SetWriteLimit(4)
+
+	r := bytes.NewReader([]byte("hello"))
+	if err := conn.WriteReader(websocket.MessageBinary, r); !errors.Is(err, websocket.ErrMessageTooLarge) {
+		t.Fatalf("expected MESSAGE_TOO_LARGE error, got %v", err)
+	}
+	if r.Len() != 5 || mockConn.buf.Len() != 0 {
+		t.Fatalf("expected nothing to be read or written for a message over the limit")
+	}
+	if conn.Closed() {
+		t.Fatalf("expected the connection to stay open")
+	}
+}
+
+func TestWriteReader_ReadError(t *testing.T) {
+	errRead := errors.New("read failed")
+
+	mockConn := &MockNetConn{}
+	conn := websocket.From(mockConn)
+	if err := conn.WriteReader(websocket.MessageBinary, iotest.ErrReader(errRead)); !errors.Is(err, websocket.ErrMessageAborted) || !errors.Is(err, errRead) {
+		t.Fatalf("expected MESSAGE_ABORTED error wrapping the read error, got %v", err)
+	}
+	if mockConn.buf.Len() != 0 || conn.Closed() {
+		t.Fatalf("expected nothing to be written and the connection to stay open")
+	}
+
+	client, server := websocket.Pipe(websocket.WithWriteFragmentSize(4))
+	defer client.Close()
+	defer server.Close()
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.WriteReader(websocket.MessageBinary, io.MultiReader(strings.NewReader("hello, world"), iotest.ErrReader(errRead)))
+	}()
+	if _, err := client.Read(); !websocket.IsCloseError(err, websocket.CloseInternalServerErr) {
+		t.Fatalf("expected a close error with code %d, got %v", websocket.CloseInternalServerErr, err)
+	}
+	if err := <-errs; !errors.Is(err, websocket.ErrMessageAborted) {
+		t.Fatalf("expected MESSAGE_ABORTED error, got %v", err)
+	}
+}